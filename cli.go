@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/api"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/coordinator"
+	"os"
+	"strings"
+)
+
+// Command is a single (sub)command of the wirefire cli
+type Command struct {
+	Name      string
+	ShortHelp string        // one-line description shown in the parent's usage
+	Usage     string        // usage string, eg. "tailnet create -name <name>"
+	FlagSet   *flag.FlagSet // optional; command specific flags
+
+	Subcommands []*Command
+	Exec        func(ctx context.Context, args []string) error // optional if the command has subcommands
+}
+
+// Run parses the command's flags from args and runs either the subcommand named by the first
+// remaining argument, or the command's Exec function with the remaining arguments.
+func (c *Command) Run(ctx context.Context, args []string) error {
+	if c.FlagSet != nil {
+		c.FlagSet.Usage = func() { c.usage() }
+		if err := c.FlagSet.Parse(args); err != nil {
+			return err
+		}
+		args = c.FlagSet.Args()
+	}
+
+	if len(args) > 0 {
+		for _, sub := range c.Subcommands {
+			if sub.Name == args[0] {
+				return sub.Run(ctx, args[1:])
+			}
+		}
+	}
+
+	if c.Exec == nil {
+		c.usage()
+		if len(args) > 0 {
+			return errors.Errorf("unknown command %q", args[0])
+		}
+		return errors.New("no command specified")
+	}
+
+	return c.Exec(ctx, args)
+}
+
+func (c *Command) usage() {
+	var out = flag.CommandLine.Output()
+	_, _ = fmt.Fprintf(out, "usage: wirefire %s\n", c.Usage)
+
+	if c.FlagSet != nil {
+		_, _ = fmt.Fprintln(out, "\nflags:")
+		c.FlagSet.PrintDefaults()
+	}
+
+	if len(c.Subcommands) > 0 {
+		_, _ = fmt.Fprintln(out, "\ncommands:")
+		for _, sub := range c.Subcommands {
+			_, _ = fmt.Fprintf(out, "  %-12s %s\n", sub.Name, sub.ShortHelp)
+		}
+	}
+}
+
+// client returns a new api.Client for the admin api of the server described by the configuration
+func client() (*api.Client, error) {
+	var cfg = config.Read[coordinator.Config]()
+	if cfg.BaseUrl == nil {
+		return nil, errors.New("server.url is not configured")
+	}
+
+	var apiCfg = config.Read[api.Config]()
+	if apiCfg.Token == "" {
+		return nil, errors.New("api.token is not configured")
+	}
+
+	return &api.Client{BaseUrl: cfg.BaseUrl.JoinPath("/api/v1"), Token: apiCfg.Token}, nil
+}
+
+// call sends a request to the admin api and prints the response to stdout
+func call(ctx context.Context, method, path string, body any) error {
+	c, err := client()
+	if err != nil {
+		return err
+	}
+
+	var out json.RawMessage
+	if err = c.Do(ctx, method, path, body, &out); err != nil {
+		return err
+	}
+
+	return output(out)
+}
+
+// output writes the json value to stdout, indented for readability
+func output(v json.RawMessage) error {
+	var enc = json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// requireArgs returns an error unless exactly n positional arguments, named by names, were passed
+func requireArgs(args []string, names ...string) error {
+	if len(args) != len(names) {
+		return errors.Errorf("expected %d argument(s): %s", len(names), strings.Join(names, " "))
+	}
+	return nil
+}
@@ -0,0 +1,679 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/api"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Root returns the root command of the wirefire cli. Without a command, the server is started (same as serve).
+//
+// All commands, except serve, administer a running server using its admin api. The server's url and the
+// api token are read from the configuration (server.url and api.token).
+func Root() *Command {
+	return &Command{
+		Name:  "wirefire",
+		Usage: "[-config <files>] [-env <name>] <command> [flags]",
+		Subcommands: []*Command{
+			{Name: "serve", ShortHelp: "run the coordination server", Usage: "serve", Exec: Serve},
+			tailnetCommand(),
+			memberCommand(),
+			userCommand(),
+			machineCommand(),
+			authKeyCommand(),
+			aclCommand(),
+			policyCommand(),
+			backupCommand(),
+			migrateHostCommand(),
+			{Name: "versions", ShortHelp: "report the capability versions presented by clients", Usage: "versions", Exec: func(ctx context.Context, _ []string) error {
+				return call(ctx, http.MethodGet, "/versions", nil)
+			}},
+		},
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 0 {
+				return errors.Errorf("unknown command %q", args[0])
+			}
+			return Serve(ctx, args)
+		},
+	}
+}
+
+func tailnetCommand() *Command {
+	var create = flag.NewFlagSet("tailnet create", flag.ExitOnError)
+	var name = create.String("name", "", "unique name of the tailnet")
+
+	var pools = flag.NewFlagSet("tailnet pools", flag.ExitOnError)
+	var ipv4 = pools.String("ipv4", "", "prefix to allocate ipv4 addresses from (default: 100.64.0.0/10)")
+	var ipv6 = pools.String("ipv6", "", "prefix to allocate ipv6 addresses from (default: ipam.ipv6_prefix)")
+	var migrate = pools.Bool("migrate", false, "re-address machines outside the new pools")
+
+	return &Command{
+		Name:      "tailnet",
+		ShortHelp: "manage tailnets",
+		Usage:     "tailnet <command>",
+		Subcommands: []*Command{
+			{
+				Name: "list", ShortHelp: "list all tailnets", Usage: "tailnet list",
+				Exec: func(ctx context.Context, _ []string) error { return call(ctx, http.MethodGet, "/tailnets", nil) },
+			},
+			{
+				Name: "create", ShortHelp: "create a new tailnet", Usage: "tailnet create -name <name>", FlagSet: create,
+				Exec: func(ctx context.Context, _ []string) error {
+					return call(ctx, http.MethodPost, "/tailnets", map[string]any{"name": *name})
+				},
+			},
+			{
+				Name: "pools", ShortHelp: "set the tailnet's address pools", Usage: "tailnet pools [-ipv4 <prefix>] [-ipv6 <prefix>] [-migrate] <tailnet>", FlagSet: pools,
+				Exec: func(ctx context.Context, args []string) error {
+					if err := requireArgs(args, "<tailnet>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPut, "/tailnets/"+args[0]+"/pools", map[string]any{"ipv4": *ipv4, "ipv6": *ipv6, "migrate": *migrate})
+				},
+			},
+			{
+				Name: "delete", ShortHelp: "delete a tailnet and all its machines", Usage: "tailnet delete <tailnet>",
+				Exec: func(ctx context.Context, args []string) error {
+					if err := requireArgs(args, "<tailnet>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodDelete, "/tailnets/"+args[0], nil)
+				},
+			},
+		},
+	}
+}
+
+func memberCommand() *Command {
+	var list = flag.NewFlagSet("member list", flag.ExitOnError)
+	var listTailnet = list.String("tailnet", "", "id of the tailnet")
+
+	var add = flag.NewFlagSet("member add", flag.ExitOnError)
+	var addTailnet = add.String("tailnet", "", "id of the tailnet")
+	var addUser = add.String("user", "", "subject of the user to add")
+	var addRole = add.String("role", "member", "role of the user in the tailnet (owner, admin, auditor or member)")
+
+	var setRole = flag.NewFlagSet("member set-role", flag.ExitOnError)
+	var setRoleTailnet = setRole.String("tailnet", "", "id of the tailnet")
+
+	var remove = flag.NewFlagSet("member remove", flag.ExitOnError)
+	var removeTailnet = remove.String("tailnet", "", "id of the tailnet")
+
+	return &Command{
+		Name:      "member",
+		ShortHelp: "manage tailnet members",
+		Usage:     "member <command>",
+		Subcommands: []*Command{
+			{
+				Name: "list", ShortHelp: "list members of a tailnet", Usage: "member list -tailnet <id>", FlagSet: list,
+				Exec: withTailnet(listTailnet, func(ctx context.Context, tailnet string, _ []string) error {
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/members", tailnet), nil)
+				}),
+			},
+			{
+				Name: "add", ShortHelp: "add a user to a tailnet", Usage: "member add -tailnet <id> -user <subject> [-role <role>]", FlagSet: add,
+				Exec: withTailnet(addTailnet, func(ctx context.Context, tailnet string, _ []string) error {
+					return call(ctx, http.MethodPost, fmt.Sprintf("/tailnets/%s/members", tailnet), map[string]any{"user": *addUser, "role": *addRole})
+				}),
+			},
+			{
+				Name: "set-role", ShortHelp: "change the role of a member; one of owner, admin, auditor or member", Usage: "member set-role -tailnet <id> <user id> <role>", FlagSet: setRole,
+				Exec: withTailnet(setRoleTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<user id>", "<role>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPut, fmt.Sprintf("/tailnets/%s/members/%s", tailnet, args[0]), map[string]any{"role": args[1]})
+				}),
+			},
+			{
+				Name: "roles", ShortHelp: "list the roles members can be assigned", Usage: "member roles",
+				Exec: func(ctx context.Context, _ []string) error {
+					return call(ctx, http.MethodGet, "/roles", nil)
+				},
+			},
+			{
+				Name: "remove", ShortHelp: "remove a user (and their machines) from a tailnet", Usage: "member remove -tailnet <id> <user id>", FlagSet: remove,
+				Exec: withTailnet(removeTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<user id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodDelete, fmt.Sprintf("/tailnets/%s/members/%s", tailnet, args[0]), nil)
+				}),
+			},
+		},
+	}
+}
+
+func userCommand() *Command {
+	var revoke = flag.NewFlagSet("user revoke", flag.ExitOnError)
+	var disableLogin = revoke.Bool("disable-login", false, "also disable the user's future logins")
+
+	return &Command{
+		Name:      "user",
+		ShortHelp: "manage users across all tailnets",
+		Usage:     "user <command>",
+		Subcommands: []*Command{
+			{
+				Name: "revoke", ShortHelp: "expire the keys of all of a user's machines and revoke their auth keys", Usage: "user revoke [-disable-login] <user id>", FlagSet: revoke,
+				Exec: func(ctx context.Context, args []string) error {
+					if err := requireArgs(args, "<user id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPost, fmt.Sprintf("/users/%s/revoke", args[0]), map[string]any{"disable_login": *disableLogin})
+				},
+			},
+			{
+				Name: "enable", ShortHelp: "enable the logins of a user disabled using revoke", Usage: "user enable <user id>",
+				Exec: func(ctx context.Context, args []string) error {
+					if err := requireArgs(args, "<user id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPost, fmt.Sprintf("/users/%s/enable", args[0]), nil)
+				},
+			},
+			{
+				Name: "roles", ShortHelp: "list a user's role in each of their tailnets", Usage: "user roles <user id>",
+				Exec: func(ctx context.Context, args []string) error {
+					if err := requireArgs(args, "<user id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodGet, fmt.Sprintf("/users/%s/roles", args[0]), nil)
+				},
+			},
+		},
+	}
+}
+
+func machineCommand() *Command {
+	var list = flag.NewFlagSet("machine list", flag.ExitOnError)
+	var listTailnet = list.String("tailnet", "", "id of the tailnet")
+
+	var remove = flag.NewFlagSet("machine delete", flag.ExitOnError)
+	var removeTailnet = remove.String("tailnet", "", "id of the tailnet")
+
+	var rename = flag.NewFlagSet("machine rename", flag.ExitOnError)
+	var renameTailnet = rename.String("tailnet", "", "id of the tailnet")
+
+	var routes = flag.NewFlagSet("machine routes", flag.ExitOnError)
+	var routesTailnet = routes.String("tailnet", "", "id of the tailnet")
+
+	var approve = flag.NewFlagSet("machine approve-routes", flag.ExitOnError)
+	var approveTailnet = approve.String("tailnet", "", "id of the tailnet")
+
+	var site = flag.NewFlagSet("machine set-site", flag.ExitOnError)
+	var siteTailnet = site.String("tailnet", "", "id of the tailnet")
+
+	var export = flag.NewFlagSet("machine export", flag.ExitOnError)
+	var exportTailnet = export.String("tailnet", "", "id of the tailnet")
+
+	var adopt = flag.NewFlagSet("machine import", flag.ExitOnError)
+	var importTailnet = adopt.String("tailnet", "", "id of the tailnet")
+	var importUser = adopt.Int("user", 0, "id of the user to own the machine; defaults to the machine's owner on the other coordinator")
+
+	var authorize = flag.NewFlagSet("machine authorize", flag.ExitOnError)
+	var authorizeTailnet = authorize.String("tailnet", "", "id of the tailnet")
+	var authorizeRevoke = authorize.Bool("revoke", false, "revoke the machine's approval instead")
+
+	var health = flag.NewFlagSet("machine health", flag.ExitOnError)
+	var healthTailnet = health.String("tailnet", "", "id of the tailnet")
+
+	var sessions = flag.NewFlagSet("machine ssh-sessions", flag.ExitOnError)
+	var sessionsTailnet = sessions.String("tailnet", "", "id of the tailnet")
+	var sessionsLimit = sessions.Int("limit", 100, "maximum number of events to list")
+
+	var uptime = flag.NewFlagSet("machine uptime", flag.ExitOnError)
+	var uptimeTailnet = uptime.String("tailnet", "", "id of the tailnet")
+	var uptimeWindow = uptime.String("window", "24h", "window to report uptime over, eg. 720h")
+
+	var path = flag.NewFlagSet("machine path", flag.ExitOnError)
+	var pathTailnet = path.String("tailnet", "", "id of the tailnet")
+
+	var exitNodes = flag.NewFlagSet("machine exit-nodes", flag.ExitOnError)
+	var exitNodesTailnet = exitNodes.String("tailnet", "", "id of the tailnet")
+
+	var expire = flag.NewFlagSet("machine expire", flag.ExitOnError)
+	var expireTailnet = expire.String("tailnet", "", "id of the tailnet")
+
+	var renew = flag.NewFlagSet("machine renew", flag.ExitOnError)
+	var renewTailnet = renew.String("tailnet", "", "id of the tailnet")
+	var renewExpiry = renew.String("expiry", "", "duration after which the key expires, eg. 720h; defaults to the configured key expiry, 0 disables expiry")
+
+	return &Command{
+		Name:      "machine",
+		ShortHelp: "manage machines",
+		Usage:     "machine <command>",
+		Subcommands: []*Command{
+			{
+				Name: "list", ShortHelp: "list machines in a tailnet", Usage: "machine list -tailnet <id>", FlagSet: list,
+				Exec: withTailnet(listTailnet, func(ctx context.Context, tailnet string, _ []string) error {
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/machines", tailnet), nil)
+				}),
+			},
+			{
+				Name: "delete", ShortHelp: "delete a machine", Usage: "machine delete -tailnet <id> <machine id>", FlagSet: remove,
+				Exec: withTailnet(removeTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodDelete, fmt.Sprintf("/tailnets/%s/machines/%s", tailnet, args[0]), nil)
+				}),
+			},
+			{
+				Name: "rename", ShortHelp: "give a machine a name, distinct from its hostname; an empty name reverts to the hostname", Usage: "machine rename -tailnet <id> <machine id> <name>", FlagSet: rename,
+				Exec: withTailnet(renameTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>", "<name>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPatch, fmt.Sprintf("/tailnets/%s/machines/%s", tailnet, args[0]), map[string]any{"name": args[1]})
+				}),
+			},
+			{
+				Name: "routes", ShortHelp: "list subnet routes advertised by a machine", Usage: "machine routes -tailnet <id> <machine id>", FlagSet: routes,
+				Exec: withTailnet(routesTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/machines/%s/routes", tailnet, args[0]), nil)
+				}),
+			},
+			{
+				Name: "approve-routes", ShortHelp: "set the approved subnet routes of a machine", Usage: "machine approve-routes -tailnet <id> <machine id> <comma-separated routes>", FlagSet: approve,
+				Exec: withTailnet(approveTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>", "<comma-separated routes>"); err != nil {
+						return err
+					}
+
+					var approved = make([]string, 0)
+					if args[1] != "" {
+						approved = strings.Split(args[1], ",")
+					}
+
+					return call(ctx, http.MethodPut, fmt.Sprintf("/tailnets/%s/machines/%s/routes", tailnet, args[0]), map[string]any{"approved": approved})
+				}),
+			},
+			{
+				Name: "set-site", ShortHelp: "assign a machine to a site; machines at different sites are relayed over derp, an empty site removes it from its site", Usage: "machine set-site -tailnet <id> <machine id> <site>", FlagSet: site,
+				Exec: withTailnet(siteTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>", "<site>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPut, fmt.Sprintf("/tailnets/%s/machines/%s/site", tailnet, args[0]), map[string]any{"site": args[1]})
+				}),
+			},
+			{
+				Name: "export", ShortHelp: "export a machine's sealed identity, to import it into another coordinator", Usage: "machine export -tailnet <id> <machine id>", FlagSet: export,
+				Exec: withTailnet(exportTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPost, fmt.Sprintf("/tailnets/%s/machines/%s/export", tailnet, args[0]), nil)
+				}),
+			},
+			{
+				Name: "import", ShortHelp: "import a machine exported from another coordinator, keeping its keys and addresses", Usage: "machine import -tailnet <id> [-user <id>] <identity>", FlagSet: adopt,
+				Exec: withTailnet(importTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<identity>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPost, fmt.Sprintf("/tailnets/%s/machines/import", tailnet), map[string]any{"identity": args[0], "user": *importUser})
+				}),
+			},
+			{
+				Name: "authorize", ShortHelp: "approve a machine in a tailnet that requires device approval", Usage: "machine authorize -tailnet <id> [-revoke] <machine id>", FlagSet: authorize,
+				Exec: withTailnet(authorizeTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPut, fmt.Sprintf("/tailnets/%s/machines/%s/authorized", tailnet, args[0]), map[string]any{"authorized": !*authorizeRevoke})
+				}),
+			},
+			{
+				Name: "health", ShortHelp: "list health warnings reported by machines", Usage: "machine health -tailnet <id> [<machine id>]", FlagSet: health,
+				Exec: withTailnet(healthTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if len(args) > 0 {
+						return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/machines/%s/health", tailnet, args[0]), nil)
+					}
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/health", tailnet), nil)
+				}),
+			},
+			{
+				Name: "ssh-sessions", ShortHelp: "list tailscale ssh session events, newest first", Usage: "machine ssh-sessions -tailnet <id> [-limit <n>] [<machine id>]", FlagSet: sessions,
+				Exec: withTailnet(sessionsTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if len(args) > 0 {
+						return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/machines/%s/ssh-sessions?limit=%d", tailnet, args[0], *sessionsLimit), nil)
+					}
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/ssh-sessions?limit=%d", tailnet, *sessionsLimit), nil)
+				}),
+			},
+			{
+				Name: "uptime", ShortHelp: "report a machine's online / offline history", Usage: "machine uptime -tailnet <id> [-window <duration>] <machine id>", FlagSet: uptime,
+				Exec: withTailnet(uptimeTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/machines/%s/uptime?window=%s", tailnet, args[0], url.QueryEscape(*uptimeWindow)), nil)
+				}),
+			},
+			{
+				Name: "path", ShortHelp: "diagnose the connection path between two machines", Usage: "machine path -tailnet <id> <machine id> <peer id>", FlagSet: path,
+				Exec: withTailnet(pathTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>", "<peer id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/machines/%s/path/%s", tailnet, args[0], args[1]), nil)
+				}),
+			},
+			{
+				Name: "exit-nodes", ShortHelp: "list exit nodes and the machines using them", Usage: "machine exit-nodes -tailnet <id>", FlagSet: exitNodes,
+				Exec: withTailnet(exitNodesTailnet, func(ctx context.Context, tailnet string, _ []string) error {
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/exit-nodes", tailnet), nil)
+				}),
+			},
+			{
+				Name: "expire", ShortHelp: "expire a machine's key, forcing it to re-authenticate", Usage: "machine expire -tailnet <id> <machine id>", FlagSet: expire,
+				Exec: withTailnet(expireTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPost, fmt.Sprintf("/tailnets/%s/machines/%s/expire", tailnet, args[0]), nil)
+				}),
+			},
+			{
+				Name: "renew", ShortHelp: "extend a machine's key expiry", Usage: "machine renew -tailnet <id> [-expiry <duration>] <machine id>", FlagSet: renew,
+				Exec: withTailnet(renewTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<machine id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodPost, fmt.Sprintf("/tailnets/%s/machines/%s/renew", tailnet, args[0]), map[string]any{"expiry": *renewExpiry})
+				}),
+			},
+		},
+	}
+}
+
+func authKeyCommand() *Command {
+	var list = flag.NewFlagSet("authkey list", flag.ExitOnError)
+	var listTailnet = list.String("tailnet", "", "id of the tailnet")
+
+	var create = flag.NewFlagSet("authkey create", flag.ExitOnError)
+	var createTailnet = create.String("tailnet", "", "id of the tailnet")
+	var user = create.String("user", "", "subject of the user that owns machines registered with the key")
+	var description = create.String("description", "", "description of the key")
+	var reusable = create.Bool("reusable", false, "allow the key to register more than one machine")
+	var ephemeral = create.Bool("ephemeral", false, "register machines as ephemeral")
+	var tags = create.String("tags", "", "comma-separated list of tags applied to registered machines, eg. tag:server")
+	var expiry = create.String("expiry", "", "duration after which the key expires, eg. 24h; the key never expires if empty")
+
+	var revoke = flag.NewFlagSet("authkey revoke", flag.ExitOnError)
+	var revokeTailnet = revoke.String("tailnet", "", "id of the tailnet")
+
+	return &Command{
+		Name:      "authkey",
+		ShortHelp: "manage auth keys",
+		Usage:     "authkey <command>",
+		Subcommands: []*Command{
+			{
+				Name: "list", ShortHelp: "list auth keys in a tailnet", Usage: "authkey list -tailnet <id>", FlagSet: list,
+				Exec: withTailnet(listTailnet, func(ctx context.Context, tailnet string, _ []string) error {
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/keys", tailnet), nil)
+				}),
+			},
+			{
+				Name: "create", ShortHelp: "create a new auth key", Usage: "authkey create -tailnet <id> -user <subject> [flags]", FlagSet: create,
+				Exec: withTailnet(createTailnet, func(ctx context.Context, tailnet string, _ []string) error {
+					var body = map[string]any{"user": *user, "description": *description, "reusable": *reusable, "ephemeral": *ephemeral, "expiry": *expiry}
+					if *tags != "" {
+						body["tags"] = strings.Split(*tags, ",")
+					}
+					return call(ctx, http.MethodPost, fmt.Sprintf("/tailnets/%s/keys", tailnet), body)
+				}),
+			},
+			{
+				Name: "revoke", ShortHelp: "revoke an auth key", Usage: "authkey revoke -tailnet <id> <key id>", FlagSet: revoke,
+				Exec: withTailnet(revokeTailnet, func(ctx context.Context, tailnet string, args []string) error {
+					if err := requireArgs(args, "<key id>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodDelete, fmt.Sprintf("/tailnets/%s/keys/%s", tailnet, args[0]), nil)
+				}),
+			},
+		},
+	}
+}
+
+func aclCommand() *Command {
+	var get = flag.NewFlagSet("acl get", flag.ExitOnError)
+	var getTailnet = get.String("tailnet", "", "id of the tailnet")
+
+	var set = flag.NewFlagSet("acl set", flag.ExitOnError)
+	var setTailnet = set.String("tailnet", "", "id of the tailnet")
+	var file = set.String("file", "", "path to the policy file; reads from stdin if empty")
+
+	var history = flag.NewFlagSet("acl history", flag.ExitOnError)
+	var historyTailnet = history.String("tailnet", "", "id of the tailnet")
+
+	var test = flag.NewFlagSet("acl test", flag.ExitOnError)
+	var testTailnet = test.String("tailnet", "", "id of the tailnet")
+	var testFile = test.String("file", "", "path to the policy file to test; tests the current policy if empty")
+
+	var imp = flag.NewFlagSet("acl import", flag.ExitOnError)
+	var impTailnet = imp.String("tailnet", "", "id of the tailnet to apply the converted policy to; only prints it if empty")
+	var impFile = imp.String("file", "", "path to the policy file exported from tailscale; reads from stdin if empty")
+
+	return &Command{
+		Name:      "acl",
+		ShortHelp: "manage a tailnet's acl policy",
+		Usage:     "acl <command>",
+		Subcommands: []*Command{
+			{
+				Name: "get", ShortHelp: "print the acl policy", Usage: "acl get -tailnet <id>", FlagSet: get,
+				Exec: withTailnet(getTailnet, func(ctx context.Context, tailnet string, _ []string) error {
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/acl", tailnet), nil)
+				}),
+			},
+			{
+				Name: "set", ShortHelp: "replace the acl policy", Usage: "acl set -tailnet <id> [-file <policy.json>]", FlagSet: set,
+				Exec: withTailnet(setTailnet, func(ctx context.Context, tailnet string, _ []string) (err error) {
+					var policy []byte
+					if *file == "" {
+						policy, err = io.ReadAll(os.Stdin)
+					} else {
+						policy, err = os.ReadFile(*file)
+					}
+
+					if err != nil {
+						return err
+					}
+
+					return call(ctx, http.MethodPut, fmt.Sprintf("/tailnets/%s/acl", tailnet), policy)
+				}),
+			},
+			{
+				Name: "history", ShortHelp: "list past revisions of the acl policy", Usage: "acl history -tailnet <id>", FlagSet: history,
+				Exec: withTailnet(historyTailnet, func(ctx context.Context, tailnet string, _ []string) error {
+					return call(ctx, http.MethodGet, fmt.Sprintf("/tailnets/%s/acl/history", tailnet), nil)
+				}),
+			},
+			{
+				Name: "test", ShortHelp: "run the tests declared in an acl policy", Usage: "acl test -tailnet <id> [-file <policy.json>]", FlagSet: test,
+				Exec: withTailnet(testTailnet, func(ctx context.Context, tailnet string, _ []string) error {
+					var policy []byte
+					if *testFile != "" {
+						var err error
+						if policy, err = os.ReadFile(*testFile); err != nil {
+							return err
+						}
+					}
+
+					return call(ctx, http.MethodPost, fmt.Sprintf("/tailnets/%s/acl/test", tailnet), map[string]any{"policy": string(policy)})
+				}),
+			},
+			{
+				Name: "import", ShortHelp: "convert a policy file exported from tailscale's admin console", Usage: "acl import [-tailnet <id>] [-file <policy.hujson>]", FlagSet: imp,
+				Exec: func(ctx context.Context, _ []string) (err error) {
+					var policy []byte
+					if *impFile == "" {
+						policy, err = io.ReadAll(os.Stdin)
+					} else {
+						policy, err = os.ReadFile(*impFile)
+					}
+
+					if err != nil {
+						return err
+					}
+
+					var unsupported []string
+					if policy, unsupported, err = domain.ImportPolicy(policy); err != nil {
+						return err
+					}
+
+					for _, u := range unsupported {
+						_, _ = fmt.Fprintln(os.Stderr, "dropped:", u)
+					}
+
+					if *impTailnet == "" {
+						return output(policy)
+					}
+
+					return call(ctx, http.MethodPut, fmt.Sprintf("/tailnets/%s/acl", *impTailnet), policy)
+				},
+			},
+		},
+	}
+}
+
+func policyCommand() *Command {
+	var set = flag.NewFlagSet("policy set", flag.ExitOnError)
+	var file = set.String("file", "", "path to the policy file; reads from stdin if empty")
+
+	return &Command{
+		Name:      "policy",
+		ShortHelp: "manage shared acl policies included by tailnets' policies",
+		Usage:     "policy <command>",
+		Subcommands: []*Command{
+			{
+				Name: "list", ShortHelp: "list all shared policies", Usage: "policy list",
+				Exec: func(ctx context.Context, _ []string) error { return call(ctx, http.MethodGet, "/policies", nil) },
+			},
+			{
+				Name: "get", ShortHelp: "print a shared policy", Usage: "policy get <name>",
+				Exec: func(ctx context.Context, args []string) error {
+					if err := requireArgs(args, "<name>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodGet, "/policies/"+args[0], nil)
+				},
+			},
+			{
+				Name: "set", ShortHelp: "create or replace a shared policy", Usage: "policy set [-file <policy.json>] <name>", FlagSet: set,
+				Exec: func(ctx context.Context, args []string) (err error) {
+					if err = requireArgs(args, "<name>"); err != nil {
+						return err
+					}
+
+					var policy []byte
+					if *file == "" {
+						policy, err = io.ReadAll(os.Stdin)
+					} else {
+						policy, err = os.ReadFile(*file)
+					}
+
+					if err != nil {
+						return err
+					}
+
+					return call(ctx, http.MethodPut, "/policies/"+args[0], policy)
+				},
+			},
+			{
+				Name: "delete", ShortHelp: "delete a shared policy that's no longer included", Usage: "policy delete <name>",
+				Exec: func(ctx context.Context, args []string) error {
+					if err := requireArgs(args, "<name>"); err != nil {
+						return err
+					}
+					return call(ctx, http.MethodDelete, "/policies/"+args[0], nil)
+				},
+			},
+		},
+	}
+}
+
+func backupCommand() *Command {
+	var fs = flag.NewFlagSet("backup", flag.ExitOnError)
+	var name = fs.String("name", "", "file name of the backup, created in database.backup_dir; defaults to one based on the current time")
+
+	return &Command{
+		Name: "backup", ShortHelp: "backup the database of a running server", Usage: "backup [-name <file>]", FlagSet: fs,
+		Exec: func(ctx context.Context, _ []string) error {
+			return call(ctx, http.MethodPost, "/backup", map[string]string{"name": *name})
+		},
+	}
+}
+
+func migrateHostCommand() *Command {
+	var fs = flag.NewFlagSet("migrate-host", flag.ExitOnError)
+	var name = fs.String("name", "", "file name of the copy, created in database.backup_dir; defaults to one based on the current time")
+
+	return &Command{
+		Name: "migrate-host", ShortHelp: "copy the database of a running server, to move the server to a new host", Usage: "migrate-host [-name <file>]", FlagSet: fs,
+		Exec: func(ctx context.Context, _ []string) (err error) {
+			var c *api.Client
+			if c, err = client(); err != nil {
+				return err
+			}
+
+			var maintenance struct {
+				Value bool `json:"value"`
+			}
+			if err = c.Do(ctx, http.MethodGet, "/settings/maintenance_mode", nil, &maintenance); err != nil {
+				return err
+			}
+
+			// pause registrations, so that no machine joins the tailnet after the copy is made, and is lost in the cutover
+			if err = c.Do(ctx, http.MethodPut, "/settings/maintenance_mode", []byte("true"), nil); err != nil {
+				return errors.Wrap(err, "failed to enable maintenance mode")
+			}
+
+			var backup api.Backup
+			if err = c.Do(ctx, http.MethodPost, "/backup", map[string]any{"name": *name, "verify": true}, &backup); err != nil {
+				if !maintenance.Value {
+					_ = c.Do(ctx, http.MethodPut, "/settings/maintenance_mode", []byte("false"), nil)
+				}
+				return errors.Wrap(err, "failed to copy the database")
+			}
+
+			_, err = fmt.Fprintf(os.Stdout, `Copied and verified the database to %[1]s (%[2]d bytes) in %[3]s. Registrations are paused (maintenance mode).
+
+To move the server to the new host:
+
+  1. Copy %[1]s to the new host, eg. scp %[1]s new-host:/var/lib/wirefire/wirefire.db
+  2. Configure the server on the new host the same as this one (noise.private_key in particular), with database.url set to the copy.
+  3. Stop the server on this host. Changes made since the copy are lost; clients re-report their endpoints and
+     host info once they reconnect, but run migrate-host again if settings or tailnets were changed in the meantime.
+  4. Start the server on the new host, and point the dns record (or load balancer) of server.url at it.
+  5. Resume registrations on the new host, eg.
+     curl -X DELETE -H "Authorization: Bearer $TOKEN" <server.url>/api/v1/settings/maintenance_mode
+`, backup.Path, backup.Size, backup.Duration)
+
+			return err
+		},
+	}
+}
+
+// withTailnet wraps a command's Exec function that requires the -tailnet flag, which must be non-empty
+func withTailnet(id *string, fn func(ctx context.Context, tailnet string, args []string) error) func(context.Context, []string) error {
+	return func(ctx context.Context, args []string) error {
+		if *id == "" {
+			return errors.New("-tailnet is required")
+		}
+		return fn(ctx, *id, args)
+	}
+}
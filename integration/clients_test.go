@@ -0,0 +1,105 @@
+//go:build integration
+
+package integration
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	allowAll = `{"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}]}`
+	denyAll  = `{"acls": []}`
+)
+
+// TestClients registers a pair of clients of each version, and verifies that they can see and reach each
+// other, that the acl policy is enforced, and that magic dns names are assigned.
+func TestClients(t *testing.T) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is required to run the integration tests")
+	}
+
+	var srv = startServer(t)
+
+	var tailnet struct {
+		ID int `json:"id"`
+	}
+	do(t, srv, http.MethodPost, "/tailnets", map[string]any{"name": "integration"}, &tailnet)
+	do(t, srv, http.MethodPost, fmt.Sprintf("/tailnets/%d/members", tailnet.ID), map[string]any{"user": "integration@example.com"}, nil)
+
+	var authKey struct {
+		Key string `json:"key"`
+	}
+	do(t, srv, http.MethodPost, fmt.Sprintf("/tailnets/%d/keys", tailnet.ID), map[string]any{"user": "integration@example.com", "reusable": true}, &authKey)
+
+	var policy = func(t *testing.T, acl string) {
+		t.Helper()
+		do(t, srv, http.MethodPut, fmt.Sprintf("/tailnets/%d/acl", tailnet.ID), []byte(acl), nil)
+	}
+
+	for _, version := range versions() {
+		t.Run(version, func(t *testing.T) {
+			var suffix = strings.ReplaceAll(version, ".", "-")
+			var a = startClient(t, srv, version, "alpha-"+suffix, authKey.Key)
+			var b = startClient(t, srv, version, "bravo-"+suffix, authKey.Key)
+
+			policy(t, allowAll)
+
+			t.Run("Map", func(t *testing.T) {
+				eventually(t, 30*time.Second, func() error {
+					status, err := a.Status()
+					if err != nil {
+						return err
+					}
+
+					for _, peer := range status.Peer {
+						if strings.HasPrefix(peer.HostName, "bravo-"+suffix) {
+							return nil
+						}
+					}
+
+					return fmt.Errorf("peer bravo-%s not found in netmap", suffix)
+				})
+			})
+
+			t.Run("MagicDNS", func(t *testing.T) {
+				status, err := b.Status()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if want := "bravo-" + suffix + ".integration.wirefire.net."; status.Self.DNSName != want {
+					t.Errorf("unexpected dns name %q; want %q", status.Self.DNSName, want)
+				}
+
+				if status.CurrentTailnet == nil || !status.CurrentTailnet.MagicDNSEnabled {
+					t.Errorf("magic dns is not enabled")
+				}
+			})
+
+			t.Run("ACL", func(t *testing.T) {
+				status, err := b.Status()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var ip = status.Self.TailscaleIPs[0].String()
+				eventually(t, 30*time.Second, func() error { return a.Ping(ip) })
+
+				policy(t, denyAll)
+				defer policy(t, allowAll)
+
+				eventually(t, 30*time.Second, func() error {
+					if err := a.Ping(ip); err == nil {
+						return fmt.Errorf("ping succeeded despite deny-all policy")
+					}
+					return nil
+				})
+			})
+		})
+	}
+}
@@ -0,0 +1,11 @@
+// Package integration contains end-to-end tests that run real tailscale clients against a wirefire
+// server, guarding against protocol drift as the tailscale.com dependency (and supported clients) are updated.
+//
+// The tests are behind the integration build tag, and require docker to run the clients in containers:
+//
+//	go test -tags integration ./integration -v
+//
+// By default, the tests run against a few client versions, starting with the oldest supported one.
+// Set WIREFIRE_TEST_TAILSCALE_VERSIONS to a comma-separated list of versions to test against others.
+// Each version must be available as a tag of the tailscale/tailscale docker image.
+package integration
@@ -0,0 +1,249 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/riyaz-ali/wirefire/internal/api"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"testing"
+	"time"
+)
+
+// defaultVersions are the tailscale client versions tested by default; the first one is the oldest supported version
+var defaultVersions = []string{"1.48.0", "1.62.0", "1.76.3"}
+
+// versions returns the list of tailscale client versions to test against
+func versions() []string {
+	if v := os.Getenv("WIREFIRE_TEST_TAILSCALE_VERSIONS"); v != "" {
+		return strings.Split(v, ",")
+	}
+	return defaultVersions
+}
+
+// server is a wirefire instance started for the tests
+type server struct {
+	URL *url.URL
+	API *api.Client
+}
+
+// startServer builds and starts a new wirefire server, backed by a fresh database in a temporary directory.
+// The server is stopped when the test completes.
+func startServer(t *testing.T) *server {
+	t.Helper()
+
+	var dir = t.TempDir()
+
+	var bin = filepath.Join(dir, "wirefire")
+	if out, err := exec.Command("go", "build", "-o", bin, "github.com/riyaz-ali/wirefire").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build wirefire: %v\n%s", err, out)
+	}
+
+	var addr = freeAddr(t)
+	var base = &url.URL{Scheme: "http", Host: addr}
+
+	noiseKey, _ := key.NewMachine().MarshalText()
+	var token = "integration-test-token"
+
+	var cfg = fmt.Sprintf(`
+noise:
+  private_key: %s
+server:
+  url: %s
+  listen_addr: %s
+database:
+  url: file:%s
+api:
+  token: %s
+oidc:
+  provider: %s
+  client_id: wirefire
+  client_secret: secret
+log:
+  level: debug
+`, noiseKey, base, addr, filepath.Join(dir, "wirefire.db"), token, fakeIssuer(t))
+
+	var config = filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(config, []byte(cfg), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	var logs bytes.Buffer
+	var cmd = exec.Command(bin, "-config", config, "serve")
+	cmd.Stdout, cmd.Stderr = &logs, &logs
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start wirefire: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+
+		if t.Failed() {
+			t.Logf("wirefire logs:\n%s", logs.String())
+		}
+	})
+
+	eventually(t, 30*time.Second, func() error {
+		res, err := http.Get(base.JoinPath("/key").String() + "?v=" + "100")
+		if err != nil {
+			return err
+		}
+		_ = res.Body.Close()
+		return nil
+	})
+
+	return &server{URL: base, API: &api.Client{BaseUrl: base.JoinPath("/api/v1"), Token: token}}
+}
+
+// fakeIssuer starts a minimal oidc provider that only serves the discovery document. It's required for the server
+// to start, but never used as the tests register machines using auth keys.
+func fakeIssuer(t *testing.T) string {
+	t.Helper()
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"issuer":                                srv.URL,
+				"authorization_endpoint":                srv.URL + "/authorize",
+				"token_endpoint":                        srv.URL + "/token",
+				"jwks_uri":                              srv.URL + "/jwks",
+				"id_token_signing_alg_values_supported": []string{"RS256"},
+			})
+		case "/jwks":
+			_, _ = w.Write([]byte(`{"keys":[]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// freeAddr returns a free, local tcp address to listen on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	return l.Addr().String()
+}
+
+// client is a tailscale client, running in a docker container
+type client struct {
+	Name string
+}
+
+// startClient starts a new tailscale client of the given version in a container, and registers it with the
+// server using the auth key. The client runs in userspace networking mode, so that no extra privileges are required.
+// The container shares the host's network to reach the server. It's removed when the test completes.
+func startClient(t *testing.T, srv *server, version, hostname, authKey string) *client {
+	t.Helper()
+
+	var name = fmt.Sprintf("wirefire-it-%s-%d", hostname, time.Now().UnixNano())
+	var args = []string{"run", "--detach", "--rm", "--name", name, "--network", "host",
+		"--env", "TS_AUTHKEY=" + authKey,
+		"--env", "TS_HOSTNAME=" + hostname,
+		"--env", "TS_USERSPACE=true",
+		"--env", "TS_STATE_DIR=/var/lib/tailscale",
+		"--env", "TS_EXTRA_ARGS=--login-server=" + srv.URL.String(),
+		"tailscale/tailscale:v" + version,
+	}
+
+	if out, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+		t.Fatalf("failed to start tailscale %s: %v\n%s", version, err, out)
+	}
+
+	t.Cleanup(func() {
+		if t.Failed() {
+			out, _ := exec.Command("docker", "logs", name).CombinedOutput()
+			t.Logf("logs for %s:\n%s", name, out)
+		}
+		_ = exec.Command("docker", "rm", "--force", name).Run()
+	})
+
+	var c = &client{Name: name}
+	eventually(t, time.Minute, func() error {
+		status, err := c.Status()
+		if err != nil {
+			return err
+		} else if status.BackendState != "Running" {
+			return fmt.Errorf("backend is %s", status.BackendState)
+		}
+		return nil
+	})
+
+	return c
+}
+
+// Exec runs the tailscale cli inside the client's container
+func (c *client) Exec(args ...string) ([]byte, error) {
+	return exec.Command("docker", append([]string{"exec", c.Name, "tailscale"}, args...)...).CombinedOutput()
+}
+
+// Status returns the client's status, as reported by tailscale status --json
+func (c *client) Status() (*ipnstate.Status, error) {
+	out, err := c.Exec("status", "--json")
+	if err != nil {
+		return nil, fmt.Errorf("tailscale status: %v: %s", err, out)
+	}
+
+	var status ipnstate.Status
+	if err = json.Unmarshal(out, &status); err != nil {
+		return nil, err
+	}
+
+	return &status, nil
+}
+
+// Ping sends icmp pings to the given tailscale ip, and returns an error if there was no reply.
+// Unlike disco pings, icmp pings are subject to the packet filter.
+func (c *client) Ping(ip string) error {
+	if out, err := c.Exec("ping", "--icmp", "--c", "3", "--timeout", "3s", ip); err != nil {
+		return fmt.Errorf("tailscale ping: %v: %s", err, out)
+	}
+	return nil
+}
+
+// do sends a request to the server's admin api, failing the test on error
+func do(t *testing.T, srv *server, method, path string, body, out any) {
+	t.Helper()
+
+	if err := srv.API.Do(context.Background(), method, path, body, out); err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+}
+
+// eventually calls fn until it succeeds, failing the test if it doesn't within the timeout
+func eventually(t *testing.T, timeout time.Duration, fn func() error) {
+	t.Helper()
+
+	var err error
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(time.Second) {
+		if err = fn(); err == nil {
+			return
+		}
+	}
+
+	t.Fatalf("condition not met within %s: %v", timeout, err)
+}
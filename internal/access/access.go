@@ -0,0 +1,114 @@
+// Package access implements the middleware that restricts access to wirefire's public, unauthenticated endpoints
+// (eg. /key), for deployments that must not expose any unauthenticated surface. Endpoints are open by default.
+//
+// Access is configured per endpoint, under http.access.<name>, using an ip allowlist and / or a shared token, eg.
+//
+//	http:
+//	  access:
+//	    key:
+//	      allowed_ips: [ "10.0.0.0/8", "2001:db8::/32", "192.0.2.1" ]
+//	    derp:
+//	      token: "s3cr3t"
+//
+// A request must pass all the checks configured for the endpoint. The client's address is resolved as for the rest of
+// wirefire, honouring forwarding headers sent by trusted proxies only (see: proxy.Trusted). Tailscale clients can't send a token themselves,
+// and so token protected endpoints must be fronted by a proxy that adds it (as an Authorization: Bearer header).
+package access
+
+import (
+	"crypto/subtle"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/proxy"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+func init() {
+	config.RegisterPrefix("http.access")
+}
+
+// Names of the endpoints that access can be configured for, under http.access
+const (
+	Key  = "key"  // the /key endpoint, which serves the coordinator's public noise key
+	Derp = "derp" // the embedded derp relay's endpoints, including its probes
+)
+
+// Policy is the set of checks a request to an endpoint must pass. An empty policy allows all requests.
+type Policy struct {
+	AllowedIPs []string `mapstructure:"allowed_ips"` // addresses or prefixes of the clients allowed to connect
+	Token      string   `mapstructure:"token"`       // shared token, passed as a bearer token in the Authorization header
+
+	prefixes []netip.Prefix
+}
+
+// Read returns the policy configured for the named endpoint
+func Read(name string) (p Policy, err error) {
+	if err = viper.UnmarshalKey("http.access."+name, &p); err != nil {
+		return Policy{}, errors.Wrapf(err, "access: failed to read http.access.%s", name)
+	}
+
+	for _, s := range p.AllowedIPs {
+		var prefix netip.Prefix
+		if strings.Contains(s, "/") {
+			prefix, err = netip.ParsePrefix(s)
+		} else if addr, e := netip.ParseAddr(s); e == nil {
+			prefix, err = addr.Prefix(addr.BitLen())
+		} else {
+			err = e
+		}
+
+		if err != nil {
+			return Policy{}, errors.Wrapf(err, "access: %s: invalid allowed ip %q", name, s)
+		}
+
+		p.prefixes = append(p.prefixes, prefix.Masked())
+	}
+
+	return p, nil
+}
+
+// allows returns true if the request, sent by the client at addr, passes all the checks of the policy
+func (p Policy) allows(r *http.Request, addr netip.Addr) bool {
+	if len(p.prefixes) > 0 {
+		if !addr.IsValid() || !slices.ContainsFunc(p.prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+			return false
+		}
+	}
+
+	if p.Token != "" {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(p.Token)) != 1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Middleware returns a middleware that rejects requests that don't pass the policy configured for the named endpoint.
+// The address of the client is resolved using forwarding headers sent by the trusted proxies.
+func Middleware(name string, proxies *proxy.Trusted) func(next http.Handler) http.Handler {
+	var p = util.Must(Read(name))
+
+	return func(next http.Handler) http.Handler {
+		if len(p.prefixes) == 0 && p.Token == "" {
+			return next // endpoint is open
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if addr := proxies.ClientAddr(r); !p.allows(r, addr) {
+				zerolog.Ctx(r.Context()).Warn().Str("endpoint", name).Stringer("remote", addr).Msg("access denied")
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
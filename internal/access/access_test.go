@@ -0,0 +1,72 @@
+package access
+
+import (
+	"github.com/riyaz-ali/wirefire/internal/proxy"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	viper.Set("http.access.key", map[string]any{"allowed_ips": []string{"10.0.0.0/8", "192.0.2.1"}})
+	viper.Set("http.access.derp", map[string]any{"allowed_ips": []string{"10.0.0.0/8"}, "token": "s3cr3t"})
+	viper.Set("http.trusted_proxies", []string{"172.16.0.1"})
+	t.Cleanup(viper.Reset)
+
+	var proxies = util.Must(proxy.Read())
+
+	var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	var cases = []struct {
+		name     string
+		endpoint string
+		remote   string
+		forwards string // X-Forwarded-For header
+		token    string
+		want     int
+	}{
+		{"AllowedPrefix", Key, "10.1.2.3:41641", "", "", http.StatusOK},
+		{"AllowedAddr", Key, "192.0.2.1:41641", "", "", http.StatusOK},
+		{"AllowedMappedAddr", Key, "[::ffff:192.0.2.1]:41641", "", "", http.StatusOK},
+		{"OtherAddr", Key, "192.0.2.2:41641", "", "", http.StatusForbidden},
+		{"AllowedAddrAndToken", Derp, "10.1.2.3:41641", "", "s3cr3t", http.StatusOK},
+		{"AllowedAddrWithoutToken", Derp, "10.1.2.3:41641", "", "", http.StatusForbidden},
+		{"AllowedAddrWithWrongToken", Derp, "10.1.2.3:41641", "", "secret", http.StatusForbidden},
+		{"TokenFromOtherAddr", Derp, "192.0.2.1:41641", "", "s3cr3t", http.StatusForbidden},
+		{"Open", "landing", "192.0.2.2:41641", "", "", http.StatusOK},
+		{"ForwardedByTrustedProxy", Key, "172.16.0.1:443", "192.0.2.1", "", http.StatusOK},
+		{"ForwardedFromOtherAddr", Key, "172.16.0.1:443", "192.0.2.2", "", http.StatusForbidden},
+		{"SpoofedForward", Key, "192.0.2.2:41641", "10.1.2.3", "", http.StatusForbidden}, // not sent by a trusted proxy
+		{"TrustedProxyItself", Key, "172.16.0.1:443", "", "", http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var r = httptest.NewRequest(http.MethodGet, "/key", nil)
+			if r.RemoteAddr = tc.remote; tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+
+			if tc.forwards != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwards)
+			}
+
+			var w = httptest.NewRecorder()
+			Middleware(tc.endpoint, proxies)(ok).ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("expected status %d; got %d", tc.want, w.Code)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	viper.Set("http.access.key", map[string]any{"allowed_ips": []string{"not-an-ip"}})
+	t.Cleanup(viper.Reset)
+
+	if _, err := Read(Key); err == nil {
+		t.Errorf("expected invalid allowed ip to be rejected")
+	}
+}
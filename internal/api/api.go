@@ -0,0 +1,220 @@
+// Package api implements the authenticated admin REST api used to manage and inspect wirefire
+package api
+
+import (
+	"context"
+	"crawshaw.io/sqlite/sqlitex"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"io"
+	"net/http"
+	"strings"
+	"tailscale.com/tsweb/varz"
+	"time"
+)
+
+// Config is the subset of configuration relevant to the admin api
+type Config struct {
+	// Token is the static bearer token used to authenticate requests to the admin api.
+	// The admin api is disabled if no token is configured.
+	Token string `viper:"api.token"`
+
+	// IdentitySecret is the secret machine identities are sealed with when they're exported, and opened with when they're
+	// imported (see: ExportMachine). It must be the same on the coordinators machines are migrated between. Anyone holding
+	// it can seal identities of their own making, and so, register any machine; guard it as closely as the token.
+	// Exports and imports are disabled if it's empty.
+	IdentitySecret string `viper:"api.identity_secret"`
+}
+
+func init() {
+	config.Register[Config]()
+}
+
+// Handler returns a new http.Handler that serves the admin api
+func Handler(_ context.Context, pool *sqlitex.Pool) http.Handler {
+	cfg := config.MustValidate(config.Read[Config]())
+
+	r := chi.NewRouter()
+	r.Use(NewAccessLog(), otelhttp.NewMiddleware("api.request"), Authenticate(cfg.Token))
+
+	r.Method(http.MethodGet, "/tailnets", ListTailnets(pool))
+	r.Method(http.MethodPost, "/tailnets", CreateTailnet(pool))
+	r.Route("/tailnets/{tailnet}", func(r chi.Router) { TailnetRoutes(r, pool) })
+
+	r.Method(http.MethodGet, "/policies", ListSharedPolicies(pool))
+	r.Method(http.MethodGet, "/policies/{name}", GetSharedPolicy(pool))
+	r.Method(http.MethodPut, "/policies/{name}", UpdateSharedPolicy(pool))
+	r.Method(http.MethodDelete, "/policies/{name}", DeleteSharedPolicy(pool))
+
+	r.Method(http.MethodPost, "/users/{user}/revoke", RevokeUser(pool))
+	r.Method(http.MethodPost, "/users/{user}/enable", EnableUser(pool))
+	r.Method(http.MethodGet, "/users/{user}/roles", ListUserRoles(pool))
+	r.Method(http.MethodGet, "/roles", ListRoles())
+
+	r.Method(http.MethodGet, "/audit", ListAuditEvents(pool))
+
+	r.Method(http.MethodGet, "/settings", ListSettings())
+	r.Method(http.MethodGet, "/settings/{key}", GetSetting())
+	r.Method(http.MethodPut, "/settings/{key}", UpdateSetting(pool))
+	r.Method(http.MethodDelete, "/settings/{key}", ResetSetting(pool))
+
+	r.Method(http.MethodGet, "/notices", ListNotices(pool))
+	r.Method(http.MethodPost, "/notices", CreateNotice(pool))
+	r.Method(http.MethodDelete, "/notices/{id}", DeleteNotice(pool))
+
+	r.Method(http.MethodGet, "/derp", GetDerpStatus())
+	r.Method(http.MethodGet, "/versions", GetClientVersions())
+	r.Method(http.MethodPost, "/backup", CreateBackup(pool))
+	r.Method(http.MethodGet, "/metrics", http.HandlerFunc(varz.Handler))
+
+	return r
+}
+
+// TailnetRoutes registers the endpoints used to manage a single tailnet with r, relative to /tailnets/{tailnet}.
+// They're shared with the admin console, which mounts them behind its own authentication.
+//
+// Each endpoint requires the caller to have (at least) the privileges of a tailnet role (see: WithRole); auditors can
+// use the endpoints that read, admins those that make changes, and only owners can delete the tailnet.
+func TailnetRoutes(r chi.Router, pool *sqlitex.Pool) {
+	r.Group(func(r chi.Router) {
+		r.Use(RequireRole(domain.RoleAuditor))
+		r.Method(http.MethodGet, "/", GetTailnet(pool))
+		r.Method(http.MethodGet, "/acl", GetPolicy(pool))
+		r.Method(http.MethodGet, "/acl/history", ListPolicyHistory(pool))
+		r.Method(http.MethodPost, "/acl/test", TestPolicy(pool))
+		r.Method(http.MethodGet, "/members", ListMembers(pool))
+		r.Method(http.MethodGet, "/machines", ListMachines(pool))
+		r.Method(http.MethodGet, "/machines/{machine}", GetMachine(pool))
+		r.Method(http.MethodGet, "/machines/{machine}/filter", ExportFilter(pool))
+		r.Method(http.MethodGet, "/machines/{machine}/routes", ListRoutes(pool))
+		r.Method(http.MethodGet, "/machines/{machine}/health", ListHealthWarnings(pool))
+		r.Method(http.MethodGet, "/machines/{machine}/uptime", GetMachineUptime(pool))
+		r.Method(http.MethodGet, "/machines/{machine}/path/{peer}", DiagnosePath(pool))
+		r.Method(http.MethodGet, "/machines/{machine}/ssh-sessions", ListSSHSessions(pool))
+		r.Method(http.MethodGet, "/machines/{machine}/ssh-principals", ExportSSHPrincipals(pool))
+		r.Method(http.MethodGet, "/exit-nodes", ListExitNodes(pool))
+		r.Method(http.MethodGet, "/derp", GetTailnetDerpStatus())
+		r.Method(http.MethodGet, "/watch", WatchMachines(pool))
+		r.Method(http.MethodGet, "/health", ListHealthWarnings(pool))
+		r.Method(http.MethodGet, "/ssh-sessions", ListSSHSessions(pool))
+		r.Method(http.MethodGet, "/keys", ListAuthKeys(pool))
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(RequireRole(domain.RoleAdmin))
+		r.Method(http.MethodPatch, "/", UpdateTailnet(pool))
+		r.Method(http.MethodPut, "/pools", SetTailnetPools(pool))
+		r.Method(http.MethodPut, "/acl", UpdatePolicy(pool))
+		r.Method(http.MethodPost, "/members", AddMember(pool))
+		r.Method(http.MethodPut, "/members/{user}", UpdateMember(pool))
+		r.Method(http.MethodDelete, "/members/{user}", RemoveMember(pool))
+		r.Method(http.MethodPatch, "/machines/{machine}", UpdateMachine(pool))
+		r.Method(http.MethodDelete, "/machines/{machine}", DeleteMachine(pool))
+		r.Method(http.MethodPut, "/machines/{machine}/visibility", SetMachineVisibility(pool))
+		r.Method(http.MethodPut, "/machines/{machine}/relay", SetMachineRelay(pool))
+		r.Method(http.MethodPut, "/machines/{machine}/site", SetMachineSite(pool))
+		r.Method(http.MethodPut, "/machines/{machine}/lock", SetMachineLock(pool))
+		r.Method(http.MethodPut, "/machines/{machine}/authorized", AuthorizeMachine(pool))
+		r.Method(http.MethodPost, "/machines/{machine}/expire", ExpireMachine(pool))
+		r.Method(http.MethodPost, "/machines/{machine}/renew", RenewMachine(pool))
+		r.Method(http.MethodPut, "/machines/{machine}/routes", SetRoutes(pool))
+		r.Method(http.MethodPost, "/machines/{machine}/export", ExportMachine(pool))
+		r.Method(http.MethodPost, "/machines/import", ImportMachine(pool))
+		r.Method(http.MethodPost, "/keys", CreateAuthKey(pool))
+		r.Method(http.MethodDelete, "/keys/{id}", RevokeAuthKey(pool))
+		r.Method(http.MethodGet, "/webhooks", ListWebhooks(pool))
+		r.Method(http.MethodPost, "/webhooks", CreateWebhook(pool))
+		r.Method(http.MethodDelete, "/webhooks/{id}", DeleteWebhook(pool))
+		r.Method(http.MethodGet, "/webhooks/{id}/deliveries", ListWebhookDeliveries(pool))
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(RequireRole(domain.RoleOwner))
+		r.Method(http.MethodDelete, "/", DeleteTailnet(pool))
+	})
+}
+
+// NewAccessLog returns a new middleware that sends its log output to the provided zerolog sink at the end of each request
+func NewAccessLog() func(next http.Handler) http.Handler {
+	return hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
+		zerolog.Ctx(r.Context()).Info().Str("method", r.Method).Str("path", r.URL.Path).Int("status", status).Send()
+	})
+}
+
+// Authenticate returns a new middleware that authenticates the request using the static bearer token, which grants
+// the owner role in every tailnet. All requests are rejected if the token is empty.
+func Authenticate(token string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				http.Error(w, "admin api is disabled", http.StatusForbidden)
+				return
+			}
+
+			bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(WithRole(r.Context(), domain.RoleOwner)))
+		})
+	}
+}
+
+// Error is an error with an associated http status code. Handlers return Error
+// to control the status code sent to the client.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// decode decodes the json request body into a new instance of T
+func decode[T any](r *http.Request) (*T, error) {
+	var v T
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&v); err != nil {
+		return nil, &Error{Status: http.StatusBadRequest, Message: "failed to decode request body: " + err.Error()}
+	}
+	return &v, nil
+}
+
+// HandlerFunc takes care of boilerplate details around encoding responses and errors for api handlers.
+type HandlerFunc func(*http.Request) (any, error)
+
+func (h HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := zerolog.Ctx(r.Context())
+
+	out, err := h(r)
+	if err != nil {
+		var ae *Error
+		if errors.As(err, &ae) {
+			http.Error(w, ae.Message, ae.Status)
+		} else {
+			log.Error().Err(err).Send()
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}
+
+		return
+	}
+
+	if page, ok := out.(*Page); ok {
+		if page.Next != "" {
+			w.Header().Set(HeaderNextCursor, page.Next)
+		}
+		out = page.Items
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(out); err != nil {
+		log.Error().Err(err).Msg("failed to encode response body")
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// auditFields are the fields audit events can be filtered and sorted on (see: parseListing)
+var auditFields = map[string]field[domain.AuditEvent]{
+	"id":          intField(func(e *domain.AuditEvent) int { return e.ID }),
+	"action":      stringField(func(e *domain.AuditEvent) string { return e.Action }),
+	"actor":       stringField(func(e *domain.AuditEvent) string { return e.Actor }),
+	"target":      stringField(func(e *domain.AuditEvent) string { return e.Target }),
+	"client_addr": stringField(func(e *domain.AuditEvent) string { return e.ClientAddr }),
+	"created_at":  timeField(func(e *domain.AuditEvent) *time.Time { return &e.CreatedAt }),
+}
+
+// ListAuditEvents serves the GET /audit endpoint and returns the most recent audit events, newest first.
+//
+// Results can be filtered to a single tailnet using the ?tailnet= query parameter, and further filtered and sorted
+// (see: parseListing) on the id, action, actor, target, client_addr and created_at fields; eg.
+// ?filter=action=machine.created&filter=created_at>2024-01-01. The number of results can be controlled using ?limit=
+// (default 100, max 1000).
+func ListAuditEvents(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		var tailnet int64
+		if v := r.URL.Query().Get("tailnet"); v != "" {
+			if tailnet, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+			}
+		}
+
+		var list *listing[domain.AuditEvent]
+		if list, err = parseListing(r, auditFields, listOptions{Key: "id", Sort: "-id", Limit: 100, MaxLimit: 1000}); err != nil {
+			return nil, err
+		}
+
+		var filters = make([]domain.AuditFilter, 0, len(list.conditions))
+		for _, c := range list.conditions {
+			filters = append(filters, domain.AuditFilter{Column: c.name, Op: c.op, Value: c.value})
+		}
+
+		var order = make([]domain.AuditOrder, 0, len(list.sort))
+		for _, o := range list.sort {
+			order = append(order, domain.AuditOrder{Column: o.name, Desc: o.desc})
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		// events are filtered, sorted and paginated by the database; one more than the limit is fetched, to tell if
+		// there's a next page
+		var events []*domain.AuditEvent
+		if events, err = database.FetchMany(conn, domain.SearchAuditEvents(tailnet, filters, order, list.after, list.limit+1)); err != nil {
+			return nil, err
+		}
+
+		return list.apply(events) // builds the page (and its cursor) out of the events, which are already in order
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestListAuditEvents(t *testing.T) {
+	var pool = open(t)
+
+	conn := pool.Get(context.Background())
+	if err := sqlitex.ExecScript(conn, `
+		INSERT INTO tailnets (id, name, acl) VALUES (1, 'example.com', '{}'), (2, 'example.org', '{}');
+		INSERT INTO audit_log (id, action, actor, target, tailnet_id, created_at) VALUES
+			(1, 'machine.created', 'Alice', 'alpha', 1, '2024-01-01T10:00:00.000Z'),
+			(2, 'machine.renamed', 'alice', 'alpha', 1, '2024-01-02T10:00:00.000Z'),
+			(3, 'machine.created', 'bob', 'bravo', 2, '2024-01-02T10:00:00.000Z'),
+			(4, 'machine.created', 'bob', 'charlie', 1, '2024-01-02T10:00:00.000Z'),
+			(5, 'machine.deleted', 'alice', 'alpha', 1, '2024-01-03T10:00:00.000Z');
+	`); err != nil {
+		t.Fatalf("failed to seed database: %v", err)
+	}
+	pool.Put(conn)
+
+	var list = func(query url.Values) (ids []int, next string) {
+		t.Helper()
+
+		out, err := ListAuditEvents(pool)(httptest.NewRequest("GET", "/audit?"+query.Encode(), nil))
+		if err != nil {
+			t.Fatalf("failed to list %q: %v", query.Encode(), err)
+		}
+
+		var page = out.(*Page)
+		for _, e := range page.Items.([]*domain.AuditEvent) {
+			ids = append(ids, e.ID)
+		}
+		return ids, page.Next
+	}
+
+	var cases = []struct {
+		query url.Values
+		ids   []int
+	}{
+		{url.Values{}, []int{5, 4, 3, 2, 1}},
+		{url.Values{"tailnet": {"2"}}, []int{3}},
+		{url.Values{"filter": {"action=machine.created"}}, []int{4, 3, 1}},
+		{url.Values{"filter": {"actor~ALI", "target!=alpha"}}, nil},
+		{url.Values{"filter": {"actor~ALI"}, "sort": {"id"}}, []int{1, 2, 5}},
+		{url.Values{"filter": {"created_at>=2024-01-02", "created_at<2024-01-03"}, "tailnet": {"1"}}, []int{4, 2}},
+		{url.Values{"filter": {"id>1", "id<=4"}, "sort": {"target,-id"}}, []int{2, 3, 4}},
+	}
+
+	for _, tc := range cases {
+		if ids, _ := list(tc.query); !slices.Equal(ids, tc.ids) {
+			t.Errorf("expected %v for %q; got %v", tc.ids, tc.query.Encode(), ids)
+		}
+	}
+
+	// pages are keyed on the sort fields, and the id, which breaks ties between events created at the same time
+	var query = url.Values{"sort": {"created_at"}, "limit": {"2"}}
+	var all []int
+	for {
+		ids, next := list(query)
+		all = append(all, ids...)
+		if next == "" {
+			break
+		}
+		query.Set("cursor", next)
+	}
+
+	if expected := []int{1, 2, 3, 4, 5}; !slices.Equal(all, expected) {
+		t.Errorf("expected pages to hold %v; got %v", expected, all)
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/rs/zerolog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BackupConfig is the subset of configuration relevant to database backups
+type BackupConfig struct {
+	// Dir is the directory database backups are written to. Backups are disabled if empty.
+	Dir string `viper:"database.backup_dir"`
+}
+
+func init() {
+	config.Register[BackupConfig]()
+}
+
+// Backup is the api representation of a completed database backup
+type Backup struct {
+	Path     string `json:"path"`
+	Size     int64  `json:"size"`
+	Duration string `json:"duration"`
+	Verified bool   `json:"verified"` // backup passed database.Verify
+}
+
+// CreateBackup serves the POST /backup endpoint and writes a consistent, online backup of the database to
+// a new file in the configured backup directory. The coordinator keeps serving requests while the backup runs.
+//
+// The file is named using the request's name (eg. {"name": "wirefire-2024-10-01.db"}), or the current time if empty.
+// If the request sets verify, the backup is checked to be usable (see database.Verify), and removed if it isn't.
+func CreateBackup(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Name   string `json:"name"`
+		Verify bool   `json:"verify"`
+	}
+
+	cfg := config.Read[BackupConfig]()
+
+	return func(r *http.Request) (_ any, err error) {
+		if cfg.Dir == "" {
+			return nil, &Error{Status: http.StatusNotFound, Message: "backups are disabled; set database.backup_dir to enable them"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		if req.Name == "" {
+			req.Name = "wirefire-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+		} else if req.Name != filepath.Base(req.Name) || strings.HasPrefix(req.Name, ".") {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "name must be a plain file name"}
+		}
+
+		var path = filepath.Join(cfg.Dir, req.Name)
+		if _, err = os.Stat(path); err == nil {
+			return nil, &Error{Status: http.StatusConflict, Message: "backup " + req.Name + " already exists"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var start = time.Now()
+		if err = database.Backup(conn, path); err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Str("path", path).Msg("failed to backup database")
+			return nil, err
+		}
+
+		var backup = &Backup{Path: path, Duration: time.Since(start).String()}
+		if req.Verify {
+			if err = database.Verify(conn, path); err != nil {
+				zerolog.Ctx(r.Context()).Error().Err(err).Str("path", path).Msg("backup failed verification")
+				_ = os.Remove(path)
+				return nil, err
+			}
+			backup.Verified = true
+		}
+
+		if fi, err := os.Stat(path); err == nil {
+			backup.Size = fi.Size()
+		}
+
+		event := &domain.AuditEvent{Action: domain.ActionDatabaseBackup, Actor: actorFrom(r.Context()), Target: path}
+		if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+			return nil, err
+		}
+
+		return backup, nil
+	}
+}
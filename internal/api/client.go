@@ -0,0 +1,73 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client is a client for the admin api, used by the wirefire cli to administer a running server
+type Client struct {
+	BaseUrl *url.URL // url the admin api is mounted at, eg. https://wirefire.example.com/api/v1
+	Token   string   // bearer token used to authenticate requests; see Config.Token
+
+	HTTP *http.Client // http client used to send requests; http.DefaultClient is used if nil
+}
+
+// Do sends a request to the admin api endpoint at path. If body is non-nil, it's sent as the json encoded
+// request body, unless it's a []byte, which is sent as-is. If out is non-nil, the json response is decoded into it.
+func (c *Client) Do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		reader = bytes.NewReader(b)
+	default:
+		buf, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseUrl.JoinPath(path).String(), reader)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	var hc = c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	res, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode >= 400 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1<<16))
+		return &Error{Status: res.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(out); err != nil {
+		return errors.Wrapf(err, "failed to decode response from %s %s", method, path)
+	}
+
+	return nil
+}
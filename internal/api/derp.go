@@ -0,0 +1,57 @@
+package api
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/coordinator"
+	"github.com/riyaz-ali/wirefire/internal/derp"
+	"github.com/spf13/viper"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"tailscale.com/tailcfg"
+	"time"
+)
+
+// DerpStatus is the api representation of the served derp map's freshness
+type DerpStatus struct {
+	Regions     int                 `json:"regions"`     // number of regions in the served map
+	Checksum    string              `json:"checksum"`    // checksum of the served map, as sent to clients; see coordinator.NodeAttrDERPMapChecksum
+	AgeSeconds  int64               `json:"age_seconds"` // time since the least recently refreshed source was fetched
+	RefreshedAt time.Time           `json:"refreshed_at"`
+	Sources     []derp.SourceStatus `json:"sources"`
+}
+
+// GetDerpStatus serves the GET /derp endpoint and reports the age of the served derp map, along with the status
+// of each of its sources, so that operators can tell if refreshing the map has been failing.
+func GetDerpStatus() HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		var age = derp.Age()
+		var status = &DerpStatus{AgeSeconds: int64(age.Seconds()), Sources: derp.Status()}
+		if age > 0 {
+			status.RefreshedAt = time.Now().Add(-age).UTC()
+		}
+
+		if dm, _ := viper.Get("derp.map").(*tailcfg.DERPMap); dm != nil {
+			status.Regions = len(dm.Regions)
+		}
+
+		status.Checksum = coordinator.DERPMapChecksum()
+
+		slices.SortFunc(status.Sources, func(a, b derp.SourceStatus) int { return strings.Compare(a.Source, b.Source) })
+		return status, nil
+	}
+}
+
+// GetTailnetDerpStatus serves the GET /tailnets/{tailnet}/derp endpoint and reports the checksum of the derp map served
+// to the tailnet, along with the machines connected to the coordinator that are yet to receive it; see coordinator.DERPMap.
+func GetTailnetDerpStatus() HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		return coordinator.DERPMap(tid), nil
+	}
+}
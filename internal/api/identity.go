@@ -0,0 +1,168 @@
+package api
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/coordinator"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/ipam"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ExportMachine serves the POST /tailnets/{tailnet}/machines/{machine}/export endpoint, and exports the machine's identity
+// (its public keys, addresses, name and tailnet binding) sealed with the configured api.identity_secret. The identity can be
+// imported into another coordinator, sharing the same secret, within domain.IdentityValidity, and only once (see: ImportMachine).
+//
+// The machine is left as-is; it's up to the admin to delete it once it has been migrated.
+func ExportMachine(pool *sqlitex.Pool) HandlerFunc {
+	type Response struct {
+		Identity  string    `json:"identity"`
+		ExpiresAt time.Time `json:"expires_at"` // time after which the identity can no longer be imported
+	}
+
+	cfg := config.Read[Config]()
+
+	return func(r *http.Request) (_ any, err error) {
+		if cfg.IdentitySecret == "" {
+			return nil, &Error{Status: http.StatusNotFound, Message: "machine exports are disabled; set api.identity_secret to enable them"}
+		}
+
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var identity *domain.MachineIdentity
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			var machine *domain.Machine
+			if machine, err = findMachine(conn, tid, mid); err != nil {
+				return err
+			}
+
+			// the owner's issuer isn't loaded along with the machine
+			if machine.Owner, err = database.FetchOne(conn, domain.UserById(int64(machine.UserID))); err != nil {
+				return err
+			}
+
+			identity = domain.NewMachineIdentity(machine)
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineExported, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid)}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		var sealed string
+		if sealed, err = domain.SealIdentity(identity, cfg.IdentitySecret); err != nil {
+			return nil, err
+		}
+
+		return &Response{Identity: sealed, ExpiresAt: identity.ExportedAt.Add(domain.IdentityValidity)}, nil
+	}
+}
+
+// ImportMachine serves the POST /tailnets/{tailnet}/machines/import endpoint, and registers a machine exported from another
+// coordinator (see: ExportMachine) in the tailnet. The machine keeps its keys, so it connects without re-registering once it's
+// pointed at this coordinator, and its addresses if they're free (see: coordinator.ImportMachine).
+//
+// The machine is owned by the user it was owned by on the other coordinator, matched by their oidc identity, unless
+// the request names another user (eg. {"identity": "wfid1-...", "user": 42}). The owner must be a member of the tailnet.
+func ImportMachine(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Identity string `json:"identity"`
+		User     int    `json:"user"`
+	}
+
+	cfg := config.Read[Config]()
+
+	return func(r *http.Request) (_ any, err error) {
+		if cfg.IdentitySecret == "" {
+			return nil, &Error{Status: http.StatusNotFound, Message: "machine imports are disabled; set api.identity_secret to enable them"}
+		}
+
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		var identity *domain.MachineIdentity
+		if identity, err = domain.OpenIdentity(req.Identity, cfg.IdentitySecret); err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: err.Error()}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			var tailnet *domain.Tailnet
+			if tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(tid))); err != nil {
+				return err
+			} else if tailnet == nil {
+				return &Error{Status: http.StatusNotFound, Message: "tailnet not found"}
+			}
+
+			var user *domain.User
+			if req.User != 0 {
+				user, err = database.FetchOne(conn, domain.UserById(int64(req.User)))
+			} else {
+				user, err = database.FetchOne(conn, domain.UserByIdentity(identity.Issuer, identity.Subject))
+			}
+
+			if err != nil {
+				return err
+			} else if user == nil {
+				return &Error{Status: http.StatusBadRequest, Message: "owner of the machine not found; pass the id of the user to own it"}
+			}
+
+			if member, err := database.FetchOne(conn, domain.CheckMembership(user, int64(tid))); err != nil {
+				return err
+			} else if !*member {
+				return &Error{Status: http.StatusBadRequest, Message: "owner of the machine is not a member of the tailnet"}
+			}
+
+			if machine, err = coordinator.ImportMachine(conn, user, tailnet, identity); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineImported, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid), Data: map[string]string{"tailnet": identity.Tailnet, "ipv4": machine.IPv4.String()}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if errors.Is(err, coordinator.ErrMachineExists) || errors.Is(err, domain.ErrIdentityUsed) {
+			return nil, &Error{Status: http.StatusConflict, Message: err.Error()}
+		} else if errors.Is(err, domain.ErrTagNotPermitted) || errors.Is(err, domain.ErrHostnameReserved) || errors.Is(err, ipam.ErrExhausted) {
+			return nil, &Error{Status: http.StatusBadRequest, Message: err.Error()}
+		} else if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.MachineCreated, Tailnet: tid, Machine: machine.ID})
+		return NewMachine(machine), nil
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuthKey is the api representation of a domain.AuthKey
+type AuthKey struct {
+	*domain.AuthKey
+	Valid bool `json:"valid"` // can the key still be used to register machines?
+
+	// Key is the complete key. It's only returned once, when the key is created.
+	Key string `json:"key,omitempty"`
+}
+
+// ListAuthKeys serves the GET /tailnets/{tailnet}/keys endpoint and lists all auth keys in the tailnet
+func ListAuthKeys(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var keys []*domain.AuthKey
+		if keys, err = database.FetchMany(conn, domain.ListAuthKeys(int64(tid))); err != nil {
+			return nil, err
+		}
+
+		var result = make([]*AuthKey, 0, len(keys))
+		for _, k := range keys {
+			result = append(result, &AuthKey{AuthKey: k, Valid: k.IsValid()})
+		}
+
+		return result, nil
+	}
+}
+
+// CreateAuthKey serves the POST /tailnets/{tailnet}/keys endpoint and creates a new auth key. Machines registered
+// using the key are owned by the given user (identified by their subject), who must be a member of the tailnet.
+func CreateAuthKey(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		User        string   `json:"user"`
+		Description string   `json:"description"`
+		Reusable    bool     `json:"reusable"`
+		Ephemeral   bool     `json:"ephemeral"`
+		Tags        []string `json:"tags"`
+		Expiry      string   `json:"expiry"` // duration after which the key expires, eg. 24h; the key never expires if empty
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		for _, tag := range req.Tags {
+			if !strings.HasPrefix(tag, "tag:") {
+				return nil, &Error{Status: http.StatusBadRequest, Message: "tags must be of the form tag:<name>"}
+			}
+		}
+
+		key, ak := domain.GenerateAuthKey()
+		ak.Description, ak.Reusable, ak.Ephemeral, ak.Tags, ak.TailnetID = req.Description, req.Reusable, req.Ephemeral, req.Tags, tid
+
+		if req.Expiry != "" {
+			expiry, err := time.ParseDuration(req.Expiry)
+			if err != nil || expiry <= 0 {
+				return nil, &Error{Status: http.StatusBadRequest, Message: "invalid expiry duration"}
+			}
+			ak.ExpiresAt = util.ToPtr(time.Now().Add(expiry))
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			var user *domain.User
+			if user, err = database.FetchOne(conn, domain.UserBySubject(req.User)); err != nil {
+				return err
+			} else if user == nil {
+				return &Error{Status: http.StatusBadRequest, Message: "user not found"}
+			} else if user.IsDisabled() {
+				return &Error{Status: http.StatusBadRequest, Message: "user is disabled"}
+			}
+
+			if member, err := database.FetchOne(conn, domain.CheckMembership(user, int64(tid))); err != nil {
+				return err
+			} else if !*member {
+				return &Error{Status: http.StatusBadRequest, Message: "user is not a member of the tailnet"}
+			}
+
+			ak.UserID = user.ID
+			if ak, err = database.FetchOne(conn, domain.CreateAuthKey(ak)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionAuthKeyCreated, Actor: actorFrom(r.Context()), Target: ak.Prefix, TailnetID: util.ToPtr(tid), Data: map[string]string{"user": user.Subject}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &AuthKey{AuthKey: ak, Valid: ak.IsValid(), Key: key}, nil
+	}
+}
+
+// RevokeAuthKey serves the DELETE /tailnets/{tailnet}/keys/{id} endpoint and revokes the auth key.
+// Machines already registered using the key are not affected.
+func RevokeAuthKey(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid key id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var ak *domain.AuthKey
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if ak, err = database.FetchOne(conn, domain.RevokeAuthKey(int64(tid), id)); err != nil {
+				return err
+			} else if ak == nil {
+				return &Error{Status: http.StatusNotFound, Message: "auth key not found"}
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionAuthKeyRevoked, Actor: actorFrom(r.Context()), Target: ak.Prefix, TailnetID: util.ToPtr(tid)}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &AuthKey{AuthKey: ak, Valid: ak.IsValid()}, nil
+	}
+}
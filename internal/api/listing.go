@@ -0,0 +1,382 @@
+package api
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// List endpoints (eg. ListMachines) share a query syntax to filter, sort, paginate and select the fields of their results,
+// using the following query parameters:
+//
+//	filter  a condition on a field, as <field><op><value>; eg. filter=tag=tag:server or filter=last_seen<2024-01-01.
+//	        It can be repeated, and results must match all conditions. Supported operators are =, !=, <, <=, >, >= and
+//	        ~ (case-insensitive substring match, on text fields). On list fields (eg. tag), = and != test for membership.
+//	sort    comma separated fields to sort by, each prefixed with - to sort in descending order; eg. sort=-last_seen,name
+//	limit   maximum number of results returned. The cursor of the next page, if any, is sent in the X-Next-Cursor header.
+//	cursor  the cursor returned with the previous page, to fetch the page after it. The other parameters must not change.
+//	fields  comma separated (json) fields of the results to return; eg. fields=id,name. All fields are returned by default.
+//
+// Time values are accepted as RFC3339 timestamps, or dates (eg. 2024-01-01). The fields that can be filtered and sorted on
+// are documented by each endpoint.
+
+// HeaderNextCursor is the response header carrying the cursor of the next page of a list endpoint's results
+const HeaderNextCursor = "X-Next-Cursor"
+
+// Page is a page of a list endpoint's results, returned by handlers in place of the results themselves
+type Page struct {
+	Items any
+	Next  string // cursor of the next page; empty if it's the last page
+}
+
+// kind of the values of a field, which determines how its values are parsed and compared
+type kind int
+
+const (
+	kindString kind = iota
+	kindInt
+	kindBool
+	kindTime
+	kindList // list of strings, which can only be filtered on (using = and !=)
+)
+
+// field is a field of T that results can be filtered and sorted on
+type field[T any] struct {
+	kind  kind
+	value func(*T) any // returns a string, int, bool, time.Time (zero if unset) or []string, as per kind
+}
+
+func stringField[T any](fn func(*T) string) field[T] {
+	return field[T]{kind: kindString, value: func(t *T) any { return fn(t) }}
+}
+
+func intField[T any](fn func(*T) int) field[T] {
+	return field[T]{kind: kindInt, value: func(t *T) any { return fn(t) }}
+}
+
+func boolField[T any](fn func(*T) bool) field[T] {
+	return field[T]{kind: kindBool, value: func(t *T) any { return fn(t) }}
+}
+
+func timeField[T any](fn func(*T) *time.Time) field[T] {
+	return field[T]{kind: kindTime, value: func(t *T) any {
+		if v := fn(t); v != nil {
+			return *v
+		}
+		return time.Time{}
+	}}
+}
+
+func listField[T any](fn func(*T) []string) field[T] {
+	return field[T]{kind: kindList, value: func(t *T) any { return fn(t) }}
+}
+
+// parse parses s as a value of the kind; values of list fields are parsed as strings
+func (k kind) parse(s string) (any, error) {
+	switch k {
+	case kindInt:
+		return strconv.Atoi(s)
+	case kindBool:
+		return strconv.ParseBool(s)
+	case kindTime:
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, nil
+		}
+		return time.Parse(time.DateOnly, s)
+	default:
+		return s, nil
+	}
+}
+
+// format formats the value such that it's parsed back as the same value
+func format(v any) string {
+	if t, ok := v.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
+
+// compare compares two (non-list) values of the same kind
+func compare(a, b any) int {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case int:
+		return cmp.Compare(a, b.(int))
+	case bool:
+		return cmp.Compare(btoi(a), btoi(b.(bool)))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	}
+	return 0
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// operators supported by filters, longest first, so that <= isn't parsed as <
+var operators = []string{"!=", "<=", ">=", "=", "<", ">", "~"}
+
+// condition is a single, parsed filter on a field
+type condition[T any] struct {
+	name  string
+	field field[T]
+	op    string
+	value any
+}
+
+func (c *condition[T]) match(t *T) bool {
+	var v = c.field.value(t)
+	if list, ok := v.([]string); ok {
+		return slices.Contains(list, c.value.(string)) == (c.op == "=")
+	}
+
+	if c.op == "~" {
+		return strings.Contains(strings.ToLower(v.(string)), strings.ToLower(c.value.(string)))
+	}
+
+	var n = compare(v, c.value)
+	switch c.op {
+	case "=":
+		return n == 0
+	case "!=":
+		return n != 0
+	case "<":
+		return n < 0
+	case "<=":
+		return n <= 0
+	case ">":
+		return n > 0
+	case ">=":
+		return n >= 0
+	}
+	return false
+}
+
+// order is a single, parsed sort key
+type order struct {
+	name string
+	desc bool
+}
+
+// cursor identifies the last result of a page, by the values of its sort keys
+type cursor struct {
+	Sort   string   `json:"s"`
+	Values []string `json:"v"`
+}
+
+// listing is a parsed list query, against results of type T
+type listing[T any] struct {
+	opts       listOptions
+	fields     map[string]field[T]
+	conditions []*condition[T]
+	sort       []order
+	sortStr    string
+	after      []any // values of the sort keys of the last result of the previous page
+	limit      int
+	selected   []string
+}
+
+// listOptions are the defaults of a list endpoint
+type listOptions struct {
+	Key      string // field that uniquely identifies a result; it's always the last sort key, so that the order is stable
+	Sort     string // default sort, used if the request doesn't sort the results
+	Limit    int    // default limit; zero if results aren't paginated by default
+	MaxLimit int    // maximum limit; zero if unlimited
+}
+
+// parseListing parses the list query of the request, against the fields that results can be filtered and sorted on
+func parseListing[T any](r *http.Request, fields map[string]field[T], opts listOptions) (_ *listing[T], err error) {
+	var query = r.URL.Query()
+	var l = &listing[T]{opts: opts, fields: fields, limit: opts.Limit}
+
+	for _, f := range query["filter"] {
+		var c *condition[T]
+		if c, err = l.parseCondition(f); err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid filter " + strconv.Quote(f) + ": " + err.Error()}
+		}
+		l.conditions = append(l.conditions, c)
+	}
+
+	l.sortStr = cmp.Or(query.Get("sort"), opts.Sort)
+
+	var key = order{name: opts.Key}
+	for _, s := range strings.Split(l.sortStr, ",") {
+		var o = order{name: strings.TrimPrefix(s, "-"), desc: strings.HasPrefix(s, "-")}
+		if f, ok := fields[o.name]; !ok || f.kind == kindList {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid sort field " + strconv.Quote(o.name)}
+		}
+
+		if o.name == opts.Key {
+			key = o
+			break // keys after the unique key can't change the order
+		}
+		l.sort = append(l.sort, o)
+	}
+	l.sort = append(l.sort, key)
+
+	if v := query.Get("limit"); v != "" {
+		if l.limit, err = strconv.Atoi(v); err != nil || l.limit <= 0 || (opts.MaxLimit > 0 && l.limit > opts.MaxLimit) {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid limit"}
+		}
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		if l.after, err = l.parseCursor(v); err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid cursor"}
+		}
+	}
+
+	if v := query.Get("fields"); v != "" {
+		l.selected = strings.Split(v, ",")
+	}
+
+	return l, nil
+}
+
+// parseCondition parses a filter of the form <field><op><value>
+func (l *listing[T]) parseCondition(s string) (*condition[T], error) {
+	var i = strings.IndexAny(s, "!<>=~")
+	if i <= 0 {
+		return nil, errors.New("expected <field><op><value>")
+	}
+
+	var name, rest = s[:i], s[i:]
+	var f, ok = l.fields[name]
+	if !ok {
+		return nil, errors.Errorf("unknown field %q", name)
+	}
+
+	for _, op := range operators {
+		if value, found := strings.CutPrefix(rest, op); found {
+			if (op == "~" && f.kind != kindString) || (f.kind == kindList && op != "=" && op != "!=") {
+				return nil, errors.Errorf("operator %s is not supported on %s", op, name)
+			}
+
+			v, err := f.kind.parse(value)
+			if err != nil {
+				return nil, errors.Errorf("invalid value of %s", name)
+			}
+
+			return &condition[T]{name: name, field: f, op: op, value: v}, nil
+		}
+	}
+
+	return nil, errors.New("unknown operator")
+}
+
+// parseCursor decodes the cursor, which must have been issued for the same sort order
+func (l *listing[T]) parseCursor(s string) ([]any, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var c cursor
+	if err = json.Unmarshal(buf, &c); err != nil {
+		return nil, err
+	}
+
+	if c.Sort != l.sortStr || len(c.Values) != len(l.sort) {
+		return nil, errors.New("cursor doesn't match the sort order")
+	}
+
+	var values = make([]any, len(l.sort))
+	for i, o := range l.sort {
+		if values[i], err = l.fields[o.name].kind.parse(c.Values[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return values, nil
+}
+
+// compare compares two results in the sort order of the listing, given the values of their i-th sort key
+func (l *listing[T]) compare(values func(i int, o order) (any, any)) int {
+	for i, o := range l.sort {
+		var a, b = values(i, o)
+		if n := compare(a, b); n != 0 {
+			if o.desc {
+				return -n
+			}
+			return n
+		}
+	}
+	return 0
+}
+
+// apply filters, sorts and paginates the results, and selects the requested fields of those on the page
+func (l *listing[T]) apply(items []*T) (*Page, error) {
+	items = slices.DeleteFunc(append([]*T{}, items...), func(t *T) bool {
+		return slices.ContainsFunc(l.conditions, func(c *condition[T]) bool { return !c.match(t) })
+	})
+
+	slices.SortStableFunc(items, func(a, b *T) int {
+		return l.compare(func(_ int, o order) (any, any) { return l.fields[o.name].value(a), l.fields[o.name].value(b) })
+	})
+
+	if l.after != nil {
+		var i = slices.IndexFunc(items, func(t *T) bool {
+			return l.compare(func(i int, o order) (any, any) { return l.fields[o.name].value(t), l.after[i] }) > 0
+		})
+
+		if i < 0 {
+			i = len(items)
+		}
+		items = items[i:]
+	}
+
+	var page = &Page{}
+	if l.limit > 0 && len(items) > l.limit {
+		items = items[:l.limit]
+
+		var c = cursor{Sort: l.sortStr}
+		for _, o := range l.sort {
+			var f = l.fields[o.name]
+			c.Values = append(c.Values, format(f.value(items[len(items)-1])))
+		}
+
+		buf, _ := json.Marshal(c)
+		page.Next = base64.RawURLEncoding.EncodeToString(buf)
+	}
+
+	if len(l.selected) == 0 {
+		page.Items = items
+		return page, nil
+	}
+
+	var selected = make([]map[string]json.RawMessage, 0, len(items))
+	for _, t := range items {
+		buf, err := json.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+
+		var all map[string]json.RawMessage
+		if err = json.Unmarshal(buf, &all); err != nil {
+			return nil, err
+		}
+
+		var result = make(map[string]json.RawMessage, len(l.selected))
+		for _, name := range l.selected {
+			if v, ok := all[name]; ok {
+				result[name] = v
+			}
+		}
+		selected = append(selected, result)
+	}
+
+	page.Items = selected
+	return page, nil
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+type item struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	Tags     []string   `json:"tags"`
+	LastSeen *time.Time `json:"last_seen"`
+}
+
+var itemFields = map[string]field[item]{
+	"id":        intField(func(i *item) int { return i.ID }),
+	"name":      stringField(func(i *item) string { return i.Name }),
+	"tag":       listField(func(i *item) []string { return i.Tags }),
+	"last_seen": timeField(func(i *item) *time.Time { return i.LastSeen }),
+}
+
+func listItems(t *testing.T, query url.Values, items []*item) ([]*item, string) {
+	t.Helper()
+
+	var r = httptest.NewRequest("GET", "/?"+query.Encode(), nil)
+	l, err := parseListing(r, itemFields, listOptions{Key: "id", Sort: "id"})
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", query.Encode(), err)
+	}
+
+	page, err := l.apply(items)
+	if err != nil {
+		t.Fatalf("failed to apply %q: %v", query.Encode(), err)
+	}
+
+	return page.Items.([]*item), page.Next
+}
+
+func ids(items []*item) (ids []int) {
+	for _, i := range items {
+		ids = append(ids, i.ID)
+	}
+	return ids
+}
+
+func TestListing(t *testing.T) {
+	var day = func(d int) *time.Time { var t = time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC); return &t }
+	var items = []*item{
+		{ID: 1, Name: "web", Tags: []string{"tag:server"}, LastSeen: day(3)},
+		{ID: 2, Name: "laptop", LastSeen: day(1)},
+		{ID: 3, Name: "db", Tags: []string{"tag:server", "tag:prod"}, LastSeen: day(2)},
+		{ID: 4, Name: "Webcam"},
+	}
+
+	var cases = []struct {
+		query    url.Values
+		expected []int
+	}{
+		{url.Values{}, []int{1, 2, 3, 4}},
+		{url.Values{"filter": {"tag=tag:server"}}, []int{1, 3}},
+		{url.Values{"filter": {"tag!=tag:server"}}, []int{2, 4}},
+		{url.Values{"filter": {"tag=tag:server", "tag=tag:prod"}}, []int{3}},
+		{url.Values{"filter": {"last_seen<2024-01-03"}}, []int{2, 3, 4}},
+		{url.Values{"filter": {"last_seen>=2024-01-02T00:00:00Z"}}, []int{1, 3}},
+		{url.Values{"filter": {"name~WEB"}}, []int{1, 4}},
+		{url.Values{"filter": {"id>2"}}, []int{3, 4}},
+		{url.Values{"sort": {"-last_seen"}}, []int{1, 3, 2, 4}},
+		{url.Values{"sort": {"name"}}, []int{4, 3, 2, 1}},
+		{url.Values{"sort": {"-id"}}, []int{4, 3, 2, 1}},
+	}
+
+	for _, c := range cases {
+		if got, _ := listItems(t, c.query, items); !slices.Equal(ids(got), c.expected) {
+			t.Errorf("%q: expected %v, got %v", c.query.Encode(), c.expected, ids(got))
+		}
+	}
+}
+
+func TestListing_Cursor(t *testing.T) {
+	var items []*item
+	for id := 1; id <= 5; id++ {
+		items = append(items, &item{ID: id, Name: []string{"b", "a"}[id%2]})
+	}
+
+	var query = url.Values{"sort": {"name"}, "limit": {"2"}}
+	var seen []int
+	for {
+		page, next := listItems(t, query, items)
+		seen = append(seen, ids(page)...)
+		if next == "" {
+			break
+		}
+		query.Set("cursor", next)
+	}
+
+	if expected := []int{1, 3, 5, 2, 4}; !slices.Equal(seen, expected) {
+		t.Errorf("expected %v, got %v", expected, seen)
+	}
+
+	// cursors are bound to the sort order they were issued for
+	query.Set("sort", "-name")
+	if _, err := parseListing(httptest.NewRequest("GET", "/?"+query.Encode(), nil), itemFields, listOptions{Key: "id", Sort: "id"}); err == nil {
+		t.Errorf("expected cursor to be rejected")
+	}
+}
+
+func TestListing_Fields(t *testing.T) {
+	var r = httptest.NewRequest("GET", "/?fields=id,name", nil)
+	l, err := parseListing(r, itemFields, listOptions{Key: "id", Sort: "id"})
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	page, err := l.apply([]*item{{ID: 1, Name: "web", Tags: []string{"tag:server"}}})
+	if err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+
+	if buf, _ := json.Marshal(page.Items); string(buf) != `[{"id":1,"name":"web"}]` {
+		t.Errorf("unexpected items: %s", buf)
+	}
+}
+
+func TestListing_Invalid(t *testing.T) {
+	for _, q := range []string{"filter=unknown=1", "filter=tag<x", "filter=id~1", "filter=last_seen<yesterday", "sort=tag", "limit=0", "cursor=junk"} {
+		if _, err := parseListing(httptest.NewRequest("GET", "/?"+q, nil), itemFields, listOptions{Key: "id", Sort: "id"}); err == nil {
+			t.Errorf("%s: expected an error", q)
+		}
+	}
+}
@@ -0,0 +1,979 @@
+package api
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/tacl"
+	"github.com/riyaz-ali/wirefire/internal/coordinator"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/firewall"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"tailscale.com/util/dnsname"
+	"time"
+)
+
+// Machine is the api representation of a domain.Machine
+type Machine struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	NodeKey   string `json:"node_key"`
+	IPv4      string `json:"ipv4"`
+	IPv6      string `json:"ipv6"`
+	TailnetID int    `json:"tailnet_id"`
+	User      string `json:"user"`
+
+	Tags      []string         `json:"tags,omitempty"`
+	LastAddr  string           `json:"last_addr,omitempty"`
+	Location  *domain.Location `json:"location,omitempty"`
+	Endpoints []Endpoint       `json:"endpoints"` // magicsock endpoints last reported by the machine
+
+	Hostname string `json:"hostname,omitempty"` // hostname reported by the machine, which it's named after unless given or generated a name
+
+	GivenName     bool `json:"given_name"`     // named by an admin, rather than after the machine's hostname
+	Hidden        bool `json:"hidden"`         // hidden from peers' netmaps due to the tailnet's offline policy
+	AlwaysVisible bool `json:"always_visible"` // exempt from the tailnet's offline policy
+	ForceDerp     bool `json:"force_derp"`     // connections to and from the machine are relayed over derp
+	Locked        bool `json:"locked"`         // exempt from the tailnet's expired machine retention policy
+	Authorized    bool `json:"authorized"`     // approved by an admin, in tailnets that require device approval
+	LoggedOut     bool `json:"logged_out"`     // logged out by its user, until it logs in again
+
+	Site string `json:"site,omitempty"` // location the machine is at; see domain.Machine.Site
+
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+}
+
+// Endpoint is the api representation of a machine's tailcfg.Endpoint
+type Endpoint struct {
+	Addr string `json:"addr"`
+	Type string `json:"type"` // source of the endpoint; one of local, stun, portmap, stun4localport, explicitconf or ? if unknown
+}
+
+func NewMachine(m *domain.Machine) *Machine {
+	var _, v6 = m.IP()
+	var machine = &Machine{
+		ID:        m.ID,
+		Name:      m.CompleteName(),
+		NodeKey:   m.NodeKey.String(),
+		IPv4:      m.IPv4.String(),
+		IPv6:      v6.String(),
+		TailnetID: m.TailnetID,
+		User:      m.Owner.Subject,
+		Tags:      m.AssignedTags,
+		Location:  m.Location,
+		Hidden:    m.IsHidden(),
+		CreatedAt: m.CreatedAt,
+		ExpiresAt: m.ExpiresAt,
+		LastSeen:  m.LastSeen,
+
+		GivenName:     m.GivenName,
+		AlwaysVisible: m.AlwaysVisible,
+		ForceDerp:     m.ForceDerp,
+		Locked:        m.Locked,
+		Authorized:    m.Authorized,
+		LoggedOut:     m.LoggedOut,
+		Site:          m.Site,
+	}
+
+	if m.HostInfo != nil {
+		machine.Hostname = m.HostInfo.Hostname
+	}
+
+	if m.LastAddr.IsValid() {
+		machine.LastAddr = m.LastAddr.String()
+	}
+
+	machine.Endpoints = make([]Endpoint, 0, len(m.Endpoints))
+	for _, ep := range m.Endpoints {
+		machine.Endpoints = append(machine.Endpoints, Endpoint{Addr: ep.Addr.String(), Type: ep.Type.String()})
+	}
+
+	return machine
+}
+
+// machineFields are the fields machines can be filtered and sorted on (see: parseListing)
+var machineFields = map[string]field[Machine]{
+	"id":         intField(func(m *Machine) int { return m.ID }),
+	"name":       stringField(func(m *Machine) string { return m.Name }),
+	"hostname":   stringField(func(m *Machine) string { return m.Hostname }),
+	"user":       stringField(func(m *Machine) string { return m.User }),
+	"ipv4":       stringField(func(m *Machine) string { return m.IPv4 }),
+	"site":       stringField(func(m *Machine) string { return m.Site }),
+	"tag":        listField(func(m *Machine) []string { return m.Tags }),
+	"hidden":     boolField(func(m *Machine) bool { return m.Hidden }),
+	"authorized": boolField(func(m *Machine) bool { return m.Authorized }),
+	"locked":     boolField(func(m *Machine) bool { return m.Locked }),
+	"logged_out": boolField(func(m *Machine) bool { return m.LoggedOut }),
+	"created_at": timeField(func(m *Machine) *time.Time { return &m.CreatedAt }),
+	"expires_at": timeField(func(m *Machine) *time.Time { return &m.ExpiresAt }),
+	"last_seen":  timeField(func(m *Machine) *time.Time { return m.LastSeen }),
+}
+
+// ListMachines serves the GET /tailnets/{tailnet}/machines endpoint and lists all machines in the tailnet.
+//
+// Results can be filtered and sorted (see: parseListing) on the id, name, hostname, user, ipv4, site, tag, hidden,
+// authorized, locked, logged_out, created_at, expires_at and last_seen fields; eg. ?filter=tag=tag:server&sort=-last_seen.
+// Machines that have never connected sort before all others on last_seen.
+func ListMachines(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var list *listing[Machine]
+		if list, err = parseListing(r, machineFields, listOptions{Key: "id", Sort: "id"}); err != nil {
+			return nil, err
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machines []*domain.Machine
+		if machines, err = database.FetchMany(conn, domain.ListMachines(&domain.Tailnet{ID: tid})); err != nil {
+			return nil, err
+		}
+
+		var result = make([]*Machine, 0, len(machines))
+		for _, m := range machines {
+			result = append(result, NewMachine(m))
+		}
+
+		return list.apply(result)
+	}
+}
+
+// GetMachine serves the GET /tailnets/{tailnet}/machines/{machine} endpoint
+func GetMachine(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		if machine, err = findMachine(conn, tid, mid); err != nil {
+			return nil, err
+		}
+
+		return NewMachine(machine), nil
+	}
+}
+
+// findMachine returns the machine identified by mid in the given tailnet, or a not found Error
+func findMachine(conn *sqlite.Conn, tid, mid int) (*domain.Machine, error) {
+	machines, err := database.FetchMany(conn, domain.ListMachines(&domain.Tailnet{ID: tid}))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range machines {
+		if m.ID == mid {
+			return m, nil
+		}
+	}
+
+	return nil, &Error{Status: http.StatusNotFound, Message: "machine not found"}
+}
+
+// ExportFilter serves the GET /tailnets/{tailnet}/machines/{machine}/filter endpoint and renders the machine's
+// compiled packet filter as host firewall rules. The output format is selected using the ?format= query
+// parameter (one of nftables, iptables or ip6tables; defaults to nftables).
+func ExportFilter(pool *sqlitex.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := zerolog.Ctx(r.Context())
+
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			http.Error(w, "invalid tailnet id", http.StatusBadRequest)
+			return
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			http.Error(w, "invalid machine id", http.StatusBadRequest)
+			return
+		}
+
+		var format = firewall.Format(r.URL.Query().Get("format"))
+		if format == "" {
+			format = firewall.Nftables
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machines []*domain.Machine
+		if machines, err = database.FetchMany(conn, domain.ListMachines(&domain.Tailnet{ID: tid})); err != nil {
+			log.Error().Err(err).Msg("failed to list machines")
+			http.Error(w, "failed to list machines", http.StatusInternalServerError)
+			return
+		}
+
+		// split the list into the requested machine and its peers, and compile the filter the same way the mapper does
+		var machine *domain.Machine
+		var peers = make([]tacl.Machine, 0, len(machines))
+		for _, m := range machines {
+			if m.ID == mid {
+				machine = m
+			} else if !m.IsHidden() {
+				peers = append(peers, m)
+			}
+		}
+
+		if machine == nil {
+			http.Error(w, "machine not found", http.StatusNotFound)
+			return
+		}
+
+		rules := machine.Tailnet.Acl.BuildFilter(machine, peers)
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		comment := fmt.Sprintf("packet filter for %s (tailnet %s)\ngenerated by wirefire at %s", machine.CompleteName(), machine.Tailnet.Name, time.Now().UTC().Format(time.RFC3339))
+		if err = firewall.Render(w, format, rules, firewall.Options{Comment: comment}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+}
+
+// SetMachineVisibility serves the PUT /tailnets/{tailnet}/machines/{machine}/visibility endpoint. Setting always_visible
+// exempts the machine from the tailnet's offline policy, un-hiding it from its peers' netmaps with their next update.
+func SetMachineVisibility(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		AlwaysVisible bool `json:"always_visible"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if machine, err = findMachine(conn, tid, mid); err != nil {
+				return err
+			}
+
+			if _, err = database.Exec(conn, domain.SetMachineVisibility(machine, req.AlwaysVisible)); err != nil {
+				return err
+			}
+
+			machine.AlwaysVisible = req.AlwaysVisible
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineVisibilityChanged, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid), Data: map[string]string{"always_visible": strconv.FormatBool(req.AlwaysVisible)}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.MachineUpdated, Tailnet: tid, Machine: machine.ID})
+
+		return NewMachine(machine), nil
+	}
+}
+
+// SetMachineRelay serves the PUT /tailnets/{tailnet}/machines/{machine}/relay endpoint. Setting force_derp forces all
+// connections to and from the machine to be relayed over derp; the machine and its peers pick up the change right away.
+func SetMachineRelay(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		ForceDerp bool `json:"force_derp"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if machine, err = findMachine(conn, tid, mid); err != nil {
+				return err
+			}
+
+			if _, err = database.Exec(conn, domain.SetMachineForceDerp(machine, req.ForceDerp)); err != nil {
+				return err
+			}
+
+			machine.ForceDerp = req.ForceDerp
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineRelayChanged, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid), Data: map[string]string{"force_derp": strconv.FormatBool(req.ForceDerp)}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.MachineUpdated, Tailnet: tid, Machine: machine.ID})
+
+		return NewMachine(machine), nil
+	}
+}
+
+// SetMachineSite serves the PUT /tailnets/{tailnet}/machines/{machine}/site endpoint, and assigns the machine to a site; an
+// empty site removes it from its site. Machines at the same site connect over their local endpoints, while connections
+// between machines at different sites are relayed over derp; the machine and its peers pick up the change right away.
+func SetMachineSite(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Site string `json:"site"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		if req.Site = strings.ToLower(req.Site); req.Site != "" && dnsname.ValidLabel(req.Site) != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: domain.ErrInvalidSite.Error()}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if machine, err = findMachine(conn, tid, mid); err != nil {
+				return err
+			}
+
+			if _, err = database.Exec(conn, domain.SetMachineSite(machine, req.Site)); err != nil {
+				return err
+			}
+
+			var previous = machine.Site
+			machine.Site = req.Site
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineSiteChanged, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid), Data: map[string]string{"site": req.Site, "previous_site": previous}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.MachineUpdated, Tailnet: tid, Machine: machine.ID})
+
+		return NewMachine(machine), nil
+	}
+}
+
+// SetMachineLock serves the PUT /tailnets/{tailnet}/machines/{machine}/lock endpoint. A locked machine is exempt
+// from the tailnet's delete_expired_after policy, and isn't deleted once its key has expired.
+func SetMachineLock(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Locked bool `json:"locked"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if machine, err = findMachine(conn, tid, mid); err != nil {
+				return err
+			}
+
+			if _, err = database.Exec(conn, domain.SetMachineLocked(machine, req.Locked)); err != nil {
+				return err
+			}
+
+			machine.Locked = req.Locked
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineLockChanged, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid), Data: map[string]string{"locked": strconv.FormatBool(req.Locked)}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return NewMachine(machine), nil
+	}
+}
+
+// AuthorizeMachine serves the PUT /tailnets/{tailnet}/machines/{machine}/authorized endpoint, and approves (or revokes the
+// approval of) a machine in a tailnet that requires device approval. Machines pending approval can't connect to their peers.
+func AuthorizeMachine(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Authorized bool `json:"authorized"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if machine, err = findMachine(conn, tid, mid); err != nil {
+				return err
+			}
+
+			if _, err = database.Exec(conn, domain.SetMachineAuthorized(machine, req.Authorized)); err != nil {
+				return err
+			}
+
+			machine.Authorized = req.Authorized
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineAuthorized, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid), Data: map[string]string{"authorized": strconv.FormatBool(req.Authorized)}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.MachineUpdated, Tailnet: tid, Machine: machine.ID})
+
+		return NewMachine(machine), nil
+	}
+}
+
+// ExpireMachine serves the POST /tailnets/{tailnet}/machines/{machine}/expire endpoint and expires the machine's key
+// right away. The machine must re-authenticate (using tailscale up --force-reauth) before it can connect to its peers again.
+func ExpireMachine(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		return setKeyExpiry(r, pool, tid, mid, time.Now().UTC(), domain.ActionMachineKeyExpired)
+	}
+}
+
+// RenewMachine serves the POST /tailnets/{tailnet}/machines/{machine}/renew endpoint and extends the machine's key expiry
+// by the given duration, or by the configured default key expiry if none is given. A zero duration disables key expiry.
+func RenewMachine(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Expiry string `json:"expiry"` // duration after which the key expires, eg. 720h
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		var expiresAt time.Time
+		if expiresAt, err = parseExpiry(req.Expiry); err != nil {
+			return nil, err
+		}
+
+		return setKeyExpiry(r, pool, tid, mid, expiresAt, domain.ActionMachineKeyRenewed)
+	}
+}
+
+// parseExpiry returns the time at which a key renewed now, to expire after the given duration (eg. 720h), expires. An empty
+// duration uses the configured key expiry, and a zero duration returns the zero time, meaning that the key never expires.
+func parseExpiry(duration string) (time.Time, error) {
+	if duration == "" {
+		return coordinator.KeyExpiryAt(time.Now().UTC()), nil
+	}
+
+	expiry, err := time.ParseDuration(duration)
+	if err != nil || expiry < 0 {
+		return time.Time{}, &Error{Status: http.StatusBadRequest, Message: "invalid expiry duration"}
+	}
+
+	if expiry == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Now().UTC().Add(expiry), nil
+}
+
+// UpdateMachine serves the PATCH /tailnets/{tailnet}/machines/{machine} endpoint, and renames the machine and / or renews its key.
+//
+// A name given to the machine is kept even if the machine's hostname changes later; an empty name reverts to the name derived
+// from the hostname. Peers pick up the new name (and its MagicDNS record) right away, without the machine having to re-register.
+func UpdateMachine(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Name   *string `json:"name"`
+		Expiry *string `json:"expiry"` // duration after which the key expires, eg. 720h; 0 disables expiry
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		var expiresAt time.Time
+		if req.Expiry != nil {
+			if expiresAt, err = parseExpiry(*req.Expiry); err != nil {
+				return nil, err
+			}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if machine, err = findMachine(conn, tid, mid); err != nil {
+				return err
+			}
+
+			if req.Name != nil {
+				var previous = machine.CompleteName()
+				if err = coordinator.RenameMachine(conn, machine, *req.Name); err != nil {
+					return err
+				}
+
+				event := &domain.AuditEvent{Action: domain.ActionMachineRenamed, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid), Data: map[string]string{"previous_name": previous, "given": strconv.FormatBool(machine.GivenName)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.Expiry != nil {
+				if _, err = database.Exec(conn, domain.ExpireNode(machine, expiresAt)); err != nil {
+					return err
+				}
+
+				machine.ExpiresAt = expiresAt
+
+				event := &domain.AuditEvent{Action: domain.ActionMachineKeyRenewed, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid), Data: map[string]string{"expires_at": expiresAt.Format(time.RFC3339)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+
+		if errors.Is(err, domain.ErrInvalidMachineName) || errors.Is(err, domain.ErrHostnameReserved) {
+			return nil, &Error{Status: http.StatusBadRequest, Message: err.Error()}
+		} else if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.MachineUpdated, Tailnet: tid, Machine: machine.ID})
+
+		return NewMachine(machine), nil
+	}
+}
+
+// setKeyExpiry updates the machine's key expiry, recording the action in the audit log. Peers are notified
+// of the change (as an incremental patch) so that they stop, or resume, talking to the machine.
+func setKeyExpiry(r *http.Request, pool *sqlitex.Pool, tid, mid int, expiresAt time.Time, action string) (_ any, err error) {
+	conn := pool.Get(r.Context())
+	defer pool.Put(conn)
+
+	var machine *domain.Machine
+	err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+		if machine, err = findMachine(conn, tid, mid); err != nil {
+			return err
+		}
+
+		if _, err = database.Exec(conn, domain.ExpireNode(machine, expiresAt)); err != nil {
+			return err
+		}
+
+		machine.ExpiresAt = expiresAt
+
+		event := &domain.AuditEvent{Action: action, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid), Data: map[string]string{"expires_at": expiresAt.Format(time.RFC3339)}}
+		_, err = database.Exec(conn, domain.RecordEvent(event))
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	notifier.Publish(notifier.Event{Kind: notifier.MachineUpdated, Tailnet: tid, Machine: machine.ID})
+
+	return NewMachine(machine), nil
+}
+
+// DeleteMachine serves the DELETE /tailnets/{tailnet}/machines/{machine} endpoint and deletes the machine.
+// The machine's own sessions are terminated, and its peers stop seeing it, right away.
+func DeleteMachine(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if machine, err = findMachine(conn, tid, mid); err != nil {
+				return err
+			}
+
+			if _, err = database.Exec(conn, domain.DeleteNode(machine)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineDeleted, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid)}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.MachineDeleted, Tailnet: tid, Machine: machine.ID})
+		return struct{}{}, nil
+	}
+}
+
+// ListRoutes serves the GET /tailnets/{tailnet}/machines/{machine}/routes endpoint and lists the subnet routes
+// advertised by the machine, along with their approval status
+func ListRoutes(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		if machine, err = findMachine(conn, tid, mid); err != nil {
+			return nil, err
+		}
+
+		return database.FetchMany(conn, domain.ListRoutes(machine))
+	}
+}
+
+// ListHealthWarnings serves the GET /tailnets/{tailnet}/health and /tailnets/{tailnet}/machines/{machine}/health
+// endpoints, and lists the health warnings currently reported by the clients of the tailnet's (or the given) machines.
+func ListHealthWarnings(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var mid int
+		if param := chi.URLParam(r, "machine"); param != "" {
+			if mid, err = strconv.Atoi(param); err != nil {
+				return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+			}
+
+			if _, err = findMachine(conn, tid, mid); err != nil {
+				return nil, err
+			}
+		}
+
+		return database.FetchMany(conn, domain.ListHealthWarnings(int64(tid), int64(mid)))
+	}
+}
+
+// GetMachineUptime serves the GET /tailnets/{tailnet}/machines/{machine}/uptime endpoint, and reports the machine's online / offline
+// transitions, and the fraction of time it was online, over the window given by ?window= (default 24h, limited by the presence retention).
+func GetMachineUptime(pool *sqlitex.Pool) HandlerFunc {
+	type Response struct {
+		Since        time.Time          `json:"since"`
+		Until        time.Time          `json:"until"`
+		Uptime       float64            `json:"uptime"`       // seconds the machine was online within the window
+		Availability float64            `json:"availability"` // fraction of the window the machine was online, between 0 and 1
+		Transitions  []*domain.Presence `json:"transitions"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		var window = 24 * time.Hour
+		if v := r.URL.Query().Get("window"); v != "" {
+			if window, err = time.ParseDuration(v); err != nil || window <= 0 {
+				return nil, &Error{Status: http.StatusBadRequest, Message: "invalid window"}
+			}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		if machine, err = findMachine(conn, tid, mid); err != nil {
+			return nil, err
+		}
+
+		var resp = &Response{Until: time.Now().UTC()}
+		resp.Since = resp.Until.Add(-window)
+
+		if resp.Transitions, err = database.FetchMany(conn, domain.ListPresence(machine, resp.Since)); err != nil {
+			return nil, err
+		}
+
+		var uptime = domain.Uptime(resp.Transitions, resp.Since, resp.Until)
+		resp.Uptime, resp.Availability = uptime.Seconds(), uptime.Seconds()/window.Seconds()
+
+		return resp, nil
+	}
+}
+
+// DiagnosePath serves the GET /tailnets/{tailnet}/machines/{machine}/path/{peer} endpoint, and reports the likely connection path
+// between the machine and its peer (direct over the lan, direct over the internet, or relayed over derp), along with the reasons for it.
+func DiagnosePath(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		pid, err := strconv.Atoi(chi.URLParam(r, "peer"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid peer id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine, peer *domain.Machine
+		if machine, err = findMachine(conn, tid, mid); err != nil {
+			return nil, err
+		}
+
+		if peer, err = findMachine(conn, tid, pid); err != nil {
+			return nil, err
+		}
+
+		return domain.DiagnosePath(machine, peer), nil
+	}
+}
+
+// ListExitNodes serves the GET /tailnets/{tailnet}/exit-nodes endpoint and lists the tailnet's exit nodes, along with
+// the machines using each of them. Usage is only known for machines whose clients report the exit node they're using.
+func ListExitNodes(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		return database.FetchMany(conn, domain.ListExitNodeUsage(int64(tid)))
+	}
+}
+
+// SetRoutes serves the PUT /tailnets/{tailnet}/machines/{machine}/routes endpoint. It approves the given subnet routes,
+// which must've been advertised by the machine, and un-approves all others; peers pick up the change right away.
+func SetRoutes(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Approved []netip.Prefix `json:"approved"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		var routes []*domain.Route
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if machine, err = findMachine(conn, tid, mid); err != nil {
+				return err
+			}
+
+			if routes, err = database.FetchMany(conn, domain.ListRoutes(machine)); err != nil {
+				return err
+			}
+
+			var approved = make([]netip.Prefix, 0, len(req.Approved))
+			for _, prefix := range req.Approved {
+				if !slices.ContainsFunc(routes, func(route *domain.Route) bool { return route.Prefix == prefix.Masked() }) {
+					return &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("route %s is not advertised by the machine", prefix)}
+				}
+
+				if addr, ok, err := coordinator.CheckRouteOverlap(conn, machine.Tailnet, prefix.Masked()); err != nil {
+					return err
+				} else if ok {
+					return &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("route %s overlaps the address %s of a machine in the tailnet", prefix, addr)}
+				}
+				approved = append(approved, prefix.Masked())
+			}
+
+			if _, err = database.Exec(conn, domain.SetApprovedRoutes(machine, approved)); err != nil {
+				return err
+			}
+
+			if routes, err = database.FetchMany(conn, domain.ListRoutes(machine)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineRoutesChanged, Actor: actorFrom(r.Context()), Target: machine.CompleteName(), TailnetID: util.ToPtr(tid), Data: map[string]string{"approved": fmt.Sprint(approved)}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.MachineUpdated, Tailnet: tid, Machine: machine.ID})
+
+		return routes, nil
+	}
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memberFields are the fields members can be filtered and sorted on (see: parseListing)
+var memberFields = map[string]field[domain.Member]{
+	"user_id":    intField(func(m *domain.Member) int { return m.UserID }),
+	"user":       stringField(func(m *domain.Member) string { return m.Subject }),
+	"name":       stringField(func(m *domain.Member) string { return m.Name }),
+	"role":       stringField(func(m *domain.Member) string { return m.Role }),
+	"created_at": timeField(func(m *domain.Member) *time.Time { return &m.CreatedAt }),
+}
+
+// ListMembers serves the GET /tailnets/{tailnet}/members endpoint and lists all members of the tailnet.
+//
+// Results can be filtered and sorted (see: parseListing) on the user_id, user, name, role and created_at fields;
+// eg. ?filter=role=admin&sort=name.
+func ListMembers(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var list *listing[domain.Member]
+		if list, err = parseListing(r, memberFields, listOptions{Key: "user_id", Sort: "user_id"}); err != nil {
+			return nil, err
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var members []*domain.Member
+		if members, err = database.FetchMany(conn, domain.ListMembers(int64(tid))); err != nil {
+			return nil, err
+		}
+
+		if members == nil {
+			members = []*domain.Member{}
+		}
+
+		return list.apply(members)
+	}
+}
+
+// AddMember serves the POST /tailnets/{tailnet}/members endpoint and adds the user (identified by their subject) to
+// the tailnet. Users that have never logged in are provisioned, so that they can join the tailnet on their first login.
+func AddMember(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		User string `json:"user"`
+		Role string `json:"role"` // one of owner, admin, auditor or member; defaults to member
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		if req.User = strings.TrimSpace(req.User); req.User == "" {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "user is required"}
+		}
+
+		if req.Role == "" {
+			req.Role = domain.RoleMember
+		} else if !domain.IsValidRole(req.Role) {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "role must be one of owner, admin, auditor or member"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var member *domain.Member
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			var tailnet *domain.Tailnet
+			if tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(tid))); err != nil {
+				return err
+			} else if tailnet == nil {
+				return &Error{Status: http.StatusNotFound, Message: "tailnet not found"}
+			}
+
+			var user *domain.User
+			if user, err = database.FetchOne(conn, domain.UserBySubject(req.User)); err != nil {
+				return err
+			} else if user == nil { // user has never logged in; add a placeholder
+				if user, err = database.FetchOne(conn, domain.EnsureUser(req.User)); err != nil {
+					return err
+				}
+			}
+
+			var current *string
+			if current, err = database.FetchOne(conn, domain.MemberRole(user, int64(tid))); err != nil {
+				return err
+			} else if current == nil {
+				current = util.ToPtr("")
+			}
+
+			if err = checkOwnership(r.Context(), conn, tid, *current, req.Role); err != nil {
+				return err
+			}
+
+			if member, err = database.FetchOne(conn, domain.SaveMember(int64(tid), user, req.Role)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionMemberAdded, Actor: actorFrom(r.Context()), Target: user.Subject, TailnetID: util.ToPtr(tid), Data: map[string]string{"role": req.Role}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		return member, err
+	}
+}
+
+// UpdateMember serves the PUT /tailnets/{tailnet}/members/{user} endpoint and changes the member's role.
+// Only owners can grant the owner role, or change the role of another owner.
+func UpdateMember(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Role string `json:"role"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		uid, err := strconv.Atoi(chi.URLParam(r, "user"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid user id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		if !domain.IsValidRole(req.Role) {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "role must be one of owner, admin, auditor or member"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var member *domain.Member
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			var user *domain.User
+			if user, err = database.FetchOne(conn, domain.UserById(int64(uid))); err != nil {
+				return err
+			} else if user == nil {
+				return &Error{Status: http.StatusNotFound, Message: "member not found"}
+			}
+
+			if current, err := database.FetchOne(conn, domain.MemberRole(user, int64(tid))); err != nil {
+				return err
+			} else if current == nil {
+				return &Error{Status: http.StatusNotFound, Message: "member not found"}
+			} else if err = checkOwnership(r.Context(), conn, tid, *current, req.Role); err != nil {
+				return err
+			}
+
+			if member, err = database.FetchOne(conn, domain.SaveMember(int64(tid), user, req.Role)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionMemberUpdated, Actor: actorFrom(r.Context()), Target: user.Subject, TailnetID: util.ToPtr(tid), Data: map[string]string{"role": req.Role}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		// the member's machines may be granted different capabilities with the new role
+		notifier.Publish(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: tid})
+		return member, nil
+	}
+}
+
+// RemoveMember serves the DELETE /tailnets/{tailnet}/members/{user} endpoint and removes the user from the tailnet.
+// All machines owned by the user in the tailnet are deleted, and their sessions terminated.
+func RemoveMember(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		uid, err := strconv.Atoi(chi.URLParam(r, "user"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid user id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var events []notifier.Event
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			var user *domain.User
+			if user, err = database.FetchOne(conn, domain.UserById(int64(uid))); err != nil {
+				return err
+			} else if user == nil {
+				return &Error{Status: http.StatusNotFound, Message: "member not found"}
+			}
+
+			if current, err := database.FetchOne(conn, domain.MemberRole(user, int64(tid))); err != nil {
+				return err
+			} else if current == nil {
+				return &Error{Status: http.StatusNotFound, Message: "member not found"}
+			} else if err = checkOwnership(r.Context(), conn, tid, *current, ""); err != nil {
+				return err
+			}
+
+			var machines []*domain.Machine
+			if machines, err = database.FetchMany(conn, domain.ListMachines(&domain.Tailnet{ID: tid})); err != nil {
+				return err
+			}
+
+			for _, m := range machines {
+				if m.UserID == user.ID {
+					events = append(events, notifier.Event{Kind: notifier.MachineDeleted, Tailnet: tid, Machine: m.ID})
+				}
+			}
+
+			if _, err = database.Exec(conn, domain.RemoveMember(int64(tid), user.ID)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionMemberRemoved, Actor: actorFrom(r.Context()), Target: user.Subject, TailnetID: util.ToPtr(tid), Data: map[string]string{"machines": strconv.Itoa(len(events))}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(events...)
+		return struct{}{}, nil
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ListNotices serves the GET /notices endpoint and returns all notices, including the expired ones
+func ListNotices(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (any, error) {
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		return database.FetchMany(conn, domain.ListNotices())
+	}
+}
+
+// CreateNotice serves the POST /notices endpoint and creates a new notice, delivered to clients as a health message.
+//
+// A notice is delivered to all machines unless it's scoped to a tailnet (using tailnet_id) or a machine (using machine_id).
+func CreateNotice(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		var notice *domain.Notice
+		if notice, err = decode[domain.Notice](r); err != nil {
+			return nil, err
+		}
+
+		if notice.Message = strings.TrimSpace(notice.Message); notice.Message == "" {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "message is required"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) error {
+			if notice, err = database.FetchOne(conn, domain.CreateNotice(notice)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionNoticeCreated, Actor: actorFrom(r.Context()), Target: strconv.Itoa(notice.ID), TailnetID: notice.TailnetID, Data: map[string]string{"message": notice.Message}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		var tailnet = notifier.All
+		if notice.TailnetID != nil {
+			tailnet = *notice.TailnetID
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.NoticesChanged, Tailnet: tailnet})
+
+		return notice, nil
+	}
+}
+
+// DeleteNotice serves the DELETE /notices/{id} endpoint. Clients stop receiving the notice with their next map update.
+func DeleteNotice(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid notice id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) error {
+			if _, err := database.Exec(conn, domain.DeleteNotice(id)); err != nil {
+				return err
+			}
+
+			_, err := database.Exec(conn, domain.RecordEvent(&domain.AuditEvent{Action: domain.ActionNoticeDeleted, Actor: actorFrom(r.Context()), Target: strconv.Itoa(id)}))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.NoticesChanged, Tailnet: notifier.All})
+
+		return struct{}{}, nil
+	}
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/tacl"
+	"github.com/riyaz-ali/wirefire/internal/coordinator"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// sharedPolicyName matches valid shared policy names
+var sharedPolicyName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ListSharedPolicies serves the GET /policies endpoint and lists all shared policies
+func ListSharedPolicies(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		return database.FetchMany(conn, domain.ListSharedPolicies())
+	}
+}
+
+// GetSharedPolicy serves the GET /policies/{name} endpoint and returns the shared policy
+func GetSharedPolicy(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var policy *domain.SharedPolicy
+		if policy, err = database.FetchOne(conn, domain.SharedPolicyByName(chi.URLParam(r, "name"))); err != nil {
+			return nil, err
+		} else if policy == nil {
+			return nil, &Error{Status: http.StatusNotFound, Message: "shared policy not found"}
+		}
+
+		return policy, nil
+	}
+}
+
+// UpdateSharedPolicy serves the PUT /policies/{name} endpoint and creates, or replaces, the shared policy with the HuJSON
+// document in the request body. The policies of tailnets that include it are resolved again, and must be valid (with
+// their tests passing) for the change to be saved. Connected machines of those tailnets receive updated packet filters right away.
+func UpdateSharedPolicy(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		var name = chi.URLParam(r, "name")
+		if !sharedPolicyName.MatchString(name) {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid shared policy name"}
+		}
+
+		var policy []byte
+		if policy, err = io.ReadAll(io.LimitReader(r.Body, 1<<20)); err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "failed to read request body: " + err.Error()}
+		}
+
+		if err = domain.ValidateSharedPolicy(policy); err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid shared policy: " + err.Error()}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var saved *domain.SharedPolicy
+		var events []notifier.Event
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if saved, err = database.FetchOne(conn, domain.SaveSharedPolicy(name, policy)); err != nil {
+				return err
+			}
+
+			var tailnets []*domain.Tailnet
+			if tailnets, err = includedBy(conn, name); err != nil {
+				return err
+			}
+
+			var audit = []*domain.AuditEvent{{Action: domain.ActionSharedPolicyUpdated, Actor: actorFrom(r.Context()), Target: name}}
+			for _, tailnet := range tailnets {
+				var source = []byte(tailnet.AclSource)
+
+				resolved, acl, tests, err := resolvePolicy(conn, source)
+				if err != nil {
+					return withTailnet(err, tailnet)
+				}
+
+				if err = runPolicyTests(conn, tailnet, acl, tests); err != nil {
+					return withTailnet(err, tailnet)
+				}
+
+				if _, err = database.Exec(conn, domain.SetTailnetPolicy(tailnet, resolved, source)); err != nil {
+					return err
+				}
+
+				if err = coordinator.ReapproveRoutes(conn, tailnet); err != nil {
+					return err
+				}
+
+				audit = append(audit, &domain.AuditEvent{Action: domain.ActionPolicyUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"shared_policy": name}})
+				events = append(events, notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: tailnet.ID})
+			}
+
+			_, err = database.Exec(conn, domain.RecordEvent(audit...))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(events...)
+		return saved, nil
+	}
+}
+
+// DeleteSharedPolicy serves the DELETE /policies/{name} endpoint and deletes the shared policy.
+// A policy that's still included by a tailnet's policy cannot be deleted.
+func DeleteSharedPolicy(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		var name = chi.URLParam(r, "name")
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if policy, err := database.FetchOne(conn, domain.SharedPolicyByName(name)); err != nil {
+				return err
+			} else if policy == nil {
+				return &Error{Status: http.StatusNotFound, Message: "shared policy not found"}
+			}
+
+			var tailnets []*domain.Tailnet
+			if tailnets, err = includedBy(conn, name); err != nil {
+				return err
+			} else if len(tailnets) > 0 {
+				var names = make([]string, 0, len(tailnets))
+				for _, t := range tailnets {
+					names = append(names, t.Name)
+				}
+
+				return &Error{Status: http.StatusConflict, Message: "shared policy is included by tailnet(s): " + strings.Join(names, ", ")}
+			}
+
+			if _, err = database.Exec(conn, domain.DeleteSharedPolicy(name)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionSharedPolicyDeleted, Actor: actorFrom(r.Context()), Target: name}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return struct{}{}, nil
+	}
+}
+
+// includedBy returns the tailnets whose policy includes the named shared policy
+func includedBy(conn *sqlite.Conn, name string) (_ []*domain.Tailnet, err error) {
+	var tailnets []*domain.Tailnet
+	if tailnets, err = database.FetchMany(conn, domain.ListAllTailnets()); err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(tailnets, func(t *domain.Tailnet) bool {
+		includes, _ := domain.PolicyIncludes([]byte(t.AclSource)) // source was validated when it was saved
+		return !slices.Contains(includes, name)
+	}), nil
+}
+
+// resolvePolicy resolves the shared policies included by the policy document (see domain.ResolvePolicy), and parses
+// the resolved policy. Invalid documents, and missing shared policies, are reported as a bad request Error.
+func resolvePolicy(conn *sqlite.Conn, source []byte) (resolved []byte, acl *tacl.ACL, tests []domain.PolicyTest, err error) {
+	var dbErr error
+	resolved, err = domain.ResolvePolicy(source, func(name string) ([]byte, error) {
+		policy, err := database.FetchOne(conn, domain.SharedPolicyByName(name))
+		if err != nil {
+			dbErr = err
+			return nil, err
+		} else if policy == nil {
+			return nil, domain.ErrSharedPolicyNotFound
+		}
+
+		return []byte(policy.Policy), nil
+	})
+
+	if dbErr != nil {
+		return nil, nil, nil, dbErr
+	} else if err != nil {
+		return nil, nil, nil, &Error{Status: http.StatusBadRequest, Message: "invalid acl policy: " + err.Error()}
+	}
+
+	if acl, tests, err = domain.ParsePolicy(resolved); err != nil {
+		return nil, nil, nil, &Error{Status: http.StatusBadRequest, Message: "invalid acl policy: " + err.Error()}
+	}
+
+	return resolved, acl, tests, nil
+}
+
+// runPolicyTests runs the policy's tests against the tailnet's machines, returning a bad request Error listing any failures
+func runPolicyTests(conn *sqlite.Conn, tailnet *domain.Tailnet, acl *tacl.ACL, tests []domain.PolicyTest) error {
+	if len(tests) == 0 {
+		return nil
+	}
+
+	machines, err := database.FetchMany(conn, domain.ListMachines(tailnet))
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, result := range domain.RunPolicyTests(acl, machines, tests) {
+		failed = append(failed, result.Errors...)
+	}
+
+	if len(failed) > 0 {
+		return &Error{Status: http.StatusBadRequest, Message: "acl policy tests failed: " + strings.Join(failed, "; ")}
+	}
+
+	return nil
+}
+
+// withTailnet prefixes the message of an Error with the tailnet's name, to point out which of the tailnets the error belongs to
+func withTailnet(err error, tailnet *domain.Tailnet) error {
+	var ae *Error
+	if errors.As(err, &ae) {
+		return &Error{Status: ae.Status, Message: fmt.Sprintf("tailnet %s: %s", tailnet.Name, ae.Message)}
+	}
+	return err
+}
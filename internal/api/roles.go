@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"net/http"
+	"strconv"
+)
+
+type roleKey struct{}
+
+// WithRole returns a copy of ctx that carries the caller's role in the tailnet being managed. The api token grants the
+// owner role in every tailnet (see: Authenticate), while the admin console grants the signed-in user's role in the tailnet.
+func WithRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+// roleFrom returns the caller's role added to the context by WithRole; empty if there's none
+func roleFrom(ctx context.Context) string {
+	role, _ := ctx.Value(roleKey{}).(string)
+	return role
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx that carries the name of the caller, which is recorded as the actor of the audit events
+// of the changes it makes. The admin console passes on the signed-in user's login name.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// actorFrom returns the caller's name added to the context by WithActor; "api" (ie. the holder of the api token) if there's none
+func actorFrom(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return "api"
+}
+
+// RequireRole returns a new middleware that only allows callers with (at least) the privileges of the given role through
+func RequireRole(role string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !domain.HasRole(roleFrom(r.Context()), role) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// checkOwnership verifies that the caller may grant the new role to the member, whose current role is given (empty if
+// they aren't a member yet); only owners can grant the owner role, or change the role of other owners. A role of empty
+// removes the member. The last owner of the tailnet can't be demoted or removed, so that it's never left without one.
+func checkOwnership(ctx context.Context, conn *sqlite.Conn, tid int, current, role string) error {
+	if current != domain.RoleOwner && role != domain.RoleOwner {
+		return nil
+	}
+
+	if !domain.HasRole(roleFrom(ctx), domain.RoleOwner) {
+		return &Error{Status: http.StatusForbidden, Message: "only owners can manage the owners of a tailnet"}
+	}
+
+	if current == domain.RoleOwner && role != domain.RoleOwner {
+		if count, err := database.FetchOne(conn, domain.CountOwners(int64(tid))); err != nil {
+			return err
+		} else if *count <= 1 {
+			return &Error{Status: http.StatusConflict, Message: "the last owner of a tailnet can't be demoted or removed"}
+		}
+	}
+
+	return nil
+}
+
+// Role describes a tailnet role, as returned by ListRoles
+type Role struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Console     bool   `json:"console"` // whether users with the role can sign in to the admin console
+	Write       bool   `json:"write"`   // whether users with the role can make changes using the admin console
+}
+
+// ListRoles serves the GET /roles endpoint and lists the roles users can be assigned in a tailnet, most privileged first
+func ListRoles() HandlerFunc {
+	var descriptions = map[string]string{
+		domain.RoleOwner:   "manages the tailnet, including its owners, and can delete it",
+		domain.RoleAdmin:   "manages the tailnet's policy, machines, keys and members, other than its owners",
+		domain.RoleAuditor: "has read-only access to the tailnet's configuration, machines and members",
+		domain.RoleMember:  "registers machines in the tailnet; has no access to the admin console",
+	}
+
+	return func(r *http.Request) (any, error) {
+		var roles = make([]*Role, 0, len(domain.Roles))
+		for _, name := range domain.Roles {
+			roles = append(roles, &Role{
+				Name: name, Description: descriptions[name],
+				Console: domain.HasRole(name, domain.RoleAuditor), Write: domain.HasRole(name, domain.RoleAdmin),
+			})
+		}
+
+		return roles, nil
+	}
+}
+
+// ListUserRoles serves the GET /users/{user}/roles endpoint and lists the user's role in each of the tailnets they're a member of
+func ListUserRoles(pool *sqlitex.Pool) HandlerFunc {
+	type Membership struct {
+		TailnetID int    `json:"tailnet_id"`
+		Tailnet   string `json:"tailnet"`
+		Role      string `json:"role"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		uid, err := strconv.Atoi(chi.URLParam(r, "user"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid user id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var user *domain.User
+		if user, err = database.FetchOne(conn, domain.UserById(int64(uid))); err != nil {
+			return nil, err
+		} else if user == nil {
+			return nil, &Error{Status: http.StatusNotFound, Message: "user not found"}
+		}
+
+		var tailnets []*domain.Tailnet
+		if tailnets, err = database.FetchMany(conn, domain.ListTailnets(user)); err != nil {
+			return nil, err
+		}
+
+		var memberships = make([]*Membership, 0, len(tailnets))
+		for _, t := range tailnets {
+			memberships = append(memberships, &Membership{TailnetID: t.ID, Tailnet: t.Name, Role: t.Role})
+		}
+
+		return memberships, nil
+	}
+}
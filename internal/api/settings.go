@@ -0,0 +1,94 @@
+package api
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"io"
+	"net/http"
+)
+
+// ListSettings serves the GET /settings endpoint and returns all runtime settings along with their current values
+func ListSettings() HandlerFunc {
+	return func(r *http.Request) (any, error) { return settings.List(), nil }
+}
+
+// GetSetting serves the GET /settings/{key} endpoint and returns a single runtime setting
+func GetSetting() HandlerFunc {
+	return func(r *http.Request) (any, error) {
+		info, err := settings.Describe(chi.URLParam(r, "key"))
+		if errors.Is(err, settings.ErrUnknownSetting) {
+			return nil, &Error{Status: http.StatusNotFound, Message: "unknown setting"}
+		}
+
+		return info, err
+	}
+}
+
+// UpdateSetting serves the PUT /settings/{key} endpoint. The request body must contain the json-encoded value of the setting.
+func UpdateSetting(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		var name = chi.URLParam(r, "key")
+
+		var value json.RawMessage
+		if value, err = io.ReadAll(io.LimitReader(r.Body, 64<<10)); err != nil || !json.Valid(value) {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "request body must be valid json"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) error {
+			// record the event first, as settings.Set() updates the in-memory value immediately
+			event := &domain.AuditEvent{Action: domain.ActionSettingUpdated, Actor: actorFrom(r.Context()), Target: name, Data: map[string]string{"value": string(value)}}
+			if _, err := database.Exec(conn, domain.RecordEvent(event)); err != nil {
+				return err
+			}
+
+			return settings.Set(conn, name, value)
+		})
+
+		var invalid *settings.InvalidValueError
+		if errors.Is(err, settings.ErrUnknownSetting) {
+			return nil, &Error{Status: http.StatusNotFound, Message: "unknown setting"}
+		} else if errors.As(err, &invalid) {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid value: " + invalid.Err.Error()}
+		} else if err != nil {
+			return nil, err
+		}
+
+		return settings.Describe(name)
+	}
+}
+
+// ResetSetting serves the DELETE /settings/{key} endpoint and resets the setting to its default value
+func ResetSetting(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		var name = chi.URLParam(r, "key")
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) error {
+			event := &domain.AuditEvent{Action: domain.ActionSettingReset, Actor: actorFrom(r.Context()), Target: name}
+			if _, err := database.Exec(conn, domain.RecordEvent(event)); err != nil {
+				return err
+			}
+
+			return settings.Reset(conn, name)
+		})
+
+		if errors.Is(err, settings.ErrUnknownSetting) {
+			return nil, &Error{Status: http.StatusNotFound, Message: "unknown setting"}
+		} else if err != nil {
+			return nil, err
+		}
+
+		return settings.Describe(name)
+	}
+}
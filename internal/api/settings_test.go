@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"crawshaw.io/sqlite/sqlitex"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/database/schema"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testLimit = settings.Define("test.limit", 10, "limit used by the api tests")
+
+// open opens a new, file-backed database pool and applies the schema
+func open(t *testing.T) *sqlitex.Pool {
+	t.Helper()
+
+	pool, err := sqlitex.Open("file:"+filepath.Join(t.TempDir(), "wirefire.db"), 0, 2)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+
+	conn := pool.Get(context.Background())
+	defer pool.Put(conn)
+
+	if err = schema.Apply(conn); err != nil {
+		t.Fatalf("failed to apply schema: %v", err)
+	}
+
+	return pool
+}
+
+// serve sends the request to the handler and returns the response
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	var w, r = httptest.NewRecorder(), httptest.NewRequest(method, target, strings.NewReader(body))
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestSettings(t *testing.T) {
+	var pool = open(t)
+
+	var r = chi.NewRouter()
+	r.Method(http.MethodGet, "/settings/{key}", GetSetting())
+	r.Method(http.MethodPut, "/settings/{key}", UpdateSetting(pool))
+	r.Method(http.MethodDelete, "/settings/{key}", ResetSetting(pool))
+
+	var value = func(w *httptest.ResponseRecorder) any {
+		var info settings.Info
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatalf("failed to decode setting: %v", err)
+		}
+		return info.Value
+	}
+
+	t.Run("Read", func(t *testing.T) {
+		var w = serve(r, http.MethodGet, "/settings/test.limit", "")
+		if w.Code != http.StatusOK || value(w) != float64(10) {
+			t.Errorf("expected default value; got %d %s", w.Code, w.Body)
+		}
+
+		if w = serve(r, http.MethodGet, "/settings/test.unknown", ""); w.Code != http.StatusNotFound {
+			t.Errorf("expected unknown setting to be not found; got %d", w.Code)
+		}
+	})
+
+	t.Run("Set", func(t *testing.T) {
+		var w = serve(r, http.MethodPut, "/settings/test.limit", "25")
+		if w.Code != http.StatusOK || value(w) != float64(25) || testLimit.Get() != 25 {
+			t.Fatalf("expected setting to be updated; got %d %s", w.Code, w.Body)
+		}
+
+		conn := pool.Get(context.Background())
+		defer pool.Put(conn)
+
+		stored, err := database.FetchMany(conn, domain.ListSettings())
+		if err != nil || len(stored) != 1 || string(stored[0].Value) != "25" {
+			t.Errorf("expected setting to be persisted; got %v (err: %v)", stored, err)
+		}
+
+		if w = serve(r, http.MethodDelete, "/settings/test.limit", ""); w.Code != http.StatusOK || testLimit.Get() != 10 {
+			t.Errorf("expected setting to be reset; got %d %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("Reject", func(t *testing.T) {
+		var cases = []struct {
+			name, key, body string
+			want            int
+		}{
+			{"InvalidJson", "test.limit", "{", http.StatusBadRequest},
+			{"WrongType", "test.limit", `"many"`, http.StatusBadRequest},
+			{"UnknownSetting", "test.unknown", "1", http.StatusNotFound},
+		}
+
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				if w := serve(r, http.MethodPut, "/settings/"+tc.key, tc.body); w.Code != tc.want {
+					t.Errorf("expected status %d; got %d %s", tc.want, w.Code, w.Body)
+				}
+
+				if testLimit.Get() != 10 {
+					t.Errorf("expected rejected value not to be applied; got %d", testLimit.Get())
+				}
+			})
+		}
+	})
+
+	t.Run("InternalError", func(t *testing.T) {
+		conn := pool.Get(context.Background())
+		if err := sqlitex.ExecScript(conn, "DROP TABLE settings;"); err != nil {
+			t.Fatalf("failed to drop settings: %v", err)
+		}
+		pool.Put(conn)
+
+		var w = serve(r, http.MethodPut, "/settings/test.limit", "25")
+		if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "settings") {
+			t.Errorf("expected internal error without details; got %d %s", w.Code, w.Body)
+		}
+	})
+}
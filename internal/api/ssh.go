@@ -0,0 +1,136 @@
+package api
+
+import (
+	"crawshaw.io/sqlite/sqlitex"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/coordinator"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/rs/zerolog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListSSHSessions serves the GET /tailnets/{tailnet}/ssh-sessions and /tailnets/{tailnet}/machines/{machine}/ssh-sessions
+// endpoints, and returns the most recent tailscale ssh session events of the tailnet, or of connections made from or to the machine.
+//
+// The number of results can be controlled using ?limit= (default 100, max 1000).
+func ListSSHSessions(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var limit = 100
+		if v := r.URL.Query().Get("limit"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > 1000 {
+				return nil, &Error{Status: http.StatusBadRequest, Message: "invalid limit"}
+			}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var mid int
+		if param := chi.URLParam(r, "machine"); param != "" {
+			if mid, err = strconv.Atoi(param); err != nil {
+				return nil, &Error{Status: http.StatusBadRequest, Message: "invalid machine id"}
+			}
+
+			if _, err = findMachine(conn, tid, mid); err != nil {
+				return nil, err
+			}
+		}
+
+		return database.FetchMany(conn, domain.ListSSHSessions(int64(tid), int64(mid), limit))
+	}
+}
+
+// ExportSSHPrincipals serves the GET /tailnets/{tailnet}/machines/{machine}/ssh-principals endpoint, and renders the
+// principals that may log in to the machine as the local user given by ?user=, as per the tailnet's ssh policy
+// (see: coordinator.AuthorizedPrincipals). It lets hosts that run OpenSSH's sshd, rather than tailscale ssh, enforce
+// the same policy; eg. with AuthorizedPrincipalsCommand set to a script that fetches this endpoint for %u.
+//
+// The output format is selected using the ?format= query parameter; either principals (the default), which renders an
+// authorized_principals file, or authorized_keys, which renders a cert-authority line trusting the user certificate
+// authority whose public key is given by ?ca=, for the principals.
+func ExportSSHPrincipals(pool *sqlitex.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := zerolog.Ctx(r.Context())
+
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			http.Error(w, "invalid tailnet id", http.StatusBadRequest)
+			return
+		}
+
+		mid, err := strconv.Atoi(chi.URLParam(r, "machine"))
+		if err != nil {
+			http.Error(w, "invalid machine id", http.StatusBadRequest)
+			return
+		}
+
+		var q = r.URL.Query()
+		var user, ca = q.Get("user"), strings.TrimSpace(q.Get("ca"))
+		if user == "" {
+			http.Error(w, "user is required", http.StatusBadRequest)
+			return
+		}
+
+		var format = q.Get("format")
+		switch format {
+		case "", "principals":
+		case "authorized_keys":
+			if ca == "" {
+				http.Error(w, "ca is required by the authorized_keys format", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "unknown format "+strconv.Quote(format), http.StatusBadRequest)
+			return
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var machines []*domain.Machine
+		if machines, err = database.FetchMany(conn, domain.ListMachines(&domain.Tailnet{ID: tid})); err != nil {
+			log.Error().Err(err).Msg("failed to list machines")
+			http.Error(w, "failed to list machines", http.StatusInternalServerError)
+			return
+		}
+
+		var machine *domain.Machine
+		for _, m := range machines {
+			if m.ID == mid {
+				machine = m
+			}
+		}
+
+		if machine == nil {
+			http.Error(w, "machine not found", http.StatusNotFound)
+			return
+		}
+
+		principals := coordinator.AuthorizedPrincipals(machine, machines, user)
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = fmt.Fprintf(w, "# ssh principals of %s for %s (tailnet %s)\n# generated by wirefire at %s\n",
+			machine.CompleteName(), user, machine.Tailnet.Name, time.Now().UTC().Format(time.RFC3339))
+
+		if format == "authorized_keys" {
+			if len(principals) > 0 { // without principals, sshd would accept any of the ca's certificates issued for the user
+				_, _ = fmt.Fprintf(w, "cert-authority,principals=\"%s\" %s\n", strings.Join(principals, ","), ca)
+			}
+			return
+		}
+
+		for _, p := range principals {
+			_, _ = fmt.Fprintln(w, p)
+		}
+	}
+}
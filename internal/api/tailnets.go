@@ -0,0 +1,682 @@
+package api
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/coordinator"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/ipam"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/tailscale/hujson"
+	"io"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"tailscale.com/tailcfg"
+	"time"
+)
+
+// Tailnet is the api representation of a domain.Tailnet
+type Tailnet struct {
+	ID                 int    `json:"id"`
+	Name               string `json:"name"`
+	HideOfflineAfter   int    `json:"hide_offline_after"`   // days after which offline machines are hidden from peers; 0 if disabled
+	DeleteExpiredAfter int    `json:"delete_expired_after"` // days after which expired machines are deleted; 0 if disabled
+	ForceDerp          bool   `json:"force_derp"`           // connections between all machines in the tailnet are relayed over derp
+	RequireApproval    bool   `json:"require_approval"`     // new machines must be approved by an admin before they can connect to peers
+	Naming             string `json:"naming"`               // how new machines are named; one of hostname or words
+	IPv4Pool           string `json:"ipv4_pool"`            // prefix machines are allocated ipv4 addresses from; empty if the global default is used
+	IPv6Pool           string `json:"ipv6_pool"`            // prefix machines are allocated ipv6 addresses from; empty if the global default is used
+
+	Capabilities map[string][]tailcfg.NodeCapability `json:"capabilities"` // node capabilities granted to machines, keyed by the owner's role
+	DNS          domain.DNS                          `json:"dns"`          // fallback resolvers and split dns routes
+	Welcome      domain.Welcome                      `json:"welcome"`      // message shown to users when they add a new device
+	Features     domain.Features                     `json:"features"`     // client features enabled for the tailnet's machines
+	Privacy      domain.Privacy                      `json:"privacy"`      // host details redacted from peers' netmaps
+	Guardrails   domain.Guardrails                   `json:"guardrails"`   // thresholds on the size of netmaps sent to machines
+	Logging      domain.Logging                      `json:"logging"`      // whether machines stream their client logs, and where to
+
+	// Netmap is the size of the netmaps recently sent to the tailnet's machines; level is exceeded if they're past the guardrails
+	Netmap *coordinator.NetmapStatus `json:"netmap,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func NewTailnet(t *domain.Tailnet) *Tailnet {
+	v4, _ := t.IPv4Pool.MarshalText() // zero value is marshalled as empty string
+	v6, _ := t.IPv6Pool.MarshalText()
+
+	return &Tailnet{ID: t.ID, Name: t.Name, HideOfflineAfter: t.HideOfflineAfter, DeleteExpiredAfter: t.DeleteExpiredAfter, ForceDerp: t.ForceDerp, RequireApproval: t.RequireApproval, Naming: t.Naming, IPv4Pool: string(v4), IPv6Pool: string(v6), Capabilities: t.Capabilities, DNS: t.DNS, Welcome: t.Welcome, Features: t.Features, Privacy: t.Privacy, Guardrails: t.Guardrails, Logging: t.Logging, Netmap: coordinator.Netmap(t.ID), CreatedAt: t.CreatedAt, UpdatedAt: t.UpdatedAt}
+}
+
+// ListTailnets serves the GET /tailnets endpoint and lists all tailnets managed by the server
+func ListTailnets(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var tailnets []*domain.Tailnet
+		if tailnets, err = database.FetchMany(conn, domain.ListAllTailnets()); err != nil {
+			return nil, err
+		}
+
+		var result = make([]*Tailnet, 0, len(tailnets))
+		for _, t := range tailnets {
+			result = append(result, NewTailnet(t))
+		}
+
+		return result, nil
+	}
+}
+
+// GetTailnet serves the GET /tailnets/{tailnet} endpoint
+func GetTailnet(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var tailnet *domain.Tailnet
+		if tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(tid))); err != nil {
+			return nil, err
+		} else if tailnet == nil {
+			return nil, &Error{Status: http.StatusNotFound, Message: "tailnet not found"}
+		}
+
+		return NewTailnet(tailnet), nil
+	}
+}
+
+// CreateTailnet serves the POST /tailnets endpoint and creates a new tailnet with the default, allow-all policy.
+// The tailnet has no members; use the members endpoints to let users join it.
+func CreateTailnet(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Name string `json:"name"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		if req.Name = strings.TrimSpace(req.Name); req.Name == "" {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "name is required"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var tailnet *domain.Tailnet
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if tailnet, err = database.FetchOne(conn, domain.CreateTailnet(req.Name)); err != nil {
+				var se sqlite.Error
+				if errors.As(err, &se) && se.Code == sqlite.SQLITE_CONSTRAINT_UNIQUE {
+					return &Error{Status: http.StatusConflict, Message: "a tailnet with the same name already exists"}
+				}
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionTailnetCreated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID)}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return NewTailnet(tailnet), nil
+	}
+}
+
+// DeleteTailnet serves the DELETE /tailnets/{tailnet} endpoint and deletes the tailnet, along with all its
+// members, machines and auth keys. Sessions of all machines in the tailnet are terminated.
+func DeleteTailnet(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var events []notifier.Event
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			var tailnet *domain.Tailnet
+			if tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(tid))); err != nil {
+				return err
+			} else if tailnet == nil {
+				return &Error{Status: http.StatusNotFound, Message: "tailnet not found"}
+			}
+
+			var machines []*domain.Machine
+			if machines, err = database.FetchMany(conn, domain.ListMachines(tailnet)); err != nil {
+				return err
+			}
+
+			for _, m := range machines {
+				events = append(events, notifier.Event{Kind: notifier.MachineDeleted, Tailnet: tailnet.ID, Machine: m.ID})
+			}
+			events = append(events, notifier.Event{Kind: notifier.TailnetDeleted, Tailnet: tailnet.ID})
+
+			if _, err = database.Exec(conn, domain.DeleteTailnet(tailnet)); err != nil {
+				return err
+			}
+
+			// the tailnet's own audit events are deleted along with it; record this event globally instead
+			event := &domain.AuditEvent{Action: domain.ActionTailnetDeleted, Actor: actorFrom(r.Context()), Target: tailnet.Name, Data: map[string]string{"machines": strconv.Itoa(len(machines))}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(events...)
+		return struct{}{}, nil
+	}
+}
+
+// GetPolicy serves the GET /tailnets/{tailnet}/acl endpoint and returns the tailnet's acl policy document. With
+// ?resolved=true, the policy is returned with the shared policies it includes resolved, as it's applied to machines.
+func GetPolicy(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		resolved, _ := strconv.ParseBool(r.URL.Query().Get("resolved"))
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var policy *string
+		if policy, err = database.FetchOne(conn, domain.TailnetPolicy(int64(tid), resolved)); err != nil {
+			return nil, err
+		} else if policy == nil {
+			return nil, &Error{Status: http.StatusNotFound, Message: "tailnet not found"}
+		}
+
+		// policies are stored as submitted, ie. as HuJSON; use the policy history to get the document with comments
+		var buf []byte
+		if buf, err = hujson.Standardize([]byte(*policy)); err != nil {
+			return nil, err
+		}
+
+		return json.RawMessage(buf), nil
+	}
+}
+
+// ListPolicyHistory serves the GET /tailnets/{tailnet}/acl/history endpoint and returns all revisions
+// of the tailnet's acl policy, most recent first.
+func ListPolicyHistory(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		return database.FetchMany(conn, domain.ListPolicyHistory(int64(tid)))
+	}
+}
+
+// TestPolicy serves the POST /tailnets/{tailnet}/acl/test endpoint and evaluates acl tests, like tailscale's
+// policy file tests, without saving anything. The tests run against the given policy (or the tailnet's current
+// policy, if none is given) and use the given tests (or the ones declared in the policy, if none are given).
+func TestPolicy(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		Policy string              `json:"policy"` // HuJSON policy document
+		Tests  []domain.PolicyTest `json:"tests"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var tailnet *domain.Tailnet
+		if tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(tid))); err != nil {
+			return nil, err
+		} else if tailnet == nil {
+			return nil, &Error{Status: http.StatusNotFound, Message: "tailnet not found"}
+		}
+
+		var policy = []byte(req.Policy)
+		if req.Policy == "" {
+			var current *string
+			if current, err = database.FetchOne(conn, domain.TailnetPolicy(int64(tid), false)); err != nil {
+				return nil, err
+			}
+			policy = []byte(*current)
+		}
+
+		_, acl, tests, err := resolvePolicy(conn, policy)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(req.Tests) > 0 {
+			tests = req.Tests
+		}
+
+		var machines []*domain.Machine
+		if machines, err = database.FetchMany(conn, domain.ListMachines(tailnet)); err != nil {
+			return nil, err
+		}
+
+		return domain.RunPolicyTests(acl, machines, tests), nil
+	}
+}
+
+// UpdatePolicy serves the PUT /tailnets/{tailnet}/acl endpoint and replaces the tailnet's acl policy with the
+// HuJSON policy document in the request body. The policy is validated, and the tests declared in it must pass,
+// before it's saved (and recorded in the policy's history). Connected machines receive updated packet filters right away.
+//
+// The policy may include shared policies (see UpdateSharedPolicy) by listing their names in its include section.
+func UpdatePolicy(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var policy []byte
+		if policy, err = io.ReadAll(io.LimitReader(r.Body, 1<<20)); err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "failed to read request body: " + err.Error()}
+		}
+
+		var includes []string
+		if includes, err = domain.PolicyIncludes(policy); err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid acl policy: " + err.Error()}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			var tailnet *domain.Tailnet
+			if tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(tid))); err != nil {
+				return err
+			} else if tailnet == nil {
+				return &Error{Status: http.StatusNotFound, Message: "tailnet not found"}
+			}
+
+			resolved, acl, tests, err := resolvePolicy(conn, policy)
+			if err != nil {
+				return err
+			}
+
+			if err = runPolicyTests(conn, tailnet, acl, tests); err != nil {
+				return err
+			}
+
+			var source []byte // the submitted policy is only stored separately if it includes shared policies
+			if len(includes) > 0 {
+				source = policy
+			}
+
+			if _, err = database.Exec(conn, domain.SetTailnetPolicy(tailnet, resolved, source)); err != nil {
+				return err
+			}
+
+			// approve advertised routes that the updated policy's autoApprovers permit
+			if err = coordinator.ReapproveRoutes(conn, tailnet); err != nil {
+				return err
+			}
+
+			if _, err = database.Exec(conn, domain.SavePolicyRevision(tailnet, policy, "api")); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionPolicyUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID)}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: tid})
+
+		buf, _ := hujson.Standardize(policy) // already validated by PolicyIncludes
+		return json.RawMessage(buf), nil
+	}
+}
+
+// UpdateTailnet serves the PATCH /tailnets/{tailnet} endpoint and updates the tailnet's policies.
+func UpdateTailnet(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		HideOfflineAfter   *int    `json:"hide_offline_after"`
+		DeleteExpiredAfter *int    `json:"delete_expired_after"`
+		ForceDerp          *bool   `json:"force_derp"`
+		RequireApproval    *bool   `json:"require_approval"`
+		Naming             *string `json:"naming"`
+
+		Capabilities map[string][]tailcfg.NodeCapability `json:"capabilities"`
+		DNS          *domain.DNS                         `json:"dns"`
+		Welcome      *domain.Welcome                     `json:"welcome"`
+		Features     *domain.Features                    `json:"features"`
+		Privacy      *domain.Privacy                     `json:"privacy"`
+		Guardrails   *domain.Guardrails                  `json:"guardrails"`
+		Logging      *domain.Logging                     `json:"logging"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		if req.HideOfflineAfter != nil && *req.HideOfflineAfter < 0 {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "hide_offline_after must not be negative"}
+		}
+
+		if req.DeleteExpiredAfter != nil && *req.DeleteExpiredAfter < 0 {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "delete_expired_after must not be negative"}
+		}
+
+		for role, capabilities := range req.Capabilities {
+			if !domain.IsValidRole(role) {
+				return nil, &Error{Status: http.StatusBadRequest, Message: "capabilities must be keyed by one of owner, admin, auditor or member"}
+			}
+
+			for _, c := range capabilities {
+				if strings.TrimSpace(string(c)) == "" {
+					return nil, &Error{Status: http.StatusBadRequest, Message: "capabilities must not be empty"}
+				}
+			}
+		}
+
+		if req.DNS != nil {
+			if err = req.DNS.Validate(); err != nil {
+				return nil, &Error{Status: http.StatusBadRequest, Message: err.Error()}
+			}
+		}
+
+		if req.Guardrails != nil {
+			if err = req.Guardrails.Validate(); err != nil {
+				return nil, &Error{Status: http.StatusBadRequest, Message: err.Error()}
+			}
+		}
+
+		if req.Logging != nil {
+			if err = req.Logging.Validate(); err != nil {
+				return nil, &Error{Status: http.StatusBadRequest, Message: err.Error()}
+			}
+		}
+
+		if req.Naming != nil && !domain.IsValidNaming(*req.Naming) {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "naming must be one of hostname or words"}
+		}
+
+		if req.Welcome != nil && len(req.Welcome.Message) > domain.MaxWelcomeLength {
+			return nil, &Error{Status: http.StatusBadRequest, Message: fmt.Sprintf("welcome message must not be longer than %d bytes", domain.MaxWelcomeLength)}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var tailnet *domain.Tailnet
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(tid))); err != nil {
+				return err
+			} else if tailnet == nil {
+				return &Error{Status: http.StatusNotFound, Message: "tailnet not found"}
+			}
+
+			if req.HideOfflineAfter != nil {
+				if _, err = database.Exec(conn, domain.SetHideOfflineAfter(tailnet, *req.HideOfflineAfter)); err != nil {
+					return err
+				}
+
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"hide_offline_after": strconv.Itoa(*req.HideOfflineAfter)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.DeleteExpiredAfter != nil {
+				if _, err = database.Exec(conn, domain.SetDeleteExpiredAfter(tailnet, *req.DeleteExpiredAfter)); err != nil {
+					return err
+				}
+
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"delete_expired_after": strconv.Itoa(*req.DeleteExpiredAfter)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.ForceDerp != nil {
+				if _, err = database.Exec(conn, domain.SetTailnetForceDerp(tailnet, *req.ForceDerp)); err != nil {
+					return err
+				}
+
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"force_derp": strconv.FormatBool(*req.ForceDerp)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.RequireApproval != nil {
+				if _, err = database.Exec(conn, domain.SetTailnetRequireApproval(tailnet, *req.RequireApproval)); err != nil {
+					return err
+				}
+
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"require_approval": strconv.FormatBool(*req.RequireApproval)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.Naming != nil {
+				if _, err = database.Exec(conn, domain.SetTailnetNaming(tailnet, *req.Naming)); err != nil {
+					return err
+				}
+
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"naming": *req.Naming}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.Capabilities != nil {
+				if _, err = database.Exec(conn, domain.SetTailnetCapabilities(tailnet, req.Capabilities)); err != nil {
+					return err
+				}
+
+				buf, _ := json.Marshal(req.Capabilities)
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"capabilities": string(buf)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.DNS != nil {
+				if _, err = database.Exec(conn, domain.SetTailnetDNS(tailnet, req.DNS)); err != nil {
+					return err
+				}
+
+				buf, _ := json.Marshal(req.DNS)
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"dns": string(buf)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.Welcome != nil {
+				if _, err = database.Exec(conn, domain.SetTailnetWelcome(tailnet, req.Welcome)); err != nil {
+					return err
+				}
+
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"welcome": req.Welcome.Message, "welcome_health": strconv.FormatBool(req.Welcome.Health)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.Features != nil {
+				if _, err = database.Exec(conn, domain.SetTailnetFeatures(tailnet, req.Features)); err != nil {
+					return err
+				}
+
+				buf, _ := json.Marshal(req.Features)
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"features": string(buf)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.Privacy != nil {
+				if _, err = database.Exec(conn, domain.SetTailnetPrivacy(tailnet, req.Privacy)); err != nil {
+					return err
+				}
+
+				buf, _ := json.Marshal(req.Privacy)
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"privacy": string(buf)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.Guardrails != nil {
+				if _, err = database.Exec(conn, domain.SetTailnetGuardrails(tailnet, req.Guardrails)); err != nil {
+					return err
+				}
+
+				buf, _ := json.Marshal(req.Guardrails)
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"guardrails": string(buf)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			if req.Logging != nil {
+				if _, err = database.Exec(conn, domain.SetTailnetLogging(tailnet, req.Logging)); err != nil {
+					return err
+				}
+
+				buf, _ := json.Marshal(req.Logging)
+				event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"logging": string(buf)}}
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+			}
+
+			tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(tid)))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: tailnet.ID})
+
+		return NewTailnet(tailnet), nil
+	}
+}
+
+// SetTailnetPools serves the PUT /tailnets/{tailnet}/pools endpoint, and sets the prefixes the tailnet's machines are allocated
+// addresses from; an empty prefix reverts to the global default. Existing machines keep their addresses unless migrate is set,
+// in which case machines with an address outside the new pools are moved into them; peers pick up the new addresses right away.
+func SetTailnetPools(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		IPv4    string `json:"ipv4"`
+		IPv6    string `json:"ipv6"`
+		Migrate bool   `json:"migrate"`
+	}
+
+	type Response struct {
+		*Tailnet
+		Migrated []*Machine `json:"migrated"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		var v4, v6 netip.Prefix
+		if err = v4.UnmarshalText([]byte(req.IPv4)); err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid ipv4 pool"}
+		} else if err = v6.UnmarshalText([]byte(req.IPv6)); err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid ipv6 pool"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var tailnet *domain.Tailnet
+		var migrated []*domain.Machine
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(tid))); err != nil {
+				return err
+			} else if tailnet == nil {
+				return &Error{Status: http.StatusNotFound, Message: "tailnet not found"}
+			}
+
+			if migrated, err = coordinator.SetPools(conn, tailnet, v4.Masked(), v6.Masked(), req.Migrate); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionTailnetUpdated, Actor: actorFrom(r.Context()), Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"ipv4_pool": req.IPv4, "ipv6_pool": req.IPv6, "migrated": strconv.Itoa(len(migrated))}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if errors.Is(err, coordinator.ErrInvalidPool) || errors.Is(err, ipam.ErrExhausted) {
+			return nil, &Error{Status: http.StatusBadRequest, Message: err.Error()}
+		} else if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: tailnet.ID})
+
+		var resp = &Response{Tailnet: NewTailnet(tailnet), Migrated: make([]*Machine, 0, len(migrated))}
+		for _, m := range migrated {
+			resp.Migrated = append(resp.Migrated, NewMachine(m))
+		}
+
+		return resp, nil
+	}
+}
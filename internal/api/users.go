@@ -0,0 +1,166 @@
+package api
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Revocation describes the outcome of revoking a user's access
+type Revocation struct {
+	User          string     `json:"user"`
+	Machines      []*Machine `json:"machines"`  // machines whose keys were expired
+	AuthKeys      []*AuthKey `json:"auth_keys"` // auth keys that were revoked
+	LoginDisabled bool       `json:"login_disabled"`
+}
+
+// RevokeUser serves the POST /users/{user}/revoke endpoint and revokes all access of a (possibly compromised) user, across all
+// tailnets: the keys of the user's machines are expired, their sessions terminated, and the user's auth keys revoked.
+// If disable_login is set, the user can no longer login (or register machines) until their logins are enabled again.
+//
+// All changes are made in a single transaction, and recorded in the audit log.
+func RevokeUser(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		DisableLogin bool `json:"disable_login"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		uid, err := strconv.Atoi(chi.URLParam(r, "user"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid user id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var now = time.Now().UTC()
+		var result = &Revocation{Machines: []*Machine{}, AuthKeys: []*AuthKey{}, LoginDisabled: req.DisableLogin}
+		var events []notifier.Event
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			var user *domain.User
+			if user, err = database.FetchOne(conn, domain.UserById(int64(uid))); err != nil {
+				return err
+			} else if user == nil {
+				return &Error{Status: http.StatusNotFound, Message: "user not found"}
+			}
+
+			result.User = user.Subject
+
+			var tailnets []*domain.Tailnet
+			if tailnets, err = database.FetchMany(conn, domain.ListTailnets(user)); err != nil {
+				return err
+			}
+
+			var audit []*domain.AuditEvent
+			for _, tailnet := range tailnets {
+				var machines []*domain.Machine
+				if machines, err = database.FetchMany(conn, domain.ListMachines(tailnet)); err != nil {
+					return err
+				}
+
+				for _, m := range machines {
+					if m.UserID != user.ID || m.IsExpired() {
+						continue
+					}
+
+					if _, err = database.Exec(conn, domain.ExpireNode(m, now)); err != nil {
+						return err
+					}
+
+					m.ExpiresAt = now
+					result.Machines = append(result.Machines, NewMachine(m))
+
+					audit = append(audit, &domain.AuditEvent{Action: domain.ActionMachineKeyExpired, Actor: actorFrom(r.Context()), Target: m.CompleteName(), TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"expires_at": now.Format(time.RFC3339), "reason": "user_revoked"}})
+					events = append(events, notifier.Event{Kind: notifier.MachineRevoked, Tailnet: tailnet.ID, Machine: m.ID})
+				}
+			}
+
+			var keys []*domain.AuthKey
+			if keys, err = database.FetchMany(conn, domain.RevokeUserAuthKeys(user)); err != nil {
+				return err
+			}
+
+			for _, ak := range keys {
+				result.AuthKeys = append(result.AuthKeys, &AuthKey{AuthKey: ak, Valid: ak.IsValid()})
+				audit = append(audit, &domain.AuditEvent{Action: domain.ActionAuthKeyRevoked, Actor: actorFrom(r.Context()), Target: ak.Prefix, TailnetID: util.ToPtr(ak.TailnetID), Data: map[string]string{"reason": "user_revoked"}})
+			}
+
+			if req.DisableLogin {
+				if _, err = database.Exec(conn, domain.DisableUser(user, true)); err != nil {
+					return err
+				}
+			}
+
+			audit = append(audit, &domain.AuditEvent{
+				Action: domain.ActionUserRevoked,
+				Actor:  "api",
+				Target: user.Subject,
+				Data: map[string]string{
+					"machines":       strconv.Itoa(len(result.Machines)),
+					"auth_keys":      strconv.Itoa(len(result.AuthKeys)),
+					"login_disabled": strconv.FormatBool(req.DisableLogin),
+				},
+			})
+
+			_, err = database.Exec(conn, domain.RecordEvent(audit...))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		notifier.Publish(events...)
+		return result, nil
+	}
+}
+
+// EnableUser serves the POST /users/{user}/enable endpoint and re-enables the logins of a user disabled using RevokeUser.
+// Revoked machines and auth keys are not restored; the machines must re-authenticate, and new auth keys must be created.
+func EnableUser(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		uid, err := strconv.Atoi(chi.URLParam(r, "user"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid user id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			var user *domain.User
+			if user, err = database.FetchOne(conn, domain.UserById(int64(uid))); err != nil {
+				return err
+			} else if user == nil {
+				return &Error{Status: http.StatusNotFound, Message: "user not found"}
+			}
+
+			if _, err = database.Exec(conn, domain.DisableUser(user, false)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionUserEnabled, Actor: actorFrom(r.Context()), Target: user.Subject}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return struct{}{}, nil
+	}
+}
@@ -0,0 +1,14 @@
+package api
+
+import (
+	"github.com/riyaz-ali/wirefire/internal/coordinator"
+	"net/http"
+)
+
+// GetClientVersions serves the GET /versions endpoint and reports the distribution of capability versions presented by
+// clients since the server started, so that operators know when it's safe to raise the minimum supported version.
+func GetClientVersions() HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		return coordinator.Versions(), nil
+	}
+}
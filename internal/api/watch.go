@@ -0,0 +1,125 @@
+package api
+
+import (
+	"crawshaw.io/sqlite/sqlitex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/rs/zerolog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// watchKeepAlive is the interval at which a comment is sent on an idle watch stream, so that proxies don't time it out
+const watchKeepAlive = 30 * time.Second
+
+// names of the machine events sent by WatchMachines, by notifier.Kind
+var watchEvents = map[notifier.Kind]string{
+	notifier.MachineCreated: "machine.created",
+	notifier.MachineUpdated: "machine.updated",
+	notifier.MachineDeleted: "machine.deleted",
+	notifier.MachineRevoked: "machine.revoked",
+	notifier.MachineOnline:  "machine.online",
+	notifier.MachineOffline: "machine.offline",
+}
+
+// WatchMachines serves the GET /tailnets/{tailnet}/watch endpoint, and streams changes to the tailnet's machines as
+// server-sent events, as they happen; ie. when machines register, change (eg. their endpoints), connect or disconnect, and
+// are deleted. The data of each event is the machine, as returned by GetMachine, or just its id if it was deleted, eg.
+//
+//	event: machine.online
+//	data: {"id":42,"name":"laptop",...}
+//
+// Events are dropped if the client doesn't keep up; clients that mirror the tailnet's state should re-list its
+// machines (see: ListMachines) when they (re)connect, and periodically thereafter.
+func WatchMachines(pool *sqlitex.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := zerolog.Ctx(r.Context())
+
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			http.Error(w, "invalid tailnet id", http.StatusBadRequest)
+			return
+		}
+
+		var rc = http.NewResponseController(w)
+		_ = rc.SetWriteDeadline(time.Time{}) // the stream outlives the server's write timeout
+
+		events, unsubscribe := notifier.Subscribe(tid)
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err = rc.Flush(); err != nil {
+			log.Error().Err(err).Msg("watch: streaming not supported")
+			return
+		}
+
+		var keepAlive = time.NewTicker(watchKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case e := <-events:
+				var name, ok = watchEvents[e.Kind]
+				if !ok || e.Machine == 0 {
+					continue
+				}
+
+				var data any = map[string]int{"id": e.Machine}
+				if e.Kind != notifier.MachineDeleted {
+					if machine, err := watchMachine(pool, r, tid, e.Machine); err != nil {
+						log.Error().Err(err).Int("machine", e.Machine).Msg("watch: failed to load machine")
+						return
+					} else if machine == nil {
+						continue // deleted since the event was published
+					} else {
+						data = machine
+					}
+				}
+
+				buf, _ := json.Marshal(data)
+				if _, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, buf); err != nil {
+					return
+				}
+
+			case <-keepAlive.C:
+				if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+
+			case <-r.Context().Done():
+				return
+			}
+
+			if err = rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// watchMachine returns the api representation of the machine; nil if it's not found in the tailnet
+func watchMachine(pool *sqlitex.Pool, r *http.Request, tid, mid int) (_ *Machine, err error) {
+	conn := pool.Get(r.Context())
+	if conn == nil {
+		return nil, r.Context().Err()
+	}
+	defer pool.Put(conn)
+
+	var machine *domain.Machine
+	if machine, err = findMachine(conn, tid, mid); err != nil {
+		var ae *Error
+		if errors.As(err, &ae) && ae.Status == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return NewMachine(machine), nil
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"net/http"
+	"strconv"
+)
+
+// deliveriesLimit is the number of recent deliveries returned by ListWebhookDeliveries
+const deliveriesLimit = 100
+
+// Webhook is the api representation of a domain.Webhook
+type Webhook struct {
+	*domain.Webhook
+
+	// Secret is used to sign deliveries to the webhook (see: webhook.Sign). It's only returned once, when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+// ListWebhooks serves the GET /tailnets/{tailnet}/webhooks endpoint and lists all webhooks registered in the tailnet
+func ListWebhooks(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var webhooks []*domain.Webhook
+		if webhooks, err = database.FetchMany(conn, domain.ListWebhooks(int64(tid))); err != nil {
+			return nil, err
+		}
+
+		var result = make([]*Webhook, 0, len(webhooks))
+		for _, w := range webhooks {
+			result = append(result, &Webhook{Webhook: w})
+		}
+
+		return result, nil
+	}
+}
+
+// CreateWebhook serves the POST /tailnets/{tailnet}/webhooks endpoint and registers a new webhook, that's notified of
+// the given events (eg. node.joined) in the tailnet. A secret is generated to sign the deliveries to the webhook.
+func CreateWebhook(pool *sqlitex.Pool) HandlerFunc {
+	type Request struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		var req *Request
+		if req, err = decode[Request](r); err != nil {
+			return nil, err
+		}
+
+		var buf = make([]byte, 32)
+		_, _ = rand.Read(buf)
+
+		var webhook = &domain.Webhook{TailnetID: tid, URL: req.URL, Events: req.Events, Secret: base64.RawURLEncoding.EncodeToString(buf)}
+		if err = webhook.Validate(); err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: err.Error()}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if webhook, err = database.FetchOne(conn, domain.CreateWebhook(webhook)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionWebhookCreated, Actor: actorFrom(r.Context()), Target: webhook.URL, TailnetID: util.ToPtr(tid), Data: map[string]string{"id": strconv.Itoa(webhook.ID)}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &Webhook{Webhook: webhook, Secret: webhook.Secret}, nil
+	}
+}
+
+// DeleteWebhook serves the DELETE /tailnets/{tailnet}/webhooks/{id} endpoint and deletes the webhook, along with
+// its deliveries. Deliveries that are pending are dropped.
+func DeleteWebhook(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid webhook id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		var webhook *domain.Webhook
+		err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+			if webhook, err = database.FetchOne(conn, domain.DeleteWebhook(int64(tid), id)); err != nil {
+				return err
+			} else if webhook == nil {
+				return &Error{Status: http.StatusNotFound, Message: "webhook not found"}
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionWebhookDeleted, Actor: actorFrom(r.Context()), Target: webhook.URL, TailnetID: util.ToPtr(tid), Data: map[string]string{"id": strconv.Itoa(webhook.ID)}}
+			_, err = database.Exec(conn, domain.RecordEvent(event))
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &Webhook{Webhook: webhook}, nil
+	}
+}
+
+// ListWebhookDeliveries serves the GET /tailnets/{tailnet}/webhooks/{id}/deliveries endpoint and lists the most recent
+// deliveries to the webhook, most recent first, along with the outcome of their last attempt.
+func ListWebhookDeliveries(pool *sqlitex.Pool) HandlerFunc {
+	return func(r *http.Request) (_ any, err error) {
+		tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid tailnet id"}
+		}
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			return nil, &Error{Status: http.StatusBadRequest, Message: "invalid webhook id"}
+		}
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		if webhook, err := database.FetchOne(conn, domain.GetWebhook(int64(tid), id)); err != nil {
+			return nil, err
+		} else if webhook == nil {
+			return nil, &Error{Status: http.StatusNotFound, Message: "webhook not found"}
+		}
+
+		var deliveries []*domain.WebhookDelivery
+		if deliveries, err = database.FetchMany(conn, domain.ListWebhookDeliveries(id, deliveriesLimit)); err != nil {
+			return nil, err
+		}
+
+		return deliveries, nil
+	}
+}
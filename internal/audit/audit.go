@@ -0,0 +1,219 @@
+// Package audit ships the audit log (see: domain.AuditEvent) to external systems, eg. a SIEM, using pluggable exporters.
+//
+// Exporters are configured under audit.exporters, and any number of them can be used simultaneously, eg.
+//
+//	audit:
+//	  exporters:
+//	    - type: stdout
+//	    - type: file
+//	      path: /var/log/wirefire/audit.log
+//	      max_size: 100 # megabytes, after which the file is rotated
+//	      max_files: 5
+//	    - name: siem
+//	      type: http
+//	      url: https://collector.example.com/ingest
+//	      headers: { Authorization: "Bearer secret" }
+//	    - type: syslog
+//	      network: udp
+//	      address: syslog.example.com:514
+//
+// Events are exported as json objects, after they have been committed to the database. Each exporter tracks the last event
+// it has exported, in the database, and resumes from it after a restart or a failure; events are so exported at least once.
+package audit
+
+import (
+	"context"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+	"time"
+)
+
+// Interval is the interval at which newly recorded audit events are exported
+var Interval = settings.Define("audit.export_interval", settings.Duration(5*time.Second),
+	"interval at which newly recorded audit events are shipped to the configured exporters")
+
+func init() {
+	config.RegisterPrefix("audit.exporters")
+}
+
+// batchSize is the maximum number of events handed to an exporter at once
+const batchSize = 500
+
+// Exporter ships audit events to an external system
+type Exporter interface {
+	// Export ships the events, ordered oldest first. Events are retried, with the ones after them, if an error is returned.
+	Export(ctx context.Context, events []*domain.AuditEvent) error
+
+	// Close releases any resources held by the exporter
+	Close() error
+}
+
+// ExporterConfig configures one of the exporters listed under audit.exporters. Options not relevant to the type are ignored.
+type ExporterConfig struct {
+	Type string `mapstructure:"type"` // one of stdout, file, syslog or http
+	Name string `mapstructure:"name"` // unique name of the exporter, used to track its progress; defaults to Type
+
+	// options of the file exporter
+	Path     string `mapstructure:"path"`      // path of the file events are appended to
+	MaxSize  int    `mapstructure:"max_size"`  // size, in megabytes, after which the file is rotated; zero disables rotation
+	MaxFiles int    `mapstructure:"max_files"` // number of rotated files kept around; defaults to 5
+
+	// options of the syslog exporter
+	Network string `mapstructure:"network"` // one of udp, tcp or unix; empty connects to the local syslog daemon
+	Address string `mapstructure:"address"` // address of the syslog server
+	Tag     string `mapstructure:"tag"`     // tag of the messages; defaults to wirefire
+
+	// options of the http exporter
+	URL     string            `mapstructure:"url"`     // url the events are posted to, as a json array
+	Headers map[string]string `mapstructure:"headers"` // headers sent with every request, eg. for authentication
+	Timeout time.Duration     `mapstructure:"timeout"` // timeout of each request; defaults to 10s
+}
+
+// New returns the exporter described by the configuration
+func New(cfg ExporterConfig) (Exporter, error) {
+	switch cfg.Type {
+	case "stdout":
+		return NewStdout(), nil
+	case "file":
+		return NewFile(cfg.Path, cfg.MaxSize, cfg.MaxFiles)
+	case "syslog":
+		return NewSyslog(cfg.Network, cfg.Address, cfg.Tag)
+	case "http":
+		return NewHTTP(cfg.URL, cfg.Headers, cfg.Timeout)
+	default:
+		return nil, errors.Errorf("unknown exporter type %q", cfg.Type)
+	}
+}
+
+// ReadConfig returns the configuration of all exporters
+func ReadConfig() (_ []ExporterConfig, err error) {
+	var configs []ExporterConfig
+	if err = viper.UnmarshalKey("audit.exporters", &configs); err != nil {
+		return nil, errors.Wrap(err, "audit: failed to read exporters")
+	}
+
+	var names = make(map[string]bool)
+	for i := range configs {
+		var ec = &configs[i]
+		if ec.Name == "" {
+			ec.Name = ec.Type
+		}
+
+		if names[ec.Name] {
+			return nil, errors.Errorf("audit: duplicate exporter %q; exporters of the same type must be named", ec.Name)
+		}
+		names[ec.Name] = true
+	}
+
+	return configs, nil
+}
+
+// named is an exporter, along with its name and the id of the last event it has exported
+type named struct {
+	Exporter
+	name   string
+	cursor int
+}
+
+// Run ships newly recorded audit events to the configured exporters every Interval, until the context is cancelled.
+// It blocks and must be run in a goroutine. Exporters are closed when it returns.
+func Run(ctx context.Context, pool *sqlitex.Pool) error {
+	log := zerolog.Ctx(ctx).With().Str("component", "audit").Logger()
+
+	configs, err := ReadConfig()
+	if err != nil || len(configs) == 0 {
+		return err
+	}
+
+	var exporters []*named
+	defer func() {
+		for _, e := range exporters {
+			_ = e.Close()
+		}
+	}()
+
+	conn := pool.Get(ctx)
+	if conn == nil {
+		return ctx.Err()
+	}
+
+	for _, ec := range configs {
+		var e = &named{name: ec.Name}
+		if e.Exporter, err = New(ec); err != nil {
+			pool.Put(conn)
+			return errors.Wrapf(err, "audit: failed to create exporter %q", ec.Name)
+		}
+		exporters = append(exporters, e)
+
+		// record the cursor of new exporters right away, so that they start from the events recorded from now on
+		var cursor *int
+		if cursor, err = database.FetchOne(conn, domain.GetAuditCursor(e.name)); err == nil {
+			e.cursor = *cursor
+			_, err = database.Exec(conn, domain.SetAuditCursor(e.name, e.cursor))
+		}
+
+		if err != nil {
+			pool.Put(conn)
+			return errors.Wrapf(err, "audit: failed to read cursor of exporter %q", ec.Name)
+		}
+	}
+	pool.Put(conn)
+
+	var ticker = time.NewTicker(time.Duration(Interval.Get()))
+	defer ticker.Stop()
+
+	changes, unwatch := settings.Watch(Interval.Name)
+	defer unwatch()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, e := range exporters {
+				if err := export(ctx, pool, e); err != nil {
+					log.Error().Err(err).Str("exporter", e.name).Msg("failed to export audit events")
+				}
+			}
+
+		case <-changes:
+			ticker.Reset(time.Duration(Interval.Get()))
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// export ships all events recorded after the exporter's cursor, in batches, advancing the cursor after each
+func export(ctx context.Context, pool *sqlitex.Pool, e *named) error {
+	conn := pool.Get(ctx)
+	if conn == nil {
+		return ctx.Err()
+	}
+	defer pool.Put(conn)
+
+	for {
+		events, err := database.FetchMany(conn, domain.ListAuditEventsAfter(e.cursor, batchSize))
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		if err = e.Export(ctx, events); err != nil {
+			return err
+		}
+
+		e.cursor = events[len(events)-1].ID
+		if _, err = database.Exec(conn, domain.SetAuditCursor(e.name, e.cursor)); err != nil {
+			return err
+		}
+
+		if len(events) < batchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// lines writes the events to w as json lines
+func lines(w io.Writer, events []*domain.AuditEvent) error {
+	var enc = json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stdout exports events to the standard output, as json lines
+type Stdout struct{}
+
+// NewStdout returns a new Stdout exporter
+func NewStdout() *Stdout { return &Stdout{} }
+
+func (*Stdout) Export(_ context.Context, events []*domain.AuditEvent) error {
+	return lines(os.Stdout, events)
+}
+func (*Stdout) Close() error { return nil }
+
+// File exports events to a file, as json lines. Once the file grows beyond its maximum size, it's rotated;
+// ie. renamed to <path>.1 (and any previously rotated files to <path>.2, <path>.3 and so on), and a new file is started.
+type File struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+
+	maxSize  int64
+	maxFiles int
+}
+
+// NewFile returns a new File exporter appending to the file at path, which is rotated once it grows beyond maxSize megabytes
+func NewFile(path string, maxSize, maxFiles int) (*File, error) {
+	if path == "" {
+		return nil, errors.New("path is required")
+	}
+
+	if maxFiles <= 0 {
+		maxFiles = 5
+	}
+
+	var f = &File{path: path, maxSize: int64(maxSize) << 20, maxFiles: maxFiles}
+	return f, f.open()
+}
+
+// open opens (or creates) the file at path for appending
+func (f *File) open() (err error) {
+	if f.file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640); err != nil {
+		return err
+	}
+
+	var fi os.FileInfo
+	if fi, err = f.file.Stat(); err != nil {
+		return err
+	}
+
+	f.size = fi.Size()
+	return nil
+}
+
+// rotate shifts the rotated files by one, dropping the oldest, and starts a new file
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *File) Export(_ context.Context, events []*domain.AuditEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := lines(&buf, events); err != nil {
+		return err
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(buf.Len()) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return errors.Wrap(err, "failed to rotate file")
+		}
+	}
+
+	n, err := f.file.Write(buf.Bytes())
+	f.size += int64(n)
+	return err
+}
+
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Close()
+}
+
+// HTTP exports events to a remote collector, posting each batch of events as a json array
+type HTTP struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewHTTP returns a new HTTP exporter posting events to url, with the given headers
+func NewHTTP(url string, headers map[string]string, timeout time.Duration) (*HTTP, error) {
+	if url == "" {
+		return nil, errors.New("url is required")
+	}
+
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &HTTP{url: url, headers: headers, client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (h *HTTP) Export(ctx context.Context, events []*domain.AuditEvent) error {
+	buf, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range h.headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode >= 300 {
+		return errors.Errorf("collector responded with %s", res.Status)
+	}
+
+	return nil
+}
+
+func (*HTTP) Close() error { return nil }
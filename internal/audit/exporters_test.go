@@ -0,0 +1,46 @@
+package audit
+
+import (
+	"context"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFile_Rotate(t *testing.T) {
+	var path = filepath.Join(t.TempDir(), "audit.log")
+
+	f, err := NewFile(path, 1, 2)
+	if err != nil {
+		t.Fatalf("failed to create exporter: %v", err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+
+	// each batch is a little over half a megabyte, so that every batch after the first rotates the file
+	var batch = func(id int) []*domain.AuditEvent {
+		return []*domain.AuditEvent{{ID: id, Action: domain.ActionMachineCreated, Target: strings.Repeat("x", 600<<10)}}
+	}
+
+	for id := 1; id <= 4; id++ {
+		if err = f.Export(context.Background(), batch(id)); err != nil {
+			t.Fatalf("failed to export batch %d: %v", id, err)
+		}
+	}
+
+	for name, id := range map[string]string{"audit.log": `"id":4`, "audit.log.1": `"id":3`, "audit.log.2": `"id":2`} {
+		buf, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+
+		if !strings.HasPrefix(string(buf), "{"+id) {
+			t.Errorf("expected %s to hold event %s", name, id)
+		}
+	}
+
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only max_files rotated files to be kept")
+	}
+}
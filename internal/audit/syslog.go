@@ -0,0 +1,43 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"log/syslog"
+)
+
+// Syslog exports events to a syslog daemon, local or remote, one json object per message
+type Syslog struct{ w *syslog.Writer }
+
+// NewSyslog returns a new Syslog exporter connected to the daemon at address, or to the local daemon if network is empty
+func NewSyslog(network, address, tag string) (*Syslog, error) {
+	if tag == "" {
+		tag = "wirefire"
+	}
+
+	w, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Syslog{w: w}, nil
+}
+
+func (s *Syslog) Export(_ context.Context, events []*domain.AuditEvent) error {
+	for _, e := range events {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		if err = s.w.Info(string(buf)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Syslog) Close() error { return s.w.Close() }
@@ -0,0 +1,20 @@
+//go:build windows || plan9
+
+package audit
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+)
+
+// Syslog is not supported on this platform
+type Syslog struct{}
+
+// NewSyslog always fails, as syslog is not supported on this platform
+func NewSyslog(_, _, _ string) (*Syslog, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func (*Syslog) Export(context.Context, []*domain.AuditEvent) error { return nil }
+func (*Syslog) Close() error                                       { return nil }
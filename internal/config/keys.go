@@ -0,0 +1,146 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"github.com/spf13/viper"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// known holds the configuration keys, and free-form sections, registered by the packages that read them
+var known = struct {
+	sync.Mutex
+	keys     map[string]struct{}
+	prefixes []string
+}{keys: make(map[string]struct{})}
+
+// Register records the keys read by Read[T] as known, so that they aren't reported by Unknown. Packages register
+// their configuration types during initialization, next to where the types are declared.
+func Register[T any]() {
+	known.Lock()
+	defer known.Unlock()
+
+	textUnmarshal := reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	binaryUnmarshal := reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+	var walk func(typ reflect.Type)
+	walk = func(typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			var field = typ.Field(i)
+			var ft = field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			key, ok := field.Tag.Lookup("viper")
+			if !ok {
+				if ft.Kind() == reflect.Struct {
+					walk(ft)
+				}
+				continue
+			}
+
+			var pt = reflect.PointerTo(ft)
+			if (ft.Kind() == reflect.Struct || ft.Kind() == reflect.Map) && !pt.Implements(textUnmarshal) && !pt.Implements(binaryUnmarshal) {
+				known.prefixes = append(known.prefixes, key) // nested values are decoded as a whole
+			} else {
+				known.keys[key] = struct{}{}
+			}
+		}
+	}
+
+	walk(reflect.TypeOf((*T)(nil)).Elem())
+}
+
+// RegisterPrefix records all keys under the given sections as known. It's used for sections with free-form keys,
+// eg. http.routes, or those decoded with viper.UnmarshalKey rather than Read.
+func RegisterPrefix(prefixes ...string) {
+	known.Lock()
+	defer known.Unlock()
+
+	known.prefixes = append(known.prefixes, prefixes...)
+}
+
+// UnknownKey is a key set in the configuration that isn't read by any package
+type UnknownKey struct {
+	Key        string
+	Suggestion string // closest known key, likely the one that was meant; empty if there's none
+}
+
+func (u UnknownKey) String() string {
+	if u.Suggestion == "" {
+		return u.Key
+	}
+	return fmt.Sprintf("%s (did you mean %s?)", u.Key, u.Suggestion)
+}
+
+// Unknown returns the keys set in the configuration files that aren't known (see: Register), sorted by key.
+// These are most likely misspelled, and so, silently ignored.
+func Unknown() []UnknownKey {
+	return unknown(viper.AllKeys())
+}
+
+func unknown(keys []string) (out []UnknownKey) {
+	known.Lock()
+	defer known.Unlock()
+
+	for _, key := range keys {
+		if _, ok := known.keys[key]; ok {
+			continue
+		}
+
+		if slices.ContainsFunc(known.prefixes, func(p string) bool { return key == p || strings.HasPrefix(key, p+".") }) {
+			continue
+		}
+
+		out = append(out, UnknownKey{Key: key, Suggestion: suggest(key)})
+	}
+
+	slices.SortFunc(out, func(a, b UnknownKey) int { return strings.Compare(a.Key, b.Key) })
+	return out
+}
+
+// suggest returns the known key (or section) closest to the given one, if it's within a few edits of it
+func suggest(key string) (best string) {
+	var limit = len(key) / 3 // any further off, and it's unlikely to be a typo
+	var consider = func(candidate string) {
+		if d := distance(key, candidate); d < limit || (d == limit && (best == "" || candidate < best)) {
+			best, limit = candidate, d
+		}
+	}
+
+	for k := range known.keys {
+		consider(k)
+	}
+
+	for _, p := range known.prefixes {
+		consider(p)
+	}
+
+	return best
+}
+
+// distance returns the levenshtein distance between a and b
+func distance(a, b string) int {
+	var prev, curr = make([]int, len(b)+1), make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			var cost = 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestUnknown(t *testing.T) {
+	type Config struct {
+		BaseUrl *url.URL `viper:"test.url"`
+		Server  struct {
+			Addr string `viper:"test.server.listen_addr"`
+		}
+		Claims map[string]string `viper:"test.claims"`
+	}
+
+	Register[Config]()
+	RegisterPrefix("test.routes")
+
+	var got = unknown([]string{
+		"test.url", "test.server.listen_addr", "test.claims.email", "test.routes", "test.routes.api.cors", // known
+		"test.server.listen_adr", "test.unrelated_key",
+	})
+
+	if len(got) != 2 {
+		t.Fatalf("expected 2 unknown keys; got %v", got)
+	}
+
+	if got[0].Key != "test.server.listen_adr" || got[0].Suggestion != "test.server.listen_addr" {
+		t.Errorf("expected misspelled key to be reported with a suggestion; got %v", got[0])
+	}
+
+	if got[1].Key != "test.unrelated_key" || got[1].Suggestion != "" {
+		t.Errorf("expected unrelated key to be reported without a suggestion; got %v", got[1])
+	}
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// EnvPrefix is the prefix of environment variables that override configuration values.
+//
+// Nested keys are mapped by replacing dots with double underscores, eg. server.url is set
+// using WIREFIRE_SERVER__URL and server.listen_addr using WIREFIRE_SERVER__LISTEN_ADDR.
+const EnvPrefix = "WIREFIRE"
+
+// Load reads the configuration files into the global viper instance. Files are merged in order, with
+// values from later files overriding those from earlier ones.
+//
+// If env is non-empty, an environment-specific overlay is merged after each file, if it exists. The overlay
+// is named after the file with env inserted before the extension, eg. config.prod.yaml for config.yaml.
+//
+// Environment variables (see EnvPrefix) override values from all files.
+func Load(files []string, env string) error {
+	if len(files) == 0 {
+		return errors.New("config: no configuration file provided")
+	}
+
+	for i, file := range files {
+		viper.SetConfigFile(file)
+
+		var read = viper.MergeInConfig
+		if i == 0 {
+			read = viper.ReadInConfig
+		}
+
+		if err := read(); err != nil {
+			return errors.Wrapf(err, "config: failed to read %s", file)
+		}
+
+		if env == "" {
+			continue
+		}
+
+		var ext = filepath.Ext(file)
+		var overlay = strings.TrimSuffix(file, ext) + "." + env + ext
+
+		if _, err := os.Stat(overlay); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		viper.SetConfigFile(overlay)
+		if err := viper.MergeInConfig(); err != nil {
+			return errors.Wrapf(err, "config: failed to read %s", overlay)
+		}
+	}
+
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "__"))
+	viper.AutomaticEnv() // override with any environment variables
+
+	return nil
+}
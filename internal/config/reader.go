@@ -79,6 +79,12 @@ func Read[T any]() *T {
 				}
 
 			case reflect.Slice:
+				// slice of strings can be set either as a list or as a whitespace separated string (eg. from environment)
+				if ok && viper.IsSet(key) && value.Type().Elem().Kind() == reflect.String {
+					value.Set(reflect.ValueOf(viper.GetStringSlice(key)).Convert(value.Type()))
+					break
+				}
+
 				for i := 0; i < value.Len(); i++ {
 					decodeField(value.Index(i), field)
 				}
@@ -2,8 +2,12 @@ package config
 
 import (
 	"github.com/go-playground/validator/v10"
+	"github.com/riyaz-ali/wirefire/internal/domain"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"net/netip"
+	"regexp"
+	"strings"
 )
 
 // Validate applies validation on the config based on struct-tags. It returns
@@ -11,6 +15,10 @@ import (
 func Validate[T any](config *T) (*T, error) {
 	validate := validator.New(validator.WithRequiredStructEnabled())
 	_ = validate.RegisterValidation("loglevel", logLevel)
+	_ = validate.RegisterValidation("resolver", resolver)
+	_ = validate.RegisterValidation("sqliteurl", sqliteURL)
+	_ = validate.RegisterValidation("pattern", pattern)
+	_ = validate.RegisterValidation("ipv6prefix", ipv6Prefix)
 
 	return config, validate.Struct(config)
 }
@@ -29,3 +37,26 @@ func logLevel(fl validator.FieldLevel) bool {
 	level, ok := fl.Field().Interface().(zerolog.Level)
 	return ok && level != zerolog.NoLevel
 }
+
+func resolver(fl validator.FieldLevel) bool {
+	return domain.ValidateResolver(fl.Field().String()) == nil
+}
+
+// sqliteURL accepts a path, or a file: uri, to a sqlite database. Urls for other databases (eg. postgres://)
+// are rejected, rather than being opened as a (oddly named) sqlite file, as sqlite is the only supported backend.
+func sqliteURL(fl validator.FieldLevel) bool {
+	scheme, _, found := strings.Cut(fl.Field().String(), "://")
+	return !found || scheme == "file"
+}
+
+// pattern accepts a valid regular expression
+func pattern(fl validator.FieldLevel) bool {
+	_, err := regexp.Compile(fl.Field().String())
+	return err == nil
+}
+
+// ipv6Prefix accepts an IPv6 prefix, of at most 96 bits, leaving enough room to allocate addresses from
+func ipv6Prefix(fl validator.FieldLevel) bool {
+	prefix, err := netip.ParsePrefix(fl.Field().String())
+	return err == nil && prefix.Addr().Is6() && !prefix.Addr().Is4In6() && prefix.Bits() <= 96
+}
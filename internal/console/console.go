@@ -0,0 +1,339 @@
+// Package console implements wirefire's web-based admin console, served from /admin.
+//
+// Users sign in to the console using the configured OIDC provider, and can manage the tailnets in which they have
+// the owner or admin role, or inspect those in which they're an auditor. The console is a single page that talks to the
+// admin api's tailnet endpoints (see: api.TailnetRoutes) which are mounted under /admin/api, authenticated using the user's
+// session instead of the api token, and limited to the privileges of the user's role in the tailnet.
+package console
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"crypto/rand"
+	"crypto/sha256"
+	"embed"
+	"encoding/base64"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/csrf"
+	"github.com/gorilla/securecookie"
+	"github.com/riyaz-ali/wirefire/internal/api"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	wfoidc "github.com/riyaz-ali/wirefire/internal/oidc"
+	"github.com/rs/zerolog"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed templates
+var templates embed.FS
+
+// SessionDuration is the duration after which a console session expires, and the user must sign in again
+const SessionDuration = 12 * time.Hour
+
+// Config is the subset of configuration relevant to the admin console
+type Config struct {
+	// Enabled serves the admin console from /admin. When disabled, /admin redirects to server.admin_url instead.
+	Enabled bool `viper:"console.enabled"`
+
+	// Key is the coordination server's key.MachinePrivate key.
+	// We use the key's hash to sign session cookies and secure csrf tokens.
+	Key string `viper:"noise.private_key"`
+
+	// BaseUrl used to construct redirect urls
+	BaseUrl *url.URL `viper:"server.url"`
+}
+
+func init() {
+	config.Register[Config]()
+}
+
+// session is the signed value stored in the console's session cookie
+type session struct {
+	UserID    int
+	ExpiresAt time.Time
+}
+
+// Handler returns a new http.Handler that serves the admin console. It must be mounted at /admin.
+func Handler(ctx context.Context, pool *sqlitex.Pool) http.Handler {
+	cfg := config.MustValidate(config.Read[Config]())
+	ocfg := config.MustValidate(config.Read[wfoidc.Config]())
+	ps := wfoidc.NewProviders(ctx, ocfg).WithRedirect(cfg.BaseUrl.JoinPath("/admin/callback"))
+
+	var hash = sha256.Sum256([]byte("console:" + cfg.Key))
+	var cookies = securecookie.New(hash[:], nil).MaxAge(int(SessionDuration.Seconds()))
+
+	r := chi.NewRouter()
+	r.Use(wfoidc.NewAccessLog())
+	r.Method(http.MethodGet, "/login", Login(cfg, ps))
+	r.Method(http.MethodGet, "/callback", Callback(cfg, ocfg, ps, cookies, pool))
+	r.Method(http.MethodPost, "/logout", Logout(cfg))
+
+	r.Group(func(r chi.Router) {
+		r.Use(Authenticate(cookies, pool))
+		r.Method(http.MethodGet, "/", Index(pool))
+
+		r.Route("/api/tailnets/{tailnet}", func(r chi.Router) {
+			r.Use(RequireRole(pool))
+			api.TailnetRoutes(r, pool)
+		})
+	})
+
+	csrfProtect := csrf.Protect(hash[:], csrf.Secure(cfg.BaseUrl.Scheme == "https"),
+		csrf.CookieName("console_csrf"), csrf.Path("/admin"))
+
+	return csrfProtect(r)
+}
+
+// Login serves the GET /admin/login endpoint and starts the OIDC authentication flow with the provider named by the
+// provider parameter. If more than one provider is configured, and none is named, the user is shown a provider picker.
+func Login(cfg *Config, ps *wfoidc.Providers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var name = r.URL.Query().Get("provider")
+		if name == "" && ps.Len() > 1 {
+			err := ps.Picker(w, func(name string) string { return "/admin/login?" + url.Values{"provider": {name}}.Encode() })
+			if err != nil {
+				zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to render template")
+			}
+
+			return
+		}
+
+		var rs = ps.Get(name)
+		if rs == nil {
+			http.Error(w, "unknown provider", http.StatusBadRequest)
+			return
+		}
+
+		var buf = make([]byte, 24)
+		_, _ = rand.Read(buf)
+
+		var state, secure = base64.RawURLEncoding.EncodeToString(buf), cfg.BaseUrl.Scheme == "https"
+		http.SetCookie(w, &http.Cookie{Name: "console_state", Value: state, Path: "/admin", Secure: secure, HttpOnly: true})
+		http.SetCookie(w, &http.Cookie{Name: "console_provider", Value: rs.Name(), Path: "/admin", Secure: secure, HttpOnly: true})
+		http.Redirect(w, r, rs.AuthCodeURL(state), http.StatusFound)
+	}
+}
+
+// Callback serves the GET /admin/callback endpoint. It completes the OIDC authentication flow and, if the user
+// is an auditor (or more privileged) of at least one tailnet, starts a new console session.
+func Callback(cfg *Config, ocfg *wfoidc.Config, ps *wfoidc.Providers, cookies *securecookie.SecureCookie, pool *sqlitex.Pool) http.HandlerFunc {
+	var tpl = template.Must(template.ParseFS(templates, "templates/*.html"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		ctx, log := r.Context(), zerolog.Ctx(r.Context())
+
+		if cookie, err := r.Cookie("console_state"); err != nil || cookie.Value != r.URL.Query().Get("state") {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+
+			return
+		}
+
+		var rs *wfoidc.RemoteService
+		if cookie, err := r.Cookie("console_provider"); err == nil {
+			rs = ps.Get(cookie.Value)
+		}
+
+		if rs == nil {
+			http.Error(w, "unknown provider", http.StatusBadRequest)
+
+			return
+		}
+
+		var raw string
+		if raw, err = rs.Exchange(ctx, r.URL.Query().Get("code")); err != nil {
+			log.Error().Err(err).Msg("failed to exchange code")
+			http.Error(w, "failed to exchange code", http.StatusBadRequest)
+
+			return
+		}
+
+		var token *oidc.IDToken
+		if token, err = rs.Verify(ctx, raw); err != nil {
+			log.Error().Err(err).Msg("failed to verify token")
+			http.Error(w, "failed to verify token", http.StatusBadRequest)
+
+			return
+		}
+
+		var claims domain.UserClaims
+		if claims, err = rs.Claims(token); err != nil {
+			http.Error(w, "failed to parse claims from token", http.StatusBadRequest)
+
+			return
+		}
+
+		var deny = func(reason string) {
+			log.Warn().Str("sub", claims.Subject).Str("reason", reason).Msg("console login denied")
+
+			w.WriteHeader(http.StatusForbidden)
+			if err := tpl.ExecuteTemplate(w, "denied.html", map[string]any{"reason": reason}); err != nil {
+				log.Error().Err(err).Msg("failed to render template")
+			}
+		}
+
+		if err = wfoidc.CheckConditions(ocfg, claims); err != nil {
+			deny(err.Error())
+			return
+		}
+
+		conn := pool.Get(ctx)
+		defer pool.Put(conn)
+
+		var user *domain.User
+		if user, err = database.FetchOne(conn, domain.UserByIdentity(claims.Issuer, claims.Subject)); err != nil {
+			http.Error(w, "failed to find user", http.StatusInternalServerError)
+
+			return
+		}
+
+		if user != nil && user.IsDisabled() {
+			deny("your account has been disabled by an administrator")
+			return
+		}
+
+		if tailnets, _ := managedTailnets(conn, user); len(tailnets) == 0 {
+			deny("you are not an admin, or auditor, of any tailnet")
+			return
+		}
+
+		var value string
+		if value, err = cookies.Encode("console_session", &session{UserID: user.ID, ExpiresAt: time.Now().Add(SessionDuration)}); err != nil {
+			http.Error(w, "failed to create session", http.StatusInternalServerError)
+
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name: "console_session", Value: value, Path: "/admin", MaxAge: int(SessionDuration.Seconds()),
+			Secure: cfg.BaseUrl.Scheme == "https", HttpOnly: true, SameSite: http.SameSiteLaxMode,
+		})
+
+		http.Redirect(w, r, "/admin/", http.StatusFound)
+	}
+}
+
+// Logout serves the POST /admin/logout endpoint and ends the user's console session
+func Logout(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "console_session", Path: "/admin", MaxAge: -1, Secure: cfg.BaseUrl.Scheme == "https", HttpOnly: true})
+		http.Redirect(w, r, "/admin/login", http.StatusFound)
+	}
+}
+
+// Index serves the GET /admin/ endpoint and renders the console for the signed-in user
+func Index(pool *sqlitex.Pool) http.HandlerFunc {
+	var tpl = template.Must(template.ParseFS(templates, "templates/*.html"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		log, user := zerolog.Ctx(r.Context()), userFrom(r.Context())
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		tailnets, err := managedTailnets(conn, user)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to list tailnets")
+			http.Error(w, "failed to list tailnets", http.StatusInternalServerError)
+
+			return
+		}
+
+		params := map[string]any{"csrfToken": csrf.Token(r), "user": user, "tailnets": tailnets}
+		if err = tpl.ExecuteTemplate(w, "console.html", params); err != nil {
+			log.Error().Err(err).Msg("failed to render template")
+			http.Error(w, "failed to render template", http.StatusInternalServerError)
+		}
+	}
+}
+
+// managedTailnets returns the tailnets in which the user has access to the console, ie. the auditor role or a more privileged one
+func managedTailnets(conn *sqlite.Conn, user *domain.User) (_ []*domain.Tailnet, err error) {
+	if user == nil {
+		return nil, nil
+	}
+
+	var tailnets []*domain.Tailnet
+	if tailnets, err = database.FetchMany(conn, domain.ListTailnets(user)); err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(tailnets, func(t *domain.Tailnet) bool { return !domain.HasRole(t.Role, domain.RoleAuditor) }), nil
+}
+
+type ctxKey struct{}
+
+// userFrom returns the signed-in user added to the context by Authenticate
+func userFrom(ctx context.Context) *domain.User { return ctx.Value(ctxKey{}).(*domain.User) }
+
+// Authenticate returns a new middleware that authenticates the request using the console's session cookie.
+// Requests without a valid session are redirected to the login page, or rejected if they are api requests.
+func Authenticate(cookies *securecookie.SecureCookie, pool *sqlitex.Pool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var unauthorized = func() {
+				if r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/admin/api/") {
+					http.Redirect(w, r, "/admin/login", http.StatusFound)
+				} else {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+				}
+			}
+
+			var s session
+			if cookie, err := r.Cookie("console_session"); err != nil {
+				unauthorized()
+				return
+			} else if err = cookies.Decode("console_session", cookie.Value, &s); err != nil || s.ExpiresAt.Before(time.Now()) {
+				unauthorized()
+				return
+			}
+
+			conn := pool.Get(r.Context())
+			user, err := database.FetchOne(conn, domain.UserById(int64(s.UserID)))
+			pool.Put(conn)
+
+			if err != nil || user == nil || user.IsDisabled() {
+				unauthorized()
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKey{}, user)))
+		})
+	}
+}
+
+// RequireRole returns a new middleware that only allows auditors (or more privileged members) of the {tailnet} in the
+// request's path through, and passes their role on to the api (see: api.WithRole), which enforces it per endpoint.
+// The user is passed on as well (see: api.WithActor), and recorded as the actor of the changes they make.
+func RequireRole(pool *sqlitex.Pool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tid, err := strconv.Atoi(chi.URLParam(r, "tailnet"))
+			if err != nil {
+				http.Error(w, "invalid tailnet id", http.StatusBadRequest)
+				return
+			}
+
+			conn := pool.Get(r.Context())
+			role, err := database.FetchOne(conn, domain.MemberRole(userFrom(r.Context()), int64(tid)))
+			pool.Put(conn)
+
+			if err != nil || role == nil || !domain.HasRole(*role, domain.RoleAuditor) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
+			var ctx = api.WithActor(api.WithRole(r.Context(), *role), userFrom(r.Context()).LoginName())
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package console
+
+import (
+	"context"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/api"
+	"github.com/riyaz-ali/wirefire/internal/database/schema"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRequireRole(t *testing.T) {
+	pool, err := sqlitex.Open("file:"+filepath.Join(t.TempDir(), "wirefire.db"), 0, 2)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+
+	conn := pool.Get(context.Background())
+	if err = schema.Apply(conn); err == nil {
+		err = sqlitex.ExecScript(conn, `
+			INSERT INTO tailnets (id, name, acl) VALUES (1, 'example.com', '{}'), (2, 'example.org', '{}');
+			INSERT INTO users (id, claims) VALUES (1, '{"sub":"owner@example.com"}'), (2, '{"sub":"admin@example.com"}'),
+			                                     (3, '{"sub":"auditor@example.com"}'), (4, '{"sub":"member@example.com"}');
+			INSERT INTO tailnet_members (tailnet_id, user_id, role) VALUES (1, 1, 'owner'), (1, 2, 'admin'), (1, 3, 'auditor'), (1, 4, 'member'),
+			                                                              (2, 3, 'admin');
+		`)
+	}
+	pool.Put(conn)
+
+	if err != nil {
+		t.Fatalf("failed to seed database: %v", err)
+	}
+
+	// mounted as in Handler, behind Authenticate, which adds the signed-in user to the request's context
+	var r = chi.NewRouter()
+	r.Route("/api/tailnets/{tailnet}", func(r chi.Router) {
+		r.Use(RequireRole(pool))
+		api.TailnetRoutes(r, pool)
+	})
+
+	var cases = []struct {
+		user    int
+		method  string
+		path    string
+		body    string
+		allowed bool
+	}{
+		{4, http.MethodGet, "/api/tailnets/1/", "", false}, // members have no access to the console
+		{4, http.MethodGet, "/api/tailnets/1/machines", "", false},
+		{3, http.MethodGet, "/api/tailnets/1/", "", true},
+		{3, http.MethodGet, "/api/tailnets/1/machines", "", true},
+		{3, http.MethodPatch, "/api/tailnets/1/", "{}", false},
+		{3, http.MethodPut, "/api/tailnets/1/acl", "{}", false},
+		{3, http.MethodPatch, "/api/tailnets/2/", "{}", true}, // role is that of the tailnet in the path
+		{2, http.MethodPatch, "/api/tailnets/1/", "{}", true},
+		{2, http.MethodPut, "/api/tailnets/1/members/1", `{"role":"admin"}`, false},
+		{2, http.MethodDelete, "/api/tailnets/1/", "", false},
+		{2, http.MethodGet, "/api/tailnets/2/", "", false}, // not a member
+		{1, http.MethodPut, "/api/tailnets/1/members/2", `{"role":"auditor"}`, true},
+		{1, http.MethodDelete, "/api/tailnets/1/", "", true},
+	}
+
+	for _, tc := range cases {
+		var user = &domain.User{ID: tc.user}
+		t.Run(tc.method+tc.path, func(t *testing.T) {
+			var ctx = context.WithValue(context.Background(), ctxKey{}, user)
+			var w, req = httptest.NewRecorder(), httptest.NewRequestWithContext(ctx, tc.method, tc.path, strings.NewReader(tc.body))
+			r.ServeHTTP(w, req)
+
+			if forbidden := w.Code == http.StatusForbidden; forbidden == tc.allowed {
+				t.Errorf("expected allowed=%t for user %d; got %d %s", tc.allowed, tc.user, w.Code, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package coordinator
+
+import (
+	"crawshaw.io/sqlite"
+	"encoding/binary"
+	"github.com/riyaz-ali/tacl"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"hash"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"time"
+)
+
+// CacheTTL is the duration for which tailnets, users and machines, read while generating map responses, are cached
+var CacheTTL = settings.Define("coordinator.cache_ttl", settings.Duration(time.Minute),
+	"duration for which tailnets, users and machines, read while generating map responses, are cached")
+
+// entry is a cached object, along with the time it expires at
+type entry[T any] struct {
+	val     *T
+	expires time.Time
+}
+
+// compiled is a machine's compiled packet filter, along with the inputs it was compiled from
+type compiled struct {
+	tailnet int
+	acl     *tacl.ACL
+	inputs  uint64 // hash of the machine and the peers the filter was compiled against; see fingerprint
+	rules   []tailcfg.FilterRule
+}
+
+// snapshot is the cached list of a tailnet's machines, as of a change generation of the tailnet
+type snapshot struct {
+	machines []*domain.Machine
+	gen      uint64 // notifier.Generation of the tailnet, read before the machines were
+	expires  time.Time
+}
+
+// cache is a read-through cache of the tailnets (along with their parsed acl policy) and users that machines are joined
+// with when generating map responses. Without it, every sync of every session re-reads them for each machine in the tailnet.
+//
+// It also holds a snapshot of each tailnet's machines, which the sessions of all machines in the tailnet derive their
+// (personalized) map responses from. A snapshot is loaded once per change generation of the tailnet (see: notifier.Generation),
+// rather than by every session on every sync, which makes the rows read per sync grow with the square of the tailnet's size.
+// Likewise, the packet filter compiled for each machine is cached until its policy, or the machine or its peers change (see: cache.filter).
+//
+// Entries are invalidated as changes are published to the notifier, and expire after CacheTTL regardless, in case an
+// invalidation is missed (eg. the notifier drops events when the cache doesn't keep up). Cached objects are shared by
+// all sessions, and must not be modified. A nil cache is valid, and reads straight from the database.
+type cache struct {
+	mu       sync.Mutex
+	tailnets map[int]entry[domain.Tailnet]
+	users    map[int]entry[domain.User]
+
+	snapshots map[int]snapshot // machines of each tailnet, keyed by tailnet id
+	filters   map[int]compiled // compiled packet filter of each machine, keyed by machine id
+
+	// gen is incremented on every invalidation, so that an object loaded concurrently with an invalidation isn't cached
+	gen uint64
+}
+
+// newCache returns a new cache, invalidated by the notifier for the lifetime of the process
+func newCache() *cache {
+	var c = &cache{
+		tailnets:  make(map[int]entry[domain.Tailnet]),
+		users:     make(map[int]entry[domain.User]),
+		snapshots: make(map[int]snapshot),
+		filters:   make(map[int]compiled),
+	}
+
+	events, _ := notifier.SubscribeAll()
+	go func() {
+		for e := range events {
+			c.invalidate(e)
+		}
+	}()
+
+	return c
+}
+
+// invalidate removes the cached objects affected by the event
+func (c *cache) invalidate(e notifier.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case e.Kind == notifier.TailnetUpdated || e.Kind == notifier.TailnetDeleted:
+		delete(c.tailnets, e.Tailnet)
+		c.forget(e.Tailnet)
+	case e.Kind == notifier.UserUpdated:
+		delete(c.users, e.User)
+	case e.Kind == notifier.MachineCreated || e.Kind == notifier.MachineDeleted || e.Kind == notifier.MachineRevoked:
+		c.forget(e.Tailnet) // peers have changed; filters compiled against the old ones won't be used again
+		return
+	default:
+		return
+	}
+
+	// snapshots hold their machines' (now stale) tailnet and owner, and must be reloaded as well
+	for id := range c.snapshots {
+		if e.Tailnet == notifier.All || id == e.Tailnet {
+			delete(c.snapshots, id)
+		}
+	}
+
+	c.gen++
+}
+
+// forget removes the compiled filters of the tailnet's machines, or of all machines if tailnet is notifier.All.
+// It must be called with c.mu held.
+func (c *cache) forget(tailnet int) {
+	for id, f := range c.filters {
+		if tailnet == notifier.All || f.tailnet == tailnet {
+			delete(c.filters, id)
+		}
+	}
+}
+
+// machine returns the machine with the given key, along with its Tailnet and Owner
+func (c *cache) machine(conn *sqlite.Conn, k key.MachinePublic) (m *domain.Machine, err error) {
+	if c == nil {
+		return database.FetchOne(conn, domain.GetMachineByKey(k))
+	}
+
+	if m, err = database.FetchOne(conn, domain.GetBareMachineByKey(k)); err != nil || m == nil {
+		return m, err
+	}
+
+	return m, c.resolve(conn, m)
+}
+
+// machines returns all machines in the tailnet, along with their Tailnet and Owner, from the tailnet's snapshot; the snapshot
+// is reloaded if any event was published to the tailnet since it was loaded. The returned slice belongs to the caller,
+// but the machines in it are shared with other sessions, and must not be modified.
+func (c *cache) machines(conn *sqlite.Conn, tailnet *domain.Tailnet) (machines []*domain.Machine, err error) {
+	if c == nil {
+		return database.FetchMany(conn, domain.ListMachines(tailnet))
+	}
+
+	var now, gen = time.Now(), notifier.Generation(tailnet.ID)
+
+	c.mu.Lock()
+	s, ok := c.snapshots[tailnet.ID]
+	var epoch = c.gen
+	c.mu.Unlock()
+
+	if ok && s.gen == gen && now.Before(s.expires) {
+		return slices.Clone(s.machines), nil
+	}
+
+	if machines, err = database.FetchMany(conn, domain.ListBareMachines(tailnet)); err != nil {
+		return nil, err
+	}
+
+	for _, m := range machines {
+		if err = c.resolve(conn, m); err != nil {
+			return nil, err
+		}
+	}
+
+	c.mu.Lock()
+	// don't replace a snapshot of a later generation, or cache one that may have resolved invalidated objects
+	if current, ok := c.snapshots[tailnet.ID]; epoch == c.gen && (!ok || current.gen <= gen) {
+		c.snapshots[tailnet.ID] = snapshot{machines: machines, gen: gen, expires: now.Add(time.Duration(CacheTTL.Get()))}
+	}
+	c.mu.Unlock()
+
+	return slices.Clone(machines), nil
+}
+
+// resolve sets the (bare) machine's Tailnet and Owner
+func (c *cache) resolve(conn *sqlite.Conn, m *domain.Machine) (err error) {
+	if m.Tailnet, err = load(c, c.tailnets, m.TailnetID, func() (*domain.Tailnet, error) {
+		return database.FetchOne(conn, domain.TailnetById(int64(m.TailnetID)))
+	}); err != nil {
+		return err
+	}
+
+	m.Owner, err = load(c, c.users, m.UserID, func() (*domain.User, error) {
+		return database.FetchOne(conn, domain.UserById(int64(m.UserID)))
+	})
+
+	return err
+}
+
+// load returns the object identified by id from the given map of the cache, reading it using fn if it isn't cached, or has expired.
+func load[T any](c *cache, entries map[int]entry[T], id int, fn func() (*T, error)) (*T, error) {
+	var now = time.Now()
+
+	c.mu.Lock()
+	e, ok := entries[id]
+	var gen = c.gen
+	c.mu.Unlock()
+
+	if ok && now.Before(e.expires) {
+		return e.val, nil
+	}
+
+	val, err := fn()
+	if err != nil || val == nil {
+		return val, err
+	}
+
+	c.mu.Lock()
+	if gen == c.gen { // don't cache objects that may have been invalidated while they were being read
+		entries[id] = entry[T]{val: val, expires: now.Add(time.Duration(CacheTTL.Get()))}
+	}
+	c.mu.Unlock()
+
+	return val, nil
+}
+
+// filter returns the packet filter of the machine, compiled from its tailnet's acl policy against the given peers, with the
+// sources of each rule sorted. A machine's filter is only recompiled when the policy, the machine or the peers (see: fingerprint)
+// differ from those it was last compiled for, rather than on every map response, or on every event published to the tailnet.
+// The returned rules are shared with other sessions of the machine, and must not be modified; appending to them is safe.
+func (c *cache) filter(m *domain.Machine, peers []tacl.Machine) []tailcfg.FilterRule {
+	var compile = func() []tailcfg.FilterRule {
+		var rules = m.Tailnet.Acl.BuildFilter(m, peers)
+		for _, rule := range rules {
+			slices.Sort(rule.SrcIPs) // sources are compiled in no particular order; sort them to keep the checksum stable
+		}
+		return rules
+	}
+
+	if c == nil {
+		return compile()
+	}
+
+	var hash = fnv.New64a()
+	fingerprint(hash, m)
+	for _, p := range peers {
+		fingerprint(hash, p.(*domain.Machine))
+	}
+
+	var key = compiled{tailnet: m.TailnetID, acl: m.Tailnet.Acl.ACL, inputs: hash.Sum64()}
+
+	c.mu.Lock()
+	f, ok := c.filters[m.ID]
+	c.mu.Unlock()
+
+	if ok && f.acl == key.acl && f.inputs == key.inputs {
+		return slices.Clip(f.rules)
+	}
+
+	key.rules = compile()
+
+	c.mu.Lock()
+	c.filters[m.ID] = key
+	c.mu.Unlock()
+
+	return slices.Clip(key.rules)
+}
+
+// fingerprint writes the properties of the machine that its packet filter (or that of its peers) is compiled from to the hash:
+// its id, addresses, approved routes, tags, and its owner's login name and role. Other changes to the machine (eg. to its
+// endpoints, or its presence) don't affect compiled filters.
+func fingerprint(h hash.Hash64, m *domain.Machine) {
+	var v4, v6 = m.IP()
+	var login string
+	if m.Owner != nil {
+		login = m.Owner.LoginName()
+	}
+
+	_ = binary.Write(h, binary.LittleEndian, int64(m.ID))
+	_, _ = h.Write(v4.AsSlice())
+	_, _ = h.Write(v6.AsSlice())
+
+	_ = binary.Write(h, binary.LittleEndian, int64(len(m.ApprovedRoutes)))
+	for _, r := range m.ApprovedRoutes {
+		_, _ = h.Write(r.Addr().AsSlice())
+		_, _ = h.Write([]byte{byte(r.Bits())})
+	}
+
+	_ = binary.Write(h, binary.LittleEndian, int64(len(m.AssignedTags)))
+	for _, s := range append(slices.Clip(m.AssignedTags), login, m.Role) {
+		_, _ = h.Write([]byte(s))
+		_, _ = h.Write([]byte{0})
+	}
+}
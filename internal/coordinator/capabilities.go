@@ -0,0 +1,46 @@
+package coordinator
+
+import (
+	"maps"
+	"slices"
+	"tailscale.com/tailcfg"
+)
+
+// Capability versions that introduced the features gated by Capabilities; see tailcfg.CapabilityVersion for the full history.
+// Features understood by all clients as old as SupportedCapabilityVersion are pinned to it, and gated all the same, so that
+// the mapper keeps working if the supported version is ever lowered.
+const (
+	capVerDeltaPeers        tailcfg.CapabilityVersion = 68 // MapResponse.PeersChanged and PeersRemoved
+	capVerPeersChangedPatch tailcfg.CapabilityVersion = 68 // MapResponse.PeersChangedPatch and OnlineChange
+	capVerNodeCapMap        tailcfg.CapabilityVersion = 74 // Node.CapMap; older clients read Node.Capabilities
+)
+
+// Capabilities are the protocol features supported by a client, negotiated from the capability version it presents.
+// Map responses leave out the features a client doesn't support, or send them in the older form it understands.
+type Capabilities struct {
+	Version tailcfg.CapabilityVersion
+}
+
+// Negotiate returns the capabilities of a client presenting the given capability version. It returns false
+// if the version is older than SupportedCapabilityVersion, in which case the client must be turned away.
+func Negotiate(version tailcfg.CapabilityVersion) (Capabilities, bool) {
+	return Capabilities{Version: version}, version >= SupportedCapabilityVersion
+}
+
+// DeltaPeers reports whether the client applies incremental peer updates; if not, delta responses carry the complete list of peers
+func (c Capabilities) DeltaPeers() bool { return c.Version >= capVerDeltaPeers }
+
+// PeersChangedPatch reports whether the client applies patches to its peers; if not, changed peers are sent in full
+func (c Capabilities) PeersChangedPatch() bool { return c.Version >= capVerPeersChangedPatch }
+
+// NodeCapMap reports whether the client reads node capabilities from Node.CapMap, rather than Node.Capabilities
+func (c Capabilities) NodeCapMap() bool { return c.Version >= capVerNodeCapMap }
+
+// adapt rewrites the node in the form understood by the client
+func (c Capabilities) adapt(node *tailcfg.Node) {
+	if !c.NodeCapMap() && len(node.CapMap) > 0 {
+		// older clients only know of capabilities without values
+		node.Capabilities = slices.Sorted(maps.Keys(node.CapMap))
+		node.CapMap = nil
+	}
+}
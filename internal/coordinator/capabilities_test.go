@@ -0,0 +1,35 @@
+package coordinator
+
+import (
+	"slices"
+	"tailscale.com/tailcfg"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	if _, ok := Negotiate(SupportedCapabilityVersion - 1); ok {
+		t.Errorf("expected versions older than the supported version to be turned away")
+	}
+
+	if caps, ok := Negotiate(SupportedCapabilityVersion); !ok || !caps.DeltaPeers() || !caps.PeersChangedPatch() {
+		t.Errorf("expected the supported version to apply incremental peer updates")
+	}
+}
+
+func TestCapabilities_Adapt(t *testing.T) {
+	var node = func() *tailcfg.Node {
+		return &tailcfg.Node{CapMap: tailcfg.NodeCapMap{tailcfg.CapabilitySSH: nil, tailcfg.CapabilityFileSharing: nil}}
+	}
+
+	var current = node()
+	Capabilities{Version: capVerNodeCapMap}.adapt(current)
+	if len(current.CapMap) != 2 || len(current.Capabilities) != 0 {
+		t.Errorf("expected node to be left as-is for clients that read Node.CapMap; got %+v", current)
+	}
+
+	var older = node()
+	Capabilities{Version: capVerNodeCapMap - 1}.adapt(older)
+	if older.CapMap != nil || !slices.Equal(older.Capabilities, []tailcfg.NodeCapability{tailcfg.CapabilityFileSharing, tailcfg.CapabilitySSH}) {
+		t.Errorf("expected capabilities to be moved to Node.Capabilities for older clients; got %+v", older)
+	}
+}
@@ -0,0 +1,195 @@
+package coordinator
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/rs/zerolog"
+	"slices"
+	"strings"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/util/dnsname"
+	"time"
+)
+
+// CertConfig configures https certificates for machines (ie. `tailscale cert`).
+//
+// Clients obtain certificates for their MagicDNS name from Let's Encrypt, using DNS-01 challenges. The challenge's
+// TXT record is published by wirefire on the client's behalf, using the configured DNSBackend. The default backend
+// sends RFC 2136 dynamic updates to the authoritative nameserver of dns.magic_dns_suffix, which therefore must be a
+// publicly resolvable domain.
+type CertConfig struct {
+	Enabled bool `viper:"certs.enabled" default:"false"`
+
+	// Backend is the DNSBackend that publishes the records; one of rfc2136 (dynamic updates sent to Nameserver),
+	// or records (the tailnet's extra records, served to its machines by MagicDNS; see domain.DNS.ExtraRecords)
+	Backend string `viper:"certs.backend" default:"rfc2136" validate:"oneof=rfc2136 records"`
+
+	// Nameserver is the address (host:port) of the nameserver that accepts dynamic updates for Zone
+	Nameserver string `viper:"certs.nameserver" validate:"required_if=Enabled true Backend rfc2136"`
+
+	// Zone is the zone the challenge records are added to; defaults to dns.magic_dns_suffix
+	Zone string `viper:"certs.zone"`
+
+	// TsigKey and TsigSecret (base64-encoded) are used to sign the updates; updates are unsigned if TsigKey is empty
+	TsigKey       string `viper:"certs.tsig_key"`
+	TsigSecret    string `viper:"certs.tsig_secret"`
+	TsigAlgorithm string `viper:"certs.tsig_algorithm" default:"hmac-sha256."`
+}
+
+func init() {
+	config.Register[CertConfig]()
+}
+
+// fqdn returns the machine's fully-qualified MagicDNS name, without the trailing dot
+func fqdn(m *domain.Machine, suffix string) string {
+	return fmt.Sprintf("%s.%s.%s", m.CompleteName(), dnsname.SanitizeHostname(m.Tailnet.Name), suffix)
+}
+
+// DNSBackend publishes the dns records that machines request over the /machine/set-dns endpoint
+type DNSBackend interface {
+	// SetRecord replaces the records of the given type at name with value, on behalf of the machine
+	SetRecord(ctx context.Context, conn *sqlite.Conn, m *domain.Machine, name, typ, value string) error
+}
+
+// NewDNSBackend returns the DNSBackend selected by the configuration
+func NewDNSBackend(cfg *CertConfig) DNSBackend {
+	switch cfg.Backend {
+	case "records":
+		return extraRecords{}
+	default:
+		return rfc2136{cfg: cfg}
+	}
+}
+
+// MachineSetDNS handles the /machine/set-dns endpoint, which clients use to publish the TXT record of an
+// ACME DNS-01 challenge while obtaining an https certificate for their MagicDNS name (see: CertConfig).
+func MachineSetDNS(peer key.MachinePublic, pool *sqlitex.Pool) util.HandlerFunc[tailcfg.SetDNSRequest, tailcfg.SetDNSResponse] {
+	cfg := config.MustValidate(config.Read[CertConfig]())
+	suffix := config.MustValidate(config.Read[DnsConfig]()).MagicDnsSuffix
+
+	if cfg.Zone == "" {
+		cfg.Zone = suffix
+	}
+
+	backend := NewDNSBackend(cfg)
+
+	return func(ctx context.Context, req tailcfg.SetDNSRequest) (_ *tailcfg.SetDNSResponse, err error) {
+		log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Logger()
+
+		if !cfg.Enabled {
+			return nil, errors.New("https certificates are not enabled on this server")
+		}
+
+		conn := pool.Get(ctx)
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		if machine, err = database.FetchOne(conn, domain.GetMachineByKey(peer)); err != nil {
+			return nil, err
+		} else if machine == nil || machine.NodeKey != req.NodeKey {
+			return nil, errors.New("machine not found")
+		} else if !machine.Authorized || machine.IsExpired() {
+			return nil, errors.New("machine is not authorized, or its key has expired")
+		}
+
+		// machines may only publish challenges for their own name
+		var name = "_acme-challenge." + fqdn(machine, suffix)
+		if req.Type != "TXT" || !strings.EqualFold(strings.TrimSuffix(req.Name, "."), name) {
+			return nil, errors.Errorf("cannot set %s record for %q", req.Type, req.Name)
+		}
+
+		if err = backend.SetRecord(ctx, conn, machine, name, req.Type, req.Value); err != nil {
+			log.Error().Err(err).Str("name", name).Msg("failed to publish challenge record")
+			return nil, errors.Wrapf(err, "failed to publish challenge record")
+		}
+
+		log.Info().Str("name", name).Msg("published challenge record")
+		return &tailcfg.SetDNSResponse{}, nil
+	}
+}
+
+// rfc2136 is the DNSBackend that publishes records using RFC 2136 dynamic updates, sent to the nameserver of the zone
+type rfc2136 struct{ cfg *CertConfig }
+
+// SetRecord replaces the TXT records at name with value, using an RFC 2136 dynamic update
+func (b rfc2136) SetRecord(ctx context.Context, _ *sqlite.Conn, _ *domain.Machine, name, typ, value string) error {
+	if typ != "TXT" {
+		return errors.Errorf("unsupported record type %q", typ)
+	}
+
+	var cfg = b.cfg
+	var txt = &dns.TXT{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{value},
+	}
+
+	var msg = new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(cfg.Zone))
+	msg.RemoveRRset([]dns.RR{txt}) // drop challenges left behind by earlier attempts
+	msg.Insert([]dns.RR{txt})
+
+	var client = &dns.Client{Net: "tcp", Timeout: 10 * time.Second}
+	if cfg.TsigKey != "" {
+		client.TsigSecret = map[string]string{dns.Fqdn(cfg.TsigKey): cfg.TsigSecret}
+		msg.SetTsig(dns.Fqdn(cfg.TsigKey), cfg.TsigAlgorithm, 300, time.Now().Unix())
+	}
+
+	resp, _, err := client.ExchangeContext(ctx, msg, cfg.Nameserver)
+	if err != nil {
+		return err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return errors.Errorf("nameserver refused update: %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	return nil
+}
+
+// extraRecords is the DNSBackend that stores records as the extra records of the machine's tailnet, which are served
+// to the tailnet's machines by MagicDNS. The records aren't resolvable outside the tailnet, and so are only useful
+// with an acme server that resolves challenges through it.
+type extraRecords struct{}
+
+// SetRecord replaces the tailnet's extra records of the given type at name with value, and notifies its machines
+func (extraRecords) SetRecord(_ context.Context, conn *sqlite.Conn, m *domain.Machine, name, typ, value string) error {
+	var record = domain.DNSRecord{Name: name, Type: typ, Value: value}
+	if err := record.Validate(); err != nil {
+		return err
+	}
+
+	err := database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+		var tailnet *domain.Tailnet
+		if tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(m.TailnetID))); err != nil {
+			return err
+		} else if tailnet == nil {
+			return errors.New("tailnet not found")
+		}
+
+		var dns = tailnet.DNS
+		dns.ExtraRecords = slices.DeleteFunc(slices.Clone(dns.ExtraRecords), func(r domain.DNSRecord) bool {
+			return r.Type == typ && strings.EqualFold(strings.TrimSuffix(r.Name, "."), name)
+		})
+		dns.ExtraRecords = append(dns.ExtraRecords, record)
+
+		_, err = database.Exec(conn, domain.SetTailnetDNS(tailnet, &dns))
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	notifier.Publish(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: m.TailnetID})
+	return nil
+}
@@ -6,35 +6,102 @@ import (
 	"github.com/go-chi/chi/v5"
 	stock "github.com/go-chi/chi/v5/middleware"
 	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/geoip"
+	"github.com/riyaz-ali/wirefire/internal/proxy"
+	"github.com/riyaz-ali/wirefire/internal/settings"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 	"io"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"tailscale.com/control/controlhttp"
 	"tailscale.com/net/netutil"
 	"tailscale.com/types/key"
+	"time"
 )
 
 const (
 	SupportedCapabilityVersion      = 68
 	NoiseCapabilityVersion          = 28
 	UnsupportedClientVersionMessage = "wirefire only support client version >= 1.48.0, please upgrade your client"
+	MaintenanceModeMessage          = "wirefire is undergoing maintenance and isn't accepting new registrations, please try again later"
+	InvalidAuthKeyMessage           = "invalid auth key; the key may have been revoked, expired or already used"
 )
 
+// List of runtime-tunable settings used by the coordinator
+var (
+	// SyncInterval is the interval at which connected clients are checked for pending map updates
+	SyncInterval = settings.Define("coordinator.sync_interval", settings.Duration(5*time.Second),
+		"interval at which connected clients are checked for pending map updates")
+
+	// KeepAliveInterval is the interval at which keep-alive messages are sent to connected clients
+	KeepAliveInterval = settings.Define("coordinator.keep_alive_interval", settings.Duration(10*time.Second),
+		"interval at which keep-alive messages are sent to connected clients")
+
+	// ReconnectJitter is the maximum duration clients are asked to wait before reconnecting, when the server shuts down
+	ReconnectJitter = settings.Define("coordinator.reconnect_jitter", settings.Duration(30*time.Second),
+		"maximum duration clients are asked to wait before reconnecting, when the server shuts down")
+
+	// DisableLogCollection, when enabled, disables client log streaming on every tailnet, regardless of its logging policy
+	DisableLogCollection = settings.Define("coordinator.disable_log_collection", false,
+		"disable client log streaming on every tailnet, regardless of its logging policy")
+
+	// MaintenanceMode, when enabled, pauses registration of new machines. Existing machines continue to work as usual.
+	MaintenanceMode = settings.Define("maintenance_mode", false,
+		"pause registration of new machines; existing machines are not affected")
+)
+
+// tracer starts the spans of the coordinator's operations; see package tracing
+var tracer = otel.Tracer("github.com/riyaz-ali/wirefire/internal/coordinator")
+
 // Config is the subset of configuration relevant to the coordinator server
 type Config struct {
 	// BaseUrl is the url (optionally public) on which the coordinator is available
 	BaseUrl *url.URL `viper:"server.url" validation:"required"`
 }
 
-// Upgrade returns a new http.Handler that implement Tailscale's 2021 Noise-based REST protocol
-func Upgrade(serverKey key.MachinePrivate, pool *sqlitex.Pool) http.HandlerFunc {
+func init() {
+	config.Register[Config]()
+}
+
+// Remote describes the client on the other end of the Noise channel, as seen by the server.
+type Remote struct {
+	Addr     netip.Addr       // client's ip address
+	Location *domain.Location // resolved geo / asn location of Addr; nil if unknown
+}
+
+// String returns the client's address as string, or an empty string if the address is unknown
+func (r Remote) String() string {
+	if !r.Addr.IsValid() {
+		return ""
+	}
+	return r.Addr.String()
+}
+
+// Upgrade returns a new http.Handler that implement Tailscale's 2021 Noise-based REST protocol. The client's address,
+// recorded with its registration and sessions, is resolved using forwarding headers sent by the trusted proxies.
+func Upgrade(serverKey key.MachinePrivate, pool *sqlitex.Pool, geo *geoip.Resolver, proxies *proxy.Trusted) http.HandlerFunc {
+	var objects = newCache() // shared by all sessions
+	pruneNetmaps()
+
 	return func(w http.ResponseWriter, req *http.Request) {
-		conn, err := controlhttp.AcceptHTTP(req.Context(), w, req, serverKey, nil)
+		ctx, span := tracer.Start(req.Context(), "noise.upgrade")
+		conn, err := controlhttp.AcceptHTTP(ctx, w, req, serverKey, nil)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+
 		if err != nil {
 			log.Err(err).Msg("failed to upgrade noise connection")
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -42,15 +109,22 @@ func Upgrade(serverKey key.MachinePrivate, pool *sqlitex.Pool) http.HandlerFunc
 			return
 		}
 
+		var remote = Remote{Addr: proxies.ClientAddr(req)}
+		remote.Location = geo.Lookup(remote.Addr)
+
 		var logger zerolog.Logger
 		logger = zerolog.Ctx(req.Context()).With().Str("peer", conn.Peer().String()).Logger()
 
 		r := chi.NewRouter()
 		r.Use(stock.NoCache, stock.Recoverer)
-		r.Use(hlog.NewHandler(logger), NewAccessLog(conn.Peer()))
+		r.Use(hlog.NewHandler(logger), NewAccessLog(conn.Peer(), remote), RecordMetrics)
 
-		r.Method(http.MethodPost, "/machine/register", MachineRegister(conn.Peer(), pool))
-		r.Method(http.MethodPost, "/machine/map", MachineMap(conn.Peer(), pool))
+		r.With(otelhttp.NewMiddleware("machine.register")).Method(http.MethodPost, "/machine/register", MachineRegister(conn.Peer(), remote, pool))
+		r.With(otelhttp.NewMiddleware("machine.map")).Method(http.MethodPost, "/machine/map", MachineMap(conn.Peer(), remote, pool, objects))
+		r.Method(http.MethodPost, "/machine/set-dns", MachineSetDNS(conn.Peer(), pool))
+		r.Method(http.MethodPost, "/machine/update-health", MachineUpdateHealth(conn.Peer(), pool))
+		r.Method(http.MethodGet, "/machine/ssh/action/from/{src}/to/{dst}", MachineSSHAction(conn.Peer(), pool))
+		r.Method(http.MethodPost, "/machine/ssh/notify", MachineSSHNotify(conn.Peer(), pool))
 
 		// h2c protocol (un-encrypted http2 over http/1) is used over a Noise authenticated channel
 		srv := &http.Server{Handler: h2c.NewHandler(r, &http2.Server{})}
@@ -67,11 +141,14 @@ func Upgrade(serverKey key.MachinePrivate, pool *sqlitex.Pool) http.HandlerFunc
 //
 // The log is sent at the start of the request itself as /machine endpoints can engage in
 // long-running operations, and we don't want to wait till the end to emit a log.
-func NewAccessLog(peer key.MachinePublic) func(next http.Handler) http.Handler {
+//
+// The remote client's address and resolved location (if known) are included in every log entry.
+func NewAccessLog(peer key.MachinePublic, remote Remote) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			sink := zerolog.Ctx(r.Context())
-			sink.Info().Str("peer", peer.String()).Str("method", r.Method).Str("path", r.URL.Path).Send()
+			sink.Info().Str("peer", peer.String()).Str("client_addr", remote.String()).Stringer("location", remote.Location).
+				Str("method", r.Method).Str("path", r.URL.Path).Send()
 
 			next.ServeHTTP(w, r)
 		})
@@ -0,0 +1,85 @@
+package coordinator
+
+import (
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"net"
+	"slices"
+	"strconv"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"time"
+)
+
+// diff compares the previously sent version of a peer with its current version, and returns a tailcfg.PeerChange
+// that patches the client's copy of the peer. It returns false if the peer has changed in a way that cannot be expressed
+// as a patch, in which case the complete node must be sent (using MapResponse.PeersChanged). A nil change is returned
+// if nothing (that can be patched) has changed.
+//
+// Changes to Node.Online are not included in the patch and must be sent using MapResponse.OnlineChange instead.
+func diff(prev, next *tailcfg.Node) (_ *tailcfg.PeerChange, ok bool) {
+	// clients flag peers as expired using the patched KeyExpiry, but never clear the flag
+	// once set; renewing an expired peer requires sending the complete node
+	if prev.Expired && !next.Expired {
+		return nil, false
+	}
+
+	// compare everything except the patchable fields
+	if util.Checksum(unpatchable(prev)) != util.Checksum(unpatchable(next)) {
+		return nil, false
+	}
+
+	var change = &tailcfg.PeerChange{NodeID: next.ID}
+	var changed = false
+
+	if prev.DERP != next.DERP {
+		change.DERPRegion, changed = derpRegion(next.DERP), true
+	}
+
+	if !slices.Equal(prev.Endpoints, next.Endpoints) {
+		if len(next.Endpoints) == 0 {
+			return nil, false // a nil PeerChange.Endpoints means unchanged; clearing them requires sending the complete node
+		}
+		change.Endpoints, changed = next.Endpoints, true
+	}
+
+	if prev.Key != next.Key {
+		change.Key, changed = util.ToPtr(next.Key), true
+	}
+
+	if prev.DiscoKey != next.DiscoKey {
+		change.DiscoKey, changed = util.ToPtr(next.DiscoKey), true
+	}
+
+	if !prev.KeyExpiry.Equal(next.KeyExpiry) {
+		change.KeyExpiry, changed = util.ToPtr(next.KeyExpiry), true
+	}
+
+	if next.LastSeen != nil && (prev.LastSeen == nil || !prev.LastSeen.Equal(*next.LastSeen)) {
+		change.LastSeen, changed = next.LastSeen, true
+	}
+
+	if !changed {
+		return nil, true
+	}
+
+	return change, true
+}
+
+// unpatchable returns a copy of the node with all fields that can be sent using tailcfg.PeerChange cleared
+func unpatchable(n *tailcfg.Node) *tailcfg.Node {
+	var c = n.Clone()
+	c.DERP, c.Endpoints, c.LastSeen, c.Online = "", nil, nil, nil
+	c.Key, c.DiscoKey, c.KeyExpiry, c.Expired = key.NodePublic{}, key.DiscoPublic{}, time.Time{}, false
+	return c
+}
+
+// derpRegion extracts the region id from the Node.DERP field, which is of the form 127.3.3.40:<region>
+func derpRegion(s string) int {
+	_, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return 0
+	}
+
+	region, _ := strconv.Atoi(port)
+	return region
+}
@@ -0,0 +1,89 @@
+package coordinator
+
+import (
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/spf13/viper"
+	"slices"
+	"sync"
+	"tailscale.com/tailcfg"
+)
+
+// NodeAttrDERPMapChecksum is the node attribute that carries the checksum of the derp map served to the tailnet, so that
+// support tooling can tell, from a client's netmap (eg. tailscale debug netmap), which relay map the client last received.
+const NodeAttrDERPMapChecksum tailcfg.NodeCapability = "github.com/riyaz-ali/wirefire/cap/derp-map-checksum"
+
+// DERPMapChecksum returns the checksum of the derp map currently served to clients; empty if no map is configured
+func DERPMapChecksum() string {
+	if dm, _ := viper.Get("derp.map").(*tailcfg.DERPMap); dm != nil {
+		return util.Checksum(dm)
+	}
+	return ""
+}
+
+// DERPMapStatus reports whether the machines connected to a tailnet have received the derp map currently served
+type DERPMapStatus struct {
+	Checksum  string   `json:"checksum"`        // checksum of the derp map currently served
+	Connected int      `json:"connected"`       // number of machines connected to the coordinator
+	Current   int      `json:"current"`         // number of connected machines that have received the current map
+	Stale     []string `json:"stale,omitempty"` // names of connected machines that are yet to receive the current map
+}
+
+// derpEntry is the checksum of the last derp map sent to a machine
+type derpEntry struct {
+	name     string
+	checksum string
+}
+
+// derpmaps tracks the checksum of the derp map last sent to connected machines, in memory, by tailnet
+var derpmaps = struct {
+	sync.Mutex
+	sent map[int]map[int]derpEntry // by tailnet, and machine
+}{
+	sent: make(map[int]map[int]derpEntry),
+}
+
+// DERPMap returns the derp map status of the machines connected to the tailnet
+func DERPMap(tailnetID int) *DERPMapStatus {
+	var status = &DERPMapStatus{Checksum: DERPMapChecksum()}
+
+	derpmaps.Lock()
+	for _, sent := range derpmaps.sent[tailnetID] {
+		status.Connected++
+		if sent.checksum == status.Checksum {
+			status.Current++
+		} else {
+			status.Stale = append(status.Stale, sent.name)
+		}
+	}
+	derpmaps.Unlock()
+
+	slices.Sort(status.Stale)
+	return status
+}
+
+// recordDERPMap records the checksum of the derp map sent to the machine
+func recordDERPMap(m *domain.Machine, checksum string) {
+	derpmaps.Lock()
+	defer derpmaps.Unlock()
+
+	var sent, ok = derpmaps.sent[m.TailnetID]
+	if !ok {
+		sent = make(map[int]derpEntry)
+		derpmaps.sent[m.TailnetID] = sent
+	}
+	sent[m.ID] = derpEntry{name: m.CompleteName(), checksum: checksum}
+}
+
+// forgetDERPMap stops tracking the derp map of the machine, once its map session ends
+func forgetDERPMap(m *domain.Machine) {
+	derpmaps.Lock()
+	defer derpmaps.Unlock()
+
+	if sent, ok := derpmaps.sent[m.TailnetID]; ok {
+		delete(sent, m.ID)
+		if len(sent) == 0 {
+			delete(derpmaps.sent, m.TailnetID)
+		}
+	}
+}
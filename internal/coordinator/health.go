@@ -0,0 +1,51 @@
+package coordinator
+
+import (
+	"context"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/rs/zerolog"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// maxHealthWarningLength is the length at which health warnings reported by clients are truncated
+const maxHealthWarningLength = 1024
+
+// MachineUpdateHealth handles the /machine/update-health endpoint, which clients use to report changes
+// to their health (eg. a warning being raised or cleared). Warnings are stored with the machine, and
+// are listed using the admin api. Clients ignore the response.
+func MachineUpdateHealth(peer key.MachinePublic, pool *sqlitex.Pool) util.HandlerFunc[tailcfg.HealthChangeRequest, struct{}] {
+	return func(ctx context.Context, req tailcfg.HealthChangeRequest) (_ *struct{}, err error) {
+		log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Logger()
+
+		if req.Subsys == "" || len(req.Subsys) > 128 {
+			return nil, errors.New("invalid health subsystem")
+		}
+
+		conn := pool.Get(ctx)
+		defer pool.Put(conn)
+
+		var machine *domain.Machine
+		if machine, err = database.FetchOne(conn, domain.GetMachineByKey(peer)); err != nil {
+			return nil, err
+		} else if machine == nil || (!req.NodeKey.IsZero() && machine.NodeKey != req.NodeKey) {
+			return nil, errors.New("machine not found")
+		}
+
+		var warning = req.Error
+		if len(warning) > maxHealthWarningLength {
+			warning = warning[:maxHealthWarningLength]
+		}
+
+		if _, err = database.Exec(conn, domain.SetHealthWarning(machine, req.Subsys, warning)); err != nil {
+			return nil, err
+		}
+
+		log.Debug().Str("subsys", req.Subsys).Str("warning", warning).Msg("client health changed")
+		return &struct{}{}, nil
+	}
+}
@@ -0,0 +1,356 @@
+package coordinator
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"tailscale.com/util/dnsname"
+	"time"
+)
+
+// KeyExpiry is the duration after which the key of a newly registered (or renewed) machine expires
+var KeyExpiry = settings.Define("coordinator.key_expiry", settings.Duration(180*24*time.Hour),
+	"duration after which a machine's key expires, requiring it to re-authenticate; keys never expire if zero")
+
+// KeyExpiryAt returns the time at which a key issued at t expires, as per KeyExpiry.
+// It returns the zero time if keys are configured to never expire.
+func KeyExpiryAt(t time.Time) time.Time {
+	if expiry := time.Duration(KeyExpiry.Get()); expiry > 0 {
+		return t.Add(expiry)
+	}
+	return time.Time{}
+}
+
+// NamingConfig configures the hostnames machines are allowed to register with
+type NamingConfig struct {
+	// ReservedNames are hostnames that machines cannot claim, eg. to keep them free for well-known services
+	ReservedNames []string `viper:"machines.reserved_names" default:"admin,api,login,vpn,wirefire"`
+
+	// ReservedPattern is a regular expression, matched against the whole (sanitized) hostname, of names that machines cannot claim
+	ReservedPattern string `viper:"machines.reserved_pattern" validate:"omitempty,pattern"`
+}
+
+func init() {
+	config.Register[NamingConfig]()
+}
+
+// CheckHostname returns domain.ErrHostnameReserved if the (sanitized) hostname is one of the reserved names, or matches the reserved pattern.
+func (c *NamingConfig) CheckHostname(name string) error {
+	if slices.ContainsFunc(c.ReservedNames, func(r string) bool { return strings.EqualFold(r, name) }) {
+		return errors.Wrap(domain.ErrHostnameReserved, name)
+	}
+
+	if c.ReservedPattern != "" {
+		if re, err := regexp.Compile("^(?:" + c.ReservedPattern + ")$"); err == nil && re.MatchString(name) {
+			return errors.Wrap(domain.ErrHostnameReserved, name)
+		}
+	}
+
+	return nil
+}
+
+// RenameMachine gives the machine a name chosen by an admin, which is kept even if the machine's hostname changes later. An empty
+// name reverts the machine to the name derived from its hostname, or to a new generated name in tailnets that use domain.NamingWords.
+// The machine is assigned a new name index if the name changes.
+//
+// domain.ErrInvalidMachineName is returned if the name isn't a valid dns label, and domain.ErrHostnameReserved
+// if the name is reserved (see: NamingConfig).
+func RenameMachine(conn *sqlite.Conn, machine *domain.Machine, name string) (err error) {
+	var given = name != ""
+	if given {
+		if name = strings.ToLower(name); dnsname.ValidLabel(name) != nil {
+			return errors.Wrap(domain.ErrInvalidMachineName, name)
+		}
+	} else if machine.Tailnet != nil && machine.Tailnet.Naming == domain.NamingWords {
+		if name, err = generateName(conn, machine.Tailnet); err != nil {
+			return err
+		}
+	} else if machine.HostInfo != nil {
+		name = dnsname.SanitizeHostname(machine.HostInfo.Hostname)
+	} else {
+		name = machine.Name
+	}
+
+	if err = config.Read[NamingConfig]().CheckHostname(name); err != nil {
+		return err
+	}
+
+	var idx = machine.NameIdx
+	if name != machine.Name {
+		idx = 0 // first machine with the given name has name_idx = 0
+		if ni, err := database.FetchOne[int](conn, domain.GetNextNameIndex(&domain.Tailnet{ID: machine.TailnetID}, name)); err != nil {
+			return err
+		} else if ni != nil {
+			idx = *ni
+		}
+	}
+
+	if _, err = database.Exec(conn, domain.RenameMachine(machine, name, idx, given)); err != nil {
+		return err
+	}
+
+	machine.Name, machine.NameIdx, machine.GivenName = name, idx, given
+	return nil
+}
+
+// CreateMachine creates a new machine, owned by user, in the given tailnet using the data from the registration request.
+// The machine is assigned a unique name and a free ip address from the tailnet's address space.
+//
+// Tags requested by the machine are verified against the tailnet's acl policy, and domain.ErrTagNotPermitted
+// is returned if the user is not allowed to apply any one of them. domain.ErrHostnameReserved is returned if the
+// machine's hostname is reserved (see: NamingConfig). In tailnets that use domain.NamingWords, the machine is given
+// a generated name instead, and its hostname is only kept as part of its hostinfo.
+func CreateMachine(conn *sqlite.Conn, user *domain.User, tailnet *domain.Tailnet, req *domain.RegistrationRequest) (_ *domain.Machine, err error) {
+	var machine = &domain.Machine{
+		NoiseKey: req.NoiseKey,
+		NodeKey:  req.Data.NodeKey,
+
+		HostInfo:  req.Data.Hostinfo,
+		Ephemeral: req.Data.Ephemeral,
+
+		CreatedAt: time.Now(),
+		ExpiresAt: KeyExpiryAt(time.Now()),
+
+		Location: req.Location,
+
+		TailnetID: tailnet.ID,
+		Tailnet:   tailnet,
+		UserID:    user.ID,
+		Owner:     user,
+	}
+
+	if addr, err := netip.ParseAddr(req.ClientAddr); err == nil {
+		machine.LastAddr = addr
+	}
+
+	// verify that the user is allowed to apply the tags requested by the machine (using tailscale up --advertise-tags)
+	if tags := req.Data.Hostinfo.RequestTags; len(tags) > 0 {
+		var role *string
+		if role, err = database.FetchOne(conn, domain.MemberRole(user, int64(tailnet.ID))); err != nil {
+			return nil, err
+		} else if role == nil {
+			role = util.ToPtr(domain.RoleMember)
+		}
+
+		if err = tailnet.VerifyTags(user, *role, tags); err != nil {
+			return nil, err
+		}
+
+		machine.AssignedTags = tags
+	}
+
+	// sanitize host name (or generate one) and assign name index if required
+	var name = dnsname.SanitizeHostname(req.Data.Hostinfo.Hostname)
+	if tailnet.Naming == domain.NamingWords {
+		name, err = generateName(conn, tailnet)
+	} else {
+		err = config.Read[NamingConfig]().CheckHostname(name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	machine.Name = name
+	machine.NameIdx = 0 // first machine with the given name has name_idx = 0
+
+	if ni, err := database.FetchOne[int](conn, domain.GetNextNameIndex(tailnet, name)); err != nil {
+		return nil, err
+	} else if ni != nil {
+		machine.NameIdx = *ni
+	}
+
+	// assign ip addresses to the node
+	if machine.IPv4, machine.IPv6, err = allocateAddrs(conn, tailnet); err != nil {
+		return nil, err
+	}
+
+	if m, err := database.Exec(conn, domain.SaveMachine(machine)); err != nil {
+		return nil, err
+	} else {
+		machine = m[0]
+	}
+
+	if _, err = database.Exec(conn, domain.ClaimAddrs(machine)); err != nil {
+		return nil, err
+	}
+
+	// record subnet routes advertised by the machine, approving the ones permitted by the acl policy
+	if err = SyncRoutes(conn, machine); err != nil {
+		return nil, err
+	}
+
+	return machine, nil
+}
+
+// ReauthenticateMachine re-registers an existing machine that has authenticated again (eg. after its key expired, or it
+// logged out) as user, in the given tailnet. The machine's node key and hostinfo are replaced with the ones from the
+// registration request, and its key expiry is renewed; the disco key isn't part of the request, and is updated by the
+// client's next map request. A machine can't change its owner or tailnet, so if either differs, the machine is deleted
+// and created afresh (see: CreateMachine).
+//
+// It returns the re-registered machine, and whether it was created afresh.
+func ReauthenticateMachine(conn *sqlite.Conn, user *domain.User, tailnet *domain.Tailnet, machine *domain.Machine, req *domain.RegistrationRequest) (_ *domain.Machine, created bool, err error) {
+	if machine.UserID != user.ID || machine.TailnetID != tailnet.ID {
+		if _, err = database.Exec(conn, domain.DeleteNode(machine)); err != nil {
+			return nil, false, err
+		}
+
+		machine, err = CreateMachine(conn, user, tailnet, req)
+		return machine, true, err
+	}
+
+	// verify that the user is (still) allowed to apply the tags requested by the machine
+	if tags := req.Data.Hostinfo.RequestTags; len(tags) > 0 && !slices.Equal(tags, machine.AssignedTags) {
+		if err = tailnet.VerifyTags(user, machine.Role, tags); err != nil {
+			return nil, false, err
+		}
+
+		machine.AssignedTags = tags
+	}
+
+	// the hostname may have changed while the machine was logged out
+	if sanitizeHostname := dnsname.SanitizeHostname(req.Data.Hostinfo.Hostname); machine.Name != sanitizeHostname && followsHostname(machine, tailnet) {
+		if err = config.Read[NamingConfig]().CheckHostname(sanitizeHostname); err != nil {
+			return nil, false, err
+		}
+
+		machine.Name, machine.NameIdx = sanitizeHostname, 0
+		if ni, err := database.FetchOne[int](conn, domain.GetNextNameIndex(tailnet, sanitizeHostname)); err != nil {
+			return nil, false, err
+		} else if ni != nil {
+			machine.NameIdx = *ni
+		}
+	}
+
+	machine.NodeKey = req.Data.NodeKey
+	machine.HostInfo = req.Data.Hostinfo
+	machine.ExpiresAt = KeyExpiryAt(time.Now())
+
+	if addr, err := netip.ParseAddr(req.ClientAddr); err == nil {
+		machine.LastAddr = addr
+	}
+
+	if m, err := database.Exec(conn, domain.SaveMachine(machine)); err != nil {
+		return nil, false, err
+	} else {
+		machine = m[0]
+	}
+
+	// routes advertised by the machine may have changed as well
+	if err = SyncRoutes(conn, machine); err != nil {
+		return nil, false, err
+	}
+
+	return machine, false, nil
+}
+
+// ErrMachineExists is returned when importing a machine that's already registered with the coordinator
+var ErrMachineExists = errors.New("machine is already registered")
+
+// ImportMachine registers a machine, exported from another coordinator (see: domain.MachineIdentity), owned by user in
+// the given tailnet. The machine keeps its keys, key expiry and, if they're in the tailnet's pools and free, its addresses,
+// so that it can connect to this coordinator without re-registering. It's assigned new addresses otherwise.
+//
+// Tags on the machine are verified against the tailnet's acl policy, as in CreateMachine. ErrMachineExists is returned
+// if a machine with the same machine key is already registered, and domain.ErrIdentityUsed if the identity has already
+// been imported; the claim on it is only kept if the import is committed.
+func ImportMachine(conn *sqlite.Conn, user *domain.User, tailnet *domain.Tailnet, identity *domain.MachineIdentity) (_ *domain.Machine, err error) {
+	if existing, err := database.FetchOne(conn, domain.GetMachineByKey(identity.NoiseKey)); err != nil {
+		return nil, err
+	} else if existing != nil {
+		return nil, ErrMachineExists
+	}
+
+	if claimed, err := database.FetchOne(conn, domain.ClaimIdentity(identity)); err != nil {
+		return nil, err
+	} else if claimed == nil {
+		return nil, domain.ErrIdentityUsed
+	}
+
+	var machine = &domain.Machine{
+		NoiseKey: identity.NoiseKey,
+		NodeKey:  identity.NodeKey,
+		DiscoKey: identity.DiscoKey,
+
+		HostInfo:  identity.HostInfo,
+		Ephemeral: identity.Ephemeral,
+
+		CreatedAt: time.Now(),
+		ExpiresAt: identity.ExpiresAt,
+
+		TailnetID: tailnet.ID,
+		Tailnet:   tailnet,
+		UserID:    user.ID,
+		Owner:     user,
+	}
+
+	if tags := identity.Tags; len(tags) > 0 {
+		var role *string
+		if role, err = database.FetchOne(conn, domain.MemberRole(user, int64(tailnet.ID))); err != nil {
+			return nil, err
+		} else if role == nil {
+			role = util.ToPtr(domain.RoleMember)
+		}
+
+		if err = tailnet.VerifyTags(user, *role, tags); err != nil {
+			return nil, err
+		}
+
+		machine.AssignedTags = tags
+	}
+
+	if err = config.Read[NamingConfig]().CheckHostname(identity.Name); err != nil {
+		return nil, err
+	}
+
+	machine.Name = identity.Name
+	if ni, err := database.FetchOne[int](conn, domain.GetNextNameIndex(tailnet, identity.Name)); err != nil {
+		return nil, err
+	} else if ni != nil {
+		machine.NameIdx = *ni
+	}
+
+	if machine.IPv4, machine.IPv6, err = allocateAddrs(conn, tailnet, identity.IPv4, identity.IPv6); err != nil {
+		return nil, err
+	}
+
+	if m, err := database.Exec(conn, domain.SaveMachine(machine)); err != nil {
+		return nil, err
+	} else {
+		machine = m[0]
+	}
+
+	if _, err = database.Exec(conn, domain.ClaimAddrs(machine)); err != nil {
+		return nil, err
+	}
+
+	// the name given by an admin, and the site, aren't part of the registration data saved above
+	if identity.GivenName {
+		if _, err = database.Exec(conn, domain.RenameMachine(machine, machine.Name, machine.NameIdx, true)); err != nil {
+			return nil, err
+		}
+		machine.GivenName = true
+	}
+
+	if identity.Site != "" {
+		if _, err = database.Exec(conn, domain.SetMachineSite(machine, identity.Site)); err != nil {
+			return nil, err
+		}
+		machine.Site = identity.Site
+	}
+
+	if err = SyncRoutes(conn, machine); err != nil {
+		return nil, err
+	}
+
+	return machine, nil
+}
@@ -0,0 +1,358 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/spf13/viper"
+	"net/netip"
+	"slices"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"testing"
+)
+
+func TestCreateMachine_Tags(t *testing.T) {
+	var conn = fixture(t)
+	exec(t, conn, `UPDATE tailnets SET acl = '{
+		"groups": { "group:ops": ["bob@example.com"] },
+		"tagOwners": { "tag:server": ["group:ops"], "tag:ci": [], "tag:any": ["autogroup:member"] },
+		"acls": [{ "action": "accept", "src": ["*"], "dst": ["*:*"] }]
+	}' WHERE id = 1`)
+
+	var tailnet, _ = database.FetchOne(conn, domain.TailnetById(1))
+	var alice, _ = database.FetchOne(conn, domain.UserById(1)) // admin
+	var bob, _ = database.FetchOne(conn, domain.UserById(2))   // member
+
+	var cases = []struct {
+		name    string
+		user    *domain.User
+		tags    []string
+		allowed bool
+	}{
+		{"Owner", bob, []string{"tag:server"}, true},
+		{"Autogroup", bob, []string{"tag:any"}, true},
+		{"NotOwner", bob, []string{"tag:server", "tag:ci"}, false},
+		{"Admin", alice, []string{"tag:server", "tag:ci"}, true},
+		{"Undeclared", alice, []string{"tag:unknown"}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var req = &domain.RegistrationRequest{
+				NoiseKey: key.NewMachine().Public(),
+				Data: tailcfg.RegisterRequest{
+					NodeKey:  key.NewNode().Public(),
+					Hostinfo: &tailcfg.Hostinfo{Hostname: "delta", RequestTags: tc.tags},
+				},
+			}
+
+			m, err := CreateMachine(conn, tc.user, tailnet, req)
+			if !tc.allowed {
+				if !errors.Is(err, domain.ErrTagNotPermitted) {
+					t.Fatalf("expected ErrTagNotPermitted; got %v", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("failed to create machine: %v", err)
+			} else if !slices.Equal(m.Tags(), tc.tags) {
+				t.Errorf("unexpected tags %v; want %v", m.Tags(), tc.tags)
+			}
+		})
+	}
+}
+
+func TestCreateMachine_ReservedHostname(t *testing.T) {
+	var conn = fixture(t)
+	var tailnet, _ = database.FetchOne(conn, domain.TailnetById(1))
+	var alice, _ = database.FetchOne(conn, domain.UserById(1))
+
+	viper.Set("machines.reserved_pattern", "gw-[0-9]+")
+	t.Cleanup(func() { viper.Set("machines.reserved_pattern", "") })
+
+	for hostname, allowed := range map[string]bool{"Admin": false, "gw-01": false, "gw-01-backup": true, "delta": true} {
+		var req = &domain.RegistrationRequest{
+			NoiseKey: key.NewMachine().Public(),
+			Data:     tailcfg.RegisterRequest{NodeKey: key.NewNode().Public(), Hostinfo: &tailcfg.Hostinfo{Hostname: hostname}},
+		}
+
+		if _, err := CreateMachine(conn, alice, tailnet, req); allowed && err != nil {
+			t.Errorf("failed to create machine %q: %v", hostname, err)
+		} else if !allowed && !errors.Is(err, domain.ErrHostnameReserved) {
+			t.Errorf("expected ErrHostnameReserved for %q; got %v", hostname, err)
+		}
+	}
+}
+
+func TestRenameMachine(t *testing.T) {
+	var conn = fixture(t)
+	var bravo = machine(t, conn, 2)
+
+	// alpha is already taken, so bravo is assigned the next name index
+	if err := RenameMachine(conn, bravo, "Alpha"); err != nil {
+		t.Fatalf("failed to rename machine: %v", err)
+	}
+
+	if got := machine(t, conn, 2); got.CompleteName() != "alpha-1" || !got.GivenName {
+		t.Errorf("unexpected name %q (given=%t); want alpha-1", got.CompleteName(), got.GivenName)
+	}
+
+	for _, name := range []string{"not valid", "-alpha", "admin"} {
+		if err := RenameMachine(conn, bravo, name); err == nil {
+			t.Errorf("expected error renaming machine to %q", name)
+		}
+	}
+
+	// an empty name reverts to the hostname
+	if err := RenameMachine(conn, bravo, ""); err != nil {
+		t.Fatalf("failed to revert machine name: %v", err)
+	}
+
+	if got := machine(t, conn, 2); got.CompleteName() != "bravo" || got.GivenName {
+		t.Errorf("unexpected name %q (given=%t); want bravo", got.CompleteName(), got.GivenName)
+	}
+}
+
+func TestImportMachine_Replay(t *testing.T) {
+	var conn = fixture(t)
+	var tailnet, _ = database.FetchOne(conn, domain.TailnetById(1))
+	var alice, _ = database.FetchOne(conn, domain.UserById(1))
+
+	// remove deletes the machine, as when it's migrated to another coordinator
+	var remove = func(id int) {
+		exec(t, conn, fmt.Sprintf(`DELETE FROM ip_allocations WHERE machine_id = %[1]d; DELETE FROM machines WHERE id = %[1]d`, id))
+	}
+
+	var identity = domain.NewMachineIdentity(machine(t, conn, 1))
+	remove(1)
+
+	m, err := ImportMachine(conn, alice, tailnet, identity)
+	if err != nil {
+		t.Fatalf("failed to import machine: %v", err)
+	}
+
+	// the machine is deleted again, so the replayed identity doesn't collide with it
+	remove(m.ID)
+	if _, err = ImportMachine(conn, alice, tailnet, identity); !errors.Is(err, domain.ErrIdentityUsed) {
+		t.Errorf("expected replayed identity to be rejected; got %v", err)
+	}
+}
+
+func TestCheckRouteOverlap(t *testing.T) {
+	var conn = fixture(t)
+	var tailnet, _ = database.FetchOne(conn, domain.TailnetById(1))
+
+	var cases = []struct {
+		route    string
+		overlaps bool
+	}{
+		{"100.64.0.0/30", true},
+		{"100.64.0.2/32", true},
+		{"100.64.1.0/24", false},
+		{"10.0.0.0/8", false},
+		{"fd7a:115c:a1e0::/48", true},
+		{"fd7a:115c:a1e0:ab12:4843:cd96:6240:3/128", true},
+		{"fd7a:115c:a1e0:ab12:4843:cd96:6240:4/128", false},
+		{"0.0.0.0/0", false},
+		{"::/0", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.route, func(t *testing.T) {
+			_, overlaps, err := CheckRouteOverlap(conn, tailnet, netip.MustParsePrefix(tc.route))
+			if err != nil {
+				t.Fatalf("failed to check overlap: %v", err)
+			} else if overlaps != tc.overlaps {
+				t.Errorf("unexpected overlap %v; want %v", overlaps, tc.overlaps)
+			}
+		})
+	}
+}
+
+func TestReapproveRoutes(t *testing.T) {
+	var conn = fixture(t)
+	exec(t, conn, `UPDATE machines SET host_info = json_set(host_info, '$.RoutableIPs', json('["10.1.0.0/16", "192.168.0.0/24"]')) WHERE id = 2`)
+	exec(t, conn, `INSERT INTO routes (machine_id, prefix, approved) VALUES (2, '10.1.0.0/16', false), (2, '192.168.0.0/24', true)`)
+	exec(t, conn, `UPDATE tailnets SET acl = '{
+		"autoApprovers": { "routes": { "10.0.0.0/8": ["bob@example.com"] } },
+		"acls": [{ "action": "accept", "src": ["*"], "dst": ["*:*"] }]
+	}' WHERE id = 1`)
+
+	var tailnet, _ = database.FetchOne(conn, domain.TailnetById(1))
+	if err := ReapproveRoutes(conn, tailnet); err != nil {
+		t.Fatalf("failed to re-approve routes: %v", err)
+	}
+
+	routes, err := database.FetchMany(conn, domain.ListRoutes(machine(t, conn, 2)))
+	if err != nil {
+		t.Fatalf("failed to list routes: %v", err)
+	} else if len(routes) != 2 {
+		t.Fatalf("expected both advertised routes to be kept; got %d", len(routes))
+	}
+
+	for _, route := range routes {
+		if !route.Approved {
+			t.Errorf("expected %s to be approved", route.Prefix)
+		}
+	}
+}
+
+func TestCheckIpInTailnet(t *testing.T) {
+	var conn = fixture(t)
+	var tailnet, _ = database.FetchOne(conn, domain.TailnetById(1))
+	exec(t, conn, `UPDATE machines SET ipv6 = 'fd7a:115c:a1e0::beef' WHERE id = 3`)
+
+	for ip, want := range map[string]bool{
+		"100.64.0.1":                           true,
+		"100.64.0.9":                           false,
+		"fd7a:115c:a1e0:ab12:4843:cd96:6240:1": true,
+		"fd7a:115c:a1e0:ab12:4843:cd96:6240:9": false,
+		"fd7a:115c:a1e0::beef":                 true,
+		"fd00::1":                              false,
+	} {
+		exists, err := database.FetchOne(conn, domain.CheckIpInTailnet(netip.MustParseAddr(ip), tailnet))
+		if err != nil {
+			t.Fatalf("failed to check %s: %v", ip, err)
+		} else if *exists != want {
+			t.Errorf("unexpected result for %s: %v; want %v", ip, *exists, want)
+		}
+	}
+}
+
+func TestReserveAddr(t *testing.T) {
+	var conn = fixture(t)
+	var tailnet, _ = database.FetchOne(conn, domain.TailnetById(1))
+
+	var reserve = func(ip string) bool {
+		t.Helper()
+
+		reserved, err := database.FetchOne(conn, domain.ReserveAddr(tailnet, netip.MustParseAddr(ip)))
+		if err != nil {
+			t.Fatalf("failed to reserve %s: %v", ip, err)
+		}
+		return reserved != nil && *reserved
+	}
+
+	if reserve("100.64.0.1") {
+		t.Errorf("expected address allocated to a machine to not be reserved")
+	}
+
+	if !reserve("100.64.0.9") || reserve("100.64.0.9") {
+		t.Errorf("expected free address to be reserved exactly once")
+	}
+
+	exec(t, conn, `DELETE FROM machines WHERE id = 3`)
+	if !reserve("100.64.0.3") {
+		t.Errorf("expected address of a deleted machine to be reclaimed")
+	}
+}
+
+func TestSetPools(t *testing.T) {
+	var conn = fixture(t)
+	var tailnet, _ = database.FetchOne(conn, domain.TailnetById(1))
+	exec(t, conn, `INSERT INTO routes (machine_id, prefix, approved) VALUES (2, '100.90.0.0/24', true)`)
+
+	for _, pool := range []string{"10.0.0.0/8", "100.64.0.0/31", "100.90.0.0/16"} {
+		if _, err := SetPools(conn, tailnet, netip.MustParsePrefix(pool), netip.Prefix{}, false); !errors.Is(err, ErrInvalidPool) {
+			t.Errorf("expected ErrInvalidPool for %s; got %v", pool, err)
+		}
+	}
+
+	var v4 = netip.MustParsePrefix("100.80.0.0/24")
+	migrated, err := SetPools(conn, tailnet, v4, netip.Prefix{}, true)
+	if err != nil {
+		t.Fatalf("failed to set pools: %v", err)
+	} else if len(migrated) != 3 {
+		t.Fatalf("expected all machines to be migrated; got %d", len(migrated))
+	}
+
+	for _, id := range []int{1, 2, 3} {
+		if m := machine(t, conn, id); !v4.Contains(m.IPv4) || !m.IPv6.IsValid() {
+			t.Errorf("expected machine %d to be migrated into the pool; got %s, %s", id, m.IPv4, m.IPv6)
+		}
+	}
+
+	// machines already in the pool are left as-is
+	if migrated, err = SetPools(conn, tailnet, v4, netip.Prefix{}, true); err != nil || len(migrated) != 0 {
+		t.Errorf("expected no machines to be migrated; got %d, %v", len(migrated), err)
+	}
+}
+
+func TestExitNodeUsage(t *testing.T) {
+	var conn = fixture(t)
+	exec(t, conn, `INSERT INTO routes (machine_id, prefix, approved) VALUES (3, '0.0.0.0/0', true), (3, '::/0', true)`)
+
+	var wire WireMapRequest
+	if err := json.Unmarshal([]byte(`{"Version": 68, "Hostinfo": {"Hostname": "alpha", "ExitNodeID": "3"}}`), &wire); err != nil {
+		t.Fatalf("failed to decode map request: %v", err)
+	}
+
+	req, exitNode := wire.Unwrap()
+	if req.Hostinfo == nil || req.Hostinfo.Hostname != "alpha" || exitNode != 3 {
+		t.Fatalf("unexpected map request %+v with exit node %d", req, exitNode)
+	}
+
+	var alpha, bravo = machine(t, conn, 1), machine(t, conn, 2)
+	for _, q := range []database.I[database.EmptyResponse, *domain.Machine]{
+		domain.SetExitNode(alpha, exitNode),
+		domain.SetExitNode(bravo, 3),
+		domain.SetExitNode(bravo, 0),  // bravo stopped using the exit node
+		domain.SetExitNode(bravo, 42), // unknown machines are ignored
+	} {
+		if _, err := database.Exec(conn, q); err != nil {
+			t.Fatalf("failed to set exit node: %v", err)
+		}
+	}
+
+	usage, err := database.FetchMany(conn, domain.ListExitNodeUsage(1))
+	if err != nil {
+		t.Fatalf("failed to list exit node usage: %v", err)
+	}
+
+	if len(usage) != 1 || usage[0].MachineID != 3 || !usage[0].Approved || !slices.Equal(usage[0].Clients, []string{alpha.CompleteName()}) {
+		t.Errorf("unexpected exit node usage %+v", usage)
+	}
+}
+
+func TestHealthWarnings(t *testing.T) {
+	var conn = fixture(t)
+	var alpha, bravo = machine(t, conn, 1), machine(t, conn, 2)
+
+	for _, q := range []database.I[database.EmptyResponse, *domain.Machine]{
+		domain.SetHealthWarning(alpha, "derp", "unable to connect to home derp region"),
+		domain.SetHealthWarning(alpha, "dns", "failed to set dns configuration"),
+		domain.SetHealthWarning(alpha, "derp", "home derp region unhealthy"), // replaces the previous warning
+		domain.SetHealthWarning(alpha, "dns", ""),                            // clears the warning
+		domain.SetHealthWarning(bravo, "router", "failed to configure routes"),
+	} {
+		if _, err := database.Exec(conn, q); err != nil {
+			t.Fatalf("failed to set health warning: %v", err)
+		}
+	}
+
+	warnings, err := database.FetchMany(conn, domain.ListHealthWarnings(1, int64(alpha.ID)))
+	if err != nil {
+		t.Fatalf("failed to list health warnings: %v", err)
+	}
+
+	if len(warnings) != 1 || warnings[0].Subsys != "derp" || warnings[0].Error != "home derp region unhealthy" || warnings[0].Machine != "alpha" {
+		t.Errorf("unexpected warnings %+v", warnings)
+	}
+
+	if warnings, _ = database.FetchMany(conn, domain.ListHealthWarnings(1, 0)); len(warnings) != 2 {
+		t.Errorf("expected warnings of all machines; got %+v", warnings)
+	}
+
+	// warnings for new subsystems are dropped once the limit is reached
+	for i := 0; i < domain.MaxHealthWarnings+5; i++ {
+		_, _ = database.Exec(conn, domain.SetHealthWarning(bravo, fmt.Sprintf("subsys-%d", i), "warning"))
+	}
+
+	if warnings, _ = database.FetchMany(conn, domain.ListHealthWarnings(1, int64(bravo.ID))); len(warnings) != domain.MaxHealthWarnings {
+		t.Errorf("expected %d warnings; got %d", domain.MaxHealthWarnings, len(warnings))
+	}
+}
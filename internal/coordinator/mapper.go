@@ -2,42 +2,73 @@ package coordinator
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/riyaz-ali/tacl"
 	"github.com/riyaz-ali/wirefire/internal/config"
 	"github.com/riyaz-ali/wirefire/internal/database"
 	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/riyaz-ali/wirefire/internal/tracing"
 	"github.com/riyaz-ali/wirefire/internal/util"
 	"github.com/rs/zerolog"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 	"golang.org/x/sync/errgroup"
+	"io"
+	"math/rand/v2"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/key"
 	"tailscale.com/util/dnsname"
+	"tailscale.com/util/rands"
 	"time"
 )
 
 type DnsConfig struct {
 	MagicDns       bool   `viper:"dns.magic_dns" default:"true"`
 	MagicDnsSuffix string `viper:"dns.magic_dns_suffix" default:"wirefire.net"`
+
+	// FallbackResolvers are sent to clients of tailnets that don't define their own fallback resolvers
+	FallbackResolvers []string `viper:"dns.fallback_resolvers" validate:"dive,resolver"`
+
+	// HttpsCerts enables https certificates for machines' MagicDNS names; see CertConfig
+	HttpsCerts bool `viper:"certs.enabled" default:"false"`
+
+	// ReverseDns routes reverse (PTR) lookups of the tailnet's addresses to the client's built-in resolver, which answers
+	// them with the MagicDNS names of the machines; eg. so that traceroute and ssh show machine names rather than addresses.
+	ReverseDns bool `viper:"dns.reverse_dns" default:"true"`
+}
+
+func init() {
+	config.Register[DnsConfig]()
 }
 
-// Adapt adapts the global DNS config for use with the given tailnet
-func (c *DnsConfig) Adapt(tailnet *domain.Tailnet) *tailcfg.DNSConfig {
-	var config = &tailcfg.DNSConfig{}
+// Adapt adapts the global DNS config for use with the given machine
+func (c *DnsConfig) Adapt(m *domain.Machine) *tailcfg.DNSConfig {
+	var config, tailnet = &tailcfg.DNSConfig{}, m.Tailnet
 
 	sanitizeTailnetName := dnsname.SanitizeHostname(tailnet.Name)
 	tailnetDomain := fmt.Sprintf("%s.%s", sanitizeTailnetName, c.MagicDnsSuffix)
 
-	// routes is used to implement split dns; we use this when enabling magic dns
+	// routes is used to implement split dns; the tailnet's own routes are merged with the one for magic dns
 	var routes = make(map[string][]*dnstype.Resolver)
+	for domain, addrs := range tailnet.DNS.Routes {
+		routes[domain] = resolvers(addrs)
+	}
 
 	if c.MagicDns {
 		// If the value is an empty slice, that means the suffix should still
@@ -47,190 +78,770 @@ func (c *DnsConfig) Adapt(tailnet *domain.Tailnet) *tailcfg.DNSConfig {
 		config.Domains = append(config.Domains, tailnetDomain)
 		config.Proxied = true
 
-		// TODO(@riyaz): enable this when implementing https certificates
-		//
-		// if certsEnabled {
-		// 	certDomains = append(certDomains, fmt.Sprintf("%s.%s", m.CompleteName(), tailnetDomain))
-		// }
+		if c.HttpsCerts {
+			config.CertDomains = []string{fqdn(m, c.MagicDnsSuffix)}
+		}
+
+		if c.ReverseDns {
+			for _, zone := range reverseZones(tailnet) {
+				if _, exists := routes[zone]; !exists { // the tailnet may route some of its reverse zones elsewhere
+					routes[zone] = nil
+				}
+			}
+		}
 	}
 
 	config.Routes = routes
+	config.Resolvers = resolvers(tailnet.DNS.Nameservers)
+	config.Domains = append(config.Domains, tailnet.DNS.SearchDomains...)
+
+	for _, r := range tailnet.DNS.ExtraRecords {
+		config.ExtraRecords = append(config.ExtraRecords, tailcfg.DNSRecord{Name: r.Name, Type: r.Type, Value: r.Value})
+	}
+
+	if config.FallbackResolvers = resolvers(tailnet.DNS.FallbackResolvers); len(config.FallbackResolvers) == 0 {
+		config.FallbackResolvers = resolvers(c.FallbackResolvers)
+	}
 	config.ExitNodeFilteredSet = []string{fmt.Sprintf(".%s", c.MagicDnsSuffix)}
 
 	return config
 }
 
-// mapper returns a function that can be used to create tailcfg.MapResponse. It uses a
-// closure to capture state between invocations and serve delta requests more efficiently.
-func mapper() func(context.Context, *sqlite.Conn, *domain.Machine) (*tailcfg.MapResponse, error) {
-	dns := config.MustValidate(config.Read[DnsConfig]())
+// reverseZones returns the reverse dns zones covering the tailnet's address pools, along with Tailscale's 4to6 range
+// that machines registered before ipv6 addresses were allocated natively use (see: domain.Machine.IP).
+func reverseZones(tailnet *domain.Tailnet) []string {
+	var v4, v6 = Pools(tailnet)
+	var zones = slices.Concat(domain.ReverseZones(v4), domain.ReverseZones(v6))
+
+	if via := tsaddr.Tailscale4To6Range(); !v6.Contains(via.Addr()) || v6.Bits() > via.Bits() {
+		zones = append(zones, domain.ReverseZones(via)...)
+	}
+
+	return zones
+}
+
+// resolvers converts the list of resolver addresses into dnstype.Resolver
+func resolvers(addrs []string) []*dnstype.Resolver {
+	var result = make([]*dnstype.Resolver, 0, len(addrs))
+	for _, addr := range addrs {
+		result = append(result, &dnstype.Resolver{Addr: addr})
+	}
+	return result
+}
+
+// mapState is the state a map session keeps between responses, to serve delta responses. It's persisted when the server
+// shuts down, so that a client resuming the session after the restart (see: tailcfg.MapRequest.MapSessionHandle) is sent
+// a delta from what it was last sent, rather than a full netmap.
+type mapState struct {
+	Version tailcfg.CapabilityVersion `json:"version"` // capability version of the client the session was served to
+	Counter int                       `json:"counter"` // number of responses prepared so far, plus one
+	Seq     int64                     `json:"seq"`     // sequence number of the last response sent to the client; see serve
+
+	// checksums of the parts of the netmap, as last sent to the client
+	DERP    string `json:"derp"`
+	Health  string `json:"health"`
+	Node    string `json:"node"`
+	DNS     string `json:"dns"`
+	Filter  string `json:"filter"`
+	SSH     string `json:"ssh"`
+	Peers   string `json:"peers"`
+	LogTail bool   `json:"log_tail_disabled"` // has log streaming been disabled?
+
+	SentPeers map[tailcfg.NodeID]*tailcfg.Node `json:"sent_peers"` // peers, as last sent to the client
+	SentUsers map[tailcfg.UserID]bool          `json:"sent_users"` // user profiles already sent to the client
+}
+
+// newMapState returns the state of a new map session with a client of the given capabilities
+func newMapState(caps Capabilities) *mapState {
+	return &mapState{Version: caps.Version, Counter: 1, SentPeers: make(map[tailcfg.NodeID]*tailcfg.Node), SentUsers: make(map[tailcfg.UserID]bool)}
+}
+
+// mapper returns a function that can be used to create tailcfg.MapResponse, for a new map session; see resume.
+func mapper(objects *cache, caps Capabilities) func(context.Context, *sqlite.Conn, *domain.Machine) (*tailcfg.MapResponse, error) {
+	return resume(objects, caps, newMapState(caps))
+}
 
-	// save state between invocations to serve delta responses
-	counter, derpChecksum := 1, ""
+// resume returns a function that can be used to create tailcfg.MapResponse, continuing the map session whose state is
+// given. State is kept between invocations to serve delta requests more efficiently.
+//
+// The first invocation of a new session returns a complete response. Subsequent invocations (and all invocations of a
+// resumed session) return a delta response that only contains what has changed since the last response (using PeersChanged,
+// PeersRemoved, PeersChangedPatch and OnlineChange for peers, as far as the client's capabilities allow), or nil if nothing
+// has changed at all.
+func resume(objects *cache, caps Capabilities, st *mapState) func(context.Context, *sqlite.Conn, *domain.Machine) (*tailcfg.MapResponse, error) {
+	dns := config.MustValidate(config.Read[DnsConfig]())
+	action := sshAction(config.Read[Config]().BaseUrl)
 
 	return func(ctx context.Context, conn *sqlite.Conn, m *domain.Machine) (_ *tailcfg.MapResponse, err error) {
 		log := zerolog.Ctx(ctx).With().Str("peer", m.NoiseKey.String()).Logger()
-		delta := counter > 1
-		defer func() { counter += 1 }()
+		delta := st.Counter > 1
+		defer func() { st.Counter += 1 }()
 
 		log.Debug().Msgf("preparing map response for machine(name=%q tailnet=%d) delta=%t", m.CompleteName(), m.Tailnet.ID, delta)
 		var resp = &tailcfg.MapResponse{Domain: domain.SanitizeTailnetName(m.Tailnet.Name), ControlTime: util.ToPtr(time.Now().UTC())}
 
-		if !delta {
-			resp.Debug = &tailcfg.Debug{DisableLogTail: true}
+		// changed tracks whether the (delta) response carries any change at all
+		var changed = !delta
+
+		// clients stream their logs only if the tailnet's logging policy enables it (see: domain.Logging), and it isn't
+		// disabled server-wide (see: DisableLogCollection). It's disabled on every response, including deltas, so that
+		// the policy holds however the client picks up the stream; as a client can't turn log streaming back on once it's
+		// been disabled (until it restarts), only the first response that disables it counts as a change.
+		var logging = m.Tailnet.Logging
+		if !logging.Enabled || DisableLogCollection.Get() {
+			changed = changed || !st.LogTail
+			st.LogTail, resp.Debug = true, &tailcfg.Debug{DisableLogTail: true}
 		}
 
 		var users = make(map[int]tailcfg.UserProfile)
 		users[m.UserID] = m.Owner.AsUserProfile()
 
+		// list all machines in this tailnet, used to build peer info below
+		var machines []*domain.Machine
+		if machines, err = objects.machines(conn, m.Tailnet); err != nil {
+			var se sqlite.Error
+			if errors.As(err, &se) && se.Code == sqlite.SQLITE_INTERRUPT {
+				return nil, nil // suppress interrupt errors
+			}
+
+			return nil, err
+		}
+
+		// machines pending approval are not shown to peers, and don't see any themselves; see domain.Tailnet.RequireApproval
+		machines = slices.DeleteFunc(machines, func(machine *domain.Machine) bool {
+			return machine.ID != m.ID && (!machine.Authorized || !m.Authorized)
+		})
+
+		// machines that logged out are removed from their peers' netmaps right away; see domain.RevokeNodeKey
+		machines = slices.DeleteFunc(machines, func(machine *domain.Machine) bool { return machine.ID != m.ID && machine.LoggedOut })
+
+		var primaries = primaryRoutes(machines) // machines elected as primary for each subnet route
+
 		var node = m.AsNode() // convert this machine to *tailcfg.Node
+		applyPrimaryRoutes(node, primaries)
 
 		// NOTE: trailing dot is important!
-		node.Name = fmt.Sprintf("%s.%s.%s.", m.CompleteName(), dnsname.SanitizeHostname(m.Tailnet.Name), dns.MagicDnsSuffix)
+		node.Name = fqdn(m, dns.MagicDnsSuffix) + "."
 		node.Online = util.ToPtr(true)
 
-		resp.Node = node
+		if m.IsDerpOnly() {
+			// restrict the client to tcp/443, which implies all traffic is relayed over derp
+			node.CapMap[tailcfg.NodeAttrOnlyTCP443] = nil
+		}
 
-		resp.DNSConfig = dns.Adapt(m.Tailnet) // build dns configuration
+		// grant capabilities based on the owner's role in the tailnet; see domain.Tailnet.Capabilities
+		for _, c := range m.Tailnet.CapabilitiesFor(m.Role) {
+			node.CapMap[c] = nil
+		}
+
+		// enable client features turned on for the tailnet; see domain.Features
+		for _, c := range m.Tailnet.Features.Capabilities() {
+			node.CapMap[c] = nil
+		}
+
+		if dns.MagicDns && dns.HttpsCerts {
+			node.CapMap[tailcfg.CapabilityHTTPS] = nil // enables `tailscale cert`
+		}
+
+		// point clients at the tailnet's self-hosted log collector, if any
+		if !st.LogTail && logging.Collector != "" {
+			node.CapMap[NodeAttrLogTarget] = []tailcfg.RawMessage{tailcfg.RawMessage(strconv.Quote(logging.Collector))}
+		}
 
+		// let support tooling verify the relay map the client has; see DERPMap
 		derpMap, _ := viper.Get("derp.map").(*tailcfg.DERPMap)
-		if checksum := util.Checksum(derpMap); delta || checksum != derpChecksum {
-			derpChecksum = checksum
-			resp.DERPMap = derpMap
+		var derpMapChecksum = util.Checksum(derpMap)
+		if derpMap != nil {
+			node.CapMap[NodeAttrDERPMapChecksum] = []tailcfg.RawMessage{tailcfg.RawMessage(strconv.Quote(derpMapChecksum))}
 		}
 
-		// list all machines in this tailnet and build peer info
-		var machines []*domain.Machine
-		if machines, err = database.FetchMany(conn, domain.ListMachines(m.Tailnet)); err != nil {
-			var se sqlite.Error
-			if errors.As(err, &se) && se.Code == sqlite.SQLITE_INTERRUPT {
-				return nil, nil // suppress interrupt errors
+		caps.adapt(node)
+		if checksum := util.Checksum(node); !delta || checksum != st.Node {
+			st.Node, changed = checksum, true
+			resp.Node = node
+		}
+
+		var dnsConfig = dns.Adapt(m) // build dns configuration
+		if checksum := util.Checksum(dnsConfig); !delta || checksum != st.DNS {
+			st.DNS, changed = checksum, true
+			resp.DNSConfig = dnsConfig
+		}
+
+		if !delta || derpMapChecksum != st.DERP {
+			st.DERP, changed = derpMapChecksum, true
+			resp.DERPMap = derpMap
+			if derpMap != nil {
+				recordDERPMap(m, derpMapChecksum)
 			}
+		}
 
+		// deliver operator-defined notices (and key expiry warning) as health messages
+		var health []string
+		if health, err = notices(conn, m); err != nil {
 			return nil, err
 		}
 
+		if checksum := util.Checksum(health); !delta || checksum != st.Health {
+			st.Health, changed = checksum, true
+			resp.Health = health // a non-nil, empty slice clears any previously sent messages
+		}
+
 		// convert domain.Machine to tacl.Peer for use below to compile packet filter rules
-		var peers = make([]tacl.Machine, 0, len(machines)-1)
+		var peers = make([]tacl.Machine, 0, len(machines))
+		var candidates = make([]netmapPeer, 0, len(machines))
 
 		for _, machine := range machines {
 			if machine.ID == m.ID {
 				continue // skip the current node
 			}
 
+			if machine.IsHidden() {
+				continue // offline for longer than the tailnet's policy permits; see domain.Tailnet.HideOfflineAfter
+			}
+
 			var peer = machine.AsNode()
-			peer.Name = fmt.Sprintf("%s.%s.%s.", machine.CompleteName(), dnsname.SanitizeHostname(machine.Tailnet.Name), dns.MagicDnsSuffix)
+			peer.Name = fqdn(machine, dns.MagicDnsSuffix) + "."
 			peer.Online = util.ToPtr(true) // TODO(@riyaz): check status using a presence service
+			applyPrimaryRoutes(peer, primaries)
+			caps.adapt(peer)
+
+			// redact host details the tailnet doesn't share with peers; see domain.Tailnet.Privacy
+			peer.Hostinfo = m.Tailnet.Privacy.Redact(machine.HostInfo).View()
 
-			users[machine.UserID] = machine.Owner.AsUserProfile()
+			peer.Endpoints = siteEndpoints(m, machine) // machines at different sites are relayed over derp
+
+			if m.IsDerpOnly() || machine.IsDerpOnly() {
+				peer.Endpoints = nil // without any endpoints to try, the client can only reach the peer over derp
+			}
 
-			// TODO(@riyaz): implement support for delta changes
-			resp.Peers = append(resp.Peers, peer)
 			peers = append(peers, machine)
+			candidates = append(candidates, netmapPeer{machine: machine, node: peer})
 		}
 
-		// build packet filter rules based on the acl
+		// build packet filter rules based on the acl; compiled rules are cached, and shared by the machine's sessions
 		acl := m.Tailnet.Acl
-		resp.PacketFilter = acl.BuildFilter(m, peers)
+		var filter = objects.filter(m, peers)
+
+		var extra []tailcfg.FilterRule
+		if m.Tailnet.Features.Taildrop {
+			if rule := taildropRule(m, machines); rule != nil {
+				extra = append(extra, *rule)
+			}
+		}
+
+		if m.Tailnet.Features.WebClient {
+			if rule := webClientRule(m, machines); rule != nil {
+				extra = append(extra, *rule)
+			}
+		}
+
+		for _, rule := range extra {
+			slices.Sort(rule.SrcIPs) // keep the checksum stable
+		}
+		filter = append(filter, extra...)
 
 		// build ssh policy for the current node
-		resp.SSHPolicy = acl.BuildSSHPolicy(m, peers,
-			// TODO(@riyaz): this needs to be updated when we want to add support for ssh check action
-			func(_ *tacl.SshRuleConfig) *tailcfg.SSHAction { return &tailcfg.SSHAction{Accept: true} },
-		)
+		sshPolicy := acl.BuildSSHPolicy(m, peers, action)
+
+		if !m.Tailnet.Features.SSH {
+			sshPolicy = &tailcfg.SSHPolicy{} // an empty policy (rather than nil) clears any previously sent one
+		}
+
+		// check the size of full netmaps against the tailnet's guardrails, and apply mitigations to oversized ones; see domain.Guardrails
+		var mitigate bool
+		if !delta {
+			var nodes = make([]*tailcfg.Node, 0, len(candidates))
+			for _, c := range candidates {
+				nodes = append(nodes, c.node)
+			}
+
+			mitigate = recordNetmapSize(ctx, conn, m, netmapSize(nodes, filter, sshPolicy))
+		} else {
+			mitigate = mitigating(m.Tailnet)
+		}
+
+		if mitigate {
+			candidates = pruneUnreachable(m, filter, candidates)
+			filter = compressFilter(filter)
+		}
+
+		var current = make(map[tailcfg.NodeID]*tailcfg.Node, len(candidates))
+		for _, c := range candidates {
+			var peer = c.node
+
+			users[c.machine.UserID] = c.machine.Owner.AsUserProfile()
+			current[peer.ID] = peer
+
+			if !delta || !caps.DeltaPeers() {
+				resp.Peers = append(resp.Peers, peer)
+				continue
+			}
+
+			// compute the minimal change required to bring the client's view of the peer up-to-date
+			if prev, ok := st.SentPeers[peer.ID]; !ok {
+				resp.PeersChanged = append(resp.PeersChanged, peer)
+			} else if change, ok := diff(prev, peer); !ok {
+				resp.PeersChanged = append(resp.PeersChanged, peer)
+			} else if !caps.PeersChangedPatch() {
+				if change != nil || *prev.Online != *peer.Online {
+					resp.PeersChanged = append(resp.PeersChanged, peer) // the client can't apply the patch; send the peer in full
+				}
+			} else {
+				if change != nil {
+					resp.PeersChangedPatch = append(resp.PeersChangedPatch, change)
+				}
+
+				if online := *peer.Online; *prev.Online != online {
+					if resp.OnlineChange == nil {
+						resp.OnlineChange = make(map[tailcfg.NodeID]bool)
+					}
+					resp.OnlineChange[peer.ID] = online
+				}
+			}
+		}
+
+		for id := range st.SentPeers {
+			if _, ok := current[id]; !ok {
+				resp.PeersRemoved = append(resp.PeersRemoved, id)
+			}
+		}
+
+		st.SentPeers = current
+
+		// clients that don't apply incremental peer updates are sent the complete list of peers, whenever it changes
+		if delta && !caps.DeltaPeers() {
+			if checksum := util.Checksum(resp.Peers); checksum != st.Peers {
+				st.Peers, changed = checksum, true
+			} else {
+				resp.Peers = nil
+			}
+		} else if !delta {
+			st.Peers = util.Checksum(resp.Peers)
+		}
 
-		resp.UserProfiles = make([]tailcfg.UserProfile, 0, len(users))
+		// PeersChanged and PeersRemoved must be sorted by node id
+		slices.SortFunc(resp.PeersChanged, func(a, b *tailcfg.Node) int { return cmp.Compare(a.ID, b.ID) })
+		slices.SortFunc(resp.PeersChangedPatch, func(a, b *tailcfg.PeerChange) int { return cmp.Compare(a.NodeID, b.NodeID) })
+		slices.Sort(resp.PeersRemoved)
+
+		if len(resp.PeersChanged) > 0 || len(resp.PeersRemoved) > 0 || len(resp.PeersChangedPatch) > 0 || len(resp.OnlineChange) > 0 {
+			changed = true
+		}
+
+		if checksum := util.Checksum(filter); !delta || checksum != st.Filter {
+			if filter == nil {
+				filter = []tailcfg.FilterRule{} // a nil filter means "unchanged" to the client; an empty one denies everything
+			}
+
+			st.Filter, changed = checksum, true
+			resp.PacketFilter = filter
+		}
+
+		if checksum := util.Checksum(sshPolicy); !delta || checksum != st.SSH {
+			st.SSH, changed = checksum, true
+			resp.SSHPolicy = sshPolicy
+		}
+
+		// user profiles are only sent for users the client hasn't seen before
 		for _, user := range users {
-			resp.UserProfiles = append(resp.UserProfiles, user)
+			if !st.SentUsers[user.ID] {
+				st.SentUsers[user.ID], changed = true, true
+				resp.UserProfiles = append(resp.UserProfiles, user)
+			}
+		}
+
+		slices.SortFunc(resp.UserProfiles, func(a, b tailcfg.UserProfile) int { return cmp.Compare(a.ID, b.ID) })
+
+		if !changed {
+			log.Debug().Msg("peer in-sync; no changes to send")
+			return nil, nil
 		}
 
 		return resp, nil
 	}
 }
 
+// KeyExpiryWarning is the duration before a machine's key expiry when a warning is sent to the client
+var KeyExpiryWarning = settings.Define("coordinator.key_expiry_warning", settings.Duration(72*time.Hour),
+	"duration before a machine's key expiry when a warning is sent to the client")
+
+// WelcomeDuration is the duration, after a machine is added, during which the tailnet's welcome message is sent to it
+var WelcomeDuration = settings.Define("coordinator.welcome_duration", settings.Duration(24*time.Hour),
+	"duration after a machine is added during which the tailnet's welcome message is sent to the client as a health message")
+
+// notices returns the list of messages to deliver to the given machine as health messages.
+// The returned slice is never nil.
+func notices(conn *sqlite.Conn, m *domain.Machine) (_ []string, err error) {
+	var all []*domain.Notice
+	if all, err = database.FetchMany(conn, domain.ListActiveNotices(m)); err != nil {
+		return nil, err
+	}
+
+	var messages = make([]string, 0, len(all)+1)
+	for _, n := range all {
+		messages = append(messages, n.Message)
+	}
+
+	if w := m.Tailnet.Welcome; w.Health && w.Message != "" && time.Since(m.CreatedAt) < time.Duration(WelcomeDuration.Get()) {
+		messages = append(messages, w.Message)
+	}
+
+	if !m.ExpiresAt.IsZero() && time.Until(m.ExpiresAt) < time.Duration(KeyExpiryWarning.Get()) {
+		if remaining := time.Until(m.ExpiresAt); remaining > 0 {
+			messages = append(messages, fmt.Sprintf("your node key expires in %s, re-authenticate using `tailscale up --force-reauth`", remaining.Round(time.Hour)))
+		}
+	}
+
+	return messages, nil
+}
+
+// WireMapResponse wraps tailcfg.MapResponse for serialization over the wire.
+//
+// tailcfg.MapResponse cannot marshal a non-nil, zero-length Health (which is used to clear previously sent
+// health messages) or PacketFilter (which denies all traffic) due to its use of omitempty. WireMapResponse
+// shadows the fields to fix that.
+type WireMapResponse struct {
+	*tailcfg.MapResponse
+	Health       *[]string             `json:",omitempty"`
+	PacketFilter *[]tailcfg.FilterRule `json:",omitempty"`
+}
+
+// Wire wraps the given tailcfg.MapResponse into WireMapResponse
+func Wire(mr *tailcfg.MapResponse) *WireMapResponse {
+	var w = &WireMapResponse{MapResponse: mr}
+	if mr.Health != nil {
+		w.Health = &mr.Health
+	}
+	if mr.PacketFilter != nil {
+		w.PacketFilter = &mr.PacketFilter
+	}
+	return w
+}
+
+// taildropRule returns the packet filter rule that lets the machine send files (using taildrop) to the other
+// untagged machines of its owner, or nil if there are none. Tagged machines are never taildrop targets.
+func taildropRule(m *domain.Machine, machines []*domain.Machine) *tailcfg.FilterRule {
+	if len(m.AssignedTags) > 0 {
+		return nil
+	}
+
+	var rule = &tailcfg.FilterRule{}
+	for _, machine := range machines {
+		if machine.ID == m.ID || machine.UserID != m.UserID || len(machine.AssignedTags) > 0 || machine.IsHidden() {
+			continue
+		}
+
+		v4, v6 := machine.IP()
+		rule.SrcIPs = append(rule.SrcIPs, v4.String(), v6.String())
+	}
+
+	if len(rule.SrcIPs) == 0 {
+		return nil
+	}
+
+	v4, v6 := m.IP()
+	rule.CapGrant = []tailcfg.CapGrant{{
+		Dsts:   []netip.Prefix{netip.PrefixFrom(v4, v4.BitLen()), netip.PrefixFrom(v6, v6.BitLen())},
+		CapMap: tailcfg.PeerCapMap{tailcfg.PeerCapabilityFileSharingTarget: nil},
+	}}
+
+	return rule
+}
+
+// NodeAttrLogTarget is the node attribute that carries the url of the tailnet's self-hosted log collector, for clients
+// (or log shippers running alongside them) to stream their logs to; see domain.Logging.
+const NodeAttrLogTarget tailcfg.NodeCapability = "github.com/riyaz-ali/wirefire/cap/log-target"
+
+// PeerCapabilityWebUI is the peer capability that lets a peer manage a machine using its client's web interface.
+// Its value lists the settings the peer can edit; see webClientRule.
+const PeerCapabilityWebUI tailcfg.PeerCapability = "tailscale.com/cap/webui"
+
+// webClientRule returns the packet filter rule that lets the machine's owner, and the tailnet's admins, manage the
+// machine using its client's web interface from their other untagged machines, or nil if there are no such machines.
+func webClientRule(m *domain.Machine, machines []*domain.Machine) *tailcfg.FilterRule {
+	var rule = &tailcfg.FilterRule{}
+	for _, machine := range machines {
+		if machine.ID == m.ID || len(machine.AssignedTags) > 0 || machine.IsHidden() {
+			continue
+		}
+
+		if machine.UserID != m.UserID && !domain.HasRole(machine.Role, domain.RoleAdmin) {
+			continue
+		}
+
+		v4, v6 := machine.IP()
+		rule.SrcIPs = append(rule.SrcIPs, v4.String(), v6.String())
+	}
+
+	if len(rule.SrcIPs) == 0 {
+		return nil
+	}
+
+	v4, v6 := m.IP()
+	rule.CapGrant = []tailcfg.CapGrant{{
+		Dsts:   []netip.Prefix{netip.PrefixFrom(v4, v4.BitLen()), netip.PrefixFrom(v6, v6.BitLen())},
+		CapMap: tailcfg.PeerCapMap{PeerCapabilityWebUI: []tailcfg.RawMessage{`{"canEdit":["*"]}`}},
+	}}
+
+	return rule
+}
+
+// siteEndpoints returns the endpoints of the peer advertised to the machine, as per the sites they're at (see: domain.Machine.Site).
+// A peer at the same site is advertised with its local endpoints, if it reported any, and a peer at a different site with
+// none at all, so that it's reached over derp rather than with direct connections that the sites' firewalls would block.
+func siteEndpoints(m, peer *domain.Machine) []netip.AddrPort {
+	if m.Site == "" || peer.Site == "" {
+		return peer.EndpointAddrs()
+	}
+
+	if m.Site != peer.Site {
+		return nil
+	}
+
+	var local []netip.AddrPort
+	for _, ep := range peer.Endpoints {
+		if ep.Type == tailcfg.EndpointLocal {
+			local = append(local, ep.Addr)
+		}
+	}
+
+	if len(local) == 0 {
+		return peer.EndpointAddrs()
+	}
+
+	return local
+}
+
+// WireMapRequest extends tailcfg.MapRequest with fields sent by clients newer than the version of tailscale.com wirefire is built with
+type WireMapRequest struct {
+	tailcfg.MapRequest
+	Hostinfo *WireHostinfo `json:",omitempty"`
+}
+
+// WireHostinfo extends tailcfg.Hostinfo with the exit node the client is using, reported by newer clients
+type WireHostinfo struct {
+	tailcfg.Hostinfo
+	ExitNodeID tailcfg.StableNodeID `json:",omitempty"`
+}
+
+// Unwrap returns the tailcfg.MapRequest, along with the id of the exit node reported by the client; zero if it's not using one.
+func (w *WireMapRequest) Unwrap() (tailcfg.MapRequest, int) {
+	var req = w.MapRequest
+	if w.Hostinfo == nil {
+		return req, 0
+	}
+
+	req.Hostinfo = &w.Hostinfo.Hostinfo
+	exitNode, _ := strconv.Atoi(string(w.Hostinfo.ExitNodeID)) // see domain.Machine.AsNode for how stable ids are assigned
+	return req, exitNode
+}
+
+// deleted returns the final map response sent to a machine that has been deleted, or whose key has been revoked.
+// The response marks the machine's key as expired, prompting the client to re-authenticate.
+func deleted(m *domain.Machine) *tailcfg.MapResponse {
+	var node = m.AsNode()
+	node.KeyExpiry, node.Expired = time.Now().UTC(), true
+
+	return &tailcfg.MapResponse{Node: node, ControlTime: util.ToPtr(time.Now().UTC())}
+}
+
+// reconnectHint returns the final map response sent to a session when the server shuts down. It asks the client to wait for
+// a random duration, up to ReconnectJitter, before reconnecting, so that clients don't all reconnect at once once the server is back.
+//
+// The session is saved before the hint is sent, and a client that resumes it (see: resumable) is sent a delta from the last
+// response it processed once the server is back. Clients that don't resume their session are sent a full netmap, as ever.
+// Either way, a client that reconnects with the state it reported before doesn't trigger an update to all of its peers (see domain.MapSession).
+func reconnectHint() *tailcfg.MapResponse {
+	var jitter = rand.Float64() * time.Duration(ReconnectJitter.Get()).Seconds()
+	return &tailcfg.MapResponse{ControlTime: util.ToPtr(time.Now().UTC()), Debug: &tailcfg.Debug{SleepSeconds: jitter}}
+}
+
 // MachineMap implements handler for the /machine/map endpoint served over the Noise channel.
 //
 // The /machine/map endpoint is used to the node to update its status and also to start a long-polling
 // session to receive status updates from other nodes in the tailnet.
-func MachineMap(peer key.MachinePublic, pool *sqlitex.Pool) util.StreamingHandlerFunc[tailcfg.MapRequest] {
+func MachineMap(peer key.MachinePublic, remote Remote, pool *sqlitex.Pool, objects *cache) util.StreamingHandlerFunc[WireMapRequest] {
 	// utility function to get around defer-in-for-loop situations in serve() below
 	var with = func(ctx context.Context, fn func(*sqlite.Conn) error) error {
 		conn := pool.Get(ctx)
 		defer pool.Put(conn)
+		defer tracing.Bind(conn, ctx)()
 
 		return fn(conn)
 	}
 
 	// Serve handles the long-running poll session and writes to sink everytime an update needs
 	// to be sent to the client. Serve must be run in a goroutine to prevent it from blocking other request handling operations.
-	var serve = func(ctx context.Context, sink chan<- *tailcfg.MapResponse, req tailcfg.MapRequest) error {
+	//
+	// The session continues from the given state, which is new unless the client is resuming a saved session, and is
+	// identified by handle in the first response, which the client can resume the session with later on.
+	var serve = func(ctx context.Context, sink chan<- *tailcfg.MapResponse, req tailcfg.MapRequest, tailnet int, state *mapState, handle string) error {
 		log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Logger()
-		mapFunc := mapper()
+		caps, _ := Negotiate(req.Version) // unsupported versions are turned away before the session starts
+		mapFunc := resume(objects, caps, state)
 
-		// TODO(@riyaz): maybe make it configurable?
-		var keepAlive = time.NewTicker(10 * time.Second)
+		defer RecordConnected(req.Version)()
 
-		var conduit = make(chan struct{}, 20)
-		var sync = time.NewTicker(5 * time.Second)
-		defer sync.Stop()
+		// keep-alive and sync ticks are delivered by the shared scheduler, rather than per-session tickers
+		ticks, unregister := sessions.register()
+		defer unregister()
 
-		// The following two timestamps are used to buffer updates coming in from conduit.
+		// The following two timestamps are used to buffer updates coming in from the notifier.
 		//
-		// The way it works is that for every tailnet update we receive on the conduit, we only update
+		// The way it works is that for every tailnet update we receive from the notifier, we only update
 		// the lastUpdate timestamp, which cause lastSync and lastUpdate to go out of sync.
 		//
-		// Then, every 5-seconds, we check if lastSync.Before(lastUpdate) and send out new tailcfg.MapResponse if
-		// we had received any updates in the last 5 seconds.
+		// Then, every SyncInterval (5-seconds by default), we check if lastSync.Before(lastUpdate) and send out new tailcfg.MapResponse if
+		// we had received any updates in the last 5 seconds. If nothing has changed, no map response is generated at all.
 		//
 		// This works independently of the keep-alive timer.
 		now := time.Now()
 		lastUpdate, lastSync := now, now
 
+		var self *domain.Machine // the machine, as last read from the database
+		var first = true         // is the next response the first of the session?
+
+		// push prepares a new map response for the machine and sends it out, if there's anything to send. Responses are
+		// numbered (see: tailcfg.MapResponse.Seq), so that the client can tell which one it processed last when resuming.
+		var push = func() (err error) {
+			ctx, span := tracer.Start(ctx, "map.response")
+			defer func() {
+				if err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+				}
+				span.End()
+			}()
+
+			return with(ctx, func(conn *sqlite.Conn) error {
+				machine, err := objects.machine(conn, peer)
+				if err != nil || machine == nil {
+					return errors.Errorf("no machine found with key")
+				}
+
+				self = machine
+				span.SetAttributes(attribute.Int("machine.id", machine.ID), attribute.Int("tailnet.id", machine.TailnetID))
+
+				resp, err := mapFunc(ctx, conn, machine)
+				if err != nil {
+					return errors.Wrapf(err, "failed to prepare map response")
+				}
+
+				if first && resp == nil {
+					resp = &tailcfg.MapResponse{ControlTime: util.ToPtr(time.Now().UTC())} // a resumed session is confirmed, even if nothing has changed
+				}
+
+				if resp != nil {
+					if first {
+						resp.MapSessionHandle = handle
+					}
+
+					state.Seq += 1
+					resp.Seq, first = state.Seq, false
+
+					span.SetAttributes(attribute.Int("map.peers", len(resp.Peers)+len(resp.PeersChanged)))
+					sink <- resp
+				}
+
+				return nil
+			})
+		}
+
+		// subscribe before the first update is prepared, so that events published in the meantime aren't lost;
+		// they're buffered in the channel, and handled by the loop below once the session is set up.
+		events, unsubscribe := notifier.Subscribe(tailnet)
+		defer unsubscribe()
+
 		// send out the first update immediately
-		err := with(ctx, func(conn *sqlite.Conn) error {
-			machine, err := database.FetchOne(conn, domain.GetMachineByKey(peer))
-			if err != nil || machine == nil {
-				return errors.Errorf("no machine found with key")
+		if err := push(); err != nil {
+			return err
+		}
+
+		// refresh the machine's LastSeen while the stream is open, so that connected machines
+		// aren't hidden from their peers by the tailnet's HideOfflineAfter policy
+		var lastTouch time.Time
+		var touch = func() {
+			var now = time.Now()
+			if err := with(context.WithoutCancel(ctx), func(conn *sqlite.Conn) error {
+				_, err := database.Exec(conn, domain.TouchMachine(self, now))
+				return err
+			}); err != nil {
+				log.Error().Err(err).Msg("failed to update last seen")
+				return
 			}
 
-			if resp, err := mapFunc(ctx, conn, machine); err != nil {
-				return errors.Wrapf(err, "failed to prepare map response")
-			} else if resp != nil {
-				sink <- resp
+			lastTouch = now
+		}
+
+		// record the machine's presence, for uptime reporting; see domain.Presence
+		var presence = func(online bool) {
+			if err := with(context.WithoutCancel(ctx), func(conn *sqlite.Conn) error {
+				_, err := database.Exec(conn, domain.RecordPresence(self, online))
+				return err
+			}); err != nil {
+				log.Error().Err(err).Bool("online", online).Msg("failed to record presence")
 			}
+			touch()
 
-			return nil
-		})
+			var kind = notifier.MachineOffline
+			if online {
+				kind = notifier.MachineOnline
+			}
+			notifier.Publish(notifier.Event{Kind: kind, Tailnet: self.TailnetID, Machine: self.ID})
+		}
 
-		if err != nil {
-			return err
+		// save the session's state, along with its handle, so that the client can resume it; see resumable
+		var save = func() {
+			buf, err := json.Marshal(state)
+			if err == nil {
+				err = with(context.WithoutCancel(ctx), func(conn *sqlite.Conn) error {
+					_, err := database.Exec(conn, domain.SaveMapSessionState(self, handle, state.Seq, buf))
+					return err
+				})
+			}
+
+			if err != nil {
+				log.Error().Err(err).Msg("failed to save map session")
+			}
 		}
 
+		presence(true)
+		defer presence(false)
+		defer forgetDERPMap(self)
+		defer forgetNetmap(self.TailnetID, self.ID)
+
 		for { // go on forever! or at-least until power lasts ;P
 			select {
-			// conduit messages are updates received on a tailnet
-			case <-conduit:
-				lastUpdate = time.Now()
-
-			// sync updates are ticker received every 5 seconds
-			case <-sync.C:
-				if lastSync.Before(lastUpdate) || true {
-					var err = with(ctx, func(conn *sqlite.Conn) error {
-						machine, err := database.FetchOne(conn, domain.GetMachineByKey(peer))
-						if err != nil || machine == nil {
-							return errors.Errorf("no machine found with key")
-						}
-
-						if resp, err := mapFunc(ctx, conn, machine); err != nil {
-							return errors.Wrapf(err, "failed to prepare map response")
-						} else if resp != nil {
-							sink <- resp
-						}
-
-						return nil
-					})
-
-					if err != nil {
+			// events are updates received on the tailnet
+			case e := <-events:
+				switch {
+				case e.Kind == notifier.MachineDeleted && e.Machine == self.ID:
+					log.Info().Msg("machine deleted; terminating session")
+					sink <- deleted(self)
+					return nil
+
+				case e.Kind == notifier.MachineRevoked && e.Machine == self.ID:
+					log.Info().Msg("machine key revoked; terminating session")
+					sink <- deleted(self)
+					return nil
+
+				case e.Kind == notifier.MachineDeleted || e.Kind == notifier.MachineRevoked:
+					// let the peers know right away, rather than waiting for the next sync, so that they stop using the machine
+					if err := push(); err != nil {
+						return err
+					}
+
+				case e.Kind == notifier.MachineOnline || e.Kind == notifier.MachineOffline:
+					// presence isn't part of the netmap (yet); nothing to sync
+
+				default:
+					lastUpdate = time.Now()
+				}
+
+			// sync updates are ticker received every SyncInterval
+			case <-ticks.sync:
+				if lastSync.Before(lastUpdate) {
+					if err := push(); err != nil {
 						return err
 					}
 
@@ -240,11 +851,23 @@ func MachineMap(peer key.MachinePublic, pool *sqlitex.Pool) util.StreamingHandle
 				}
 
 			// keep-alive updates are ticker updates to send keep-alive pings to the peer, if it has requested one.
-			case <-keepAlive.C:
+			case <-ticks.keepAlive:
 				if req.KeepAlive {
-					sink <- &tailcfg.MapResponse{KeepAlive: true}
+					sink <- keepAliveMessage
+				}
+
+				if time.Since(lastTouch) > lastSeenInterval {
+					touch()
 				}
 
+			// the server is shutting down; save the session, so that the client can resume it once the server is back,
+			// and flush a final message (so the client knows the stream ended cleanly) and terminate.
+			case <-sessions.drain:
+				log.Debug().Msg("server shutting down; terminating session")
+				save()
+				sink <- reconnectHint()
+				return nil
+
 			// ctx.Done() signals that either some concurrent operation has cancelled the context or
 			// the client has disconnected, either way, we terminate and clean-up our resources.
 			case <-ctx.Done():
@@ -253,16 +876,23 @@ func MachineMap(peer key.MachinePublic, pool *sqlitex.Pool) util.StreamingHandle
 		}
 	}
 
-	return func(ctx context.Context, res http.ResponseWriter, req tailcfg.MapRequest) (err error) {
-		log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Logger()
+	return func(ctx context.Context, res http.ResponseWriter, wire WireMapRequest) (err error) {
+		req, exitNode := wire.Unwrap()
+		if req.Stream {
+			markStreaming(ctx)
+		}
+		log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Int("version", int(req.Version)).Logger()
 
-		if req.Version < SupportedCapabilityVersion {
+		RecordVersion(EndpointMap, peer, req.Version)
+		caps, ok := Negotiate(req.Version)
+		if !ok {
 			log.Warn().Msg("unsupported client version")
 			return errors.New(UnsupportedClientVersionMessage)
 		}
 
 		conn := pool.Get(ctx)
 		defer pool.Put(conn)
+		defer tracing.Bind(conn, ctx)()
 
 		var machine *domain.Machine
 		if machine, err = database.FetchOne(conn, domain.GetMachineByKey(peer)); err != nil {
@@ -273,6 +903,15 @@ func MachineMap(peer key.MachinePublic, pool *sqlitex.Pool) util.StreamingHandle
 			return errors.New("machine not found")
 		}
 
+		// the node key a machine logged out with can't be used again; see domain.RevokeNodeKey
+		var revoked *bool
+		if revoked, err = database.FetchOne(conn, domain.IsNodeKeyRevoked(req.NodeKey)); err != nil {
+			return err
+		} else if *revoked {
+			log.Warn().Str("node_key", req.NodeKey.ShortString()).Msg("map request rejected; node key revoked")
+			return errors.New("node key revoked")
+		}
+
 		// if !req.Stream and req.Version >= 68 (always true for us), update the machine info
 		// and send out a single MapResponse, only if req.OmitPeers is false.
 		if !req.Stream {
@@ -281,43 +920,97 @@ func MachineMap(peer key.MachinePublic, pool *sqlitex.Pool) util.StreamingHandle
 			machine.HostInfo = req.Hostinfo
 			machine.DiscoKey = req.DiscoKey
 			machine.NodeKey = req.NodeKey
-			machine.Endpoints = req.Endpoints
+			machine.Endpoints = domain.Endpoints(req.Endpoints, req.EndpointTypes)
 			machine.LastSeen = util.ToPtr(time.Now())
 
+			// record the address (and location) the machine is connecting from, and
+			// log an audit event if it's different from the one we saw last time
+			if remote.Addr.IsValid() && remote.Addr != machine.LastAddr {
+				previous := Remote{Addr: machine.LastAddr, Location: machine.Location}
+				event := &domain.AuditEvent{
+					Action:     domain.ActionMachineAddrChanged,
+					Actor:      peer.String(),
+					Target:     machine.CompleteName(),
+					TailnetID:  util.ToPtr(machine.TailnetID),
+					ClientAddr: remote.String(),
+					Location:   remote.Location,
+					Data:       map[string]string{"previous_addr": previous.String(), "previous_location": previous.Location.String()},
+				}
+
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					log.Error().Err(err).Msg("failed to record audit event")
+				}
+
+				machine.LastAddr, machine.Location = remote.Addr, remote.Location
+			}
+
 			var m []*domain.Machine
 			if m, err = database.Exec(conn, domain.SaveMachine(machine)); err != nil {
 				return err
 			}
 
-			// TODO(@riyaz): notify connected clients about node status update
-
 			machine = m[0]
 
+			// record any change to the subnet routes advertised by the machine
+			if err = SyncRoutes(conn, machine); err != nil {
+				return err
+			}
+
+			// record the exit node the machine is using, if its client reports one
+			if req.Hostinfo != nil {
+				if _, err = database.Exec(conn, domain.SetExitNode(machine, exitNode)); err != nil {
+					return err
+				}
+			}
+
+			// let connected peers know about the machine's updated endpoints, keys etc. Clients report the same state when they
+			// reconnect (eg. after a server restart), which the peers already know about; see domain.MapSession
+			var reported = util.Checksum([]any{req.NodeKey, req.DiscoKey, req.Hostinfo, machine.Endpoints, exitNode})
+
+			var session *domain.MapSession
+			if session, err = database.FetchOne(conn, domain.MapSessionByMachine(machine)); err != nil {
+				return err
+			}
+
+			if session == nil || session.Checksum != reported {
+				if _, err = database.Exec(conn, domain.SaveMapSession(machine, reported)); err != nil {
+					return err
+				}
+
+				notifier.Publish(notifier.Event{Kind: notifier.MachineUpdated, Tailnet: machine.TailnetID, Machine: machine.ID})
+			} else {
+				log.Debug().Msg("machine state unchanged since last session; skipping peer update")
+			}
+
 			var mr *tailcfg.MapResponse // prepare full tailcfg.MapResponse to send to the client
-			if mr, err = mapper()(ctx, conn, machine); err != nil {
+			if mr, err = mapper(objects, caps)(ctx, conn, machine); err != nil {
 				return err
 			}
 
-			var encoder = util.Json[tailcfg.MapResponse]
+			var encoder = util.Json[WireMapResponse]
 			if req.Compress == "zstd" {
-				encoder = util.Zstd[tailcfg.MapResponse]
+				encoder = util.Zstd[WireMapResponse]
 			}
 
 			var buf bytes.Buffer
-			if err = encoder(mr, &buf); err != nil {
+			if err = frame(&buf, encoder, Wire(mr)); err != nil {
 				return err
 			}
 
-			// add 4-byte length to the payload
-			var data = make([]byte, buf.Len()+4)
-			binary.LittleEndian.PutUint32(data, uint32(buf.Len()))
-			copy(data[4:], buf.Bytes())
-
 			res.WriteHeader(http.StatusOK) // write all the headers and status
-			_, err = res.Write(data)
+			_, err = res.Write(buf.Bytes())
 			return err
 		}
 
+		// start a new map session, unless the client is resuming one it was served before the server was restarted
+		var state, handle = newMapState(caps), rands.HexString(16)
+		if resumed, err := resumable(conn, machine, req); err != nil {
+			return err
+		} else if resumed != nil {
+			log.Info().Int64("seq", resumed.Seq).Msg("resuming map session")
+			state, handle = resumed, req.MapSessionHandle
+		}
+
 		// create a new wrapped context that is used to pass from encoder routine to serve routine
 		serveCtx, stopServe := context.WithCancel(ctx)
 
@@ -328,31 +1021,31 @@ func MachineMap(peer key.MachinePublic, pool *sqlitex.Pool) util.StreamingHandle
 		g.Go(func() error {
 			defer close(ch) // make sure to always close sink to prevent request hang-up
 
-			return serve(serveCtx, ch, req)
+			return serve(serveCtx, ch, req, machine.TailnetID, state, handle)
 		})
 
 		// serialize and send out updates over network
 		g.Go(func() error {
 			defer stopServe() // signal serve() to stop as well
 
-			var encoder = util.Json[tailcfg.MapResponse]
+			var encoder, keepAlive = util.Json[WireMapResponse], keepAliveFrames.json
 			if req.Compress == "zstd" {
-				encoder = util.Zstd[tailcfg.MapResponse]
+				encoder, keepAlive = util.Zstd[WireMapResponse], keepAliveFrames.zstd
 			}
 
 			res.WriteHeader(http.StatusOK)
 			var buf = bytes.NewBuffer(make([]byte, 0, 4096)) // pre-allocate a buffer of 4kb
 			for mr := range ch {
-				if err = encoder(mr, buf); err != nil {
-					return err
-				}
+				var out = keepAlive // keep-alive messages are written as-is from the pre-encoded frame
+				if mr != keepAliveMessage {
+					if err = frame(buf, encoder, Wire(mr)); err != nil {
+						return err
+					}
 
-				// add 4-byte length to the payload
-				var data = make([]byte, buf.Len()+4)
-				binary.LittleEndian.PutUint32(data, uint32(buf.Len()))
-				copy(data[4:], buf.Bytes())
+					out = buf.Bytes()
+				}
 
-				if _, err = res.Write(data); err != nil {
+				if _, err = res.Write(out); err != nil {
 					return err
 				}
 
@@ -369,3 +1062,43 @@ func MachineMap(peer key.MachinePublic, pool *sqlitex.Pool) util.StreamingHandle
 		return g.Wait()
 	}
 }
+
+// resumable returns the saved state of the machine's streaming map session, if the client asked to resume it (see:
+// tailcfg.MapRequest.MapSessionHandle), and it can be; nil otherwise. A session can only be resumed from the last response
+// it was sent, and by a client of the same capability version. The saved state is cleared either way, as it's only good once.
+func resumable(conn *sqlite.Conn, m *domain.Machine, req tailcfg.MapRequest) (_ *mapState, err error) {
+	var session *domain.MapSession
+	if session, err = database.FetchOne(conn, domain.MapSessionByMachine(m)); err != nil || session == nil || session.Handle == "" {
+		return nil, err
+	}
+
+	if _, err = database.Exec(conn, domain.ClearMapSessionState(m)); err != nil {
+		return nil, err
+	}
+
+	if req.MapSessionHandle == "" || req.MapSessionHandle != session.Handle || req.MapSessionSeq != session.Seq {
+		return nil, nil // the client is starting a new session, or missed (some of) the responses sent since the one it reports
+	}
+
+	var state mapState
+	if err = json.Unmarshal([]byte(session.State), &state); err != nil || state.Version != req.Version {
+		return nil, nil // eg. the client was upgraded in the meantime
+	}
+
+	return &state, nil
+}
+
+// frame encodes src into buf, prefixed with its 4-byte little-endian length as expected by the client.
+// Space for the length is reserved ahead of encoding, and backfilled after, so that the payload is written
+// straight into buf, without being copied over into a separate, length-prefixed slice.
+func frame[T any](buf *bytes.Buffer, encoder func(*T, io.Writer) error, src *T) error {
+	var start = buf.Len()
+	buf.Write([]byte{0, 0, 0, 0}) // reserve space for the length
+
+	if err := encoder(src, buf); err != nil {
+		return err
+	}
+
+	binary.LittleEndian.PutUint32(buf.Bytes()[start:], uint32(buf.Len()-start-4))
+	return nil
+}
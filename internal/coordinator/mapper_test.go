@@ -0,0 +1,611 @@
+package coordinator
+
+import (
+	"bytes"
+	"context"
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"github.com/riyaz-ali/tacl"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/database/schema"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/spf13/viper"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"tailscale.com/tailcfg"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata/golden")
+
+// latest are the capabilities of a client presenting the newest capability version
+var latest = Capabilities{Version: tailcfg.CurrentCapabilityVersion}
+
+// fixture opens a new in-memory database, applies the schema and seeds it using testdata/fixture.sql
+func fixture(t *testing.T) *sqlite.Conn {
+	t.Helper()
+
+	var conn = util.Must(sqlite.OpenConn("file::memory:?mode=memory", 0))
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if err := schema.Apply(conn); err != nil {
+		t.Fatalf("failed to apply schema: %v", err)
+	}
+
+	if err := sqlitex.ExecScript(conn, string(util.Must(os.ReadFile("testdata/fixture.sql")))); err != nil {
+		t.Fatalf("failed to seed fixture: %v", err)
+	}
+
+	return conn
+}
+
+// machine returns the fixture machine identified by id
+func machine(t *testing.T, conn *sqlite.Conn, id int) *domain.Machine {
+	t.Helper()
+
+	machines, err := database.FetchMany(conn, domain.ListMachines(&domain.Tailnet{ID: 1}))
+	if err != nil {
+		t.Fatalf("failed to list machines: %v", err)
+	}
+
+	for _, m := range machines {
+		if m.ID == id {
+			return m
+		}
+	}
+
+	t.Fatalf("no machine with id %d in fixture", id)
+	return nil
+}
+
+// exec executes the given sql statement(s) against the fixture database
+func exec(t *testing.T, conn *sqlite.Conn, query string) {
+	t.Helper()
+	if err := sqlitex.ExecScript(conn, query); err != nil {
+		t.Fatalf("failed to execute %q: %v", query, err)
+	}
+}
+
+// golden compares the normalized json encoding of v against testdata/golden/<name>.json.
+// Run the tests with -update to re-generate the golden files.
+func golden(t *testing.T, name string, v any) {
+	t.Helper()
+
+	var got = normalize(t, v)
+	var path = filepath.Join("testdata", "golden", name+".json")
+
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("failed to update golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run with -update to create it): %v", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("response doesn't match %s (run with -update to accept changes)\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
+
+// normalize returns the indented json encoding of v, with all timestamps generated
+// during the test (eg. MapResponse.ControlTime) replaced with a fixed value.
+func normalize(t *testing.T, v any) []byte {
+	t.Helper()
+
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %v", err)
+	}
+
+	var tree any
+	_ = json.Unmarshal(buf, &tree)
+
+	var walk func(any) any
+	walk = func(node any) any {
+		switch n := node.(type) {
+		case map[string]any:
+			for k, v := range n {
+				n[k] = walk(v)
+			}
+		case []any:
+			for i, v := range n {
+				n[i] = walk(v)
+			}
+		case string:
+			// fixture timestamps are fixed and in the past; anything recent must've been generated during the test
+			if ts, err := time.Parse(time.RFC3339Nano, n); err == nil && time.Since(ts).Abs() < time.Hour {
+				return "<timestamp>"
+			}
+		}
+		return node
+	}
+
+	var out bytes.Buffer
+	var enc = json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+
+	if err = enc.Encode(walk(tree)); err != nil {
+		t.Fatalf("failed to marshal normalized response: %v", err)
+	}
+
+	return out.Bytes()
+}
+
+func TestMapper_Full(t *testing.T) {
+	var conn = fixture(t)
+
+	resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 1))
+	if err != nil {
+		t.Fatalf("failed to generate map response: %v", err)
+	}
+
+	golden(t, "full", Wire(resp))
+}
+
+func TestMapper_Delta(t *testing.T) {
+	var conn = fixture(t)
+	var mapFunc = mapper(nil, latest)
+
+	var next = func() *WireMapResponse {
+		t.Helper()
+
+		resp, err := mapFunc(context.Background(), conn, machine(t, conn, 1))
+		if err != nil {
+			t.Fatalf("failed to generate map response: %v", err)
+		} else if resp == nil {
+			return nil
+		}
+
+		return Wire(resp)
+	}
+
+	_ = next() // initial, full response
+
+	t.Run("NoChange", func(t *testing.T) {
+		if resp := next(); resp != nil {
+			t.Errorf("expected no response when nothing has changed; got %s", normalize(t, resp))
+		}
+	})
+
+	t.Run("PeerPatched", func(t *testing.T) {
+		exec(t, conn, `UPDATE machines SET endpoints = '[{"Addr":"192.0.2.2:41641","Type":1},{"Addr":"198.51.100.2:41641","Type":2}]', last_seen = '2024-01-03T00:00:00Z' WHERE id = 2`)
+		golden(t, "delta_peer_patched", next())
+	})
+
+	t.Run("PeerChanged", func(t *testing.T) {
+		exec(t, conn, `UPDATE machines SET host_info = '{"Hostname":"bravo","OS":"linux"}' WHERE id = 2`)
+		golden(t, "delta_peer_changed", next())
+	})
+
+	t.Run("PeerRemoved", func(t *testing.T) {
+		exec(t, conn, `DELETE FROM machines WHERE id = 3`)
+		golden(t, "delta_peer_removed", next())
+	})
+
+	t.Run("AclChanged", func(t *testing.T) {
+		exec(t, conn, `UPDATE tailnets SET acl = '{"acls":[{"action":"accept","src":["*"],"dst":["*:*"]}]}' WHERE id = 1`)
+		golden(t, "delta_acl_changed", next())
+	})
+
+	t.Run("PeerExpired", func(t *testing.T) {
+		exec(t, conn, `UPDATE machines SET expires_at = '2024-01-02T00:00:00Z' WHERE id = 2`)
+		golden(t, "delta_peer_expired", next())
+	})
+
+	t.Run("AclDenyAll", func(t *testing.T) {
+		exec(t, conn, `UPDATE tailnets SET acl = '{"acls":[]}' WHERE id = 1`)
+		golden(t, "delta_acl_deny_all", next()) // must carry an empty (rather than no) packet filter
+	})
+}
+
+func TestMapper_Resume(t *testing.T) {
+	var conn = fixture(t)
+	var self = machine(t, conn, 1)
+
+	// serve the first response of a session, and save its state as the server does when shutting down
+	var state = newMapState(latest)
+	if _, err := resume(nil, latest, state)(context.Background(), conn, self); err != nil {
+		t.Fatalf("failed to generate map response: %v", err)
+	}
+
+	state.Seq = 1
+	var save = func() {
+		t.Helper()
+		if _, err := database.Exec(conn, domain.SaveMapSessionState(self, "handle", state.Seq, util.Must(json.Marshal(state)))); err != nil {
+			t.Fatalf("failed to save map session: %v", err)
+		}
+	}
+
+	var request = func(handle string, seq int64, version tailcfg.CapabilityVersion) tailcfg.MapRequest {
+		return tailcfg.MapRequest{MapSessionHandle: handle, MapSessionSeq: seq, Version: version}
+	}
+
+	t.Run("Mismatch", func(t *testing.T) {
+		for name, req := range map[string]tailcfg.MapRequest{
+			"Handle":  request("other", 1, latest.Version),
+			"Seq":     request("handle", 2, latest.Version),
+			"Version": request("handle", 1, latest.Version-1),
+		} {
+			t.Run(name, func(t *testing.T) {
+				save() // saved state is cleared every time
+
+				if resumed, err := resumable(conn, self, req); err != nil {
+					t.Fatalf("failed to resume map session: %v", err)
+				} else if resumed != nil {
+					t.Errorf("expected session not to be resumed")
+				}
+			})
+		}
+	})
+
+	save()
+	exec(t, conn, `UPDATE machines SET host_info = '{"Hostname":"bravo","OS":"linux"}' WHERE id = 2`)
+
+	resumed, err := resumable(conn, self, request("handle", 1, latest.Version))
+	if err != nil || resumed == nil {
+		t.Fatalf("expected session to be resumed; got %v", err)
+	} else if resumed.Seq != 1 {
+		t.Errorf("expected resumed session at seq 1; got %d", resumed.Seq)
+	}
+
+	t.Run("Delta", func(t *testing.T) {
+		resp, err := resume(nil, latest, resumed)(context.Background(), conn, self)
+		if err != nil {
+			t.Fatalf("failed to generate map response: %v", err)
+		}
+
+		golden(t, "resume_peer_changed", Wire(resp)) // only the change since the saved state; not a full netmap
+	})
+
+	t.Run("Once", func(t *testing.T) {
+		if again, err := resumable(conn, self, request("handle", 1, latest.Version)); err != nil {
+			t.Fatalf("failed to resume map session: %v", err)
+		} else if again != nil {
+			t.Errorf("expected saved session to be resumed only once")
+		}
+	})
+}
+
+func TestMapper_Cache(t *testing.T) {
+	var conn = fixture(t)
+	var objects = newCache()
+
+	var compare = func() {
+		t.Helper()
+
+		cached, err := mapper(objects, latest)(context.Background(), conn, machine(t, conn, 1))
+		if err != nil {
+			t.Fatalf("failed to generate map response: %v", err)
+		}
+
+		uncached, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 1))
+		if err != nil {
+			t.Fatalf("failed to generate map response: %v", err)
+		}
+
+		if got, want := normalize(t, Wire(cached)), normalize(t, Wire(uncached)); !bytes.Equal(got, want) {
+			t.Errorf("cached response doesn't match\n--- got\n%s\n--- want\n%s", got, want)
+		}
+	}
+
+	compare()
+
+	exec(t, conn, `UPDATE tailnets SET acl = '{"acls":[{"action":"accept","src":["*"],"dst":["*:*"]}]}' WHERE id = 1`)
+	objects.invalidate(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: 1})
+
+	exec(t, conn, `UPDATE users SET claims = json_set(claims, '$.name', 'Robert') WHERE id = 2`)
+	objects.invalidate(notifier.Event{Kind: notifier.UserUpdated, Tailnet: notifier.All, User: 2})
+
+	compare()
+}
+
+func TestCache_Filter(t *testing.T) {
+	var conn = fixture(t)
+	var objects = newCache()
+
+	// filter returns the compiled filter of the fixture's first machine, against the other machines in the tailnet
+	var filter = func() []tailcfg.FilterRule {
+		t.Helper()
+
+		machines, err := objects.machines(conn, &domain.Tailnet{ID: 1})
+		if err != nil {
+			t.Fatalf("failed to list machines: %v", err)
+		}
+
+		var self *domain.Machine
+		var peers []tacl.Machine
+		for _, m := range machines {
+			if m.ID == 1 {
+				self = m
+			} else {
+				peers = append(peers, m)
+			}
+		}
+
+		return objects.filter(self, peers)
+	}
+
+	var first = filter()
+	if len(first) == 0 {
+		t.Fatalf("expected the fixture's policy to compile to a non-empty filter")
+	}
+
+	// events that don't change the policy, the machine or its peers must not recompile the filter
+	notifier.Publish(notifier.Event{Kind: notifier.MachineOnline, Tailnet: 1, Machine: 2})
+	exec(t, conn, `UPDATE machines SET endpoints = '[{"Addr":"192.0.2.2:41641","Type":2}]' WHERE id = 2`)
+	notifier.Publish(notifier.Event{Kind: notifier.MachineUpdated, Tailnet: 1, Machine: 2})
+
+	if second := filter(); &second[0] != &first[0] {
+		t.Errorf("expected the cached filter to be reused across unrelated events")
+	}
+
+	exec(t, conn, `UPDATE tailnets SET acl = '{"acls":[{"action":"accept","src":["*"],"dst":["*:*"]}]}' WHERE id = 1`)
+	objects.invalidate(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: 1})
+	notifier.Publish(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: 1})
+
+	if third := filter(); &third[0] == &first[0] || third[0].DstPorts[0].Ports.Last != 65535 {
+		t.Errorf("expected the filter to be recompiled after the policy changed; got %+v", third)
+	}
+}
+
+func TestCache_UserUpdated(t *testing.T) {
+	var objects = &cache{
+		users:     map[int]entry[domain.User]{1: {val: &domain.User{ID: 1}}},
+		snapshots: map[int]snapshot{1: {}, 2: {}},
+	}
+
+	// a user's profile is only seen in the tailnets they're a member of; others' snapshots must be kept
+	objects.invalidate(notifier.Event{Kind: notifier.UserUpdated, Tailnet: 1, User: 1})
+
+	if _, ok := objects.users[1]; ok {
+		t.Errorf("expected the user to be evicted")
+	}
+
+	if _, ok := objects.snapshots[1]; ok {
+		t.Errorf("expected the snapshot of the user's tailnet to be evicted")
+	}
+
+	if _, ok := objects.snapshots[2]; !ok {
+		t.Errorf("expected the snapshot of another tailnet to be kept")
+	}
+}
+
+func TestMapper_HiddenPeer(t *testing.T) {
+	var conn = fixture(t)
+	exec(t, conn, `UPDATE tailnets SET hide_offline_after = 7 WHERE id = 1; UPDATE machines SET last_seen = '2024-01-02T00:00:00Z', always_visible = true WHERE id = 2`)
+
+	resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 1))
+	if err != nil {
+		t.Fatalf("failed to generate map response: %v", err)
+	}
+
+	golden(t, "hidden_peer", Wire(resp))
+}
+
+func TestMapper_PendingApproval(t *testing.T) {
+	var conn = fixture(t)
+	exec(t, conn, `UPDATE machines SET authorized = false WHERE id = 2`)
+
+	t.Run("Peer", func(t *testing.T) {
+		resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 1))
+		if err != nil {
+			t.Fatalf("failed to generate map response: %v", err)
+		}
+
+		for _, peer := range resp.Peers {
+			if peer.ID == 2 {
+				t.Errorf("expected bravo, pending approval, to be hidden from alpha")
+			}
+		}
+	})
+
+	t.Run("Self", func(t *testing.T) {
+		resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 2))
+		if err != nil {
+			t.Fatalf("failed to generate map response: %v", err)
+		}
+
+		if resp.Node.MachineAuthorized || len(resp.Peers) != 0 {
+			t.Errorf("expected bravo to be unauthorized without any peers; got authorized=%t peers=%d", resp.Node.MachineAuthorized, len(resp.Peers))
+		}
+	})
+}
+
+func TestMapper_DerpOnly(t *testing.T) {
+	var conn = fixture(t)
+	exec(t, conn, `UPDATE machines SET force_derp = true WHERE id = 2`)
+
+	t.Run("Peer", func(t *testing.T) {
+		resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 1))
+		if err != nil {
+			t.Fatalf("failed to generate map response: %v", err)
+		}
+
+		golden(t, "derp_only_peer", Wire(resp))
+	})
+
+	t.Run("Self", func(t *testing.T) {
+		resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 2))
+		if err != nil {
+			t.Fatalf("failed to generate map response: %v", err)
+		}
+
+		golden(t, "derp_only_self", Wire(resp))
+	})
+}
+
+func TestMapper_DNS(t *testing.T) {
+	var conn = fixture(t)
+	exec(t, conn, `UPDATE tailnets SET dns = '{
+		"fallback_resolvers": ["1.1.1.1", "https://dns.example.com/dns-query"],
+		"routes": { "corp.example.com": ["10.0.0.53:53"], "internal.example.com": [] },
+		"nameservers": ["9.9.9.9", "2620:fe::fe"],
+		"search_domains": ["corp.example.com"],
+		"extra_records": [
+			{ "name": "grafana.corp.example.com", "type": "A", "value": "100.64.0.2" },
+			{ "name": "grafana.corp.example.com", "type": "AAAA", "value": "fd7a:115c:a1e0::2" }
+		]
+	}' WHERE id = 1`)
+
+	resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 1))
+	if err != nil {
+		t.Fatalf("failed to generate map response: %v", err)
+	}
+
+	golden(t, "dns", resp.DNSConfig)
+}
+
+func TestMapper_Welcome(t *testing.T) {
+	var conn = fixture(t)
+	exec(t, conn, `UPDATE tailnets SET welcome = '{"message": "welcome to example.com!", "health": true}' WHERE id = 1`)
+
+	// fixture machines were added long ago, and no longer receive the welcome message
+	resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 1))
+	if err != nil {
+		t.Fatalf("failed to generate map response: %v", err)
+	} else if slices.Contains(resp.Health, "welcome to example.com!") {
+		t.Errorf("unexpected welcome message in %v", resp.Health)
+	}
+
+	exec(t, conn, `UPDATE machines SET created_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = 1`)
+	if resp, err = mapper(nil, latest)(context.Background(), conn, machine(t, conn, 1)); err != nil {
+		t.Fatalf("failed to generate map response: %v", err)
+	} else if !slices.Contains(resp.Health, "welcome to example.com!") {
+		t.Errorf("expected welcome message in %v", resp.Health)
+	}
+}
+
+func TestMapper_HttpsCerts(t *testing.T) {
+	var conn = fixture(t)
+
+	viper.Set("certs.enabled", true)
+	t.Cleanup(func() { viper.Set("certs.enabled", false) })
+
+	resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 1))
+	if err != nil {
+		t.Fatalf("failed to generate map response: %v", err)
+	}
+
+	if want := strings.TrimSuffix(resp.Node.Name, "."); !slices.Equal(resp.DNSConfig.CertDomains, []string{want}) {
+		t.Errorf("unexpected cert domains %v; want %q", resp.DNSConfig.CertDomains, want)
+	}
+
+	if _, ok := resp.Node.CapMap[tailcfg.CapabilityHTTPS]; !ok {
+		t.Errorf("expected node to have the https capability")
+	}
+}
+
+func TestMapper_Features(t *testing.T) {
+	var conn = fixture(t)
+	exec(t, conn, `UPDATE tailnets SET features = '{"taildrop": true, "ssh": false}' WHERE id = 1`)
+
+	// bravo can send files to charlie, also owned by bob; the ssh policy is cleared
+	resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 2))
+	if err != nil {
+		t.Fatalf("failed to generate map response: %v", err)
+	}
+
+	golden(t, "features", Wire(resp))
+}
+
+func TestWebClientRule(t *testing.T) {
+	var conn = fixture(t)
+
+	machines, err := database.FetchMany(conn, domain.ListMachines(&domain.Tailnet{ID: 1}))
+	if err != nil {
+		t.Fatalf("failed to list machines: %v", err)
+	}
+
+	// bravo can be managed from charlie (also owned by bob) and from alpha (owned by alice, an admin)
+	rule := webClientRule(machine(t, conn, 2), machines)
+	if rule == nil {
+		t.Fatalf("expected a web client rule for bravo")
+	}
+
+	slices.Sort(rule.SrcIPs)
+	if want := []string{"100.64.0.1", "100.64.0.3", "fd7a:115c:a1e0:ab12:4843:cd96:6240:1", "fd7a:115c:a1e0:ab12:4843:cd96:6240:3"}; !slices.Equal(rule.SrcIPs, want) {
+		t.Errorf("unexpected sources: got %v, want %v", rule.SrcIPs, want)
+	}
+
+	// alpha can only be managed by alice, who has no other machines
+	if rule = webClientRule(machine(t, conn, 1), machines); rule != nil {
+		t.Errorf("expected no web client rule for alpha, got %+v", rule)
+	}
+}
+
+func TestSiteEndpoints(t *testing.T) {
+	var peer = &domain.Machine{Site: "hq", Endpoints: []tailcfg.Endpoint{
+		{Addr: netip.MustParseAddrPort("192.168.1.10:41641"), Type: tailcfg.EndpointLocal},
+		{Addr: netip.MustParseAddrPort("203.0.113.1:41641"), Type: tailcfg.EndpointSTUN},
+	}}
+
+	var cases = []struct {
+		name string
+		site string
+		want int
+	}{
+		{"NoSite", "", 2},
+		{"SameSite", "hq", 1},
+		{"DifferentSite", "dc", 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := siteEndpoints(&domain.Machine{Site: tc.site}, peer); len(got) != tc.want {
+				t.Errorf("expected %d endpoints; got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMapper_SubnetRoutes(t *testing.T) {
+	var conn = fixture(t)
+
+	// both bravo and charlie advertise the same route; bravo (with the lower id) is elected as the primary
+	exec(t, conn, `INSERT INTO routes (machine_id, prefix, approved) VALUES (2, '192.168.1.0/24', true), (3, '192.168.1.0/24', true), (3, '10.0.0.0/8', false)`)
+
+	resp, err := mapper(nil, latest)(context.Background(), conn, machine(t, conn, 1))
+	if err != nil {
+		t.Fatalf("failed to generate map response: %v", err)
+	}
+
+	golden(t, "subnet_routes", Wire(resp))
+}
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	for _, host := range []string{"alpha", "bravo"} { // frames are appended back-to-back
+		if err := frame(&buf, util.Json[WireMapResponse], Wire(&tailcfg.MapResponse{Domain: host})); err != nil {
+			t.Fatalf("failed to frame response: %v", err)
+		}
+	}
+
+	for _, host := range []string{"alpha", "bravo"} {
+		var n = binary.LittleEndian.Uint32(buf.Next(4))
+
+		var mr WireMapResponse
+		if err := json.Unmarshal(buf.Next(int(n)), &mr); err != nil {
+			t.Fatalf("failed to decode frame: %v", err)
+		} else if mr.Domain != host {
+			t.Errorf("unexpected domain %q; want %q", mr.Domain, host)
+		}
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("unexpected %d trailing bytes", buf.Len())
+	}
+}
@@ -0,0 +1,189 @@
+package coordinator
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EndpointLabel labels a metric with the noise endpoint (ie. its route pattern) a request was served by, and whether
+// the request started a streaming session (ie. a /machine/map request with Stream set), which stays open for as long
+// as the client is connected, and is measured apart from the other requests
+type EndpointLabel struct {
+	Endpoint  string
+	Streaming bool
+}
+
+var (
+	// RequestSize is the distribution of the size of request bodies received over the noise channel, by endpoint
+	RequestSize = newHistogram("wirefire_noise_request_size_bytes", "size of request bodies received over the noise channel, by endpoint", sizeBuckets)
+
+	// ResponseSize is the distribution of the size of response bodies sent over the noise channel, by endpoint;
+	// the size of a streaming session's response is the total size of the map responses sent in the session
+	ResponseSize = newHistogram("wirefire_noise_response_size_bytes", "size of response bodies sent over the noise channel, by endpoint", sizeBuckets)
+
+	// RequestDuration is the distribution of the time spent serving requests received over the noise channel, by endpoint
+	RequestDuration = newHistogram("wirefire_noise_request_duration_seconds", "time spent serving requests received over the noise channel, by endpoint", durationBuckets)
+)
+
+var (
+	sizeBuckets     = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+	durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 1800, 3600}
+)
+
+// histogram is a prometheus histogram of observed values, by EndpointLabel. It's published with expvar, and written
+// out in the prometheus text format by the metrics endpoint (see: varz.PrometheusWriter).
+type histogram struct {
+	help    string
+	buckets []float64 // upper bounds of the buckets, in increasing order
+
+	mu     sync.Mutex
+	series map[EndpointLabel]*series
+}
+
+type series struct {
+	counts []uint64 // non-cumulative count of values in each bucket, followed by values above the last bucket
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	var h = &histogram{help: help, buckets: buckets, series: make(map[EndpointLabel]*series)}
+	expvar.Publish(name, h)
+	return h
+}
+
+// Observe records the value in the label's series
+func (h *histogram) Observe(label EndpointLabel, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[label]
+	if !ok {
+		s = &series{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[label] = s
+	}
+
+	i, _ := slices.BinarySearch(h.buckets, v) // first bucket whose upper bound is >= v
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+// String implements expvar.Var, encoding the count and sum of each series as json
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var out = make(map[string]any, len(h.series))
+	for label, s := range h.series {
+		out[label.Endpoint+";streaming="+strconv.FormatBool(label.Streaming)] = map[string]any{"count": s.count, "sum": s.sum}
+	}
+
+	buf, _ := json.Marshal(out)
+	return string(buf)
+}
+
+// WritePrometheus writes the histogram out in the prometheus text format
+func (h *histogram) WritePrometheus(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var labels = make([]EndpointLabel, 0, len(h.series))
+	for label := range h.series {
+		labels = append(labels, label)
+	}
+
+	slices.SortFunc(labels, func(a, b EndpointLabel) int {
+		return cmp.Or(strings.Compare(a.Endpoint, b.Endpoint), strings.Compare(strconv.FormatBool(a.Streaming), strconv.FormatBool(b.Streaming)))
+	})
+
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, h.help, name)
+	for _, label := range labels {
+		var s = h.series[label]
+		var l = fmt.Sprintf("endpoint=%q,streaming=%q", label.Endpoint, strconv.FormatBool(label.Streaming))
+
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			_, _ = fmt.Fprintf(w, "%s_bucket{%s,le=%q} %d\n", name, l, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+
+		_, _ = fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, l, s.count)
+		_, _ = fmt.Fprintf(w, "%s_sum{%s} %s\n", name, l, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		_, _ = fmt.Fprintf(w, "%s_count{%s} %d\n", name, l, s.count)
+	}
+}
+
+type streamingKey struct{}
+
+// markStreaming marks the request, whose context is ctx, as having started a streaming session (see: EndpointLabel)
+func markStreaming(ctx context.Context) {
+	if streaming, ok := ctx.Value(streamingKey{}).(*bool); ok {
+		*streaming = true
+	}
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written to a response. It implements http.Flusher, as streaming sessions flush
+// every map response they write.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// RecordMetrics is a middleware that records the size of the request and response bodies, and the time spent serving
+// the request, of each request served by the noise channel's router, by the route it matched (see: EndpointLabel).
+func RecordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, streaming = time.Now(), false
+		var body, res = &countingBody{ReadCloser: r.Body}, &countingWriter{ResponseWriter: w}
+
+		r.Body = body
+		next.ServeHTTP(res, r.WithContext(context.WithValue(r.Context(), streamingKey{}, &streaming)))
+
+		var label = EndpointLabel{Endpoint: "unknown", Streaming: streaming}
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			label.Endpoint = rctx.RoutePattern()
+		}
+
+		RequestSize.Observe(label, float64(body.n))
+		ResponseSize.Observe(label, float64(res.n))
+		RequestDuration.Observe(label, time.Since(start).Seconds())
+	})
+}
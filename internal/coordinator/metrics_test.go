@@ -0,0 +1,37 @@
+package coordinator
+
+import (
+	"bytes"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecordMetrics(t *testing.T) {
+	var r = chi.NewRouter()
+	r.Use(RecordMetrics)
+	r.Post("/test/{id}", func(w http.ResponseWriter, r *http.Request) {
+		markStreaming(r.Context())
+		_, _ = w.Write(make([]byte, 300))
+		w.(http.Flusher).Flush()
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/test/1", strings.NewReader("hello")))
+
+	var buf bytes.Buffer
+	ResponseSize.WritePrometheus(&buf, "response_size")
+
+	for _, line := range []string{
+		"# TYPE response_size histogram",
+		`response_size_bucket{endpoint="/test/{id}",streaming="true",le="256"} 0`,
+		`response_size_bucket{endpoint="/test/{id}",streaming="true",le="1024"} 1`,
+		`response_size_bucket{endpoint="/test/{id}",streaming="true",le="+Inf"} 1`,
+		`response_size_sum{endpoint="/test/{id}",streaming="true"} 300`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected output to contain %q; got:\n%s", line, buf.String())
+		}
+	}
+}
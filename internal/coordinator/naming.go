@@ -0,0 +1,67 @@
+package coordinator
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"math/rand/v2"
+)
+
+// words used to generate memorable machine names, in tailnets that use domain.NamingWords
+var (
+	adjectives = []string{
+		"amber", "bold", "brave", "bright", "calm", "clever", "cosmic", "crisp", "daring", "eager",
+		"fancy", "fierce", "gentle", "giant", "golden", "happy", "hidden", "humble", "jolly", "keen",
+		"lively", "lucky", "mellow", "merry", "mighty", "misty", "noble", "polite", "proud", "quick",
+		"quiet", "rapid", "rustic", "shiny", "silent", "silver", "sleepy", "smooth", "snowy", "solar",
+		"steady", "sunny", "swift", "tidy", "tiny", "vivid", "wandering", "wild", "wise", "witty",
+	}
+
+	animals = []string{
+		"alpaca", "badger", "beaver", "bison", "cheetah", "condor", "coyote", "crane", "dolphin", "falcon",
+		"ferret", "finch", "fox", "gecko", "heron", "ibex", "jaguar", "koala", "lemur", "lynx",
+		"marmot", "marten", "moose", "narwhal", "ocelot", "orca", "osprey", "otter", "owl", "panda",
+		"pelican", "penguin", "puffin", "quokka", "raven", "robin", "salmon", "seal", "sparrow", "squirrel",
+		"stork", "swan", "tapir", "tiger", "toucan", "turtle", "walrus", "weasel", "wombat", "yak",
+	}
+)
+
+// generateAttempts is the number of names tried before settling for one that's in use, and distinguished by its name index
+const generateAttempts = 8
+
+// generateName returns a memorable, random name (eg. brave-otter) for a new machine in the tailnet. Names that aren't used
+// by another machine in the tailnet are preferred, while reserved names (see: NamingConfig) are never returned.
+func generateName(conn *sqlite.Conn, tailnet *domain.Tailnet) (name string, err error) {
+	var naming = config.Read[NamingConfig]()
+
+	var fallback string // a name that's in use, if no unused one is found
+	var reserved error  // set if candidates were reserved
+	for i := 0; i < generateAttempts; i++ {
+		var candidate = adjectives[rand.IntN(len(adjectives))] + "-" + animals[rand.IntN(len(animals))]
+		if err = naming.CheckHostname(candidate); err != nil {
+			reserved = err
+			continue
+		}
+
+		if idx, err := database.FetchOne[int](conn, domain.GetNextNameIndex(tailnet, candidate)); err != nil {
+			return "", err
+		} else if idx == nil {
+			return candidate, nil
+		}
+
+		fallback = candidate
+	}
+
+	if fallback == "" {
+		return "", reserved // all the candidates were reserved
+	}
+
+	return fallback, nil
+}
+
+// followsHostname returns true if the machine is renamed as its client's hostname changes, ie. if it's neither
+// been named by an admin, nor given a generated name.
+func followsHostname(m *domain.Machine, tailnet *domain.Tailnet) bool {
+	return !m.GivenName && tailnet.Naming != domain.NamingWords
+}
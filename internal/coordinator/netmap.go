@@ -0,0 +1,351 @@
+package coordinator
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"encoding/json"
+	"fmt"
+	"github.com/riyaz-ali/tacl"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/rs/zerolog"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"tailscale.com/metrics"
+	"tailscale.com/tailcfg"
+	"time"
+)
+
+// Global defaults of the netmap size guardrails, used for tailnets that don't set their own; see domain.Guardrails
+var (
+	// NetmapWarnSize is the size, in bytes, of a netmap beyond which admins are alerted
+	NetmapWarnSize = settings.Define("coordinator.netmap_warn_size", int64(4<<20),
+		"size, in bytes, of a netmap beyond which admins are alerted")
+
+	// NetmapMaxSize is the size, in bytes, of a netmap beyond which mitigations are applied, in tailnets that enable them
+	NetmapMaxSize = settings.Define("coordinator.netmap_max_size", int64(16<<20),
+		"size, in bytes, of a netmap beyond which mitigations are applied, in tailnets that enable them")
+)
+
+// Levels of a tailnet's netmap size, as compared to its guardrails
+const (
+	NetmapOK       = "ok"
+	NetmapWarn     = "warn"
+	NetmapExceeded = "exceeded"
+)
+
+// NetmapLabel labels a metric with the name of the tailnet it belongs to
+type NetmapLabel struct {
+	Tailnet string `prom:"tailnet"`
+}
+
+var (
+	// NetmapSize is the size of the largest netmap recently sent to a machine in the tailnet
+	NetmapSize = metrics.NewMultiLabelMap[NetmapLabel]("wirefire_netmap_size_bytes", "gauge", "size of the largest netmap recently sent to a machine in the tailnet")
+
+	// NetmapAlerts is the number of times the tailnet's netmap size went past one of its guardrails
+	NetmapAlerts = metrics.NewMultiLabelMap[NetmapLabel]("wirefire_netmap_alerts_total", "counter", "number of times the size of the tailnet's netmaps went past one of its guardrails")
+)
+
+// NetmapStatus is the size of the netmaps sent to a tailnet's machines, as compared to its guardrails
+type NetmapStatus struct {
+	Size       int64     `json:"size"`    // size of the largest netmap, last sent to any of the tailnet's machines
+	Machine    string    `json:"machine"` // machine the largest netmap was sent to
+	Level      string    `json:"level"`   // one of ok, warn or exceeded
+	Mitigating bool      `json:"mitigating"`
+	MeasuredAt time.Time `json:"measured_at"`
+}
+
+// netmapEntry is the size of the last full netmap sent to a machine
+type netmapEntry struct {
+	name string
+	size int64
+}
+
+// netmapSizes are the sizes of the last full netmaps sent to a tailnet's machines, along with the tailnet's guardrails
+// as of the last one
+type netmapSizes struct {
+	name        string // name of the tailnet, used to label its metrics
+	warn, limit int64
+	mitigate    bool
+	machines    map[int]netmapEntry // by machine
+}
+
+// evaluate returns the status of the largest of the netmaps, as compared to the guardrails
+func (n *netmapSizes) evaluate() *NetmapStatus {
+	var status = &NetmapStatus{Level: NetmapOK, MeasuredAt: time.Now().UTC()}
+	for _, e := range n.machines {
+		if e.size > status.Size {
+			status.Size, status.Machine = e.size, e.name
+		}
+	}
+
+	switch {
+	case status.Size > n.limit:
+		status.Level = NetmapExceeded
+	case status.Size > n.warn:
+		status.Level = NetmapWarn
+	}
+
+	status.Mitigating = n.mitigate && status.Level == NetmapExceeded
+	return status
+}
+
+// netmaps tracks the size of the full netmaps sent to machines, in memory, by tailnet. A machine's entry is removed once
+// its session is closed, or it's deleted, so that the status reflects the netmaps of the machines still connected.
+var netmaps = struct {
+	sync.Mutex
+	sizes  map[int]*netmapSizes // by tailnet
+	status map[int]*NetmapStatus
+}{
+	sizes:  make(map[int]*netmapSizes),
+	status: make(map[int]*NetmapStatus),
+}
+
+// Netmap returns the netmap size status of the tailnet; nil if none of its connected machines has been sent a netmap
+func Netmap(tailnetID int) *NetmapStatus {
+	netmaps.Lock()
+	defer netmaps.Unlock()
+
+	if status, ok := netmaps.status[tailnetID]; ok {
+		var s = *status
+		return &s
+	}
+	return nil
+}
+
+// mitigating reports whether mitigations are applied to the netmaps of the tailnet
+func mitigating(t *domain.Tailnet) bool {
+	netmaps.Lock()
+	defer netmaps.Unlock()
+
+	status, ok := netmaps.status[t.ID]
+	return ok && t.Guardrails.Mitigate && status.Level == NetmapExceeded
+}
+
+// netmapSize returns the serialized size of the peers, packet filter and ssh policy, which make up the bulk of a netmap
+func netmapSize(peers []*tailcfg.Node, filter []tailcfg.FilterRule, ssh *tailcfg.SSHPolicy) int64 {
+	buf, _ := json.Marshal(struct {
+		Peers        []*tailcfg.Node
+		PacketFilter []tailcfg.FilterRule
+		SSHPolicy    *tailcfg.SSHPolicy
+	}{peers, filter, ssh})
+
+	return int64(len(buf))
+}
+
+// recordNetmapSize records the size of the full (unmitigated) netmap prepared for the machine, and returns whether
+// mitigations must be applied to it. Admins are alerted, through the tailnet's webhooks (see: domain.WebhookNetmapSize),
+// when the size of the tailnet's largest netmap goes past one of its guardrails, and connected machines are re-synced
+// when mitigations are turned on or off.
+func recordNetmapSize(ctx context.Context, conn *sqlite.Conn, m *domain.Machine, size int64) bool {
+	var t = m.Tailnet
+	var warn, limit = t.Guardrails.WarnSize, t.Guardrails.MaxSize
+	if warn == 0 {
+		warn = NetmapWarnSize.Get()
+	}
+
+	if limit == 0 {
+		limit = NetmapMaxSize.Get()
+	}
+
+	netmaps.Lock()
+
+	var sizes, ok = netmaps.sizes[t.ID]
+	if !ok {
+		sizes = &netmapSizes{machines: make(map[int]netmapEntry)}
+		netmaps.sizes[t.ID] = sizes
+	}
+
+	sizes.name, sizes.warn, sizes.limit, sizes.mitigate = t.Name, warn, limit, t.Guardrails.Mitigate
+	sizes.machines[m.ID] = netmapEntry{name: m.CompleteName(), size: size}
+
+	var status = sizes.evaluate()
+
+	var prev = netmaps.status[t.ID]
+	if prev == nil {
+		prev = &NetmapStatus{Level: NetmapOK}
+	}
+
+	var alert = level(status.Level) > level(prev.Level)
+	netmaps.status[t.ID] = status
+
+	netmaps.Unlock()
+
+	NetmapSize.SetInt(NetmapLabel{Tailnet: t.Name}, status.Size)
+
+	if alert {
+		NetmapAlerts.Add(NetmapLabel{Tailnet: t.Name}, 1)
+
+		zerolog.Ctx(ctx).Warn().Str("tailnet", t.Name).Str("machine", status.Machine).Int64("size", status.Size).
+			Int64("warn_size", warn).Int64("max_size", limit).Bool("mitigating", status.Mitigating).Msg("netmap size past guardrail")
+
+		netmapAlert(ctx, conn, t, status, warn, limit)
+	}
+
+	if status.Mitigating != prev.Mitigating {
+		notifier.Publish(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: t.ID})
+	}
+
+	return status.Mitigating
+}
+
+// forgetNetmap removes the size of the netmap sent to the machine, or of all the tailnet's machines if machine is zero,
+// and re-evaluates the tailnet's status against the rest. Connected machines are re-synced if mitigations are turned off.
+func forgetNetmap(tailnet, machine int) {
+	netmaps.Lock()
+
+	var sizes, ok = netmaps.sizes[tailnet]
+	if !ok {
+		netmaps.Unlock()
+		return
+	}
+
+	if delete(sizes.machines, machine); machine == 0 || len(sizes.machines) == 0 {
+		var prev = netmaps.status[tailnet]
+		delete(netmaps.sizes, tailnet)
+		delete(netmaps.status, tailnet)
+		netmaps.Unlock()
+
+		NetmapSize.Delete(NetmapLabel{Tailnet: sizes.name})
+		if prev != nil && prev.Mitigating {
+			notifier.Publish(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: tailnet})
+		}
+
+		return
+	}
+
+	var prev, status = netmaps.status[tailnet], sizes.evaluate()
+	netmaps.status[tailnet] = status
+	netmaps.Unlock()
+
+	NetmapSize.SetInt(NetmapLabel{Tailnet: sizes.name}, status.Size)
+	if prev != nil && status.Mitigating != prev.Mitigating {
+		notifier.Publish(notifier.Event{Kind: notifier.TailnetUpdated, Tailnet: tailnet})
+	}
+}
+
+// pruneNetmaps removes the netmap sizes of machines and tailnets, as their deletion is published to the notifier, for
+// the lifetime of the process
+func pruneNetmaps() {
+	events, _ := notifier.SubscribeAll()
+	go func() {
+		for e := range events {
+			switch e.Kind {
+			case notifier.MachineDeleted:
+				forgetNetmap(e.Tailnet, e.Machine)
+			case notifier.TailnetDeleted:
+				forgetNetmap(e.Tailnet, 0)
+			}
+		}
+	}()
+}
+
+// level orders the netmap levels by severity
+func level(l string) int { return slices.Index([]string{NetmapOK, NetmapWarn, NetmapExceeded}, l) }
+
+// netmapAlert records the tailnet's netmap size status in the audit log, from where it's delivered to the tailnet's
+// webhooks that subscribe to it (see: webhook.Run)
+func netmapAlert(ctx context.Context, conn *sqlite.Conn, t *domain.Tailnet, status *NetmapStatus, warn, limit int64) {
+	event := &domain.AuditEvent{Action: domain.ActionNetmapSizeExceeded, Actor: "coordinator", Target: t.Name, TailnetID: util.ToPtr(t.ID), Data: map[string]string{
+		"level":      status.Level,
+		"size":       strconv.FormatInt(status.Size, 10),
+		"machine":    status.Machine,
+		"warn_size":  strconv.FormatInt(warn, 10),
+		"max_size":   strconv.FormatInt(limit, 10),
+		"mitigating": strconv.FormatBool(status.Mitigating),
+	}}
+
+	if _, err := database.Exec(conn, domain.RecordEvent(event)); err != nil {
+		zerolog.Ctx(ctx).Error().Err(err).Str("tailnet", t.Name).Msg("failed to record netmap alert")
+	}
+}
+
+// netmapPeer is a peer included in a machine's netmap
+type netmapPeer struct {
+	machine *domain.Machine
+	node    *tailcfg.Node
+}
+
+// pruneUnreachable removes peers that can't communicate with the machine, in either direction, as per the tailnet's acl policy.
+// A peer is kept if it's allowed by the machine's packet filter, or if the machine is allowed by the peer's. Compiling the
+// filter of every peer is expensive, and is only done for netmaps beyond their tailnet's guardrails.
+func pruneUnreachable(m *domain.Machine, filter []tailcfg.FilterRule, peers []netmapPeer) []netmapPeer {
+	var self = []tacl.Machine{m}
+	var v4, v6 = m.IP()
+
+	return slices.DeleteFunc(peers, func(p netmapPeer) bool {
+		if p4, p6 := p.machine.IP(); allows(filter, p4, p6) {
+			return false
+		}
+
+		return !allows(m.Tailnet.Acl.BuildFilter(p.machine, self), v4, v6)
+	})
+}
+
+// allows reports whether any of the packet filter's rules accepts traffic from any of the addresses
+func allows(filter []tailcfg.FilterRule, addrs ...netip.Addr) bool {
+	for _, rule := range filter {
+		for _, src := range rule.SrcIPs {
+			for _, addr := range addrs {
+				if addr.IsValid() && matches(src, addr) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// matches reports whether the source of a filter rule (one of *, an ip address, prefix or range) contains the address
+func matches(src string, addr netip.Addr) bool {
+	if src == "*" {
+		return true
+	}
+
+	if from, to, ok := strings.Cut(src, "-"); ok {
+		start, err1 := netip.ParseAddr(from)
+		end, err2 := netip.ParseAddr(to)
+		return err1 == nil && err2 == nil && start.Compare(addr) <= 0 && addr.Compare(end) <= 0
+	}
+
+	if prefix, err := netip.ParsePrefix(src); err == nil {
+		return prefix.Contains(addr)
+	}
+
+	ip, err := netip.ParseAddr(src)
+	return err == nil && ip == addr
+}
+
+// compressFilter merges rules with the same sources and protocols, and no capability grants, into a single rule
+// with the union of their destinations. Rules only ever accept traffic, and so, their order doesn't matter.
+func compressFilter(filter []tailcfg.FilterRule) []tailcfg.FilterRule {
+	var out = make([]tailcfg.FilterRule, 0, len(filter))
+	var index = make(map[string]int)
+
+	for _, rule := range filter {
+		if len(rule.CapGrant) > 0 {
+			out = append(out, rule)
+			continue
+		}
+
+		var key = strings.Join(rule.SrcIPs, ",") + "|" + fmt.Sprint(rule.IPProto)
+		if i, ok := index[key]; ok {
+			out[i].DstPorts = append(out[i].DstPorts, rule.DstPorts...)
+			continue
+		}
+
+		index[key] = len(out)
+		rule.DstPorts = slices.Clone(rule.DstPorts)
+		out = append(out, rule)
+	}
+
+	return out
+}
@@ -0,0 +1,100 @@
+package coordinator
+
+import (
+	"context"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"net/netip"
+	"tailscale.com/tailcfg"
+	"testing"
+)
+
+func TestAllows(t *testing.T) {
+	var cases = []struct {
+		name string
+		src  string
+		want bool
+	}{
+		{"Wildcard", "*", true},
+		{"Address", "100.64.0.1", true},
+		{"OtherAddress", "100.64.0.2", false},
+		{"Prefix", "100.64.0.0/24", true},
+		{"OtherPrefix", "100.65.0.0/24", false},
+		{"Range", "100.64.0.0-100.64.0.10", true},
+		{"OtherRange", "100.64.0.2-100.64.0.10", false},
+		{"Invalid", "autogroup:member", false},
+	}
+
+	var addr = netip.MustParseAddr("100.64.0.1")
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var filter = []tailcfg.FilterRule{{SrcIPs: []string{tc.src}}}
+			if got := allows(filter, netip.Addr{}, addr); got != tc.want {
+				t.Errorf("allows(%q) = %t; want %t", tc.src, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCompressFilter(t *testing.T) {
+	var port = func(ip string, p uint16) tailcfg.NetPortRange {
+		return tailcfg.NetPortRange{IP: ip, Ports: tailcfg.PortRange{First: p, Last: p}}
+	}
+
+	var filter = []tailcfg.FilterRule{
+		{SrcIPs: []string{"100.64.0.1"}, DstPorts: []tailcfg.NetPortRange{port("100.64.0.2", 22)}},
+		{SrcIPs: []string{"100.64.0.3"}, DstPorts: []tailcfg.NetPortRange{port("100.64.0.2", 22)}},
+		{SrcIPs: []string{"100.64.0.1"}, DstPorts: []tailcfg.NetPortRange{port("100.64.0.2", 443)}},
+		{SrcIPs: []string{"100.64.0.1"}, DstPorts: []tailcfg.NetPortRange{port("100.64.0.2", 53)}, IPProto: []int{17}},
+		{SrcIPs: []string{"100.64.0.1"}, CapGrant: []tailcfg.CapGrant{{Dsts: []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")}}}},
+	}
+
+	var got = compressFilter(filter)
+	if len(got) != 4 {
+		t.Fatalf("expected 4 rules; got %d", len(got))
+	}
+
+	if ports := got[0].DstPorts; len(ports) != 2 || ports[0].Ports.First != 22 || ports[1].Ports.First != 443 {
+		t.Errorf("expected rules with the same sources to be merged; got %v", ports)
+	}
+
+	if len(filter[0].DstPorts) != 1 {
+		t.Errorf("expected the original filter to be left untouched")
+	}
+
+	if len(got[2].IPProto) != 1 || len(got[3].CapGrant) != 1 {
+		t.Errorf("expected rules with other protocols, or capability grants, to be kept as-is")
+	}
+}
+
+func TestRecordNetmapSize(t *testing.T) {
+	var conn = fixture(t)
+	var alpha, bravo = machine(t, conn, 1), machine(t, conn, 2)
+	alpha.Tailnet.Guardrails = domain.Guardrails{WarnSize: 100, MaxSize: 1000, Mitigate: true}
+	bravo.Tailnet.Guardrails = alpha.Tailnet.Guardrails
+
+	forgetNetmap(1, 0) // sizes recorded by other tests
+	t.Cleanup(func() { forgetNetmap(1, 0) })
+
+	if recordNetmapSize(context.Background(), conn, alpha, 50) || Netmap(1).Level != NetmapOK {
+		t.Fatalf("expected netmap within guardrails; got %+v", Netmap(1))
+	}
+
+	if !recordNetmapSize(context.Background(), conn, bravo, 2000) || Netmap(1).Level != NetmapExceeded {
+		t.Fatalf("expected netmap past guardrails to be mitigated; got %+v", Netmap(1))
+	}
+
+	events, err := database.FetchMany(conn, domain.ListAuditEvents(1, 10))
+	if err != nil || len(events) != 1 || events[0].Action != domain.ActionNetmapSizeExceeded || events[0].Data["level"] != NetmapExceeded {
+		t.Errorf("expected alert recorded for the tailnet's webhooks; got %+v (err: %v)", events, err)
+	}
+
+	// the largest netmap is no longer in use once its machine disconnects (or is deleted)
+	if forgetNetmap(1, bravo.ID); Netmap(1).Size != 50 || Netmap(1).Mitigating || mitigating(alpha.Tailnet) {
+		t.Errorf("expected status of the remaining netmaps; got %+v", Netmap(1))
+	}
+
+	if forgetNetmap(1, 0); Netmap(1) != nil {
+		t.Errorf("expected no status once the tailnet is forgotten; got %+v", Netmap(1))
+	}
+}
@@ -0,0 +1,163 @@
+package coordinator
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/ipam"
+	"net/netip"
+	"slices"
+	"tailscale.com/net/tsaddr"
+)
+
+// ErrInvalidPool is returned when a tailnet's address pool is invalid, or overlaps one of its subnet routes
+var ErrInvalidPool = errors.New("invalid address pool")
+
+func init() {
+	config.Register[ipam.Config]()
+}
+
+// Pools returns the prefixes the tailnet's machines are allocated addresses from; the tailnet's own pools if it defines
+// them, or the global defaults otherwise (see: ipam.DefaultIPv4Pool and ipam.Config).
+func Pools(tailnet *domain.Tailnet) (v4, v6 netip.Prefix) {
+	if v4 = tailnet.IPv4Pool; !v4.IsValid() {
+		v4 = ipam.DefaultIPv4Pool
+	}
+
+	if v6 = tailnet.IPv6Pool; !v6.IsValid() {
+		v6 = netip.MustParsePrefix(config.MustValidate(config.Read[ipam.Config]()).IPv6Prefix)
+	}
+
+	return v4, v6
+}
+
+// allocateAddrs allocates a free address of each family, from the tailnet's pools, to a machine in the tailnet.
+// An address is free if it isn't allocated to another machine, and isn't routed to a subnet router in the tailnet.
+//
+// The addresses are reserved in the ip_allocations table, whose unique constraint guarantees that concurrent registrations
+// are never allocated the same address. The caller must claim them (see: domain.ClaimAddrs) in the same transaction.
+//
+// The preferred addresses, if any, are allocated instead if they're in the tailnet's pools and free (eg. to keep the
+// addresses of an imported machine).
+func allocateAddrs(conn *sqlite.Conn, tailnet *domain.Tailnet, prefer ...netip.Addr) (v4, v6 netip.Addr, err error) {
+	var routes []*domain.Route
+	if routes, err = database.FetchMany(conn, domain.ListTailnetRoutes(tailnet)); err != nil {
+		return v4, v6, err
+	}
+
+	predicate := func(ip netip.Addr) (bool, error) {
+		if slices.ContainsFunc(routes, func(r *domain.Route) bool { return !tsaddr.IsExitRoute(r.Prefix) && r.Prefix.Contains(ip) }) {
+			return false, nil
+		}
+
+		reserved, err := database.FetchOne(conn, domain.ReserveAddr(tailnet, ip))
+		return reserved != nil && *reserved, err
+	}
+
+	var pool4, pool6 = Pools(tailnet)
+	for _, addr := range prefer {
+		var free bool
+		if (addr.Is4() && !v4.IsValid() && pool4.Contains(addr)) || (addr.Is6() && !v6.IsValid() && pool6.Contains(addr)) {
+			if free, err = predicate(addr); err != nil {
+				return v4, v6, err
+			}
+		}
+
+		if free && addr.Is4() {
+			v4 = addr
+		} else if free {
+			v6 = addr
+		}
+	}
+
+	if !v4.IsValid() {
+		if v4, err = ipam.SelectIPv4(pool4, predicate); err != nil {
+			return v4, v6, err
+		}
+	}
+
+	if !v6.IsValid() {
+		if v6, err = ipam.SelectIPv6(pool6, predicate); err != nil {
+			return v4, v6, err
+		}
+	}
+
+	return v4, v6, nil
+}
+
+// SetPools sets the prefixes the tailnet's machines are allocated addresses from. An invalid (zero) prefix reverts to the
+// global default. The IPv4 pool must be contained in Tailscale's CGNAT range, and neither pool may overlap the tailnet's subnet routes.
+//
+// Existing machines keep their addresses, unless migrate is set, in which case machines with an address outside
+// the new pools are allocated a new address from them. The migrated machines are returned.
+func SetPools(conn *sqlite.Conn, tailnet *domain.Tailnet, v4, v6 netip.Prefix, migrate bool) (migrated []*domain.Machine, err error) {
+	if v4.IsValid() && (!v4.Addr().Is4() || v4.Bits() > 30 || !tsaddr.CGNATRange().Contains(v4.Addr())) {
+		return nil, errors.Wrapf(ErrInvalidPool, "%s must be contained in %s", v4, tsaddr.CGNATRange())
+	}
+
+	if v6.IsValid() && (!v6.Addr().Is6() || v6.Addr().Is4In6() || v6.Bits() > 96 || tsaddr.Tailscale4To6Range().Contains(v6.Addr())) {
+		return nil, errors.Wrapf(ErrInvalidPool, "%s must be an ipv6 prefix of at most 96 bits, outside of %s", v6, tsaddr.Tailscale4To6Range())
+	}
+
+	var routes []*domain.Route
+	if routes, err = database.FetchMany(conn, domain.ListTailnetRoutes(tailnet)); err != nil {
+		return nil, err
+	}
+
+	for _, route := range routes {
+		if tsaddr.IsExitRoute(route.Prefix) {
+			continue
+		}
+
+		for _, pool := range []netip.Prefix{v4, v6} {
+			if pool.IsValid() && pool.Overlaps(route.Prefix) {
+				return nil, errors.Wrapf(ErrInvalidPool, "%s overlaps subnet route %s", pool, route.Prefix)
+			}
+		}
+	}
+
+	if _, err = database.Exec(conn, domain.SetTailnetPools(tailnet, v4, v6)); err != nil {
+		return nil, err
+	}
+
+	tailnet.IPv4Pool, tailnet.IPv6Pool = v4, v6
+	if !migrate {
+		return nil, nil
+	}
+
+	var machines []*domain.Machine
+	if machines, err = database.FetchMany(conn, domain.ListMachines(tailnet)); err != nil {
+		return nil, err
+	}
+
+	var pool4, pool6 = Pools(tailnet)
+	for _, machine := range machines {
+		ip4, ip6 := machine.IP()
+		if pool4.Contains(ip4) && pool6.Contains(ip6) {
+			continue
+		}
+
+		if ip4, ip6, err = allocateAddrs(conn, tailnet); err != nil {
+			return nil, err
+		}
+
+		if _, err = database.Exec(conn, domain.SetMachineAddrs(machine, ip4, ip6)); err != nil {
+			return nil, err
+		}
+
+		// release the machine's previous addresses, and claim the new ones in their place
+		if _, err = database.Exec(conn, domain.ReleaseAddrs(machine)); err != nil {
+			return nil, err
+		}
+
+		machine.IPv4, machine.IPv6 = ip4, ip6
+		if _, err = database.Exec(conn, domain.ClaimAddrs(machine)); err != nil {
+			return nil, err
+		}
+		migrated = append(migrated, machine)
+	}
+
+	return migrated, nil
+}
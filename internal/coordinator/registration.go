@@ -4,12 +4,17 @@ import (
 	"context"
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"github.com/pkg/errors"
 	"github.com/riyaz-ali/wirefire/internal/config"
 	"github.com/riyaz-ali/wirefire/internal/database"
 	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/riyaz-ali/wirefire/internal/tracing"
 	"github.com/riyaz-ali/wirefire/internal/util"
 	"github.com/rs/zerolog"
 	"net/url"
+	"slices"
 	"strings"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
@@ -18,24 +23,32 @@ import (
 	"time"
 )
 
+// DeleteEphemeralOnLogout controls whether ephemeral machines are deleted when they log out, rather than once they've been
+// offline for longer than the janitor's ephemeral.offline_grace
+var DeleteEphemeralOnLogout = settings.Define("coordinator.delete_ephemeral_on_logout", true,
+	"delete ephemeral machines when they log out; otherwise, they're deleted once they've been offline for longer than ephemeral.offline_grace")
+
 // MachineRegister implements handler for the /machine/register endpoint served over Noise channel.
 //
 // The /machine/register endpoint is the first endpoint that the node talks to start the authentication process.
 // This endpoint is used by the node to register its Noise public-key and Node public-key and kick-off a user authentication process.
 //
 // Upon successful authentication, the machine registration request is marked as successful and the node is added to the selected tailnet.
-func MachineRegister(peer key.MachinePublic, pool *sqlitex.Pool) util.HandlerFunc[tailcfg.RegisterRequest, tailcfg.RegisterResponse] {
+func MachineRegister(peer key.MachinePublic, remote Remote, pool *sqlitex.Pool) util.HandlerFunc[tailcfg.RegisterRequest, tailcfg.RegisterResponse] {
 	cfg := config.MustValidate(config.Read[Config]())
 
 	return func(ctx context.Context, req tailcfg.RegisterRequest) (_ *tailcfg.RegisterResponse, err error) {
-		log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Logger()
+		log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Int("version", int(req.Version)).Logger()
 
-		if req.Version < SupportedCapabilityVersion {
+		RecordVersion(EndpointRegister, peer, req.Version)
+		if _, ok := Negotiate(req.Version); !ok {
+			log.Warn().Msg("unsupported client version")
 			return &tailcfg.RegisterResponse{Error: UnsupportedClientVersionMessage}, nil
 		}
 
 		var conn = pool.Get(ctx)
 		defer pool.Put(conn)
+		defer tracing.Bind(conn, ctx)()
 
 		// @NOTE: do not use transaction here as it'd prevent the connection from seeing
 		//        changes made by concurrent processes (namely, oidc endpoint marking request as authenticated).
@@ -50,8 +63,27 @@ func MachineRegister(peer key.MachinePublic, pool *sqlitex.Pool) util.HandlerFun
 			return nil, err
 		}
 
-		if machine == nil { // this is a new machine that we are seeing for the first time
-			log.Debug().Msg("no machine found for peer")
+		// a known machine registering a new node key is re-authenticating (eg. after its key expired, or it logged out),
+		// and goes through the same authentication as a new machine; an expiry in the past is a logout, handled below.
+		var reauth = machine != nil && !req.NodeKey.IsZero() && req.NodeKey != machine.NodeKey &&
+			(req.Expiry.IsZero() || !req.Expiry.Before(time.Now()))
+
+		if reauth {
+			var revoked *bool
+			if revoked, err = database.FetchOne(conn, domain.IsNodeKeyRevoked(req.NodeKey)); err != nil {
+				return nil, err
+			} else if *revoked {
+				log.Debug().Msg("node key revoked on logout")
+				return &tailcfg.RegisterResponse{NodeKeyExpired: true}, nil
+			}
+		}
+
+		if machine == nil || reauth { // this is a new machine that we are seeing for the first time, or one that's re-authenticating
+			if machine == nil {
+				log.Debug().Msg("no machine found for peer")
+			} else {
+				log.Debug().Str("machine", machine.CompleteName()).Msg("machine re-authenticating with a new node key")
+			}
 
 			if req.Followup != "" { // client is polling / following up on the status of authentication
 				log.Debug().Msg("peer requesting follow-up; entering follow-up loop")
@@ -76,18 +108,26 @@ func MachineRegister(peer key.MachinePublic, pool *sqlitex.Pool) util.HandlerFun
 				return followup(ctx, conn, peer, flow)
 			}
 
-			if req.Auth != nil && req.Auth.AuthKey != "" {
-				log.Error().Msg("peer requesting auth-key based authentication")
+			if MaintenanceMode.Get() {
+				log.Warn().Msg("registration rejected; server is in maintenance mode")
+				return &tailcfg.RegisterResponse{Error: MaintenanceModeMessage}, nil
+			}
 
-				// TODO(@riyaz): add support for auth key based authentication (see: https://tailscale.com/kb/1085/auth-keys)
-				return &tailcfg.RegisterResponse{Error: "Auth key based authentication is not supported"}, nil
+			if req.Auth != nil && req.Auth.AuthKey != "" {
+				log.Debug().Msg("peer requesting auth-key based authentication")
+				return registerWithAuthKey(ctx, conn, peer, remote, machine, req)
 			}
 
 			rid := rands.HexString(8)
-			if _, err = database.Exec(conn, domain.CreateRegistrationRequest(rid, peer, req)); err != nil {
+			if _, err = database.Exec(conn, domain.CreateRegistrationRequest(rid, peer, req, remote.String(), remote.Location)); err != nil {
 				return &tailcfg.RegisterResponse{Error: err.Error()}, nil
 			}
 
+			event := &domain.AuditEvent{Action: domain.ActionRegistrationStarted, Actor: peer.String(), Target: rid, ClientAddr: remote.String(), Location: remote.Location}
+			if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+				log.Error().Err(err).Msg("failed to record audit event")
+			}
+
 			authUrl := cfg.BaseUrl.JoinPath("/oidc/login")
 
 			q := authUrl.Query()
@@ -98,31 +138,65 @@ func MachineRegister(peer key.MachinePublic, pool *sqlitex.Pool) util.HandlerFun
 
 			return &tailcfg.RegisterResponse{AuthURL: authUrl.String()}, nil
 		} else {
+			// notify connected sessions once the transaction below has been committed
+			var events []notifier.Event
+			defer func() {
+				if err == nil {
+					notifier.Publish(events...)
+				}
+			}()
+
 			defer sqlitex.Save(conn)(&err) // run the following block in a transaction
 
 			log = log.With().Int("tailnet", machine.Tailnet.ID).Str("machine", machine.CompleteName()).Logger()
 			log.Debug().Msg("found machine for peer")
 
+			// an expiry in the past is how clients log out (eg. tailscale logout)
+			if !req.Expiry.IsZero() && req.Expiry.Before(time.Now()) {
+				log.Debug().Msgf("requested expiry %s has passed; logging out machine", req.Expiry)
+
+				var event notifier.Event
+				if event, err = logout(conn, peer, remote, machine); err != nil {
+					return nil, err
+				}
+
+				events = append(events, event)
+				return &tailcfg.RegisterResponse{NodeKeyExpired: true}, nil
+			}
+
 			if machine.IsExpired() { // node has expired
 				log.Debug().Msg("machine key has expired")
 				return &tailcfg.RegisterResponse{NodeKeyExpired: true}, nil
 			}
 
-			// indicated expiry in the request has passed
-			if !req.Expiry.IsZero() && req.Expiry.Before(time.Now()) {
-				log.Debug().Msgf("requested expiry %s has passed; expiring machine key", req.Expiry)
-				if _, err = database.Exec(conn, domain.DeleteNode(machine)); err != nil {
-					return nil, err
+			var revoked *bool
+			if revoked, err = database.FetchOne(conn, domain.IsNodeKeyRevoked(req.NodeKey)); err != nil {
+				return nil, err
+			} else if *revoked {
+				log.Debug().Msg("node key revoked on logout")
+				return &tailcfg.RegisterResponse{NodeKeyExpired: true}, nil
+			}
+
+			// machine is requesting a new set of tags (eg. tailscale up --advertise-tags); verify and apply them
+			if tags := req.Hostinfo.RequestTags; len(tags) > 0 && !slices.Equal(tags, machine.AssignedTags) {
+				if err = machine.Tailnet.VerifyTags(machine.Owner, machine.Role, tags); err != nil {
+					log.Warn().Err(err).Msg("re-registration rejected; tag not permitted")
+					return &tailcfg.RegisterResponse{Error: err.Error()}, nil
 				}
 
-				return &tailcfg.RegisterResponse{NodeKeyExpired: true}, nil
+				machine.AssignedTags = tags
 			}
 
 			// update the machine hostname and save all associated data
 			sanitizeHostname := dnsname.SanitizeHostname(req.Hostinfo.Hostname)
-			if machine.Name != sanitizeHostname { // has the hostname changed? if yes, we need to generate a new name_idx
+			if machine.Name != sanitizeHostname && followsHostname(machine, machine.Tailnet) { // has the hostname changed? if yes, we need to generate a new name_idx
 				log.Debug().Msgf("renaming machine to %s", sanitizeHostname)
 
+				if err = config.Read[NamingConfig]().CheckHostname(sanitizeHostname); err != nil {
+					log.Warn().Err(err).Msg("re-registration rejected; hostname reserved")
+					return &tailcfg.RegisterResponse{Error: err.Error()}, nil
+				}
+
 				var nextIdx = 0 // first machine with the given name has name_idx = 0
 				if ni, err := database.FetchOne[int](conn, domain.GetNextNameIndex(machine.Tailnet, sanitizeHostname)); err != nil {
 					return nil, err
@@ -138,8 +212,10 @@ func MachineRegister(peer key.MachinePublic, pool *sqlitex.Pool) util.HandlerFun
 				return nil, err
 			}
 
+			events = append(events, notifier.Event{Kind: notifier.MachineUpdated, Tailnet: machine.TailnetID, Machine: machine.ID})
+
 			return &tailcfg.RegisterResponse{
-				MachineAuthorized: true,
+				MachineAuthorized: machine.Authorized,
 				User: tailcfg.User{
 					ID:          tailcfg.UserID(machine.Owner.ID),
 					LoginName:   machine.Owner.Name,
@@ -156,11 +232,187 @@ func MachineRegister(peer key.MachinePublic, pool *sqlitex.Pool) util.HandlerFun
 	}
 }
 
+// logout logs the machine out, as requested by its client. The machine's node key is expired and revoked, so that it can't
+// be used again, and its peers are notified right away to remove it from their netmaps; the machine is kept, and rejoins
+// its tailnet when its user logs in again. Ephemeral machines are deleted instead, unless DeleteEphemeralOnLogout is off.
+//
+// It returns the event to publish once the changes have been committed.
+func logout(conn *sqlite.Conn, peer key.MachinePublic, remote Remote, machine *domain.Machine) (_ notifier.Event, err error) {
+	var audit = &domain.AuditEvent{
+		Action:     domain.ActionMachineLoggedOut,
+		Actor:      peer.String(),
+		Target:     machine.CompleteName(),
+		TailnetID:  util.ToPtr(machine.TailnetID),
+		ClientAddr: remote.String(),
+		Location:   remote.Location,
+	}
+
+	var event = notifier.Event{Kind: notifier.MachineRevoked, Tailnet: machine.TailnetID, Machine: machine.ID}
+
+	if machine.Ephemeral && DeleteEphemeralOnLogout.Get() {
+		if _, err = database.Exec(conn, domain.DeleteNode(machine)); err != nil {
+			return event, err
+		}
+
+		audit.Action, audit.Data = domain.ActionMachineDeleted, map[string]string{"reason": "logout"}
+		event.Kind = notifier.MachineDeleted
+	} else {
+		if !machine.IsExpired() {
+			if _, err = database.Exec(conn, domain.ExpireNode(machine, time.Now().UTC())); err != nil {
+				return event, err
+			}
+		}
+
+		if _, err = database.Exec(conn, domain.RevokeNodeKey(machine)); err != nil {
+			return event, err
+		}
+	}
+
+	_, err = database.Exec(conn, domain.RecordEvent(audit))
+	return event, err
+}
+
+// registerWithAuthKey registers a new machine using the pre-authentication key passed in the request,
+// adding the machine to the key's tailnet without going through the interactive oidc flow. If the peer
+// already has a machine (ie. existing is non-nil), it's re-authenticated instead (see: ReauthenticateMachine).
+func registerWithAuthKey(ctx context.Context, conn *sqlite.Conn, peer key.MachinePublic, remote Remote, existing *domain.Machine, req tailcfg.RegisterRequest) (_ *tailcfg.RegisterResponse, err error) {
+	log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Logger()
+
+	prefix, secret, err := domain.ParseAuthKey(req.Auth.AuthKey)
+	if err != nil {
+		log.Warn().Msg("malformed auth key")
+		return &tailcfg.RegisterResponse{Error: InvalidAuthKeyMessage}, nil
+	}
+
+	var machine *domain.Machine
+	var events []notifier.Event // published once the transaction has been committed
+	err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+		var ak *domain.AuthKey
+		if ak, err = database.FetchOne(conn, domain.AuthKeyByPrefix(prefix)); err != nil {
+			return err
+		} else if ak == nil || !ak.Verify(secret) {
+			return domain.ErrInvalidAuthKey
+		}
+
+		// atomically mark the key as used; this fails for revoked / expired keys and for single-use keys that are already used
+		if ak, err = database.FetchOne(conn, domain.UseAuthKey(ak)); err != nil {
+			return err
+		} else if ak == nil {
+			return domain.ErrInvalidAuthKey
+		}
+
+		var user *domain.User
+		if user, err = database.FetchOne(conn, domain.UserById(int64(ak.UserID))); err != nil {
+			return err
+		} else if user.IsDisabled() {
+			return domain.ErrInvalidAuthKey // keys are revoked when the user is disabled; see api.RevokeUser
+		}
+
+		var tailnet *domain.Tailnet
+		if tailnet, err = database.FetchOne(conn, domain.TailnetById(int64(ak.TailnetID))); err != nil {
+			return err
+		}
+
+		var rr = &domain.RegistrationRequest{NoiseKey: peer, Data: req, ClientAddr: remote.String(), Location: remote.Location}
+		rr.Data.Ephemeral = req.Ephemeral || ak.Ephemeral
+
+		if len(ak.Tags) > 0 && req.Hostinfo != nil { // tags on the key take precedence over the ones requested by the machine
+			rr.Data.Hostinfo = req.Hostinfo.Clone()
+			rr.Data.Hostinfo.RequestTags = nil
+		}
+
+		var created = true
+		if existing == nil {
+			machine, err = CreateMachine(conn, user, tailnet, rr)
+		} else {
+			machine, created, err = ReauthenticateMachine(conn, user, tailnet, existing, rr)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(ak.Tags) > 0 {
+			machine.AssignedTags = ak.Tags
+			if _, err = database.Exec(conn, domain.SaveMachine(machine)); err != nil {
+				return err
+			}
+
+			// routes may be auto-approved for the key's tags
+			if err = SyncRoutes(conn, machine); err != nil {
+				return err
+			}
+		}
+
+		event := &domain.AuditEvent{
+			Action:     domain.ActionMachineCreated,
+			Actor:      user.Subject,
+			Target:     machine.CompleteName(),
+			TailnetID:  util.ToPtr(tailnet.ID),
+			ClientAddr: remote.String(),
+			Location:   remote.Location,
+			Data:       map[string]string{"auth_key": ak.Prefix, "ipv4": machine.IPv4.String()},
+		}
+
+		if existing != nil && created { // re-authenticated as a different user, or into a different tailnet
+			events = append(events, notifier.Event{Kind: notifier.MachineDeleted, Tailnet: existing.TailnetID, Machine: existing.ID})
+		}
+
+		if created {
+			events = append(events, notifier.Event{Kind: notifier.MachineCreated, Tailnet: machine.TailnetID, Machine: machine.ID})
+		} else {
+			event.Action, event.Data = domain.ActionMachineReauthenticated, map[string]string{"auth_key": ak.Prefix}
+			events = append(events, notifier.Event{Kind: notifier.MachineUpdated, Tailnet: machine.TailnetID, Machine: machine.ID})
+		}
+
+		_, err = database.Exec(conn, domain.RecordEvent(event))
+		return err
+	})
+
+	if errors.Is(err, domain.ErrInvalidAuthKey) {
+		log.Warn().Str("auth_key", prefix).Msg("registration rejected; invalid auth key")
+		return &tailcfg.RegisterResponse{Error: InvalidAuthKeyMessage}, nil
+	} else if errors.Is(err, domain.ErrTagNotPermitted) {
+		log.Warn().Err(err).Str("auth_key", prefix).Msg("registration rejected; tag not permitted")
+		return &tailcfg.RegisterResponse{Error: err.Error()}, nil
+	} else if errors.Is(err, domain.ErrHostnameReserved) {
+		log.Warn().Err(err).Str("auth_key", prefix).Msg("registration rejected; hostname reserved")
+		return &tailcfg.RegisterResponse{Error: err.Error()}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("auth_key", prefix).Int("tailnet", machine.Tailnet.ID).Str("machine", machine.CompleteName()).Msg("machine registered using auth key")
+	notifier.Publish(events...)
+
+	return &tailcfg.RegisterResponse{
+		MachineAuthorized: machine.Authorized,
+		User: tailcfg.User{
+			ID:          tailcfg.UserID(machine.Owner.ID),
+			LoginName:   machine.Owner.Name,
+			DisplayName: machine.Owner.Name,
+			Created:     machine.Owner.CreatedAt,
+		},
+		Login: tailcfg.Login{
+			ID:          tailcfg.LoginID(machine.Owner.ID),
+			LoginName:   machine.Owner.Name,
+			DisplayName: machine.Owner.Name,
+		},
+	}, nil
+}
+
 // followup polls for domain.RegistrationRequest changes (every 2 seconds)
 // until either the RegistrationRequest.Authenticated becomes true or the client disconnects or the authentication fails.
+//
+// A flow the client disconnects from is marked as abandoned, and is cancelled unless the client follows up on it again
+// within a grace period (see: janitor.RegistrationAbandonGrace), so that its login link can't be used long after.
 func followup(ctx context.Context, conn *sqlite.Conn, peer key.MachinePublic, flow string) (*tailcfg.RegisterResponse, error) {
 	log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Str("flow", flow).Logger()
 
+	if _, err := database.Exec(conn, domain.ResumeRegistrationRequest(flow)); err != nil {
+		log.Error().Err(err).Msg("failed to resume registration request")
+	}
+
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
@@ -180,9 +432,15 @@ func followup(ctx context.Context, conn *sqlite.Conn, peer key.MachinePublic, fl
 			if rr.Authenticated {
 				log.Debug().Msg("request authenticated")
 
+				// the machine may yet need to be approved by an admin; see domain.Tailnet.RequireApproval
+				machine, err := database.FetchOne(conn, domain.GetMachineByKey(peer))
+				if err != nil || machine == nil {
+					log.Err(err).Msg("failed to fetch machine")
+					return &tailcfg.RegisterResponse{MachineAuthorized: false, Error: "something went wrong"}, nil
+				}
+
 				return &tailcfg.RegisterResponse{
-					MachineAuthorized: len(rr.Error) == 0,
-					Error:             rr.Error,
+					MachineAuthorized: machine.Authorized,
 					User: tailcfg.User{
 						ID:          tailcfg.UserID(rr.User.ID),
 						LoginName:   rr.User.Name,
@@ -198,7 +456,13 @@ func followup(ctx context.Context, conn *sqlite.Conn, peer key.MachinePublic, fl
 			}
 
 		case <-ctx.Done():
-			log.Debug().Err(ctx.Err()).Msg("context expired")
+			log.Debug().Err(ctx.Err()).Msg("context expired; marking flow as abandoned")
+
+			conn.SetInterrupt(nil) // the connection is interrupted along with ctx; it's reset when returned to the pool anyway
+			if _, err := database.Exec(conn, domain.AbandonRegistrationRequest(flow)); err != nil {
+				log.Error().Err(err).Msg("failed to abandon registration request")
+			}
+
 			return nil, nil
 		}
 	}
@@ -0,0 +1,148 @@
+package coordinator
+
+import (
+	"context"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"testing"
+	"time"
+)
+
+func TestRegisterWithAuthKey(t *testing.T) {
+	var conn = fixture(t)
+
+	// generate creates a new auth key, owned by bob, in the fixture's tailnet
+	var generate = func(t *testing.T, k domain.AuthKey) string {
+		t.Helper()
+
+		secret, ak := domain.GenerateAuthKey()
+		k.Prefix, k.Hash, k.TailnetID, k.UserID = ak.Prefix, ak.Hash, 1, 2
+		if _, err := database.FetchOne(conn, domain.CreateAuthKey(&k)); err != nil {
+			t.Fatalf("failed to create auth key: %v", err)
+		}
+
+		return secret
+	}
+
+	// register registers a new machine using the given auth key
+	var register = func(t *testing.T, authKey, hostname string) (key.MachinePublic, *tailcfg.RegisterResponse) {
+		t.Helper()
+
+		var peer = key.NewMachine().Public()
+		var req = tailcfg.RegisterRequest{
+			Version:  tailcfg.CurrentCapabilityVersion,
+			NodeKey:  key.NewNode().Public(),
+			Hostinfo: &tailcfg.Hostinfo{Hostname: hostname},
+			Auth:     &tailcfg.RegisterResponseAuth{AuthKey: authKey},
+		}
+
+		resp, err := registerWithAuthKey(context.Background(), conn, peer, Remote{}, nil, req)
+		if err != nil {
+			t.Fatalf("failed to register machine: %v", err)
+		}
+
+		return peer, resp
+	}
+
+	// registered returns the machine registered by the peer; nil if there's none
+	var registered = func(t *testing.T, peer key.MachinePublic) *domain.Machine {
+		t.Helper()
+
+		m, err := database.FetchOne(conn, domain.GetMachineByKey(peer))
+		if err != nil {
+			t.Fatalf("failed to fetch machine: %v", err)
+		}
+
+		return m
+	}
+
+	t.Run("Register", func(t *testing.T) {
+		var authKey = generate(t, domain.AuthKey{})
+
+		peer, resp := register(t, authKey, "delta")
+		if resp.Error != "" || !resp.MachineAuthorized || resp.User.ID != 2 {
+			t.Fatalf("expected authorized machine owned by bob; got %+v", resp)
+		}
+
+		if m := registered(t, peer); m == nil || m.Name != "delta" || m.TailnetID != 1 {
+			t.Errorf("expected machine registered in tailnet; got %+v", m)
+		}
+
+		if _, resp = register(t, authKey, "echo"); resp.Error != InvalidAuthKeyMessage {
+			t.Errorf("expected single-use key to be rejected once used; got %+v", resp)
+		}
+	})
+
+	t.Run("Reusable", func(t *testing.T) {
+		var authKey = generate(t, domain.AuthKey{Reusable: true, Ephemeral: true})
+
+		for _, hostname := range []string{"foxtrot", "golf"} {
+			peer, resp := register(t, authKey, hostname)
+			if resp.Error != "" {
+				t.Fatalf("expected reusable key to register %s; got %q", hostname, resp.Error)
+			}
+
+			if m := registered(t, peer); m == nil || !m.Ephemeral {
+				t.Errorf("expected ephemeral machine, as per the key; got %+v", m)
+			}
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		var authKey = generate(t, domain.AuthKey{Reusable: true})
+		var prefix, _, _ = domain.ParseAuthKey(authKey)
+
+		var expired = time.Now().Add(-time.Hour)
+		var cases = map[string]string{
+			"Malformed": "not-a-key",
+			"Unknown":   "wfkey-000000000000-secret",
+			"Secret":    "wfkey-" + prefix + "-secret",
+			"Expired":   generate(t, domain.AuthKey{ExpiresAt: &expired}),
+		}
+
+		for name, authKey := range cases {
+			t.Run(name, func(t *testing.T) {
+				if peer, resp := register(t, authKey, "hotel"); resp.Error != InvalidAuthKeyMessage {
+					t.Errorf("expected key to be rejected; got %+v", resp)
+				} else if registered(t, peer) != nil {
+					t.Errorf("expected no machine registered with rejected key")
+				}
+			})
+		}
+
+		exec(t, conn, `UPDATE auth_keys SET revoked_at = '2024-01-01T00:00:00Z' WHERE prefix = '`+prefix+`'`)
+		if _, resp := register(t, authKey, "india"); resp.Error != InvalidAuthKeyMessage {
+			t.Errorf("expected revoked key to be rejected; got %+v", resp)
+		}
+	})
+
+	t.Run("Approval", func(t *testing.T) {
+		exec(t, conn, `UPDATE tailnets SET require_approval = true WHERE id = 1`)
+		t.Cleanup(func() { exec(t, conn, `UPDATE tailnets SET require_approval = false WHERE id = 1`) })
+
+		peer, resp := register(t, generate(t, domain.AuthKey{}), "juliett")
+		if resp.Error != "" || resp.MachineAuthorized {
+			t.Fatalf("expected machine pending approval; got %+v", resp)
+		}
+
+		var m = registered(t, peer)
+		if pending, err := mapper(nil, latest)(context.Background(), conn, m); err != nil {
+			t.Fatalf("failed to generate map response: %v", err)
+		} else if len(pending.Peers) != 0 {
+			t.Errorf("expected machine pending approval to see no peers; got %d", len(pending.Peers))
+		}
+
+		// an admin approves the machine; see api.AuthorizeMachine
+		if _, err := database.Exec(conn, domain.SetMachineAuthorized(m, true)); err != nil {
+			t.Fatalf("failed to approve machine: %v", err)
+		}
+
+		if approved, err := mapper(nil, latest)(context.Background(), conn, registered(t, peer)); err != nil {
+			t.Fatalf("failed to generate map response: %v", err)
+		} else if len(approved.Peers) == 0 {
+			t.Errorf("expected approved machine to see its peers")
+		}
+	})
+}
@@ -0,0 +1,151 @@
+package coordinator
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"net/netip"
+	"slices"
+	"strings"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+// SyncRoutes records the subnet routes advertised by the machine (in Hostinfo.RoutableIPs), approving the ones
+// permitted by the autoApprovers section of the tailnet's acl policy, and removes routes that are no longer advertised.
+// An audit event is recorded when the machine advertises routes it didn't before.
+func SyncRoutes(conn *sqlite.Conn, m *domain.Machine) (err error) {
+	var advertised []netip.Prefix
+	if m.HostInfo != nil {
+		advertised = m.HostInfo.RoutableIPs
+	}
+
+	var addrs []*netip.Addr
+	var known []*domain.Route
+	if len(advertised) > 0 {
+		if addrs, err = database.FetchMany(conn, domain.ListTailnetAddrs(m.Tailnet)); err != nil {
+			return err
+		}
+
+		if known, err = database.FetchMany(conn, domain.ListRoutes(m)); err != nil {
+			return err
+		}
+	}
+
+	// routes overlapping the tailnet's own addresses are recorded, but never approved automatically
+	var routes = make(map[netip.Prefix]bool, len(advertised))
+	for _, route := range advertised {
+		_, overlaps := overlapping(route.Masked(), addrs)
+		routes[route.Masked()] = !overlaps && m.Tailnet.CanAutoApprove(m, route.Masked())
+	}
+
+	if _, err = database.Exec(conn, domain.RemoveStaleRoutes(m, advertised)); err != nil {
+		return err
+	}
+
+	if _, err = database.Exec(conn, domain.AdvertiseRoutes(m, routes)); err != nil {
+		return err
+	}
+
+	var added []string
+	for route := range routes {
+		if !slices.ContainsFunc(known, func(r *domain.Route) bool { return r.Prefix == route }) {
+			added = append(added, route.String())
+		}
+	}
+
+	if len(added) > 0 {
+		slices.Sort(added)
+		event := &domain.AuditEvent{Action: domain.ActionMachineRoutesAdvertised, Actor: m.CompleteName(), Target: m.CompleteName(), TailnetID: util.ToPtr(m.TailnetID), Data: map[string]string{"routes": strings.Join(added, ",")}}
+		_, err = database.Exec(conn, domain.RecordEvent(event))
+	}
+
+	return err
+}
+
+// ReapproveRoutes re-evaluates the routes advertised by all machines in the tailnet against the autoApprovers section of
+// its acl policy. It's used when the policy changes, so that routes permitted by the new policy are approved without
+// having to wait for the advertising machines to report their host info again. Routes are never un-approved.
+func ReapproveRoutes(conn *sqlite.Conn, tailnet *domain.Tailnet) (err error) {
+	var machines []*domain.Machine
+	if machines, err = database.FetchMany(conn, domain.ListMachines(tailnet)); err != nil {
+		return err
+	}
+
+	for _, m := range machines {
+		if m.HostInfo == nil || len(m.HostInfo.RoutableIPs) == 0 {
+			continue
+		}
+
+		if err = SyncRoutes(conn, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckRouteOverlap returns the address of a machine in the tailnet, of either family, that is contained in the route.
+// Such a route must not be approved, as peers would then send traffic meant for the machine to the subnet router instead.
+// Exit routes contain every address, but are only used for traffic that doesn't match a more specific route, and never overlap.
+func CheckRouteOverlap(conn *sqlite.Conn, tailnet *domain.Tailnet, route netip.Prefix) (_ netip.Addr, _ bool, err error) {
+	var addrs []*netip.Addr
+	if addrs, err = database.FetchMany(conn, domain.ListTailnetAddrs(tailnet)); err != nil {
+		return netip.Addr{}, false, err
+	}
+
+	addr, ok := overlapping(route, addrs)
+	return addr, ok, nil
+}
+
+// overlapping returns the first of addrs contained in the (non-exit) route
+func overlapping(route netip.Prefix, addrs []*netip.Addr) (netip.Addr, bool) {
+	if tsaddr.IsExitRoute(route) {
+		return netip.Addr{}, false
+	}
+
+	for _, addr := range addrs {
+		if route.Contains(*addr) {
+			return *addr, true
+		}
+	}
+
+	return netip.Addr{}, false
+}
+
+// primaryRoutes elects a primary machine for each approved subnet route in the tailnet. When more than one machine
+// advertises the same route, the one with the lowest id is elected, so that peers agree on where to send the traffic.
+//
+// Exit routes (0.0.0.0/0 and ::/0) are not subnet routes, and are never elected.
+func primaryRoutes(machines []*domain.Machine) map[netip.Prefix]int {
+	var primaries = make(map[netip.Prefix]int)
+	for _, m := range machines {
+		if m.IsHidden() {
+			continue
+		}
+
+		for _, route := range m.ApprovedRoutes {
+			if tsaddr.IsExitRoute(route) {
+				continue
+			}
+
+			if id, ok := primaries[route]; !ok || m.ID < id {
+				primaries[route] = m.ID
+			}
+		}
+	}
+
+	return primaries
+}
+
+// applyPrimaryRoutes removes subnet routes that the node is not the primary for from its AllowedIPs and PrimaryRoutes.
+func applyPrimaryRoutes(node *tailcfg.Node, primaries map[netip.Prefix]int) {
+	var secondary = func(p netip.Prefix) bool {
+		id, ok := primaries[p]
+		return ok && id != int(node.ID)
+	}
+
+	node.AllowedIPs = slices.DeleteFunc(node.AllowedIPs, secondary)
+	node.PrimaryRoutes = slices.DeleteFunc(node.PrimaryRoutes, secondary)
+}
@@ -0,0 +1,174 @@
+package coordinator
+
+import (
+	"bytes"
+	"context"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"tailscale.com/tailcfg"
+	"time"
+)
+
+// slots is the number of phases each interval is divided into by the scheduler
+const slots = 16
+
+// tick is the set of signals delivered to a session by the scheduler
+type tick struct {
+	keepAlive chan struct{} // signalled every KeepAliveInterval
+	sync      chan struct{} // signalled every SyncInterval
+	slot      int           // phase of the intervals at which the session is signalled
+}
+
+// scheduler drives the keep-alive and sync timing of all streaming sessions from a single pair of tickers,
+// rather than each session running its own, so that the number of timers (and their goroutines) doesn't grow with connected clients.
+//
+// Each interval is divided into slots phases, and every session is assigned one of them at random when it registers. The
+// tickers fire once per phase, signalling only the sessions in it, so that the sync work (database reads and map responses)
+// of all sessions is spread over the interval, rather than done all at once.
+//
+// Signals are delivered on buffered channels with a capacity of one, and are dropped if the session hasn't
+// consumed the previous one yet; a slow session only ever misses ticks, it never holds up others.
+type scheduler struct {
+	mu       sync.Mutex
+	sessions [slots]map[*tick]struct{} // registered sessions, by slot
+	start    sync.Once
+
+	drain    chan struct{} // closed when the server begins to shut down, see Drain
+	draining sync.Once
+}
+
+// sessions is the scheduler shared by all streaming sessions
+var sessions = newScheduler()
+
+func newScheduler() *scheduler {
+	var s = &scheduler{drain: make(chan struct{})}
+	for i := range s.sessions {
+		s.sessions[i] = make(map[*tick]struct{})
+	}
+	return s
+}
+
+// Drain signals all streaming sessions to send a final keep-alive and terminate, and waits until they have,
+// or until ctx is done. Sessions started after Drain is called terminate right away.
+//
+// Streaming sessions are served over hijacked (Noise) connections, which http.Server.Shutdown doesn't track,
+// and so Drain must be called before shutting down the http server for the sessions to end gracefully.
+func Drain(ctx context.Context) error {
+	sessions.draining.Do(func() { close(sessions.drain) })
+
+	var poll = time.NewTicker(50 * time.Millisecond)
+	defer poll.Stop()
+
+	for {
+		if sessions.count() == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-poll.C:
+		}
+	}
+}
+
+// count returns the number of registered sessions
+func (s *scheduler) count() (n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, slot := range s.sessions {
+		n += len(slot)
+	}
+	return n
+}
+
+// register adds a new session to the scheduler, returning its tick channels, and a function to remove it when the session ends.
+func (s *scheduler) register() (*tick, func()) {
+	s.start.Do(func() { go s.run() })
+
+	var t = &tick{keepAlive: make(chan struct{}, 1), sync: make(chan struct{}, 1), slot: rand.IntN(slots)}
+
+	s.mu.Lock()
+	s.sessions[t.slot][t] = struct{}{}
+	s.mu.Unlock()
+
+	return t, func() {
+		s.mu.Lock()
+		delete(s.sessions[t.slot], t)
+		s.mu.Unlock()
+	}
+}
+
+// phase returns the duration of a single phase of the interval
+func phase(interval time.Duration) time.Duration { return max(interval/slots, time.Millisecond) }
+
+// run fans out ticks to the registered sessions, one phase at a time. It picks up changes to the interval settings at runtime, and runs for the lifetime of the process.
+func (s *scheduler) run() {
+	var keepAlive = time.NewTicker(phase(time.Duration(KeepAliveInterval.Get())))
+	defer keepAlive.Stop()
+
+	var sync = time.NewTicker(phase(time.Duration(SyncInterval.Get())))
+	defer sync.Stop()
+
+	changes, unwatch := settings.Watch(SyncInterval.Name, KeepAliveInterval.Name)
+	defer unwatch()
+
+	var keepAliveSlot, syncSlot int
+	for {
+		select {
+		case <-keepAlive.C:
+			s.broadcast(keepAliveSlot, func(t *tick) chan struct{} { return t.keepAlive })
+			keepAliveSlot = (keepAliveSlot + 1) % slots
+
+		case <-sync.C:
+			s.broadcast(syncSlot, func(t *tick) chan struct{} { return t.sync })
+			syncSlot = (syncSlot + 1) % slots
+
+		case <-changes:
+			sync.Reset(phase(time.Duration(SyncInterval.Get())))
+			keepAlive.Reset(phase(time.Duration(KeepAliveInterval.Get())))
+		}
+	}
+}
+
+// broadcast signals the channel selected by ch on every registered session in the given slot, without blocking
+func (s *scheduler) broadcast(slot int, ch func(*tick) chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for t := range s.sessions[slot] {
+		select {
+		case ch(t) <- struct{}{}:
+		default: // session hasn't consumed the previous tick yet
+		}
+	}
+}
+
+// lastSeenInterval is how often, at most, a streaming session refreshes its machine's LastSeen, on keep-alive ticks.
+// It only needs to be well below the HideOfflineAfter policy's granularity of a day.
+const lastSeenInterval = 5 * time.Minute
+
+// keepAliveMessage is the sentinel sent by a session to its writer to request a keep-alive message.
+// The writer recognises it by identity and writes the pre-encoded frame instead of encoding it afresh.
+var keepAliveMessage = &tailcfg.MapResponse{KeepAlive: true}
+
+// keepAliveFrames holds the framed keep-alive message for each supported encoding, encoded once at startup
+// so that the (by far most frequent) keep-alive write doesn't allocate.
+var keepAliveFrames = struct{ json, zstd []byte }{
+	json: mustFrame(util.Json[WireMapResponse]),
+	zstd: mustFrame(util.Zstd[WireMapResponse]),
+}
+
+// mustFrame returns keepAliveMessage framed using encoder
+func mustFrame(encoder func(*WireMapResponse, io.Writer) error) []byte {
+	var buf bytes.Buffer
+	if err := frame(&buf, encoder, Wire(keepAliveMessage)); err != nil {
+		panic(err)
+	}
+
+	return buf.Bytes()
+}
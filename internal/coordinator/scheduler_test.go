@@ -0,0 +1,48 @@
+package coordinator
+
+import (
+	"testing"
+)
+
+func TestScheduler_Staggered(t *testing.T) {
+	var s = newScheduler()
+	s.start.Do(func() {}) // ticks are broadcast by the test, rather than by run
+
+	var ticks []*tick
+	for range 64 {
+		t, unregister := s.register()
+		defer unregister()
+		ticks = append(ticks, t)
+	}
+
+	var used = make(map[int]bool)
+	for _, t := range ticks {
+		used[t.slot] = true
+	}
+
+	if len(used) < 2 {
+		t.Errorf("expected sessions to be spread over slots; all are in %v", used)
+	}
+
+	var signalled = func(t *tick) bool {
+		select {
+		case <-t.sync:
+			return true
+		default:
+			return false
+		}
+	}
+
+	for slot := range slots {
+		s.broadcast(slot, func(t *tick) chan struct{} { return t.sync })
+		for _, tk := range ticks {
+			if got := signalled(tk); got != (tk.slot == slot) {
+				t.Errorf("slot %d: session in slot %d signalled = %t", slot, tk.slot, got)
+			}
+		}
+	}
+
+	if s.count() != len(ticks) {
+		t.Errorf("expected %d sessions; got %d", len(ticks), s.count())
+	}
+}
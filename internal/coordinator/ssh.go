@@ -0,0 +1,337 @@
+package coordinator
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/tacl"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/rs/zerolog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/util/rands"
+	"time"
+)
+
+// Bounds of the check period of ssh rules with the check action, as accepted by tailscale
+const (
+	DefaultCheckPeriod = 12 * time.Hour
+	MinCheckPeriod     = time.Minute
+	MaxCheckPeriod     = 7 * 24 * time.Hour
+)
+
+// sshCheckTimeout is the duration for which a connection is held, waiting for the user to re-authenticate
+const sshCheckTimeout = 10 * time.Minute
+
+// sshRule is the subset of an ssh rule, of the acl policy, used to build its action
+type sshRule struct {
+	Action      string          `json:"action"`
+	CheckPeriod json.RawMessage `json:"checkPeriod"`
+}
+
+// checkPeriod returns the rule's check period; zero if every connection must be checked (ie. checkPeriod is always)
+func (r *sshRule) checkPeriod() time.Duration {
+	var period = DefaultCheckPeriod
+
+	var s string
+	if err := json.Unmarshal(r.CheckPeriod, &s); err == nil {
+		if strings.EqualFold(s, "always") {
+			return 0
+		} else if d, err := time.ParseDuration(s); err == nil {
+			period = d
+		}
+	} else if err = json.Unmarshal(r.CheckPeriod, &period); err != nil {
+		period = DefaultCheckPeriod
+	}
+
+	return min(max(period, MinCheckPeriod), MaxCheckPeriod)
+}
+
+// sshAction returns the function used to build the action of the machine's ssh rules. Rules with the check action
+// hold connections, and delegate the decision to the MachineSSHAction endpoint, which has the user re-authenticate.
+func sshAction(base *url.URL) func(*tacl.SshRuleConfig) *tailcfg.SSHAction {
+	return func(rc *tacl.SshRuleConfig) *tailcfg.SSHAction {
+		var rule sshRule
+		if buf, err := json.Marshal(rc); err == nil {
+			_ = json.Unmarshal(buf, &rule)
+		}
+
+		if !strings.EqualFold(rule.Action, "check") {
+			return &tailcfg.SSHAction{Accept: true}
+		}
+
+		// the variables are expanded by the client; they mustn't be escaped
+		var delegate = base.JoinPath("/machine/ssh/action/from/$SRC_NODE_ID/to/$DST_NODE_ID").String() +
+			"?ssh_user=$SSH_USER&local_user=$LOCAL_USER&check_period=" + strconv.Itoa(int(rule.checkPeriod().Seconds()))
+
+		return &tailcfg.SSHAction{HoldAndDelegate: delegate}
+	}
+}
+
+// AuthorizedPrincipals returns the principals that may log in to the machine as the local user, as per the ssh rules
+// of its tailnet's policy, for use by hosts that enforce the policy using OpenSSH's sshd rather than tailscale ssh
+// (eg. with an AuthorizedPrincipalsCommand). Principals are the login names of the users, and the tags of the tagged
+// machines, that the rules accept connections from; machines is the list of the tailnet's machines.
+//
+// Rules with the check action are left out, as sshd can't have the user re-authenticate; as are rules that accept
+// connections from any machine, as sshd has no wildcard principal.
+func AuthorizedPrincipals(m *domain.Machine, machines []*domain.Machine, localUser string) []string {
+	if m.Tailnet == nil || m.Tailnet.Acl.ACL == nil || !m.Tailnet.Features.SSH {
+		return nil
+	}
+
+	var peers = make([]tacl.Machine, 0, len(machines))
+	for _, machine := range machines {
+		if machine.ID != m.ID && !machine.IsHidden() {
+			peers = append(peers, machine)
+		}
+	}
+
+	return authorizedPrincipals(m.Tailnet.Acl.BuildSSHPolicy(m, peers, sshAction(&url.URL{})), machines, localUser)
+}
+
+func authorizedPrincipals(policy *tailcfg.SSHPolicy, machines []*domain.Machine, localUser string) []string {
+	if policy == nil {
+		return nil
+	}
+
+	var principals []string
+	var add = func(m *domain.Machine) {
+		if len(m.AssignedTags) > 0 {
+			principals = append(principals, m.AssignedTags...)
+		} else if m.Owner != nil {
+			principals = append(principals, m.Owner.LoginName())
+		}
+	}
+
+	for _, rule := range policy.Rules {
+		if rule.Action == nil || !rule.Action.Accept || (rule.RuleExpires != nil && rule.RuleExpires.Before(time.Now())) {
+			continue // rejected, checked or expired
+		}
+
+		// ssh users map the requested user to the local user; sshd always logs in as the requested user
+		local, ok := rule.SSHUsers[localUser]
+		if !ok {
+			local = rule.SSHUsers["*"]
+		}
+
+		if local != "=" && local != localUser {
+			continue
+		}
+
+		for _, p := range rule.Principals {
+			switch {
+			case p.UserLogin != "":
+				principals = append(principals, p.UserLogin)
+			case p.Node != "":
+				if i := slices.IndexFunc(machines, func(m *domain.Machine) bool { return strconv.Itoa(m.ID) == string(p.Node) }); i >= 0 {
+					add(machines[i])
+				}
+			case p.NodeIP != "":
+				if i := slices.IndexFunc(machines, func(m *domain.Machine) bool {
+					v4, v6 := m.IP()
+					return v4.String() == p.NodeIP || v6.String() == p.NodeIP
+				}); i >= 0 {
+					add(machines[i])
+				}
+			}
+		}
+	}
+
+	slices.Sort(principals)
+	return slices.Compact(principals)
+}
+
+// MachineSSHAction handles the /machine/ssh/action endpoint, which the destination machine of an ssh connection calls
+// when the connection matches an ssh rule with the check action (see: sshAction).
+//
+// If the owner of the source machine has re-authenticated within the rule's check period, the connection is accepted
+// right away. Otherwise, a new domain.SSHCheck is created, and the client is asked to show the user a url to re-authenticate
+// at (see: oidc.SSHCheckStart) and to call back, with the check's id, which holds the connection until the check is completed.
+func MachineSSHAction(peer key.MachinePublic, pool *sqlitex.Pool) http.HandlerFunc {
+	cfg := config.MustValidate(config.Read[Config]())
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Logger()
+
+		conn := pool.Get(ctx)
+		defer pool.Put(conn)
+
+		srcID, _ := strconv.Atoi(chi.URLParam(r, "src"))
+		dstID, _ := strconv.Atoi(chi.URLParam(r, "dst"))
+
+		// only the destination machine, that holds the connection, may ask for the action
+		var dst, src *domain.Machine
+		if m, err := database.FetchOne(conn, domain.GetMachineByKey(peer)); err != nil {
+			log.Error().Err(err).Msg("failed to fetch machine")
+			http.Error(w, "failed to fetch machine", http.StatusInternalServerError)
+			return
+		} else if m == nil || m.ID != dstID {
+			http.Error(w, "machine not found", http.StatusForbidden)
+			return
+		} else {
+			dst = m
+		}
+
+		if machines, err := database.FetchMany(conn, domain.ListMachines(dst.Tailnet)); err != nil {
+			log.Error().Err(err).Msg("failed to list machines")
+			http.Error(w, "failed to list machines", http.StatusInternalServerError)
+			return
+		} else {
+			for _, m := range machines {
+				if m.ID == srcID {
+					src = m
+				}
+			}
+		}
+
+		var q = r.URL.Query()
+		var period, _ = strconv.Atoi(q.Get("check_period"))
+
+		var action *tailcfg.SSHAction
+		switch {
+		case src == nil:
+			action = &tailcfg.SSHAction{Reject: true, Message: "source machine not found\n"}
+		case len(src.AssignedTags) > 0:
+			action = &tailcfg.SSHAction{Reject: true, Message: "connections from tagged machines can't be checked, as they have no user to re-authenticate\n"}
+		case q.Get("auth_id") == "":
+			action = startSSHCheck(conn, cfg, r.URL, src, dst, q.Get("local_user"), period)
+		default:
+			action = awaitSSHCheck(ctx, conn, q.Get("auth_id"), src, dst)
+		}
+
+		if action.Reject {
+			log.Info().Int("src", srcID).Str("local_user", q.Get("local_user")).Msg("ssh connection rejected")
+		}
+
+		// only decisions are recorded; not the connection being held for the check to complete
+		if action.Accept || action.Reject {
+			var session = &domain.SSHSession{
+				TailnetID: dst.TailnetID, Event: domain.SSHSessionAccepted, SrcMachineID: srcID, DstMachineID: dst.ID,
+				SSHUser: q.Get("ssh_user"), LocalUser: q.Get("local_user"), Message: strings.TrimSpace(action.Message),
+			}
+			if action.Reject {
+				session.Event = domain.SSHSessionRejected
+			}
+
+			if _, err := database.Exec(conn, domain.RecordSSHSession(session)); err != nil {
+				log.Error().Err(err).Msg("failed to record ssh session")
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(action); err != nil {
+			log.Error().Err(err).Msg("failed to encode response body")
+		}
+	}
+}
+
+// sshEvents maps the ssh events reported by clients to the events recorded
+var sshEvents = map[tailcfg.SSHEventType]string{
+	tailcfg.SSHSessionRecordingRejected:   domain.SSHSessionRecordingRejected,
+	tailcfg.SSHSessionRecordingTerminated: domain.SSHSessionRecordingTerminated,
+	tailcfg.SSHSessionRecordingFailed:     domain.SSHSessionRecordingFailed,
+}
+
+// MachineSSHNotify handles the /machine/ssh/notify endpoint, which the destination machine of an ssh connection calls
+// to report events of the session (eg. its recording failing). Events are recorded as domain.SSHSession, and are listed
+// using the admin api. Clients ignore the response.
+func MachineSSHNotify(peer key.MachinePublic, pool *sqlitex.Pool) util.HandlerFunc[tailcfg.SSHEventNotifyRequest, struct{}] {
+	return func(ctx context.Context, req tailcfg.SSHEventNotifyRequest) (_ *struct{}, err error) {
+		log := zerolog.Ctx(ctx).With().Str("peer", peer.String()).Logger()
+
+		event, ok := sshEvents[req.EventType]
+		if !ok {
+			return nil, errors.Errorf("unknown ssh event type %d", req.EventType)
+		}
+
+		conn := pool.Get(ctx)
+		defer pool.Put(conn)
+
+		var dst *domain.Machine
+		if dst, err = database.FetchOne(conn, domain.GetMachineByKey(peer)); err != nil {
+			return nil, err
+		} else if dst == nil || (!req.NodeKey.IsZero() && dst.NodeKey != req.NodeKey) {
+			return nil, errors.New("machine not found")
+		}
+
+		var session = &domain.SSHSession{
+			TailnetID: dst.TailnetID, Event: event, ConnectionID: req.ConnectionID, SrcMachineID: int(req.SrcNode), DstMachineID: dst.ID,
+			SSHUser: req.SSHUser, LocalUser: req.LocalUser,
+		}
+
+		if _, err = database.Exec(conn, domain.RecordSSHSession(session)); err != nil {
+			return nil, err
+		}
+
+		log.Info().Str("event", event).Str("connection", req.ConnectionID).Int64("src", int64(req.SrcNode)).Msg("ssh session event")
+		return &struct{}{}, nil
+	}
+}
+
+// startSSHCheck accepts the connection if the user has re-authenticated within the check period, or starts a new check
+func startSSHCheck(conn *sqlite.Conn, cfg *Config, self *url.URL, src, dst *domain.Machine, localUser string, period int) *tailcfg.SSHAction {
+	if valid, err := database.FetchOne(conn, domain.FindValidSSHCheck(src.UserID, dst.ID, localUser, time.Now())); err != nil {
+		return &tailcfg.SSHAction{Reject: true, Message: "failed to look up previous checks\n"}
+	} else if valid != nil {
+		return &tailcfg.SSHAction{Accept: true}
+	}
+
+	var check = &domain.SSHCheck{ID: rands.HexString(16), SrcMachineID: src.ID, DstMachineID: dst.ID, UserID: src.UserID, LocalUser: localUser, CheckPeriod: period}
+	if _, err := database.Exec(conn, domain.CreateSSHCheck(check)); err != nil {
+		return &tailcfg.SSHAction{Reject: true, Message: "failed to start the check\n"}
+	}
+
+	var q = self.Query()
+	q.Set("auth_id", check.ID)
+
+	var delegate = cfg.BaseUrl.JoinPath(self.Path)
+	delegate.RawQuery = q.Encode()
+
+	return &tailcfg.SSHAction{
+		Message:         fmt.Sprintf("# This connection requires an additional check.\n# To authenticate, visit: %s\n", cfg.BaseUrl.JoinPath("/ssh/action", check.ID)),
+		HoldAndDelegate: delegate.String(),
+	}
+}
+
+// awaitSSHCheck polls for the check to be authenticated (every 2 seconds), until it is, the client disconnects, or sshCheckTimeout passes
+func awaitSSHCheck(ctx context.Context, conn *sqlite.Conn, id string, src, dst *domain.Machine) *tailcfg.SSHAction {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	timeout := time.NewTimer(sshCheckTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			check, err := database.FetchOne(conn, domain.SSHCheckById(id))
+			if err != nil || check == nil || check.SrcMachineID != src.ID || check.DstMachineID != dst.ID {
+				return &tailcfg.SSHAction{Reject: true, Message: "invalid check\n"}
+			}
+
+			if check.AuthenticatedAt != nil {
+				return &tailcfg.SSHAction{Accept: true}
+			}
+
+		case <-timeout.C:
+			return &tailcfg.SSHAction{Reject: true, Message: "timed out waiting for the check to complete\n"}
+
+		case <-ctx.Done():
+			return &tailcfg.SSHAction{Reject: true}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"net/netip"
+	"slices"
+	"tailscale.com/tailcfg"
+	"testing"
+	"time"
+)
+
+func TestSSHRule_CheckPeriod(t *testing.T) {
+	var cases = []struct {
+		name   string
+		rule   string
+		period time.Duration
+	}{
+		{"Default", `{"action": "check"}`, DefaultCheckPeriod},
+		{"Always", `{"action": "check", "checkPeriod": "always"}`, 0},
+		{"Duration", `{"action": "check", "checkPeriod": "1h30m"}`, 90 * time.Minute},
+		{"TooShort", `{"action": "check", "checkPeriod": "10s"}`, MinCheckPeriod},
+		{"TooLong", `{"action": "check", "checkPeriod": "720h"}`, MaxCheckPeriod},
+		{"Invalid", `{"action": "check", "checkPeriod": "soon"}`, DefaultCheckPeriod},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var rule sshRule
+			if err := json.Unmarshal([]byte(tc.rule), &rule); err != nil {
+				t.Fatalf("failed to parse rule: %v", err)
+			}
+
+			if got := rule.checkPeriod(); got != tc.period {
+				t.Errorf("unexpected check period %s; want %s", got, tc.period)
+			}
+		})
+	}
+}
+
+func TestAuthorizedPrincipals(t *testing.T) {
+	var alice = &domain.Machine{ID: 1, IPv4: netip.MustParseAddr("100.64.0.1"), Owner: &domain.User{Subject: "alice@example.com"}}
+	var ci = &domain.Machine{ID: 2, IPv4: netip.MustParseAddr("100.64.0.2"), Owner: &domain.User{Subject: "bob@example.com"}, AssignedTags: []string{"tag:ci"}}
+	var machines = []*domain.Machine{alice, ci}
+
+	var policy = &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{
+		{ // users and machines accepted as any local user
+			Principals: []*tailcfg.SSHPrincipal{{UserLogin: "carol@example.com"}, {NodeIP: "100.64.0.1"}},
+			SSHUsers:   map[string]string{"*": "=", "root": ""},
+			Action:     &tailcfg.SSHAction{Accept: true},
+		},
+		{ // tagged machines accepted as the deploy user
+			Principals: []*tailcfg.SSHPrincipal{{Node: "2"}},
+			SSHUsers:   map[string]string{"deploy": "deploy"},
+			Action:     &tailcfg.SSHAction{Accept: true},
+		},
+		{ // checked rules can't be enforced by sshd
+			Principals: []*tailcfg.SSHPrincipal{{UserLogin: "dave@example.com"}},
+			SSHUsers:   map[string]string{"root": "root"},
+			Action:     &tailcfg.SSHAction{HoldAndDelegate: "https://example.com/machine/ssh/action"},
+		},
+	}}
+
+	var cases = map[string][]string{
+		"ubuntu": {"alice@example.com", "carol@example.com"},
+		"deploy": {"alice@example.com", "carol@example.com", "tag:ci"},
+		"root":   nil,
+	}
+
+	for user, expected := range cases {
+		if got := authorizedPrincipals(policy, machines, user); !slices.Equal(got, expected) {
+			t.Errorf("%s: unexpected principals %v; want %v", user, got, expected)
+		}
+	}
+}
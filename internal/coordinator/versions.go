@@ -0,0 +1,131 @@
+package coordinator
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"sync"
+	"tailscale.com/metrics"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"time"
+)
+
+// Endpoints that clients present their capability version at
+const (
+	EndpointKey      = "key"
+	EndpointRegister = "register"
+	EndpointMap      = "map"
+)
+
+// VersionLabel labels a metric with the endpoint, and the capability version the client presented at it
+type VersionLabel struct {
+	Endpoint string `prom:"endpoint"`
+	Version  string `prom:"version"`
+}
+
+// ClientVersions is the number of requests received from clients, by endpoint and capability version
+var ClientVersions = metrics.NewMultiLabelMap[VersionLabel]("wirefire_client_requests_total", "counter", "number of requests received from clients, by endpoint and capability version")
+
+// ConnectedClients is the number of clients with an open map session, by capability version
+var ConnectedClients = metrics.NewMultiLabelMap[ConnectedLabel]("wirefire_clients_connected", "gauge", "number of clients with an open map session, by capability version")
+
+// ConnectedLabel labels a metric with the capability version presented by connected clients
+type ConnectedLabel struct {
+	Version string `prom:"version"`
+}
+
+// VersionStatus is the usage of a single capability version, since the server started
+type VersionStatus struct {
+	Version   tailcfg.CapabilityVersion `json:"version"`
+	Machines  int                       `json:"machines"`  // number of machines whose latest request presented this version
+	Connected int                       `json:"connected"` // number of machines with an open map session, presenting this version
+	Requests  map[string]int64          `json:"requests"`  // number of requests that presented this version, by endpoint
+	LastSeen  time.Time                 `json:"last_seen"`
+}
+
+// VersionReport is the distribution of capability versions presented by clients since the server started. It's used to
+// tell when it's safe to raise SupportedCapabilityVersion, ie. once no machine presents a version older than the new one.
+type VersionReport struct {
+	Supported tailcfg.CapabilityVersion `json:"supported"` // oldest version supported by the server
+	Current   tailcfg.CapabilityVersion `json:"current"`   // newest version known to the server
+	Versions  []VersionStatus           `json:"versions"`  // ordered oldest first
+}
+
+// versions aggregates the capability versions presented by clients, in memory
+var versions = struct {
+	sync.Mutex
+	machines  map[key.MachinePublic]tailcfg.CapabilityVersion // latest version presented by each machine
+	connected map[tailcfg.CapabilityVersion]int               // number of open map sessions, by version
+	status    map[tailcfg.CapabilityVersion]*VersionStatus
+}{
+	machines:  make(map[key.MachinePublic]tailcfg.CapabilityVersion),
+	connected: make(map[tailcfg.CapabilityVersion]int),
+	status:    make(map[tailcfg.CapabilityVersion]*VersionStatus),
+}
+
+// RecordVersion records the capability version presented by the client at the endpoint. The peer is zero for requests
+// made outside the Noise channel (ie. to /key), which count towards the version's requests but not its machines.
+func RecordVersion(endpoint string, peer key.MachinePublic, version tailcfg.CapabilityVersion) {
+	ClientVersions.Add(VersionLabel{Endpoint: endpoint, Version: strconv.Itoa(int(version))}, 1)
+
+	versions.Lock()
+	defer versions.Unlock()
+
+	var status, ok = versions.status[version]
+	if !ok {
+		status = &VersionStatus{Version: version, Requests: make(map[string]int64)}
+		versions.status[version] = status
+	}
+
+	status.Requests[endpoint]++
+	status.LastSeen = time.Now().UTC()
+
+	if !peer.IsZero() {
+		versions.machines[peer] = version
+	}
+}
+
+// RecordConnected records a map session opened by a client presenting the version. It returns a function that
+// must be called once the session has been closed.
+func RecordConnected(version tailcfg.CapabilityVersion) (closed func()) {
+	var label = ConnectedLabel{Version: strconv.Itoa(int(version))}
+	ConnectedClients.Add(label, 1)
+
+	versions.Lock()
+	versions.connected[version]++
+	versions.Unlock()
+
+	return func() {
+		ConnectedClients.Add(label, -1)
+
+		versions.Lock()
+		versions.connected[version]--
+		versions.Unlock()
+	}
+}
+
+// Versions returns the report of the capability versions presented by clients since the server started
+func Versions() *VersionReport {
+	versions.Lock()
+	defer versions.Unlock()
+
+	var machines = make(map[tailcfg.CapabilityVersion]int)
+	for _, version := range versions.machines {
+		machines[version]++
+	}
+
+	var report = &VersionReport{Supported: SupportedCapabilityVersion, Current: tailcfg.CurrentCapabilityVersion}
+	for version, status := range versions.status {
+		var s = *status
+		s.Machines, s.Connected, s.Requests = machines[version], versions.connected[version], make(map[string]int64, len(status.Requests))
+		for endpoint, n := range status.Requests {
+			s.Requests[endpoint] = n
+		}
+
+		report.Versions = append(report.Versions, s)
+	}
+
+	slices.SortFunc(report.Versions, func(a, b VersionStatus) int { return cmp.Compare(a.Version, b.Version) })
+	return report
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/tracing"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"sync/atomic"
+	"tailscale.com/metrics"
+	"time"
+	"unicode"
+)
+
+// OperationLabel labels a metric with the sql operation (eg. select, insert) of the queries it counts
+type OperationLabel struct {
+	Operation string `prom:"operation"`
+}
+
+var (
+	// Queries is the number of queries run using FetchOne, FetchMany or Exec, by operation
+	Queries = metrics.NewMultiLabelMap[OperationLabel]("wirefire_database_queries_total", "counter", "number of database queries run, by operation")
+
+	// QueryErrors is the number of queries that failed, by operation
+	QueryErrors = metrics.NewMultiLabelMap[OperationLabel]("wirefire_database_query_errors_total", "counter", "number of database queries that failed, by operation")
+
+	// QueryDuration is the total time spent running queries, by operation
+	QueryDuration = metrics.NewMultiLabelMap[OperationLabel]("wirefire_database_query_duration_seconds_total", "counter", "total time spent running database queries, by operation")
+
+	// SlowQueries is the number of queries that took longer than the slow query threshold, by operation
+	SlowQueries = metrics.NewMultiLabelMap[OperationLabel]("wirefire_database_slow_queries_total", "counter", "number of database queries slower than database.slow_query_threshold, by operation")
+)
+
+// tracer starts the spans of database queries
+var tracer = otel.Tracer("github.com/riyaz-ali/wirefire/internal/database")
+
+// slowQueryThreshold is the duration after which queries are logged as slow; zero if slow queries aren't logged
+var slowQueryThreshold atomic.Int64
+
+// SetSlowQueryThreshold sets the duration after which queries are logged (at warn level) as slow. Slow queries are not
+// logged if d is zero.
+func SetSlowQueryThreshold(d time.Duration) { slowQueryThreshold.Store(int64(d)) }
+
+// instrument times the query, and starts a span for it, as a child of the span bound to the connection (see: tracing.Bind),
+// if any. The returned function records the query's duration and the error it failed with, if any, in the query metrics,
+// logs the query if it was slow, and ends the span.
+func instrument(conn *sqlite.Conn, query string, rows int) func(*error) {
+	var start, label = time.Now(), OperationLabel{Operation: operation(query)}
+
+	var span trace.Span
+	if ctx := tracing.Bound(conn); ctx != nil {
+		_, span = tracer.Start(ctx, "database."+label.Operation, trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String("db.system", "sqlite"), attribute.String("db.statement", statement(query))))
+		if rows > 0 {
+			span.SetAttributes(attribute.Int("db.batch_size", rows))
+		}
+	}
+
+	return func(err *error) {
+		var elapsed = time.Since(start)
+
+		Queries.Add(label, 1)
+		QueryDuration.AddFloat(label, elapsed.Seconds())
+		if *err != nil {
+			QueryErrors.Add(label, 1)
+		}
+
+		if threshold := time.Duration(slowQueryThreshold.Load()); threshold > 0 && elapsed >= threshold {
+			SlowQueries.Add(label, 1)
+
+			var event = log.Warn().Str("statement", statement(query)).Dur("duration", elapsed).AnErr("error", *err)
+			if rows > 0 {
+				event = event.Int("batch_size", rows)
+			}
+			event.Msg("slow database query")
+		}
+
+		if span != nil {
+			if *err != nil {
+				span.RecordError(*err)
+				span.SetStatus(codes.Error, (*err).Error())
+			}
+			span.End()
+		}
+	}
+}
+
+// operation returns the (lowercase) sql operation of the query, ie. its first keyword
+func operation(query string) string {
+	var op = strings.TrimLeftFunc(query, unicode.IsSpace)
+	if i := strings.IndexFunc(op, unicode.IsSpace); i >= 0 {
+		op = op[:i]
+	}
+	return strings.ToLower(op)
+}
+
+// statement returns the query on a single line, with runs of whitespace collapsed
+func statement(query string) string { return strings.Join(strings.Fields(query), " ") }
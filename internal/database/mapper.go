@@ -9,42 +9,56 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// ScanAs scans and return the value T from the given sqlite.Stmt, using reflection for mapping.
-func ScanAs[T any](stmt *sqlite.Stmt) (*T, error) {
-	type FieldInfo struct {
-		Field reflect.Value
-		Json  bool
+// field describes the struct field a column is scanned into
+type field struct {
+	Index int  // index of the field in the struct
+	Json  bool // is the column value json-encoded?
+}
+
+// fields caches the column name to field mapping of struct types scanned using ScanAs, keyed by reflect.Type.
+// The mapping is computed once per type, rather than for every row scanned.
+var fields sync.Map
+
+// fieldsOf returns the column name to field mapping for the given struct type
+func fieldsOf(typ reflect.Type) map[string]field {
+	if cached, ok := fields.Load(typ); ok {
+		return cached.(map[string]field)
 	}
 
-	var dest T
-	var fields = make(map[string]FieldInfo)
-	for i, val := 0, reflect.ValueOf(&dest).Elem(); i < val.NumField(); i++ {
-		name := val.Type().Field(i).Name
-		if tag, exists := val.Type().Field(i).Tag.Lookup("db"); exists {
+	var mapping = make(map[string]field, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		name := typ.Field(i).Name
+		if tag, exists := typ.Field(i).Tag.Lookup("db"); exists {
 			if tag != "-" {
 				parts := strings.SplitN(tag, ",", 2)
-				name = parts[0]
-				if len(parts) > 1 {
-					fields[name] = FieldInfo{Field: val.Field(i), Json: parts[1] == "json"}
-				} else {
-					fields[name] = FieldInfo{Field: val.Field(i)}
-				}
+				mapping[parts[0]] = field{Index: i, Json: len(parts) > 1 && parts[1] == "json"}
 			}
 		} else {
-			fields[name] = FieldInfo{Field: val.Field(i)}
+			mapping[name] = field{Index: i}
 		}
 	}
 
+	cached, _ := fields.LoadOrStore(typ, mapping)
+	return cached.(map[string]field)
+}
+
+// ScanAs scans and return the value T from the given sqlite.Stmt, using reflection for mapping.
+func ScanAs[T any](stmt *sqlite.Stmt) (*T, error) {
+	var dest T
+	var val = reflect.ValueOf(&dest).Elem()
+	var mapping = fieldsOf(val.Type())
+
 	for i := 0; i < stmt.ColumnCount(); i++ {
-		field := fields[stmt.ColumnName(i)]
-		if !field.Field.IsValid() {
+		f, ok := mapping[stmt.ColumnName(i)]
+		if !ok {
 			return nil, fmt.Errorf("no field found for %q", stmt.ColumnName(i))
 		}
 
-		if err := scan(stmt, i, field.Field, field.Json); err != nil {
+		if err := scan(stmt, i, val.Field(f.Index), f.Json); err != nil {
 			return nil, err
 		}
 	}
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/database/schema"
+	"github.com/riyaz-ali/wirefire/internal/domain"
 	"github.com/riyaz-ali/wirefire/internal/util"
 	"net/url"
 	"testing"
@@ -339,3 +341,39 @@ func TestScanAs_Alias(t *testing.T) {
 		t.Fatalf("invalid value: %v", res)
 	}
 }
+
+// BenchmarkScanAs_ListMachines measures the cost of scanning a tailnet's machines, which happens
+// for every map response sent to every connected client.
+func BenchmarkScanAs_ListMachines(b *testing.B) {
+	var conn = util.Must(sqlite.OpenConn("file::memory:?mode=memory", 0))
+	defer conn.Close()
+
+	if err := schema.Apply(conn); err != nil {
+		b.Fatalf("failed to apply schema: %v", err)
+	}
+
+	const seed = `
+		INSERT INTO tailnets (id, name) VALUES (1, 'example.com');
+		INSERT INTO users (id, claims) VALUES (1, '{"sub":"alice@example.com","name":"Alice"}');
+		INSERT INTO tailnet_members (tailnet_id, user_id, role) VALUES (1, 1, 'admin');
+
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 250)
+		INSERT INTO machines (name, noise_key, node_key, disco_key, host_info, endpoints, ipv4, expires_at, tailnet_id, user_id)
+		SELECT 'machine-' || i, printf('mkey:%064x', i), printf('nodekey:%064x', i), printf('discokey:%064x', i),
+		       '{"Hostname":"machine","OS":"linux"}', '[{"Addr":"192.0.2.1:41641","Type":2}]', '100.64.' || (i / 256) || '.' || (i % 256), '2099-01-01T00:00:00Z', 1, 1
+		FROM n;
+	`
+
+	if err := sqlitex.ExecScript(conn, seed); err != nil {
+		b.Fatalf("failed to seed database: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := database.FetchMany(conn, domain.ListMachines(&domain.Tailnet{ID: 1})); err != nil {
+			b.Fatalf("failed to list machines: %v", err)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package database
 import (
 	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
+	"github.com/pkg/errors"
+	"strings"
 )
 
 // EmptyResponse is a placeholder type that can be used Q and I to indicate queries
@@ -11,23 +13,27 @@ type EmptyResponse struct{}
 
 // Q represents a sqlite query that returns one or more instances of M when executed
 type Q[M any] struct {
-	// QueryStr is the sql query used to create a prepared statement
+	// QueryStr is the sql query used to create a prepared statement. The statement is cached on the connection,
+	// like those of I (see: Exec); QueryStr must therefore be one of a fixed set of strings, and never carry any values inline.
 	QueryStr string
 
 	// Bind is used to bind any variables to the given statement
 	Bind func(stmt *sqlite.Stmt) error
 
-	// Val is used to extract values from the statement and create a new instance of M
+	// Val is used to extract values from the statement and create a new instance of M. As the statement is shared,
+	// Val must not run the same query again, on the same connection.
 	Val func(stmt *sqlite.Stmt) (*M, error)
 }
 
 // FetchMany runs the given query and returns a slice of zero or more instances of M
 func FetchMany[M any](conn *sqlite.Conn, query Q[M]) (_ []*M, err error) {
+	defer instrument(conn, query.QueryStr, 0)(&err)
+
 	var stmt *sqlite.Stmt
-	if stmt, _, err = conn.PrepareTransient(query.QueryStr); err != nil {
+	if stmt, err = conn.Prepare(query.QueryStr); err != nil {
 		return nil, err
 	}
-	defer finalize(stmt, &err) // always finalize to prevent resource leaks
+	defer reset(stmt, &err) // always reset, so that the cached statement doesn't hold on to locks
 
 	if stmt.BindParamCount() > 0 {
 		if err = query.Bind(stmt); err != nil { // bind all variables to the statement
@@ -49,11 +55,13 @@ func FetchMany[M any](conn *sqlite.Conn, query Q[M]) (_ []*M, err error) {
 
 // FetchOne runs the given query and returns either nil or a single instance of M
 func FetchOne[M any](conn *sqlite.Conn, query Q[M]) (_ *M, err error) {
+	defer instrument(conn, query.QueryStr, 0)(&err)
+
 	var stmt *sqlite.Stmt
-	if stmt, _, err = conn.PrepareTransient(query.QueryStr); err != nil {
+	if stmt, err = conn.Prepare(query.QueryStr); err != nil {
 		return nil, err
 	}
-	defer finalize(stmt, &err) // always finalize to prevent resource leaks
+	defer reset(stmt, &err) // always reset, so that the cached statement doesn't hold on to locks
 
 	if stmt.BindParamCount() > 0 {
 		if err = query.Bind(stmt); err != nil { // bind all variables to the statement
@@ -76,6 +84,7 @@ type I[M, A any] struct {
 
 	// ArgSet is a set of values that are inserted / updated / deleted using
 	// a single prepared statement, i.e. the execution of the query is batched together.
+	// Large sets (see: BatchThreshold) are executed within a single savepoint.
 	ArgSet []A
 
 	// Bind is used to bind any variables to the given statement
@@ -86,13 +95,27 @@ type I[M, A any] struct {
 	Val func(stmt *sqlite.Stmt) (*M, error)
 }
 
+// BatchThreshold is the size of the ArgSet at or above which Exec runs the statement within a single savepoint. This makes the
+// batch atomic, and, when the connection isn't already in a transaction, saves sqlite from committing each row separately.
+const BatchThreshold = 16
+
 // Exec executes the given query and returns a slice of zero or more instances of M, if the query return any rows.
+//
+// The prepared statement is cached on the connection (see: sqlite.Conn.Prepare), and reused by later calls with
+// the same QueryStr; QueryStr must therefore be one of a fixed set of strings, and never carry any values inline.
+// Cached statements are finalized when the connection is closed, ie. when its pool is closed.
 func Exec[M, A any](conn *sqlite.Conn, query I[M, A]) (_ []*M, err error) {
+	defer instrument(conn, query.QueryStr, len(query.ArgSet))(&err)
+
+	if len(query.ArgSet) >= BatchThreshold {
+		defer sqlitex.Save(conn)(&err) // rolls back the whole batch if any of the statements fail
+	}
+
 	var stmt *sqlite.Stmt
-	if stmt, _, err = conn.PrepareTransient(query.QueryStr); err != nil {
+	if stmt, err = conn.Prepare(query.QueryStr); err != nil {
 		return nil, err
 	}
-	defer finalize(stmt, &err) // always finalize to prevent resource leaks
+	defer reset(stmt, &err) // always reset, so that the cached statement doesn't hold on to locks
 
 	var result, has = make([]*M, 0), false
 	for _, arg := range query.ArgSet {
@@ -126,8 +149,53 @@ func Tx(conn *sqlite.Conn, fn func(*sqlite.Conn) error) (err error) {
 	return fn(conn)
 }
 
-func finalize(stmt *sqlite.Stmt, err *error) {
-	if fe := stmt.Finalize(); fe != nil && *err == nil {
-		*err = fe
+func reset(stmt *sqlite.Stmt, err *error) {
+	if re := stmt.Reset(); re != nil && *err == nil {
+		*err = re
 	}
+	_ = stmt.ClearBindings()
+}
+
+// Backup writes a consistent copy of the connection's main database to path, using VACUUM INTO.
+// Other connections can keep reading and writing the database while the backup runs. The file at path must not exist.
+func Backup(conn *sqlite.Conn, path string) error {
+	return sqlitex.Exec(conn, "VACUUM INTO ?", nil, path)
+}
+
+// Verify checks that the backup at path, of the connection's main database, is usable; ie. that it passes sqlite's
+// integrity check, and is at the same schema version (user_version) as the database itself.
+func Verify(conn *sqlite.Conn, path string) (err error) {
+	var backup *sqlite.Conn
+	if backup, err = sqlite.OpenConn(path, sqlite.SQLITE_OPEN_READONLY); err != nil {
+		return err
+	}
+	defer func() { _ = backup.Close() }()
+
+	var problems []string
+	if err = sqlitex.Exec(backup, "PRAGMA integrity_check", func(stmt *sqlite.Stmt) error {
+		if v := stmt.ColumnText(0); v != "ok" {
+			problems = append(problems, v)
+		}
+		return nil
+	}); err != nil {
+		return err
+	} else if len(problems) > 0 {
+		return errors.Errorf("backup failed integrity check: %s", strings.Join(problems, "; "))
+	}
+
+	var version = func(c *sqlite.Conn) (v int, err error) {
+		err = sqlitex.Exec(c, "PRAGMA user_version", func(stmt *sqlite.Stmt) error { v = stmt.ColumnInt(0); return nil })
+		return v, err
+	}
+
+	var want, got int
+	if want, err = version(conn); err != nil {
+		return err
+	} else if got, err = version(backup); err != nil {
+		return err
+	} else if got != want {
+		return errors.Errorf("backup is at schema version %d; want %d", got, want)
+	}
+
+	return nil
 }
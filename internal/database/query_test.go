@@ -0,0 +1,173 @@
+package database
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestExec(t *testing.T) {
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if err = sqlitex.ExecScript(conn, "CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT UNIQUE);"); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	var insert = func(values ...string) I[int64, string] {
+		return I[int64, string]{
+			QueryStr: "INSERT INTO t (v) VALUES (?) RETURNING id",
+			ArgSet:   values,
+			Bind:     func(stmt *sqlite.Stmt, v string) error { stmt.BindText(1, v); return nil },
+			Val:      func(stmt *sqlite.Stmt) (*int64, error) { var id = stmt.ColumnInt64(0); return &id, nil },
+		}
+	}
+
+	var count = func() (n int) {
+		_ = sqlitex.Exec(conn, "SELECT COUNT(*) FROM t", func(stmt *sqlite.Stmt) error { n = stmt.ColumnInt(0); return nil })
+		return n
+	}
+
+	var batch []string
+	for i := 0; i < BatchThreshold*2; i++ {
+		batch = append(batch, fmt.Sprintf("v%d", i))
+	}
+
+	if ids, err := Exec(conn, insert(batch...)); err != nil {
+		t.Fatalf("failed to insert batch: %v", err)
+	} else if len(ids) != len(batch) || *ids[len(ids)-1] != int64(len(batch)) {
+		t.Errorf("unexpected ids returned for batch: got %d ids", len(ids))
+	}
+
+	// the cached statement is reused by later calls
+	if ids, err := Exec(conn, insert("single")); err != nil {
+		t.Fatalf("failed to insert using cached statement: %v", err)
+	} else if len(ids) != 1 || *ids[0] != int64(len(batch)+1) {
+		t.Errorf("unexpected ids returned for single insert: %v", ids)
+	}
+
+	// a batch that fails part-way through is rolled back entirely
+	if _, err = Exec(conn, insert(append([]string{"new"}, batch...)...)); err == nil {
+		t.Fatalf("expected batch with duplicate values to fail")
+	} else if n := count(); n != len(batch)+1 {
+		t.Errorf("unexpected row count %d after failed batch; want %d", n, len(batch)+1)
+	}
+
+	// the statement must have been reset, so the connection isn't left in a transaction
+	if !conn.GetAutocommit() {
+		t.Errorf("expected connection to be in autocommit mode after exec")
+	}
+}
+
+func TestFetch_CachedStatement(t *testing.T) {
+	conn, err := sqlite.OpenConn(":memory:", 0)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if err = sqlitex.ExecScript(conn, "CREATE TABLE t (id INTEGER PRIMARY KEY, v TEXT); INSERT INTO t (v) VALUES ('a'), ('b'), ('c');"); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	var after = func(id int64) Q[string] {
+		return Q[string]{
+			QueryStr: "SELECT v FROM t WHERE id > ? ORDER BY id",
+			Bind:     func(stmt *sqlite.Stmt) error { stmt.BindInt64(1, id); return nil },
+			Val:      func(stmt *sqlite.Stmt) (*string, error) { var v = stmt.ColumnText(0); return &v, nil },
+		}
+	}
+
+	// fetching one of many rows leaves the cached statement mid-way; it must be reset before it's reused
+	for id, expected := range []string{"a", "b", "c"} {
+		if v, err := FetchOne(conn, after(int64(id))); err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		} else if v == nil || *v != expected {
+			t.Errorf("unexpected value %v after %d; want %s", v, id, expected)
+		}
+	}
+
+	if values, err := FetchMany(conn, after(1)); err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	} else if len(values) != 2 || *values[0] != "b" || *values[1] != "c" {
+		t.Errorf("unexpected values %v", values)
+	}
+
+	if !conn.GetAutocommit() {
+		t.Errorf("expected connection to be in autocommit mode after fetch")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	var dir = t.TempDir()
+
+	pool, err := sqlitex.Open("file:"+filepath.Join(dir, "wirefire.db"), 0, 2)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+
+	conn := pool.Get(context.Background())
+	defer pool.Put(conn)
+
+	if err = sqlitex.ExecScript(conn, "CREATE TABLE t (v TEXT); INSERT INTO t VALUES ('a'), ('b');"); err != nil {
+		t.Fatalf("failed to seed database: %v", err)
+	}
+
+	var path = filepath.Join(dir, "backup.db")
+	if err = Backup(conn, path); err != nil {
+		t.Fatalf("failed to backup database: %v", err)
+	}
+
+	if err = Backup(conn, path); err == nil {
+		t.Errorf("expected backup to an existing file to fail")
+	}
+
+	if err = Verify(conn, path); err != nil {
+		t.Errorf("expected backup to pass verification: %v", err)
+	}
+
+	if err = sqlitex.ExecTransient(conn, "PRAGMA user_version = 2", nil); err != nil {
+		t.Fatalf("failed to bump schema version: %v", err)
+	} else if err = Verify(conn, path); err == nil {
+		t.Errorf("expected backup at an older schema version to fail verification")
+	}
+
+	backup, err := sqlite.OpenConn(path, sqlite.SQLITE_OPEN_READONLY)
+	if err != nil {
+		t.Fatalf("failed to open backup: %v", err)
+	}
+	defer func() { _ = backup.Close() }()
+
+	var count int
+	if err = sqlitex.Exec(backup, "SELECT COUNT(*) FROM t", func(stmt *sqlite.Stmt) error { count = stmt.ColumnInt(0); return nil }); err != nil {
+		t.Fatalf("failed to query backup: %v", err)
+	} else if count != 2 {
+		t.Errorf("unexpected row count %d in backup; want 2", count)
+	}
+}
+
+func TestOperation(t *testing.T) {
+	var cases = map[string]string{
+		"SELECT * FROM t":                      "select",
+		"\n\t\tINSERT INTO t (v)\n VALUES (?)": "insert",
+		"WITH x AS (SELECT 1) SELECT * FROM x": "with",
+		"":                                     "",
+	}
+
+	for query, expected := range cases {
+		if got := operation(query); got != expected {
+			t.Errorf("operation(%q) = %q; want %q", query, got, expected)
+		}
+	}
+
+	if got := statement("\n\tSELECT *\n\tFROM t\n\tWHERE id = ?  "); got != "SELECT * FROM t WHERE id = ?" {
+		t.Errorf("unexpected statement %q", got)
+	}
+}
@@ -0,0 +1,18 @@
+-- This sql migration adds subnet routes advertised by machines, and their approval status.
+
+-- Table routes stores the subnet routes advertised by machines (using tailscale up --advertise-routes).
+-- A route is only used by peers after it's approved, either manually using the admin api or automatically
+-- using the autoApprovers section in the tailnet's acl policy.
+CREATE TABLE routes
+(
+    id         INTEGER PRIMARY KEY,      -- auto-generated, sequential identifier for the route
+    machine_id INTEGER NOT NULL,         -- machine that advertises the route
+    prefix     TEXT    NOT NULL,         -- advertised ip prefix, eg. 192.168.1.0/24
+    approved   BOOLEAN DEFAULT false,    -- has the route been approved?
+
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    -- routes are removed along with the machine that advertises them
+    CONSTRAINT fk_route_machine FOREIGN KEY (machine_id) REFERENCES machines (id) ON DELETE CASCADE,
+    CONSTRAINT uq_route_prefix UNIQUE (machine_id, prefix)
+);
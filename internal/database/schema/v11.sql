@@ -0,0 +1,4 @@
+-- This sql migration adds per-tailnet dns settings, delivered to clients along with the MagicDNS configuration.
+
+-- dns holds the tailnet's fallback resolvers and split dns routes (mapping a domain to the list of resolvers used for it)
+ALTER TABLE tailnets ADD COLUMN dns JSON NOT NULL DEFAULT '{}';
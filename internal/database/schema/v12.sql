@@ -0,0 +1,7 @@
+-- This sql migration adds a per-tailnet retention policy for expired machines.
+
+-- delete_expired_after is the number of days after which a machine whose key has expired is deleted. Zero disables the policy.
+ALTER TABLE tailnets ADD COLUMN delete_expired_after INTEGER DEFAULT 0;
+
+-- locked exempts the machine from the tailnet's delete_expired_after policy
+ALTER TABLE machines ADD COLUMN locked BOOLEAN DEFAULT false;
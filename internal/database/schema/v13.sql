@@ -0,0 +1,18 @@
+-- This sql migration adds a history of every acl policy saved for a tailnet.
+
+-- Table acl_history stores each revision of a tailnet's acl policy, as it was submitted (ie. HuJSON, with comments).
+-- The tailnet's current policy is also stored in tailnets.acl; the history is only used to inspect (and restore) past revisions.
+CREATE TABLE acl_history
+(
+    id         INTEGER PRIMARY KEY,  -- auto-generated, sequential identifier for the revision
+    tailnet_id INTEGER NOT NULL,     -- tailnet the policy belongs to
+    policy     TEXT    NOT NULL,     -- policy document, as it was submitted
+    actor      TEXT    DEFAULT '',   -- identity of the user that saved the policy
+
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    -- history is removed along with the tailnet
+    CONSTRAINT fk_acl_history_tailnet FOREIGN KEY (tailnet_id) REFERENCES tailnets (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_acl_history_tailnet ON acl_history (tailnet_id, id);
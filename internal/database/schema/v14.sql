@@ -0,0 +1,5 @@
+-- This sql migration adds a per-tailnet welcome message shown to users when they add a new device.
+
+-- welcome holds the tailnet's welcome message (eg. onboarding instructions), and whether it's also delivered to
+-- newly added devices as a health message (see: domain.Welcome)
+ALTER TABLE tailnets ADD COLUMN welcome JSON NOT NULL DEFAULT '{}';
@@ -0,0 +1,17 @@
+-- This sql migration records the exit node used by each machine, as reported by its client.
+
+-- Table exit_node_usage maps a machine to the exit node it's currently routing its traffic through. Machines
+-- that aren't using an exit node have no row. It's only used to report the usage of exit nodes (see: domain.ExitNodeUsage).
+CREATE TABLE exit_node_usage
+(
+    machine_id   INTEGER PRIMARY KEY, -- machine using the exit node
+    exit_node_id INTEGER NOT NULL,    -- machine being used as the exit node
+
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    -- usage is removed along with either of the machines
+    CONSTRAINT fk_exit_node_usage_machine FOREIGN KEY (machine_id) REFERENCES machines (id) ON DELETE CASCADE,
+    CONSTRAINT fk_exit_node_usage_exit_node FOREIGN KEY (exit_node_id) REFERENCES machines (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_exit_node_usage_exit_node ON exit_node_usage (exit_node_id);
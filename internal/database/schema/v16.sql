@@ -0,0 +1,5 @@
+-- This sql migration adds per-tailnet toggles for client features, like taildrop, funnel and tailscale ssh.
+
+-- features holds the client features enabled for the tailnet's machines (see: domain.Features). Tailscale ssh
+-- is enabled for existing tailnets, since ssh policies were always delivered to clients before this migration.
+ALTER TABLE tailnets ADD COLUMN features JSON NOT NULL DEFAULT '{"ssh": true}';
@@ -0,0 +1,17 @@
+-- This sql migration adds storage for health warnings reported by clients.
+
+-- Table machine_health stores the health warnings currently reported by each machine's client (using the
+-- /machine/update-health endpoint), one per subsystem. Warnings are removed once the client reports them as cleared.
+CREATE TABLE machine_health
+(
+    machine_id INTEGER NOT NULL, -- machine reporting the warning
+    subsys     TEXT    NOT NULL, -- client subsystem (or warnable code) the warning belongs to
+    error      TEXT    NOT NULL, -- warning text, as reported by the client
+
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    PRIMARY KEY (machine_id, subsys),
+
+    -- warnings are removed along with the machine
+    CONSTRAINT fk_machine_health_machine FOREIGN KEY (machine_id) REFERENCES machines (id) ON DELETE CASCADE
+);
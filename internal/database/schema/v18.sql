@@ -0,0 +1,7 @@
+-- This sql migration changes the format of machines' endpoints to carry the type (ie. source) of each endpoint.
+
+-- endpoints were stored as a list of ip:port strings; they're now stored as a list of tailcfg.Endpoint objects.
+-- The type of existing endpoints is unknown (0) until the machine reports its endpoints again.
+UPDATE machines
+    SET endpoints = (SELECT json_group_array(json_object('Addr', value, 'Type', 0)) FROM json_each(machines.endpoints))
+    WHERE json_type(endpoints) = 'array';
@@ -0,0 +1,5 @@
+-- This sql migration adds the ability to disable a user's logins, eg. after their account has been compromised.
+
+-- disabled_at is set when an admin disables the user's logins; the user can neither login using oidc, nor register
+-- machines using auth keys, until it's cleared again.
+ALTER TABLE users ADD COLUMN disabled_at TIMESTAMP;
@@ -0,0 +1,29 @@
+-- This sql migration adds client address / location tracking and the audit log.
+
+-- client ip address and resolved geo / asn location of the client that initiated the registration request
+ALTER TABLE machine_registration_requests ADD COLUMN client_addr TEXT DEFAULT '';
+ALTER TABLE machine_registration_requests ADD COLUMN location JSON;
+
+-- client ip address and resolved geo / asn location from the machine's most recent session
+ALTER TABLE machines ADD COLUMN last_addr TEXT DEFAULT '';
+ALTER TABLE machines ADD COLUMN location JSON;
+
+-- Table audit_log records security-relevant events that occur in the system (registrations, logins, location changes etc.)
+-- Events are append-only and are never updated once written.
+CREATE TABLE audit_log
+(
+    id          INTEGER PRIMARY KEY,       -- auto-generated, sequential identifier for the event
+    action      TEXT NOT NULL,             -- action that was performed, eg. machine.created
+    actor       TEXT      DEFAULT '',      -- identity of the user / machine that performed the action
+    target      TEXT      DEFAULT '',      -- identity of the object the action was performed on
+    tailnet_id  INTEGER,                   -- tailnet the event belongs to, if any
+    client_addr TEXT      DEFAULT '',      -- ip address of the client that performed the action
+    location    JSON,                      -- resolved geo / asn location of client_addr
+    data        JSON NOT NULL DEFAULT '{}', -- additional, action specific details
+
+    created_at  TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    CONSTRAINT fk_audit_tailnet FOREIGN KEY (tailnet_id) REFERENCES tailnets (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_audit_log_tailnet ON audit_log (tailnet_id, created_at DESC);
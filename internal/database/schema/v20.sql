@@ -0,0 +1,16 @@
+-- This sql migration adds shared acl policies, that tailnets' policies can include to share a common baseline.
+
+-- Table shared_policies stores acl policy documents, as they were submitted (ie. HuJSON, with comments), that
+-- are included by tailnets' policies using the include section (see: domain.ResolvePolicy).
+CREATE TABLE shared_policies
+(
+    name       TEXT PRIMARY KEY, -- unique name used to include the policy
+    policy     TEXT NOT NULL,    -- policy document, as it was submitted
+
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+
+-- acl_source stores the tailnet's policy document, as it was submitted, if it includes shared policies; acl then
+-- holds the resolved policy, and is updated whenever one of the included policies changes. It's NULL otherwise.
+ALTER TABLE tailnets ADD COLUMN acl_source TEXT;
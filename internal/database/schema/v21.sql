@@ -0,0 +1,4 @@
+-- This sql migration adds per-tailnet privacy settings, controlling which of a machine's host details are shared with its peers.
+
+-- privacy holds the host details redacted from peers' netmaps (see: domain.Privacy); nothing is redacted by default.
+ALTER TABLE tailnets ADD COLUMN privacy JSON NOT NULL DEFAULT '{}';
@@ -0,0 +1,24 @@
+-- This sql migration scopes users to the oidc provider (issuer) they login with, so that users of different providers
+-- with the same subject don't collide. SQLite can't alter a table's constraints, so the users table is rebuilt.
+
+-- iss is the issuer of the oidc tokens the user logs in with. It's empty for placeholder users (see: domain.EnsureUser)
+-- that have never logged in, and is set when the user first logs in, using any of the configured providers.
+CREATE TABLE users_v22
+(
+    id          INTEGER PRIMARY KEY,                     -- auto-generated, sequential identifier for the user
+    iss         TEXT NOT NULL DEFAULT '',                -- issuer of the user's oidc tokens; empty for placeholders
+    sub         GENERATED ALWAYS AS (claims ->> 'sub'),  -- subject extracted from oidc token, unique per issuer
+    name        GENERATED ALWAYS AS (claims ->> 'name'), -- user's name extracted from the oidc token
+    claims      JSON NOT NULL,                           -- OIDC standard claims extracted from the token
+
+    created_at  TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    disabled_at TIMESTAMP,
+
+    CONSTRAINT uq_subject UNIQUE (iss, sub)              -- subject must be unique for the issuer
+);
+
+INSERT INTO users_v22 (id, iss, claims, created_at, disabled_at)
+SELECT id, COALESCE(claims ->> 'iss', ''), claims, created_at, disabled_at FROM users;
+
+DROP TABLE users;
+ALTER TABLE users_v22 RENAME TO users;
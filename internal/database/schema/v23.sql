@@ -0,0 +1,16 @@
+-- This sql migration adds persistent map session state, so that clients reconnecting after a server restart don't
+-- all trigger netmap updates for their peers at once.
+
+-- Table map_sessions stores, for each machine, a checksum of the state (keys, endpoints, host info etc.) its client
+-- last reported over /machine/map. A client reporting the same state again, eg. when it reconnects after a restart,
+-- doesn't cause an update to be sent to its peers.
+CREATE TABLE map_sessions
+(
+    machine_id INTEGER PRIMARY KEY, -- machine the session belongs to
+    checksum   TEXT NOT NULL,       -- checksum of the state last reported by the machine's client
+
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    -- session state is removed along with the machine
+    CONSTRAINT fk_map_session_machine FOREIGN KEY (machine_id) REFERENCES machines (id) ON DELETE CASCADE
+);
@@ -0,0 +1,8 @@
+-- This sql migration adds an opt-in device approval gate, that holds new machines until an admin approves them.
+
+-- require_approval holds new machines in the tailnet in a pending state, until an admin approves them
+ALTER TABLE tailnets ADD COLUMN require_approval BOOLEAN NOT NULL DEFAULT false;
+
+-- authorized is false for machines pending approval; these are not shown to, and can not connect to, their peers.
+-- Existing machines are approved.
+ALTER TABLE machines ADD COLUMN authorized BOOLEAN NOT NULL DEFAULT true;
@@ -0,0 +1,17 @@
+-- This sql migration adds a time-series of machine presence (online / offline) transitions, used to report uptime.
+
+-- Table presence stores a row for every transition of a machine between online (streaming a map session) and offline.
+-- Rows older than the configured retention are deleted periodically (see: janitor.PrunePresence).
+CREATE TABLE presence
+(
+    machine_id INTEGER NOT NULL, -- machine that went online or offline
+    online     BOOLEAN NOT NULL, -- true if the machine came online, false if it went offline
+
+    at         TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    -- transitions are removed along with the machine
+    CONSTRAINT fk_presence_machine FOREIGN KEY (machine_id) REFERENCES machines (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_presence_machine_at ON presence (machine_id, at);
+CREATE INDEX idx_presence_at ON presence (at);
@@ -0,0 +1,5 @@
+-- This sql migration lets admins give machines a name of their choosing, distinct from the machine's hostname.
+
+-- given_name is true if the machine's name was given by an admin, rather than derived from its hostname.
+-- A given name is kept as-is when the machine's hostname changes.
+ALTER TABLE machines ADD COLUMN given_name BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,7 @@
+-- This sql migration adds natively allocated IPv6 addresses, from a configurable prefix, alongside the IPv4 addresses.
+
+-- ipv6 is the IPv6 address allocated to the machine (see: ipam.SelectIPv6). It's empty for machines registered before
+-- this migration, whose IPv6 address is derived from their IPv4 address instead (see: domain.Machine.IP).
+ALTER TABLE machines ADD COLUMN ipv6 TEXT NOT NULL DEFAULT '';
+
+CREATE UNIQUE INDEX idx_tailnet_id_ipv6 ON machines (tailnet_id, ipv6) WHERE ipv6 != '';
@@ -0,0 +1,6 @@
+-- This sql migration lets each tailnet define its own address pools, that its machines are allocated addresses from.
+
+-- ipv4_pool and ipv6_pool are the prefixes the tailnet's machines are allocated addresses from. An empty pool uses the
+-- global default; Tailscale's CGNAT range for IPv4, and the configured prefix (see: ipam.Config) for IPv6.
+ALTER TABLE tailnets ADD COLUMN ipv4_pool TEXT NOT NULL DEFAULT '';
+ALTER TABLE tailnets ADD COLUMN ipv6_pool TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,28 @@
+-- This sql migration adds a table of allocated addresses, so that concurrent registrations can't be allocated the same address.
+
+-- Table ip_allocations stores a row for every address allocated to a machine. An address is reserved, inside the registration
+-- transaction, by inserting its row; the primary key guarantees that an address is only ever reserved once in a tailnet.
+-- The row is then claimed by the machine it's assigned to (see: domain.ReserveAddr and domain.ClaimAddrs).
+CREATE TABLE ip_allocations
+(
+    tailnet_id INTEGER NOT NULL, -- tailnet the address is allocated in
+    addr       TEXT    NOT NULL, -- allocated address, of either family
+    machine_id INTEGER,          -- machine the address is assigned to; null until claimed
+
+    created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    CONSTRAINT pk_ip_allocations PRIMARY KEY (tailnet_id, addr),
+
+    -- addresses are reclaimed when the machine (or the tailnet) is deleted
+    CONSTRAINT fk_allocation_tailnet FOREIGN KEY (tailnet_id) REFERENCES tailnets (id) ON DELETE CASCADE,
+    CONSTRAINT fk_allocation_machine FOREIGN KEY (machine_id) REFERENCES machines (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_ip_allocations_machine ON ip_allocations (machine_id);
+
+-- allocate the addresses already assigned to existing machines. Machines registered before natively allocated IPv6 addresses
+-- use an address derived from their IPv4 address, which is never allocated (see: ipam.SelectIPv6), and isn't recorded.
+INSERT OR IGNORE INTO ip_allocations (tailnet_id, addr, machine_id)
+SELECT tailnet_id, ipv4, id FROM machines WHERE ipv4 IS NOT NULL
+UNION ALL
+SELECT tailnet_id, ipv6, id FROM machines WHERE ipv6 != '';
@@ -0,0 +1,12 @@
+-- This sql migration adds the key-value settings store used for runtime-tunable values.
+
+-- Table settings stores runtime-tunable values (intervals, feature flags, maintenance mode etc.) that can be changed
+-- without editing configuration files or restarting the server. Only keys that are overridden are stored here;
+-- for all other keys, the default value defined in code is used.
+CREATE TABLE settings
+(
+    key        TEXT PRIMARY KEY, -- unique, dot-separated name of the setting, eg. coordinator.sync_interval
+    value      JSON NOT NULL,    -- json-encoded value of the setting
+
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
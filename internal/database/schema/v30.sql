@@ -0,0 +1,23 @@
+-- This sql migration adds a table of ssh checks, used to implement the check action of the acl policy's ssh rules.
+
+-- Table ssh_checks stores a row for every ssh connection held for the user to re-authenticate (ie. an ssh rule with
+-- action check). The check is completed once the owner of the source machine signs in again with the oidc provider,
+-- after which connections from any of the user's machines to the destination are accepted for the rule's check period.
+CREATE TABLE ssh_checks
+(
+    id               TEXT PRIMARY KEY,  -- random text id used to identify checks; exposed in the check url
+    src_machine_id   INTEGER NOT NULL,  -- machine the connection is made from
+    dst_machine_id   INTEGER NOT NULL,  -- machine the connection is made to, which holds the connection
+    user_id          INTEGER NOT NULL,  -- owner of the source machine, who must re-authenticate
+    local_user       TEXT    NOT NULL,  -- user on the destination machine the connection logs in as
+    check_period     INTEGER NOT NULL,  -- seconds after authentication for which the check holds; zero checks every connection
+
+    authenticated_at TIMESTAMP,         -- set once the user has re-authenticated
+    created_at       TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    CONSTRAINT fk_ssh_check_src FOREIGN KEY (src_machine_id) REFERENCES machines (id) ON DELETE CASCADE,
+    CONSTRAINT fk_ssh_check_dst FOREIGN KEY (dst_machine_id) REFERENCES machines (id) ON DELETE CASCADE,
+    CONSTRAINT fk_ssh_check_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_ssh_checks_user ON ssh_checks (user_id, dst_machine_id);
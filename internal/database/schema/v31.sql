@@ -0,0 +1,11 @@
+-- This sql migration adds a table of audit exporter cursors, used to ship the audit log to external systems.
+
+-- Table audit_exports stores, for each configured exporter, the id of the last audit event it has exported. Exporters
+-- resume from their cursor after a restart, so that every event is exported (at least) once.
+CREATE TABLE audit_exports
+(
+    exporter   TEXT PRIMARY KEY, -- name of the exporter, as configured
+    last_id    INTEGER NOT NULL, -- id of the last audit event exported
+
+    updated_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
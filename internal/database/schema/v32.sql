@@ -0,0 +1,22 @@
+-- This sql migration adds a table of ssh session events, that gives operators an audit trail of tailscale ssh connections.
+
+-- Table ssh_sessions stores a row for every ssh session event reported by, or decided for, the destination machine of a
+-- connection; eg. a connection accepted (or rejected) after a check, or a session whose recording failed.
+CREATE TABLE ssh_sessions
+(
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    tailnet_id     INTEGER NOT NULL,
+    event          TEXT    NOT NULL,              -- type of the event, eg. accepted or recording_failed
+    connection_id  TEXT    NOT NULL DEFAULT '',   -- id of the connection assigned by the destination, if reported
+    src_machine_id INTEGER NOT NULL,              -- machine the connection is made from
+    dst_machine_id INTEGER NOT NULL,              -- machine the connection is made to, which reported the event
+    ssh_user       TEXT    NOT NULL DEFAULT '',   -- user name the client connected as
+    local_user     TEXT    NOT NULL DEFAULT '',   -- user on the destination machine the connection logs in as
+    message        TEXT    NOT NULL DEFAULT '',   -- additional details, eg. why the connection was rejected
+
+    created_at     TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    CONSTRAINT fk_ssh_session_tailnet FOREIGN KEY (tailnet_id) REFERENCES tailnets (id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_ssh_sessions_tailnet ON ssh_sessions (tailnet_id, id);
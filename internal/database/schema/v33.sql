@@ -0,0 +1,5 @@
+-- This sql migration adds per-tailnet netmap size guardrails, that alert admins (and optionally apply mitigations) when
+-- the netmaps sent to the tailnet's machines grow too large.
+
+-- guardrails holds the tailnet's netmap size thresholds (see: domain.Guardrails); global defaults apply if unset.
+ALTER TABLE tailnets ADD COLUMN guardrails JSON NOT NULL DEFAULT '{}';
@@ -0,0 +1,9 @@
+-- This sql migration introduces the owner role (see: domain.Roles), and promotes the longest-standing admin of each
+-- tailnet to its owner, so that every tailnet that has admins keeps a member who can manage them.
+UPDATE tailnet_members SET role = 'owner'
+WHERE (tailnet_id, user_id) IN (
+    SELECT tailnet_id, user_id FROM (
+        SELECT tailnet_id, user_id, row_number() OVER (PARTITION BY tailnet_id ORDER BY created_at, user_id) AS n
+        FROM tailnet_members WHERE role = 'admin'
+    ) WHERE n = 1
+);
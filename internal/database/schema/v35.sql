@@ -0,0 +1,13 @@
+-- This sql migration adds a table of node keys revoked when their machine logs out, so that they can't be used again.
+
+-- Table revoked_node_keys stores the node keys machines have logged out with (eg. tailscale logout). Clients generate
+-- a new node key when they login again, and requests made using a revoked key are rejected.
+CREATE TABLE revoked_node_keys
+(
+    node_key   TEXT    NOT NULL PRIMARY KEY,
+    machine_id INTEGER NOT NULL,
+
+    revoked_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    CONSTRAINT fk_revoked_node_key_machine FOREIGN KEY (machine_id) REFERENCES machines (id) ON DELETE CASCADE
+);
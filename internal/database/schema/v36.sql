@@ -0,0 +1,5 @@
+-- This sql migration adds location profiles (sites), that group machines behind the same NAT or firewall, so that machines
+-- at the same site connect directly over their local endpoints, and those at different sites are relayed over derp.
+
+-- site is the name of the site the machine is located at; empty if the machine isn't assigned to one.
+ALTER TABLE machines ADD COLUMN site TEXT NOT NULL DEFAULT '';
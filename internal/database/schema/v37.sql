@@ -0,0 +1,4 @@
+-- This sql migration adds per-tailnet logging settings, controlling whether the tailnet's clients stream their logs, and where to.
+
+-- logging holds the tailnet's log streaming policy (see: domain.Logging); log streaming is disabled by default, as it always has been.
+ALTER TABLE tailnets ADD COLUMN logging JSON NOT NULL DEFAULT '{}';
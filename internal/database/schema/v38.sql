@@ -0,0 +1,5 @@
+-- This sql migration adds per-tailnet machine naming modes, letting tailnets give their machines memorable, generated names
+-- (eg. brave-otter) rather than naming them after their client's hostname.
+
+-- naming is the tailnet's machine naming mode (see: domain.Naming); machines are named after their hostname by default.
+ALTER TABLE tailnets ADD COLUMN naming TEXT NOT NULL DEFAULT 'hostname';
@@ -0,0 +1,5 @@
+-- This sql migration tracks registration flows abandoned by their client, so that they can be cancelled if the client
+-- doesn't return to them, rather than leaving their login link usable until the flow expires.
+
+-- abandoned_at is set when the client stops following up on the flow (eg. it was interrupted), and cleared when it resumes
+ALTER TABLE machine_registration_requests ADD COLUMN abandoned_at TIMESTAMP;
@@ -0,0 +1,17 @@
+-- This sql migration adds operator-defined notices that are pushed to clients as health messages.
+
+-- Table notices stores operator-defined messages (eg. "maintenance tonight at 22:00 UTC") delivered to clients
+-- via MapResponse.Health. A notice with neither tailnet_id nor machine_id set is delivered to all machines.
+CREATE TABLE notices
+(
+    id         INTEGER PRIMARY KEY, -- auto-generated, sequential identifier for the notice
+    message    TEXT NOT NULL,       -- message displayed to the user by the client
+    tailnet_id INTEGER,             -- if set, only machines in this tailnet receive the notice
+    machine_id INTEGER,             -- if set, only this machine receives the notice
+    expires_at TIMESTAMP,           -- if set, the notice is no longer delivered after this time
+
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+
+    CONSTRAINT fk_notice_tailnet FOREIGN KEY (tailnet_id) REFERENCES tailnets (id) ON DELETE CASCADE,
+    CONSTRAINT fk_notice_machine FOREIGN KEY (machine_id) REFERENCES machines (id) ON DELETE CASCADE
+);
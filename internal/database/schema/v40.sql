@@ -0,0 +1,37 @@
+-- This sql migration adds webhooks, letting admins subscribe external systems to events in their tailnet (eg. a machine
+-- joining it), along with a log of their deliveries.
+
+-- Table webhooks stores the webhooks registered in each tailnet. Deliveries are signed using the webhook's secret.
+CREATE TABLE webhooks
+(
+    id         INTEGER PRIMARY KEY,
+    tailnet_id INTEGER NOT NULL REFERENCES tailnets (id) ON DELETE CASCADE,
+    url        TEXT    NOT NULL,             -- url the events are posted to
+    secret     TEXT    NOT NULL,             -- secret used to sign deliveries; 32 random bytes, unpadded base64url-encoded
+    events     JSON    NOT NULL DEFAULT '[]', -- types of the events delivered to the webhook, eg. node.joined
+
+    created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+
+CREATE INDEX idx_webhooks_tailnet ON webhooks (tailnet_id);
+
+-- Table webhook_deliveries stores each event delivered (or to be delivered) to a webhook, along with the outcome of
+-- the last attempt. Failed deliveries are retried with backoff, until they succeed or run out of attempts.
+CREATE TABLE webhook_deliveries
+(
+    id              INTEGER PRIMARY KEY,
+    webhook_id      INTEGER NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event           TEXT    NOT NULL,                   -- type of the event, eg. node.joined
+    payload         TEXT    NOT NULL,                   -- json body posted to the webhook
+    status          TEXT    NOT NULL DEFAULT 'pending', -- one of pending, delivered or failed
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    response_code   INTEGER NOT NULL DEFAULT 0,         -- http status of the last attempt; zero if no response was received
+    error           TEXT    NOT NULL DEFAULT '',        -- error of the last attempt, if it failed
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    delivered_at    TIMESTAMP,
+
+    created_at      TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+
+CREATE INDEX idx_webhook_deliveries_pending ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX idx_webhook_deliveries_webhook ON webhook_deliveries (webhook_id, id);
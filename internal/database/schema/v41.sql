@@ -0,0 +1,15 @@
+-- This sql migration lets clients resume their map session after a server restart, and be sent what has changed since
+-- the last response they processed, rather than a full netmap.
+
+-- The state of a machine's streaming map session (checksums of the netmap last sent, and the peers in it) is saved when
+-- the server shuts down, along with the session's handle and the sequence number of its last response. The saved state
+-- is cleared once the machine starts its next session, whether it resumes the saved one or not.
+
+-- handle of the saved session; empty if there's none
+ALTER TABLE map_sessions ADD COLUMN handle TEXT NOT NULL DEFAULT '';
+
+-- sequence number of the last response of the saved session
+ALTER TABLE map_sessions ADD COLUMN seq INTEGER NOT NULL DEFAULT 0;
+
+-- json-encoded state of the saved session
+ALTER TABLE map_sessions ADD COLUMN state TEXT NOT NULL DEFAULT '';
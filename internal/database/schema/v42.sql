@@ -0,0 +1,11 @@
+-- This sql migration records the machine identities imported from other coordinators, so that each exported identity
+-- can only be imported once, and a copy of it can't be replayed (eg. to re-register a machine that has since been deleted).
+
+-- Table imported_identities stores the id of each imported identity, until it would have expired anyway.
+CREATE TABLE imported_identities
+(
+    id          TEXT PRIMARY KEY,    -- random id of the export; see domain.MachineIdentity
+    exported_at TIMESTAMP NOT NULL,  -- time the identity was exported at, after which it expires
+
+    imported_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
@@ -0,0 +1,5 @@
+-- This sql migration adds consumed-state tracking to registration requests.
+
+-- consumed_at is set (exactly once) when the oidc flow for the request is completed. It's used to
+-- guard against duplicate / concurrent submissions of the same flow (eg. double-submit or multiple tabs).
+ALTER TABLE machine_registration_requests ADD COLUMN consumed_at TIMESTAMP;
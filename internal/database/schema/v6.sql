@@ -0,0 +1,8 @@
+-- This sql migration adds the per-tailnet policy to hide long-offline machines from peers' netmaps.
+
+-- hide_offline_after is the number of days after which a machine that hasn't been seen is hidden from its peers.
+-- Hidden machines are not deleted and become visible again as soon as they come back online. Zero disables the policy.
+ALTER TABLE tailnets ADD COLUMN hide_offline_after INTEGER DEFAULT 0;
+
+-- always_visible exempts the machine from the tailnet's hide_offline_after policy
+ALTER TABLE machines ADD COLUMN always_visible BOOLEAN DEFAULT false;
@@ -0,0 +1,31 @@
+-- This sql migration adds pre-authentication keys and machine tags.
+
+-- Table auth_keys stores pre-authentication keys used to register (headless) machines without going through the oidc flow.
+-- Only a hash of the key's secret is stored; the complete key is shown to the user once, when it's created.
+CREATE TABLE auth_keys
+(
+    id          INTEGER PRIMARY KEY,         -- auto-generated, sequential identifier for the key
+    prefix      TEXT NOT NULL UNIQUE,        -- random, public identifier that's embedded in the key
+    hash        TEXT NOT NULL,               -- hex-encoded sha256 hash of the key's secret
+    description TEXT      DEFAULT '',        -- optional, user-provided description of the key
+
+    reusable    BOOLEAN   DEFAULT false,     -- can the key be used to register more than one machine?
+    ephemeral   BOOLEAN   DEFAULT false,     -- are machines registered with this key ephemeral?
+    tags        JSON NOT NULL DEFAULT '[]',  -- tags applied to machines registered with this key
+
+    tailnet_id  INTEGER NOT NULL,            -- tailnet that machines registered with this key join
+    user_id     INTEGER NOT NULL,            -- user that owns machines registered with this key
+
+    created_at  TIMESTAMP DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+    expires_at  TIMESTAMP,                   -- key cannot be used after it has expired; NULL if the key never expires
+    revoked_at  TIMESTAMP,                   -- set when the key is revoked
+    used_at     TIMESTAMP,                   -- set every time the key is used to register a machine
+
+    -- key's life is tied to the owner's membership in a tailnet
+    CONSTRAINT fk_auth_key_membership FOREIGN KEY (tailnet_id, user_id) REFERENCES tailnet_members (tailnet_id, user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_auth_keys_tailnet ON auth_keys (tailnet_id);
+
+-- tags applied to the machine, eg. by the auth key it was registered with
+ALTER TABLE machines ADD COLUMN tags JSON NOT NULL DEFAULT '[]';
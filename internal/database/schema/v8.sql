@@ -0,0 +1,8 @@
+-- This sql migration adds the derp-only policy, which forces connections to be relayed over derp servers,
+-- for environments where direct udp paths between machines are prohibited.
+
+-- force_derp forces all connections of all machines in the tailnet to be relayed over derp
+ALTER TABLE tailnets ADD COLUMN force_derp BOOLEAN DEFAULT false;
+
+-- force_derp forces all connections to and from the machine to be relayed over derp
+ALTER TABLE machines ADD COLUMN force_derp BOOLEAN DEFAULT false;
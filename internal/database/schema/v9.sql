@@ -0,0 +1,6 @@
+-- This sql migration adds per-tailnet node capability grants, delivered to clients in their self node's capability map.
+-- Clients use these to enable features in their UI (eg. the link to the admin console shown to tailnet admins).
+
+-- capabilities maps a tailnet role (see tailnet_members.role) to the list of node capabilities granted to machines owned
+-- by users with that role. By default, only tailnet admins are granted the https://tailscale.com/cap/is-admin capability.
+ALTER TABLE tailnets ADD COLUMN capabilities JSON NOT NULL DEFAULT '{"admin": ["https://tailscale.com/cap/is-admin"]}';
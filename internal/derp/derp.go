@@ -1,40 +1,295 @@
 package derp
 
 import (
+	"context"
 	"encoding/json"
+	"expvar"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"tailscale.com/metrics"
 	"tailscale.com/tailcfg"
+	"time"
 )
 
-// Load loads derp map from multiple sources and returns a merged map
+// RefreshInterval is the interval at which the derp map is re-fetched from its sources
+var RefreshInterval = settings.Define("derp.refresh_interval", settings.Duration(time.Hour),
+	"interval at which the derp map is re-fetched from derp.sources; the map is never refreshed if zero")
+
+// SourceLabel labels a metric with the url of the derp map source it belongs to
+type SourceLabel struct {
+	Source string `prom:"source"`
+}
+
+// LastRefresh is the unix time at which the derp map was last fetched successfully from each source
+var LastRefresh = metrics.NewMultiLabelMap[SourceLabel]("wirefire_derp_source_last_refresh_timestamp_seconds", "gauge", "unix time of the last successful fetch of the derp map from the source")
+
+// RefreshFailures is the number of failed attempts to fetch the derp map from each source
+var RefreshFailures = metrics.NewMultiLabelMap[SourceLabel]("wirefire_derp_source_refresh_failures_total", "counter", "number of failed attempts to fetch the derp map from the source")
+
+func init() {
+	config.RegisterPrefix("derp.map_inline") // free-form regions, merged into the derp map
+
+	expvar.Publish("gauge_wirefire_derp_map_age_seconds", expvar.Func(func() any { return int64(Age().Seconds()) }))
+}
+
+// SourceStatus reports the state of a single derp map source
+type SourceStatus struct {
+	Source      string    `json:"source"`
+	LastRefresh time.Time `json:"last_refresh"` // time of the last successful fetch; zero if never fetched
+	LastAttempt time.Time `json:"last_attempt"`
+	LastError   string    `json:"last_error,omitempty"` // error from the last attempt, if it failed
+}
+
+// state holds the last successfully fetched map, and the status, of each source
+var state struct {
+	sync.Mutex
+	maps   map[string]*tailcfg.DERPMap
+	status map[string]*SourceStatus
+}
+
+// InlineSource is the source of the regions defined inline in the configuration, under derp.map_inline,
+// using the same structure as a derp map served over http (ie. tailcfg.DERPMap). It's always loaded last, if configured.
+const InlineSource = "inline"
+
+// Load loads derp map from multiple sources and returns a merged map. A source is either a http(s) url, a file:// path
+// to a json encoded derp map, or InlineSource. Regions of later sources replace regions, with the same id, of earlier ones.
+//
+// Sources that fail to load contribute the map they returned last time they were loaded successfully,
+// so that a failing source doesn't remove its regions. An error is returned only if a source has never loaded.
 func Load(srcs []string) (_ *tailcfg.DERPMap, err error) {
+	state.Lock()
+	defer state.Unlock()
+
+	if state.maps == nil {
+		state.maps, state.status = make(map[string]*tailcfg.DERPMap), make(map[string]*SourceStatus)
+	}
+
 	var result = &tailcfg.DERPMap{
 		Regions: map[int]*tailcfg.DERPRegion{},
 	}
 
+	if viper.IsSet("derp.map_inline") && !slices.Contains(srcs, InlineSource) {
+		srcs = append(slices.Clone(srcs), InlineSource)
+	}
+
 	for _, src := range srcs {
-		var req *http.Request
-		if req, err = http.NewRequest("GET", src, http.NoBody); err != nil {
-			return nil, err
+		var status, ok = state.status[src]
+		if !ok {
+			status = &SourceStatus{Source: src}
+			state.status[src] = status
+		}
+
+		status.LastAttempt = time.Now()
+		if dm, ferr := fetch(src); ferr != nil {
+			status.LastError = ferr.Error()
+			RefreshFailures.Add(SourceLabel{Source: src}, 1)
+
+			if state.maps[src] == nil {
+				err = errors.Wrapf(ferr, "failed to load derp map from %s", src)
+			}
+		} else {
+			status.LastRefresh, status.LastError = status.LastAttempt, ""
+			state.maps[src] = dm
+			LastRefresh.SetInt(SourceLabel{Source: src}, status.LastRefresh.Unix())
+		}
+
+		if dm := state.maps[src]; dm != nil {
+			for id, r := range dm.Regions {
+				result.Regions[id] = r
+			}
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// fetch fetches the derp map from the source
+func fetch(src string) (_ *tailcfg.DERPMap, err error) {
+	if src == InlineSource {
+		return inline()
+	}
+
+	if path, ok := strings.CutPrefix(src, "file://"); ok {
+		return read(path)
+	}
+
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return nil, errors.Errorf("unsupported derp map source %q", src)
+	}
+
+	var req *http.Request
+	if req, err = http.NewRequest("GET", src, http.NoBody); err != nil {
+		return nil, err
+	}
+
+	var resp *http.Response
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var dm tailcfg.DERPMap
+	if err = json.NewDecoder(resp.Body).Decode(&dm); err != nil {
+		return nil, err
+	}
+
+	return &dm, nil
+}
+
+// read reads the json encoded derp map from the file at path
+func read(path string) (_ *tailcfg.DERPMap, err error) {
+	var buf []byte
+	if buf, err = os.ReadFile(path); err != nil {
+		return nil, err
+	}
+
+	var dm tailcfg.DERPMap
+	if err = json.Unmarshal(buf, &dm); err != nil {
+		return nil, err
+	}
+
+	return &dm, nil
+}
+
+// inline returns the derp map defined in the configuration, under derp.map_inline. Keys are matched to the
+// fields of tailcfg.DERPMap case-insensitively, as configuration keys are case-insensitive (eg. regions.900.regionid).
+func inline() (_ *tailcfg.DERPMap, err error) {
+	var buf []byte
+	if buf, err = json.Marshal(viper.Get("derp.map_inline")); err != nil {
+		return nil, err
+	}
+
+	var dm tailcfg.DERPMap
+	if err = json.Unmarshal(buf, &dm); err != nil {
+		return nil, errors.Wrap(err, "invalid derp.map_inline")
+	}
+
+	return &dm, nil
+}
+
+// Status returns the status of all the sources loaded so far
+func Status() []SourceStatus {
+	state.Lock()
+	defer state.Unlock()
+
+	var status = make([]SourceStatus, 0, len(state.status))
+	for _, s := range state.status {
+		status = append(status, *s)
+	}
+
+	return status
+}
+
+// Age returns the age of the served derp map, ie. the time since the least recently refreshed source was fetched.
+// It returns zero if no map has been loaded yet.
+func Age() time.Duration {
+	state.Lock()
+	defer state.Unlock()
+
+	var oldest time.Time
+	for _, s := range state.status {
+		if oldest.IsZero() || s.LastRefresh.Before(oldest) {
+			oldest = s.LastRefresh
 		}
+	}
+
+	if oldest.IsZero() {
+		return 0
+	}
 
-		var resp *http.Response
-		if resp, err = http.DefaultClient.Do(req); err != nil {
-			return nil, err
+	return time.Since(oldest)
+}
+
+// Diff compares the regions of two derp maps, returning the ids of the regions that were added, removed or changed
+// in next, sorted in ascending order. A nil map has no regions.
+func Diff(prev, next *tailcfg.DERPMap) (added, removed, changed []int) {
+	var regions = func(dm *tailcfg.DERPMap) map[int]*tailcfg.DERPRegion {
+		if dm == nil {
+			return nil
 		}
+		return dm.Regions
+	}
 
-		var dm tailcfg.DERPMap
-		if err = json.NewDecoder(resp.Body).Decode(&dm); err != nil {
-			_ = resp.Body.Close()
-			return nil, err
+	var p, n = regions(prev), regions(next)
+	for id, r := range n {
+		if old, ok := p[id]; !ok {
+			added = append(added, id)
+		} else if util.Checksum(old) != util.Checksum(r) {
+			changed = append(changed, id)
 		}
+	}
 
-		_ = resp.Body.Close()
+	for id := range p {
+		if _, ok := n[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+
+	slices.Sort(added)
+	slices.Sort(removed)
+	slices.Sort(changed)
+	return added, removed, changed
+}
 
-		for id, r := range dm.Regions {
-			result.Regions[id] = r
+// Refresh re-loads the derp map from the sources every RefreshInterval, passing the merged map to apply,
+// until the context is cancelled. Failures are logged, and the previous map stays in use. It blocks and must be run in a goroutine.
+func Refresh(ctx context.Context, srcs []string, apply func(*tailcfg.DERPMap)) {
+	log := zerolog.Ctx(ctx).With().Str("component", "derp").Logger()
+
+	var ticker = time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	var reset = func() {
+		if interval := time.Duration(RefreshInterval.Get()); interval > 0 {
+			ticker.Reset(interval)
+		} else {
+			ticker.Stop()
 		}
 	}
 
-	return result, nil
+	changes, unwatch := settings.Watch(RefreshInterval.Name)
+	defer unwatch()
+
+	reset()
+	for {
+		select {
+		case <-ticker.C:
+			dm, err := Load(srcs)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to refresh derp map")
+				continue
+			}
+
+			for _, s := range Status() {
+				if s.LastError != "" {
+					log.Warn().Str("source", s.Source).Str("error", s.LastError).Msg("failed to refresh derp source; using its last known map")
+				}
+			}
+
+			apply(dm)
+
+		case <-changes:
+			reset()
+
+		case <-ctx.Done():
+			return
+		}
+	}
 }
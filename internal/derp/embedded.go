@@ -0,0 +1,140 @@
+package derp
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/rs/zerolog"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// EmbeddedConfig configures the derp relay and stun responder embedded in the coordination server.
+type EmbeddedConfig struct {
+	// Enabled starts the embedded derp relay, and adds its region to the derp map sent to clients
+	Enabled bool `viper:"derp.embedded.enabled"`
+
+	// Region advertised in the derp map. The id must not conflict with any region loaded from derp.sources;
+	// ids 900-999 are reserved by Tailscale for custom regions.
+	RegionID   int    `viper:"derp.embedded.region_id" default:"900"`
+	RegionCode string `viper:"derp.embedded.region_code" default:"wirefire"`
+	RegionName string `viper:"derp.embedded.region_name" default:"Wirefire Embedded DERP"`
+
+	// STUNAddr is the udp address the stun responder listens on. The responder is disabled if empty.
+	STUNAddr string `viper:"derp.embedded.stun_listen_addr" default:":3478"`
+
+	// IPv4 and IPv6 are the server's optional, public addresses. Clients resolve the server's host name if not set.
+	IPv4 string `viper:"derp.embedded.ipv4"`
+	IPv6 string `viper:"derp.embedded.ipv6"`
+
+	// BaseUrl is the server's public url. Clients connect to the relay at <server.url>/derp, which must be served over https.
+	BaseUrl *url.URL `viper:"server.url"`
+}
+
+func init() {
+	config.Register[EmbeddedConfig]()
+}
+
+// Embedded is a derp relay, and stun responder, embedded in the coordination server.
+type Embedded struct {
+	cfg    *EmbeddedConfig
+	server *derp.Server
+}
+
+// NewEmbedded creates a new embedded derp relay, with a new, random private key.
+func NewEmbedded(ctx context.Context, cfg *EmbeddedConfig) *Embedded {
+	log := zerolog.Ctx(ctx).With().Str("component", "derp").Logger()
+	var logf = func(format string, args ...any) { log.Debug().Msgf(format, args...) }
+
+	return &Embedded{cfg: cfg, server: derp.NewServer(key.NewNode(), logf)}
+}
+
+// Region returns the derp region served by the embedded relay, to be added to the derp map sent to clients.
+func (e *Embedded) Region() *tailcfg.DERPRegion {
+	var node = &tailcfg.DERPNode{
+		Name:     fmt.Sprintf("%da", e.cfg.RegionID),
+		RegionID: e.cfg.RegionID,
+		HostName: e.cfg.BaseUrl.Hostname(),
+		IPv4:     e.cfg.IPv4,
+		IPv6:     e.cfg.IPv6,
+		STUNPort: -1, // disabled, unless the stun responder is configured
+	}
+
+	if port, _ := strconv.Atoi(e.cfg.BaseUrl.Port()); port != 0 && port != 443 {
+		node.DERPPort = port
+	}
+
+	if _, p, err := net.SplitHostPort(e.cfg.STUNAddr); err == nil {
+		node.STUNPort, _ = strconv.Atoi(p)
+	}
+
+	return &tailcfg.DERPRegion{
+		RegionID:   e.cfg.RegionID,
+		RegionCode: e.cfg.RegionCode,
+		RegionName: e.cfg.RegionName,
+		Nodes:      []*tailcfg.DERPNode{node},
+	}
+}
+
+// Mount registers the relay's endpoints with the router: /derp for relayed connections, along with
+// the /derp/probe, /derp/latency-check and /generate_204 endpoints used by clients to measure latency and connectivity.
+func (e *Embedded) Mount(r chi.Router) {
+	r.Handle("/derp", derphttp.Handler(e.server))
+	r.HandleFunc("/derp/probe", derphttp.ProbeHandler)
+	r.HandleFunc("/derp/latency-check", derphttp.ProbeHandler)
+	r.HandleFunc("/generate_204", derphttp.ServeNoContent)
+}
+
+// ServeSTUN runs the stun responder, used by clients to discover their public address, until the context is cancelled.
+func (e *Embedded) ServeSTUN(ctx context.Context) error {
+	log := zerolog.Ctx(ctx).With().Str("component", "stun").Logger()
+
+	pc, err := net.ListenPacket("udp", e.cfg.STUNAddr)
+	if err != nil {
+		return err
+	}
+
+	go func() { <-ctx.Done(); _ = pc.Close() }()
+
+	log.Info().Str("addr", pc.LocalAddr().String()).Msg("starting stun responder")
+
+	var buf [64 << 10]byte
+	for {
+		n, addr, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			log.Error().Err(err).Msg("failed to read packet")
+			continue
+		}
+
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok || !stun.Is(buf[:n]) {
+			continue
+		}
+
+		txId, err := stun.ParseBindingRequest(buf[:n])
+		if err != nil {
+			log.Debug().Err(err).Str("addr", ua.String()).Msg("invalid stun binding request")
+			continue
+		}
+
+		var ap = ua.AddrPort()
+		if _, err = pc.WriteTo(stun.Response(txId, netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())), addr); err != nil {
+			log.Debug().Err(err).Str("addr", ua.String()).Msg("failed to write stun response")
+		}
+	}
+}
+
+// Close stops the relay, disconnecting all clients.
+func (e *Embedded) Close() error { return e.server.Close() }
@@ -0,0 +1,60 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"net/netip"
+)
+
+// ReserveAddr reserves the address in the tailnet, returning true if it was reserved, or false if it's already allocated.
+// The reservation is claimed by the machine the address is assigned to, using ClaimAddrs, in the same transaction.
+//
+// Addresses that are allocated to a machine that no longer exists are reclaimed, and reserved again.
+func ReserveAddr(tailnet *Tailnet, addr netip.Addr) database.Q[bool] {
+	return database.Q[bool]{
+		QueryStr: `
+			INSERT INTO ip_allocations (tailnet_id, addr) VALUES ($1, $2)
+				ON CONFLICT (tailnet_id, addr) DO UPDATE SET machine_id = NULL, created_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+				WHERE machine_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM machines WHERE id = ip_allocations.machine_id)
+			RETURNING true
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(tailnet.ID))
+			stmt.BindText(2, addr.String())
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*bool, error) {
+			reserved := stmt.ColumnInt(0) == 1
+			return &reserved, nil
+		},
+	}
+}
+
+// ClaimAddrs assigns the machine's reserved addresses to it.
+func ClaimAddrs(m *Machine) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE ip_allocations SET machine_id = ? WHERE tailnet_id = ? AND addr IN (?, ?) AND machine_id IS NULL",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			ipv6, _ := m.IPv6.MarshalText() // zero value is marshalled as empty string
+
+			stmt.BindInt64(1, int64(m.ID))
+			stmt.BindInt64(2, int64(m.TailnetID))
+			stmt.BindText(3, m.IPv4.String())
+			stmt.BindText(4, string(ipv6))
+			return nil
+		},
+	}
+}
+
+// ReleaseAddrs releases all addresses allocated to the machine, so that they can be allocated again.
+func ReleaseAddrs(m *Machine) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "DELETE FROM ip_allocations WHERE machine_id = ?",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindInt64(1, int64(m.ID))
+			return nil
+		},
+	}
+}
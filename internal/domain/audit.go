@@ -0,0 +1,325 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"strings"
+	"time"
+)
+
+// List of actions recorded in the audit log
+const (
+	ActionRegistrationStarted      = "registration.started"
+	ActionRegistrationExpired      = "registration.expired"
+	ActionRegistrationAbandoned    = "registration.abandoned"
+	ActionLoginDenied              = "login.denied"
+	ActionMachineCreated           = "machine.created"
+	ActionMachineDeleted           = "machine.deleted"
+	ActionMachineAddrChanged       = "machine.address_changed"
+	ActionMachineRenamed           = "machine.renamed"
+	ActionMachineVisibilityChanged = "machine.visibility_changed"
+	ActionMachineRelayChanged      = "machine.relay_changed"
+	ActionMachineSiteChanged       = "machine.site_changed"
+	ActionMachineLockChanged       = "machine.lock_changed"
+	ActionMachineAuthorized        = "machine.authorized"
+	ActionMachineApprovalExpired   = "machine.approval_expired"
+	ActionMachineRoutesChanged     = "machine.routes_changed"
+	ActionMachineRoutesAdvertised  = "machine.routes_advertised"
+	ActionMachineKeyExpired        = "machine.key_expired"
+	ActionMachineKeyRenewed        = "machine.key_renewed"
+	ActionMachineLoggedOut         = "machine.logged_out"
+	ActionMachineReauthenticated   = "machine.reauthenticated"
+	ActionMachineExported          = "machine.exported"
+	ActionMachineImported          = "machine.imported"
+	ActionAuthKeyCreated           = "auth_key.created"
+	ActionAuthKeyRevoked           = "auth_key.revoked"
+	ActionTailnetCreated           = "tailnet.created"
+	ActionTailnetUpdated           = "tailnet.updated"
+	ActionTailnetDeleted           = "tailnet.deleted"
+	ActionPolicyUpdated            = "tailnet.policy_updated"
+	ActionNetmapSizeExceeded       = "tailnet.netmap_size_exceeded"
+	ActionSharedPolicyUpdated      = "shared_policy.updated"
+	ActionSharedPolicyDeleted      = "shared_policy.deleted"
+	ActionMemberAdded              = "member.added"
+	ActionMemberUpdated            = "member.updated"
+	ActionMemberRemoved            = "member.removed"
+	ActionUserRevoked              = "user.revoked"
+	ActionUserEnabled              = "user.enabled"
+	ActionSettingUpdated           = "setting.updated"
+	ActionSettingReset             = "setting.reset"
+	ActionNoticeCreated            = "notice.created"
+	ActionNoticeDeleted            = "notice.deleted"
+	ActionDatabaseBackup           = "database.backup"
+	ActionSSHCheckCompleted        = "ssh.check_completed"
+	ActionWebhookCreated           = "webhook.created"
+	ActionWebhookDeleted           = "webhook.deleted"
+)
+
+// AuditEvent represents a single, security-relevant event recorded in the audit log.
+//
+// Events are append-only and are never modified once written. Where possible, events capture
+// the client's ip address and its resolved Location so that admins can spot devices connecting from unexpected places.
+type AuditEvent struct {
+	ID         int               `db:"id" json:"id"`                             // auto-generated, sequential identifier for the event
+	Action     string            `db:"action" json:"action"`                     // action that was performed, eg. machine.created
+	Actor      string            `db:"actor" json:"actor"`                       // identity of the user / machine that performed the action
+	Target     string            `db:"target" json:"target"`                     // identity of the object the action was performed on
+	TailnetID  *int              `db:"tailnet_id" json:"tailnet_id,omitempty"`   // tailnet the event belongs to, if any
+	ClientAddr string            `db:"client_addr" json:"client_addr,omitempty"` // ip address of the client that performed the action
+	Location   *Location         `db:"location,json" json:"location,omitempty"`  // resolved geo / asn location of ClientAddr
+	Data       map[string]string `db:"data,json" json:"data,omitempty"`          // additional, action specific details
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// RecordEvent appends the given event(s) to the audit log.
+func RecordEvent(events ...*AuditEvent) database.I[database.EmptyResponse, *AuditEvent] {
+	return database.I[database.EmptyResponse, *AuditEvent]{
+		QueryStr: `INSERT INTO audit_log (action, actor, target, tailnet_id, client_addr, location, data) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		ArgSet:   events,
+		Bind: func(stmt *sqlite.Stmt, e *AuditEvent) error {
+			stmt.BindText(1, e.Action)
+			stmt.BindText(2, e.Actor)
+			stmt.BindText(3, e.Target)
+
+			if e.TailnetID != nil {
+				stmt.BindInt64(4, int64(*e.TailnetID))
+			} else {
+				stmt.BindNull(4)
+			}
+
+			stmt.BindText(5, e.ClientAddr)
+
+			if e.Location != nil {
+				location, err := json.Marshal(e.Location)
+				if err != nil {
+					return err
+				}
+				stmt.BindBytes(6, location)
+			} else {
+				stmt.BindNull(6)
+			}
+
+			var data = e.Data
+			if data == nil {
+				data = map[string]string{}
+			}
+
+			buf, err := json.Marshal(data)
+			stmt.BindBytes(7, buf)
+
+			return err
+		},
+	}
+}
+
+// ListAuditEvents returns the most recent audit events, newest first. If tailnet is non-zero,
+// only events belonging to that tailnet are returned.
+func ListAuditEvents(tailnet int64, limit int) database.Q[AuditEvent] {
+	return database.Q[AuditEvent]{
+		QueryStr: `SELECT * FROM audit_log WHERE ($1 = 0 OR tailnet_id = $1) ORDER BY id DESC LIMIT $2`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnet)
+			stmt.BindInt64(2, int64(limit))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*AuditEvent, error) {
+			return database.ScanAs[AuditEvent](stmt)
+		},
+	}
+}
+
+// auditColumns are the columns of the audit log that SearchAuditEvents filters and sorts on, by name, as sql expressions
+var auditColumns = map[string]string{
+	"id":          "id",
+	"action":      "action",
+	"actor":       "actor",
+	"target":      "target",
+	"client_addr": "client_addr",
+	"created_at":  "julianday(created_at)",
+}
+
+// AuditFilter is a condition on a column of the audit log
+type AuditFilter struct {
+	Column string // one of id, action, actor, target, client_addr or created_at
+	Op     string // one of =, !=, <, <=, >, >= or ~ (case-insensitive substring match, on text columns)
+	Value  any    // an int, string or time.Time, as per Column
+}
+
+// AuditOrder is a sort key of the audit log
+type AuditOrder struct {
+	Column string // one of the columns AuditFilter accepts
+	Desc   bool
+}
+
+// SearchAuditEvents returns up to limit audit events that match all the filters, sorted in the given order. If after
+// is non-nil, it holds the values of the order's columns of an event, and only the events sorted after it are returned.
+// If tailnet is non-zero, only events belonging to that tailnet are returned.
+func SearchAuditEvents(tailnet int64, filters []AuditFilter, order []AuditOrder, after []any, limit int) database.Q[AuditEvent] {
+	var err error
+	var column = func(name string) (expr, param string) {
+		if name == "created_at" {
+			return auditColumns[name], "julianday(?)" // timestamps are compared as julian days, as in HasAuditEvent
+		}
+
+		if expr, ok := auditColumns[name]; ok {
+			return expr, "?"
+		}
+
+		err = errors.Errorf("domain: unknown audit log column %q", name)
+		return "NULL", "?"
+	}
+
+	var where, args = []string{"(? = 0 OR tailnet_id = ?)"}, []any{tailnet, tailnet}
+	for _, f := range filters {
+		var expr, param = column(f.Column)
+		switch f.Op {
+		case "~":
+			where = append(where, "instr(lower("+expr+"), lower("+param+")) > 0")
+		case "=", "!=", "<", "<=", ">", ">=":
+			where = append(where, expr+" "+f.Op+" "+param)
+		default:
+			err = errors.Errorf("domain: unknown operator %q", f.Op)
+		}
+		args = append(args, f.Value)
+	}
+
+	// events after the cursor sort after it on the first key, or are equal on it and sort after it on the next, and so on
+	if after != nil {
+		if len(after) != len(order) {
+			err = errors.New("domain: cursor doesn't match the sort order")
+		}
+
+		var keyset []string
+		for i := 0; i < len(order) && i < len(after); i++ {
+			var terms []string
+			for j, o := range order[:i+1] {
+				var expr, param = column(o.Column)
+				var op = "="
+				if j == i && o.Desc {
+					op = "<"
+				} else if j == i {
+					op = ">"
+				}
+
+				terms = append(terms, expr+" "+op+" "+param)
+				args = append(args, after[j])
+			}
+			keyset = append(keyset, "("+strings.Join(terms, " AND ")+")")
+		}
+		where = append(where, "("+strings.Join(keyset, " OR ")+")")
+	}
+
+	var sort []string
+	for _, o := range order {
+		var expr, _ = column(o.Column)
+		if o.Desc {
+			expr += " DESC"
+		}
+		sort = append(sort, expr)
+	}
+
+	var query = "SELECT * FROM audit_log WHERE " + strings.Join(where, " AND ")
+	if len(sort) > 0 {
+		query += " ORDER BY " + strings.Join(sort, ", ")
+	}
+
+	return database.Q[AuditEvent]{
+		QueryStr: query + " LIMIT ?",
+		Bind: func(stmt *sqlite.Stmt) error {
+			if err != nil {
+				return err
+			}
+
+			for i, arg := range append(args, limit) {
+				switch v := arg.(type) {
+				case int:
+					stmt.BindInt64(i+1, int64(v))
+				case int64:
+					stmt.BindInt64(i+1, v)
+				case string:
+					stmt.BindText(i+1, v)
+				case time.Time:
+					stmt.BindText(i+1, v.UTC().Format(timestampFormat))
+				default:
+					return errors.Errorf("domain: unsupported value %v", v)
+				}
+			}
+
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*AuditEvent, error) {
+			return database.ScanAs[AuditEvent](stmt)
+		},
+	}
+}
+
+// ListAuditEventsAfter returns the audit events recorded after the event with the given id, oldest first
+func ListAuditEventsAfter(id, limit int) database.Q[AuditEvent] {
+	return database.Q[AuditEvent]{
+		QueryStr: `SELECT * FROM audit_log WHERE id > $1 ORDER BY id LIMIT $2`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(id))
+			stmt.BindInt64(2, int64(limit))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*AuditEvent, error) {
+			return database.ScanAs[AuditEvent](stmt)
+		},
+	}
+}
+
+// HasAuditEvent returns true if an event with the given action was recorded, for the target in the tailnet, at or after since
+func HasAuditEvent(tailnetID int, action, target string, since time.Time) database.Q[bool] {
+	return database.Q[bool]{
+		QueryStr: `
+			SELECT EXISTS (
+				SELECT 1 FROM audit_log
+				WHERE tailnet_id = $1 AND action = $2 AND target = $3 AND julianday(created_at) >= julianday($4)
+			)`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(tailnetID))
+			stmt.BindText(2, action)
+			stmt.BindText(3, target)
+			stmt.BindText(4, since.UTC().Format(timestampFormat))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*bool, error) {
+			ok := stmt.ColumnInt(0) == 1
+			return &ok, nil
+		},
+	}
+}
+
+// GetAuditCursor returns the id of the last audit event exported by the named exporter. Exporters without a cursor start
+// from the most recent event (and so, only export events recorded after they were first configured).
+func GetAuditCursor(exporter string) database.Q[int] {
+	return database.Q[int]{
+		QueryStr: `SELECT coalesce((SELECT last_id FROM audit_exports WHERE exporter = $1), (SELECT max(id) FROM audit_log), 0)`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, exporter)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*int, error) {
+			id := stmt.ColumnInt(0)
+			return &id, nil
+		},
+	}
+}
+
+// SetAuditCursor records the id of the last audit event exported by the named exporter
+func SetAuditCursor(exporter string, id int) database.I[database.EmptyResponse, string] {
+	return database.I[database.EmptyResponse, string]{
+		QueryStr: `
+			INSERT INTO audit_exports (exporter, last_id) VALUES (?, ?)
+			ON CONFLICT (exporter) DO UPDATE SET last_id = excluded.last_id, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')`,
+		ArgSet: []string{exporter},
+		Bind: func(stmt *sqlite.Stmt, exporter string) error {
+			stmt.BindText(1, exporter)
+			stmt.BindInt64(2, int64(id))
+			return nil
+		},
+	}
+}
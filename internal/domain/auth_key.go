@@ -0,0 +1,209 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"strings"
+	"tailscale.com/util/rands"
+	"time"
+)
+
+// authKeyPrefix is prepended to all generated auth keys to make them easy to identify (eg. by secret scanners)
+const authKeyPrefix = "wfkey"
+
+// ErrInvalidAuthKey is returned when an auth key is malformed, unknown, revoked, expired or already used.
+var ErrInvalidAuthKey = errors.New("invalid auth key")
+
+// AuthKey is a pre-authentication key used to register machines without going through the interactive oidc flow.
+// It's useful for headless machines, servers and containers. For details, see https://tailscale.com/kb/1085/auth-keys
+//
+// A key is formatted as wfkey-<prefix>-<secret> where prefix is the key's public identifier. Only the
+// hash of the secret is stored in the database, and so the complete key is only available when it's generated.
+type AuthKey struct {
+	ID          int    `db:"id" json:"id"`                             // auto-generated, sequential identifier for the key
+	Prefix      string `db:"prefix" json:"prefix"`                     // random, public identifier that's embedded in the key
+	Hash        string `db:"hash" json:"-"`                            // hex-encoded sha256 hash of the key's secret
+	Description string `db:"description" json:"description,omitempty"` // optional, user-provided description of the key
+
+	Reusable  bool     `db:"reusable" json:"reusable"`   // can the key be used to register more than one machine?
+	Ephemeral bool     `db:"ephemeral" json:"ephemeral"` // are machines registered with this key ephemeral?
+	Tags      []string `db:"tags,json" json:"tags"`      // tags applied to machines registered with this key
+
+	TailnetID int `db:"tailnet_id" json:"tailnet_id"` // tailnet that machines registered with this key join
+	UserID    int `db:"user_id" json:"user_id"`       // user that owns machines registered with this key
+
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	ExpiresAt *time.Time `db:"expires_at" json:"expires_at,omitempty"`
+	RevokedAt *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+	UsedAt    *time.Time `db:"used_at" json:"used_at,omitempty"`
+}
+
+// GenerateAuthKey generates a new random auth key. It returns the complete key, which must be handed over
+// to the user, and an AuthKey with the Prefix and Hash fields populated.
+func GenerateAuthKey() (string, *AuthKey) {
+	var prefix, secret = rands.HexString(12), rands.HexString(32)
+	return fmt.Sprintf("%s-%s-%s", authKeyPrefix, prefix, secret), &AuthKey{Prefix: prefix, Hash: hashSecret(secret)}
+}
+
+// ParseAuthKey splits the complete key into its prefix and secret parts.
+func ParseAuthKey(key string) (prefix, secret string, err error) {
+	var parts = strings.Split(key, "-")
+	if len(parts) != 3 || parts[0] != authKeyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", ErrInvalidAuthKey
+	}
+
+	return parts[1], parts[2], nil
+}
+
+// Verify returns true if the given secret matches the key's hash.
+func (k *AuthKey) Verify(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(k.Hash)) == 1
+}
+
+// IsValid returns true if the key has not been revoked or expired, and is either reusable or has not been used yet.
+func (k *AuthKey) IsValid() bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || k.ExpiresAt.After(time.Now())) && (k.Reusable || k.UsedAt == nil)
+}
+
+func hashSecret(secret string) string {
+	var sum = sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAuthKey creates a new auth key and returns the created record.
+// Use GenerateAuthKey to generate the key's Prefix and Hash.
+func CreateAuthKey(k *AuthKey) database.Q[AuthKey] {
+	return database.Q[AuthKey]{
+		QueryStr: `
+			INSERT INTO auth_keys (prefix, hash, description, reusable, ephemeral, tags, tailnet_id, user_id, expires_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING *
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, k.Prefix)
+			stmt.BindText(2, k.Hash)
+			stmt.BindText(3, k.Description)
+			stmt.BindBool(4, k.Reusable)
+			stmt.BindBool(5, k.Ephemeral)
+
+			var tags = k.Tags
+			if tags == nil {
+				tags = []string{}
+			}
+
+			buf, err := json.Marshal(tags)
+			if err != nil {
+				return err
+			}
+			stmt.BindBytes(6, buf)
+
+			stmt.BindInt64(7, int64(k.TailnetID))
+			stmt.BindInt64(8, int64(k.UserID))
+
+			if k.ExpiresAt != nil {
+				stmt.BindText(9, k.ExpiresAt.UTC().Format(timestampFormat))
+			} else {
+				stmt.BindNull(9)
+			}
+
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*AuthKey, error) {
+			return database.ScanAs[AuthKey](stmt)
+		},
+	}
+}
+
+// ListAuthKeys returns all auth keys (including revoked and expired ones) for the given tailnet.
+func ListAuthKeys(tailnet int64) database.Q[AuthKey] {
+	return database.Q[AuthKey]{
+		QueryStr: "SELECT * FROM auth_keys WHERE tailnet_id = $1 ORDER BY id",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnet)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*AuthKey, error) {
+			return database.ScanAs[AuthKey](stmt)
+		},
+	}
+}
+
+// AuthKeyByPrefix returns the auth key identified by the given prefix.
+func AuthKeyByPrefix(prefix string) database.Q[AuthKey] {
+	return database.Q[AuthKey]{
+		QueryStr: "SELECT * FROM auth_keys WHERE prefix = $1",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, prefix)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*AuthKey, error) {
+			return database.ScanAs[AuthKey](stmt)
+		},
+	}
+}
+
+// UseAuthKey atomically marks the key as used, and returns the updated record. It returns no rows if the key
+// cannot be used (ie. it has been revoked, has expired, or is a single-use key that has already been used).
+func UseAuthKey(k *AuthKey) database.Q[AuthKey] {
+	return database.Q[AuthKey]{
+		QueryStr: `
+			UPDATE auth_keys SET used_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+			WHERE id = $1
+			  AND revoked_at IS NULL
+			  AND (expires_at IS NULL OR expires_at > strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+			  AND (reusable OR used_at IS NULL)
+			RETURNING *
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(k.ID))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*AuthKey, error) {
+			return database.ScanAs[AuthKey](stmt)
+		},
+	}
+}
+
+// RevokeAuthKey revokes the auth key identified by id in the given tailnet, and returns the revoked record.
+// Machines already registered using the key are not affected.
+func RevokeAuthKey(tailnet int64, id int) database.Q[AuthKey] {
+	return database.Q[AuthKey]{
+		QueryStr: `
+			UPDATE auth_keys SET revoked_at = COALESCE(revoked_at, strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+			WHERE tailnet_id = $1 AND id = $2
+			RETURNING *
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnet)
+			stmt.BindInt64(2, int64(id))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*AuthKey, error) {
+			return database.ScanAs[AuthKey](stmt)
+		},
+	}
+}
+
+// RevokeUserAuthKeys revokes all unrevoked auth keys owned by the user, across all tailnets, and returns the revoked records.
+func RevokeUserAuthKeys(u *User) database.Q[AuthKey] {
+	return database.Q[AuthKey]{
+		QueryStr: `
+			UPDATE auth_keys SET revoked_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+			WHERE user_id = $1 AND revoked_at IS NULL
+			RETURNING *
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(u.ID))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*AuthKey, error) {
+			return database.ScanAs[AuthKey](stmt)
+		},
+	}
+}
@@ -0,0 +1,180 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"tailscale.com/util/dnsname"
+)
+
+// DNS holds a tailnet's custom dns settings. These are merged with the MagicDNS configuration
+// before being delivered to clients (see: coordinator.DnsConfig.Adapt).
+type DNS struct {
+	// Nameservers are global resolvers used by clients for all queries, overriding the operating system's resolvers.
+	Nameservers []string `json:"nameservers,omitempty"`
+
+	// FallbackResolvers are used by clients when they cannot determine the operating system's default resolvers.
+	FallbackResolvers []string `json:"fallback_resolvers,omitempty"`
+
+	// Routes maps a domain to the resolvers used for queries under it (split dns). An empty list
+	// of resolvers means that queries for the domain are answered by the client's built-in resolver.
+	Routes map[string][]string `json:"routes,omitempty"`
+
+	// SearchDomains are appended to the client's search domains, after the MagicDNS domain.
+	SearchDomains []string `json:"search_domains,omitempty"`
+
+	// ExtraRecords are answered by the client's built-in resolver, in addition to the MagicDNS names of machines.
+	ExtraRecords []DNSRecord `json:"extra_records,omitempty"`
+}
+
+// DNSRecord is an extra dns record served to the tailnet's machines
+type DNSRecord struct {
+	Name  string `json:"name"`  // fully qualified domain name of the record; the trailing dot is optional
+	Type  string `json:"type"`  // one of A, AAAA or TXT; clients currently ignore TXT records
+	Value string `json:"value"` // ip address for A and AAAA records, or the text value of TXT records
+}
+
+// Validate checks that the record's name is a valid domain name, and its value matches its type.
+func (r *DNSRecord) Validate() error {
+	if _, err := dnsname.ToFQDN(r.Name); err != nil || r.Name == "" {
+		return errors.Errorf("invalid record name %q", r.Name)
+	}
+
+	switch r.Type {
+	case "A", "AAAA":
+		if addr, err := netip.ParseAddr(r.Value); err != nil || addr.Is4() != (r.Type == "A") {
+			return errors.Errorf("invalid value %q for %s record %q", r.Value, r.Type, r.Name)
+		}
+	case "TXT":
+		if r.Value == "" || len(r.Value) > 255 {
+			return errors.Errorf("value of TXT record %q must be between 1 and 255 bytes", r.Name)
+		}
+	default:
+		return errors.Errorf("unsupported type %q for record %q; must be one of A, AAAA or TXT", r.Type, r.Name)
+	}
+
+	return nil
+}
+
+// ReverseZones returns the reverse dns zones (under in-addr.arpa or ip6.arpa) that together cover the prefix. Zones are
+// delegated on octet (ipv4) or nibble (ipv6) boundaries, and so, a prefix that isn't aligned to one is covered by all zones
+// at the next boundary, eg. 100.64.0.0/10 is covered by the 64 zones from 64.100.in-addr.arpa to 127.100.in-addr.arpa.
+func ReverseZones(prefix netip.Prefix) []string {
+	prefix = prefix.Masked()
+
+	var width, base, suffix = 8, 10, "in-addr.arpa"
+	if prefix.Addr().Is6() {
+		width, base, suffix = 4, 16, "ip6.arpa"
+	}
+
+	var labels []int // octets, or nibbles, of the address; most significant first
+	for _, b := range prefix.Addr().AsSlice() {
+		if width == 8 {
+			labels = append(labels, int(b))
+		} else {
+			labels = append(labels, int(b>>4), int(b&0xf))
+		}
+	}
+
+	var n = (prefix.Bits() + width - 1) / width // number of labels in each zone's name, before the suffix
+	if n == 0 {
+		return []string{suffix}
+	}
+
+	var count = 1 << (n*width - prefix.Bits())
+	var zones = make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		var parts = make([]string, 0, n+1)
+		for j := n - 1; j >= 0; j-- {
+			var label = labels[j]
+			if j == n-1 {
+				label += i // low bits of the last label are zero in the masked prefix
+			}
+			parts = append(parts, strconv.FormatInt(int64(label), base))
+		}
+
+		zones = append(zones, strings.Join(append(parts, suffix), "."))
+	}
+
+	return zones
+}
+
+// ValidateResolver checks that addr is a valid resolver address, ie. an ip address with an optional
+// port (eg. 1.1.1.1 or [2606:4700:4700::1111]:53) or the https url of a DNS-over-HTTPS resolver.
+func ValidateResolver(addr string) error {
+	if strings.HasPrefix(addr, "https://") {
+		if u, err := url.Parse(addr); err != nil || u.Host == "" {
+			return errors.Errorf("invalid DNS-over-HTTPS resolver %q", addr)
+		}
+		return nil
+	}
+
+	if _, err := netip.ParseAddr(addr); err == nil {
+		return nil
+	}
+
+	if _, err := netip.ParseAddrPort(addr); err != nil {
+		return errors.Errorf("invalid resolver address %q", addr)
+	}
+
+	return nil
+}
+
+// Validate checks that all resolver addresses, domains and records are valid.
+func (d *DNS) Validate() error {
+	for _, addr := range slices.Concat(d.Nameservers, d.FallbackResolvers) {
+		if err := ValidateResolver(addr); err != nil {
+			return err
+		}
+	}
+
+	for _, domain := range d.SearchDomains {
+		if _, err := dnsname.ToFQDN(domain); err != nil || domain == "" {
+			return errors.Errorf("invalid search domain %q", domain)
+		}
+	}
+
+	for _, record := range d.ExtraRecords {
+		if err := record.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for domain, resolvers := range d.Routes {
+		if _, err := dnsname.ToFQDN(domain); err != nil || domain == "" {
+			return errors.Errorf("invalid route domain %q", domain)
+		}
+
+		for _, addr := range resolvers {
+			if err := ValidateResolver(addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetTailnetDNS replaces the tailnet's dns settings.
+func SetTailnetDNS(t *Tailnet, dns *DNS) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET dns = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			buf, err := json.Marshal(dns)
+			if err != nil {
+				return err
+			}
+
+			stmt.BindBytes(1, buf)
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,35 @@
+package domain
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestReverseZones(t *testing.T) {
+	var cases = []struct {
+		prefix string
+		count  int
+		first  string
+		last   string
+	}{
+		{"10.0.0.0/8", 1, "10.in-addr.arpa", "10.in-addr.arpa"},
+		{"192.168.1.0/24", 1, "1.168.192.in-addr.arpa", "1.168.192.in-addr.arpa"},
+		{"100.64.0.0/10", 64, "64.100.in-addr.arpa", "127.100.in-addr.arpa"},
+		{"fd7a:115c:a1e0::/48", 1, "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa", "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa"},
+		{"fd7a:115c:a1e0::/46", 4, "0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa", "3.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.prefix, func(t *testing.T) {
+			var zones = ReverseZones(netip.MustParsePrefix(tc.prefix))
+			if len(zones) != tc.count || zones[0] != tc.first || zones[len(zones)-1] != tc.last {
+				t.Errorf("unexpected zones %v; want %d zones from %s to %s", zones, tc.count, tc.first, tc.last)
+			}
+		})
+	}
+
+	if zones := ReverseZones(netip.MustParsePrefix("100.64.0.0/10")); slices.Contains(zones, "128.100.in-addr.arpa") {
+		t.Errorf("expected zones to stay within the prefix")
+	}
+}
@@ -0,0 +1,6 @@
+// Package domain defines wirefire's core entities and the database queries used to manage them.
+package domain
+
+// timestampFormat is the layout of timestamps generated by strftime('%Y-%m-%dT%H:%M:%fZ', 'now') in the schema.
+// Use it (with UTC time values) when binding values that are compared against such columns.
+const timestampFormat = "2006-01-02T15:04:05.000Z"
@@ -0,0 +1,72 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"time"
+)
+
+// MaxHealthWarnings is the maximum number of health warnings stored for a single machine.
+// Warnings for new subsystems are dropped once a machine has reached the limit.
+const MaxHealthWarnings = 32
+
+// HealthWarning is a health warning reported by a machine's client, eg. when it's unable to reach derp
+// servers or to configure dns. Clients report a warning when it's raised, and again when it's cleared.
+type HealthWarning struct {
+	MachineID int    `db:"machine_id" json:"machine_id"`
+	Machine   string `db:"machine" json:"machine"` // complete name of the machine
+	Subsys    string `db:"subsys" json:"subsys"`   // client subsystem (or warnable code) the warning belongs to
+	Error     string `db:"error" json:"error"`
+
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// SetHealthWarning records the warning reported by the machine for the subsystem, replacing the previous one.
+// An empty warning clears the subsystem's warning.
+func SetHealthWarning(m *Machine, subsys, warning string) database.I[database.EmptyResponse, *Machine] {
+	var query = `
+		INSERT INTO machine_health (machine_id, subsys, error)
+			SELECT $1, $2, $3 WHERE (SELECT count(*) FROM machine_health WHERE machine_id = $1 AND subsys != $2) < $4
+		ON CONFLICT (machine_id, subsys)
+			DO UPDATE SET error = EXCLUDED.error, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+	`
+
+	if warning == "" {
+		query = "DELETE FROM machine_health WHERE machine_id = $1 AND subsys = $2"
+	}
+
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: query,
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindInt64(1, int64(m.ID))
+			stmt.BindText(2, subsys)
+			if warning != "" {
+				stmt.BindText(3, warning)
+				stmt.BindInt64(4, MaxHealthWarnings)
+			}
+			return nil
+		},
+	}
+}
+
+// ListHealthWarnings returns the health warnings currently reported by machines in the tailnet,
+// or only by the given machine if machineID is non-zero.
+func ListHealthWarnings(tailnetID, machineID int64) database.Q[HealthWarning] {
+	return database.Q[HealthWarning]{
+		QueryStr: `
+			SELECT h.*, iif(m.name_idx = 0, m.name, m.name || '-' || m.name_idx) AS machine
+			FROM machine_health h JOIN machines m ON m.id = h.machine_id
+				WHERE m.tailnet_id = $1 AND ($2 = 0 OR m.id = $2)
+			ORDER BY m.id, h.subsys
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnetID)
+			stmt.BindInt64(2, machineID)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*HealthWarning, error) {
+			return database.ScanAs[HealthWarning](stmt)
+		},
+	}
+}
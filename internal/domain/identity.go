@@ -0,0 +1,195 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"net/netip"
+	"strings"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/util/rands"
+	"time"
+)
+
+// identityPrefix is prepended to all sealed machine identities, and identifies the format of the blob that follows
+const identityPrefix = "wfid1-"
+
+// IdentityValidity is how long a sealed machine identity can be imported for, after it's exported
+const IdentityValidity = 24 * time.Hour
+
+var (
+	// ErrInvalidIdentity is returned when a sealed machine identity is malformed, or wasn't sealed with the same secret
+	ErrInvalidIdentity = errors.New("invalid machine identity")
+
+	// ErrIdentityExpired is returned when a sealed machine identity was exported more than IdentityValidity ago
+	ErrIdentityExpired = errors.New("machine identity has expired; export it again")
+
+	// ErrIdentityUsed is returned when a sealed machine identity has already been imported; see ClaimIdentity
+	ErrIdentityUsed = errors.New("machine identity has already been imported; export it again")
+)
+
+// MachineIdentity is the portable identity of a machine, exported from one coordinator and imported into another, so
+// that the machine can be migrated between them without re-registering. It only carries the machine's public keys;
+// its private keys never leave the machine.
+type MachineIdentity struct {
+	ID string `json:"id"` // random id of the export; each export can only be imported once
+
+	NoiseKey key.MachinePublic `json:"noise_key"`
+	NodeKey  key.NodePublic    `json:"node_key"`
+	DiscoKey key.DiscoPublic   `json:"disco_key"`
+
+	Name      string            `json:"name"`
+	GivenName bool              `json:"given_name"`
+	IPv4      netip.Addr        `json:"ipv4"`
+	IPv6      netip.Addr        `json:"ipv6"`
+	Tags      []string          `json:"tags,omitempty"`
+	Site      string            `json:"site,omitempty"`
+	Ephemeral bool              `json:"ephemeral"`
+	HostInfo  *tailcfg.Hostinfo `json:"host_info"`
+
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	Tailnet string `json:"tailnet"` // name of the tailnet the machine was exported from
+	Issuer  string `json:"issuer"`  // issuer of the machine owner's oidc identity
+	Subject string `json:"subject"` // subject of the machine owner's oidc identity
+
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+// NewMachineIdentity returns the portable identity of the machine
+func NewMachineIdentity(m *Machine) *MachineIdentity {
+	var identity = &MachineIdentity{
+		ID:       rands.HexString(16),
+		NoiseKey: m.NoiseKey, NodeKey: m.NodeKey, DiscoKey: m.DiscoKey,
+		Name: m.Name, GivenName: m.GivenName, IPv4: m.IPv4, IPv6: m.IPv6, Tags: m.AssignedTags,
+		Site: m.Site, Ephemeral: m.Ephemeral, HostInfo: m.HostInfo,
+		CreatedAt: m.CreatedAt, ExpiresAt: m.ExpiresAt,
+		ExportedAt: time.Now().UTC(),
+	}
+
+	if m.Tailnet != nil {
+		identity.Tailnet = m.Tailnet.Name
+	}
+
+	if m.Owner != nil {
+		identity.Issuer, identity.Subject = m.Owner.Issuer, m.Owner.Subject
+	}
+
+	return identity
+}
+
+// SealIdentity encrypts the identity with a key derived from secret, which must be shared by the exporting and the
+// importing coordinators. The encryption is authenticated (aes-gcm), so a sealed identity can neither be read nor
+// forged without the secret.
+//
+// Note that anyone holding the secret can seal identities of their own making, ie. register any machine keys, with any
+// addresses and owner, with a coordinator that shares it. The secret must be guarded as closely as the api token.
+func SealIdentity(identity *MachineIdentity, secret string) (string, error) {
+	plain, err := json.Marshal(identity)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := identityCipher(secret)
+	if err != nil {
+		return "", err
+	}
+
+	var nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	var sealed = aead.Seal(nonce, nonce, plain, []byte(identityPrefix))
+	return identityPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// OpenIdentity decrypts an identity sealed using SealIdentity with the same secret. ErrInvalidIdentity is returned
+// if the blob is malformed or was sealed with a different secret, and ErrIdentityExpired if it's no longer valid.
+func OpenIdentity(blob, secret string) (*MachineIdentity, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimSpace(blob), identityPrefix)
+	if !ok {
+		return nil, ErrInvalidIdentity
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidIdentity
+	}
+
+	aead, err := identityCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrInvalidIdentity
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(identityPrefix))
+	if err != nil {
+		return nil, ErrInvalidIdentity
+	}
+
+	var identity MachineIdentity
+	if err = json.Unmarshal(plain, &identity); err != nil || identity.ID == "" {
+		return nil, ErrInvalidIdentity
+	}
+
+	if time.Since(identity.ExportedAt) > IdentityValidity {
+		return nil, ErrIdentityExpired
+	}
+
+	return &identity, nil
+}
+
+// ClaimIdentity records the import of the identity, and returns its id; nil if it has already been imported. Claims
+// are kept until the identity expires (see: DeleteImportedIdentities), after which it can't be imported anyway.
+func ClaimIdentity(identity *MachineIdentity) database.Q[string] {
+	return database.Q[string]{
+		QueryStr: "INSERT INTO imported_identities (id, exported_at) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING RETURNING id",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, identity.ID)
+			stmt.BindText(2, identity.ExportedAt.UTC().Format(timestampFormat))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*string, error) {
+			id := stmt.ColumnText(0)
+			return &id, nil
+		},
+	}
+}
+
+// DeleteImportedIdentities deletes the claims of identities exported before the given time
+func DeleteImportedIdentities(before time.Time) database.I[database.EmptyResponse, time.Time] {
+	return database.I[database.EmptyResponse, time.Time]{
+		QueryStr: "DELETE FROM imported_identities WHERE exported_at < $1",
+		ArgSet:   []time.Time{before},
+		Bind: func(stmt *sqlite.Stmt, before time.Time) error {
+			stmt.BindText(1, before.UTC().Format(timestampFormat))
+			return nil
+		},
+	}
+}
+
+// identityCipher returns the aead used to seal identities, keyed by a key derived from the shared secret
+func identityCipher(secret string) (cipher.AEAD, error) {
+	var mac = hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("wirefire machine identity"))
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
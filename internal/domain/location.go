@@ -0,0 +1,37 @@
+package domain
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Location is the geographical and network location of a client's ip address,
+// as resolved from a local GeoIP / ASN database.
+//
+// For details on how it's resolved, see geoip.Resolver
+type Location struct {
+	Country      string `json:"country,omitempty"` // ISO 3166-1 alpha-2 country code
+	City         string `json:"city,omitempty"`    // english name of the city
+	ASN          uint   `json:"asn,omitempty"`     // autonomous system number the address belongs to
+	Organization string `json:"org,omitempty"`     // organization that owns the autonomous system
+}
+
+// String returns a short, human-readable representation of the location, eg. "Mumbai, IN (AS9829 BSNL)"
+func (l *Location) String() string {
+	if l == nil {
+		return ""
+	}
+
+	var parts []string
+	if place := strings.Trim(strings.Join([]string{l.City, l.Country}, ", "), ", "); place != "" {
+		parts = append(parts, place)
+	}
+
+	if l.ASN != 0 && l.Organization != "" {
+		parts = append(parts, fmt.Sprintf("(AS%d %s)", l.ASN, l.Organization))
+	} else if l.ASN != 0 {
+		parts = append(parts, fmt.Sprintf("(AS%d)", l.ASN))
+	}
+
+	return strings.Join(parts, " ")
+}
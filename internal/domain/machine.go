@@ -4,9 +4,11 @@ import (
 	"crawshaw.io/sqlite"
 	"encoding/json"
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/riyaz-ali/tacl"
 	"github.com/riyaz-ali/wirefire/internal/database"
 	"net/netip"
+	"slices"
 	"strconv"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
@@ -15,6 +17,15 @@ import (
 	"time"
 )
 
+// ErrInvalidMachineName is returned when a machine is renamed to a name that isn't a valid dns label
+var ErrInvalidMachineName = errors.New("invalid machine name; must be a valid dns label")
+
+// ErrInvalidSite is returned when a machine is assigned to a site whose name isn't a valid dns label
+var ErrInvalidSite = errors.New("invalid site; must be a valid dns label")
+
+// ErrHostnameReserved is returned when a machine registers with, or is renamed to, a reserved hostname
+var ErrHostnameReserved = errors.New("hostname is reserved; rename the machine (eg. tailscale set --hostname) and try again")
+
 // Machine represents an individual node in the Tailnet. A machine belongs to a User,
 // and it's lifecycle is tied to the Tailnet's and the User's lifecycle.
 //
@@ -23,16 +34,42 @@ import (
 //
 // For node creation, refer to oidc.AuthComplete handler.
 type Machine struct {
-	ID        int               `db:"id"`             // auto-generated unique machine identifier
-	Name      string            `db:"name"`           // machine's hostname
-	NameIdx   int               `db:"name_idx"`       // arbiter used as suffix to guarantee unique hostname within a given tailnet
-	NoiseKey  key.MachinePublic `db:"noise_key"`      // machine's public key used when establishing secure Noise channel over /ts2021
-	NodeKey   key.NodePublic    `db:"node_key"`       // key used for wireguard tunnel and for communication over DERP
-	DiscoKey  key.DiscoPublic   `db:"disco_key"`      // key used for peer-to-peer path discovery
-	Ephemeral bool              `db:"ephemeral"`      // is the device ephemeral?
-	HostInfo  *tailcfg.Hostinfo `db:"host_info,json"` // serialized tailcfg.HostInfo object from either the first registration request or subsequent map requests
-	Endpoints []netip.AddrPort  `db:"endpoints,json"` // machine's magicsock UDP ip:port endpoints (can be public and / or private addresses)
-	IPv4      netip.Addr        `db:"ipv4"`           // assigned IPv4 address for this node
+	ID        int                `db:"id"`             // auto-generated unique machine identifier
+	Name      string             `db:"name"`           // machine's hostname
+	NameIdx   int                `db:"name_idx"`       // arbiter used as suffix to guarantee unique hostname within a given tailnet
+	NoiseKey  key.MachinePublic  `db:"noise_key"`      // machine's public key used when establishing secure Noise channel over /ts2021
+	NodeKey   key.NodePublic     `db:"node_key"`       // key used for wireguard tunnel and for communication over DERP
+	DiscoKey  key.DiscoPublic    `db:"disco_key"`      // key used for peer-to-peer path discovery
+	Ephemeral bool               `db:"ephemeral"`      // is the device ephemeral?
+	HostInfo  *tailcfg.Hostinfo  `db:"host_info,json"` // serialized tailcfg.HostInfo object from either the first registration request or subsequent map requests
+	Endpoints []tailcfg.Endpoint `db:"endpoints,json"` // machine's magicsock UDP ip:port endpoints (can be public and / or private addresses), along with their source
+	IPv4      netip.Addr         `db:"ipv4"`           // assigned IPv4 address for this node
+	IPv6      netip.Addr         `db:"ipv6"`           // assigned IPv6 address for this node; see Machine.IP
+
+	GivenName bool `db:"given_name"` // is Name given by an admin? if so, it isn't changed when the machine's hostname changes
+
+	LastAddr netip.Addr `db:"last_addr"`     // client ip address from the machine's most recent session
+	Location *Location  `db:"location,json"` // resolved geo / asn location of LastAddr
+
+	AlwaysVisible bool `db:"always_visible"` // exempts the machine from the tailnet's HideOfflineAfter policy
+	ForceDerp     bool `db:"force_derp"`     // forces connections to and from the machine to be relayed over derp
+	Locked        bool `db:"locked"`         // exempts the machine from the tailnet's DeleteExpiredAfter policy
+
+	// Site is the location (eg. an office or a datacenter) the machine is at, behind the same NAT or firewall as the
+	// other machines at the site; empty if it isn't assigned to one. Machines at the same site connect over their
+	// local endpoints, while connections between machines at different sites are relayed over derp.
+	Site string `db:"site"`
+
+	AssignedTags []string `db:"tags,json"` // tags applied to the machine, eg. by the auth key it was registered with
+
+	// Authorized is false for machines pending an admin's approval, in tailnets that require it (see Tailnet.RequireApproval).
+	// Unauthorized machines are not shown to, and can not connect to, their peers.
+	Authorized bool `db:"authorized"`
+
+	// ApprovedRoutes are the subnet routes, advertised by the machine, that have been approved; see Route.
+	//
+	// This field isn't stored in the machines table and is only added by queries that select from the routes table.
+	ApprovedRoutes []netip.Prefix `db:"approved_routes,json"`
 
 	CreatedAt time.Time  `db:"created_at"`
 	ExpiresAt time.Time  `db:"expires_at"`
@@ -44,22 +81,105 @@ type Machine struct {
 	UserID int   `db:"user_id"`
 	Owner  *User `db:"user,json"` // user this node belongs to; renamed to prevent conflict with User()
 
-	// Role of the user for whom this object was fetched.
+	// Role of the machine's owner in the tailnet.
 	//
-	// This field isn't stored in the tailnet's table and is only added by the ListMachines
-	// query to when JOINed with tailnet_members table for a given user.
+	// This field isn't stored in the machines table and is only added by queries
+	// that JOIN with the tailnet_members table (eg. ListMachines and GetMachineByKey).
 	Role string `db:"role"`
+
+	// LoggedOut is true if the machine's node key was revoked when it logged out (see: RevokeNodeKey). Logged out machines
+	// are left out of their peers' netmaps until they login again, using a new node key.
+	//
+	// This field isn't stored in the machines table and is only added by queries that list the tailnet's machines (eg. ListMachines).
+	LoggedOut bool `db:"logged_out"`
 }
 
 func (m *Machine) HostName() string           { return m.CompleteName() }
-func (m *Machine) Tags() []string             { return nil }
+func (m *Machine) Tags() []string             { return m.AssignedTags }
 func (m *Machine) User() tacl.User            { return m.Owner }
-func (m *Machine) AllowedIPs() []netip.Prefix { return nil }
-func (m *Machine) IP() (v4, v6 netip.Addr)    { return m.IPv4, tsaddr.Tailscale4To6(m.IPv4) }
+func (m *Machine) AllowedIPs() []netip.Prefix { return m.ApprovedRoutes }
+
+// IP returns the machine's IPv4 and IPv6 addresses. Machines registered before IPv6 addresses were allocated
+// natively (see: ipam.SelectIPv6) use the address derived from their IPv4 address, in Tailscale's 4to6 range.
+func (m *Machine) IP() (v4, v6 netip.Addr) {
+	if m.IPv6.IsValid() {
+		return m.IPv4, m.IPv6
+	}
+
+	return m.IPv4, tsaddr.Tailscale4To6(m.IPv4)
+}
 
 // IsExpired returns true if the machine has expired.
 func (m *Machine) IsExpired() bool { return !m.ExpiresAt.IsZero() && m.ExpiresAt.Before(time.Now()) }
 
+// IsHidden returns true if the machine has been offline for longer than its tailnet's HideOfflineAfter policy
+// permits and must be left out of its peers' netmaps. Machines that were never seen are measured from their creation time.
+func (m *Machine) IsHidden() bool {
+	if m.AlwaysVisible || m.Tailnet == nil || m.Tailnet.HideOfflineAfter <= 0 {
+		return false
+	}
+
+	var seen = m.CreatedAt
+	if m.LastSeen != nil && !m.LastSeen.IsZero() {
+		seen = *m.LastSeen
+	}
+
+	return time.Since(seen) > time.Duration(m.Tailnet.HideOfflineAfter)*24*time.Hour
+}
+
+// IsStale returns true if the machine's key expired longer ago than its tailnet's DeleteExpiredAfter
+// policy permits, and the machine must be deleted. Locked machines are never stale.
+func (m *Machine) IsStale() bool {
+	if m.Locked || m.Tailnet == nil || m.Tailnet.DeleteExpiredAfter <= 0 || !m.IsExpired() {
+		return false
+	}
+
+	return time.Since(m.ExpiresAt) > time.Duration(m.Tailnet.DeleteExpiredAfter)*24*time.Hour
+}
+
+// IsDerpOnly returns true if connections to and from the machine must be relayed over derp,
+// either due to the machine's own ForceDerp policy or its tailnet's.
+func (m *Machine) IsDerpOnly() bool {
+	return m.ForceDerp || (m.Tailnet != nil && m.Tailnet.ForceDerp)
+}
+
+// EndpointAddrs returns the ip:port addresses of the machine's endpoints
+func (m *Machine) EndpointAddrs() []netip.AddrPort {
+	var addrs = make([]netip.AddrPort, 0, len(m.Endpoints))
+	for _, ep := range m.Endpoints {
+		addrs = append(addrs, ep.Addr)
+	}
+	return addrs
+}
+
+// Endpoints combines the endpoints reported by a client, along with their types, into a canonical list of
+// tailcfg.Endpoint. Invalid addresses (eg. unspecified, multicast or with a zero port) are dropped, ipv4-mapped
+// ipv6 addresses are unmapped, and duplicates are removed, keeping the first occurrence. Types are only used
+// if the client reported a type for every endpoint; otherwise all endpoints are of tailcfg.EndpointUnknownType.
+func Endpoints(addrs []netip.AddrPort, types []tailcfg.EndpointType) []tailcfg.Endpoint {
+	var endpoints = make([]tailcfg.Endpoint, 0, len(addrs))
+	for i, ap := range addrs {
+		var addr = ap.Addr().Unmap()
+		if !ap.IsValid() || ap.Port() == 0 || addr.IsUnspecified() || addr.IsMulticast() {
+			continue
+		}
+
+		ap = netip.AddrPortFrom(addr, ap.Port())
+		if slices.ContainsFunc(endpoints, func(ep tailcfg.Endpoint) bool { return ep.Addr == ap }) {
+			continue
+		}
+
+		var ep = tailcfg.Endpoint{Addr: ap, Type: tailcfg.EndpointUnknownType}
+		if len(types) == len(addrs) {
+			ep.Type = types[i]
+		}
+
+		endpoints = append(endpoints, ep)
+	}
+
+	return endpoints
+}
+
 // CompleteName returns the machine's name with optional name_idx suffix applied.
 func (m *Machine) CompleteName() string {
 	if m.NameIdx != 0 {
@@ -101,7 +221,6 @@ func (m *Machine) AsNode() *tailcfg.Node {
 		node.DERP = fmt.Sprintf("127.3.3.40:%d", ni.PreferredDERP)
 	}
 
-	// TODO(@riyaz): also take into account approved routes for machine
 	var addrs, allowedIps []netip.Prefix
 
 	if v4, v6 := m.IP(); v4.IsValid() {
@@ -112,12 +231,16 @@ func (m *Machine) AsNode() *tailcfg.Node {
 		allowedIps = append(allowedIps, p4, p6)
 	}
 
+	// peers route traffic for approved subnet routes through the machine
+	allowedIps = append(allowedIps, m.ApprovedRoutes...)
+
 	node.Addresses = addrs
 	node.AllowedIPs = allowedIps
-	node.Endpoints = m.Endpoints
+	node.PrimaryRoutes = slices.DeleteFunc(slices.Clone(m.ApprovedRoutes), tsaddr.IsExitRoute)
+	node.Endpoints = m.EndpointAddrs()
 
-	// TODO(@riyaz): add support for tags
-	node.MachineAuthorized = true
+	node.Tags = m.AssignedTags
+	node.MachineAuthorized = m.Authorized
 
 	return node
 }
@@ -129,8 +252,8 @@ func (m *Machine) AsNode() *tailcfg.Node {
 func SaveMachine(m *Machine) database.I[Machine, *Machine] {
 	return database.I[Machine, *Machine]{
 		QueryStr: `
-			INSERT INTO machines (name, name_idx, noise_key, node_key, disco_key, ephemeral, host_info, endpoints, ipv4, expires_at, last_seen, tailnet_id, user_id)
-				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			INSERT INTO machines (name, name_idx, noise_key, node_key, disco_key, ephemeral, host_info, endpoints, ipv4, expires_at, last_seen, tailnet_id, user_id, last_addr, location, tags, ipv6, authorized)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, (SELECT NOT require_approval FROM tailnets WHERE id = $12))
 			ON CONFLICT (noise_key) 
 				DO UPDATE 
 				SET name       = EXCLUDED.name, 
@@ -140,7 +263,10 @@ func SaveMachine(m *Machine) database.I[Machine, *Machine] {
 					host_info  = EXCLUDED.host_info,
 					endpoints  = EXCLUDED.endpoints,
 					expires_at = EXCLUDED.expires_at,
-					last_seen  = EXCLUDED.last_seen
+					last_seen  = EXCLUDED.last_seen,
+					last_addr  = EXCLUDED.last_addr,
+					location   = EXCLUDED.location,
+					tags       = EXCLUDED.tags
 			RETURNING 
 			    id, 
 				name, 
@@ -152,11 +278,23 @@ func SaveMachine(m *Machine) database.I[Machine, *Machine] {
 				host_info, 
 			    endpoints,
 				ipv4, 
-			    created_at
+			    ipv6,
+			    created_at,
 				expires_at,
 			    last_seen,
+			    last_addr,
+			    location,
+			    always_visible,
+			    force_derp,
+			    locked,
+			    tags,
+			    authorized,
+			    given_name,
+			    site,
 				(SELECT json_object('ID', id, 'Subject', sub, 'Name', name, 'Claims', json(claims), 'CreatedAt', created_at) FROM users WHERE users.id = machines.user_id) AS user,
-				(SELECT json_object('ID', id, 'Name', name, 'Acl', acl) FROM tailnets WHERE tailnets.id = machines.tailnet_id) AS tailnet
+				(SELECT json_object('ID', id, 'Name', name, 'Acl', acl, 'HideOfflineAfter', hide_offline_after, 'DeleteExpiredAfter', delete_expired_after, 'ForceDerp', json(iif(force_derp, 'true', 'false')), 'Capabilities', json(capabilities), 'DNS', json(dns), 'Welcome', json(welcome), 'Features', json(features), 'Privacy', json(privacy), 'Guardrails', json(guardrails), 'Logging', json(logging), 'Naming', naming, 'RequireApproval', json(iif(require_approval, 'true', 'false')), 'IPv4Pool', ipv4_pool, 'IPv6Pool', ipv6_pool) FROM tailnets WHERE tailnets.id = machines.tailnet_id) AS tailnet,
+				(SELECT role FROM tailnet_members WHERE tailnet_members.tailnet_id = machines.tailnet_id AND tailnet_members.user_id = machines.user_id) AS role,
+				(SELECT json_group_array(prefix) FROM (SELECT prefix FROM routes WHERE routes.machine_id = machines.id AND approved ORDER BY prefix)) AS approved_routes
 		`,
 
 		ArgSet: []*Machine{m},
@@ -192,6 +330,33 @@ func SaveMachine(m *Machine) database.I[Machine, *Machine] {
 			stmt.BindInt64(12, int64(m.Tailnet.ID))
 			stmt.BindInt64(13, int64(m.Owner.ID))
 
+			lastAddr, _ := m.LastAddr.MarshalText() // zero value is marshalled as empty string
+			stmt.BindBytes(14, lastAddr)
+
+			if m.Location != nil {
+				location, err := json.Marshal(m.Location)
+				if err != nil {
+					return err
+				}
+				stmt.BindBytes(15, location)
+			} else {
+				stmt.BindNull(15)
+			}
+
+			var tags = m.AssignedTags
+			if tags == nil {
+				tags = []string{}
+			}
+
+			buf, err := json.Marshal(tags)
+			if err != nil {
+				return err
+			}
+			stmt.BindBytes(16, buf)
+
+			ipv6, _ := m.IPv6.MarshalText() // zero value is marshalled as empty string
+			stmt.BindText(17, string(ipv6))
+
 			return nil
 		},
 
@@ -206,11 +371,36 @@ func GetMachineByKey(k key.MachinePublic) database.Q[Machine] {
 	return database.Q[Machine]{
 		QueryStr: `
 			SELECT m.*, 
-			       json_object('ID', t.id, 'Name', t.name, 'Acl', t.acl, 'CreatedAt', t.created_at, 'UpdatedAt', t.updated_at) AS tailnet, 
-			       json_object('ID', u.id, 'Subject', u.sub, 'Name', u.name, 'Claims', json(u.claims), 'CreatedAt', u.created_at) AS user 
+			       json_object('ID', t.id, 'Name', t.name, 'Acl', t.acl, 'HideOfflineAfter', t.hide_offline_after, 'DeleteExpiredAfter', t.delete_expired_after, 'ForceDerp', json(iif(t.force_derp, 'true', 'false')), 'Capabilities', json(t.capabilities), 'DNS', json(t.dns), 'Welcome', json(t.welcome), 'Features', json(t.features), 'Privacy', json(t.privacy), 'Guardrails', json(t.guardrails), 'Logging', json(t.logging), 'Naming', t.naming, 'RequireApproval', json(iif(t.require_approval, 'true', 'false')), 'IPv4Pool', t.ipv4_pool, 'IPv6Pool', t.ipv6_pool, 'CreatedAt', t.created_at, 'UpdatedAt', t.updated_at) AS tailnet, 
+			       json_object('ID', u.id, 'Subject', u.sub, 'Name', u.name, 'Claims', json(u.claims), 'CreatedAt', u.created_at) AS user,
+			       tailnet_members.role AS role,
+			       (SELECT json_group_array(prefix) FROM (SELECT prefix FROM routes WHERE routes.machine_id = m.id AND approved ORDER BY prefix)) AS approved_routes
 			FROM machines m
 				INNER JOIN tailnets t ON m.tailnet_id = t.id
 				INNER JOIN users    u ON m.user_id    = u.id
+				INNER JOIN tailnet_members USING (tailnet_id, user_id)
+			WHERE noise_key = ?
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, k.String())
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Machine, error) {
+			return database.ScanAs[Machine](stmt)
+		},
+	}
+}
+
+// GetBareMachineByKey returns the machine with the given key, like GetMachineByKey, without joining its Tailnet and Owner,
+// which are left nil for the caller to resolve; eg. from a cache, to avoid re-reading (and re-parsing) them on every read.
+func GetBareMachineByKey(k key.MachinePublic) database.Q[Machine] {
+	return database.Q[Machine]{
+		QueryStr: `
+			SELECT m.*, 
+			       tailnet_members.role AS role,
+			       (SELECT json_group_array(prefix) FROM (SELECT prefix FROM routes WHERE routes.machine_id = m.id AND approved ORDER BY prefix)) AS approved_routes
+			FROM machines m
+				INNER JOIN tailnet_members USING (tailnet_id, user_id)
 			WHERE noise_key = ?
 		`,
 		Bind: func(stmt *sqlite.Stmt) error {
@@ -237,6 +427,92 @@ func ExpireNode(m *Machine, expiry time.Time) database.I[database.EmptyResponse,
 	}
 }
 
+// SetMachineVisibility sets the machine's AlwaysVisible flag, exempting it from (or subjecting it to) the tailnet's
+// HideOfflineAfter policy.
+func SetMachineVisibility(m *Machine, visible bool) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE machines SET always_visible = ? WHERE id = ?",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindBool(1, visible)
+			stmt.BindInt64(2, int64(m.ID))
+			return nil
+		},
+	}
+}
+
+// TouchMachine sets the machine's LastSeen time. It's used to keep LastSeen current for machines that hold a
+// streaming map session open, as only non-streaming map requests save the rest of the machine's state.
+func TouchMachine(m *Machine, at time.Time) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE machines SET last_seen = ? WHERE id = ?",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindText(1, at.Format(time.RFC3339))
+			stmt.BindInt64(2, int64(m.ID))
+			return nil
+		},
+	}
+}
+
+// SetMachineLocked sets the machine's Locked flag, exempting it from (or subjecting it to) the tailnet's
+// DeleteExpiredAfter policy.
+func SetMachineLocked(m *Machine, locked bool) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE machines SET locked = ? WHERE id = ?",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindBool(1, locked)
+			stmt.BindInt64(2, int64(m.ID))
+			return nil
+		},
+	}
+}
+
+// SetMachineAddrs updates the machine's addresses, eg. when it's moved to its tailnet's new address pool
+func SetMachineAddrs(m *Machine, v4, v6 netip.Addr) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE machines SET ipv4 = ?, ipv6 = ? WHERE id = ?",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			ipv6, _ := v6.MarshalText() // zero value is marshalled as empty string
+
+			stmt.BindText(1, v4.String())
+			stmt.BindText(2, string(ipv6))
+			stmt.BindInt64(3, int64(m.ID))
+			return nil
+		},
+	}
+}
+
+// RenameMachine updates the machine's name and name index. given marks the name as given by an admin (see: Machine.GivenName).
+func RenameMachine(m *Machine, name string, idx int, given bool) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE machines SET name = ?, name_idx = ?, given_name = ? WHERE id = ?",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindText(1, name)
+			stmt.BindInt64(2, int64(idx))
+			stmt.BindBool(3, given)
+			stmt.BindInt64(4, int64(m.ID))
+			return nil
+		},
+	}
+}
+
+// SetMachineAuthorized approves (or revokes the approval of) the machine, in a tailnet that requires device approval.
+func SetMachineAuthorized(m *Machine, authorized bool) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE machines SET authorized = ? WHERE id = ?",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindBool(1, authorized)
+			stmt.BindInt64(2, int64(m.ID))
+			return nil
+		},
+	}
+}
+
 // DeleteNode deletes the given machine record from the database.
 func DeleteNode(m *Machine) database.I[database.EmptyResponse, key.MachinePublic] {
 	return database.I[database.EmptyResponse, key.MachinePublic]{
@@ -249,13 +525,56 @@ func DeleteNode(m *Machine) database.I[database.EmptyResponse, key.MachinePublic
 	}
 }
 
-// CheckIpInTailnet returns true if the provided ip exists in the given tailnet.
+// RevokeNodeKey marks the machine's current node key as revoked, eg. when the machine logs out, so that it can't be used
+// again. The machine must register a new node key to rejoin its tailnet.
+func RevokeNodeKey(m *Machine) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "INSERT INTO revoked_node_keys (node_key, machine_id) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindText(1, m.NodeKey.String())
+			stmt.BindInt64(2, int64(m.ID))
+			return nil
+		},
+	}
+}
+
+// IsNodeKeyRevoked returns true if the node key has been revoked (see: RevokeNodeKey)
+func IsNodeKeyRevoked(k key.NodePublic) database.Q[bool] {
+	return database.Q[bool]{
+		QueryStr: "SELECT EXISTS (SELECT 1 FROM revoked_node_keys WHERE node_key = ?)",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, k.String())
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*bool, error) {
+			revoked := stmt.ColumnInt(0) == 1
+			return &revoked, nil
+		},
+	}
+}
+
+// CheckIpInTailnet returns true if the provided ip is assigned to a machine in the given tailnet.
+//
+// IPv6 addresses in Tailscale's 4to6 range are checked against the IPv4 address embedded in them as well,
+// as machines registered before IPv6 addresses were allocated natively use the derived address (see: Machine.IP).
 func CheckIpInTailnet(ip netip.Addr, tailnet *Tailnet) database.Q[bool] {
 	return database.Q[bool]{
-		QueryStr: `SELECT EXISTS (SELECT 1 FROM machines WHERE tailnet_id = $1 AND ipv4 = $2)`,
+		QueryStr: `SELECT EXISTS (SELECT 1 FROM machines WHERE tailnet_id = $1 AND (ipv4 = $2 OR ipv6 = $3))`,
 		Bind: func(stmt *sqlite.Stmt) error {
 			stmt.BindInt64(1, int64(tailnet.ID))
-			stmt.BindText(2, ip.String())
+
+			if ip.Is4() {
+				stmt.BindText(2, ip.String())
+				stmt.BindNull(3)
+			} else if v4, ok := tsaddr.Tailscale6to4(ip); ok {
+				stmt.BindText(2, v4.String())
+				stmt.BindText(3, ip.String())
+			} else {
+				stmt.BindNull(2)
+				stmt.BindText(3, ip.String())
+			}
+
 			return nil
 		},
 		Val: func(stmt *sqlite.Stmt) (*bool, error) {
@@ -265,6 +584,29 @@ func CheckIpInTailnet(ip netip.Addr, tailnet *Tailnet) database.Q[bool] {
 	}
 }
 
+// ListTailnetAddrs returns the addresses, of both families, assigned to machines in the given tailnet.
+func ListTailnetAddrs(tailnet *Tailnet) database.Q[netip.Addr] {
+	return database.Q[netip.Addr]{
+		QueryStr: "SELECT ipv4, 4 FROM machines WHERE tailnet_id = $1 UNION ALL SELECT iif(ipv6 != '', ipv6, ipv4), 6 FROM machines WHERE tailnet_id = $1",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(tailnet.ID))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*netip.Addr, error) {
+			ip, err := netip.ParseAddr(stmt.ColumnText(0))
+			if err != nil {
+				return nil, err
+			}
+
+			if stmt.ColumnInt(1) == 6 && ip.Is4() {
+				ip = tsaddr.Tailscale4To6(ip) // derived address of a machine without a natively allocated one
+			}
+
+			return &ip, nil
+		},
+	}
+}
+
 // GetNextNameIndex returns the next index number for use as arbiter to distinguish between machine's with same hostname.
 func GetNextNameIndex(tailnet *Tailnet, name string) database.Q[int] {
 	return database.Q[int]{
@@ -284,3 +626,29 @@ func GetNextNameIndex(tailnet *Tailnet, name string) database.Q[int] {
 		},
 	}
 }
+
+// SetMachineSite assigns the machine to the given site, or removes it from its site if empty; see Machine.Site.
+func SetMachineSite(m *Machine, site string) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE machines SET site = ? WHERE id = ?",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindText(1, site)
+			stmt.BindInt64(2, int64(m.ID))
+			return nil
+		},
+	}
+}
+
+// SetMachineForceDerp sets the machine's ForceDerp flag, forcing connections to and from the machine to be relayed over derp.
+func SetMachineForceDerp(m *Machine, force bool) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE machines SET force_derp = ? WHERE id = ?",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindBool(1, force)
+			stmt.BindInt64(2, int64(m.ID))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,128 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"slices"
+	"time"
+)
+
+// List of roles a user can be assigned in a tailnet
+const (
+	RoleOwner   = "owner"   // manages the tailnet, including its owners, and can delete it
+	RoleAdmin   = "admin"   // manages the tailnet's policy, machines, keys and members, other than its owners
+	RoleAuditor = "auditor" // has read-only access to the tailnet's configuration, machines and members
+	RoleMember  = "member"  // registers machines in the tailnet; has no access to the admin surface
+)
+
+// Roles lists all tailnet roles, most privileged first. Each role is granted the privileges of the roles that follow it.
+var Roles = []string{RoleOwner, RoleAdmin, RoleAuditor, RoleMember}
+
+// IsValidRole returns true if role is one of the known tailnet roles
+func IsValidRole(role string) bool { return slices.Contains(Roles, role) }
+
+// HasRole returns true if role is granted (at least) the privileges of the required role, eg. owners have those of admins.
+// Unknown roles are granted no privileges.
+func HasRole(role, required string) bool {
+	var i, j = slices.Index(Roles, role), slices.Index(Roles, required)
+	return i >= 0 && j >= 0 && i <= j
+}
+
+// Member represents a user's membership in a tailnet.
+//
+// A user must be a member of a tailnet to register machines in it. Removing a member
+// deletes all machines (and auth keys) the user owns in the tailnet.
+type Member struct {
+	TailnetID int    `db:"tailnet_id" json:"tailnet_id"`
+	UserID    int    `db:"user_id" json:"user_id"`
+	Subject   string `db:"sub" json:"user"`
+	Name      string `db:"name" json:"name"`
+	Role      string `db:"role" json:"role"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// ListMembers returns all members of the given tailnet.
+func ListMembers(tailnet int64) database.Q[Member] {
+	return database.Q[Member]{
+		QueryStr: `
+			SELECT m.tailnet_id, m.user_id, u.sub, u.name, m.role, m.created_at
+			FROM tailnet_members m INNER JOIN users u ON u.id = m.user_id
+			WHERE m.tailnet_id = $1
+			ORDER BY m.user_id
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnet)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Member, error) {
+			return database.ScanAs[Member](stmt)
+		},
+	}
+}
+
+// SaveMember adds the user to the tailnet with the given role, or updates the role if the user is already a member.
+func SaveMember(tailnet int64, u *User, role string) database.Q[Member] {
+	return database.Q[Member]{
+		QueryStr: `
+			INSERT INTO tailnet_members (tailnet_id, user_id, role) VALUES ($1, $2, $3)
+				ON CONFLICT (tailnet_id, user_id) DO UPDATE SET role = EXCLUDED.role
+			RETURNING tailnet_id, user_id, (SELECT sub FROM users WHERE id = user_id) AS sub,
+				(SELECT name FROM users WHERE id = user_id) AS name, role, created_at
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnet)
+			stmt.BindInt64(2, int64(u.ID))
+			stmt.BindText(3, role)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Member, error) {
+			return database.ScanAs[Member](stmt)
+		},
+	}
+}
+
+// RemoveMember removes the user from the tailnet. Machines and auth keys owned by the user in the tailnet are deleted as well.
+func RemoveMember(tailnet int64, user int) database.I[database.EmptyResponse, int] {
+	return database.I[database.EmptyResponse, int]{
+		QueryStr: "DELETE FROM tailnet_members WHERE tailnet_id = ? AND user_id = ?",
+		ArgSet:   []int{user},
+		Bind: func(stmt *sqlite.Stmt, user int) error {
+			stmt.BindInt64(1, tailnet)
+			stmt.BindInt64(2, int64(user))
+			return nil
+		},
+	}
+}
+
+// MemberRole returns the user's role in the tailnet, or nil if the user isn't a member.
+func MemberRole(u *User, tailnet int64) database.Q[string] {
+	return database.Q[string]{
+		QueryStr: "SELECT role FROM tailnet_members WHERE user_id = $1 AND tailnet_id = $2",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(u.ID))
+			stmt.BindInt64(2, tailnet)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*string, error) {
+			role := stmt.ColumnText(0)
+			return &role, nil
+		},
+	}
+}
+
+// CountOwners returns the number of owners of the tailnet
+func CountOwners(tailnet int64) database.Q[int] {
+	return database.Q[int]{
+		QueryStr: "SELECT count(*) FROM tailnet_members WHERE tailnet_id = $1 AND role = $2",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnet)
+			stmt.BindText(2, RoleOwner)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*int, error) {
+			count := stmt.ColumnInt(0)
+			return &count, nil
+		},
+	}
+}
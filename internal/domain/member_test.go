@@ -0,0 +1,25 @@
+package domain
+
+import "testing"
+
+func TestHasRole(t *testing.T) {
+	var cases = []struct {
+		role, required string
+		want           bool
+	}{
+		{RoleOwner, RoleAdmin, true},
+		{RoleAdmin, RoleAdmin, true},
+		{RoleAdmin, RoleOwner, false},
+		{RoleAuditor, RoleAuditor, true},
+		{RoleAuditor, RoleAdmin, false},
+		{RoleMember, RoleAuditor, false},
+		{"", RoleMember, false},
+		{"superuser", RoleMember, false},
+	}
+
+	for _, tc := range cases {
+		if got := HasRole(tc.role, tc.required); got != tc.want {
+			t.Errorf("HasRole(%q, %q) = %t; want %t", tc.role, tc.required, got, tc.want)
+		}
+	}
+}
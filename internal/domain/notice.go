@@ -0,0 +1,98 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"time"
+)
+
+// Notice is an operator-defined message that is pushed to clients using MapResponse.Health,
+// and is displayed by the client as a warning (eg. in `tailscale status`).
+//
+// A notice can target all machines (global), all machines in a tailnet or a single machine.
+type Notice struct {
+	ID        int        `db:"id" json:"id"`                           // auto-generated, sequential identifier for the notice
+	Message   string     `db:"message" json:"message"`                 // message displayed to the user by the client
+	TailnetID *int       `db:"tailnet_id" json:"tailnet_id,omitempty"` // if set, only machines in this tailnet receive the notice
+	MachineID *int       `db:"machine_id" json:"machine_id,omitempty"` // if set, only this machine receives the notice
+	ExpiresAt *time.Time `db:"expires_at" json:"expires_at,omitempty"` // if set, the notice is no longer delivered after this time
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// CreateNotice creates a new notice and returns the created record.
+func CreateNotice(n *Notice) database.Q[Notice] {
+	return database.Q[Notice]{
+		QueryStr: "INSERT INTO notices (message, tailnet_id, machine_id, expires_at) VALUES ($1, $2, $3, $4) RETURNING *",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, n.Message)
+
+			if n.TailnetID != nil {
+				stmt.BindInt64(2, int64(*n.TailnetID))
+			} else {
+				stmt.BindNull(2)
+			}
+
+			if n.MachineID != nil {
+				stmt.BindInt64(3, int64(*n.MachineID))
+			} else {
+				stmt.BindNull(3)
+			}
+
+			if n.ExpiresAt != nil {
+				stmt.BindText(4, n.ExpiresAt.UTC().Format(time.RFC3339))
+			} else {
+				stmt.BindNull(4)
+			}
+
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Notice, error) {
+			return database.ScanAs[Notice](stmt)
+		},
+	}
+}
+
+// ListNotices returns all notices, including the expired ones.
+func ListNotices() database.Q[Notice] {
+	return database.Q[Notice]{
+		QueryStr: "SELECT * FROM notices ORDER BY id",
+		Val: func(stmt *sqlite.Stmt) (*Notice, error) {
+			return database.ScanAs[Notice](stmt)
+		},
+	}
+}
+
+// ListActiveNotices returns all non-expired notices that must be delivered to the given machine,
+// ie. all global notices, notices for the machine's tailnet and notices for the machine itself.
+func ListActiveNotices(m *Machine) database.Q[Notice] {
+	return database.Q[Notice]{
+		QueryStr: `
+			SELECT * FROM notices
+			WHERE (tailnet_id IS NULL OR tailnet_id = $1)
+			  AND (machine_id IS NULL OR machine_id = $2)
+			  AND (expires_at IS NULL OR expires_at > strftime('%Y-%m-%dT%H:%M:%SZ', 'now'))
+			ORDER BY id
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(m.TailnetID))
+			stmt.BindInt64(2, int64(m.ID))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Notice, error) {
+			return database.ScanAs[Notice](stmt)
+		},
+	}
+}
+
+// DeleteNotice deletes the notice identified by the given id.
+func DeleteNotice(id int) database.I[database.EmptyResponse, int] {
+	return database.I[database.EmptyResponse, int]{
+		QueryStr: "DELETE FROM notices WHERE id = ?",
+		ArgSet:   []int{id},
+		Bind: func(stmt *sqlite.Stmt, id int) error {
+			stmt.BindInt64(1, int64(id))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,185 @@
+package domain
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+// Connection paths reported by DiagnosePath
+const (
+	PathDirectLAN = "direct-lan" // machines are on the same local network, and connect over it
+	PathDirectWAN = "direct-wan" // machines connect directly over the internet, traversing any nat
+	PathRelayed   = "relayed"    // machines can't connect directly, and their traffic is relayed over derp
+)
+
+// PathReport is the likely connection path between two machines, as inferred from the endpoints and NetInfo
+// last reported by their clients, along with the reasons for it. Clients make the actual decision, with
+// information the server doesn't have (eg. which probes succeeded), and so the report is a best guess.
+type PathReport struct {
+	Path    string   `json:"path"`
+	Reasons []string `json:"reasons"`
+
+	// DERP regions the machines are homed at, that relayed traffic flows through; zero if unknown
+	FromDERP int `json:"from_derp"`
+	ToDERP   int `json:"to_derp"`
+}
+
+// DiagnosePath reports the likely connection path between the two machines, eg. to answer why traffic between them is relayed.
+func DiagnosePath(a, b *Machine) *PathReport {
+	var report = &PathReport{FromDERP: derpHome(a), ToDERP: derpHome(b)}
+	var because = func(format string, args ...any) {
+		report.Reasons = append(report.Reasons, fmt.Sprintf(format, args...))
+	}
+
+	for _, m := range []*Machine{a, b} {
+		var ni = netInfo(m)
+		switch {
+		case m.IsDerpOnly():
+			because("%s is forced to relay all traffic over derp", m.CompleteName())
+		case len(m.Endpoints) == 0:
+			because("%s hasn't reported any endpoints", m.CompleteName())
+		case ni.WorkingUDP.EqualBool(false):
+			because("%s can't send or receive udp traffic", m.CompleteName())
+		}
+	}
+
+	if a.Site != "" && b.Site != "" && a.Site != b.Site {
+		because("%s and %s are at different sites, %s and %s, whose traffic is relayed over derp", a.CompleteName(), b.CompleteName(), a.Site, b.Site)
+	}
+
+	if len(report.Reasons) > 0 {
+		report.Path = PathRelayed
+		return report
+	}
+
+	// machines at the same site are advertised to each other with only their local endpoints; see Machine.Site
+	if a.Site != "" && a.Site == b.Site && len(local(a)) > 0 && len(local(b)) > 0 {
+		report.Path = PathDirectLAN
+		because("both machines are at the site %s, and connect using their local endpoints", a.Site)
+		return report
+	}
+
+	// machines behind the same public address, that share a local network, connect using their local endpoints
+	if addr, ok := sharedAddr(public(a), public(b)); ok {
+		if network, ok := sharedNetwork(local(a), local(b)); ok {
+			report.Path = PathDirectLAN
+			because("both machines are behind the same public address %s, and share the local network %s", addr, network)
+			return report
+		}
+	}
+
+	if public6(a) && public6(b) {
+		report.Path = PathDirectWAN
+		because("both machines have a public ipv6 address")
+		return report
+	}
+
+	var traversable = false
+	for _, m := range []*Machine{a, b} {
+		var ni = netInfo(m)
+		switch {
+		case !behindNAT(m):
+			traversable = true
+			because("%s has a public ipv4 address", m.CompleteName())
+		case ni.HavePortMap || slices.ContainsFunc(m.Endpoints, isType(tailcfg.EndpointPortmapped)):
+			traversable = true
+			because("%s has a port mapped on its router (using upnp, nat-pmp or pcp)", m.CompleteName())
+		case ni.MappingVariesByDestIP.EqualBool(true):
+			because("%s is behind a hard nat, whose mapping varies by destination", m.CompleteName())
+		default:
+			traversable = true
+			because("%s is behind an easy nat, whose mapping doesn't vary by destination", m.CompleteName())
+		}
+	}
+
+	if report.Path = PathRelayed; traversable {
+		report.Path = PathDirectWAN
+	}
+
+	if report.Path == PathRelayed && report.FromDERP != report.ToDERP && report.FromDERP != 0 && report.ToDERP != 0 {
+		because("relayed traffic flows through both derp regions %d and %d", report.FromDERP, report.ToDERP)
+	}
+
+	return report
+}
+
+// netInfo returns the machine's last reported NetInfo, or a zero NetInfo if it hasn't reported one
+func netInfo(m *Machine) *tailcfg.NetInfo {
+	if m.HostInfo == nil || m.HostInfo.NetInfo == nil {
+		return &tailcfg.NetInfo{}
+	}
+	return m.HostInfo.NetInfo
+}
+
+// derpHome returns the machine's preferred (home) derp region, or zero if unknown
+func derpHome(m *Machine) int { return netInfo(m).PreferredDERP }
+
+// isType returns a predicate that matches endpoints of the given type
+func isType(t tailcfg.EndpointType) func(tailcfg.Endpoint) bool {
+	return func(ep tailcfg.Endpoint) bool { return ep.Type == t }
+}
+
+// isPublic returns true if the address is a public, internet routable, address
+func isPublic(addr netip.Addr) bool {
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !tsaddr.CGNATRange().Contains(addr)
+}
+
+// local returns the machine's private ipv4 endpoints, on its local network
+func local(m *Machine) (addrs []netip.Addr) {
+	for _, ep := range m.Endpoints {
+		if ep.Addr.Addr().Is4() && !isPublic(ep.Addr.Addr()) {
+			addrs = append(addrs, ep.Addr.Addr())
+		}
+	}
+	return addrs
+}
+
+// public returns the machine's public ipv4 endpoints; either bound to the machine itself, or discovered using stun
+func public(m *Machine) (addrs []netip.Addr) {
+	for _, ep := range m.Endpoints {
+		if ep.Addr.Addr().Is4() && isPublic(ep.Addr.Addr()) {
+			addrs = append(addrs, ep.Addr.Addr())
+		}
+	}
+	return addrs
+}
+
+// public6 returns true if the machine has a public ipv6 endpoint, and ipv6 works for it
+func public6(m *Machine) bool {
+	if netInfo(m).WorkingIPv6.EqualBool(false) {
+		return false
+	}
+
+	return slices.ContainsFunc(m.Endpoints, func(ep tailcfg.Endpoint) bool { return ep.Addr.Addr().Is6() && isPublic(ep.Addr.Addr()) })
+}
+
+// behindNAT returns true unless a public ipv4 address is bound to the machine itself
+func behindNAT(m *Machine) bool {
+	return !slices.ContainsFunc(m.Endpoints, func(ep tailcfg.Endpoint) bool {
+		return ep.Type == tailcfg.EndpointLocal && ep.Addr.Addr().Is4() && isPublic(ep.Addr.Addr())
+	})
+}
+
+// sharedAddr returns an address common to both lists
+func sharedAddr(a, b []netip.Addr) (netip.Addr, bool) {
+	for _, addr := range a {
+		if slices.Contains(b, addr) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// sharedNetwork returns a /24 network that contains an address from both lists
+func sharedNetwork(a, b []netip.Addr) (netip.Prefix, bool) {
+	for _, x := range a {
+		var network = netip.PrefixFrom(x, 24).Masked()
+		if slices.ContainsFunc(b, network.Contains) {
+			return network, true
+		}
+	}
+	return netip.Prefix{}, false
+}
@@ -0,0 +1,93 @@
+package domain
+
+import (
+	"net/netip"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/opt"
+	"testing"
+)
+
+func TestDiagnosePath(t *testing.T) {
+	var endpoint = func(addr string, typ tailcfg.EndpointType) tailcfg.Endpoint {
+		return tailcfg.Endpoint{Addr: netip.MustParseAddrPort(addr), Type: typ}
+	}
+
+	var machine = func(name string, ni *tailcfg.NetInfo, endpoints ...tailcfg.Endpoint) *Machine {
+		return &Machine{Name: name, HostInfo: &tailcfg.Hostinfo{NetInfo: ni}, Endpoints: endpoints}
+	}
+
+	var easy = &tailcfg.NetInfo{WorkingUDP: opt.NewBool(true), MappingVariesByDestIP: opt.NewBool(false), PreferredDERP: 1}
+	var hard = &tailcfg.NetInfo{WorkingUDP: opt.NewBool(true), MappingVariesByDestIP: opt.NewBool(true), PreferredDERP: 2}
+
+	var cases = []struct {
+		name string
+		a, b *Machine
+		path string
+	}{
+		{
+			"SameNetwork",
+			machine("alpha", hard, endpoint("192.168.1.10:41641", tailcfg.EndpointLocal), endpoint("203.0.113.1:41641", tailcfg.EndpointSTUN)),
+			machine("bravo", hard, endpoint("192.168.1.20:41641", tailcfg.EndpointLocal), endpoint("203.0.113.1:52000", tailcfg.EndpointSTUN)),
+			PathDirectLAN,
+		},
+		{
+			"EasyNAT",
+			machine("alpha", easy, endpoint("192.168.1.10:41641", tailcfg.EndpointLocal), endpoint("203.0.113.1:41641", tailcfg.EndpointSTUN)),
+			machine("bravo", hard, endpoint("10.0.0.20:41641", tailcfg.EndpointLocal), endpoint("198.51.100.2:41641", tailcfg.EndpointSTUN)),
+			PathDirectWAN,
+		},
+		{
+			"PublicAddress",
+			machine("alpha", hard, endpoint("203.0.113.1:41641", tailcfg.EndpointLocal)),
+			machine("bravo", hard, endpoint("10.0.0.20:41641", tailcfg.EndpointLocal), endpoint("198.51.100.2:41641", tailcfg.EndpointSTUN)),
+			PathDirectWAN,
+		},
+		{
+			"HardNAT",
+			machine("alpha", hard, endpoint("192.168.1.10:41641", tailcfg.EndpointLocal), endpoint("203.0.113.1:41641", tailcfg.EndpointSTUN)),
+			machine("bravo", hard, endpoint("10.0.0.20:41641", tailcfg.EndpointLocal), endpoint("198.51.100.2:41641", tailcfg.EndpointSTUN)),
+			PathRelayed,
+		},
+		{
+			"UDPBlocked",
+			machine("alpha", &tailcfg.NetInfo{WorkingUDP: opt.NewBool(false)}, endpoint("192.168.1.10:41641", tailcfg.EndpointLocal)),
+			machine("bravo", easy, endpoint("198.51.100.2:41641", tailcfg.EndpointLocal)),
+			PathRelayed,
+		},
+		{
+			"NoEndpoints",
+			machine("alpha", easy),
+			machine("bravo", easy, endpoint("198.51.100.2:41641", tailcfg.EndpointLocal)),
+			PathRelayed,
+		},
+		{
+			"ForcedDerp",
+			&Machine{Name: "alpha", ForceDerp: true, Endpoints: []tailcfg.Endpoint{endpoint("203.0.113.1:41641", tailcfg.EndpointLocal)}},
+			machine("bravo", easy, endpoint("198.51.100.2:41641", tailcfg.EndpointLocal)),
+			PathRelayed,
+		},
+		{
+			"SameSite",
+			&Machine{Name: "alpha", Site: "hq", Endpoints: []tailcfg.Endpoint{endpoint("192.168.1.10:41641", tailcfg.EndpointLocal)}},
+			&Machine{Name: "bravo", Site: "hq", Endpoints: []tailcfg.Endpoint{endpoint("192.168.2.20:41641", tailcfg.EndpointLocal)}},
+			PathDirectLAN,
+		},
+		{
+			"DifferentSites",
+			&Machine{Name: "alpha", Site: "hq", Endpoints: []tailcfg.Endpoint{endpoint("203.0.113.1:41641", tailcfg.EndpointLocal)}},
+			&Machine{Name: "bravo", Site: "dc", Endpoints: []tailcfg.Endpoint{endpoint("198.51.100.2:41641", tailcfg.EndpointLocal)}},
+			PathRelayed,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			report := DiagnosePath(tc.a, tc.b)
+			if report.Path != tc.path {
+				t.Errorf("unexpected path %q; want %q (reasons: %v)", report.Path, tc.path, report.Reasons)
+			} else if len(report.Reasons) == 0 {
+				t.Errorf("expected the report to give reasons")
+			}
+		})
+	}
+}
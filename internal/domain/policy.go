@@ -0,0 +1,547 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/tacl"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/tailscale/hujson"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"tailscale.com/tailcfg"
+	"time"
+)
+
+// PolicyTest is an entry in the tests section of an acl policy. It asserts that the src is allowed to, or denied
+// from, reaching each of the destinations, written as host:port (see: https://tailscale.com/kb/1337/policy-syntax#tests).
+type PolicyTest struct {
+	Src    string        `json:"src"`             // user, group, tag, host alias, machine name or ip address
+	Proto  tacl.Protocol `json:"proto,omitempty"` // protocol to test; defaults to tcp
+	Accept []string      `json:"accept,omitempty"`
+	Deny   []string      `json:"deny,omitempty"`
+}
+
+// PolicyTestResult is the outcome of evaluating a single PolicyTest
+type PolicyTestResult struct {
+	Src    string   `json:"src"`
+	Passed bool     `json:"passed"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// PolicyRevision is a single, past or current, revision of a tailnet's acl policy
+type PolicyRevision struct {
+	ID        int    `db:"id" json:"id"`
+	TailnetID int    `db:"tailnet_id" json:"tailnet_id"`
+	Policy    string `db:"policy" json:"policy"` // policy document, as it was submitted
+	Actor     string `db:"actor" json:"actor"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// SharedPolicy is an acl policy document shared between tailnets, eg. to maintain a common security baseline.
+// A tailnet's policy includes shared policies by listing their names in its include section; see ResolvePolicy.
+type SharedPolicy struct {
+	Name   string `db:"name" json:"name"`
+	Policy string `db:"policy" json:"policy"` // policy document, as it was submitted
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// ErrSharedPolicyNotFound is returned when a policy includes a shared policy that doesn't exist
+var ErrSharedPolicyNotFound = errors.New("shared policy not found")
+
+// ParsePolicy parses a HuJSON (ie. JSON with comments and trailing commas) acl policy document,
+// returning the policy along with the tests declared in its tests section.
+func ParsePolicy(buf []byte) (_ *tacl.ACL, _ []PolicyTest, err error) {
+	if buf, err = hujson.Standardize(buf); err != nil {
+		return nil, nil, err
+	}
+
+	var acl *tacl.ACL
+	if acl, err = tacl.Parse(buf); err != nil {
+		return nil, nil, err
+	}
+
+	var doc struct {
+		Tests []PolicyTest `json:"tests"`
+	}
+
+	if err = json.Unmarshal(buf, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	return acl, doc.Tests, nil
+}
+
+// RunPolicyTests evaluates the tests against the acl policy, like tailscale's policy file tests do, using the
+// tailnet's machines to resolve sources and destinations. A destination is accepted if the packet filter
+// compiled for the destination machine permits traffic from every one of the source's machines.
+func RunPolicyTests(acl *tacl.ACL, machines []*Machine, tests []PolicyTest) []PolicyTestResult {
+	var filters = make(map[int][]tailcfg.FilterRule) // compiled filters, keyed by destination machine id
+
+	var filter = func(dst *Machine) []tailcfg.FilterRule {
+		if rules, ok := filters[dst.ID]; ok {
+			return rules
+		}
+
+		var peers = make([]tacl.Machine, 0, len(machines))
+		for _, m := range machines {
+			if m.ID != dst.ID && !m.IsHidden() {
+				peers = append(peers, m)
+			}
+		}
+
+		filters[dst.ID] = acl.BuildFilter(dst, peers)
+		return filters[dst.ID]
+	}
+
+	var results = make([]PolicyTestResult, 0, len(tests))
+	for _, test := range tests {
+		var result = PolicyTestResult{Src: test.Src}
+
+		var proto = test.Proto.Value()
+		if test.Proto == "" {
+			proto = []int{6} // tcp
+		}
+
+		var srcs = resolveAlias(acl, machines, test.Src)
+		if len(srcs) == 0 {
+			result.Errors = append(result.Errors, fmt.Sprintf("src %q does not match any machine", test.Src))
+		}
+
+		var check = func(dst string, want bool) {
+			idx := strings.LastIndex(dst, ":")
+			if idx == -1 {
+				result.Errors = append(result.Errors, fmt.Sprintf("invalid destination %q; expected host:port", dst))
+				return
+			}
+
+			port, err := strconv.ParseUint(dst[idx+1:], 10, 16)
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("invalid port in destination %q", dst))
+				return
+			}
+
+			var dsts = resolveAlias(acl, machines, dst[:idx])
+			if len(dsts) == 0 {
+				result.Errors = append(result.Errors, fmt.Sprintf("destination %q does not match any machine", dst))
+				return
+			}
+
+			for _, d := range dsts {
+				for _, s := range srcs {
+					if s.ID == d.ID {
+						continue // traffic to self is never filtered
+					}
+
+					if allowed := permits(filter(d), s, d, proto, uint16(port)); allowed != want {
+						var verb = map[bool]string{true: "accepted", false: "denied"}[want]
+						result.Errors = append(result.Errors, fmt.Sprintf("expected %s -> %s:%d to be %s", s.CompleteName(), d.CompleteName(), port, verb))
+					}
+				}
+			}
+		}
+
+		for _, dst := range test.Accept {
+			check(dst, true)
+		}
+
+		for _, dst := range test.Deny {
+			check(dst, false)
+		}
+
+		result.Passed = len(result.Errors) == 0
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// resolveAlias returns the machines matched by alias, which is one of a tag, user, group, host alias,
+// machine name or ip address. Users and groups only match untagged machines, like they do in acl rules.
+func resolveAlias(acl *tacl.ACL, machines []*Machine, alias string) []*Machine {
+	if addr, ok := acl.Hosts[alias]; ok {
+		alias = addr
+	}
+
+	var match func(m *Machine) bool
+	switch a := tacl.Alias(alias); {
+	case a.IsTag():
+		match = func(m *Machine) bool { return slices.Contains(m.AssignedTags, alias) }
+	case a.IsGroup():
+		match = func(m *Machine) bool {
+			return len(m.AssignedTags) == 0 && slices.Contains(acl.Groups[alias], m.Owner.LoginName())
+		}
+	case a.IsUser():
+		match = func(m *Machine) bool { return len(m.AssignedTags) == 0 && m.Owner.LoginName() == alias }
+	default:
+		if ip, err := netip.ParseAddr(alias); err == nil {
+			match = func(m *Machine) bool { v4, v6 := m.IP(); return ip == v4 || ip == v6 }
+		} else {
+			match = func(m *Machine) bool { return m.Name == alias || m.CompleteName() == alias }
+		}
+	}
+
+	var matched []*Machine
+	for _, m := range machines {
+		if match(m) {
+			matched = append(matched, m)
+		}
+	}
+
+	return matched
+}
+
+// permits returns true if the packet filter rules allow traffic using one of the protocols from src to dst's ipv4 address at port
+func permits(rules []tailcfg.FilterRule, src, dst *Machine, proto []int, port uint16) bool {
+	var srcIP, _ = src.IP()
+	var dstIP, _ = dst.IP()
+
+	for _, rule := range rules {
+		if !slices.ContainsFunc(rule.SrcIPs, func(s string) bool { return matchIP(s, srcIP) }) {
+			continue
+		}
+
+		// rules without protocols apply to tcp, udp and icmp traffic
+		var ruleProto = []int{6, 17, 1, 58}
+		if len(rule.IPProto) > 0 {
+			ruleProto = make([]int, 0, len(rule.IPProto))
+			for _, p := range rule.IPProto {
+				ruleProto = append(ruleProto, int(p))
+			}
+		}
+
+		if !slices.ContainsFunc(proto, func(p int) bool { return slices.Contains(ruleProto, p) }) {
+			continue
+		}
+
+		for _, dp := range rule.DstPorts {
+			if matchIP(dp.IP, dstIP) && dp.Ports.First <= port && port <= dp.Ports.Last {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchIP returns true if ip matches s, which is either the "*" wildcard, an ip address, a prefix or an ip range
+func matchIP(s string, ip netip.Addr) bool {
+	switch {
+	case s == "*":
+		return true
+	case strings.Contains(s, "-"):
+		from, to, _ := strings.Cut(s, "-")
+		first, err1 := netip.ParseAddr(from)
+		last, err2 := netip.ParseAddr(to)
+		return err1 == nil && err2 == nil && first.Compare(ip) <= 0 && ip.Compare(last) <= 0
+	case strings.Contains(s, "/"):
+		prefix, err := netip.ParsePrefix(s)
+		return err == nil && prefix.Contains(ip)
+	default:
+		addr, err := netip.ParseAddr(s)
+		return err == nil && addr == ip
+	}
+}
+
+// PolicyIncludes returns the names of the shared policies included by the HuJSON policy document, listed in its include section.
+func PolicyIncludes(buf []byte) (_ []string, err error) {
+	if buf, err = hujson.Standardize(buf); err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Include []string `json:"include"`
+	}
+
+	if err = json.Unmarshal(buf, &doc); err != nil {
+		return nil, err
+	}
+
+	return doc.Include, nil
+}
+
+// ValidateSharedPolicy checks that the HuJSON document can be included by other policies. A shared policy needn't be
+// a complete policy on its own (eg. it may only declare groups), but it cannot include other shared policies.
+func ValidateSharedPolicy(buf []byte) error {
+	if includes, err := PolicyIncludes(buf); err != nil {
+		return err
+	} else if len(includes) > 0 {
+		return errors.New("shared policies cannot include other policies")
+	}
+
+	return mergePolicy(make(map[string]any), buf)
+}
+
+// ResolvePolicy composes the HuJSON policy document with the shared policies it includes, using lookup to fetch
+// each shared policy by its name. Documents are merged in the order they're included, followed by the policy itself:
+// rules in list sections (eg. acls, ssh or tests) are appended, while entries of object sections (eg. groups, hosts
+// or tagOwners) replace the ones with the same key, so that a tailnet's policy can override the shared baseline.
+//
+// The document is returned as-is if it doesn't include any shared policies.
+func ResolvePolicy(buf []byte, lookup func(name string) ([]byte, error)) (_ []byte, err error) {
+	var includes []string
+	if includes, err = PolicyIncludes(buf); err != nil || len(includes) == 0 {
+		return buf, err
+	}
+
+	var merged = make(map[string]any)
+	for _, name := range includes {
+		var shared []byte
+		if shared, err = lookup(name); err != nil {
+			return nil, errors.Wrapf(err, "failed to include %q", name)
+		}
+
+		if err = ValidateSharedPolicy(shared); err != nil {
+			return nil, errors.Wrapf(err, "failed to include %q", name)
+		}
+
+		_ = mergePolicy(merged, shared) // already validated above
+	}
+
+	if err = mergePolicy(merged, buf); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(merged, "", "  ")
+}
+
+// mergePolicy merges the sections of the HuJSON policy document into dst; see ResolvePolicy.
+// Section names are case-insensitive, and are merged using their canonical name.
+func mergePolicy(dst map[string]any, buf []byte) (err error) {
+	if buf, err = hujson.Standardize(buf); err != nil {
+		return err
+	}
+
+	var doc map[string]any
+	if err = json.Unmarshal(buf, &doc); err != nil {
+		return err
+	}
+
+	for key, value := range doc {
+		if strings.EqualFold(key, "include") {
+			continue // includes are resolved, and aren't part of the resolved policy
+		}
+
+		if name, ok := policySections[strings.ToLower(key)]; ok {
+			key = name
+		}
+
+		switch v := value.(type) {
+		case []any:
+			if rules, ok := dst[key].([]any); ok {
+				value = append(rules, v...)
+			}
+		case map[string]any:
+			value = mergeObject(dst[key], v)
+		}
+
+		dst[key] = value
+	}
+
+	return nil
+}
+
+// mergeObject merges the entries of src into dst (if it's an object), recursively. Entries that aren't objects replace the ones in dst.
+func mergeObject(dst any, src map[string]any) map[string]any {
+	var obj, ok = dst.(map[string]any)
+	if !ok {
+		return src
+	}
+
+	for key, value := range src {
+		if v, ok := value.(map[string]any); ok {
+			value = mergeObject(obj[key], v)
+		}
+		obj[key] = value
+	}
+
+	return obj
+}
+
+// ListSharedPolicies returns all shared policies, ordered by their name.
+func ListSharedPolicies() database.Q[SharedPolicy] {
+	return database.Q[SharedPolicy]{
+		QueryStr: "SELECT * FROM shared_policies ORDER BY name",
+		Val: func(stmt *sqlite.Stmt) (*SharedPolicy, error) {
+			return database.ScanAs[SharedPolicy](stmt)
+		},
+	}
+}
+
+// SharedPolicyByName returns the shared policy with the given name.
+func SharedPolicyByName(name string) database.Q[SharedPolicy] {
+	return database.Q[SharedPolicy]{
+		QueryStr: "SELECT * FROM shared_policies WHERE name = $1",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, name)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*SharedPolicy, error) {
+			return database.ScanAs[SharedPolicy](stmt)
+		},
+	}
+}
+
+// SaveSharedPolicy creates, or replaces, the shared policy with the given name and returns the saved record.
+// The policy must be validated (using ValidateSharedPolicy) beforehand.
+func SaveSharedPolicy(name string, policy []byte) database.Q[SharedPolicy] {
+	return database.Q[SharedPolicy]{
+		QueryStr: `
+			INSERT INTO shared_policies (name, policy) VALUES ($1, $2)
+				ON CONFLICT (name) DO UPDATE SET policy = EXCLUDED.policy, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+			RETURNING *
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, name)
+			stmt.BindText(2, string(policy))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*SharedPolicy, error) {
+			return database.ScanAs[SharedPolicy](stmt)
+		},
+	}
+}
+
+// DeleteSharedPolicy deletes the shared policy with the given name. Tailnets' policies must no longer include it.
+func DeleteSharedPolicy(name string) database.I[database.EmptyResponse, string] {
+	return database.I[database.EmptyResponse, string]{
+		QueryStr: "DELETE FROM shared_policies WHERE name = ?",
+		ArgSet:   []string{name},
+		Bind: func(stmt *sqlite.Stmt, name string) error {
+			stmt.BindText(1, name)
+			return nil
+		},
+	}
+}
+
+// SavePolicyRevision appends the tailnet's (new) acl policy to its history.
+func SavePolicyRevision(t *Tailnet, policy []byte, actor string) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "INSERT INTO acl_history (tailnet_id, policy, actor) VALUES (?, ?, ?)",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			stmt.BindInt64(1, int64(t.ID))
+			stmt.BindText(2, string(policy))
+			stmt.BindText(3, actor)
+			return nil
+		},
+	}
+}
+
+// ListPolicyHistory returns all revisions of the tailnet's acl policy, most recent first.
+func ListPolicyHistory(tailnetID int64) database.Q[PolicyRevision] {
+	return database.Q[PolicyRevision]{
+		QueryStr: "SELECT * FROM acl_history WHERE tailnet_id = $1 ORDER BY id DESC",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnetID)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*PolicyRevision, error) {
+			return database.ScanAs[PolicyRevision](stmt)
+		},
+	}
+}
+
+// policySections maps the lower-cased name of each policy section supported by wirefire to its canonical name.
+// Section names in tailscale's policy files are case-insensitive.
+var policySections = map[string]string{
+	"acls": "acls", "grants": "grants", "ssh": "ssh", "groups": "groups", "hosts": "hosts",
+	"tagowners": "tagOwners", "autoapprovers": "autoApprovers", "tests": "tests",
+}
+
+// ruleFields is the set of (lower-cased) fields supported in the rules of each of the rule sections
+var ruleFields = map[string][]string{
+	"acls":   {"action", "proto", "src", "dst"},
+	"grants": {"src", "dst", "ip", "app"},
+	"ssh":    {"action", "src", "dst", "users", "checkperiod", "acceptenv"},
+}
+
+// ImportPolicy converts a policy file exported from tailscale's admin console into a policy document accepted by wirefire.
+//
+// Sections that wirefire doesn't support (eg. postures, ipsets or nodeAttrs) are dropped. Rules using unsupported
+// constructs (eg. posture conditions, via or ip sets) are dropped as a whole, rather than stripped of the construct,
+// since that would grant more access than the original rule did. Everything that was dropped is reported in unsupported.
+func ImportPolicy(buf []byte) (policy []byte, unsupported []string, err error) {
+	if buf, err = hujson.Standardize(buf); err != nil {
+		return nil, nil, err
+	}
+
+	var doc map[string]json.RawMessage
+	if err = json.Unmarshal(buf, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	var keys = make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys) // report in a stable order
+
+	var out = make(map[string]any, len(doc))
+	for _, key := range keys {
+		name, ok := policySections[strings.ToLower(key)]
+		if !ok {
+			unsupported = append(unsupported, fmt.Sprintf("section %q is not supported", key))
+			continue
+		}
+
+		if _, ok = ruleFields[name]; !ok {
+			out[name] = doc[key]
+			continue
+		}
+
+		var rules []map[string]json.RawMessage
+		if err = json.Unmarshal(doc[key], &rules); err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid %s section", key)
+		}
+
+		var kept = make([]map[string]json.RawMessage, 0, len(rules))
+		for i, rule := range rules {
+			if reason := unsupportedRule(name, rule); reason != "" {
+				unsupported = append(unsupported, fmt.Sprintf("%s[%d]: %s", key, i, reason))
+			} else {
+				kept = append(kept, rule)
+			}
+		}
+
+		out[name] = kept
+	}
+
+	if policy, err = json.MarshalIndent(out, "", "  "); err != nil {
+		return nil, nil, err
+	}
+
+	if _, _, err = ParsePolicy(policy); err != nil {
+		return nil, nil, err
+	}
+
+	return policy, unsupported, nil
+}
+
+// unsupportedRule returns the reason the rule in section can't be imported, or an empty string if it can
+func unsupportedRule(section string, rule map[string]json.RawMessage) string {
+	for field, value := range rule {
+		if !slices.Contains(ruleFields[section], strings.ToLower(field)) {
+			return fmt.Sprintf("field %q is not supported", field)
+		}
+
+		if f := strings.ToLower(field); f == "src" || f == "dst" {
+			var aliases []string
+			_ = json.Unmarshal(value, &aliases) // malformed values are reported when the policy is parsed
+
+			for _, alias := range aliases {
+				if strings.HasPrefix(alias, "ipset:") {
+					return fmt.Sprintf("ip set %q is not supported", alias)
+				}
+			}
+		}
+	}
+
+	return ""
+}
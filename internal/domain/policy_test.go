@@ -0,0 +1,169 @@
+package domain
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRunPolicyTests(t *testing.T) {
+	var policy = []byte(`{
+		// hujson comments and trailing commas are allowed
+		"groups": { "group:ops": ["bob@example.com"], },
+		"tagOwners": { "tag:server": ["group:ops"] },
+		"hosts": { "db": "100.64.0.3" },
+		"acls": [
+			{ "action": "accept", "src": ["group:ops"], "dst": ["tag:server:22"] },
+			{ "action": "accept", "src": ["autogroup:member"], "dst": ["tag:server:443"] },
+			{ "action": "accept", "proto": "udp", "src": ["alice@example.com"], "dst": ["db:53"] },
+		],
+		"tests": [
+			{ "src": "bob@example.com", "accept": ["tag:server:22", "server:443"], "deny": ["tag:server:80"] },
+		],
+	}`)
+
+	acl, tests, err := ParsePolicy(policy)
+	if err != nil {
+		t.Fatalf("failed to parse policy: %v", err)
+	}
+
+	var alice, bob = &User{ID: 1, Subject: "alice@example.com"}, &User{ID: 2, Subject: "bob@example.com"}
+	var machines = []*Machine{
+		{ID: 1, Name: "laptop", IPv4: netip.MustParseAddr("100.64.0.1"), Owner: alice},
+		{ID: 2, Name: "desktop", IPv4: netip.MustParseAddr("100.64.0.2"), Owner: bob},
+		{ID: 3, Name: "server", IPv4: netip.MustParseAddr("100.64.0.3"), Owner: bob, AssignedTags: []string{"tag:server"}},
+	}
+
+	if results := RunPolicyTests(acl, machines, tests); len(results) != 1 || !results[0].Passed {
+		t.Fatalf("expected the policy's own tests to pass; got %+v", results)
+	}
+
+	var cases = []struct {
+		name   string
+		test   PolicyTest
+		passed bool
+	}{
+		{"Accepted", PolicyTest{Src: "alice@example.com", Accept: []string{"server:443"}}, true},
+		{"Denied", PolicyTest{Src: "alice@example.com", Deny: []string{"server:22"}}, true},
+		{"WrongExpectation", PolicyTest{Src: "alice@example.com", Accept: []string{"server:22"}}, false},
+		{"Protocol", PolicyTest{Src: "100.64.0.1", Proto: "udp", Accept: []string{"db:53"}}, true},
+		{"DefaultProtocol", PolicyTest{Src: "laptop", Deny: []string{"db:53"}}, true},
+		{"UnknownSource", PolicyTest{Src: "carol@example.com", Accept: []string{"server:443"}}, false},
+		{"UnknownDestination", PolicyTest{Src: "bob@example.com", Accept: []string{"tag:unknown:22"}}, false},
+		{"InvalidDestination", PolicyTest{Src: "bob@example.com", Accept: []string{"server"}}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			results := RunPolicyTests(acl, machines, []PolicyTest{tc.test})
+			if results[0].Passed != tc.passed {
+				t.Errorf("unexpected result %v; want %v (errors: %v)", results[0].Passed, tc.passed, results[0].Errors)
+			} else if !tc.passed && len(results[0].Errors) == 0 {
+				t.Errorf("expected failed test to report errors")
+			}
+		})
+	}
+}
+
+func TestParsePolicy_Invalid(t *testing.T) {
+	for _, policy := range []string{`{"acls": [}`, `{"tests": "bad"}`} {
+		if _, _, err := ParsePolicy([]byte(policy)); err == nil {
+			t.Errorf("expected error for %q", policy)
+		}
+	}
+
+	if _, tests, err := ParsePolicy([]byte(`{"acls": []}`)); err != nil || len(tests) != 0 {
+		t.Errorf("expected no tests; got %v, %v", tests, err)
+	}
+}
+
+func TestImportPolicy(t *testing.T) {
+	var export = []byte(`{
+		// exported from the admin console
+		"Groups": { "group:ops": ["bob@example.com"] },
+		"tagOwners": { "tag:server": ["group:ops"] },
+		"postures": { "posture:latest": ["node:tsVersion >= '1.60'"] },
+		"ipsets": { "ipset:office": ["10.0.0.0/8"] },
+		"nodeAttrs": [{ "target": ["*"], "attr": ["funnel"] }],
+		"ACLs": [
+			{ "action": "accept", "src": ["group:ops"], "dst": ["tag:server:22"] },
+			{ "action": "accept", "src": ["autogroup:member"], "dst": ["tag:server:443"], "srcPosture": ["posture:latest"] },
+			{ "action": "accept", "src": ["ipset:office"], "dst": ["tag:server:80"] },
+		],
+		"grants": [{ "src": ["*"], "dst": ["tag:server"], "ip": ["*"], "via": ["tag:router"] }],
+		"tests": [{ "src": "bob@example.com", "accept": ["tag:server:22"] }],
+	}`)
+
+	policy, unsupported, err := ImportPolicy(export)
+	if err != nil {
+		t.Fatalf("failed to import policy: %v", err)
+	}
+
+	if len(unsupported) != 6 {
+		t.Errorf("expected 6 unsupported items; got %d: %v", len(unsupported), unsupported)
+	}
+
+	acl, tests, err := ParsePolicy(policy)
+	if err != nil {
+		t.Fatalf("failed to parse imported policy: %v", err)
+	}
+
+	if len(acl.Entries) != 1 || len(acl.Grants) != 0 || len(acl.Groups) != 1 || len(tests) != 1 {
+		t.Errorf("unexpected imported policy: %s", policy)
+	}
+}
+
+func TestResolvePolicy(t *testing.T) {
+	var shared = map[string]string{
+		"baseline": `{
+			// shared by all tailnets
+			"groups": { "group:ops": ["bob@example.com"], "group:dev": ["alice@example.com"] },
+			"tagOwners": { "tag:server": ["group:ops"] },
+			"acls": [{ "action": "accept", "src": ["group:ops"], "dst": ["tag:server:22"] }],
+		}`,
+		"nested": `{ "include": ["baseline"] }`,
+	}
+
+	var lookup = func(name string) ([]byte, error) {
+		if policy, ok := shared[name]; ok {
+			return []byte(policy), nil
+		}
+		return nil, ErrSharedPolicyNotFound
+	}
+
+	policy, err := ResolvePolicy([]byte(`{
+		"include": ["baseline"],
+		"Groups": { "group:dev": ["carol@example.com"] },
+		"acls": [{ "action": "accept", "src": ["group:dev"], "dst": ["tag:server:443"] }],
+	}`), lookup)
+	if err != nil {
+		t.Fatalf("failed to resolve policy: %v", err)
+	}
+
+	acl, _, err := ParsePolicy(policy)
+	if err != nil {
+		t.Fatalf("failed to parse resolved policy: %v", err)
+	}
+
+	if len(acl.Entries) != 2 || len(acl.TagOwners) != 1 {
+		t.Errorf("expected rules and tag owners of both documents; got %s", policy)
+	}
+
+	if dev := acl.Groups["group:dev"]; len(dev) != 1 || dev[0] != "carol@example.com" {
+		t.Errorf("expected the tailnet's group to override the shared one; got %v", dev)
+	}
+
+	if ops := acl.Groups["group:ops"]; len(ops) != 1 {
+		t.Errorf("expected the shared group to be kept; got %v", ops)
+	}
+
+	for _, include := range []string{"unknown", "nested"} {
+		if _, err = ResolvePolicy([]byte(`{"include": ["`+include+`"]}`), lookup); err == nil {
+			t.Errorf("expected error when including %q", include)
+		}
+	}
+
+	var standalone = []byte(`{"acls": []}`)
+	if policy, err = ResolvePolicy(standalone, lookup); err != nil || string(policy) != string(standalone) {
+		t.Errorf("expected policy without includes to be returned as-is; got %s, %v", policy, err)
+	}
+}
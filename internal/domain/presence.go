@@ -0,0 +1,103 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"time"
+)
+
+// Presence is a single transition of a machine between online (connected with a streaming map session) and offline
+type Presence struct {
+	MachineID int       `db:"machine_id" json:"-"`
+	Online    bool      `db:"online" json:"online"`
+	At        time.Time `db:"at" json:"at"`
+}
+
+// RecordPresence records the machine's transition to online (or offline)
+func RecordPresence(m *Machine, online bool) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "INSERT INTO presence (machine_id, online) VALUES (?, ?)",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindInt64(1, int64(m.ID))
+			stmt.BindBool(2, online)
+			return nil
+		},
+	}
+}
+
+// ListPresence returns the machine's transitions since the given time, oldest first. The last transition
+// before since, if any, is included as well, so that the machine's state at the start of the window is known.
+func ListPresence(m *Machine, since time.Time) database.Q[Presence] {
+	return database.Q[Presence]{
+		QueryStr: `
+			SELECT * FROM (SELECT * FROM presence WHERE machine_id = $1 AND at < $2 ORDER BY at DESC LIMIT 1)
+			UNION ALL
+			SELECT * FROM presence WHERE machine_id = $1 AND at >= $2
+			ORDER BY at`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(m.ID))
+			stmt.BindText(2, since.UTC().Format(timestampFormat))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Presence, error) {
+			return database.ScanAs[Presence](stmt)
+		},
+	}
+}
+
+// DeletePresence deletes transitions recorded before the given time. Each machine's latest transition
+// is always kept, so that its state is known even if it hasn't changed for a long time.
+func DeletePresence(before time.Time) database.I[database.EmptyResponse, time.Time] {
+	return database.I[database.EmptyResponse, time.Time]{
+		QueryStr: `
+			DELETE FROM presence
+			WHERE at < ? AND rowid NOT IN (SELECT id FROM (SELECT rowid AS id, max(at) FROM presence GROUP BY machine_id))`,
+		ArgSet: []time.Time{before},
+		Bind: func(stmt *sqlite.Stmt, before time.Time) error {
+			stmt.BindText(1, before.UTC().Format(timestampFormat))
+			return nil
+		},
+	}
+}
+
+// ClosePresence records machines that are still online, as per their last transition, as having gone offline at the given
+// time. It's used on startup to close out sessions that were left open by an unclean shutdown.
+func ClosePresence(at time.Time) database.I[database.EmptyResponse, time.Time] {
+	return database.I[database.EmptyResponse, time.Time]{
+		QueryStr: `
+			INSERT INTO presence (machine_id, online, at)
+			SELECT machine_id, false, ? FROM (SELECT machine_id, online, max(at) FROM presence GROUP BY machine_id) WHERE online`,
+		ArgSet: []time.Time{at},
+		Bind: func(stmt *sqlite.Stmt, at time.Time) error {
+			stmt.BindText(1, at.UTC().Format(timestampFormat))
+			return nil
+		},
+	}
+}
+
+// Uptime returns the duration, within the window [since, until), that the machine was online as per the
+// given transitions (ordered oldest first). The machine is assumed offline before its first transition.
+func Uptime(transitions []*Presence, since, until time.Time) (uptime time.Duration) {
+	var online, from = false, since
+	for _, p := range transitions {
+		var at = p.At
+		if at.Before(since) {
+			at = since
+		} else if at.After(until) {
+			break
+		}
+
+		if online {
+			uptime += at.Sub(from)
+		}
+
+		online, from = p.Online, at
+	}
+
+	if online {
+		uptime += until.Sub(from)
+	}
+
+	return uptime
+}
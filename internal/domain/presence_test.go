@@ -0,0 +1,33 @@
+package domain
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUptime(t *testing.T) {
+	var since = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var until = since.Add(10 * time.Hour)
+	var at = func(h int) time.Time { return since.Add(time.Duration(h) * time.Hour) }
+
+	var cases = []struct {
+		name        string
+		transitions []*Presence
+		want        time.Duration
+	}{
+		{"NoTransitions", nil, 0},
+		{"OnlineBeforeWindow", []*Presence{{Online: true, At: at(-5)}}, 10 * time.Hour},
+		{"OfflineBeforeWindow", []*Presence{{Online: false, At: at(-5)}}, 0},
+		{"WithinWindow", []*Presence{{Online: true, At: at(1)}, {Online: false, At: at(3)}, {Online: true, At: at(8)}}, 4 * time.Hour},
+		{"SpanningStart", []*Presence{{Online: true, At: at(-1)}, {Online: false, At: at(2)}}, 2 * time.Hour},
+		{"RepeatedOnline", []*Presence{{Online: true, At: at(1)}, {Online: true, At: at(4)}, {Online: false, At: at(6)}}, 5 * time.Hour},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Uptime(tc.transitions, since, until); got != tc.want {
+				t.Errorf("unexpected uptime %v; want %v", got, tc.want)
+			}
+		})
+	}
+}
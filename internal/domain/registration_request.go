@@ -10,6 +10,12 @@ import (
 	"time"
 )
 
+// RegistrationExpiredMessage is the error recorded against a registration request that wasn't completed in time
+const RegistrationExpiredMessage = "registration request has expired, please run `tailscale up` again"
+
+// RegistrationAbandonedMessage is the error recorded against a registration request that was abandoned by its client
+const RegistrationAbandonedMessage = "registration flow expired as the client stopped waiting for it, please run `tailscale up` again"
+
 // RegistrationRequest represents a node's request to join a tailnet network.
 //
 // A new request is created when a node first makes the /machine/register request.
@@ -23,27 +29,52 @@ type RegistrationRequest struct {
 	Authenticated bool                    `db:"authenticated"` // is the request authenticated? becomes true after oidc flow completes successfully
 	Error         string                  `db:"error"`         // any error that occurs during authentication flow
 
+	ClientAddr string    `db:"client_addr"`   // ip address of the client that initiated the request
+	Location   *Location `db:"location,json"` // resolved geo / asn location of ClientAddr
+
 	UserID sql.Null[int] `db:"user_id"`
 	User   *User         `db:"user,json"` // the user who authenticated the request
 
-	CreatedAt time.Time `db:"created_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	ConsumedAt  *time.Time `db:"consumed_at"`  // set when the oidc flow for this request is completed; a request can only be consumed once
+	AbandonedAt *time.Time `db:"abandoned_at"` // set while the client isn't following up on the request, eg. after it was interrupted
+}
+
+// Expired returns true if the request was rejected as it expired, or was abandoned by its client
+func (r *RegistrationRequest) Expired() bool {
+	return r.Error == RegistrationExpiredMessage || r.Error == RegistrationAbandonedMessage
 }
 
 // CreateRegistrationRequest creates a new registration request for node, identified by its noise key,
-// and the given request data passed into /machine/register.
-func CreateRegistrationRequest(id string, nk key.MachinePublic, req tailcfg.RegisterRequest) database.I[database.EmptyResponse, RegistrationRequest] {
+// and the given request data passed into /machine/register. The client's address and its
+// resolved location (which can be nil) are recorded alongside the request.
+func CreateRegistrationRequest(id string, nk key.MachinePublic, req tailcfg.RegisterRequest, addr string, loc *Location) database.I[database.EmptyResponse, RegistrationRequest] {
 	return database.I[database.EmptyResponse, RegistrationRequest]{
-		QueryStr: "INSERT INTO machine_registration_requests(id, noise_key, data) VALUES (?, ?, ?)",
-		ArgSet:   []RegistrationRequest{{ID: id, NoiseKey: nk, Data: req}},
+		QueryStr: "INSERT INTO machine_registration_requests(id, noise_key, data, client_addr, location) VALUES (?, ?, ?, ?, ?)",
+		ArgSet:   []RegistrationRequest{{ID: id, NoiseKey: nk, Data: req, ClientAddr: addr, Location: loc}},
 
 		Bind: func(stmt *sqlite.Stmt, arg RegistrationRequest) error {
 			stmt.BindText(1, arg.ID)
 			stmt.BindText(2, arg.NoiseKey.String())
 
 			data, err := json.Marshal(arg.Data)
+			if err != nil {
+				return err
+			}
 			stmt.BindBytes(3, data)
 
-			return err
+			stmt.BindText(4, arg.ClientAddr)
+			if arg.Location != nil {
+				location, err := json.Marshal(arg.Location)
+				if err != nil {
+					return err
+				}
+				stmt.BindBytes(5, location)
+			} else {
+				stmt.BindNull(5)
+			}
+
+			return nil
 		},
 	}
 }
@@ -67,6 +98,28 @@ func RegistrationRequestById(id string) database.Q[RegistrationRequest] {
 	}
 }
 
+// ConsumeRegistrationRequest atomically marks the registration request identified by the given id as consumed,
+// and returns the updated request. It returns nil if no such request exists or if it has already been consumed.
+//
+// When used as the first statement in a transaction, it acquires the database write lock upfront, serializing
+// concurrent attempts to complete the same flow.
+func ConsumeRegistrationRequest(id string) database.Q[RegistrationRequest] {
+	return database.Q[RegistrationRequest]{
+		QueryStr: `
+			UPDATE machine_registration_requests SET consumed_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+			WHERE id = ? AND consumed_at IS NULL AND COALESCE(error, '') = ''
+			RETURNING *
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, id)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*RegistrationRequest, error) {
+			return database.ScanAs[RegistrationRequest](stmt)
+		},
+	}
+}
+
 // SaveRegistrationRequest saves the updated registration request.
 func SaveRegistrationRequest(req *RegistrationRequest) database.I[database.EmptyResponse, *RegistrationRequest] {
 	return database.I[database.EmptyResponse, *RegistrationRequest]{
@@ -87,3 +140,83 @@ func SaveRegistrationRequest(req *RegistrationRequest) database.I[database.Empty
 		},
 	}
 }
+
+// ExpireRegistrationRequests marks all pending (un-authenticated and un-consumed) registration requests created before
+// the given cutoff as expired, by recording RegistrationExpiredMessage as their error. It returns the expired requests.
+func ExpireRegistrationRequests(cutoff time.Time) database.Q[RegistrationRequest] {
+	return database.Q[RegistrationRequest]{
+		QueryStr: `
+			UPDATE machine_registration_requests SET error = $1
+			WHERE authenticated = false AND consumed_at IS NULL AND COALESCE(error, '') = '' AND created_at < $2
+			RETURNING *
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, RegistrationExpiredMessage)
+			stmt.BindText(2, cutoff.UTC().Format(timestampFormat))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*RegistrationRequest, error) {
+			return database.ScanAs[RegistrationRequest](stmt)
+		},
+	}
+}
+
+// AbandonRegistrationRequest records that the client stopped following up on the pending registration request
+// identified by the given id. Requests that have been completed (or rejected) are left as-is.
+func AbandonRegistrationRequest(id string) database.I[database.EmptyResponse, string] {
+	return database.I[database.EmptyResponse, string]{
+		QueryStr: `
+			UPDATE machine_registration_requests SET abandoned_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+			WHERE id = ? AND abandoned_at IS NULL AND authenticated = false AND consumed_at IS NULL AND COALESCE(error, '') = ''
+		`,
+		ArgSet: []string{id},
+		Bind: func(stmt *sqlite.Stmt, id string) error {
+			stmt.BindText(1, id)
+			return nil
+		},
+	}
+}
+
+// ResumeRegistrationRequest records that the client is following up on the registration request (again)
+func ResumeRegistrationRequest(id string) database.I[database.EmptyResponse, string] {
+	return database.I[database.EmptyResponse, string]{
+		QueryStr: "UPDATE machine_registration_requests SET abandoned_at = NULL WHERE id = ? AND abandoned_at IS NOT NULL",
+		ArgSet:   []string{id},
+		Bind: func(stmt *sqlite.Stmt, id string) error {
+			stmt.BindText(1, id)
+			return nil
+		},
+	}
+}
+
+// CancelAbandonedRegistrationRequests marks all pending registration requests abandoned by their clients before
+// the given cutoff as cancelled, by recording RegistrationAbandonedMessage as their error. It returns the cancelled requests.
+func CancelAbandonedRegistrationRequests(cutoff time.Time) database.Q[RegistrationRequest] {
+	return database.Q[RegistrationRequest]{
+		QueryStr: `
+			UPDATE machine_registration_requests SET error = $1
+			WHERE authenticated = false AND consumed_at IS NULL AND COALESCE(error, '') = '' AND abandoned_at < $2
+			RETURNING *
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, RegistrationAbandonedMessage)
+			stmt.BindText(2, cutoff.UTC().Format(timestampFormat))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*RegistrationRequest, error) {
+			return database.ScanAs[RegistrationRequest](stmt)
+		},
+	}
+}
+
+// DeleteRegistrationRequests deletes all registration requests created before the given time.
+func DeleteRegistrationRequests(before time.Time) database.I[database.EmptyResponse, time.Time] {
+	return database.I[database.EmptyResponse, time.Time]{
+		QueryStr: "DELETE FROM machine_registration_requests WHERE created_at < ?",
+		ArgSet:   []time.Time{before},
+		Bind: func(stmt *sqlite.Stmt, before time.Time) error {
+			stmt.BindText(1, before.UTC().Format(timestampFormat))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,225 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"encoding/json"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Route is a subnet route advertised by a machine, using tailscale up --advertise-routes.
+//
+// Peers only route traffic for the prefix through the machine once the route has been approved, either
+// manually using the admin api or automatically using the autoApprovers section of the tailnet's acl policy.
+type Route struct {
+	ID        int          `db:"id" json:"id"`
+	MachineID int          `db:"machine_id" json:"machine_id"`
+	Prefix    netip.Prefix `db:"prefix" json:"prefix"`
+	Approved  bool         `db:"approved" json:"approved"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// CanAutoApprove returns true if the route, advertised by the machine, is approved automatically as per the
+// autoApprovers section of the tailnet's acl policy. A route is approved if it's contained in one of the policy's
+// prefixes, and the machine's owner (directly, or using a group or autogroup:member) or one of its tags is an approver.
+func (t *Tailnet) CanAutoApprove(m *Machine, route netip.Prefix) bool {
+	if t.Acl == nil || t.Acl.ACL == nil {
+		return false
+	}
+
+	var isApprover = func(approver string) bool {
+		switch {
+		case strings.HasPrefix(approver, "tag:"):
+			return slices.Contains(m.AssignedTags, approver)
+		case len(m.AssignedTags) > 0:
+			return false // tagged machines are only approved using their tags
+		case approver == "autogroup:member", approver == m.Owner.LoginName():
+			return true
+		case strings.HasPrefix(approver, "group:"):
+			return slices.Contains(t.Acl.Groups[approver], m.Owner.LoginName())
+		}
+		return false
+	}
+
+	for p, approvers := range t.Acl.AutoApprovers.Routes {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil || prefix.Addr().Is4() != route.Addr().Is4() || prefix.Bits() > route.Bits() || !prefix.Contains(route.Addr()) {
+			continue
+		}
+
+		if slices.ContainsFunc(approvers, isApprover) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ListRoutes returns all routes advertised by the machine.
+func ListRoutes(m *Machine) database.Q[Route] {
+	return database.Q[Route]{
+		QueryStr: "SELECT * FROM routes WHERE machine_id = $1 ORDER BY prefix",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(m.ID))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Route, error) {
+			return database.ScanAs[Route](stmt)
+		},
+	}
+}
+
+// ListTailnetRoutes returns the approved routes of all machines in the given tailnet.
+func ListTailnetRoutes(tailnet *Tailnet) database.Q[Route] {
+	return database.Q[Route]{
+		QueryStr: `
+			SELECT r.* FROM routes r JOIN machines m ON m.id = r.machine_id
+				WHERE m.tailnet_id = $1 AND r.approved ORDER BY r.prefix
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(tailnet.ID))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Route, error) {
+			return database.ScanAs[Route](stmt)
+		},
+	}
+}
+
+// AdvertiseRoutes records the routes advertised by the machine, mapped to whether they're approved automatically.
+// Routes that are already known are approved if required, but are never un-approved, so that manual approvals aren't lost.
+func AdvertiseRoutes(m *Machine, routes map[netip.Prefix]bool) database.I[database.EmptyResponse, netip.Prefix] {
+	var prefixes = make([]netip.Prefix, 0, len(routes))
+	for prefix := range routes {
+		prefixes = append(prefixes, prefix)
+	}
+
+	return database.I[database.EmptyResponse, netip.Prefix]{
+		QueryStr: `
+			INSERT INTO routes (machine_id, prefix, approved) VALUES (?, ?, ?)
+				ON CONFLICT (machine_id, prefix) DO UPDATE SET approved = approved OR EXCLUDED.approved
+		`,
+		ArgSet: prefixes,
+		Bind: func(stmt *sqlite.Stmt, prefix netip.Prefix) error {
+			stmt.BindInt64(1, int64(m.ID))
+			stmt.BindText(2, prefix.String())
+			stmt.BindBool(3, routes[prefix])
+			return nil
+		},
+	}
+}
+
+// RemoveStaleRoutes removes all routes of the machine that aren't in the list of advertised routes.
+func RemoveStaleRoutes(m *Machine, advertised []netip.Prefix) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "DELETE FROM routes WHERE machine_id = ? AND prefix NOT IN (SELECT value FROM json_each(?))",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			var prefixes = make([]string, 0, len(advertised))
+			for _, prefix := range advertised {
+				prefixes = append(prefixes, prefix.String())
+			}
+
+			buf, err := json.Marshal(prefixes)
+			if err != nil {
+				return err
+			}
+
+			stmt.BindInt64(1, int64(m.ID))
+			stmt.BindText(2, string(buf))
+			return nil
+		},
+	}
+}
+
+// SetApprovedRoutes approves the given routes of the machine, and un-approves all others.
+func SetApprovedRoutes(m *Machine, approved []netip.Prefix) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE routes SET approved = prefix IN (SELECT value FROM json_each(?)) WHERE machine_id = ?",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			var prefixes = make([]string, 0, len(approved))
+			for _, prefix := range approved {
+				prefixes = append(prefixes, prefix.String())
+			}
+
+			buf, err := json.Marshal(prefixes)
+			if err != nil {
+				return err
+			}
+
+			stmt.BindText(1, string(buf))
+			stmt.BindInt64(2, int64(m.ID))
+			return nil
+		},
+	}
+}
+
+// ExitNodeUsage reports the machines using an exit node, as reported by their clients.
+type ExitNodeUsage struct {
+	MachineID int      `db:"machine_id" json:"machine_id"`
+	Name      string   `db:"name" json:"name"`            // complete name of the exit node
+	Approved  bool     `db:"approved" json:"approved"`    // whether the machine's exit routes are approved
+	Clients   []string `db:"clients,json" json:"clients"` // complete names of the machines using the exit node
+}
+
+// SetExitNode records the exit node the machine reports using, or clears it if exitNode is zero.
+// Exit nodes outside the machine's tailnet are ignored.
+func SetExitNode(m *Machine, exitNode int) database.I[database.EmptyResponse, *Machine] {
+	var query = `
+		INSERT INTO exit_node_usage (machine_id, exit_node_id) 
+			SELECT $1, id FROM machines WHERE id = $2 AND tailnet_id = $3 AND id != $1
+		ON CONFLICT (machine_id) 
+			DO UPDATE SET exit_node_id = EXCLUDED.exit_node_id, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+			WHERE exit_node_id != EXCLUDED.exit_node_id
+	`
+
+	if exitNode == 0 {
+		query = "DELETE FROM exit_node_usage WHERE machine_id = $1"
+	}
+
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: query,
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindInt64(1, int64(m.ID))
+			if exitNode != 0 {
+				stmt.BindInt64(2, int64(exitNode))
+				stmt.BindInt64(3, int64(m.TailnetID))
+			}
+			return nil
+		},
+	}
+}
+
+// ListExitNodeUsage returns the usage of all exit nodes in the given tailnet, ie. machines that advertise
+// exit routes, or that are reported as being used as one, along with the machines using them.
+func ListExitNodeUsage(tailnetID int64) database.Q[ExitNodeUsage] {
+	return database.Q[ExitNodeUsage]{
+		QueryStr: `
+			SELECT 
+				m.id AS machine_id,
+				iif(m.name_idx = 0, m.name, m.name || '-' || m.name_idx) AS name,
+				EXISTS (SELECT 1 FROM routes r WHERE r.machine_id = m.id AND r.prefix IN ('0.0.0.0/0', '::/0') AND r.approved) AS approved,
+				(SELECT json_group_array(iif(c.name_idx = 0, c.name, c.name || '-' || c.name_idx)) 
+					FROM exit_node_usage u JOIN machines c ON c.id = u.machine_id WHERE u.exit_node_id = m.id) AS clients
+			FROM machines m
+				WHERE m.tailnet_id = $1 AND (
+					EXISTS (SELECT 1 FROM routes r WHERE r.machine_id = m.id AND r.prefix IN ('0.0.0.0/0', '::/0')) OR 
+					EXISTS (SELECT 1 FROM exit_node_usage u WHERE u.exit_node_id = m.id)
+				)
+			ORDER BY m.id
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnetID)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*ExitNodeUsage, error) {
+			return database.ScanAs[ExitNodeUsage](stmt)
+		},
+	}
+}
@@ -0,0 +1,83 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"time"
+)
+
+// MapSession is the persisted state of a machine's map session, that survives server restarts
+type MapSession struct {
+	MachineID int    `db:"machine_id"`
+	Checksum  string `db:"checksum"` // checksum of the state last reported by the machine's client
+
+	// Handle, Seq and State describe the streaming map session that was open when the server last shut down, which the
+	// client may resume (see: tailcfg.MapRequest.MapSessionHandle); Handle is empty if there's no such session.
+	Handle string `db:"handle"`
+	Seq    int64  `db:"seq"`   // sequence number of the last response sent in the session
+	State  string `db:"state"` // json-encoded state of the session, as kept by the coordinator
+
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// MapSessionByMachine returns the persisted map session state of the machine, if any
+func MapSessionByMachine(m *Machine) database.Q[MapSession] {
+	return database.Q[MapSession]{
+		QueryStr: "SELECT * FROM map_sessions WHERE machine_id = $1",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(m.ID))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*MapSession, error) {
+			return database.ScanAs[MapSession](stmt)
+		},
+	}
+}
+
+// SaveMapSession records the checksum of the state last reported by the machine's client
+func SaveMapSession(m *Machine, checksum string) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: `
+			INSERT INTO map_sessions (machine_id, checksum) VALUES ($1, $2)
+			ON CONFLICT (machine_id)
+				DO UPDATE SET checksum = EXCLUDED.checksum, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+		`,
+		ArgSet: []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindInt64(1, int64(m.ID))
+			stmt.BindText(2, checksum)
+			return nil
+		},
+	}
+}
+
+// SaveMapSessionState saves the state of the machine's streaming map session, so that its client can resume it
+func SaveMapSessionState(m *Machine, handle string, seq int64, state []byte) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: `
+			INSERT INTO map_sessions (machine_id, checksum, handle, seq, state) VALUES ($1, '', $2, $3, $4)
+			ON CONFLICT (machine_id)
+				DO UPDATE SET handle = EXCLUDED.handle, seq = EXCLUDED.seq, state = EXCLUDED.state, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+		`,
+		ArgSet: []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindInt64(1, int64(m.ID))
+			stmt.BindText(2, handle)
+			stmt.BindInt64(3, seq)
+			stmt.BindText(4, string(state))
+			return nil
+		},
+	}
+}
+
+// ClearMapSessionState clears the saved state of the machine's streaming map session, if any
+func ClearMapSessionState(m *Machine) database.I[database.EmptyResponse, *Machine] {
+	return database.I[database.EmptyResponse, *Machine]{
+		QueryStr: "UPDATE map_sessions SET handle = '', seq = 0, state = '' WHERE machine_id = $1 AND handle != ''",
+		ArgSet:   []*Machine{m},
+		Bind: func(stmt *sqlite.Stmt, m *Machine) error {
+			stmt.BindInt64(1, int64(m.ID))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,56 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"encoding/json"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"time"
+)
+
+// Setting represents an overridden value of a runtime-tunable setting.
+//
+// For the list of available settings and typed access to their values, see settings package.
+type Setting struct {
+	Key   string          `db:"key"`        // unique, dot-separated name of the setting
+	Value json.RawMessage `db:"value,json"` // json-encoded value of the setting
+
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// ListSettings returns all settings that have been overridden.
+func ListSettings() database.Q[Setting] {
+	return database.Q[Setting]{
+		QueryStr: "SELECT * FROM settings",
+		Val: func(stmt *sqlite.Stmt) (*Setting, error) {
+			return database.ScanAs[Setting](stmt)
+		},
+	}
+}
+
+// SaveSetting upsert the value of the given setting.
+func SaveSetting(s *Setting) database.I[database.EmptyResponse, *Setting] {
+	return database.I[database.EmptyResponse, *Setting]{
+		QueryStr: `
+			INSERT INTO settings (key, value) VALUES ($1, $2)
+			ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+		`,
+		ArgSet: []*Setting{s},
+		Bind: func(stmt *sqlite.Stmt, s *Setting) error {
+			stmt.BindText(1, s.Key)
+			stmt.BindBytes(2, s.Value)
+			return nil
+		},
+	}
+}
+
+// DeleteSetting deletes the overridden value of the given setting, resetting it to its default value.
+func DeleteSetting(key string) database.I[database.EmptyResponse, string] {
+	return database.I[database.EmptyResponse, string]{
+		QueryStr: "DELETE FROM settings WHERE key = ?",
+		ArgSet:   []string{key},
+		Bind: func(stmt *sqlite.Stmt, key string) error {
+			stmt.BindText(1, key)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,114 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"time"
+)
+
+// SSHCheck is an ssh connection held by its destination machine, as per an ssh rule with the check action, until the
+// owner of the source machine re-authenticates. Once authenticated, the check holds for the rule's check period,
+// during which connections from any of the user's machines to the destination are accepted without another check.
+//
+// For more details on the flow, see coordinator.MachineSSHAction and oidc.SSHCheckStart
+type SSHCheck struct {
+	ID           string `db:"id"` // random text id used to identify checks; exposed in the check url
+	SrcMachineID int    `db:"src_machine_id"`
+	DstMachineID int    `db:"dst_machine_id"`
+	UserID       int    `db:"user_id"`      // owner of the source machine, who must re-authenticate
+	LocalUser    string `db:"local_user"`   // user on the destination machine the connection logs in as
+	CheckPeriod  int    `db:"check_period"` // seconds for which the check holds once authenticated
+
+	AuthenticatedAt *time.Time `db:"authenticated_at"`
+	CreatedAt       time.Time  `db:"created_at"`
+}
+
+// CreateSSHCheck creates a new, pending, check
+func CreateSSHCheck(c *SSHCheck) database.I[database.EmptyResponse, *SSHCheck] {
+	return database.I[database.EmptyResponse, *SSHCheck]{
+		QueryStr: "INSERT INTO ssh_checks (id, src_machine_id, dst_machine_id, user_id, local_user, check_period) VALUES (?, ?, ?, ?, ?, ?)",
+		ArgSet:   []*SSHCheck{c},
+		Bind: func(stmt *sqlite.Stmt, c *SSHCheck) error {
+			stmt.BindText(1, c.ID)
+			stmt.BindInt64(2, int64(c.SrcMachineID))
+			stmt.BindInt64(3, int64(c.DstMachineID))
+			stmt.BindInt64(4, int64(c.UserID))
+			stmt.BindText(5, c.LocalUser)
+			stmt.BindInt64(6, int64(c.CheckPeriod))
+			return nil
+		},
+	}
+}
+
+// SSHCheckById returns the check identified by the given id
+func SSHCheckById(id string) database.Q[SSHCheck] {
+	return database.Q[SSHCheck]{
+		QueryStr: "SELECT * FROM ssh_checks WHERE id = ?",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, id)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*SSHCheck, error) {
+			return database.ScanAs[SSHCheck](stmt)
+		},
+	}
+}
+
+// AuthenticateSSHCheck marks the pending check as authenticated by the user, and returns it. Nothing is returned
+// if the check doesn't exist, is already authenticated, or the user isn't the one the check is held for.
+func AuthenticateSSHCheck(id string, userID int) database.Q[SSHCheck] {
+	return database.Q[SSHCheck]{
+		QueryStr: `
+			UPDATE ssh_checks SET authenticated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+			WHERE id = ? AND user_id = ? AND authenticated_at IS NULL
+			RETURNING *
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, id)
+			stmt.BindInt64(2, int64(userID))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*SSHCheck, error) {
+			return database.ScanAs[SSHCheck](stmt)
+		},
+	}
+}
+
+// FindValidSSHCheck returns the most recently authenticated check of the user, for connections to the destination machine
+// as the local user, that still holds at the given time. Checks with a zero check period never hold for later connections.
+func FindValidSSHCheck(userID, dstMachineID int, localUser string, at time.Time) database.Q[SSHCheck] {
+	return database.Q[SSHCheck]{
+		QueryStr: `
+			SELECT * FROM ssh_checks
+			WHERE user_id = $1 AND dst_machine_id = $2 AND local_user = $3 AND authenticated_at IS NOT NULL
+				AND check_period > 0 AND strftime('%Y-%m-%dT%H:%M:%fZ', authenticated_at, '+' || check_period || ' seconds') > $4
+			ORDER BY authenticated_at DESC
+			LIMIT 1
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(userID))
+			stmt.BindInt64(2, int64(dstMachineID))
+			stmt.BindText(3, localUser)
+			stmt.BindText(4, at.UTC().Format(timestampFormat))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*SSHCheck, error) {
+			return database.ScanAs[SSHCheck](stmt)
+		},
+	}
+}
+
+// DeleteSSHChecks deletes checks created before the given time that no longer hold, ie. that were never authenticated,
+// or whose check period has passed.
+func DeleteSSHChecks(before time.Time) database.I[database.EmptyResponse, time.Time] {
+	return database.I[database.EmptyResponse, time.Time]{
+		QueryStr: `
+			DELETE FROM ssh_checks
+			WHERE created_at < $1 AND (authenticated_at IS NULL OR strftime('%Y-%m-%dT%H:%M:%fZ', authenticated_at, '+' || check_period || ' seconds') < $1)`,
+		ArgSet: []time.Time{before},
+		Bind: func(stmt *sqlite.Stmt, before time.Time) error {
+			stmt.BindText(1, before.UTC().Format(timestampFormat))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,84 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"time"
+)
+
+// List of ssh session events
+const (
+	SSHSessionAccepted            = "accepted"             // connection accepted after a check (see: SSHCheck)
+	SSHSessionRejected            = "rejected"             // connection rejected after a check, eg. as the user didn't re-authenticate in time
+	SSHSessionRecordingRejected   = "recording_rejected"   // session rejected as it couldn't be recorded
+	SSHSessionRecordingTerminated = "recording_terminated" // session terminated as its recording failed midway
+	SSHSessionRecordingFailed     = "recording_failed"     // session allowed to continue, though its recording failed
+)
+
+// SSHSession is an event in the lifecycle of a tailscale ssh connection, that tells who connected to what, and when.
+// Events are either reported by the destination machine, or recorded as the connection is decided by the server.
+//
+// Events are kept after either machine is deleted, in which case its name is no longer known.
+type SSHSession struct {
+	ID           int    `db:"id" json:"id"`
+	TailnetID    int    `db:"tailnet_id" json:"tailnet_id"`
+	Event        string `db:"event" json:"event"`
+	ConnectionID string `db:"connection_id" json:"connection_id,omitempty"` // id of the connection assigned by the destination
+	SrcMachineID int    `db:"src_machine_id" json:"src_machine_id"`
+	SrcMachine   string `db:"src_machine" json:"src_machine"` // complete name of the source machine
+	DstMachineID int    `db:"dst_machine_id" json:"dst_machine_id"`
+	DstMachine   string `db:"dst_machine" json:"dst_machine"` // complete name of the destination machine
+	SSHUser      string `db:"ssh_user" json:"ssh_user,omitempty"`
+	LocalUser    string `db:"local_user" json:"local_user"`
+	Message      string `db:"message" json:"message,omitempty"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// RecordSSHSession records the given ssh session event(s)
+func RecordSSHSession(events ...*SSHSession) database.I[database.EmptyResponse, *SSHSession] {
+	return database.I[database.EmptyResponse, *SSHSession]{
+		QueryStr: `
+			INSERT INTO ssh_sessions (tailnet_id, event, connection_id, src_machine_id, dst_machine_id, ssh_user, local_user, message)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		ArgSet: events,
+		Bind: func(stmt *sqlite.Stmt, e *SSHSession) error {
+			stmt.BindInt64(1, int64(e.TailnetID))
+			stmt.BindText(2, e.Event)
+			stmt.BindText(3, e.ConnectionID)
+			stmt.BindInt64(4, int64(e.SrcMachineID))
+			stmt.BindInt64(5, int64(e.DstMachineID))
+			stmt.BindText(6, e.SSHUser)
+			stmt.BindText(7, e.LocalUser)
+			stmt.BindText(8, e.Message)
+			return nil
+		},
+	}
+}
+
+// ListSSHSessions returns the most recent ssh session events of the tailnet, newest first. If machineID is non-zero,
+// only events of connections made from or to the given machine are returned.
+func ListSSHSessions(tailnetID, machineID int64, limit int) database.Q[SSHSession] {
+	return database.Q[SSHSession]{
+		QueryStr: `
+			SELECT s.*,
+				coalesce(iif(src.name_idx = 0, src.name, src.name || '-' || src.name_idx), '') AS src_machine,
+				coalesce(iif(dst.name_idx = 0, dst.name, dst.name || '-' || dst.name_idx), '') AS dst_machine
+			FROM ssh_sessions s
+				LEFT JOIN machines src ON src.id = s.src_machine_id
+				LEFT JOIN machines dst ON dst.id = s.dst_machine_id
+			WHERE s.tailnet_id = $1 AND ($2 = 0 OR s.src_machine_id = $2 OR s.dst_machine_id = $2)
+			ORDER BY s.id DESC
+			LIMIT $3
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnetID)
+			stmt.BindInt64(2, machineID)
+			stmt.BindInt64(3, int64(limit))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*SSHSession, error) {
+			return database.ScanAs[SSHSession](stmt)
+		},
+	}
+}
@@ -2,16 +2,21 @@ package domain
 
 import (
 	"crawshaw.io/sqlite"
+	"encoding/json"
 	"github.com/pkg/errors"
 	"github.com/riyaz-ali/tacl"
 	"github.com/riyaz-ali/wirefire/internal/database"
 	"net/mail"
+	"net/netip"
+	"net/url"
+	"slices"
 	"strings"
+	"tailscale.com/tailcfg"
 	"tailscale.com/util/dnsname"
 	"time"
 )
 
-// ACL wraps tacl.ACL to implement encoding.TextUnmarshaler which uses tacl.Parse
+// ACL wraps tacl.ACL to implement encoding.TextUnmarshaler which uses ParsePolicy
 // to parse HuJson formatted policy into ACL struct
 type ACL struct{ *tacl.ACL }
 
@@ -20,7 +25,7 @@ func (a *ACL) UnmarshalText(buf []byte) error {
 		return errors.New("acl: nil pointer")
 	}
 
-	acl, err := tacl.Parse(buf)
+	acl, _, err := ParsePolicy(buf)
 	if err != nil {
 		return err
 	}
@@ -33,7 +38,53 @@ func (a *ACL) UnmarshalText(buf []byte) error {
 type Tailnet struct {
 	ID   int    `db:"id"`   // auto-generated unique id of the tailnet
 	Name string `db:"name"` // unique name of the tailnet
-	Acl  *ACL   `db:"acl"`  // this tailnet's access control policy
+	Acl  *ACL   `db:"acl"`  // this tailnet's access control policy, with any included shared policies resolved
+
+	// AclSource is the tailnet's policy document, as it was submitted, if it includes shared policies; empty otherwise.
+	AclSource string `db:"acl_source"`
+
+	// HideOfflineAfter is the number of days after which machines that haven't been seen are hidden
+	// from their peers' netmaps. Hidden machines are not deleted. Zero disables the policy.
+	HideOfflineAfter int `db:"hide_offline_after"`
+
+	// DeleteExpiredAfter is the number of days after which machines whose key has expired are deleted,
+	// freeing their ip address. Locked machines are never deleted. Zero disables the policy.
+	DeleteExpiredAfter int `db:"delete_expired_after"`
+
+	// ForceDerp forces all connections between machines in the tailnet to be relayed over derp
+	ForceDerp bool `db:"force_derp"`
+
+	// RequireApproval holds new machines in a pending state (see Machine.Authorized) until an admin approves them
+	RequireApproval bool `db:"require_approval"`
+
+	// Naming is how the tailnet's new machines are named; see Naming
+	Naming string `db:"naming"`
+
+	// IPv4Pool and IPv6Pool are the prefixes the tailnet's machines are allocated addresses from; the global defaults if unset
+	IPv4Pool netip.Prefix `db:"ipv4_pool"`
+	IPv6Pool netip.Prefix `db:"ipv6_pool"`
+
+	// Capabilities maps a tailnet role to the node capabilities granted to machines owned by users with that role.
+	// Clients use these to enable features in their UI, eg. tailcfg.CapabilityAdmin shows a link to the admin console.
+	Capabilities map[string][]tailcfg.NodeCapability `db:"capabilities,json"`
+
+	// DNS holds the tailnet's fallback resolvers and split dns routes
+	DNS DNS `db:"dns,json"`
+
+	// Welcome is the message shown to users when they add a new device to the tailnet
+	Welcome Welcome `db:"welcome,json"`
+
+	// Features are the client features enabled for the tailnet's machines
+	Features Features `db:"features,json"`
+
+	// Privacy controls which of a machine's host details are shared with its peers
+	Privacy Privacy `db:"privacy,json"`
+
+	// Guardrails limits the size of the netmaps sent to the tailnet's machines
+	Guardrails Guardrails `db:"guardrails,json"`
+
+	// Logging controls whether the tailnet's machines stream their client logs, and where to
+	Logging Logging `db:"logging,json"`
 
 	CreatedAt time.Time `db:"created_at"`
 	UpdatedAt time.Time `db:"updated_at"`
@@ -45,6 +96,61 @@ type Tailnet struct {
 	Role string `db:"role"`
 }
 
+// CapabilitiesFor returns the node capabilities granted to machines owned by users with the given role.
+// Owners are granted the capabilities of admins, unless the tailnet grants them capabilities of their own.
+func (t *Tailnet) CapabilitiesFor(role string) []tailcfg.NodeCapability {
+	if caps, ok := t.Capabilities[role]; ok || role != RoleOwner {
+		return caps
+	}
+	return t.Capabilities[RoleAdmin]
+}
+
+// ErrTagNotPermitted is returned when a machine requests a tag that its owner is not allowed to apply
+var ErrTagNotPermitted = errors.New("requested tag is invalid or not permitted")
+
+// VerifyTags checks that the user, with the given role in the tailnet, is allowed to apply all the tags.
+//
+// Only tags declared in the tagOwners section of the tailnet's acl policy can be applied. Admins can apply any
+// declared tag, while other users must be listed as one of the tag's owners, either directly, using a group,
+// or using autogroup:member.
+func (t *Tailnet) VerifyTags(u *User, role string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	if t.Acl == nil || t.Acl.ACL == nil {
+		return errors.Wrap(ErrTagNotPermitted, tags[0])
+	}
+
+	var owns = func(tag string) bool {
+		owners, declared := t.Acl.TagOwners[tag]
+		if !declared {
+			return false
+		} else if HasRole(role, RoleAdmin) {
+			return true
+		}
+
+		for _, owner := range owners {
+			switch {
+			case owner == u.LoginName(), owner == tacl.AutoGroupMember:
+				return true
+			case strings.HasPrefix(owner, "group:") && slices.Contains(t.Acl.Groups[owner], u.LoginName()):
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, tag := range tags {
+		if !owns(tag) {
+			return errors.Wrap(ErrTagNotPermitted, tag)
+		}
+	}
+
+	return nil
+}
+
 func SanitizeTailnetName(name string) string {
 	name = strings.ToLower(name)
 
@@ -76,6 +182,415 @@ func TailnetById(id int64) database.Q[Tailnet] {
 	}
 }
 
+// TailnetByName returns the Tailnet with the given name.
+func TailnetByName(name string) database.Q[Tailnet] {
+	return database.Q[Tailnet]{
+		QueryStr: "SELECT * FROM tailnets WHERE name = $1",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, name)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Tailnet, error) {
+			return database.ScanAs[Tailnet](stmt)
+		},
+	}
+}
+
+// ListAllTailnets returns all tailnets managed by this server.
+func ListAllTailnets() database.Q[Tailnet] {
+	return database.Q[Tailnet]{
+		QueryStr: "SELECT * FROM tailnets ORDER BY id",
+		Val: func(stmt *sqlite.Stmt) (*Tailnet, error) {
+			return database.ScanAs[Tailnet](stmt)
+		},
+	}
+}
+
+// CreateTailnet creates a new tailnet with the given name and returns the created record.
+// The tailnet starts with the default, allow-all acl policy.
+func CreateTailnet(name string) database.Q[Tailnet] {
+	return database.Q[Tailnet]{
+		QueryStr: "INSERT INTO tailnets (name) VALUES ($1) RETURNING *",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, name)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Tailnet, error) {
+			return database.ScanAs[Tailnet](stmt)
+		},
+	}
+}
+
+// DeleteTailnet deletes the tailnet along with its members, machines, auth keys, notices and audit events.
+func DeleteTailnet(t *Tailnet) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "DELETE FROM tailnets WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			stmt.BindInt64(1, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// TailnetPolicy returns the tailnet's acl policy document, as it was submitted, or, if resolved is set,
+// with the shared policies it includes resolved.
+func TailnetPolicy(id int64, resolved bool) database.Q[string] {
+	return database.Q[string]{
+		QueryStr: "SELECT iif(?2, acl, COALESCE(acl_source, acl)) FROM tailnets WHERE id = ?1", // numbered; $2 would be bound first, as it appears first
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, id)
+			stmt.BindBool(2, resolved)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*string, error) {
+			policy := stmt.ColumnText(0)
+			return &policy, nil
+		},
+	}
+}
+
+// SetTailnetPolicy replaces the tailnet's acl policy document. The policy must be validated (using ParsePolicy) beforehand.
+// If the policy includes shared policies, policy is the resolved document (see ResolvePolicy) and source is the one
+// that was submitted; source is nil otherwise.
+func SetTailnetPolicy(t *Tailnet, policy, source []byte) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET acl = ?, acl_source = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			stmt.BindText(1, string(policy))
+			if source != nil {
+				stmt.BindText(2, string(source))
+			} else {
+				stmt.BindNull(2)
+			}
+			stmt.BindInt64(3, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// SetHideOfflineAfter updates the tailnet's HideOfflineAfter policy.
+func SetHideOfflineAfter(t *Tailnet, days int) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET hide_offline_after = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			stmt.BindInt64(1, int64(days))
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// SetDeleteExpiredAfter updates the tailnet's DeleteExpiredAfter policy.
+func SetDeleteExpiredAfter(t *Tailnet, days int) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET delete_expired_after = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			stmt.BindInt64(1, int64(days))
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// SetTailnetForceDerp updates the tailnet's ForceDerp policy.
+func SetTailnetForceDerp(t *Tailnet, force bool) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET force_derp = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			stmt.BindBool(1, force)
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// SetTailnetPools updates the prefixes the tailnet's machines are allocated addresses from. An invalid (zero) prefix uses the global default.
+func SetTailnetPools(t *Tailnet, v4, v6 netip.Prefix) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET ipv4_pool = ?, ipv6_pool = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			p4, _ := v4.MarshalText() // zero value is marshalled as empty string
+			p6, _ := v6.MarshalText()
+
+			stmt.BindText(1, string(p4))
+			stmt.BindText(2, string(p6))
+			stmt.BindInt64(3, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// SetTailnetRequireApproval updates the tailnet's RequireApproval policy. Machines already in the tailnet are not affected.
+func SetTailnetRequireApproval(t *Tailnet, require bool) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET require_approval = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			stmt.BindBool(1, require)
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// Machine naming modes, set per tailnet (see: Tailnet.Naming)
+const (
+	NamingHostname = "hostname" // machines are named after their client's hostname, and renamed as it changes
+	NamingWords    = "words"    // machines are given a memorable, generated name (eg. brave-otter), kept as their hostname changes
+)
+
+// IsValidNaming returns true if naming is one of the known machine naming modes
+func IsValidNaming(naming string) bool {
+	return naming == NamingHostname || naming == NamingWords
+}
+
+// SetTailnetNaming updates the tailnet's machine naming mode. Machines already in the tailnet keep their names.
+func SetTailnetNaming(t *Tailnet, naming string) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET naming = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			stmt.BindText(1, naming)
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// MaxWelcomeLength is the maximum length, in bytes, of a tailnet's welcome message
+const MaxWelcomeLength = 2048
+
+// Welcome is a tailnet's welcome message, eg. onboarding instructions for new team members. It's shown on the
+// login page once a new device is added, and, if Health is set, delivered to the device as a health message for a while.
+type Welcome struct {
+	Message string `json:"message,omitempty"`
+	Health  bool   `json:"health,omitempty"`
+}
+
+// SetTailnetWelcome replaces the tailnet's welcome message.
+func SetTailnetWelcome(t *Tailnet, welcome *Welcome) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET welcome = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			buf, err := json.Marshal(welcome)
+			if err != nil {
+				return err
+			}
+
+			stmt.BindBytes(1, buf)
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// Features are client features that are enabled, or disabled, centrally for all machines in a tailnet.
+type Features struct {
+	Taildrop bool `json:"taildrop"` // lets machines send files to other machines of the same owner
+	Funnel   bool `json:"funnel"`   // lets machines expose services to the internet; requires https certificates
+	SSH      bool `json:"ssh"`      // lets machines run tailscale ssh servers, as permitted by the acl policy's ssh section
+
+	// WebClient lets a machine's owner, and the tailnet's admins, manage the machine using its client's
+	// built-in web interface (tailscale web), from any of their (untagged) machines
+	WebClient bool `json:"web_client"`
+}
+
+// Capabilities returns the node capabilities that enable the features on clients
+func (f Features) Capabilities() (caps []tailcfg.NodeCapability) {
+	if f.Taildrop {
+		caps = append(caps, tailcfg.CapabilityFileSharing)
+	}
+
+	if f.Funnel {
+		caps = append(caps, tailcfg.NodeAttrFunnel)
+	}
+
+	if f.SSH {
+		caps = append(caps, tailcfg.CapabilitySSH)
+	}
+
+	return caps
+}
+
+// SetTailnetFeatures replaces the tailnet's enabled features.
+func SetTailnetFeatures(t *Tailnet, features *Features) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET features = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			buf, err := json.Marshal(features)
+			if err != nil {
+				return err
+			}
+
+			stmt.BindBytes(1, buf)
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// SetTailnetCapabilities replaces the tailnet's node capability grants.
+func SetTailnetCapabilities(t *Tailnet, capabilities map[string][]tailcfg.NodeCapability) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET capabilities = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			buf, err := json.Marshal(capabilities)
+			if err != nil {
+				return err
+			}
+
+			stmt.BindBytes(1, buf)
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// Privacy controls which of a machine's host details (reported by its client in tailcfg.Hostinfo) are propagated to its
+// peers, for privacy-sensitive deployments. Redacted details are still visible to the machine itself, and in the admin api.
+type Privacy struct {
+	HideOS          bool `json:"hide_os"`           // hides the operating system, its version and distribution
+	HideDeviceModel bool `json:"hide_device_model"` // hides the device model and hardware architecture
+	HideHostname    bool `json:"hide_hostname"`     // hides the os hostname; the machine's (magic dns) name is always shared
+}
+
+// Redact returns a copy of hi, with the details hidden by the privacy settings removed.
+// hi is returned as-is if nothing is to be hidden.
+func (p Privacy) Redact(hi *tailcfg.Hostinfo) *tailcfg.Hostinfo {
+	if hi == nil || (!p.HideOS && !p.HideDeviceModel && !p.HideHostname) {
+		return hi
+	}
+
+	var out = hi.Clone()
+	if p.HideOS {
+		out.OS, out.OSVersion, out.Desktop = "", "", ""
+		out.Distro, out.DistroVersion, out.DistroCodeName = "", "", ""
+	}
+
+	if p.HideDeviceModel {
+		out.DeviceModel, out.Machine = "", ""
+	}
+
+	if p.HideHostname {
+		out.Hostname = ""
+	}
+
+	return out
+}
+
+// SetTailnetPrivacy replaces the tailnet's privacy settings.
+func SetTailnetPrivacy(t *Tailnet, privacy *Privacy) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET privacy = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			buf, err := json.Marshal(privacy)
+			if err != nil {
+				return err
+			}
+
+			stmt.BindBytes(1, buf)
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// Guardrails are the thresholds on the size of the netmaps sent to a tailnet's machines. Admins are alerted once a netmap
+// grows beyond WarnSize, and again beyond MaxSize, past which mitigations are applied, if enabled, so that clients don't choke
+// on huge payloads. Sizes are in bytes; zero falls back to the global default (see: coordinator.NetmapWarnSize).
+type Guardrails struct {
+	WarnSize int64 `json:"warn_size"`
+	MaxSize  int64 `json:"max_size"`
+
+	// Mitigate prunes peers that the machine can't communicate with, in either direction, from netmaps beyond MaxSize,
+	// and compresses their packet filter by merging rules with the same sources.
+	Mitigate bool `json:"mitigate"`
+}
+
+// Validate checks that the thresholds are not negative, and that the warning threshold is below the maximum
+func (g *Guardrails) Validate() error {
+	if g.WarnSize < 0 || g.MaxSize < 0 {
+		return errors.New("guardrails must not be negative")
+	}
+
+	if g.WarnSize > 0 && g.MaxSize > 0 && g.WarnSize > g.MaxSize {
+		return errors.New("warn_size must not be larger than max_size")
+	}
+
+	return nil
+}
+
+// SetTailnetGuardrails replaces the tailnet's netmap size guardrails.
+func SetTailnetGuardrails(t *Tailnet, guardrails *Guardrails) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET guardrails = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			buf, err := json.Marshal(guardrails)
+			if err != nil {
+				return err
+			}
+
+			stmt.BindBytes(1, buf)
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
+// Logging is a tailnet's log streaming policy. Clients stream their logs (using logtail) to tailscale's log servers by default;
+// the coordinator disables that unless the tailnet enables it, optionally pointing clients at a self-hosted collector instead.
+// Log streaming can also be disabled on every tailnet, regardless of its policy (see: coordinator.DisableLogCollection).
+type Logging struct {
+	Enabled bool `json:"enabled"` // lets the tailnet's clients stream their logs; disabled by default
+
+	// Collector is the url of a self-hosted, logtail compatible, log collector; tailscale's log servers are used if empty.
+	// It's advertised to clients as a node attribute (see: coordinator.NodeAttrLogTarget), but stock clients only pick up
+	// a collector from their TS_LOG_TARGET environment variable.
+	Collector string `json:"collector,omitempty"`
+}
+
+// Validate checks that the collector, if any, is an absolute http(s) url
+func (l *Logging) Validate() error {
+	if l.Collector == "" {
+		return nil
+	}
+
+	if u, err := url.Parse(l.Collector); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("collector must be an absolute http or https url")
+	}
+
+	return nil
+}
+
+// SetTailnetLogging replaces the tailnet's log streaming policy.
+func SetTailnetLogging(t *Tailnet, logging *Logging) database.I[database.EmptyResponse, *Tailnet] {
+	return database.I[database.EmptyResponse, *Tailnet]{
+		QueryStr: "UPDATE tailnets SET logging = ?, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = ?",
+		ArgSet:   []*Tailnet{t},
+		Bind: func(stmt *sqlite.Stmt, t *Tailnet) error {
+			buf, err := json.Marshal(logging)
+			if err != nil {
+				return err
+			}
+
+			stmt.BindBytes(1, buf)
+			stmt.BindInt64(2, int64(t.ID))
+			return nil
+		},
+	}
+}
+
 // ListTailnets return all tailnets where the given user is a member.
 func ListTailnets(u *User) database.Q[Tailnet] {
 	return database.Q[Tailnet]{
@@ -95,9 +610,11 @@ func ListMachines(t *Tailnet) database.Q[Machine] {
 	return database.Q[Machine]{
 		QueryStr: `
 			SELECT m.*, 
-			       json_object('ID', t.id, 'Name', t.name, 'Acl', t.acl) AS tailnet, 
+			       json_object('ID', t.id, 'Name', t.name, 'Acl', t.acl, 'HideOfflineAfter', t.hide_offline_after, 'DeleteExpiredAfter', t.delete_expired_after, 'ForceDerp', json(iif(t.force_derp, 'true', 'false')), 'Capabilities', json(t.capabilities), 'DNS', json(t.dns), 'Welcome', json(t.welcome), 'Features', json(t.features), 'Privacy', json(t.privacy), 'Guardrails', json(t.guardrails), 'Logging', json(t.logging), 'Naming', t.naming, 'RequireApproval', json(iif(t.require_approval, 'true', 'false')), 'IPv4Pool', t.ipv4_pool, 'IPv6Pool', t.ipv6_pool) AS tailnet, 
 			       json_object('ID', u.id, 'Subject', u.sub, 'Name', u.name, 'Claims', json(u.claims), 'CreatedAt', u.created_at) AS user,
-			       tailnet_members.role AS role
+			       tailnet_members.role AS role,
+			       EXISTS (SELECT 1 FROM revoked_node_keys r WHERE r.node_key = m.node_key) AS logged_out,
+			       (SELECT json_group_array(prefix) FROM (SELECT prefix FROM routes WHERE routes.machine_id = m.id AND approved ORDER BY prefix)) AS approved_routes
 			FROM machines m
 				INNER JOIN tailnets t ON m.tailnet_id = t.id
 				INNER JOIN users    u ON m.user_id    = u.id
@@ -113,3 +630,26 @@ func ListMachines(t *Tailnet) database.Q[Machine] {
 		},
 	}
 }
+
+// ListBareMachines returns all machines that are part of this tailnet, like ListMachines, without joining their Tailnet
+// and Owner, which are left nil for the caller to resolve (see: GetBareMachineByKey).
+func ListBareMachines(t *Tailnet) database.Q[Machine] {
+	return database.Q[Machine]{
+		QueryStr: `
+			SELECT m.*, 
+			       tailnet_members.role AS role,
+			       EXISTS (SELECT 1 FROM revoked_node_keys r WHERE r.node_key = m.node_key) AS logged_out,
+			       (SELECT json_group_array(prefix) FROM (SELECT prefix FROM routes WHERE routes.machine_id = m.id AND approved ORDER BY prefix)) AS approved_routes
+			FROM machines m
+				INNER JOIN tailnet_members USING (tailnet_id, user_id)
+			WHERE m.tailnet_id = ?
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(t.ID))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Machine, error) {
+			return database.ScanAs[Machine](stmt)
+		},
+	}
+}
@@ -0,0 +1,31 @@
+package domain
+
+import (
+	"tailscale.com/tailcfg"
+	"testing"
+)
+
+func TestPrivacy_Redact(t *testing.T) {
+	var hi = &tailcfg.Hostinfo{Hostname: "alice-laptop", OS: "linux", OSVersion: "6.1", Distro: "debian", DeviceModel: "ThinkPad", Machine: "x86_64", IPNVersion: "1.76.1"}
+
+	if got := (Privacy{}).Redact(hi); got != hi {
+		t.Errorf("expected host info to be returned as-is when nothing is hidden")
+	}
+
+	got := Privacy{HideOS: true, HideDeviceModel: true}.Redact(hi)
+	if got.OS != "" || got.OSVersion != "" || got.Distro != "" || got.DeviceModel != "" || got.Machine != "" {
+		t.Errorf("expected os and device model to be redacted, got %+v", got)
+	}
+
+	if got.Hostname != "alice-laptop" || got.IPNVersion != "1.76.1" {
+		t.Errorf("expected other details to be retained, got %+v", got)
+	}
+
+	if hi.OS != "linux" || hi.DeviceModel != "ThinkPad" {
+		t.Errorf("expected the original host info to be left unchanged")
+	}
+
+	if got = (Privacy{HideHostname: true}).Redact(hi); got.Hostname != "" || got.OS != "linux" {
+		t.Errorf("expected only the hostname to be redacted, got %+v", got)
+	}
+}
@@ -17,6 +17,15 @@ type UserClaims struct {
 	Name    string `json:"name"`
 	Email   string `json:"email,omitempty"`
 	Picture string `json:"picture,omitempty"`
+
+	// EmailVerified is true if the provider has verified that the user controls the Email address
+	EmailVerified bool `json:"email_verified,omitempty"`
+
+	// Groups the user belongs to, as reported by providers that support the (non-standard) groups claim
+	Groups []string `json:"groups,omitempty"`
+
+	// Extra holds additional, non-standard claims requested using the oidc.extra_claims configuration
+	Extra map[string]json.RawMessage `json:"extra,omitempty"`
 }
 
 // User represents an individual user on the system.
@@ -25,13 +34,18 @@ type UserClaims struct {
 // participate in the tailnet network.
 type User struct {
 	ID      int        `db:"id"`          // auto-generated, unique id of the user
-	Subject string     `db:"sub"`         // subject claim extracted from the oidc token
+	Issuer  string     `db:"iss"`         // issuer of the user's oidc tokens; empty if the user has never logged in
+	Subject string     `db:"sub"`         // subject claim extracted from the oidc token, unique per Issuer
 	Name    string     `db:"name"`        // name claim extracted from the oidc token
 	Claims  UserClaims `db:"claims,json"` // standard user claims present in the oidc token
 
-	CreatedAt time.Time `db:"created_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+	DisabledAt *time.Time `db:"disabled_at"` // set if an admin has disabled the user's logins; see DisableUser
 }
 
+// IsDisabled returns true if an admin has disabled the user's logins
+func (u User) IsDisabled() bool { return u.DisabledAt != nil }
+
 func (u User) LoginName() string { return u.Subject }
 func (u User) Roles() []string   { return nil }
 
@@ -41,17 +55,19 @@ func (u User) AsUserProfile() tailcfg.UserProfile {
 
 // FindOrCreateUser returns a user or create a new one based the provided claims.
 //
-// UserClaims.Subject is used to uniquely identify a user in the system.
+// UserClaims.Issuer and UserClaims.Subject together uniquely identify a user in the system, so that users of
+// different oidc providers don't collide. Call ClaimPlaceholderUser beforehand to adopt a placeholder user.
 func FindOrCreateUser(claims UserClaims) database.Q[User] {
 	return database.Q[User]{
-		QueryStr: "INSERT INTO users (claims) VALUES ($1) ON CONFLICT (sub) DO UPDATE SET claims = EXCLUDED.claims RETURNING *",
+		QueryStr: "INSERT INTO users (iss, claims) VALUES ($1, $2) ON CONFLICT (iss, sub) DO UPDATE SET claims = EXCLUDED.claims RETURNING *",
 		Bind: func(stmt *sqlite.Stmt) (err error) {
 			var buf bytes.Buffer
 			if err = json.NewEncoder(&buf).Encode(claims); err != nil {
 				return err
 			}
 
-			stmt.BindBytes(1, buf.Bytes())
+			stmt.BindText(1, claims.Issuer)
+			stmt.BindBytes(2, buf.Bytes())
 			return nil
 		},
 		Val: func(stmt *sqlite.Stmt) (*User, error) {
@@ -60,10 +76,55 @@ func FindOrCreateUser(claims UserClaims) database.Q[User] {
 	}
 }
 
-// UserBySubject returns a user account for the given subject.
+// ClaimPlaceholderUser assigns the placeholder user (see EnsureUser) with the claims' subject to the claims' issuer,
+// unless the issuer already has a user with that subject. The placeholder's memberships are retained.
+func ClaimPlaceholderUser(claims UserClaims) database.I[database.EmptyResponse, *UserClaims] {
+	return database.I[database.EmptyResponse, *UserClaims]{
+		QueryStr: "UPDATE users SET iss = ?1 WHERE iss = '' AND sub = ?2 AND NOT EXISTS (SELECT 1 FROM users WHERE iss = ?1 AND sub = ?2)",
+		ArgSet:   []*UserClaims{&claims},
+		Bind: func(stmt *sqlite.Stmt, c *UserClaims) error {
+			stmt.BindText(1, c.Issuer)
+			stmt.BindText(2, c.Subject)
+			return nil
+		},
+	}
+}
+
+// EnsureUser returns a placeholder user identified by subject, creating it if needed, for users that have never logged in.
+// The placeholder's claims are replaced with the ones from the oidc token when the user first logs in (see ClaimPlaceholderUser).
+// Callers should check for an existing user with the subject (using UserBySubject) first.
+func EnsureUser(subject string) database.Q[User] {
+	return database.Q[User]{
+		QueryStr: "INSERT INTO users (iss, claims) VALUES ('', json_object('sub', $1, 'name', $1)) ON CONFLICT (iss, sub) DO UPDATE SET claims = claims RETURNING *",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindText(1, subject)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*User, error) {
+			return database.ScanAs[User](stmt)
+		},
+	}
+}
+
+// UserById returns the user identified by the given id.
+func UserById(id int64) database.Q[User] {
+	return database.Q[User]{
+		QueryStr: "SELECT * FROM users WHERE id = $1",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, id)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*User, error) {
+			return database.ScanAs[User](stmt)
+		},
+	}
+}
+
+// UserBySubject returns a user account for the given subject. If users of more than one oidc provider share the subject,
+// the oldest of them is returned; use UserByIdentity to identify the user unambiguously.
 func UserBySubject(subject string) database.Q[User] {
 	return database.Q[User]{
-		QueryStr: "SELECT * FROM users WHERE sub = $1",
+		QueryStr: "SELECT * FROM users WHERE sub = $1 ORDER BY id LIMIT 1",
 		Bind: func(stmt *sqlite.Stmt) error {
 			stmt.BindText(1, subject)
 			return nil
@@ -74,11 +135,13 @@ func UserBySubject(subject string) database.Q[User] {
 	}
 }
 
-func ListMembers(tailnet int64) database.Q[User] {
+// UserByIdentity returns the user identified by the issuer and subject claims of their oidc token.
+func UserByIdentity(issuer, subject string) database.Q[User] {
 	return database.Q[User]{
-		QueryStr: "SELECT * FROM users u, tailnet_members m WHERE u.id = m.user_id AND m.tailnet_id = ?",
+		QueryStr: "SELECT * FROM users WHERE iss = $1 AND sub = $2",
 		Bind: func(stmt *sqlite.Stmt) error {
-			stmt.BindInt64(1, tailnet)
+			stmt.BindText(1, issuer)
+			stmt.BindText(2, subject)
 			return nil
 		},
 		Val: func(stmt *sqlite.Stmt) (*User, error) {
@@ -103,3 +166,17 @@ func CheckMembership(u *User, tailnet int64) database.Q[bool] {
 		},
 	}
 }
+
+// DisableUser disables (or re-enables) the user's logins. A disabled user can neither login using oidc,
+// nor register machines using auth keys. Machines already registered by the user are not affected.
+func DisableUser(u *User, disabled bool) database.I[database.EmptyResponse, *User] {
+	return database.I[database.EmptyResponse, *User]{
+		QueryStr: "UPDATE users SET disabled_at = iif(?, COALESCE(disabled_at, strftime('%Y-%m-%dT%H:%M:%fZ', 'now')), NULL) WHERE id = ?",
+		ArgSet:   []*User{u},
+		Bind: func(stmt *sqlite.Stmt, u *User) error {
+			stmt.BindBool(1, disabled)
+			stmt.BindInt64(2, int64(u.ID))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,245 @@
+package domain
+
+import (
+	"crawshaw.io/sqlite"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Types of the events delivered to webhooks
+const (
+	WebhookNodeJoined      = "node.joined"      // a machine joined the tailnet
+	WebhookNodeExpired     = "node.expired"     // a machine's key expired, or was expired by an admin
+	WebhookACLUpdated      = "acl.updated"      // the tailnet's acl policy was updated
+	WebhookRouteAdvertised = "route.advertised" // a machine advertised new subnet routes
+	WebhookNetmapSize      = "netmap.size"      // the size of the tailnet's netmaps went past one of its guardrails
+)
+
+// WebhookEvents maps the audit actions delivered to webhooks to the type of event they're delivered as
+var WebhookEvents = map[string]string{
+	ActionMachineCreated:          WebhookNodeJoined,
+	ActionMachineImported:         WebhookNodeJoined,
+	ActionMachineKeyExpired:       WebhookNodeExpired,
+	ActionPolicyUpdated:           WebhookACLUpdated,
+	ActionMachineRoutesAdvertised: WebhookRouteAdvertised,
+	ActionNetmapSizeExceeded:      WebhookNetmapSize,
+}
+
+// Statuses of a webhook delivery
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed" // ran out of attempts
+)
+
+// Webhook is an external endpoint that's notified of events in a tailnet
+type Webhook struct {
+	ID        int      `db:"id" json:"id"`
+	TailnetID int      `db:"tailnet_id" json:"tailnet_id"`
+	URL       string   `db:"url" json:"url"`
+	Secret    string   `db:"secret" json:"-"`
+	Events    []string `db:"events,json" json:"events"` // types of the events delivered to the webhook
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Validate returns an error if the webhook's url isn't an absolute http(s) url, or it subscribes to an unknown event
+func (w *Webhook) Validate() error {
+	if u, err := url.Parse(w.URL); err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("url must be an absolute http(s) url")
+	}
+
+	if len(w.Events) == 0 {
+		return errors.New("at least one event is required")
+	}
+
+	var known = []string{WebhookNodeJoined, WebhookNodeExpired, WebhookACLUpdated, WebhookRouteAdvertised, WebhookNetmapSize}
+	for _, e := range w.Events {
+		if !slices.Contains(known, e) {
+			return errors.Errorf("unknown event %q", e)
+		}
+	}
+
+	return nil
+}
+
+// WebhookDelivery is a single event delivered (or to be delivered) to a webhook
+type WebhookDelivery struct {
+	ID            int        `db:"id" json:"id"`
+	WebhookID     int        `db:"webhook_id" json:"webhook_id"`
+	Event         string     `db:"event" json:"event"`
+	Payload       string     `db:"payload" json:"-"`
+	Status        string     `db:"status" json:"status"`
+	Attempts      int        `db:"attempts" json:"attempts"`
+	ResponseCode  int        `db:"response_code" json:"response_code,omitempty"`
+	Error         string     `db:"error" json:"error,omitempty"`
+	NextAttemptAt time.Time  `db:"next_attempt_at" json:"next_attempt_at"`
+	DeliveredAt   *time.Time `db:"delivered_at" json:"delivered_at,omitempty"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+
+	// URL and Secret of the webhook, loaded along with pending deliveries
+	URL    string `db:"url" json:"-"`
+	Secret string `db:"secret" json:"-"`
+}
+
+// CreateWebhook creates a new webhook and returns the created record.
+func CreateWebhook(w *Webhook) database.Q[Webhook] {
+	return database.Q[Webhook]{
+		QueryStr: "INSERT INTO webhooks (tailnet_id, url, secret, events) VALUES (?, ?, ?, ?) RETURNING *",
+		Bind: func(stmt *sqlite.Stmt) error {
+			events, err := json.Marshal(w.Events)
+			if err != nil {
+				return err
+			}
+
+			stmt.BindInt64(1, int64(w.TailnetID))
+			stmt.BindText(2, w.URL)
+			stmt.BindText(3, w.Secret)
+			stmt.BindBytes(4, events)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Webhook, error) {
+			return database.ScanAs[Webhook](stmt)
+		},
+	}
+}
+
+// ListWebhooks returns all webhooks registered in the tailnet.
+func ListWebhooks(tailnetID int64) database.Q[Webhook] {
+	return database.Q[Webhook]{
+		QueryStr: "SELECT * FROM webhooks WHERE tailnet_id = ? ORDER BY id",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnetID)
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Webhook, error) {
+			return database.ScanAs[Webhook](stmt)
+		},
+	}
+}
+
+// GetWebhook returns the webhook identified by the given id, in the tailnet; nil if no such webhook exists.
+func GetWebhook(tailnetID int64, id int) database.Q[Webhook] {
+	return database.Q[Webhook]{
+		QueryStr: "SELECT * FROM webhooks WHERE tailnet_id = ? AND id = ?",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnetID)
+			stmt.BindInt64(2, int64(id))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Webhook, error) {
+			return database.ScanAs[Webhook](stmt)
+		},
+	}
+}
+
+// DeleteWebhook deletes the webhook identified by the given id, in the tailnet, along with its deliveries.
+// It returns the deleted webhook; nil if no such webhook exists.
+func DeleteWebhook(tailnetID int64, id int) database.Q[Webhook] {
+	return database.Q[Webhook]{
+		QueryStr: "DELETE FROM webhooks WHERE tailnet_id = ? AND id = ? RETURNING *",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, tailnetID)
+			stmt.BindInt64(2, int64(id))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*Webhook, error) {
+			return database.ScanAs[Webhook](stmt)
+		},
+	}
+}
+
+// EnqueueWebhookDeliveries queues the delivery of an event, of the given type, to all webhooks in the tailnet that subscribe to it
+func EnqueueWebhookDeliveries(tailnetID int, event, payload string) database.I[database.EmptyResponse, string] {
+	return database.I[database.EmptyResponse, string]{
+		QueryStr: `
+			INSERT INTO webhook_deliveries (webhook_id, event, payload)
+				SELECT id, $2, $3 FROM webhooks w
+				WHERE w.tailnet_id = $1 AND EXISTS (SELECT 1 FROM json_each(w.events) WHERE value = $2)
+		`,
+		ArgSet: []string{payload},
+		Bind: func(stmt *sqlite.Stmt, payload string) error {
+			stmt.BindInt64(1, int64(tailnetID))
+			stmt.BindText(2, event)
+			stmt.BindText(3, payload)
+			return nil
+		},
+	}
+}
+
+// ListDueWebhookDeliveries returns (at most limit) pending deliveries that are due for an attempt, oldest first,
+// along with the url and secret of their webhook.
+func ListDueWebhookDeliveries(limit int) database.Q[WebhookDelivery] {
+	return database.Q[WebhookDelivery]{
+		QueryStr: `
+			SELECT d.*, w.url, w.secret FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+			WHERE d.status = 'pending' AND d.next_attempt_at <= strftime('%Y-%m-%dT%H:%M:%fZ', 'now')
+			ORDER BY d.id LIMIT ?
+		`,
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(limit))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*WebhookDelivery, error) {
+			return database.ScanAs[WebhookDelivery](stmt)
+		},
+	}
+}
+
+// ListWebhookDeliveries returns the (at most limit) most recent deliveries of the webhook, most recent first.
+func ListWebhookDeliveries(webhookID, limit int) database.Q[WebhookDelivery] {
+	return database.Q[WebhookDelivery]{
+		QueryStr: "SELECT * FROM webhook_deliveries WHERE webhook_id = ? ORDER BY id DESC LIMIT ?",
+		Bind: func(stmt *sqlite.Stmt) error {
+			stmt.BindInt64(1, int64(webhookID))
+			stmt.BindInt64(2, int64(limit))
+			return nil
+		},
+		Val: func(stmt *sqlite.Stmt) (*WebhookDelivery, error) {
+			return database.ScanAs[WebhookDelivery](stmt)
+		},
+	}
+}
+
+// SaveWebhookDelivery records the outcome of an attempt to deliver the event.
+func SaveWebhookDelivery(d *WebhookDelivery) database.I[database.EmptyResponse, *WebhookDelivery] {
+	return database.I[database.EmptyResponse, *WebhookDelivery]{
+		QueryStr: `
+			UPDATE webhook_deliveries
+			SET status = ?, attempts = ?, response_code = ?, error = ?, next_attempt_at = ?, delivered_at = ?
+			WHERE id = ?
+		`,
+		ArgSet: []*WebhookDelivery{d},
+		Bind: func(stmt *sqlite.Stmt, d *WebhookDelivery) error {
+			stmt.BindText(1, d.Status)
+			stmt.BindInt64(2, int64(d.Attempts))
+			stmt.BindInt64(3, int64(d.ResponseCode))
+			stmt.BindText(4, d.Error)
+			stmt.BindText(5, d.NextAttemptAt.UTC().Format(timestampFormat))
+			if d.DeliveredAt != nil {
+				stmt.BindText(6, d.DeliveredAt.UTC().Format(timestampFormat))
+			} else {
+				stmt.BindNull(6)
+			}
+			stmt.BindInt64(7, int64(d.ID))
+			return nil
+		},
+	}
+}
+
+// DeleteWebhookDeliveries deletes all deliveries that were completed (ie. delivered, or failed) before the given time.
+func DeleteWebhookDeliveries(before time.Time) database.I[database.EmptyResponse, time.Time] {
+	return database.I[database.EmptyResponse, time.Time]{
+		QueryStr: "DELETE FROM webhook_deliveries WHERE status != 'pending' AND created_at < ?",
+		ArgSet:   []time.Time{before},
+		Bind: func(stmt *sqlite.Stmt, before time.Time) error {
+			stmt.BindText(1, before.UTC().Format(timestampFormat))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,288 @@
+// Package firewall renders compiled tailnet packet filters (tailcfg.FilterRule) into rules for
+// host firewalls (nftables / iptables), so that operators can mirror tailnet policy on non-Tailscale hosts.
+package firewall
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net/netip"
+	"strings"
+	"tailscale.com/tailcfg"
+)
+
+// Format is the output format used when rendering rules.
+//
+// In every format the rules are rendered into a regular chain that isn't attached to any hook: the nftables
+// output declares "chain filter" without a "type filter hook ..." line, and the iptables outputs declare a
+// user-defined chain. The chain ends with an unconditional drop, so operators must jump to it only for traffic
+// that should be subject to tailnet policy, eg. by adding a base chain to the same nftables table
+// (`chain input { type filter hook input priority 0; iifname "tailscale0" jump filter }`) or with
+// `-A INPUT -i tailscale0 -j WIREFIRE` for iptables. Hooking it directly would drop all other traffic.
+type Format string
+
+const (
+	Nftables  Format = "nftables"  // nft script, loadable using `nft -f`
+	Iptables  Format = "iptables"  // iptables-restore compatible script; ipv4 rules only
+	Ip6tables Format = "ip6tables" // ip6tables-restore compatible script; ipv6 rules only
+)
+
+// well-known ip protocol numbers
+const (
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoSCTP   = 132
+	protoICMPv6 = 58
+)
+
+// Options control how the rules are rendered
+type Options struct {
+	// Name is the name of the nftables table / iptables chain that the rules are rendered into.
+	Name string
+
+	// Comment is an optional comment added to the top of the generated output.
+	Comment string
+}
+
+// entry is a single, flattened rule with one source, one destination and one protocol
+type entry struct {
+	family int    // ip family of the rule; either 4 or 6
+	src    string // source ip, prefix or range; empty matches everything
+	dst    string // destination ip, prefix or range; empty matches everything
+	proto  int    // ip protocol number
+	ports  tailcfg.PortRange
+}
+
+// Render renders the given filter rules to w using the given format.
+//
+// The generated rules accept the traffic permitted by the filter and drop everything else. Rules that
+// cannot be expressed in the target format (eg. capability grants) are skipped and reported as comments.
+func Render(w io.Writer, format Format, rules []tailcfg.FilterRule, opts Options) error {
+	if opts.Name == "" {
+		opts.Name = "wirefire"
+	}
+
+	entries, skipped := flatten(rules)
+
+	var buf = bufio.NewWriter(w)
+	for _, line := range strings.Split(opts.Comment, "\n") {
+		if line != "" {
+			_, _ = fmt.Fprintf(buf, "# %s\n", line)
+		}
+	}
+
+	for _, reason := range skipped {
+		_, _ = fmt.Fprintf(buf, "# skipped: %s\n", reason)
+	}
+
+	switch format {
+	case Nftables:
+		renderNftables(buf, opts.Name, entries)
+	case Iptables:
+		renderIptables(buf, strings.ToUpper(opts.Name), 4, entries)
+	case Ip6tables:
+		renderIptables(buf, strings.ToUpper(opts.Name), 6, entries)
+	default:
+		return errors.Errorf("firewall: unsupported format %q", format)
+	}
+
+	return buf.Flush()
+}
+
+// flatten expands the rules into a list of single source / destination / protocol entries.
+// It also returns the list of reasons for rules (or parts of rules) that were skipped.
+func flatten(rules []tailcfg.FilterRule) (entries []entry, skipped []string) {
+	for _, rule := range rules {
+		if len(rule.CapGrant) > 0 {
+			skipped = append(skipped, fmt.Sprintf("capability grant from %s", strings.Join(rule.SrcIPs, ",")))
+			continue
+		}
+
+		var protocols = rule.IPProto
+		if len(protocols) == 0 { // nil or empty means tcp, udp and icmp
+			protocols = []int{protoTCP, protoUDP, protoICMP, protoICMPv6}
+		}
+
+		for _, src := range rule.SrcIPs {
+			srcFamily, ok := family(src)
+			if !ok {
+				skipped = append(skipped, fmt.Sprintf("unsupported source %q", src))
+				continue
+			}
+
+			for _, dst := range rule.DstPorts {
+				dstFamily, ok := family(dst.IP)
+				if !ok {
+					skipped = append(skipped, fmt.Sprintf("unsupported destination %q", dst.IP))
+					continue
+				}
+
+				for _, fam := range []int{4, 6} {
+					if (srcFamily != 0 && srcFamily != fam) || (dstFamily != 0 && dstFamily != fam) {
+						continue // address family mismatch
+					}
+
+					for _, proto := range protocols {
+						if (proto == protoICMP && fam == 6) || (proto == protoICMPv6 && fam == 4) {
+							continue
+						}
+
+						entries = append(entries, entry{family: fam, src: wildcard(src), dst: wildcard(dst.IP), proto: proto, ports: dst.Ports})
+					}
+				}
+			}
+		}
+	}
+
+	return entries, skipped
+}
+
+// family returns the ip family (4 or 6) of the given ip, prefix or range. It returns 0 for the "*" wildcard.
+func family(s string) (int, bool) {
+	if s == "*" {
+		return 0, true
+	}
+
+	if first, _, ok := strings.Cut(s, "-"); ok {
+		s = first
+	} else if first, _, ok := strings.Cut(s, "/"); ok {
+		s = first
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return 0, false
+	}
+
+	if addr.Is4() {
+		return 4, true
+	}
+
+	return 6, true
+}
+
+func wildcard(s string) string {
+	if s == "*" {
+		return ""
+	}
+	return s
+}
+
+// hasPorts returns true if the protocol supports ports and the range doesn't cover all ports
+func (e entry) hasPorts() bool {
+	return (e.proto == protoTCP || e.proto == protoUDP || e.proto == protoSCTP) && !(e.ports.First == 0 && e.ports.Last == 65535)
+}
+
+func renderNftables(w io.Writer, name string, entries []entry) {
+	var protoName = map[int]string{protoTCP: "tcp", protoUDP: "udp", protoSCTP: "sctp"}
+
+	_, _ = fmt.Fprintf(w, "table inet %s {\n", name)
+	_, _ = fmt.Fprintf(w, "\tchain filter {\n")
+	_, _ = fmt.Fprintf(w, "\t\tct state established,related accept\n")
+
+	for _, e := range entries {
+		var parts []string
+
+		var ip = "ip"
+		if e.family == 6 {
+			ip = "ip6"
+		}
+
+		if e.src != "" {
+			parts = append(parts, fmt.Sprintf("%s saddr %s", ip, e.src))
+		}
+
+		if e.dst != "" {
+			parts = append(parts, fmt.Sprintf("%s daddr %s", ip, e.dst))
+		}
+
+		switch {
+		case e.hasPorts() && e.ports.First == e.ports.Last:
+			parts = append(parts, fmt.Sprintf("%s dport %d", protoName[e.proto], e.ports.First))
+		case e.hasPorts():
+			parts = append(parts, fmt.Sprintf("%s dport %d-%d", protoName[e.proto], e.ports.First, e.ports.Last))
+		case e.family == 4:
+			parts = append(parts, fmt.Sprintf("meta nfproto ipv4 meta l4proto %d", e.proto))
+		default:
+			parts = append(parts, fmt.Sprintf("meta nfproto ipv6 meta l4proto %d", e.proto))
+		}
+
+		_, _ = fmt.Fprintf(w, "\t\t%s accept\n", strings.Join(parts, " "))
+	}
+
+	_, _ = fmt.Fprintf(w, "\t\tdrop\n")
+	_, _ = fmt.Fprintf(w, "\t}\n")
+	_, _ = fmt.Fprintf(w, "}\n")
+}
+
+func renderIptables(w io.Writer, chain string, family int, entries []entry) {
+	_, _ = fmt.Fprintf(w, "*filter\n")
+	_, _ = fmt.Fprintf(w, ":%s - [0:0]\n", chain)
+	_, _ = fmt.Fprintf(w, "-A %s -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT\n", chain)
+
+	for _, e := range entries {
+		if e.family != family {
+			continue
+		}
+
+		var parts = []string{"-A", chain}
+
+		if src, dst := e.src, e.dst; strings.Contains(src, "-") || strings.Contains(dst, "-") {
+			parts = append(parts, "-m", "iprange")
+			if src != "" {
+				parts = append(parts, iprange("src", src)...)
+			}
+			if dst != "" {
+				parts = append(parts, iprange("dst", dst)...)
+			}
+		} else {
+			if src != "" {
+				parts = append(parts, "-s", src)
+			}
+			if dst != "" {
+				parts = append(parts, "-d", dst)
+			}
+		}
+
+		parts = append(parts, "-p", fmt.Sprintf("%d", e.proto))
+		if e.hasPorts() {
+			if e.ports.First == e.ports.Last {
+				parts = append(parts, "--dport", fmt.Sprintf("%d", e.ports.First))
+			} else {
+				parts = append(parts, "--dport", fmt.Sprintf("%d:%d", e.ports.First, e.ports.Last))
+			}
+		}
+
+		parts = append(parts, "-j", "ACCEPT")
+		_, _ = fmt.Fprintln(w, strings.Join(parts, " "))
+	}
+
+	_, _ = fmt.Fprintf(w, "-A %s -j DROP\n", chain)
+	_, _ = fmt.Fprintf(w, "COMMIT\n")
+}
+
+// iprange returns arguments for iptables' iprange match. Plain addresses / prefixes are also supported.
+func iprange(dir, s string) []string {
+	if strings.Contains(s, "-") {
+		return []string{fmt.Sprintf("--%s-range", dir), s}
+	}
+
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return []string{fmt.Sprintf("--%s-range", dir), fmt.Sprintf("%s-%s", prefix.Masked().Addr(), lastAddr(prefix))}
+	}
+
+	return []string{fmt.Sprintf("--%s-range", dir), fmt.Sprintf("%s-%s", s, s)}
+}
+
+// lastAddr returns the last address in the given prefix
+func lastAddr(p netip.Prefix) netip.Addr {
+	var a = p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(a)*8; i++ {
+		a[i/8] |= 1 << (7 - i%8)
+	}
+
+	addr, _ := netip.AddrFromSlice(a)
+	return addr
+}
@@ -0,0 +1,78 @@
+package firewall_test
+
+import (
+	"bytes"
+	"github.com/riyaz-ali/wirefire/internal/firewall"
+	"strings"
+	"tailscale.com/tailcfg"
+	"testing"
+)
+
+var rules = []tailcfg.FilterRule{
+	{
+		SrcIPs:   []string{"100.64.0.1", "fd7a:115c:a1e0::1"},
+		DstPorts: []tailcfg.NetPortRange{{IP: "100.64.0.2", Ports: tailcfg.PortRange{First: 22, Last: 22}}},
+		IPProto:  []int{6},
+	},
+	{
+		SrcIPs:   []string{"100.64.0.0/10"},
+		DstPorts: []tailcfg.NetPortRange{{IP: "*", Ports: tailcfg.PortRange{First: 8000, Last: 8080}}},
+	},
+	{
+		SrcIPs:   []string{"*"},
+		CapGrant: []tailcfg.CapGrant{{}},
+	},
+}
+
+func TestRender_Nftables(t *testing.T) {
+	var buf bytes.Buffer
+	if err := firewall.Render(&buf, firewall.Nftables, rules, firewall.Options{Comment: "test"}); err != nil {
+		t.Fatalf("failed to render rules: %v", err)
+	}
+
+	var out = buf.String()
+	for _, expected := range []string{
+		"# test\n",
+		"# skipped: capability grant from *\n",
+		"table inet wirefire {",
+		"ip saddr 100.64.0.1 ip daddr 100.64.0.2 tcp dport 22 accept",
+		"ip saddr 100.64.0.0/10 tcp dport 8000-8080 accept",
+		"ip saddr 100.64.0.0/10 udp dport 8000-8080 accept",
+		"ip saddr 100.64.0.0/10 meta nfproto ipv4 meta l4proto 1 accept",
+		"\t\tdrop\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q\n%s", expected, out)
+		}
+	}
+
+	// ipv6 source with ipv4 destination must not produce a rule
+	if strings.Contains(out, "fd7a:115c:a1e0::1") {
+		t.Errorf("unexpected mixed-family rule in output\n%s", out)
+	}
+}
+
+func TestRender_Iptables(t *testing.T) {
+	var buf bytes.Buffer
+	if err := firewall.Render(&buf, firewall.Iptables, rules, firewall.Options{Name: "tailnet"}); err != nil {
+		t.Fatalf("failed to render rules: %v", err)
+	}
+
+	var out = buf.String()
+	for _, expected := range []string{
+		"*filter\n:TAILNET - [0:0]\n",
+		"-A TAILNET -s 100.64.0.1 -d 100.64.0.2 -p 6 --dport 22 -j ACCEPT\n",
+		"-A TAILNET -s 100.64.0.0/10 -p 17 --dport 8000:8080 -j ACCEPT\n",
+		"-A TAILNET -j DROP\nCOMMIT\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q\n%s", expected, out)
+		}
+	}
+}
+
+func TestRender_UnsupportedFormat(t *testing.T) {
+	if err := firewall.Render(&bytes.Buffer{}, "pf", rules, firewall.Options{}); err == nil {
+		t.Errorf("expected error for unsupported format")
+	}
+}
@@ -0,0 +1,111 @@
+// Package geoip resolves client ip addresses to their geographical and network (ASN) location
+// using local, MaxMind-compatible (mmdb) databases.
+package geoip
+
+import (
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"net/netip"
+)
+
+// Config is the subset of configuration relevant to geoip resolution
+type Config struct {
+	// CityDatabase is the path to a GeoLite2-City / GeoLite2-Country compatible mmdb file.
+	// If empty, country / city information is not resolved.
+	CityDatabase string `viper:"geoip.city_database"`
+
+	// ASNDatabase is the path to a GeoLite2-ASN compatible mmdb file.
+	// If empty, autonomous system information is not resolved.
+	ASNDatabase string `viper:"geoip.asn_database"`
+}
+
+// Resolver resolves an ip address to a domain.Location. A nil *Resolver is valid
+// and resolves every address to a nil location.
+type Resolver struct {
+	city, asn *maxminddb.Reader
+}
+
+// Open opens the databases configured in cfg and returns a new Resolver. It returns a nil
+// Resolver (and no error) if no database is configured.
+func Open(cfg *Config) (_ *Resolver, err error) {
+	if cfg.CityDatabase == "" && cfg.ASNDatabase == "" {
+		return nil, nil
+	}
+
+	var r Resolver
+	if cfg.CityDatabase != "" {
+		if r.city, err = maxminddb.Open(cfg.CityDatabase); err != nil {
+			return nil, errors.Wrapf(err, "failed to open city database")
+		}
+	}
+
+	if cfg.ASNDatabase != "" {
+		if r.asn, err = maxminddb.Open(cfg.ASNDatabase); err != nil {
+			_ = r.Close()
+			return nil, errors.Wrapf(err, "failed to open asn database")
+		}
+	}
+
+	return &r, nil
+}
+
+// Lookup returns the location for the given address. It returns nil if the address is not a public
+// address, no database is configured or if the address isn't found in any of the databases.
+func (r *Resolver) Lookup(addr netip.Addr) *domain.Location {
+	if r == nil || !addr.IsValid() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return nil
+	}
+
+	var ip, loc = addr.Unmap().AsSlice(), domain.Location{}
+
+	if r.city != nil {
+		var record struct {
+			Country struct {
+				IsoCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+			City struct {
+				Names map[string]string `maxminddb:"names"`
+			} `maxminddb:"city"`
+		}
+
+		if err := r.city.Lookup(ip, &record); err == nil {
+			loc.Country, loc.City = record.Country.IsoCode, record.City.Names["en"]
+		}
+	}
+
+	if r.asn != nil {
+		var record struct {
+			Number       uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		}
+
+		if err := r.asn.Lookup(ip, &record); err == nil {
+			loc.ASN, loc.Organization = record.Number, record.Organization
+		}
+	}
+
+	if loc == (domain.Location{}) {
+		return nil // nothing found in any of the databases
+	}
+
+	return &loc
+}
+
+// Close closes all the underlying databases.
+func (r *Resolver) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	var err error
+	for _, db := range []*maxminddb.Reader{r.city, r.asn} {
+		if db != nil {
+			if ce := db.Close(); ce != nil && err == nil {
+				err = ce
+			}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,175 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestResolver_Lookup(t *testing.T) {
+	var network = netip.MustParsePrefix("81.2.69.0/24")
+
+	var dir = t.TempDir()
+	var cfg = Config{
+		CityDatabase: writeDB(t, filepath.Join(dir, "city.mmdb"), "GeoLite2-City", network, map[string]any{
+			"country": map[string]any{"iso_code": "GB"},
+			"city":    map[string]any{"names": map[string]any{"en": "London"}},
+		}),
+		ASNDatabase: writeDB(t, filepath.Join(dir, "asn.mmdb"), "GeoLite2-ASN", network, map[string]any{
+			"autonomous_system_number":       uint32(20712),
+			"autonomous_system_organization": "Andrews & Arnold Ltd",
+		}),
+	}
+
+	r, err := Open(&cfg)
+	if err != nil {
+		t.Fatalf("failed to open databases: %v", err)
+	}
+	t.Cleanup(func() { _ = r.Close() })
+
+	var cases = []struct {
+		name string
+		addr string
+		want *domain.Location
+	}{
+		{"Found", "81.2.69.160", &domain.Location{Country: "GB", City: "London", ASN: 20712, Organization: "Andrews & Arnold Ltd"}},
+		{"FoundMapped", "::ffff:81.2.69.160", &domain.Location{Country: "GB", City: "London", ASN: 20712, Organization: "Andrews & Arnold Ltd"}},
+		{"NotFound", "81.2.70.1", nil},
+		{"Private", "10.1.2.3", nil},
+		{"Loopback", "127.0.0.1", nil},
+		{"LinkLocal", "169.254.1.1", nil},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := r.Lookup(netip.MustParseAddr(tc.addr))
+			if (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+				t.Errorf("expected location %v; got %v", tc.want, got)
+			}
+		})
+	}
+
+	if got := r.Lookup(netip.Addr{}); got != nil {
+		t.Errorf("expected no location for an invalid address; got %v", got)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	r, err := Open(&Config{})
+	if err != nil || r != nil {
+		t.Fatalf("expected nil resolver without databases; got %v (err: %v)", r, err)
+	}
+
+	if loc := r.Lookup(netip.MustParseAddr("81.2.69.160")); loc != nil {
+		t.Errorf("expected nil resolver to resolve no location; got %v", loc)
+	}
+
+	if _, err = Open(&Config{CityDatabase: filepath.Join(t.TempDir(), "missing.mmdb")}); err == nil {
+		t.Errorf("expected missing database to be reported")
+	}
+}
+
+// writeDB writes an ipv4 MaxMind DB file, in which the given network maps to the record, and returns its path.
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+func writeDB(t *testing.T, path, typ string, network netip.Prefix, record map[string]any) string {
+	t.Helper()
+
+	// the search tree has one node per bit of the network, each with 24-bit left (0) and right (1) records. Following
+	// the network's bits leads to the next node, and to the data after the last one; the other side leads nowhere.
+	var nodes, ip = network.Bits(), network.Addr().As4()
+
+	var db bytes.Buffer
+	for i := 0; i < nodes; i++ {
+		var next = uint32(i + 1)
+		if i == nodes-1 {
+			next = uint32(nodes) + 16 // data section offset 0, past the 16-byte separator
+		}
+
+		var records = [2]uint32{uint32(nodes), uint32(nodes)}
+		records[ip[i/8]>>(7-i%8)&1] = next
+		for _, r := range records {
+			db.Write([]byte{byte(r >> 16), byte(r >> 8), byte(r)})
+		}
+	}
+
+	db.Write(make([]byte, 16))
+	encode(&db, record)
+
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	encode(&db, map[string]any{
+		"node_count":                  uint32(nodes),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               typ,
+		"languages":                   []any{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(0),
+		"description":                 map[string]any{"en": "wirefire test database"},
+	})
+
+	if err := os.WriteFile(path, db.Bytes(), 0o600); err != nil {
+		t.Fatalf("failed to write database: %v", err)
+	}
+
+	return path
+}
+
+// encode writes v to buf in MaxMind DB's data section format; only the types (and the sizes) used by the tests are supported
+func encode(buf *bytes.Buffer, v any) {
+	var control = func(typ, size int) {
+		var extra []byte
+		if size >= 29 {
+			size, extra = 29, []byte{byte(size - 29)} // sizes up to 284 take one extra byte
+		}
+
+		if typ <= 7 {
+			buf.WriteByte(byte(typ<<5 | size))
+		} else {
+			buf.Write([]byte{byte(size), byte(typ - 7)}) // extended type
+		}
+		buf.Write(extra)
+	}
+
+	var unsigned = func(typ int, v uint64) {
+		var b = binary.BigEndian.AppendUint64(nil, v)
+		b = bytes.TrimLeft(b, "\x00")
+		control(typ, len(b))
+		buf.Write(b)
+	}
+
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		buf.WriteString(v)
+	case uint16:
+		unsigned(5, uint64(v))
+	case uint32:
+		unsigned(6, uint64(v))
+	case uint64:
+		unsigned(9, v)
+	case []any:
+		control(11, len(v))
+		for _, e := range v {
+			encode(buf, e)
+		}
+	case map[string]any:
+		control(7, len(v))
+
+		var keys = make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		for _, k := range keys {
+			encode(buf, k)
+			encode(buf, v[k])
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// Package headers implements the middleware that applies security headers (eg. content security policy and hsts),
+// and the cors policy, to the responses of wirefire's web surfaces, ie. the landing pages, oidc, console and admin api.
+//
+// Headers are configured under http.headers, and can be overridden for a single surface under http.routes.<name>, eg.
+//
+//	http:
+//	  headers:
+//	    content_security_policy: "default-src 'self'"
+//	  routes:
+//	    api:
+//	      cors: { allowed_origins: [ "https://dashboard.example.com" ], allow_credentials: true }
+//	    console:
+//	      frame_options: "-"
+package headers
+
+import (
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/spf13/viper"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	config.RegisterPrefix("http.headers", "http.routes")
+}
+
+// Names of the web surfaces that headers can be configured for, under http.routes
+const (
+	Landing = "landing"
+	OIDC    = "oidc"
+	Console = "console"
+	API     = "api"
+)
+
+// omit is the value that disables a header, that's otherwise sent by default
+const omit = "-"
+
+// Policy is the set of security headers, and the cors policy, applied to a web surface's responses. Empty values
+// are inherited (from http.headers, or the defaults), while the value "-" omits the header altogether.
+type Policy struct {
+	ContentSecurityPolicy   string `mapstructure:"content_security_policy"`
+	StrictTransportSecurity string `mapstructure:"strict_transport_security"` // only sent if server.url is https
+	FrameOptions            string `mapstructure:"frame_options"`
+	ContentTypeOptions      string `mapstructure:"content_type_options"`
+	ReferrerPolicy          string `mapstructure:"referrer_policy"`
+
+	// CORS is the policy for cross-origin requests. It's replaced as a whole, if AllowedOrigins is set.
+	CORS CORS `mapstructure:"cors"`
+}
+
+// CORS is the policy for cross-origin requests. Cross-origin requests are denied (ie. no cors headers are sent) unless
+// their origin is allowed. The wildcard origin "*" allows any origin, but can't be combined with AllowCredentials.
+type CORS struct {
+	AllowedOrigins   []string `mapstructure:"allowed_origins"`
+	AllowedMethods   []string `mapstructure:"allowed_methods"` // defaults to GET, POST, PUT and DELETE
+	AllowedHeaders   []string `mapstructure:"allowed_headers"` // defaults to Authorization and Content-Type
+	AllowCredentials bool     `mapstructure:"allow_credentials"`
+	MaxAge           int      `mapstructure:"max_age"` // seconds for which the result of a preflight request can be cached
+}
+
+// Defaults is the policy applied to all web surfaces, unless overridden. The pages load tailwind from its cdn, and
+// style elements using inline styles it generates, both of which the content security policy has to allow.
+var Defaults = Policy{
+	ContentSecurityPolicy:   "default-src 'self'; script-src 'self' 'unsafe-inline' https://cdn.tailwindcss.com; style-src 'self' 'unsafe-inline'; img-src 'self' data: https:; frame-ancestors 'none'",
+	StrictTransportSecurity: "max-age=31536000",
+	FrameOptions:            "DENY",
+	ContentTypeOptions:      "nosniff",
+	ReferrerPolicy:          "same-origin", // gorilla/csrf requires a same-origin referer on https requests
+	CORS: CORS{
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+	},
+}
+
+// merge returns the policy with the non-empty values of override applied over it
+func (p Policy) merge(override Policy) Policy {
+	for _, f := range []struct{ dst, src *string }{
+		{&p.ContentSecurityPolicy, &override.ContentSecurityPolicy},
+		{&p.StrictTransportSecurity, &override.StrictTransportSecurity},
+		{&p.FrameOptions, &override.FrameOptions},
+		{&p.ContentTypeOptions, &override.ContentTypeOptions},
+		{&p.ReferrerPolicy, &override.ReferrerPolicy},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+
+	if len(override.CORS.AllowedOrigins) > 0 {
+		var cors = override.CORS
+		if len(cors.AllowedMethods) == 0 {
+			cors.AllowedMethods = p.CORS.AllowedMethods
+		}
+		if len(cors.AllowedHeaders) == 0 {
+			cors.AllowedHeaders = p.CORS.AllowedHeaders
+		}
+		p.CORS = cors
+	}
+
+	return p
+}
+
+// Read returns the policy configured for the named web surface
+func Read(name string) (_ Policy, err error) {
+	var global, route Policy
+	if err = viper.UnmarshalKey("http.headers", &global); err != nil {
+		return Policy{}, errors.Wrap(err, "headers: failed to read http.headers")
+	}
+
+	if err = viper.UnmarshalKey("http.routes."+name, &route); err != nil {
+		return Policy{}, errors.Wrapf(err, "headers: failed to read http.routes.%s", name)
+	}
+
+	var p = Defaults.merge(global).merge(route)
+	if p.CORS.AllowCredentials && slices.Contains(p.CORS.AllowedOrigins, "*") {
+		return Policy{}, errors.Errorf("headers: %s: the wildcard origin can't be combined with allow_credentials", name)
+	}
+
+	return p, nil
+}
+
+// Middleware returns a middleware that applies the policy configured for the named web surface to its responses.
+// Preflight requests from allowed origins are answered by the middleware itself, and never reach the handler.
+func Middleware(name string) func(next http.Handler) http.Handler {
+	var p = util.Must(Read(name))
+
+	var headers = map[string]string{
+		"Content-Security-Policy": p.ContentSecurityPolicy,
+		"X-Frame-Options":         p.FrameOptions,
+		"X-Content-Type-Options":  p.ContentTypeOptions,
+		"Referrer-Policy":         p.ReferrerPolicy,
+	}
+
+	if strings.HasPrefix(viper.GetString("server.url"), "https://") {
+		headers["Strict-Transport-Security"] = p.StrictTransportSecurity
+	}
+
+	for name, value := range headers {
+		if value == "" || value == omit {
+			delete(headers, name)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range headers {
+				w.Header().Set(name, value)
+			}
+
+			if origin := r.Header.Get("Origin"); origin != "" && len(p.CORS.AllowedOrigins) > 0 {
+				w.Header().Add("Vary", "Origin")
+				if p.CORS.allows(origin) {
+					p.CORS.apply(w, origin)
+
+					if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+						p.CORS.preflight(w)
+						return
+					}
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allows returns true if requests from the origin are allowed
+func (c CORS) allows(origin string) bool {
+	return slices.Contains(c.AllowedOrigins, "*") || slices.Contains(c.AllowedOrigins, origin)
+}
+
+// apply sets the headers that allow the origin to read the response
+func (c CORS) apply(w http.ResponseWriter, origin string) {
+	if slices.Contains(c.AllowedOrigins, "*") {
+		origin = "*"
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// preflight answers a preflight request with the methods and headers the origin is allowed to use
+func (c CORS) preflight(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	if c.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,62 @@
+package headers
+
+import (
+	"github.com/spf13/viper"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	viper.Set("server.url", "https://wirefire.example.com")
+	viper.Set("http.headers", map[string]any{"frame_options": "SAMEORIGIN"})
+	viper.Set("http.routes.api", map[string]any{
+		"content_security_policy": "-",
+		"cors":                    map[string]any{"allowed_origins": []string{"https://dashboard.example.com"}, "max_age": 600},
+	})
+	t.Cleanup(viper.Reset)
+
+	var reached bool
+	var handler = Middleware(API)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+
+	var serve = func(method, origin string) *httptest.ResponseRecorder {
+		reached = false
+
+		var r = httptest.NewRequest(method, "/api/v1/tailnets", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+			r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+		}
+
+		var w = httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(http.MethodGet, "")
+	if got := w.Header().Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Errorf("expected X-Frame-Options from http.headers; got %q", got)
+	}
+	if got := w.Header().Get("Content-Security-Policy"); got != "" {
+		t.Errorf("expected Content-Security-Policy to be omitted; got %q", got)
+	}
+	if got := w.Header().Get("Strict-Transport-Security"); got != Defaults.StrictTransportSecurity {
+		t.Errorf("expected default Strict-Transport-Security; got %q", got)
+	}
+
+	w = serve(http.MethodOptions, "https://dashboard.example.com")
+	if reached || w.Code != http.StatusNoContent {
+		t.Errorf("expected preflight to be answered by the middleware; got status %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://dashboard.example.com" {
+		t.Errorf("expected origin to be allowed; got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("unexpected Access-Control-Max-Age %q", got)
+	}
+
+	w = serve(http.MethodOptions, "https://evil.example.com")
+	if !reached || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("expected request from disallowed origin to be passed through without cors headers")
+	}
+}
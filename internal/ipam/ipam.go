@@ -3,46 +3,50 @@
 package ipam
 
 import (
+	"crypto/rand"
 	"github.com/apparentlymart/go-cidr/cidr"
+	"github.com/pkg/errors"
 	"github.com/riyaz-ali/wirefire/internal/util"
-	"github.com/rs/zerolog/log"
 	"math/big"
 	"net"
 	"net/netip"
 	"tailscale.com/net/tsaddr"
 )
 
-var ipv4Range *net.IPNet
-var ipv4Count uint64
+// Config configures the ranges machines are allocated addresses from
+type Config struct {
+	// IPv6Prefix is the prefix machines are allocated IPv6 addresses from; defaults to Tailscale's ULA prefix.
+	// Addresses in Tailscale's 4to6 range (fd7a:115c:a1e0:ab12:4843:cd96::/96) are never allocated.
+	IPv6Prefix string `viper:"ipam.ipv6_prefix" default:"fd7a:115c:a1e0::/48" validate:"ipv6prefix"`
+}
 
-func init() { ipv4Range, ipv4Count = prepareIP4Range() }
+// ErrExhausted is returned when a free address can't be found
+var ErrExhausted = errors.New("no free address available")
 
-func prepareIP4Range() (*net.IPNet, uint64) {
-	cgnatRange := tsaddr.CGNATRange()
-	_, ipNet, err := net.ParseCIDR(cgnatRange.String())
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to parse Tailscale CGNAT range")
-	}
-	return ipNet, cidr.AddressCount(ipNet)
-}
+// DefaultIPv4Pool is the prefix machines are allocated IPv4 addresses from, unless their tailnet defines its own pool
+var DefaultIPv4Pool = tsaddr.CGNATRange()
+
+// maxAttempts is the number of random addresses tried by SelectIPv6 before giving up
+const maxAttempts = 1024
 
 // Predicate is a user-defined predicate function used to filter ip addresses
 type Predicate func(netip.Addr) (bool, error)
 
-func SelectIP(predicate Predicate) (netip.Addr, netip.Addr, error) {
-	ip4, err := selectIP(predicate)
+// SelectIPv4 selects a free IPv4 address from the given prefix, starting at a random address in the prefix
+// and trying every address in it, in order, if need be. ErrExhausted is returned if no address in the prefix is free.
+//
+// Only addresses that clients consider to be Tailscale addresses, ie. in Tailscale's CGNAT range, are ever selected.
+func SelectIPv4(prefix netip.Prefix, predicate Predicate) (netip.Addr, error) {
+	_, ipNet, err := net.ParseCIDR(prefix.Masked().String())
 	if err != nil {
-		return netip.Addr{}, netip.Addr{}, err
+		return netip.Addr{}, err
 	}
 
-	return ip4, tsaddr.Tailscale4To6(ip4), nil
-}
-
-func selectIP(predicate Predicate) (netip.Addr, error) {
-	var n = util.RandUint64(ipv4Count)
+	var count = cidr.AddressCount(ipNet)
+	var n = util.RandUint64(count)
 
-	for {
-		stdIP, err := cidr.HostBig(ipv4Range, big.NewInt(int64(n)))
+	for i := uint64(0); i < count; i++ {
+		stdIP, err := cidr.HostBig(ipNet, big.NewInt(int64(n)))
 		if err != nil {
 			return netip.Addr{}, err
 		}
@@ -54,8 +58,10 @@ func selectIP(predicate Predicate) (netip.Addr, error) {
 		} else if ok {
 			return ip, nil
 		}
-		n = (n + 1) % ipv4Count
+		n = (n + 1) % count
 	}
+
+	return netip.Addr{}, ErrExhausted
 }
 
 func validateIP(ip netip.Addr, p Predicate) (bool, error) {
@@ -68,3 +74,41 @@ func validateIP(ip netip.Addr, p Predicate) (bool, error) {
 	}
 	return false, nil
 }
+
+// SelectIPv6 selects a free, random IPv6 address from the given prefix. Addresses in Tailscale's 4to6 range, which are derived
+// from IPv4 addresses (see: domain.Machine.IP), are never selected. ErrExhausted is returned if no free address is found in a bounded number of attempts.
+func SelectIPv6(prefix netip.Prefix, predicate Predicate) (netip.Addr, error) {
+	prefix = prefix.Masked()
+	var base = prefix.Addr().As16()
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		var buf [16]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return netip.Addr{}, err
+		}
+
+		// keep the prefix bits from base, and the random host bits from buf
+		for i, bits := 0, prefix.Bits(); i < len(buf) && bits > 0; i, bits = i+1, bits-8 {
+			var mask = byte(0xff)
+			if bits < 8 {
+				mask = byte(0xff << (8 - bits))
+			}
+			buf[i] = base[i]&mask | buf[i]&^mask
+		}
+
+		var ip = netip.AddrFrom16(buf)
+		if ip == prefix.Addr() || tsaddr.Tailscale4To6Range().Contains(ip) {
+			continue
+		}
+
+		if predicate == nil {
+			return ip, nil
+		} else if ok, err := predicate(ip); err != nil {
+			return netip.Addr{}, err
+		} else if ok {
+			return ip, nil
+		}
+	}
+
+	return netip.Addr{}, ErrExhausted
+}
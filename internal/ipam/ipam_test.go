@@ -0,0 +1,29 @@
+package ipam
+
+import (
+	"net/netip"
+	"tailscale.com/net/tsaddr"
+	"testing"
+)
+
+func TestSelectIPv6(t *testing.T) {
+	var prefix = netip.MustParsePrefix("fd7a:115c:a1e0::/48")
+
+	var seen = make(map[netip.Addr]bool)
+	for i := 0; i < 100; i++ {
+		ip, err := SelectIPv6(prefix, func(ip netip.Addr) (bool, error) { return !seen[ip], nil })
+		if err != nil {
+			t.Fatalf("failed to select address: %v", err)
+		}
+
+		if !prefix.Contains(ip) || tsaddr.Tailscale4To6Range().Contains(ip) {
+			t.Errorf("selected address %s outside of the prefix, or in the 4to6 range", ip)
+		}
+
+		seen[ip] = true
+	}
+
+	if _, err := SelectIPv6(prefix, func(netip.Addr) (bool, error) { return false, nil }); err != ErrExhausted {
+		t.Errorf("expected ErrExhausted when no address is free; got %v", err)
+	}
+}
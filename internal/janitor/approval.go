@@ -0,0 +1,62 @@
+package janitor
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/rs/zerolog"
+	"time"
+)
+
+// ApprovalExpiry is the duration after which a machine still pending an admin's approval is rejected and deleted
+var ApprovalExpiry = settings.Define("approval.pending_expiry", settings.Duration(7*24*time.Hour),
+	"duration after which a machine pending approval is rejected and deleted")
+
+// ExpirePendingApprovals rejects machines that have been pending an admin's approval (see domain.Tailnet.RequireApproval)
+// for longer than ApprovalExpiry, deleting them and freeing their ip address. The requesting client, if connected, is
+// told its node has expired and has to register again.
+func ExpirePendingApprovals(ctx context.Context, conn *sqlite.Conn) (err error) {
+	log := zerolog.Ctx(ctx)
+
+	var expiry = time.Duration(ApprovalExpiry.Get())
+
+	var tailnets []*domain.Tailnet
+	if tailnets, err = database.FetchMany(conn, domain.ListAllTailnets()); err != nil {
+		return err
+	}
+
+	var events []notifier.Event
+	for _, tailnet := range tailnets {
+		var machines []*domain.Machine
+		if machines, err = database.FetchMany(conn, domain.ListMachines(tailnet)); err != nil {
+			return err
+		}
+
+		for _, m := range machines {
+			if m.Authorized || time.Since(m.CreatedAt) < expiry {
+				continue
+			}
+
+			log.Info().Str("tailnet", tailnet.Name).Str("machine", m.CompleteName()).Time("created_at", m.CreatedAt).Msg("pending machine approval expired")
+
+			if _, err = database.Exec(conn, domain.DeleteNode(m)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineApprovalExpired, Actor: "janitor", Target: m.CompleteName(), TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"owner": m.Owner.LoginName()}}
+			if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+				return err
+			}
+
+			events = append(events, notifier.Event{Kind: notifier.MachineDeleted, Tailnet: tailnet.ID, Machine: m.ID})
+		}
+	}
+
+	// the requesting client's session is terminated once it sees the event, by which time the task's transaction has been committed
+	notifier.Publish(events...)
+	return nil
+}
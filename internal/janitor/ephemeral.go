@@ -0,0 +1,83 @@
+package janitor
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/rs/zerolog"
+	"time"
+)
+
+// EphemeralGrace is the duration an ephemeral machine may stay offline before it's deleted
+var EphemeralGrace = settings.Define("ephemeral.offline_grace", settings.Duration(30*time.Minute),
+	"duration after which an ephemeral machine that has gone offline is deleted")
+
+// DeleteOfflineEphemeralMachines deletes ephemeral machines (eg. those registered with an ephemeral auth key) that have
+// been offline for longer than EphemeralGrace, freeing their ip address. A machine is offline since its last presence
+// transition (see: domain.Presence), or since it was last seen if it never opened a streaming session.
+func DeleteOfflineEphemeralMachines(ctx context.Context, conn *sqlite.Conn) (err error) {
+	log := zerolog.Ctx(ctx)
+
+	var now = time.Now()
+	var cutoff = now.Add(-time.Duration(EphemeralGrace.Get()))
+
+	var tailnets []*domain.Tailnet
+	if tailnets, err = database.FetchMany(conn, domain.ListAllTailnets()); err != nil {
+		return err
+	}
+
+	var events []notifier.Event
+	for _, tailnet := range tailnets {
+		var machines []*domain.Machine
+		if machines, err = database.FetchMany(conn, domain.ListMachines(tailnet)); err != nil {
+			return err
+		}
+
+		for _, m := range machines {
+			if !m.Ephemeral {
+				continue
+			}
+
+			var offline = m.CreatedAt
+			if m.LastSeen != nil && !m.LastSeen.IsZero() {
+				offline = *m.LastSeen
+			}
+
+			var transitions []*domain.Presence // only the latest transition, if any, as the window is empty
+			if transitions, err = database.FetchMany(conn, domain.ListPresence(m, now)); err != nil {
+				return err
+			} else if len(transitions) > 0 {
+				var last = transitions[len(transitions)-1]
+				if last.Online {
+					continue // still connected
+				}
+				offline = last.At
+			}
+
+			if offline.After(cutoff) {
+				continue
+			}
+
+			log.Info().Str("tailnet", tailnet.Name).Str("machine", m.CompleteName()).Time("offline_since", offline).Msg("deleting offline ephemeral machine")
+
+			if _, err = database.Exec(conn, domain.DeleteNode(m)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineDeleted, Actor: "janitor", Target: m.CompleteName(), TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"reason": "ephemeral"}}
+			if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+				return err
+			}
+
+			events = append(events, notifier.Event{Kind: notifier.MachineDeleted, Tailnet: tailnet.ID, Machine: m.ID})
+		}
+	}
+
+	// peers act on these on their next sync tick, by which time the task's transaction has been committed
+	notifier.Publish(events...)
+	return nil
+}
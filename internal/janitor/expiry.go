@@ -0,0 +1,102 @@
+package janitor
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/util"
+	"github.com/rs/zerolog"
+	"time"
+)
+
+// expiryLookback bounds how long ago a key may have expired for RecordExpiries to record it, so that expiries that
+// predate the task aren't recorded all at once
+const expiryLookback = 24 * time.Hour
+
+// RecordExpiries records an audit event for machines whose key expired on its own (rather than being expired by an admin)
+// since it was last run, so that the expiry is delivered to webhooks, and exported, like any other.
+func RecordExpiries(ctx context.Context, conn *sqlite.Conn) (err error) {
+	log := zerolog.Ctx(ctx)
+
+	var tailnets []*domain.Tailnet
+	if tailnets, err = database.FetchMany(conn, domain.ListAllTailnets()); err != nil {
+		return err
+	}
+
+	for _, tailnet := range tailnets {
+		var machines []*domain.Machine
+		if machines, err = database.FetchMany(conn, domain.ListMachines(tailnet)); err != nil {
+			return err
+		}
+
+		for _, m := range machines {
+			if !m.IsExpired() || time.Since(m.ExpiresAt) > expiryLookback {
+				continue
+			}
+
+			var recorded *bool
+			if recorded, err = database.FetchOne(conn, domain.HasAuditEvent(tailnet.ID, domain.ActionMachineKeyExpired, m.CompleteName(), m.ExpiresAt)); err != nil {
+				return err
+			} else if *recorded {
+				continue
+			}
+
+			log.Info().Str("tailnet", tailnet.Name).Str("machine", m.CompleteName()).Time("expired_at", m.ExpiresAt).Msg("machine key expired")
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineKeyExpired, Actor: "janitor", Target: m.CompleteName(), TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"expires_at": m.ExpiresAt.UTC().Format(time.RFC3339), "reason": "expired"}}
+			if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeleteStaleMachines deletes machines whose key expired longer ago than their tailnet's
+// domain.Tailnet.DeleteExpiredAfter policy permits, freeing their ip address. Peers stop seeing the machine right away.
+func DeleteStaleMachines(ctx context.Context, conn *sqlite.Conn) (err error) {
+	log := zerolog.Ctx(ctx)
+
+	var tailnets []*domain.Tailnet
+	if tailnets, err = database.FetchMany(conn, domain.ListAllTailnets()); err != nil {
+		return err
+	}
+
+	var events []notifier.Event
+	for _, tailnet := range tailnets {
+		if tailnet.DeleteExpiredAfter <= 0 {
+			continue
+		}
+
+		var machines []*domain.Machine
+		if machines, err = database.FetchMany(conn, domain.ListMachines(tailnet)); err != nil {
+			return err
+		}
+
+		for _, m := range machines {
+			if !m.IsStale() {
+				continue
+			}
+
+			log.Info().Str("tailnet", tailnet.Name).Str("machine", m.CompleteName()).Time("expired_at", m.ExpiresAt).Msg("deleting stale machine")
+
+			if _, err = database.Exec(conn, domain.DeleteNode(m)); err != nil {
+				return err
+			}
+
+			event := &domain.AuditEvent{Action: domain.ActionMachineDeleted, Actor: "janitor", Target: m.CompleteName(), TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"reason": "expired"}}
+			if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+				return err
+			}
+
+			events = append(events, notifier.Event{Kind: notifier.MachineDeleted, Tailnet: tailnet.ID, Machine: m.ID})
+		}
+	}
+
+	// peers act on these on their next sync tick, by which time the task's transaction has been committed
+	notifier.Publish(events...)
+	return nil
+}
@@ -0,0 +1,15 @@
+package janitor
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"time"
+)
+
+// PruneImportedIdentities deletes the claims of imported machine identities that have since expired (see: domain.ClaimIdentity)
+func PruneImportedIdentities(_ context.Context, conn *sqlite.Conn) (err error) {
+	_, err = database.Exec(conn, domain.DeleteImportedIdentities(time.Now().Add(-domain.IdentityValidity)))
+	return err
+}
@@ -0,0 +1,74 @@
+// Package janitor runs periodic, background maintenance tasks (expiry, cleanup etc.) against the database.
+package janitor
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/rs/zerolog"
+	"time"
+)
+
+// Interval is the interval at which maintenance tasks are run
+var Interval = settings.Define("janitor.interval", settings.Duration(time.Minute),
+	"interval at which background maintenance tasks (expiry, cleanup etc.) are run")
+
+// Task is a single, named maintenance task. Each run of a task is executed in its own transaction.
+type Task struct {
+	Name string
+	Run  func(context.Context, *sqlite.Conn) error
+}
+
+// Tasks is the list of all maintenance tasks run by the janitor
+var Tasks = []Task{
+	{Name: "expire-registrations", Run: ExpireRegistrations},
+	{Name: "expire-pending-approvals", Run: ExpirePendingApprovals},
+	{Name: "count-hidden-machines", Run: CountHiddenMachines},
+	{Name: "record-expiries", Run: RecordExpiries},
+	{Name: "delete-stale-machines", Run: DeleteStaleMachines},
+	{Name: "delete-offline-ephemeral-machines", Run: DeleteOfflineEphemeralMachines},
+	{Name: "refresh-sessions", Run: RefreshSessions},
+	{Name: "prune-presence", Run: PrunePresence},
+	{Name: "prune-ssh-checks", Run: PruneSSHChecks},
+	{Name: "prune-imported-identities", Run: PruneImportedIdentities},
+}
+
+// Run runs all Tasks every Interval until the context is cancelled. It blocks and must be run in a goroutine.
+func Run(ctx context.Context, pool *sqlitex.Pool) {
+	log := zerolog.Ctx(ctx).With().Str("component", "janitor").Logger()
+
+	var ticker = time.NewTicker(time.Duration(Interval.Get()))
+	defer ticker.Stop()
+
+	changes, unwatch := settings.Watch(Interval.Name)
+	defer unwatch()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, task := range Tasks {
+				if err := run(ctx, pool, task); err != nil {
+					log.Error().Err(err).Str("task", task.Name).Msg("maintenance task failed")
+				}
+			}
+
+		case <-changes:
+			ticker.Reset(time.Duration(Interval.Get()))
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func run(ctx context.Context, pool *sqlitex.Pool, task Task) (err error) {
+	conn := pool.Get(ctx)
+	if conn == nil {
+		return ctx.Err() // context cancelled while waiting for a connection
+	}
+	defer pool.Put(conn)
+
+	defer sqlitex.Save(conn)(&err)
+	return task.Run(ctx, conn)
+}
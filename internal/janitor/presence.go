@@ -0,0 +1,22 @@
+package janitor
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"time"
+)
+
+// PresenceRetention is the duration for which machine presence transitions are kept, and so, the longest window uptime can be reported for
+var PresenceRetention = settings.Define("presence.retention", settings.Duration(30*24*time.Hour),
+	"duration for which machine online / offline transitions are kept for uptime reporting")
+
+// PrunePresence deletes presence transitions recorded before PresenceRetention
+func PrunePresence(_ context.Context, conn *sqlite.Conn) (err error) {
+	var cutoff = time.Now().Add(-time.Duration(PresenceRetention.Get()))
+
+	_, err = database.Exec(conn, domain.DeletePresence(cutoff))
+	return err
+}
@@ -0,0 +1,15 @@
+package janitor
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+)
+
+// RefreshSessions nudges all connected sessions to re-check their map state. Connected sessions only
+// prepare map responses when notified of a change, and this picks up changes that depend on the passage of
+// time rather than on a write (eg. expiring notices, key expiry warnings and peers going past the offline policy).
+func RefreshSessions(_ context.Context, _ *sqlite.Conn) error {
+	notifier.Publish(notifier.Event{Kind: notifier.Refresh, Tailnet: notifier.All})
+	return nil
+}
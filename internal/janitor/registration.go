@@ -0,0 +1,64 @@
+package janitor
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/rs/zerolog"
+	"time"
+)
+
+// RegistrationExpiry is the duration after which a pending (un-authenticated) registration request is rejected
+var RegistrationExpiry = settings.Define("registration.pending_expiry", settings.Duration(time.Hour),
+	"duration after which a pending registration request is rejected")
+
+// RegistrationAbandonGrace is the duration after which a registration request abandoned by its client is cancelled,
+// unless the client follows up on it again (eg. after reconnecting)
+var RegistrationAbandonGrace = settings.Define("registration.abandon_grace", settings.Duration(2*time.Minute),
+	"duration after which a registration request abandoned by its client is cancelled")
+
+// registrationRetention is the duration for which a rejected registration request is kept around after it
+// has expired, giving the polling client enough time to see the rejection before the request is deleted.
+const registrationRetention = 24 * time.Hour
+
+// ExpireRegistrations rejects pending registration requests that have not been completed within RegistrationExpiry, and
+// those abandoned by their clients for longer than RegistrationAbandonGrace. The rejection is delivered to the requesting
+// client (polling /machine/register) as an error. Expired requests are deleted once registrationRetention has passed.
+func ExpireRegistrations(ctx context.Context, conn *sqlite.Conn) (err error) {
+	log := zerolog.Ctx(ctx)
+
+	var cutoff = time.Now().Add(-time.Duration(RegistrationExpiry.Get()))
+
+	var expired []*domain.RegistrationRequest
+	if expired, err = database.FetchMany(conn, domain.ExpireRegistrationRequests(cutoff)); err != nil {
+		return err
+	}
+
+	for _, rr := range expired {
+		log.Info().Str("flow", rr.ID).Str("peer", rr.NoiseKey.String()).Msg("pending registration request expired")
+
+		event := &domain.AuditEvent{Action: domain.ActionRegistrationExpired, Actor: "janitor", Target: rr.ID, ClientAddr: rr.ClientAddr, Location: rr.Location}
+		if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+			return err
+		}
+	}
+
+	var abandoned []*domain.RegistrationRequest
+	if abandoned, err = database.FetchMany(conn, domain.CancelAbandonedRegistrationRequests(time.Now().Add(-time.Duration(RegistrationAbandonGrace.Get())))); err != nil {
+		return err
+	}
+
+	for _, rr := range abandoned {
+		log.Info().Str("flow", rr.ID).Str("peer", rr.NoiseKey.String()).Msg("abandoned registration request cancelled")
+
+		event := &domain.AuditEvent{Action: domain.ActionRegistrationAbandoned, Actor: "janitor", Target: rr.ID, ClientAddr: rr.ClientAddr, Location: rr.Location}
+		if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+			return err
+		}
+	}
+
+	_, err = database.Exec(conn, domain.DeleteRegistrationRequests(cutoff.Add(-registrationRetention)))
+	return err
+}
@@ -0,0 +1,18 @@
+package janitor
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"time"
+)
+
+// sshCheckRetention is the duration for which ssh checks are kept after they were started, even if they no longer hold
+const sshCheckRetention = 24 * time.Hour
+
+// PruneSSHChecks deletes ssh checks that were never completed, or whose check period has passed
+func PruneSSHChecks(_ context.Context, conn *sqlite.Conn) (err error) {
+	_, err = database.Exec(conn, domain.DeleteSSHChecks(time.Now().Add(-sshCheckRetention)))
+	return err
+}
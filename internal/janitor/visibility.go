@@ -0,0 +1,44 @@
+package janitor
+
+import (
+	"context"
+	"crawshaw.io/sqlite"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"tailscale.com/metrics"
+)
+
+// TailnetLabel labels a metric with the name of the tailnet it belongs to
+type TailnetLabel struct {
+	Tailnet string `prom:"tailnet"`
+}
+
+// HiddenMachines is the number of machines per tailnet that are hidden from their peers' netmaps
+// due to the tailnet's domain.Tailnet.HideOfflineAfter policy.
+var HiddenMachines = metrics.NewMultiLabelMap[TailnetLabel]("wirefire_hidden_machines", "gauge", "number of machines hidden from peers' netmaps for being offline")
+
+// CountHiddenMachines refreshes the HiddenMachines metric for all tailnets.
+func CountHiddenMachines(_ context.Context, conn *sqlite.Conn) (err error) {
+	var tailnets []*domain.Tailnet
+	if tailnets, err = database.FetchMany(conn, domain.ListAllTailnets()); err != nil {
+		return err
+	}
+
+	for _, tailnet := range tailnets {
+		var machines []*domain.Machine
+		if machines, err = database.FetchMany(conn, domain.ListMachines(tailnet)); err != nil {
+			return err
+		}
+
+		var hidden int64
+		for _, m := range machines {
+			if m.IsHidden() {
+				hidden++
+			}
+		}
+
+		HiddenMachines.SetInt(TailnetLabel{Tailnet: tailnet.Name}, hidden)
+	}
+
+	return nil
+}
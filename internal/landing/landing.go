@@ -0,0 +1,70 @@
+// Package landing serves wirefire's public landing page, with instructions to install the tailscale
+// client and login using this server, instead of a bare 404 at the server's root.
+package landing
+
+import (
+	"crawshaw.io/sqlite/sqlitex"
+	"embed"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/rs/zerolog"
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+//go:embed templates
+var templates embed.FS
+
+// Config is the subset of configuration relevant to the landing page
+type Config struct {
+	// BaseUrl is the url clients use as the login server
+	BaseUrl *url.URL `viper:"server.url"`
+}
+
+func init() {
+	config.Register[Config]()
+}
+
+// Index serves the GET / endpoint, and renders install and login instructions for this server.
+func Index() http.HandlerFunc {
+	cfg := config.MustValidate(config.Read[Config]())
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		render(w, r, map[string]any{"server": cfg.BaseUrl.String()})
+	}
+}
+
+// Join serves the GET /join/{tailnet} endpoint, a deep link that admins can share with users invited to the named tailnet.
+// It renders the same instructions as Index, along with the tailnet to pick once logged in.
+func Join(pool *sqlitex.Pool) http.HandlerFunc {
+	cfg := config.MustValidate(config.Read[Config]())
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		tailnet, err := database.FetchOne(conn, domain.TailnetByName(chi.URLParam(r, "tailnet")))
+		if err != nil {
+			zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to fetch tailnet")
+			http.Error(w, "failed to fetch tailnet", http.StatusInternalServerError)
+			return
+		} else if tailnet == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		render(w, r, map[string]any{"server": cfg.BaseUrl.String(), "tailnet": tailnet.Name})
+	}
+}
+
+func render(w http.ResponseWriter, r *http.Request, params map[string]any) {
+	var tpl = template.Must(template.ParseFS(templates, "templates/index.html"))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tpl.ExecuteTemplate(w, "index.html", params); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to render landing page")
+	}
+}
@@ -0,0 +1,146 @@
+// Package notifier implements an in-process publish / subscribe bus used to notify
+// connected sessions about changes in their tailnet (eg. machines being updated or deleted).
+//
+// Events must only be published after the change has been committed to the database,
+// as subscribers typically react to an event by reading the updated state.
+package notifier
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Kind is the kind of change an Event describes
+type Kind int
+
+const (
+	MachineDeleted Kind = iota + 1 // a machine was deleted from the tailnet
+	MachineCreated                 // a machine was added to the tailnet
+	MachineUpdated                 // a machine's details (endpoints, keys, name, tags etc.) were updated
+	TailnetUpdated                 // the tailnet's policy (acl, visibility etc.) was updated
+	NoticesChanged                 // operator-defined notices were created or deleted
+	Refresh                        // periodic nudge to pick up time-dependent changes (eg. expiring notices)
+	MachineRevoked                 // a machine's key was revoked by an admin; its sessions are terminated
+	UserUpdated                    // a user's details (name, claims etc.) were updated, eg. when they login
+	DERPMapChanged                 // the derp map served to clients has changed, eg. when it's refreshed from its sources
+	MachineOnline                  // a machine connected to the coordinator; it doesn't change its peers' netmaps
+	MachineOffline                 // a machine disconnected from the coordinator; it doesn't change its peers' netmaps
+	TailnetDeleted                 // the tailnet was deleted, after all its machines were (see: MachineDeleted)
+)
+
+// All is the tailnet id used to publish an event to subscribers of every tailnet
+const All = 0
+
+// Event describes a change in a tailnet
+type Event struct {
+	Kind    Kind
+	Tailnet int // tailnet the change belongs to, or All
+	Machine int // machine the change belongs to, if any
+	User    int // user the change belongs to, if any
+}
+
+// bufferSize is the number of events buffered per subscription. Events published to a
+// subscriber with a full buffer are dropped, so that a slow subscriber cannot block publishers.
+const bufferSize = 32
+
+var (
+	mu          sync.RWMutex
+	subscribers = make(map[int]map[chan Event]struct{}) // subscriptions keyed by tailnet id
+	observers   = make(map[chan Event]struct{})         // subscriptions to events of every tailnet; see SubscribeAll
+)
+
+// Subscribe subscribes to events published for the given tailnet. The returned function must
+// be called to cancel the subscription once the caller is no longer interested in the events.
+func Subscribe(tailnet int) (<-chan Event, func()) {
+	var ch = make(chan Event, bufferSize)
+
+	mu.Lock()
+	if subscribers[tailnet] == nil {
+		subscribers[tailnet] = make(map[chan Event]struct{})
+	}
+	subscribers[tailnet][ch] = struct{}{}
+	mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			mu.Lock()
+			defer mu.Unlock()
+
+			delete(subscribers[tailnet], ch)
+			if len(subscribers[tailnet]) == 0 {
+				delete(subscribers, tailnet)
+			}
+		})
+	}
+}
+
+// SubscribeAll subscribes to events published for every tailnet, unlike Subscribe(All) which only receives
+// the events published to all tailnets. It's meant for process-wide consumers, eg. caches that must be invalidated.
+func SubscribeAll() (<-chan Event, func()) {
+	var ch = make(chan Event, bufferSize)
+
+	mu.Lock()
+	observers[ch] = struct{}{}
+	mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			mu.Lock()
+			defer mu.Unlock()
+
+			delete(observers, ch)
+		})
+	}
+}
+
+// generations counts the events published to each tailnet (keyed by tailnet id, or All); see Generation
+var generations sync.Map
+
+// Generation returns the number of events published to the tailnet, including those published to All. It changes
+// before the events are delivered, so a subscriber reacting to an event always sees the generation that followed it.
+// It's used to tell if state derived from the tailnet (eg. a cached list of its machines) is still current.
+func Generation(tailnet int) uint64 {
+	var gen uint64
+	for _, id := range []int{tailnet, All} {
+		if n, ok := generations.Load(id); ok {
+			gen += n.(*atomic.Uint64).Load()
+		}
+	}
+	return gen
+}
+
+// Publish delivers the event(s) to all subscribers of the event's tailnet, or to all subscribers
+// if the event's tailnet is All, as well as to subscribers of every tailnet. It never blocks.
+func Publish(events ...Event) {
+	for _, e := range events {
+		n, _ := generations.LoadOrStore(e.Tailnet, new(atomic.Uint64))
+		n.(*atomic.Uint64).Add(1)
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	for _, e := range events {
+		deliver(observers, e)
+
+		if e.Tailnet != All {
+			deliver(subscribers[e.Tailnet], e)
+			continue
+		}
+
+		for _, subs := range subscribers {
+			deliver(subs, e)
+		}
+	}
+}
+
+func deliver(subs map[chan Event]struct{}, e Event) {
+	for ch := range subs {
+		select {
+		case ch <- e:
+		default: // subscriber isn't keeping up; drop the event
+		}
+	}
+}
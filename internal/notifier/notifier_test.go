@@ -0,0 +1,85 @@
+package notifier
+
+import (
+	"testing"
+)
+
+// received drains the events buffered in the subscription
+func received(ch <-chan Event) (events []Event) {
+	for {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	first, unsubscribeFirst := Subscribe(101)
+	defer unsubscribeFirst()
+
+	second, unsubscribeSecond := Subscribe(102)
+	defer unsubscribeSecond()
+
+	all, unsubscribeAll := SubscribeAll()
+	defer unsubscribeAll()
+
+	Publish(Event{Kind: MachineUpdated, Tailnet: 101, Machine: 1}, Event{Kind: DERPMapChanged, Tailnet: All})
+
+	if events := received(first); len(events) != 2 || events[0].Machine != 1 || events[1].Kind != DERPMapChanged {
+		t.Errorf("expected tailnet's own event and the one published to all; got %+v", events)
+	}
+
+	if events := received(second); len(events) != 1 || events[0].Kind != DERPMapChanged {
+		t.Errorf("expected only the event published to all; got %+v", events)
+	}
+
+	if events := received(all); len(events) != 2 {
+		t.Errorf("expected every event; got %+v", events)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	ch, unsubscribe := Subscribe(103)
+	unsubscribe()
+	unsubscribe() // must be safe to call more than once
+
+	Publish(Event{Kind: MachineUpdated, Tailnet: 103})
+	if events := received(ch); len(events) != 0 {
+		t.Errorf("expected no events once unsubscribed; got %+v", events)
+	}
+}
+
+func TestPublish_SlowSubscriber(t *testing.T) {
+	ch, unsubscribe := Subscribe(104)
+	defer unsubscribe()
+
+	for i := range bufferSize + 8 {
+		Publish(Event{Kind: MachineUpdated, Tailnet: 104, Machine: i}) // must not block once the buffer is full
+	}
+
+	if events := received(ch); len(events) != bufferSize || events[bufferSize-1].Machine != bufferSize-1 {
+		t.Errorf("expected the first %d events, and the rest dropped; got %d", bufferSize, len(events))
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	var before = Generation(105)
+
+	Publish(Event{Kind: MachineUpdated, Tailnet: 105})
+	if after := Generation(105); after != before+1 {
+		t.Errorf("expected generation to advance with the tailnet's events; got %d after %d", after, before)
+	}
+
+	Publish(Event{Kind: MachineUpdated, Tailnet: 106})
+	if after := Generation(105); after != before+1 {
+		t.Errorf("expected generation not to advance with other tailnets' events; got %d after %d", after, before)
+	}
+
+	Publish(Event{Kind: Refresh, Tailnet: All})
+	if after := Generation(105); after != before+2 {
+		t.Errorf("expected generation to advance with events published to all; got %d after %d", after, before)
+	}
+}
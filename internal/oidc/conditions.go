@@ -0,0 +1,53 @@
+package oidc
+
+import (
+	"crawshaw.io/sqlite"
+	"fmt"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"slices"
+	"strings"
+)
+
+// ConditionError is returned when the user's claims do not meet the configured login conditions.
+// Its message is shown to the user, and is safe to be displayed.
+type ConditionError struct{ Reason string }
+
+func (e *ConditionError) Error() string { return e.Reason }
+
+// CheckConditions verifies the user's claims against the login conditions in the configuration,
+// returning a *ConditionError describing the first condition that isn't met.
+func CheckConditions(cfg *Config, claims domain.UserClaims) error {
+	if cfg.RequireVerifiedEmail && (claims.Email == "" || !claims.EmailVerified) {
+		return &ConditionError{Reason: "your email address has not been verified by the identity provider"}
+	}
+
+	if len(cfg.AllowedDomains) > 0 {
+		var _, domain, _ = strings.Cut(strings.ToLower(claims.Email), "@")
+		if !slices.ContainsFunc(cfg.AllowedDomains, func(d string) bool { return strings.EqualFold(d, domain) }) {
+			return &ConditionError{Reason: fmt.Sprintf("logins from %q are not allowed", claims.Email)}
+		}
+	}
+
+	if len(cfg.RequiredGroups) > 0 {
+		if !slices.ContainsFunc(claims.Groups, func(g string) bool { return slices.Contains(cfg.RequiredGroups, g) }) {
+			return &ConditionError{Reason: "you are not a member of any of the groups allowed to login"}
+		}
+	}
+
+	return nil
+}
+
+// CheckDisabled returns a *ConditionError if an admin has disabled the logins of the user identified by the claims.
+func CheckDisabled(conn *sqlite.Conn, claims domain.UserClaims) error {
+	user, err := database.FetchOne(conn, domain.UserByIdentity(claims.Issuer, claims.Subject))
+	if err != nil {
+		return err
+	}
+
+	if user != nil && user.IsDisabled() {
+		return &ConditionError{Reason: "your account has been disabled by an administrator"}
+	}
+
+	return nil
+}
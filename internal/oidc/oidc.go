@@ -15,23 +15,31 @@ import (
 	"github.com/gorilla/csrf"
 	"github.com/pkg/errors"
 	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/coordinator"
 	"github.com/riyaz-ali/wirefire/internal/database"
 	"github.com/riyaz-ali/wirefire/internal/domain"
-	"github.com/riyaz-ali/wirefire/internal/ipam"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/tracing"
+	"github.com/riyaz-ali/wirefire/internal/util"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"html/template"
 	"net/http"
-	"net/netip"
 	"net/url"
+	"reflect"
+	"slices"
 	"strconv"
-	"tailscale.com/util/dnsname"
 	"time"
 )
 
 //go:embed templates
 var templates embed.FS
 
+// errFlowConsumed is returned when completing a registration flow that has already been completed
+var errFlowConsumed = errors.New("registration request has already been completed")
+
 // Config is the OIDC configuration provided by the user
 type Config struct {
 	// Key is the coordination server's key.MachinePrivate key.
@@ -40,25 +48,127 @@ type Config struct {
 
 	// Provider is the address of the authentication server.
 	// The server must support /.well-known/openid-configuration endpoint
+	//
+	// Provider, along with the client id, secret, scopes and extra claims below, configure the provider named "default".
+	// Additional providers are configured using oidc.providers (see ProviderConfig); users are shown a picker if there's
+	// more than one provider. Provider can be left empty if oidc.providers is set.
 	Provider string `viper:"oidc.provider"`
 
 	// OIDC client id and secret values
 	ClientID     string `viper:"oidc.client_id"`
 	ClientSecret string `viper:"oidc.client_secret"`
 
+	// Scopes requested from the provider. openid is always requested. Requesting offline_access also
+	// prompts the user for consent, as required by the OIDC specification.
+	Scopes []string `viper:"oidc.scopes" default:"openid,profile,email"`
+
+	// ExtraClaims is a list of non-standard claims (eg. groups) copied from the id token into domain.UserClaims.Extra
+	ExtraClaims []string `viper:"oidc.extra_claims"`
+
+	// Login conditions applied to the user's claims. Logins that don't meet all of them are denied.
+	//
+	// RequireVerifiedEmail requires the email_verified claim to be true, AllowedDomains restricts logins to
+	// email addresses from the given domains, and RequiredGroups requires the user to be a member of at least one
+	// of the given groups (using the groups claim). Empty values disable the respective condition.
+	RequireVerifiedEmail bool     `viper:"oidc.conditions.require_verified_email"`
+	AllowedDomains       []string `viper:"oidc.conditions.allowed_domains"`
+	RequiredGroups       []string `viper:"oidc.conditions.required_groups"`
+
+	// PersonalTailnets provisions a personal tailnet, named after the user's login and with the default (allow-all) acl policy,
+	// for users that login while not being a member of any tailnet. The user is made an admin of the new tailnet.
+	PersonalTailnets bool `viper:"oidc.personal_tailnets"`
+
 	// BaseUrl used to construct redirect urls
 	BaseUrl *url.URL `viper:"server.url"`
 }
 
+func init() {
+	config.Register[Config]()
+	config.RegisterPrefix("oidc.providers") // see: Config.ProviderConfigs
+}
+
+// ProviderConfig configures one of the providers listed under oidc.providers, eg.
+//
+//	oidc:
+//	  providers:
+//	    - name: github
+//	      display_name: GitHub
+//	      issuer: https://dex.example.com
+//	      client_id: wirefire
+//	      client_secret: secret
+//	      claim_mapping: { name: preferred_username, groups: teams }
+type ProviderConfig struct {
+	Name        string `mapstructure:"name"`         // unique name of the provider, used in login urls
+	DisplayName string `mapstructure:"display_name"` // name shown to users in the provider picker; defaults to Name
+
+	// Issuer is the address of the authentication server, which must support /.well-known/openid-configuration endpoint.
+	// Users are identified by the issuer and subject of their tokens, so users of different providers never collide.
+	Issuer string `mapstructure:"issuer"`
+
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	Scopes       []string `mapstructure:"scopes"`       // scopes requested from the provider; defaults to openid, profile and email
+	ExtraClaims  []string `mapstructure:"extra_claims"` // see Config.ExtraClaims
+
+	// ClaimMapping maps standard claims (name, email, email_verified, picture and groups) to the claims the provider
+	// reports them under, for providers that use non-standard names (eg. name: preferred_username).
+	ClaimMapping map[string]string `mapstructure:"claim_mapping"`
+}
+
+// mappableClaims are the standard claims that can be mapped using ProviderConfig.ClaimMapping
+var mappableClaims = []string{"name", "email", "email_verified", "picture", "groups"}
+
+// ProviderConfigs returns the configuration of all providers; the default provider (if configured) comes first,
+// followed by the ones listed under oidc.providers, in order.
+func (c *Config) ProviderConfigs() (_ []ProviderConfig, err error) {
+	var providers []ProviderConfig
+	if c.Provider != "" {
+		providers = append(providers, ProviderConfig{Name: "default", DisplayName: "Default", Issuer: c.Provider, ClientID: c.ClientID, ClientSecret: c.ClientSecret, Scopes: c.Scopes, ExtraClaims: c.ExtraClaims})
+	}
+
+	var others []ProviderConfig
+	if err = viper.UnmarshalKey("oidc.providers", &others); err != nil {
+		return nil, errors.Wrap(err, "oidc: failed to read providers")
+	}
+
+	if providers = append(providers, others...); len(providers) == 0 {
+		return nil, errors.New("oidc: no provider configured")
+	}
+
+	var names = make(map[string]bool)
+	for i := range providers {
+		var pc = &providers[i]
+		if pc.Name == "" || pc.Issuer == "" {
+			return nil, errors.New("oidc: provider name and issuer are required")
+		} else if names[pc.Name] {
+			return nil, errors.Errorf("oidc: duplicate provider %q", pc.Name)
+		}
+
+		for claim := range pc.ClaimMapping {
+			if !slices.Contains(mappableClaims, claim) {
+				return nil, errors.Errorf("oidc: provider %q: claim %q cannot be mapped", pc.Name, claim)
+			}
+		}
+
+		if len(pc.Scopes) == 0 {
+			pc.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+		}
+
+		names[pc.Name] = true
+	}
+
+	return providers, nil
+}
+
 func Handler(ctx context.Context, pool *sqlitex.Pool) http.Handler {
 	cfg := config.MustValidate(config.Read[Config]())
-	rs := NewRemoteService(ctx, cfg)
+	ps := NewProviders(ctx, cfg)
 
 	r := chi.NewRouter()
-	r.Use(NewAccessLog())
-	r.Method(http.MethodGet, "/login", AuthStart(cfg, rs))
-	r.Method(http.MethodGet, "/callback", AuthCallback(rs, pool))
-	r.Method(http.MethodPost, "/callback", AuthComplete(rs, pool))
+	r.Use(NewAccessLog(), otelhttp.NewMiddleware("oidc.request"))
+	r.Method(http.MethodGet, "/login", AuthStart(cfg, ps, pool))
+	r.Method(http.MethodGet, "/callback", AuthCallback(cfg, ps, pool))
+	r.Method(http.MethodPost, "/callback", AuthComplete(cfg, ps, pool))
 
 	// wrap all endpoints using csrf.Protect()
 	csrfProtect := csrf.Protect(sha256.New().Sum([]byte(cfg.Key)),
@@ -74,24 +184,76 @@ func NewAccessLog() func(next http.Handler) http.Handler {
 	})
 }
 
-// AuthStart serves the GET /login endpoint and starts the OIDC authentication flow
-func AuthStart(cfg *Config, rs *RemoteService) http.HandlerFunc {
+// AuthStart serves the GET /login endpoint and starts the OIDC authentication flow with the provider named by the
+// provider parameter. If more than one provider is configured, and none is named, the user is shown a provider picker.
+// Flows that have expired, or were cancelled after their client abandoned them, are turned away right away.
+func AuthStart(cfg *Config, ps *Providers, pool *sqlitex.Pool) http.HandlerFunc {
+	var tpl = template.Must(template.ParseFS(templates, "templates/*.html"))
+
 	return func(w http.ResponseWriter, r *http.Request) {
-		// value of flow is not validated in any way here
+		// value of flow isn't validated any further here
 		// this is taken verbatim from the request and will get passed to the /callback endpoint
 		// where it will validate it, and return appropriate error
-		if flow := r.URL.Query().Get("flow"); flow == "" {
+		var flow, name = r.URL.Query().Get("flow"), r.URL.Query().Get("provider")
+		if flow == "" {
 			http.Error(w, "missing flow parameter", http.StatusBadRequest)
-		} else {
-			http.SetCookie(w, &http.Cookie{Name: "state", Value: flow, Secure: cfg.BaseUrl.Scheme == "https", HttpOnly: true})
-			http.Redirect(w, r, rs.AuthCodeURL(flow), http.StatusFound)
+			return
+		}
+
+		if rr := pendingFlow(r, pool, flow); rr != nil && rr.Expired() {
+			expired(w, r, tpl, rr)
+			return
 		}
+
+		if name == "" && ps.Len() > 1 {
+			err := ps.Picker(w, func(name string) string {
+				return "/oidc/login?" + url.Values{"flow": {flow}, "provider": {name}}.Encode()
+			})
+
+			if err != nil {
+				zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to render template")
+			}
+
+			return
+		}
+
+		var rs = ps.Get(name)
+		if rs == nil {
+			http.Error(w, "unknown provider", http.StatusBadRequest)
+			return
+		}
+
+		var secure = cfg.BaseUrl.Scheme == "https"
+		http.SetCookie(w, &http.Cookie{Name: "state", Value: flow, Secure: secure, HttpOnly: true})
+		http.SetCookie(w, &http.Cookie{Name: "provider", Value: rs.Name(), Secure: secure, HttpOnly: true})
+		http.Redirect(w, r, rs.AuthCodeURL(flow), http.StatusFound)
+	}
+}
+
+// pendingFlow returns the registration request of the flow; nil if it isn't found
+func pendingFlow(r *http.Request, pool *sqlitex.Pool, flow string) *domain.RegistrationRequest {
+	conn := pool.Get(r.Context())
+	defer pool.Put(conn)
+
+	rr, err := database.FetchOne(conn, domain.RegistrationRequestById(flow))
+	if err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to fetch registration request")
+	}
+	return rr
+}
+
+// expired renders the page shown for a flow that can no longer be completed (eg. it expired, or its client abandoned it)
+func expired(w http.ResponseWriter, r *http.Request, tpl *template.Template, rr *domain.RegistrationRequest) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusGone)
+	if err := tpl.ExecuteTemplate(w, "expired.html", map[string]any{"reason": rr.Error}); err != nil {
+		zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to render template")
 	}
 }
 
 // AuthCallback serves the GET /callback endpoint and handles OIDC token-exchange and validation.
 // Upon successful validation, it renders a form with a list of tailnets that the user can join.
-func AuthCallback(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
+func AuthCallback(cfg *Config, ps *Providers, pool *sqlitex.Pool) http.HandlerFunc {
 	var tpl = template.Must(template.ParseFS(templates, "templates/*.html"))
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -104,8 +266,20 @@ func AuthCallback(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
 			return
 		}
 
+		var rs *RemoteService
+		if cookie, err := r.Cookie("provider"); err == nil {
+			rs = ps.Get(cookie.Value)
+		}
+
+		if rs == nil {
+			http.Error(w, "unknown provider", http.StatusBadRequest)
+
+			return
+		}
+
 		conn := pool.Get(ctx)
 		defer pool.Put(conn)
+		defer tracing.Bind(conn, ctx)()
 
 		var rr *domain.RegistrationRequest
 		if rr, err = database.FetchOne(conn, domain.RegistrationRequestById(r.URL.Query().Get("state"))); err != nil || rr == nil {
@@ -114,6 +288,24 @@ func AuthCallback(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
 			return
 		}
 
+		if rr.ConsumedAt != nil {
+			http.Error(w, "this login request has already been used", http.StatusConflict)
+
+			return
+		}
+
+		if rr.Expired() {
+			expired(w, r, tpl, rr)
+
+			return
+		}
+
+		if rr.Error != "" {
+			http.Error(w, rr.Error, http.StatusGone)
+
+			return
+		}
+
 		var raw string
 		if raw, err = rs.Exchange(ctx, r.URL.Query().Get("code")); err != nil {
 			log.Error().Err(err).Msg("failed to exchange code")
@@ -131,15 +323,32 @@ func AuthCallback(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
 		}
 
 		var claims domain.UserClaims
-		if err = token.Claims(&claims); err != nil {
+		if claims, err = rs.Claims(token); err != nil {
 			log.Error().Err(err).Msg("failed to parse claims from token")
 			http.Error(w, "failed to parse claims from token", http.StatusBadRequest)
 
 			return
 		}
 
+		if err = CheckConditions(cfg, claims); err == nil {
+			err = CheckDisabled(conn, claims)
+		}
+
+		if err != nil {
+			deny(r, conn, rr, claims, err)
+
+			w.WriteHeader(http.StatusForbidden)
+			if err = tpl.ExecuteTemplate(w, "denied.html", map[string]any{"reason": err.Error()}); err != nil {
+				log.Error().Err(err).Msg("failed to render template")
+			}
+
+			return
+		}
+
 		var user *domain.User
-		if user, err = database.FetchOne(conn, domain.FindOrCreateUser(claims)); err != nil {
+		var changed bool
+		if user, changed, err = findOrCreateUser(conn, claims); err != nil {
+			log.Error().Err(err).Msg("failed to find or create user")
 			http.Error(w, "failed to find or create user", http.StatusInternalServerError)
 
 			return
@@ -153,8 +362,31 @@ func AuthCallback(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
 			return
 		}
 
+		// the user's name and claims are updated with the ones from the token; if they've changed, let sessions (and
+		// their caches) in the user's tailnets know, as the user's machines (and so, its profile) are only seen there
+		if changed {
+			var events []notifier.Event
+			for _, tailnet := range tailnets {
+				events = append(events, notifier.Event{Kind: notifier.UserUpdated, Tailnet: tailnet.ID, User: user.ID})
+			}
+			notifier.Publish(events...)
+		}
+
+		if len(tailnets) == 0 && cfg.PersonalTailnets {
+			var tailnet *domain.Tailnet
+			if tailnet, err = createPersonalTailnet(conn, user, rr); err != nil {
+				log.Error().Err(err).Msg("failed to create personal tailnet")
+				http.Error(w, "failed to create personal tailnet", http.StatusInternalServerError)
+
+				return
+			}
+
+			log.Info().Str("sub", user.Subject).Str("tailnet", tailnet.Name).Msg("created personal tailnet")
+			tailnets = append(tailnets, tailnet)
+		}
+
 		raw = base64.StdEncoding.EncodeToString([]byte(raw)) // encode to base64 to prevent unwanted escaping when sent via html form
-		params := map[string]any{csrf.TemplateTag: csrf.TemplateField(r), "rr": rr, "token": raw, "tailnets": tailnets}
+		params := map[string]any{csrf.TemplateTag: csrf.TemplateField(r), "rr": rr, "token": raw, "provider": rs.Name(), "tailnets": tailnets}
 
 		if err = tpl.ExecuteTemplate(w, "callback.html", params); err != nil {
 			log.Error().Err(err).Msg("failed to render template")
@@ -167,7 +399,9 @@ func AuthCallback(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
 
 // AuthComplete serves the POST /callback endpoint and completes the authentication flow,
 // adding the machine to the requested tailnet.
-func AuthComplete(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
+func AuthComplete(cfg *Config, ps *Providers, pool *sqlitex.Pool) http.HandlerFunc {
+	var tpl = template.Must(template.ParseFS(templates, "templates/*.html"))
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, log := r.Context(), zerolog.Ctx(r.Context())
 
@@ -178,6 +412,13 @@ func AuthComplete(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
 			return
 		}
 
+		var rs = ps.Get(r.FormValue("provider"))
+		if rs == nil {
+			http.Error(w, "unknown provider", http.StatusBadRequest)
+
+			return
+		}
+
 		var raw, _ = base64.StdEncoding.DecodeString(r.FormValue("token"))
 
 		var token *oidc.IDToken
@@ -190,15 +431,44 @@ func AuthComplete(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
 
 		conn := pool.Get(ctx)
 		defer pool.Put(conn)
+		defer tracing.Bind(conn, ctx)()
+
+		// conditions are checked again as the token is posted back by the client, and the configuration
+		// may have changed since the form was rendered
+		var claims domain.UserClaims
+		if claims, err = rs.Claims(token); err != nil {
+			http.Error(w, "failed to parse claims from token", http.StatusBadRequest)
+
+			return
+		} else if err = CheckConditions(cfg, claims); err == nil {
+			err = CheckDisabled(conn, claims)
+		}
+
+		if err != nil {
+			if rr, _ := database.FetchOne(conn, domain.RegistrationRequestById(r.FormValue("rid"))); rr != nil {
+				deny(r, conn, rr, claims, err)
+			}
+
+			http.Error(w, err.Error(), http.StatusForbidden)
+
+			return
+		}
 
 		var rr *domain.RegistrationRequest
+		var tailnet *domain.Tailnet
+		var created *domain.Machine // machine created by this flow, if any
+		var events []notifier.Event // published once the flow has completed
 		err = database.Tx(conn, func(conn *sqlite.Conn) error {
-			if rr, err = database.FetchOne(conn, domain.RegistrationRequestById(r.FormValue("rid"))); err != nil {
+			// atomically mark the request as consumed. This must be the first statement in the transaction so that the write lock
+			// is acquired upfront, and concurrent submissions of the same flow (double-submit, multiple tabs, etc.) are serialized.
+			if rr, err = database.FetchOne(conn, domain.ConsumeRegistrationRequest(r.FormValue("rid"))); err != nil {
 				return err
+			} else if rr == nil {
+				return errFlowConsumed
 			}
 
 			var user *domain.User
-			if user, err = database.FetchOne(conn, domain.UserBySubject(token.Subject)); err != nil {
+			if user, err = database.FetchOne(conn, domain.UserByIdentity(token.Issuer, token.Subject)); err != nil {
 				return err
 			}
 
@@ -207,7 +477,6 @@ func AuthComplete(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
 				return errors.New("user is not a member of the requested tailnet")
 			}
 
-			var tailnet *domain.Tailnet
 			if tailnet, err = database.FetchOne(conn, domain.TailnetById(tid)); err != nil {
 				return err
 			}
@@ -219,11 +488,53 @@ func AuthComplete(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
 			}
 
 			if machine == nil { // create a new machine
-				if machine, err = createMachine(conn, user, tailnet, rr); err != nil {
+				if machine, err = coordinator.CreateMachine(conn, user, tailnet, rr); err != nil {
+					return err
+				}
+
+				event := &domain.AuditEvent{
+					Action:     domain.ActionMachineCreated,
+					Actor:      user.Subject,
+					Target:     machine.CompleteName(),
+					TailnetID:  util.ToPtr(tailnet.ID),
+					ClientAddr: rr.ClientAddr,
+					Location:   rr.Location,
+					Data:       map[string]string{"registration_id": rr.ID, "ipv4": machine.IPv4.String()},
+				}
+
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+					return err
+				}
+
+				created = machine
+			} else { // user has re-authenticated after node expiry (or logout); rotate the machine's keys
+				var previous = machine
+				var fresh bool
+				if machine, fresh, err = coordinator.ReauthenticateMachine(conn, user, tailnet, previous, rr); err != nil {
+					return err
+				}
+
+				event := &domain.AuditEvent{
+					Action:     domain.ActionMachineReauthenticated,
+					Actor:      user.Subject,
+					Target:     machine.CompleteName(),
+					TailnetID:  util.ToPtr(tailnet.ID),
+					ClientAddr: rr.ClientAddr,
+					Location:   rr.Location,
+					Data:       map[string]string{"registration_id": rr.ID},
+				}
+
+				if fresh { // signed in as a different user, or into a different tailnet
+					event.Action, event.Data["ipv4"] = domain.ActionMachineCreated, machine.IPv4.String()
+					events = append(events, notifier.Event{Kind: notifier.MachineDeleted, Tailnet: previous.TailnetID, Machine: previous.ID})
+					created = machine
+				} else {
+					events = append(events, notifier.Event{Kind: notifier.MachineUpdated, Tailnet: machine.TailnetID, Machine: machine.ID})
+				}
+
+				if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
 					return err
 				}
-			} else {
-				// TODO(@riyaz): user has re-authenticated after node expiry (or logout); store updated params
 			}
 
 			rr.Authenticated = true
@@ -233,75 +544,143 @@ func AuthComplete(rs *RemoteService, pool *sqlitex.Pool) http.HandlerFunc {
 			return err
 		})
 
-		if err != nil {
+		if errors.Is(err, errFlowConsumed) {
+			// the flow has either been completed already, or it doesn't exist; repeated submissions
+			// of a successfully completed flow are reported as successful, without changing any state.
+			if rr, _ = database.FetchOne(conn, domain.RegistrationRequestById(r.FormValue("rid"))); rr != nil && rr.Authenticated {
+				_, _ = fmt.Fprintf(w, "Authentication successful! Please close this window")
+			} else {
+				log.Warn().Str("flow", r.FormValue("rid")).Msg("attempt to complete an invalid or already used flow")
+				http.Error(w, "this login request is invalid or has already been used", http.StatusConflict)
+			}
+		} else if err != nil {
 			if rr != nil {
 				rr.Authenticated, rr.Error = false, err.Error()
 				_, _ = database.Exec(conn, domain.SaveRegistrationRequest(rr))
 			}
 
+			if errors.Is(err, domain.ErrHostnameReserved) {
+				log.Warn().Err(err).Msg("registration rejected; hostname reserved")
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
 			log.Error().Err(err).Msg("failed to complete authentication")
 			http.Error(w, "failed to complete authentication", http.StatusInternalServerError)
 		} else {
-			_, _ = fmt.Fprintf(w, "Authentication successful! Please close this window")
+			notifier.Publish(events...)
+
+			var params = map[string]any{}
+			if created != nil {
+				notifier.Publish(notifier.Event{Kind: notifier.MachineCreated, Tailnet: created.TailnetID, Machine: created.ID})
+				params["welcome"] = tailnet.Welcome.Message // new devices are greeted with the tailnet's welcome message
+			}
+
+			if err = tpl.ExecuteTemplate(w, "success.html", params); err != nil {
+				log.Error().Err(err).Msg("failed to render template")
+			}
 		}
 	}
 }
 
-func validateState(r *http.Request, param string) (_ bool, err error) {
-	var queryStr = r.URL.Query().Get(param)
+// deny records a denied login in the audit log, and fails the registration request so that the
+// client, following up on the request, is shown the reason as well.
+func deny(r *http.Request, conn *sqlite.Conn, rr *domain.RegistrationRequest, claims domain.UserClaims, reason error) {
+	log := zerolog.Ctx(r.Context())
+	log.Warn().Err(reason).Str("sub", claims.Subject).Str("flow", rr.ID).Msg("login denied")
+
+	event := &domain.AuditEvent{
+		Action:     domain.ActionLoginDenied,
+		Actor:      claims.Subject,
+		Target:     rr.ID,
+		ClientAddr: rr.ClientAddr,
+		Location:   rr.Location,
+		Data:       map[string]string{"email": claims.Email, "reason": reason.Error()},
+	}
 
-	var cookie *http.Cookie
-	if cookie, err = r.Cookie(param); err != nil {
-		return false, err
+	if _, err := database.Exec(conn, domain.RecordEvent(event)); err != nil {
+		log.Error().Err(err).Msg("failed to record audit event")
 	}
 
-	return queryStr == cookie.Value, nil
+	rr.Authenticated, rr.Error = false, reason.Error()
+	if _, err := database.Exec(conn, domain.SaveRegistrationRequest(rr)); err != nil {
+		log.Error().Err(err).Msg("failed to save registration request")
+	}
 }
 
-func createMachine(conn *sqlite.Conn, user *domain.User, tailnet *domain.Tailnet, req *domain.RegistrationRequest) (_ *domain.Machine, err error) {
-	var machine = &domain.Machine{
-		NoiseKey: req.NoiseKey,
-		NodeKey:  req.Data.NodeKey,
+// createPersonalTailnet creates a new tailnet, named after the user's login, and adds the user to it as its owner.
+// If the name is taken, the user's id is appended to it to keep it unique.
+func createPersonalTailnet(conn *sqlite.Conn, user *domain.User, rr *domain.RegistrationRequest) (tailnet *domain.Tailnet, err error) {
+	var login = user.Claims.Email
+	if login == "" {
+		login = user.Subject
+	}
 
-		HostInfo:  req.Data.Hostinfo,
-		Ephemeral: req.Data.Ephemeral,
+	var name = domain.SanitizeTailnetName(login)
+	err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+		if tailnet, err = database.FetchOne(conn, domain.CreateTailnet(name)); err != nil {
+			var se sqlite.Error
+			if !errors.As(err, &se) || se.Code != sqlite.SQLITE_CONSTRAINT_UNIQUE {
+				return err
+			}
 
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(180 * 24 * time.Hour), // expires after 180 days
+			if tailnet, err = database.FetchOne(conn, domain.CreateTailnet(fmt.Sprintf("%s-%d", name, user.ID))); err != nil {
+				return err
+			}
+		}
 
-		TailnetID: tailnet.ID,
-		Tailnet:   tailnet,
-		UserID:    user.ID,
-		Owner:     user,
-	}
+		if _, err = database.FetchOne(conn, domain.SaveMember(int64(tailnet.ID), user, domain.RoleOwner)); err != nil {
+			return err
+		}
 
-	// TODO(@riyaz): verify data.Hostinfo.RequestTags to ensure user has required permissions to apply those tags
+		tailnet.Role = domain.RoleOwner
 
-	// sanitize host name and assign name index if required
-	sanitizeHostname := dnsname.SanitizeHostname(req.Data.Hostinfo.Hostname)
+		var events = []*domain.AuditEvent{
+			{Action: domain.ActionTailnetCreated, Actor: user.Subject, Target: tailnet.Name, TailnetID: util.ToPtr(tailnet.ID), ClientAddr: rr.ClientAddr, Location: rr.Location, Data: map[string]string{"reason": "personal_tailnet"}},
+			{Action: domain.ActionMemberAdded, Actor: user.Subject, Target: user.Subject, TailnetID: util.ToPtr(tailnet.ID), Data: map[string]string{"role": domain.RoleOwner}},
+		}
 
-	machine.Name = sanitizeHostname
-	machine.NameIdx = 0 // first machine with the given name has name_idx = 0
+		_, err = database.Exec(conn, domain.RecordEvent(events...))
+		return err
+	})
 
-	if ni, err := database.FetchOne[int](conn, domain.GetNextNameIndex(tailnet, sanitizeHostname)); err != nil {
-		return nil, err
-	} else if ni != nil {
-		machine.NameIdx = *ni
-	}
+	return tailnet, err
+}
 
-	predicate := func(ip netip.Addr) (bool, error) {
-		exists, _ := database.FetchOne(conn, domain.CheckIpInTailnet(ip, tailnet))
-		return *exists == false, nil
-	}
+// findOrCreateUser returns the user identified by the claims, creating one if needed. A placeholder user,
+// added as a tailnet member before they ever logged in, is adopted by the first provider the user logs in with.
+//
+// It also reports whether the user's claims were changed by the ones in the token (eg. the user's name was changed
+// at the provider), which is always the case for a new, or an adopted placeholder, user.
+func findOrCreateUser(conn *sqlite.Conn, claims domain.UserClaims) (user *domain.User, changed bool, err error) {
+	err = database.Tx(conn, func(conn *sqlite.Conn) (err error) {
+		var existing *domain.User
+		if existing, err = database.FetchOne(conn, domain.UserByIdentity(claims.Issuer, claims.Subject)); err != nil {
+			return err
+		}
 
-	// assign ip address to the node
-	if machine.IPv4, _, err = ipam.SelectIP(predicate); err != nil {
-		return nil, err
-	}
+		if _, err = database.Exec(conn, domain.ClaimPlaceholderUser(claims)); err != nil {
+			return err
+		}
+
+		if user, err = database.FetchOne(conn, domain.FindOrCreateUser(claims)); err != nil {
+			return err
+		}
+
+		changed = existing == nil || !reflect.DeepEqual(existing.Claims, user.Claims)
+		return nil
+	})
+
+	return user, changed, err
+}
+
+func validateState(r *http.Request, param string) (_ bool, err error) {
+	var queryStr = r.URL.Query().Get(param)
 
-	if m, err := database.Exec(conn, domain.SaveMachine(machine)); err != nil {
-		return nil, err
-	} else {
-		return m[0], nil
+	var cookie *http.Cookie
+	if cookie, err = r.Cookie(param); err != nil {
+		return false, err
 	}
+
+	return queryStr == cookie.Value, nil
 }
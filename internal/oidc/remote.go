@@ -2,38 +2,96 @@ package oidc
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/coreos/go-oidc/v3/oidc"
 	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/domain"
 	"github.com/riyaz-ali/wirefire/internal/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
+	"html/template"
+	"net/http"
+	"net/url"
+	"slices"
 )
 
-// RemoteService encapsulates oauth2 and oidc exchanger and verifier.
+// tracer starts the spans of calls made to the identity providers; see package tracing
+var tracer = otel.Tracer("github.com/riyaz-ali/wirefire/internal/oidc")
+
+// RemoteService encapsulates oauth2 and oidc exchanger and verifier of a single provider.
 type RemoteService struct {
+	name, displayName string
+
 	provider *oidc.Provider
 	config   *oauth2.Config
+
+	extraClaims  []string          // non-standard claims copied into domain.UserClaims
+	claimMapping map[string]string // standard claims read from the provider's (non-standard) claims
 }
 
-func NewRemoteService(ctx context.Context, cfg *Config) *RemoteService {
-	provider := util.Must(oidc.NewProvider(ctx, cfg.Provider))
+func NewRemoteService(ctx context.Context, pc ProviderConfig, base *url.URL) *RemoteService {
+	provider := util.Must(oidc.NewProvider(ctx, pc.Issuer))
+
+	var scopes = slices.Clone(pc.Scopes)
+	if !slices.Contains(scopes, oidc.ScopeOpenID) {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+
+	var displayName = pc.DisplayName
+	if displayName == "" {
+		displayName = pc.Name
+	}
 
 	return &RemoteService{
-		provider: provider,
+		name:        pc.Name,
+		displayName: displayName,
+		provider:    provider,
 		config: &oauth2.Config{
-			ClientID:     cfg.ClientID,
-			ClientSecret: cfg.ClientSecret,
-			RedirectURL:  cfg.BaseUrl.JoinPath("/oidc/callback").String(),
+			ClientID:     pc.ClientID,
+			ClientSecret: pc.ClientSecret,
+			RedirectURL:  base.JoinPath("/oidc/callback").String(),
 			Endpoint:     provider.Endpoint(),
-			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+			Scopes:       scopes,
 		},
+		extraClaims:  pc.ExtraClaims,
+		claimMapping: pc.ClaimMapping,
 	}
 }
 
+// Name returns the name of the provider, as configured
+func (a *RemoteService) Name() string { return a.name }
+
+// WithRedirect returns a copy of the service that redirects the user back to the given url once authenticated.
+func (a *RemoteService) WithRedirect(u *url.URL) *RemoteService {
+	var c = *a.config
+	c.RedirectURL = u.String()
+
+	var s = *a
+	s.config = &c
+	return &s
+}
+
 func (a *RemoteService) AuthCodeURL(state string, options ...oauth2.AuthCodeOption) string {
+	if slices.Contains(a.config.Scopes, oidc.ScopeOfflineAccess) {
+		options = append(options, oauth2.SetAuthURLParam("prompt", "consent"))
+	}
+
 	return a.config.AuthCodeURL(state, options...)
 }
 
 func (a *RemoteService) Exchange(ctx context.Context, code string) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "oidc.exchange", trace.WithAttributes(attribute.String("oidc.provider", a.Name())))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	var token *oauth2.Token
 	if token, err = a.config.Exchange(ctx, code); err != nil {
 		return "", err
@@ -48,6 +106,119 @@ func (a *RemoteService) Exchange(ctx context.Context, code string) (_ string, er
 }
 
 func (a *RemoteService) Verify(ctx context.Context, token string) (_ *oidc.IDToken, err error) {
+	ctx, span := tracer.Start(ctx, "oidc.verify")
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	var verifier = a.provider.Verifier(&oidc.Config{ClientID: a.config.ClientID})
 	return verifier.Verify(ctx, token)
 }
+
+// Claims extracts the standard claims, along with any configured extra claims, from the verified token.
+// Standard claims the provider reports under a different name are read as per the provider's claim mapping.
+func (a *RemoteService) Claims(token *oidc.IDToken) (claims domain.UserClaims, err error) {
+	if len(a.extraClaims) == 0 && len(a.claimMapping) == 0 {
+		err = token.Claims(&claims)
+		return claims, err
+	}
+
+	var all map[string]json.RawMessage
+	if err = token.Claims(&all); err != nil {
+		return claims, err
+	}
+
+	var std = make(map[string]json.RawMessage, len(all))
+	for name, value := range all {
+		std[name] = value
+	}
+
+	for claim, from := range a.claimMapping {
+		if value, ok := all[from]; ok {
+			std[claim] = value
+		} else {
+			delete(std, claim)
+		}
+	}
+
+	var buf []byte
+	if buf, err = json.Marshal(std); err != nil {
+		return claims, err
+	}
+
+	if err = json.Unmarshal(buf, &claims); err != nil {
+		return claims, err
+	}
+
+	for _, name := range a.extraClaims {
+		if value, ok := all[name]; ok {
+			if claims.Extra == nil {
+				claims.Extra = make(map[string]json.RawMessage)
+			}
+			claims.Extra[name] = value
+		}
+	}
+
+	return claims, nil
+}
+
+// Providers is the set of configured providers users can login with, in the order they were configured
+type Providers struct{ list []*RemoteService }
+
+// NewProviders returns the RemoteService of all the providers in the configuration
+func NewProviders(ctx context.Context, cfg *Config) *Providers {
+	var providers = &Providers{}
+	for _, pc := range util.Must(cfg.ProviderConfigs()) {
+		providers.list = append(providers.list, NewRemoteService(ctx, pc, cfg.BaseUrl))
+	}
+
+	return providers
+}
+
+// Get returns the named provider, or nil if there's no such provider. An empty name
+// returns the only provider, if just one is configured.
+func (p *Providers) Get(name string) *RemoteService {
+	if name == "" && len(p.list) == 1 {
+		return p.list[0]
+	}
+
+	for _, rs := range p.list {
+		if rs.name == name {
+			return rs
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of configured providers
+func (p *Providers) Len() int { return len(p.list) }
+
+// WithRedirect returns a copy of the providers that redirect the user back to the given url once authenticated.
+func (p *Providers) WithRedirect(u *url.URL) *Providers {
+	var providers = &Providers{}
+	for _, rs := range p.list {
+		providers.list = append(providers.list, rs.WithRedirect(u))
+	}
+
+	return providers
+}
+
+// Picker renders a page that lets the user pick the provider to login with. link returns
+// the url that starts the login flow with the named provider.
+func (p *Providers) Picker(w http.ResponseWriter, link func(name string) string) error {
+	var tpl = template.Must(template.ParseFS(templates, "templates/providers.html"))
+
+	type option struct{ Name, URL string }
+
+	var options = make([]option, 0, len(p.list))
+	for _, rs := range p.list {
+		options = append(options, option{Name: rs.displayName, URL: link(rs.name)})
+	}
+
+	return tpl.ExecuteTemplate(w, "providers.html", map[string]any{"providers": options})
+}
@@ -0,0 +1,189 @@
+package oidc
+
+import (
+	"context"
+	"crawshaw.io/sqlite/sqlitex"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-chi/chi/v5"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/rs/zerolog"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// SSHHandler returns a new http.Handler that serves the browser-based re-authentication of users, as required by ssh rules
+// with the check action (see: domain.SSHCheck). It must be mounted at /ssh/action. As with the admin console, providers
+// redirect users back to a dedicated callback (/ssh/action/callback), which must be allowed by the provider.
+func SSHHandler(ctx context.Context, pool *sqlitex.Pool) http.Handler {
+	cfg := config.MustValidate(config.Read[Config]())
+	ps := NewProviders(ctx, cfg).WithRedirect(cfg.BaseUrl.JoinPath("/ssh/action/callback"))
+
+	r := chi.NewRouter()
+	r.Use(NewAccessLog())
+	r.Method(http.MethodGet, "/callback", SSHCheckComplete(cfg, ps, pool))
+	r.Method(http.MethodGet, "/{check}", SSHCheckStart(cfg, ps, pool))
+
+	return r
+}
+
+// SSHCheckStart serves the GET /ssh/action/{check} endpoint, which users are asked to visit by the client holding their
+// ssh connection, and starts the OIDC authentication flow with the provider named by the provider parameter.
+func SSHCheckStart(cfg *Config, ps *Providers, pool *sqlitex.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id, name = chi.URLParam(r, "check"), r.URL.Query().Get("provider")
+
+		conn := pool.Get(r.Context())
+		defer pool.Put(conn)
+
+		if check, err := database.FetchOne(conn, domain.SSHCheckById(id)); err != nil || check == nil {
+			http.Error(w, "invalid check", http.StatusNotFound)
+			return
+		} else if check.AuthenticatedAt != nil {
+			http.Error(w, "this check has already been completed", http.StatusConflict)
+			return
+		}
+
+		if name == "" && ps.Len() > 1 {
+			err := ps.Picker(w, func(name string) string {
+				return "/ssh/action/" + url.PathEscape(id) + "?" + url.Values{"provider": {name}}.Encode()
+			})
+
+			if err != nil {
+				zerolog.Ctx(r.Context()).Error().Err(err).Msg("failed to render template")
+			}
+
+			return
+		}
+
+		var rs = ps.Get(name)
+		if rs == nil {
+			http.Error(w, "unknown provider", http.StatusBadRequest)
+			return
+		}
+
+		var buf = make([]byte, 24)
+		_, _ = rand.Read(buf)
+
+		var state, secure = base64.RawURLEncoding.EncodeToString(buf), cfg.BaseUrl.Scheme == "https"
+		http.SetCookie(w, &http.Cookie{Name: "ssh_state", Value: state, Path: "/ssh/action", Secure: secure, HttpOnly: true})
+		http.SetCookie(w, &http.Cookie{Name: "ssh_check", Value: id, Path: "/ssh/action", Secure: secure, HttpOnly: true})
+		http.SetCookie(w, &http.Cookie{Name: "ssh_provider", Value: rs.Name(), Path: "/ssh/action", Secure: secure, HttpOnly: true})
+		http.Redirect(w, r, rs.AuthCodeURL(state), http.StatusFound)
+	}
+}
+
+// SSHCheckComplete serves the GET /ssh/action/callback endpoint. It completes the OIDC authentication flow and, if the
+// user is the one the check is held for, completes the check; the held connection is then accepted (see: coordinator.MachineSSHAction).
+func SSHCheckComplete(cfg *Config, ps *Providers, pool *sqlitex.Pool) http.HandlerFunc {
+	var tpl = template.Must(template.ParseFS(templates, "templates/*.html"))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		ctx, log := r.Context(), zerolog.Ctx(r.Context())
+
+		if cookie, err := r.Cookie("ssh_state"); err != nil || cookie.Value != r.URL.Query().Get("state") {
+			http.Error(w, "invalid state", http.StatusBadRequest)
+
+			return
+		}
+
+		var id string
+		if cookie, err := r.Cookie("ssh_check"); err == nil {
+			id = cookie.Value
+		}
+
+		var rs *RemoteService
+		if cookie, err := r.Cookie("ssh_provider"); err == nil {
+			rs = ps.Get(cookie.Value)
+		}
+
+		if rs == nil {
+			http.Error(w, "unknown provider", http.StatusBadRequest)
+
+			return
+		}
+
+		var raw string
+		if raw, err = rs.Exchange(ctx, r.URL.Query().Get("code")); err != nil {
+			log.Error().Err(err).Msg("failed to exchange code")
+			http.Error(w, "failed to exchange code", http.StatusBadRequest)
+
+			return
+		}
+
+		var token *oidc.IDToken
+		if token, err = rs.Verify(ctx, raw); err != nil {
+			log.Error().Err(err).Msg("failed to verify token")
+			http.Error(w, "failed to verify token", http.StatusBadRequest)
+
+			return
+		}
+
+		var claims domain.UserClaims
+		if claims, err = rs.Claims(token); err != nil {
+			http.Error(w, "failed to parse claims from token", http.StatusBadRequest)
+
+			return
+		}
+
+		var deny = func(reason string) {
+			log.Warn().Str("sub", claims.Subject).Str("check", id).Str("reason", reason).Msg("ssh check denied")
+
+			w.WriteHeader(http.StatusForbidden)
+			if err := tpl.ExecuteTemplate(w, "denied.html", map[string]any{"reason": reason}); err != nil {
+				log.Error().Err(err).Msg("failed to render template")
+			}
+		}
+
+		conn := pool.Get(ctx)
+		defer pool.Put(conn)
+
+		if err = CheckConditions(cfg, claims); err == nil {
+			err = CheckDisabled(conn, claims)
+		}
+
+		if err != nil {
+			deny(err.Error())
+			return
+		}
+
+		var user *domain.User
+		if user, err = database.FetchOne(conn, domain.UserByIdentity(token.Issuer, token.Subject)); err != nil {
+			http.Error(w, "failed to find user", http.StatusInternalServerError)
+
+			return
+		} else if user == nil {
+			deny("you are not the owner of the machine the connection is made from")
+			return
+		}
+
+		var check *domain.SSHCheck
+		if check, err = database.FetchOne(conn, domain.AuthenticateSSHCheck(id, user.ID)); err != nil {
+			http.Error(w, "failed to complete the check", http.StatusInternalServerError)
+
+			return
+		} else if check == nil {
+			deny("you are not the owner of the machine the connection is made from, or the check has already been completed")
+			return
+		}
+
+		event := &domain.AuditEvent{
+			Action: domain.ActionSSHCheckCompleted, Actor: user.Subject, Target: check.ID,
+			Data: map[string]string{"src": strconv.Itoa(check.SrcMachineID), "dst": strconv.Itoa(check.DstMachineID), "local_user": check.LocalUser},
+		}
+		if _, err = database.Exec(conn, domain.RecordEvent(event)); err != nil {
+			log.Error().Err(err).Msg("failed to record audit event")
+		}
+
+		log.Info().Str("sub", user.Subject).Str("check", check.ID).Msg("ssh check completed")
+		if err = tpl.ExecuteTemplate(w, "success.html", map[string]any{}); err != nil {
+			log.Error().Err(err).Msg("failed to render template")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Package proxy resolves the address of the client that sent a request, for deployments where wirefire is fronted by
+// one or more reverse proxies (eg. a load balancer terminating tls).
+//
+// Forwarding headers (X-Forwarded-For and X-Real-IP) are only honoured for requests received from a proxy configured
+// under http.trusted_proxies, eg.
+//
+//	http:
+//	  trusted_proxies: [ "10.0.0.0/8", "192.0.2.1" ]
+//
+// Requests from any other address are attributed to the address they were received from, so that clients can't spoof
+// their address (and with it, the location recorded for them or the allowlists they're checked against) by sending the
+// headers themselves.
+package proxy
+
+import (
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/spf13/viper"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+func init() {
+	config.RegisterPrefix("http.trusted_proxies")
+}
+
+// Trusted is the set of reverse proxies whose forwarding headers are trusted. A nil *Trusted trusts no proxy.
+type Trusted struct {
+	prefixes []netip.Prefix
+}
+
+// Read returns the trusted proxies configured under http.trusted_proxies, as addresses or prefixes
+func Read() (_ *Trusted, err error) {
+	var t Trusted
+	for _, s := range viper.GetStringSlice("http.trusted_proxies") {
+		var prefix netip.Prefix
+		if strings.Contains(s, "/") {
+			prefix, err = netip.ParsePrefix(s)
+		} else if addr, e := netip.ParseAddr(s); e == nil {
+			prefix, err = addr.Prefix(addr.BitLen())
+		} else {
+			err = e
+		}
+
+		if err != nil {
+			return nil, errors.Wrapf(err, "proxy: invalid trusted proxy %q", s)
+		}
+
+		t.prefixes = append(t.prefixes, prefix.Masked())
+	}
+
+	return &t, nil
+}
+
+// trusts returns true if addr is the address of a trusted proxy
+func (t *Trusted) trusts(addr netip.Addr) bool {
+	return t != nil && slices.ContainsFunc(t.prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
+
+// ClientAddr returns the address of the client that sent the request; the zero netip.Addr if it can't be determined.
+//
+// If the request was received from a trusted proxy, the X-Forwarded-For header is walked from the nearest hop backwards,
+// and the first address that isn't a trusted proxy is returned, as hops before it could've been made up by the client.
+// X-Real-IP is used if the proxy didn't send X-Forwarded-For.
+func (t *Trusted) ClientAddr(r *http.Request) netip.Addr {
+	ap, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+
+	var addr = ap.Addr().Unmap()
+	if !t.trusts(addr) {
+		return addr
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		var hops = strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := parse(hops[i])
+			if !ok {
+				break // malformed hop; the last (trusted) address is the best we can vouch for
+			}
+
+			if addr = hop; !t.trusts(addr) {
+				break
+			}
+		}
+
+		return addr
+	}
+
+	if hop, ok := parse(r.Header.Get("X-Real-IP")); ok {
+		return hop
+	}
+
+	return addr
+}
+
+// parse parses a forwarded address, which some proxies send along with the client's port
+func parse(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return addr.Unmap(), true
+	}
+
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+
+	return netip.Addr{}, false
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"github.com/spf13/viper"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestTrusted_ClientAddr(t *testing.T) {
+	viper.Set("http.trusted_proxies", []string{"10.0.0.0/8", "192.0.2.1"})
+	t.Cleanup(viper.Reset)
+
+	proxies, err := Read()
+	if err != nil {
+		t.Fatalf("failed to read trusted proxies: %v", err)
+	}
+
+	var cases = []struct {
+		name      string
+		remote    string
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{"Direct", "198.51.100.7:41641", nil, "", "198.51.100.7"},
+		{"DirectMapped", "[::ffff:198.51.100.7]:41641", nil, "", "198.51.100.7"},
+		{"SpoofedForwardedFor", "198.51.100.7:41641", []string{"203.0.113.9"}, "", "198.51.100.7"},
+		{"SpoofedRealIP", "198.51.100.7:41641", nil, "203.0.113.9", "198.51.100.7"},
+		{"TrustedProxy", "10.1.2.3:41641", []string{"203.0.113.9"}, "", "203.0.113.9"},
+		{"TrustedProxyAddr", "192.0.2.1:41641", []string{"203.0.113.9"}, "", "203.0.113.9"},
+		{"TrustedChain", "10.1.2.3:41641", []string{"203.0.113.9, 10.4.5.6"}, "", "203.0.113.9"},
+		{"TrustedChainAcrossHeaders", "10.1.2.3:41641", []string{"203.0.113.9", "10.4.5.6"}, "", "203.0.113.9"},
+		{"ClientPrependedHops", "10.1.2.3:41641", []string{"192.0.2.200, 203.0.113.9"}, "", "203.0.113.9"},
+		{"ForwardedWithPort", "10.1.2.3:41641", []string{"[2001:db8::1]:5555"}, "", "2001:db8::1"},
+		{"MalformedHop", "10.1.2.3:41641", []string{"not-an-ip, 10.4.5.6"}, "", "10.4.5.6"},
+		{"OnlyProxies", "10.1.2.3:41641", []string{"10.4.5.6"}, "", "10.4.5.6"},
+		{"RealIP", "10.1.2.3:41641", nil, "203.0.113.9", "203.0.113.9"},
+		{"ForwardedForOverRealIP", "10.1.2.3:41641", []string{"203.0.113.9"}, "203.0.113.10", "203.0.113.9"},
+		{"NoHeaders", "10.1.2.3:41641", nil, "", "10.1.2.3"},
+		{"InvalidRemote", "pipe", nil, "", "invalid IP"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var r = httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remote
+			for _, v := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tc.realIP != "" {
+				r.Header.Set("X-Real-IP", tc.realIP)
+			}
+
+			if got := proxies.ClientAddr(r); got.String() != tc.want {
+				t.Errorf("expected client address %s; got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestTrusted_Nil(t *testing.T) {
+	var r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.1.2.3:41641"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+
+	var proxies *Trusted
+	if got := proxies.ClientAddr(r); got != netip.MustParseAddr("10.1.2.3") {
+		t.Errorf("expected forwarding headers to be ignored; got %s", got)
+	}
+}
+
+func TestRead(t *testing.T) {
+	viper.Set("http.trusted_proxies", []string{"not-an-ip"})
+	t.Cleanup(viper.Reset)
+
+	if _, err := Read(); err == nil {
+		t.Errorf("expected invalid trusted proxy to be rejected")
+	}
+}
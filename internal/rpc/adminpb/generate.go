@@ -0,0 +1,4 @@
+// Package adminpb contains the protobuf messages and grpc bindings of wirefire's admin service, generated from admin.proto
+package adminpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
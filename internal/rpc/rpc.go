@@ -0,0 +1,225 @@
+// Package rpc implements the grpc admin service (see: adminpb), which publishes the admin api's management operations
+// to infrastructure tooling with typed clients. Calls are served by the admin api's own handlers, so that both share the
+// same validation, audit trail and notifications.
+//
+// The service listens on its own address, as grpc requires http/2, eg.
+//
+//	grpc:
+//	  listen_addr: ":50051"
+//
+// and is authenticated using the admin api's token.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crawshaw.io/sqlite/sqlitex"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/api"
+	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/rpc/adminpb"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Config is the subset of configuration relevant to the grpc admin service
+type Config struct {
+	// Addr is the tcp address the service listens on. The service is disabled if empty.
+	Addr string `viper:"grpc.listen_addr"`
+}
+
+func init() {
+	config.Register[Config]()
+}
+
+// Run serves the admin service until the context is cancelled, after which in-flight calls are allowed to finish, and
+// watch streams are ended. It blocks and must be run in a goroutine. It returns right away if the service is disabled.
+func Run(ctx context.Context, pool *sqlitex.Pool) error {
+	log := zerolog.Ctx(ctx).With().Str("component", "rpc").Logger()
+
+	var cfg = config.Read[Config]()
+	if cfg.Addr == "" {
+		return nil
+	}
+
+	lis, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "rpc: failed to listen on %s", cfg.Addr)
+	}
+
+	var srv = newServer(ctx, pool, config.Read[api.Config]().Token)
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+
+	log.Info().Str("addr", cfg.Addr).Msg("starting grpc server")
+	return srv.Serve(lis)
+}
+
+// newServer returns a new grpc server serving the admin service, authenticated using token, until the context is cancelled
+func newServer(ctx context.Context, pool *sqlitex.Pool, token string) *grpc.Server {
+	log := zerolog.Ctx(ctx).With().Str("component", "rpc").Logger()
+
+	var auth = &authenticator{token: token, log: &log}
+	var srv = grpc.NewServer(grpc.UnaryInterceptor(auth.unary), grpc.StreamInterceptor(auth.stream))
+	adminpb.RegisterAdminServer(srv, &server{pool: pool, done: ctx.Done()})
+
+	return srv
+}
+
+// authenticator authenticates calls using the admin api's static bearer token, as api.Authenticate does for http requests
+type authenticator struct {
+	token string
+	log   *zerolog.Logger
+}
+
+// authenticate returns the context the call is served with; one that carries the owner role granted by the token
+func (a *authenticator) authenticate(ctx context.Context) (context.Context, error) {
+	if a.token == "" {
+		return nil, status.Error(codes.PermissionDenied, "admin api is disabled")
+	}
+
+	var bearer, ok = "", false
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		bearer, ok = strings.CutPrefix(values[0], "Bearer ")
+	}
+
+	if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(a.token)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "unauthorized")
+	}
+
+	return api.WithRole(a.log.WithContext(ctx), domain.RoleOwner), nil
+}
+
+func (a *authenticator) unary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (_ any, err error) {
+	defer func() { a.log.Info().Str("method", info.FullMethod).Stringer("code", status.Code(err)).Send() }()
+
+	if ctx, err = a.authenticate(ctx); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (a *authenticator) stream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() { a.log.Info().Str("method", info.FullMethod).Stringer("code", status.Code(err)).Send() }()
+
+	var ctx context.Context
+	if ctx, err = a.authenticate(ss.Context()); err != nil {
+		return err
+	}
+
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// serverStream is a grpc.ServerStream served with the authenticated context
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context { return s.ctx }
+
+// statusCodes maps the status codes returned by the admin api's handlers to grpc codes
+var statusCodes = map[int]codes.Code{
+	http.StatusBadRequest:   codes.InvalidArgument,
+	http.StatusUnauthorized: codes.Unauthenticated,
+	http.StatusForbidden:    codes.PermissionDenied,
+	http.StatusNotFound:     codes.NotFound,
+	http.StatusConflict:     codes.AlreadyExists,
+}
+
+// call serves the call using the admin api's handler, as if it was made over http with the given url parameters, query
+// and request body (encoded as json, using its field names). It returns the handler's result, and the cursor of the next
+// page of results if the handler is a list endpoint's.
+func call(ctx context.Context, handler api.HandlerFunc, params map[string]string, query url.Values, body proto.Message) (_ any, next string, err error) {
+	var reader io.Reader = http.NoBody
+	if body != nil {
+		var buf []byte
+		if buf, err = (protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}).Marshal(body); err != nil {
+			return nil, "", err
+		}
+		reader = bytes.NewReader(buf)
+	}
+
+	var rc = chi.NewRouteContext()
+	for k, v := range params {
+		rc.URLParams.Add(k, v)
+	}
+
+	var r *http.Request
+	if r, err = http.NewRequestWithContext(context.WithValue(ctx, chi.RouteCtxKey, rc), http.MethodPost, "/?"+query.Encode(), reader); err != nil {
+		return nil, "", err
+	}
+
+	var out any
+	if out, err = handler(r); err != nil {
+		var ae *api.Error
+		if errors.As(err, &ae) {
+			if code, ok := statusCodes[ae.Status]; ok {
+				return nil, "", status.Error(code, ae.Message)
+			}
+		}
+
+		zerolog.Ctx(ctx).Error().Err(err).Send()
+		return nil, "", status.Error(codes.Internal, "internal server error")
+	}
+
+	if page, ok := out.(*api.Page); ok {
+		return page.Items, page.Next, nil
+	}
+
+	return out, "", nil
+}
+
+// decode decodes the handler's result into the message, whose fields are named after those of the result's json encoding
+func decode(v any, m proto.Message) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(buf, m)
+}
+
+// listing returns the admin api's list query for the options
+func listing(l *adminpb.Listing) url.Values {
+	var query = url.Values{}
+	if l == nil {
+		return query
+	}
+
+	for _, f := range l.Filter {
+		query.Add("filter", f)
+	}
+
+	if l.Sort != "" {
+		query.Set("sort", l.Sort)
+	}
+
+	if l.PageSize > 0 {
+		query.Set("limit", strconv.Itoa(int(l.PageSize)))
+	}
+
+	if l.PageToken != "" {
+		query.Set("cursor", l.PageToken)
+	}
+
+	return query
+}
@@ -0,0 +1,225 @@
+package rpc
+
+import (
+	"context"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/riyaz-ali/wirefire/internal/api"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
+	"github.com/riyaz-ali/wirefire/internal/rpc/adminpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"strconv"
+)
+
+// server implements adminpb.AdminServer using the admin api's handlers; see call
+type server struct {
+	adminpb.UnimplementedAdminServer
+
+	pool *sqlitex.Pool
+	done <-chan struct{} // closed when the server shuts down, which ends watch streams
+}
+
+// tailnet returns the url parameters identifying the tailnet
+func tailnet(id int64) map[string]string {
+	return map[string]string{"tailnet": strconv.FormatInt(id, 10)}
+}
+
+// machine returns the url parameters identifying the machine in the tailnet
+func machine(tid, mid int64) map[string]string {
+	return map[string]string{"tailnet": strconv.FormatInt(tid, 10), "machine": strconv.FormatInt(mid, 10)}
+}
+
+// member returns the url parameters identifying the user in the tailnet
+func member(tid, uid int64) map[string]string {
+	return map[string]string{"tailnet": strconv.FormatInt(tid, 10), "user": strconv.FormatInt(uid, 10)}
+}
+
+// unary serves a call that returns a single message of type T, using the admin api's handler
+func unary[T any, M interface {
+	*T
+	proto.Message
+}](ctx context.Context, handler api.HandlerFunc, params map[string]string, body proto.Message) (M, error) {
+	out, _, err := call(ctx, handler, params, nil, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var m M = new(T)
+	if err = decode(out, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// empty serves a call that returns no message, using the admin api's handler
+func empty(ctx context.Context, handler api.HandlerFunc, params map[string]string, body proto.Message) (*emptypb.Empty, error) {
+	if _, _, err := call(ctx, handler, params, nil, body); err != nil {
+		return nil, err
+	}
+
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) ListTailnets(ctx context.Context, _ *adminpb.ListTailnetsRequest) (*adminpb.ListTailnetsResponse, error) {
+	out, _, err := call(ctx, api.ListTailnets(s.pool), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp = &adminpb.ListTailnetsResponse{}
+	return resp, decode(map[string]any{"tailnets": out}, resp)
+}
+
+func (s *server) GetTailnet(ctx context.Context, req *adminpb.GetTailnetRequest) (*adminpb.Tailnet, error) {
+	return unary[adminpb.Tailnet](ctx, api.GetTailnet(s.pool), tailnet(req.TailnetId), nil)
+}
+
+func (s *server) CreateTailnet(ctx context.Context, req *adminpb.CreateTailnetRequest) (*adminpb.Tailnet, error) {
+	return unary[adminpb.Tailnet](ctx, api.CreateTailnet(s.pool), nil, req)
+}
+
+func (s *server) DeleteTailnet(ctx context.Context, req *adminpb.DeleteTailnetRequest) (*emptypb.Empty, error) {
+	return empty(ctx, api.DeleteTailnet(s.pool), tailnet(req.TailnetId), nil)
+}
+
+func (s *server) ListMachines(ctx context.Context, req *adminpb.ListMachinesRequest) (*adminpb.ListMachinesResponse, error) {
+	out, next, err := call(ctx, api.ListMachines(s.pool), tailnet(req.TailnetId), listing(req.Listing), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp = &adminpb.ListMachinesResponse{}
+	return resp, decode(map[string]any{"machines": out, "next_page_token": next}, resp)
+}
+
+func (s *server) GetMachine(ctx context.Context, req *adminpb.GetMachineRequest) (*adminpb.Machine, error) {
+	return unary[adminpb.Machine](ctx, api.GetMachine(s.pool), machine(req.TailnetId, req.MachineId), nil)
+}
+
+func (s *server) RenameMachine(ctx context.Context, req *adminpb.RenameMachineRequest) (*adminpb.Machine, error) {
+	return unary[adminpb.Machine](ctx, api.UpdateMachine(s.pool), machine(req.TailnetId, req.MachineId), req)
+}
+
+func (s *server) AuthorizeMachine(ctx context.Context, req *adminpb.AuthorizeMachineRequest) (*adminpb.Machine, error) {
+	return unary[adminpb.Machine](ctx, api.AuthorizeMachine(s.pool), machine(req.TailnetId, req.MachineId), req)
+}
+
+func (s *server) ExpireMachine(ctx context.Context, req *adminpb.ExpireMachineRequest) (*adminpb.Machine, error) {
+	return unary[adminpb.Machine](ctx, api.ExpireMachine(s.pool), machine(req.TailnetId, req.MachineId), nil)
+}
+
+func (s *server) RenewMachine(ctx context.Context, req *adminpb.RenewMachineRequest) (*adminpb.Machine, error) {
+	return unary[adminpb.Machine](ctx, api.RenewMachine(s.pool), machine(req.TailnetId, req.MachineId), req)
+}
+
+func (s *server) DeleteMachine(ctx context.Context, req *adminpb.DeleteMachineRequest) (*emptypb.Empty, error) {
+	return empty(ctx, api.DeleteMachine(s.pool), machine(req.TailnetId, req.MachineId), nil)
+}
+
+// watchKinds are the kinds of the machine events sent by WatchMachines, by notifier.Kind
+var watchKinds = map[notifier.Kind]adminpb.MachineEvent_Kind{
+	notifier.MachineCreated: adminpb.MachineEvent_CREATED,
+	notifier.MachineUpdated: adminpb.MachineEvent_UPDATED,
+	notifier.MachineDeleted: adminpb.MachineEvent_DELETED,
+	notifier.MachineRevoked: adminpb.MachineEvent_REVOKED,
+	notifier.MachineOnline:  adminpb.MachineEvent_ONLINE,
+	notifier.MachineOffline: adminpb.MachineEvent_OFFLINE,
+}
+
+// WatchMachines streams the changes to the tailnet's machines, as api.WatchMachines does over server-sent events
+func (s *server) WatchMachines(req *adminpb.WatchMachinesRequest, stream grpc.ServerStreamingServer[adminpb.MachineEvent]) (err error) {
+	var ctx = stream.Context()
+	if _, _, err = call(ctx, api.GetTailnet(s.pool), tailnet(req.TailnetId), nil, nil); err != nil {
+		return err
+	}
+
+	events, unsubscribe := notifier.Subscribe(int(req.TailnetId))
+	defer unsubscribe()
+
+	// headers are sent once subscribed, so that clients know they won't miss any event from then on
+	if err = stream.SendHeader(nil); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case e := <-events:
+			var kind, ok = watchKinds[e.Kind]
+			if !ok || e.Machine == 0 {
+				continue
+			}
+
+			var event = &adminpb.MachineEvent{Kind: kind, MachineId: int64(e.Machine)}
+			if e.Kind != notifier.MachineDeleted {
+				if event.Machine, err = s.GetMachine(ctx, &adminpb.GetMachineRequest{TailnetId: req.TailnetId, MachineId: int64(e.Machine)}); status.Code(err) == codes.NotFound {
+					continue // deleted since the event was published
+				} else if err != nil {
+					return err
+				}
+			}
+
+			if err = stream.Send(event); err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return nil
+
+		case <-s.done:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
+
+func (s *server) ListMembers(ctx context.Context, req *adminpb.ListMembersRequest) (*adminpb.ListMembersResponse, error) {
+	out, next, err := call(ctx, api.ListMembers(s.pool), tailnet(req.TailnetId), listing(req.Listing), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp = &adminpb.ListMembersResponse{}
+	return resp, decode(map[string]any{"members": out, "next_page_token": next}, resp)
+}
+
+func (s *server) AddMember(ctx context.Context, req *adminpb.AddMemberRequest) (*adminpb.Member, error) {
+	return unary[adminpb.Member](ctx, api.AddMember(s.pool), tailnet(req.TailnetId), req)
+}
+
+func (s *server) UpdateMember(ctx context.Context, req *adminpb.UpdateMemberRequest) (*adminpb.Member, error) {
+	return unary[adminpb.Member](ctx, api.UpdateMember(s.pool), member(req.TailnetId, req.UserId), req)
+}
+
+func (s *server) RemoveMember(ctx context.Context, req *adminpb.RemoveMemberRequest) (*emptypb.Empty, error) {
+	return empty(ctx, api.RemoveMember(s.pool), member(req.TailnetId, req.UserId), nil)
+}
+
+func (s *server) RevokeUser(ctx context.Context, req *adminpb.RevokeUserRequest) (*adminpb.Revocation, error) {
+	return unary[adminpb.Revocation](ctx, api.RevokeUser(s.pool), map[string]string{"user": strconv.FormatInt(req.UserId, 10)}, req)
+}
+
+func (s *server) EnableUser(ctx context.Context, req *adminpb.EnableUserRequest) (*emptypb.Empty, error) {
+	return empty(ctx, api.EnableUser(s.pool), map[string]string{"user": strconv.FormatInt(req.UserId, 10)}, nil)
+}
+
+func (s *server) ListAuthKeys(ctx context.Context, req *adminpb.ListAuthKeysRequest) (*adminpb.ListAuthKeysResponse, error) {
+	out, _, err := call(ctx, api.ListAuthKeys(s.pool), tailnet(req.TailnetId), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp = &adminpb.ListAuthKeysResponse{}
+	return resp, decode(map[string]any{"auth_keys": out}, resp)
+}
+
+func (s *server) CreateAuthKey(ctx context.Context, req *adminpb.CreateAuthKeyRequest) (*adminpb.AuthKey, error) {
+	return unary[adminpb.AuthKey](ctx, api.CreateAuthKey(s.pool), tailnet(req.TailnetId), req)
+}
+
+func (s *server) RevokeAuthKey(ctx context.Context, req *adminpb.RevokeAuthKeyRequest) (*adminpb.AuthKey, error) {
+	var params = map[string]string{"tailnet": strconv.FormatInt(req.TailnetId, 10), "id": strconv.FormatInt(req.AuthKeyId, 10)}
+	return unary[adminpb.AuthKey](ctx, api.RevokeAuthKey(s.pool), params, nil)
+}
@@ -0,0 +1,269 @@
+// Package settings provides typed access to runtime-tunable values (intervals, feature flags, maintenance mode etc.)
+//
+// Settings are defined in code, by the subsystem that uses them, using Define. Each setting has a default value
+// which can be overridden at runtime (eg. via the admin api). Overridden values are persisted in the database and
+// subsystems can Watch settings to get notified when their value changes.
+package settings
+
+import (
+	"crawshaw.io/sqlite"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrUnknownSetting is returned when trying to modify a setting that isn't defined
+var ErrUnknownSetting = errors.New("settings: unknown setting")
+
+// InvalidValueError is returned by Set when the value doesn't decode to the setting's type, or fails its validation
+type InvalidValueError struct {
+	Name string // name of the setting
+	Err  error  // reason the value was rejected
+}
+
+func (e *InvalidValueError) Error() string {
+	return fmt.Sprintf("settings: invalid value for %q: %v", e.Name, e.Err)
+}
+
+func (e *InvalidValueError) Unwrap() error { return e.Err }
+
+// definition is the type-erased view of a Key used by the registry
+type definition interface {
+	name() string
+	description() string
+	defaultValue() any
+	validate(json.RawMessage) error
+}
+
+// Key is a typed handle to a setting with value of type T.
+type Key[T any] struct {
+	Name        string // unique, dot-separated name of the setting
+	Description string // short, human-readable description of the setting
+	Default     T      // value used when the setting isn't overridden
+}
+
+func (k *Key[T]) name() string        { return k.Name }
+func (k *Key[T]) description() string { return k.Description }
+func (k *Key[T]) defaultValue() any   { return k.Default }
+
+func (k *Key[T]) validate(raw json.RawMessage) error {
+	var v T
+	return json.Unmarshal(raw, &v)
+}
+
+// Get returns the current value of the setting, or its default value if the setting isn't overridden.
+func (k *Key[T]) Get() T {
+	if raw, ok := store.get(k.Name); ok {
+		var v T
+		if err := json.Unmarshal(raw, &v); err == nil {
+			return v
+		}
+	}
+
+	return k.Default
+}
+
+// Define defines a new setting with the given name and default value. Define must only be
+// called during package initialization, and it panics if a setting with the same name already exists.
+func Define[T any](name string, def T, description string) *Key[T] {
+	var key = &Key[T]{Name: name, Default: def, Description: description}
+
+	if _, exists := registry[name]; exists {
+		panic(errors.Errorf("settings: %q defined more than once", name))
+	}
+
+	registry[name] = key
+	return key
+}
+
+// registry holds all settings defined using Define
+var registry = make(map[string]definition)
+
+// state holds the overridden values of settings along with the set of watchers
+type state struct {
+	mu       sync.RWMutex
+	values   map[string]*domain.Setting
+	watchers map[string]map[chan struct{}]struct{}
+}
+
+var store = &state{values: make(map[string]*domain.Setting), watchers: make(map[string]map[chan struct{}]struct{})}
+
+func (s *state) get(name string) (json.RawMessage, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if v, ok := s.values[name]; ok {
+		return v.Value, true
+	}
+	return nil, false
+}
+
+// set updates the in-memory value of the setting and notifies all its watchers. A nil value resets the setting.
+func (s *state) set(name string, value *domain.Setting) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if value == nil {
+		delete(s.values, name)
+	} else {
+		s.values[name] = value
+	}
+
+	for ch := range s.watchers[name] {
+		select {
+		case ch <- struct{}{}:
+		default: // watcher has a pending notification already
+		}
+	}
+}
+
+// Load loads all overridden settings from the database. It must be called once during startup,
+// after schema migrations have been applied.
+func Load(conn *sqlite.Conn) (err error) {
+	var all []*domain.Setting
+	if all, err = database.FetchMany(conn, domain.ListSettings()); err != nil {
+		return err
+	}
+
+	for _, s := range all {
+		store.set(s.Key, s)
+	}
+
+	return nil
+}
+
+// Set validates and persists the value of the setting identified by name, and notifies all its watchers.
+func Set(conn *sqlite.Conn, name string, value json.RawMessage) (err error) {
+	def, ok := registry[name]
+	if !ok {
+		return ErrUnknownSetting
+	}
+
+	if err = def.validate(value); err != nil {
+		return &InvalidValueError{Name: name, Err: err}
+	}
+
+	var setting = &domain.Setting{Key: name, Value: value, UpdatedAt: time.Now().UTC()}
+	if _, err = database.Exec(conn, domain.SaveSetting(setting)); err != nil {
+		return err
+	}
+
+	store.set(name, setting)
+	return nil
+}
+
+// Reset deletes the overridden value of the setting identified by name, resetting it to its default value.
+func Reset(conn *sqlite.Conn, name string) (err error) {
+	if _, ok := registry[name]; !ok {
+		return ErrUnknownSetting
+	}
+
+	if _, err = database.Exec(conn, domain.DeleteSetting(name)); err != nil {
+		return err
+	}
+
+	store.set(name, nil)
+	return nil
+}
+
+// Watch returns a channel that receives a notification every time the value of one of the named settings changes.
+// Notifications are coalesced, ie. multiple changes in quick succession may result in a single notification.
+//
+// The returned function must be called to stop watching and release associated resources.
+func Watch(names ...string) (<-chan struct{}, func()) {
+	var ch = make(chan struct{}, 1)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	for _, name := range names {
+		if store.watchers[name] == nil {
+			store.watchers[name] = make(map[chan struct{}]struct{})
+		}
+		store.watchers[name][ch] = struct{}{}
+	}
+
+	return ch, func() {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+
+		for _, name := range names {
+			delete(store.watchers[name], ch)
+		}
+	}
+}
+
+// Info describes a defined setting along with its current value
+type Info struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Default     any        `json:"default"`
+	Value       any        `json:"value"`
+	Overridden  bool       `json:"overridden"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+// Describe returns information about the setting identified by name.
+func Describe(name string) (*Info, error) {
+	def, ok := registry[name]
+	if !ok {
+		return nil, ErrUnknownSetting
+	}
+
+	var info = &Info{Name: name, Description: def.description(), Default: def.defaultValue(), Value: def.defaultValue()}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	if v, ok := store.values[name]; ok {
+		info.Value, info.Overridden, info.UpdatedAt = v.Value, true, &v.UpdatedAt
+	}
+
+	return info, nil
+}
+
+// List returns information about all defined settings, sorted by name.
+func List() []*Info {
+	var names = make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var all = make([]*Info, 0, len(names))
+	for _, name := range names {
+		info, _ := Describe(name)
+		all = append(all, info)
+	}
+
+	return all
+}
+
+// Duration is a time.Duration that is encoded to / decoded from json as a human-readable string, eg. "5s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) { return json.Marshal(time.Duration(d).String()) }
+
+func (d *Duration) UnmarshalJSON(buf []byte) error {
+	var s string
+	if err := json.Unmarshal(buf, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	if v <= 0 {
+		return errors.New("duration must be positive")
+	}
+
+	*d = Duration(v)
+	return nil
+}
@@ -0,0 +1,92 @@
+// Package tracing sets up OpenTelemetry tracing (see: Setup), exporting request-scoped spans (eg. of a map response being
+// generated, and the database queries it ran) to a collector using OTLP over http, so that operators can tell where
+// time is spent on slow requests.
+//
+// Spans are started using the global otel.Tracer, and incoming http requests are traced using otelhttp. Code that has no
+// context to carry a span (eg. the database package) can look up the context bound to a shared object, such as a
+// database connection, using Bind and Bound.
+package tracing
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Setup installs the global tracer provider, exporting spans to the OTLP/HTTP collector at endpoint (eg. http://localhost:4318),
+// as the given service. Ratio is the fraction of traces that are sampled (and exported); traces continued from a caller (that sent
+// a W3C traceparent header) follow the caller's sampling decision instead. Spans are exported in the background, until the context
+// is cancelled, after which the spans that are still queued are exported.
+//
+// Until Setup is called, the global tracer provider is a no-op one, and spans aren't recorded.
+func Setup(ctx context.Context, endpoint, service string, ratio float64) error {
+	if endpoint == "" {
+		return errors.New("tracing: endpoint is required")
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return errors.Wrap(err, "tracing: failed to create exporter")
+	}
+
+	var provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(service))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+
+		if err := provider.Shutdown(shutdownCtx); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("failed to flush spans")
+		}
+	}()
+
+	return nil
+}
+
+// bound holds the contexts bound to objects, using Bind
+var bound sync.Map
+
+// Bind binds the context to the key (eg. a database connection) until the returned function is called, so that code
+// that only has access to the key can start spans as children of the context's span (see: Bound). A context that
+// doesn't carry a valid span is not bound.
+func Bind(key any, ctx context.Context) (unbind func()) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return func() {}
+	}
+
+	prev, loaded := bound.Swap(key, ctx)
+	return func() {
+		if loaded {
+			bound.Store(key, prev)
+		} else {
+			bound.Delete(key)
+		}
+	}
+}
+
+// Bound returns the context bound to the key; nil if there's none
+func Bound(key any) context.Context {
+	if ctx, ok := bound.Load(key); ok {
+		return ctx.(context.Context)
+	}
+	return nil
+}
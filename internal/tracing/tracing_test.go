@@ -0,0 +1,42 @@
+package tracing
+
+import (
+	"context"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+)
+
+func TestBind(t *testing.T) {
+	var exporter = tracetest.NewInMemoryExporter()
+	var tracer = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)).Tracer("test")
+
+	var conn = new(int)
+	if unbind := Bind(conn, context.Background()); Bound(conn) != nil {
+		t.Fatalf("expected a context without a span not to be bound")
+	} else {
+		unbind()
+	}
+
+	ctx, request := tracer.Start(context.Background(), "machine.map")
+	var unbind = Bind(conn, ctx)
+
+	_, query := tracer.Start(Bound(conn), "database.select")
+	query.End()
+
+	unbind()
+	request.End()
+
+	if Bound(conn) != nil {
+		t.Errorf("expected connection to be unbound")
+	}
+
+	var spans = exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+
+	if got, want := spans[0].Parent.SpanID(), spans[1].SpanContext.SpanID(); got != want {
+		t.Errorf("expected query span to be a child of the request span; parent is %s, want %s", got, want)
+	}
+}
@@ -1,7 +1,8 @@
 package util
 
 import (
-	"crypto/md5"
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 )
@@ -16,12 +17,45 @@ func Must[T any](v T, err error) T {
 // ToPtr returns a a pointer to v
 func ToPtr[T any](v T) *T { return &v }
 
-// Checksum returns the md5 checksum of the given v when encoded as json
+// Canonical returns the canonical json encoding of v; a compact encoding where the keys of all objects are sorted,
+// at any depth, including within values that encode themselves (eg. json.RawMessage or custom json.Marshaler).
+// Numbers are preserved as they were encoded, and html characters are not escaped.
+func Canonical[T any](v T) (_ []byte, err error) {
+	var buf []byte
+	if buf, err = json.Marshal(v); err != nil {
+		return nil, err
+	}
+
+	// decode into generic values (maps, slices and numbers) and encode again, as encoding/json always sorts map keys
+	var dec = json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+
+	var generic any
+	if err = dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	var enc = json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+
+	if err = enc.Encode(generic); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
+
+// Checksum returns the hex-encoded sha-256 checksum of the canonical json encoding (see: Canonical) of the given v,
+// such that values with the same content always have the same checksum. It panics if v can't be encoded as json.
+//
+// Checksums used to be the md5 of the (non-canonical) json encoding. Persisted checksums (eg. domain.MapSession)
+// computed that way never match the ones computed now, and are simply replaced the first time they're compared.
 func Checksum[T any](v T) string {
-	if marshal, err := json.Marshal(v); err != nil {
+	if canonical, err := Canonical(v); err != nil {
 		panic(err)
 	} else {
-		sum := md5.Sum(marshal)
+		sum := sha256.Sum256(canonical)
 		return hex.EncodeToString(sum[:])
 	}
 }
@@ -0,0 +1,48 @@
+package util
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	var cases = []struct {
+		name string
+		v    any
+		want string
+	}{
+		{"Struct", struct{ B, A int }{B: 1, A: 2}, `{"A":2,"B":1}`},
+		{"RawMessage", json.RawMessage(`{ "z": [1, 2.50], "a": {"y": true, "x": null} }`), `{"a":{"x":null,"y":true},"z":[1,2.50]}`},
+		{"Html", map[string]string{"k": "<a&b>"}, `{"k":"<a&b>"}`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Canonical(tc.v)
+			if err != nil {
+				t.Fatalf("failed to canonicalize: %v", err)
+			}
+
+			if string(got) != tc.want {
+				t.Errorf("unexpected encoding %s; want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	var a = json.RawMessage(`{"x": 1, "y": [2, 3]}`)
+	var b = json.RawMessage(`{"y":[2,3],"x":1}`)
+
+	if Checksum(a) != Checksum(b) {
+		t.Errorf("expected equal checksums for values with the same content")
+	}
+
+	if Checksum(a) == Checksum(json.RawMessage(`{"x": 1, "y": [3, 2]}`)) {
+		t.Errorf("expected different checksums for values with different content")
+	}
+
+	if len(Checksum(a)) != 64 {
+		t.Errorf("expected a hex-encoded sha-256 checksum; got %s", Checksum(a))
+	}
+}
@@ -0,0 +1,276 @@
+// Package webhook notifies the webhooks registered in a tailnet (see: domain.Webhook) of events in the tailnet, eg. when a
+// machine joins it, or its acl policy is updated.
+//
+// Events are read from the audit log, after they have been committed to the database, and queued as deliveries to every
+// webhook that subscribes to them. Each delivery is posted to the webhook's url as a json object, eg.
+//
+//	{"id": 42, "type": "node.joined", "tailnet_id": 1, "timestamp": "...", "event": {"action": "machine.created", ...}}
+//
+// and is signed using the webhook's secret (see: Sign). Deliveries that fail are retried, with an exponential backoff,
+// until they've been attempted MaxAttempts times. Every attempt is recorded, and can be inspected using the admin api;
+// only the status code of the receiver's response is recorded, not its body.
+//
+// Webhooks can't be delivered to loopback, private, link-local or unspecified addresses (see: control), so that they
+// can't be used to reach services on wirefire's own network.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/riyaz-ali/wirefire/internal/database"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/rs/zerolog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Interval is the interval at which newly recorded events are queued, and due deliveries are attempted
+var Interval = settings.Define("webhook.interval", settings.Duration(5*time.Second),
+	"interval at which events are queued for, and delivered to, the webhooks registered in tailnets")
+
+// Retention is the duration for which completed deliveries are kept
+var Retention = settings.Define("webhook.retention", settings.Duration(7*24*time.Hour),
+	"duration for which completed webhook deliveries are kept for inspection")
+
+// Headers sent with every delivery
+const (
+	HeaderEvent     = "X-Wirefire-Event"     // type of the event, eg. node.joined
+	HeaderDelivery  = "X-Wirefire-Delivery"  // id of the delivery; it's the same across retries
+	HeaderTimestamp = "X-Wirefire-Timestamp" // unix time at which the delivery was attempted
+	HeaderSignature = "X-Wirefire-Signature" // signature of the delivery; see Sign
+)
+
+const (
+	// MaxAttempts is the number of times a delivery is attempted before it's marked failed
+	MaxAttempts = 8
+
+	cursor    = "@webhooks"      // name of the audit cursor tracking the events queued so far
+	batchSize = 100              // maximum number of events (or deliveries) processed at once
+	timeout   = 10 * time.Second // timeout of each delivery
+	minDelay  = 30 * time.Second // delay before the first retry
+	maxDelay  = time.Hour        // maximum delay between retries
+)
+
+// client posts deliveries; it dials no proxy, as the address it connects to must be checked by control
+var client = &http.Client{
+	Timeout:   timeout,
+	Transport: &http.Transport{DialContext: (&net.Dialer{Timeout: timeout, Control: control}).DialContext},
+}
+
+// cgnat is the shared address space tailnet addresses are allocated from
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+// control rejects connections to loopback, private (including cgnat), link-local and unspecified addresses. It checks the
+// address being dialed, after the webhook's host is resolved, so that it also covers hosts that resolve to, or redirect to,
+// such addresses.
+func control(_, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+
+	if addr := ap.Addr().Unmap(); addr.IsLoopback() || addr.IsPrivate() || cgnat.Contains(addr) || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsUnspecified() {
+		return errors.Errorf("webhook: delivery to %s is not allowed", addr)
+	}
+
+	return nil
+}
+
+// Sign returns the signature of a delivery, sent in the HeaderSignature header as sha256=<hex digest>. It's the hmac-sha256
+// of the timestamp (as sent in HeaderTimestamp), a dot, and the body, keyed with the webhook's secret. Receivers should
+// compute the same, and also reject deliveries whose timestamp is too old, to guard against replays.
+func Sign(secret string, timestamp int64, body []byte) string {
+	var mac = hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns the delay before the next attempt of a delivery that has failed the given number of times
+func Backoff(attempts int) time.Duration {
+	var delay = minDelay
+	for i := 1; i < attempts && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+// Payload is the body of a delivery
+type Payload struct {
+	ID        int                `json:"id"`   // id of the audit event; receivers can use it to discard duplicates
+	Type      string             `json:"type"` // type of the event, eg. node.joined
+	TailnetID int                `json:"tailnet_id"`
+	Timestamp time.Time          `json:"timestamp"`
+	Event     *domain.AuditEvent `json:"event"`
+}
+
+// Run queues newly recorded events, and attempts due deliveries, every Interval until the context is cancelled.
+// It blocks and must be run in a goroutine.
+func Run(ctx context.Context, pool *sqlitex.Pool) error {
+	log := zerolog.Ctx(ctx).With().Str("component", "webhook").Logger()
+
+	var ticker = time.NewTicker(time.Duration(Interval.Get()))
+	defer ticker.Stop()
+
+	changes, unwatch := settings.Watch(Interval.Name)
+	defer unwatch()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := enqueue(ctx, pool); err != nil {
+				log.Error().Err(err).Msg("failed to queue webhook deliveries")
+			}
+
+			if err := deliver(ctx, pool); err != nil {
+				log.Error().Err(err).Msg("failed to deliver webhooks")
+			}
+
+		case <-changes:
+			ticker.Reset(time.Duration(Interval.Get()))
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// enqueue queues the delivery of all events recorded after the cursor, to the webhooks subscribed to them, in batches,
+// advancing the cursor along with each batch
+func enqueue(ctx context.Context, pool *sqlitex.Pool) error {
+	conn := pool.Get(ctx)
+	if conn == nil {
+		return ctx.Err()
+	}
+	defer pool.Put(conn)
+
+	last, err := database.FetchOne(conn, domain.GetAuditCursor(cursor))
+	if err != nil {
+		return err
+	}
+
+	for {
+		events, err := database.FetchMany(conn, domain.ListAuditEventsAfter(*last, batchSize))
+		if err != nil || len(events) == 0 {
+			return err
+		}
+
+		err = database.Tx(conn, func(conn *sqlite.Conn) error {
+			for _, e := range events {
+				var typ, ok = domain.WebhookEvents[e.Action]
+				if !ok || e.TailnetID == nil {
+					continue
+				}
+
+				buf, err := json.Marshal(&Payload{ID: e.ID, Type: typ, TailnetID: *e.TailnetID, Timestamp: e.CreatedAt, Event: e})
+				if err != nil {
+					return err
+				}
+
+				if _, err = database.Exec(conn, domain.EnqueueWebhookDeliveries(*e.TailnetID, typ, string(buf))); err != nil {
+					return err
+				}
+			}
+
+			*last = events[len(events)-1].ID
+			_, err := database.Exec(conn, domain.SetAuditCursor(cursor, *last))
+			return err
+		})
+
+		if err != nil || len(events) < batchSize {
+			return err
+		}
+	}
+}
+
+// deliver attempts all deliveries that are due, recording the outcome of each, and prunes completed deliveries past Retention
+func deliver(ctx context.Context, pool *sqlitex.Pool) error {
+	conn := pool.Get(ctx)
+	if conn == nil {
+		return ctx.Err()
+	}
+
+	deliveries, err := database.FetchMany(conn, domain.ListDueWebhookDeliveries(batchSize))
+	if err == nil {
+		_, err = database.Exec(conn, domain.DeleteWebhookDeliveries(time.Now().Add(-time.Duration(Retention.Get()))))
+	}
+	pool.Put(conn) // don't hold on to the connection while waiting on receivers
+
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deliveries {
+		attempt(ctx, d)
+
+		if conn = pool.Get(ctx); conn == nil {
+			return ctx.Err()
+		}
+
+		_, err = database.Exec(conn, domain.SaveWebhookDelivery(d))
+		pool.Put(conn)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attempt posts the delivery to its webhook, and updates it with the outcome
+func attempt(ctx context.Context, d *domain.WebhookDelivery) {
+	var now = time.Now()
+	d.Attempts++
+
+	code, err := post(ctx, d, now)
+	d.ResponseCode = code
+
+	switch {
+	case err == nil:
+		d.Status, d.Error, d.DeliveredAt = domain.DeliveryDelivered, "", &now
+	case d.Attempts >= MaxAttempts:
+		d.Status, d.Error = domain.DeliveryFailed, err.Error()
+	default:
+		d.Error, d.NextAttemptAt = err.Error(), now.Add(Backoff(d.Attempts))
+	}
+}
+
+// post sends the delivery to its webhook, returning the response's status code, if any
+func post(ctx context.Context, d *domain.WebhookDelivery, now time.Time) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "wirefire-webhook")
+	req.Header.Set(HeaderEvent, d.Event)
+	req.Header.Set(HeaderDelivery, strconv.Itoa(d.ID))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(HeaderSignature, Sign(d.Secret, now.Unix(), []byte(d.Payload)))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode >= 300 {
+		return res.StatusCode, errors.Errorf("webhook responded with %s", res.Status)
+	}
+
+	return res.StatusCode, nil
+}
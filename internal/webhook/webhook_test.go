@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"context"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		7:  32 * time.Minute,
+		8:  time.Hour,
+		20: time.Hour,
+	} {
+		if delay := Backoff(attempts); delay != expected {
+			t.Errorf("Backoff(%d) = %s, expected %s", attempts, delay, expected)
+		}
+	}
+}
+
+func TestAttempt(t *testing.T) {
+	var status = http.StatusOK
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts, _ := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		if r.Header.Get(HeaderSignature) != Sign("secret", ts, body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	// the test server listens on loopback, which the default client refuses to connect to
+	var original = client
+	client = server.Client()
+	t.Cleanup(func() { client = original })
+
+	var d = &domain.WebhookDelivery{ID: 1, Event: domain.WebhookNodeJoined, Payload: `{"id":1}`, URL: server.URL, Secret: "secret"}
+	if attempt(context.Background(), d); d.Status != domain.DeliveryDelivered || d.DeliveredAt == nil {
+		t.Fatalf("expected delivery to succeed; got %q (%s)", d.Status, d.Error)
+	}
+
+	// a receiver that rejects deliveries is retried until MaxAttempts
+	status = http.StatusInternalServerError
+	d = &domain.WebhookDelivery{ID: 2, Status: domain.DeliveryPending, Payload: `{"id":2}`, URL: server.URL, Secret: "secret"}
+	for i := 1; i < MaxAttempts; i++ {
+		if attempt(context.Background(), d); d.Status != domain.DeliveryPending || d.ResponseCode != status || d.NextAttemptAt.IsZero() {
+			t.Fatalf("expected attempt %d to be retried; got %q (%d)", i, d.Status, d.ResponseCode)
+		}
+	}
+
+	if attempt(context.Background(), d); d.Status != domain.DeliveryFailed {
+		t.Fatalf("expected delivery to fail after %d attempts; got %q", MaxAttempts, d.Status)
+	}
+
+	// deliveries signed with the wrong secret are rejected
+	status = http.StatusOK
+	d = &domain.WebhookDelivery{ID: 3, Status: domain.DeliveryPending, Payload: `{"id":3}`, URL: server.URL, Secret: "other"}
+	if attempt(context.Background(), d); d.ResponseCode != http.StatusUnauthorized {
+		t.Fatalf("expected delivery to be rejected; got %d", d.ResponseCode)
+	}
+}
+
+func TestAttempt_InternalAddress(t *testing.T) {
+	var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("expected delivery to loopback address not to be attempted")
+	}))
+	t.Cleanup(server.Close)
+
+	var d = &domain.WebhookDelivery{ID: 1, Status: domain.DeliveryPending, Payload: `{"id":1}`, URL: server.URL, Secret: "secret"}
+	if attempt(context.Background(), d); d.Status != domain.DeliveryPending || d.ResponseCode != 0 || !strings.Contains(d.Error, "not allowed") {
+		t.Fatalf("expected delivery to be rejected; got %q (%s)", d.Status, d.Error)
+	}
+
+	for address, allowed := range map[string]bool{
+		"127.0.0.1:443":           false,
+		"[::1]:443":               false,
+		"10.1.2.3:443":            false,
+		"192.168.1.1:443":         false,
+		"[fd7a:115c:a1e0::1]:443": false,
+		"100.64.0.1:443":          false,
+		"169.254.169.254:80":      false,
+		"[fe80::1]:443":           false,
+		"0.0.0.0:443":             false,
+		"[::ffff:10.0.0.1]:443":   false,
+		"192.0.2.1:443":           true,
+		"[2001:db8::1]:443":       true,
+	} {
+		if err := control("tcp", address, nil); (err == nil) != allowed {
+			t.Errorf("expected allowed=%t for %s; got %v", allowed, address, err)
+		}
+	}
+}
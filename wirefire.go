@@ -2,16 +2,34 @@ package main
 
 import (
 	"context"
+	"crawshaw.io/sqlite"
 	"crawshaw.io/sqlite/sqlitex"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/go-chi/chi/v5"
 	stock "github.com/go-chi/chi/v5/middleware"
+	"github.com/riyaz-ali/wirefire/internal/access"
+	"github.com/riyaz-ali/wirefire/internal/api"
+	"github.com/riyaz-ali/wirefire/internal/audit"
 	"github.com/riyaz-ali/wirefire/internal/config"
+	"github.com/riyaz-ali/wirefire/internal/console"
 	"github.com/riyaz-ali/wirefire/internal/coordinator"
+	"github.com/riyaz-ali/wirefire/internal/database"
 	"github.com/riyaz-ali/wirefire/internal/database/schema"
 	"github.com/riyaz-ali/wirefire/internal/derp"
+	"github.com/riyaz-ali/wirefire/internal/domain"
+	"github.com/riyaz-ali/wirefire/internal/geoip"
+	"github.com/riyaz-ali/wirefire/internal/headers"
+	"github.com/riyaz-ali/wirefire/internal/janitor"
+	"github.com/riyaz-ali/wirefire/internal/landing"
+	"github.com/riyaz-ali/wirefire/internal/notifier"
 	"github.com/riyaz-ali/wirefire/internal/oidc"
+	"github.com/riyaz-ali/wirefire/internal/proxy"
+	"github.com/riyaz-ali/wirefire/internal/rpc"
+	"github.com/riyaz-ali/wirefire/internal/settings"
+	"github.com/riyaz-ali/wirefire/internal/tracing"
+	"github.com/riyaz-ali/wirefire/internal/webhook"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
@@ -21,9 +39,11 @@ import (
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
+	"time"
 )
 
 // WirefireConfig is the base configuration for the core coordination service.
@@ -32,14 +52,37 @@ type WirefireConfig struct {
 	// used for secure communication over Noise protocol
 	Key key.MachinePrivate `viper:"noise.private_key"`
 
+	// KeyRotatedAt is the time at which Key was last rotated. PreviousKey is the public half of the key
+	// in use before that, and is reported over the /key endpoint until KeyRotationWindow has passed.
+	KeyRotatedAt time.Time         `viper:"noise.rotated_at"`
+	PreviousKey  key.MachinePublic `viper:"noise.previous_public_key"`
+
 	Server struct {
 		// Addr is the listen address used by the coordination server
 		Addr string `viper:"server.listen_addr" default:"127.0.0.1:8080"`
+
+		// AdminURL is the url of an external admin console. Clients link to <server.url>/admin (eg. for users granted
+		// the is-admin capability), which redirects here unless the embedded console (console.enabled) is served instead.
+		// The /admin endpoint is disabled if empty.
+		AdminURL string `viper:"server.admin_url"`
+
+		// DrainTimeout is the number of seconds the server waits, on shutdown, for in-flight requests and streaming sessions to finish
+		DrainTimeout int `viper:"server.drain_timeout" default:"30" validate:"gte=0"`
 	}
 
 	Database struct {
-		// URL is the path to the sqlite database (see: https://www.sqlite.org/uri.html)
-		URL string `viper:"database.url" validate:"required"`
+		// URL is the path to the sqlite database (see: https://www.sqlite.org/uri.html).
+		// SQLite is the only supported database, so a deployment must run a single wirefire replica.
+		URL string `viper:"database.url" validate:"required,sqliteurl"`
+
+		// WAL opens the database in write-ahead logging mode, which lets readers proceed while a write is in progress
+		WAL bool `viper:"database.wal" default:"true"`
+
+		// BusyTimeout is the number of milliseconds a connection waits for a lock held by another connection before failing
+		BusyTimeout int `viper:"database.busy_timeout" default:"10000" validate:"gte=0"`
+
+		// SlowQueryThreshold is the number of milliseconds after which a query is logged as slow; slow queries aren't logged if zero
+		SlowQueryThreshold int `viper:"database.slow_query_threshold" default:"250" validate:"gte=0"`
 	}
 
 	Log struct {
@@ -48,30 +91,71 @@ type WirefireConfig struct {
 	}
 
 	DERP struct {
-		// Sources is a list of URLs to fetch the derp map information from.
-		// The default value uses the official Tailscale DERP service
+		// Sources is a list of URLs to fetch the derp map information from; either http(s) urls, or file:// paths
+		// to a json encoded derp map. The default value uses the official Tailscale DERP service. Regions can also be
+		// defined inline, under derp.map_inline, eg. for air-gapped deployments; these are merged after all sources.
 		Sources []string `viper:"derp.sources" default:"https://login.tailscale.com/derpmap/default"`
 	}
+
+	Tracing struct {
+		// Endpoint is the base url of an OpenTelemetry collector's OTLP/HTTP receiver (eg. http://localhost:4318) that
+		// request traces are exported to. Tracing is disabled if empty.
+		Endpoint string `viper:"tracing.endpoint"`
+
+		// ServiceName is the service.name resource attribute traces are exported with
+		ServiceName string `viper:"tracing.service_name" default:"wirefire"`
+
+		// SampleRatio is the fraction of traces that are sampled, and exported
+		SampleRatio float64 `viper:"tracing.sample_ratio" default:"1" validate:"gte=0,lte=1"`
+	}
+
+	Config struct {
+		// Strict fails startup if the configuration files set keys that aren't known, eg. as they're misspelled;
+		// such keys are otherwise ignored, with a warning.
+		Strict bool `viper:"config.strict"`
+	}
+}
+
+func init() {
+	config.Register[WirefireConfig]()
+	config.Register[geoip.Config]()
 }
 
 func init() {
 	// setup global viper configuration
-	var configFile = flag.String("config", "config.yaml", "path to configuration file")
+	var configFiles = flag.String("config", "config.yaml", "comma-separated list of configuration files, merged in order")
+	var env = flag.String("env", os.Getenv(config.EnvPrefix+"_ENV"), "environment name used to select overlay files (eg. prod for config.prod.yaml)")
+
+	flag.Usage = func() {
+		Root().usage()
+		_, _ = fmt.Fprintln(flag.CommandLine.Output(), "\nglobal flags:")
+		flag.PrintDefaults()
+	}
+
 	flag.Parse()
 
-	viper.SetConfigFile(*configFile)
-	if err := viper.ReadInConfig(); err != nil {
+	if err := config.Load(strings.Split(*configFiles, ","), *env); err != nil {
 		log.Fatal().Err(err).Msg("failed to read configuration file")
 	}
-	viper.AutomaticEnv() // override with any environment variables
 }
 
 func main() {
-	cfg := config.MustValidate(config.Read[WirefireConfig]()) // read in the configuration value
-
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGKILL, syscall.SIGTERM)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	if err := Root().Run(ctx, flag.Args()); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "wirefire: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Serve runs the coordination server until the context is cancelled, after which it shuts down gracefully;
+// streaming sessions are terminated and in-flight requests allowed to finish within the configured drain timeout.
+func Serve(ctx context.Context, _ []string) error {
+	cfg := config.MustValidate(config.Read[WirefireConfig]()) // read in the configuration value
+	_ = config.MustValidate(config.Read[coordinator.DnsConfig]())
+	_ = config.MustValidate(config.Read[coordinator.NamingConfig]())
+
 	var logger zerolog.Logger
 	{ // prepare singleton / global logging service
 		var out io.Writer = os.Stdout
@@ -85,10 +169,38 @@ func main() {
 		log.Logger = logger // set as default logger
 	}
 
+	if unknown := config.Unknown(); len(unknown) > 0 {
+		var keys = make([]string, len(unknown))
+		for i, u := range unknown {
+			keys[i] = u.String()
+		}
+
+		if cfg.Config.Strict {
+			log.Fatal().Strs("keys", keys).Msg("unknown configuration keys")
+		}
+		log.Warn().Strs("keys", keys).Msg("ignoring unknown configuration keys")
+	}
+
+	if cfg.Tracing.Endpoint != "" { // export request traces to the configured collector
+		if err := tracing.Setup(ctx, cfg.Tracing.Endpoint, cfg.Tracing.ServiceName, cfg.Tracing.SampleRatio); err != nil {
+			log.Fatal().Err(err).Msg("failed to set up tracing")
+		}
+	}
+
 	var pool *sqlitex.Pool
 	{ // open and set up the database
 		var err error
-		if pool, err = sqlitex.Open(cfg.Database.URL, 0 /* no additional flags */, 8 /* pool size*/); err != nil {
+		database.SetSlowQueryThreshold(time.Duration(cfg.Database.SlowQueryThreshold) * time.Millisecond)
+
+		var flags = sqlite.SQLITE_OPEN_READWRITE | sqlite.SQLITE_OPEN_CREATE | sqlite.SQLITE_OPEN_URI | sqlite.SQLITE_OPEN_NOMUTEX
+		if cfg.Database.WAL {
+			flags |= sqlite.SQLITE_OPEN_WAL
+		} else if err = disableWAL(cfg.Database.URL, flags); err != nil {
+			log.Fatal().Err(err).Msg("failed to disable wal mode")
+		}
+
+		var init = fmt.Sprintf("PRAGMA busy_timeout = %d;", cfg.Database.BusyTimeout)
+		if pool, err = sqlitex.OpenInit(ctx, cfg.Database.URL, flags, 8 /* pool size*/, init); err != nil {
 			log.Fatal().Err(err).Msg("failed to open database")
 		}
 
@@ -96,48 +208,218 @@ func main() {
 		if err = schema.Apply(conn); err != nil {
 			log.Fatal().Err(err).Msg("failed to apply schema migration")
 		}
+
+		if err = settings.Load(conn); err != nil {
+			log.Fatal().Err(err).Msg("failed to load runtime settings")
+		}
+
+		// machines left online by an unclean shutdown are marked offline; their clients reconnect shortly
+		if _, err = database.Exec(conn, domain.ClosePresence(time.Now())); err != nil {
+			log.Fatal().Err(err).Msg("failed to close presence sessions")
+		}
 		pool.Put(conn)
 	}
 
 	defer func() { _ = pool.Close() }() // close when server terminates
 
+	var geo *geoip.Resolver
+	{ // open the geoip databases used to annotate client addresses, if configured
+		var err error
+		if geo, err = geoip.Open(config.Read[geoip.Config]()); err != nil {
+			log.Fatal().Err(err).Msg("failed to open geoip databases")
+		}
+	}
+
+	defer func() { _ = geo.Close() }()
+
+	proxies, err := proxy.Read() // reverse proxies whose forwarding headers are trusted
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to read trusted proxies")
+	}
+
 	// load and set default derp map from official tailscale service
-	if derpMap, err := derp.Load(cfg.DERP.Sources); err != nil {
+	derpMap, err := derp.Load(cfg.DERP.Sources)
+	if err != nil {
 		log.Fatal().Err(err).Msg("failed to load derp sources")
-	} else {
-		viper.Set("derp.map", derpMap) // available for use from this point onwards
 	}
 
+	var embedded *derp.Embedded
+	var ec = config.Read[derp.EmbeddedConfig]()
+	if ec.Enabled { // start the embedded derp relay, and add its region to the map
+		embedded = derp.NewEmbedded(ctx, ec)
+		defer func() { _ = embedded.Close() }()
+
+		if ec.STUNAddr != "" {
+			go func() {
+				if err := embedded.ServeSTUN(ctx); err != nil {
+					log.Error().Err(err).Msg("stun responder failed")
+				}
+			}()
+		}
+
+		derpMap.Regions[ec.RegionID] = embedded.Region()
+	}
+
+	viper.Set("derp.map", derpMap) // available for use from this point onwards
+
+	// periodically refresh the derp map, so that clients learn about new / removed regions
+	go derp.Refresh(ctx, cfg.DERP.Sources, func(dm *tailcfg.DERPMap) {
+		if embedded != nil {
+			dm.Regions[ec.RegionID] = embedded.Region()
+		}
+
+		prev, _ := viper.Get("derp.map").(*tailcfg.DERPMap)
+		added, removed, changed := derp.Diff(prev, dm)
+		if len(added) == 0 && len(removed) == 0 && len(changed) == 0 {
+			return
+		}
+
+		log.Info().Ints("added", added).Ints("removed", removed).Ints("changed", changed).Msg("derp map changed; updating connected clients")
+		viper.Set("derp.map", dm)
+
+		// connected clients are sent the new map with their next update; see coordinator's derpChecksum
+		notifier.Publish(notifier.Event{Kind: notifier.DERPMapChanged, Tailnet: notifier.All})
+	})
+
+	// start background maintenance tasks
+	go janitor.Run(ctx, pool)
+
+	// ship the audit log to the configured exporters
+	go func() {
+		if err := audit.Run(ctx, pool); err != nil {
+			log.Error().Err(err).Msg("failed to export audit log")
+		}
+	}()
+
+	// notify the webhooks registered in tailnets of events in them
+	go func() {
+		if err := webhook.Run(ctx, pool); err != nil {
+			log.Error().Err(err).Msg("failed to deliver webhooks")
+		}
+	}()
+
+	// serve the admin operations over grpc, if enabled
+	go func() {
+		if err := rpc.Run(ctx, pool); err != nil {
+			log.Error().Err(err).Msg("failed to serve grpc admin service")
+		}
+	}()
+
 	// create new router with a set of stock middlewares registered
 	r := chi.NewRouter()
 	r.Use(stock.NoCache, stock.Recoverer, stock.RequestID)
 
-	r.Get("/key", KeyHandler(cfg.Key))
-	r.Handle("/ts2021", coordinator.Upgrade(cfg.Key, pool))
-	r.Mount("/oidc", oidc.Handler(ctx, pool))
+	r.Group(func(r chi.Router) {
+		r.Use(headers.Middleware(headers.Landing))
+		r.Get("/", landing.Index())
+		r.Get("/join/{tailnet}", landing.Join(pool))
+	})
+	r.With(access.Middleware(access.Key, proxies)).Get("/key", KeyHandler(cfg.Key, cfg.PreviousKey, cfg.KeyRotatedAt))
+	if config.Read[console.Config]().Enabled {
+		r.With(headers.Middleware(headers.Console)).Mount("/admin", console.Handler(ctx, pool))
+	} else {
+		r.Get("/admin", AdminHandler(cfg.Server.AdminURL))
+	}
+	r.Handle("/ts2021", coordinator.Upgrade(cfg.Key, pool, geo, proxies))
+	r.With(headers.Middleware(headers.OIDC)).Mount("/oidc", oidc.Handler(ctx, pool))
+	r.With(headers.Middleware(headers.OIDC)).Mount("/ssh/action", oidc.SSHHandler(ctx, pool))
+	r.With(headers.Middleware(headers.API)).Mount("/api/v1", api.Handler(ctx, pool))
+
+	if embedded != nil {
+		embedded.Mount(r.With(access.Middleware(access.Derp, proxies)))
+	}
 
 	// mount profiler endpoints to /debug
 	// r.Mount("/debug", stock.Profiler())
 
-	addr := cfg.Server.Addr
-	srv := &http.Server{Addr: addr, Handler: r, BaseContext: func(_ net.Listener) context.Context { return ctx }}
+	// requests are served with a context that isn't cancelled on shutdown, so that in-flight requests can finish while draining
+	addr, base := cfg.Server.Addr, context.WithoutCancel(ctx)
+	srv := &http.Server{Addr: addr, Handler: r, BaseContext: func(_ net.Listener) context.Context { return base }}
+
+	var errs = make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
 
 	log.Info().Str("addr", addr).Msg("starting http server")
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatal().Err(err).Send()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	var timeout = time.Duration(cfg.Server.DrainTimeout) * time.Second
+	log.Info().Dur("timeout", timeout).Msg("shutting down http server")
+
+	drainCtx, cancel := context.WithTimeout(base, timeout)
+	defer cancel()
+
+	// terminate streaming sessions first, as they are served over hijacked connections that srv.Shutdown() doesn't wait for
+	if err := coordinator.Drain(drainCtx); err != nil {
+		log.Warn().Err(err).Msg("timed out waiting for streaming sessions to terminate")
+	}
+
+	if err := srv.Shutdown(drainCtx); err != nil {
+		log.Warn().Err(err).Msg("timed out waiting for in-flight requests to finish")
+		_ = srv.Close()
+	}
+
+	log.Info().Msg("http server stopped")
+	return nil // deferred functions close the database and other resources
+}
+
+// disableWAL switches the database at url back to the default (rollback) journal mode. The journal mode is persistent,
+// so a database that was once opened in wal mode stays in it until switched back, which must be done outside a transaction.
+func disableWAL(url string, flags sqlite.OpenFlags) (err error) {
+	var conn *sqlite.Conn
+	if conn, err = sqlite.OpenConn(url, flags); err != nil {
+		return err
 	}
+	defer func() { _ = conn.Close() }()
+
+	return sqlitex.ExecTransient(conn, "PRAGMA journal_mode = delete", nil)
+}
+
+// KeyRotationWindow is the duration after a key rotation during which the previous key is reported over the /key endpoint
+const KeyRotationWindow = 7 * 24 * time.Hour
+
+// KeyResponse is served over the /key endpoint. It extends tailcfg.OverTLSPublicKeyResponse with metadata about the
+// server's key, and the range of capability versions it supports. Clients only read the embedded fields, and ignore the rest.
+type KeyResponse struct {
+	tailcfg.OverTLSPublicKeyResponse
+
+	RotatedAt         *time.Time         `json:",omitempty"` // time at which the key was last rotated, if known
+	PreviousPublicKey *key.MachinePublic `json:",omitempty"` // key in use before the last rotation, while in KeyRotationWindow
+
+	MinCapabilityVersion tailcfg.CapabilityVersion // oldest client capability version supported by the server
+	MaxCapabilityVersion tailcfg.CapabilityVersion // newest client capability version known to the server
 }
 
-// KeyHandler serves tailcfg.OverTLSPublicKeyResponse over /key endpoint
-func KeyHandler(private key.MachinePrivate) http.HandlerFunc {
+// KeyHandler serves KeyResponse over /key endpoint
+func KeyHandler(private key.MachinePrivate, previous key.MachinePublic, rotatedAt time.Time) http.HandlerFunc {
 	public := private.Public()
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		if v := r.URL.Query().Get("v"); v != "" {
 			if clientVersion, err := strconv.Atoi(v); err != nil {
 				http.Error(w, "invalid version", http.StatusBadRequest)
-			} else if clientVersion >= coordinator.NoiseCapabilityVersion {
-				var resp = &tailcfg.OverTLSPublicKeyResponse{PublicKey: public}
+			} else {
+				coordinator.RecordVersion(coordinator.EndpointKey, key.MachinePublic{}, tailcfg.CapabilityVersion(clientVersion))
+				if clientVersion < coordinator.NoiseCapabilityVersion {
+					return
+				}
+
+				var resp = &KeyResponse{
+					OverTLSPublicKeyResponse: tailcfg.OverTLSPublicKeyResponse{PublicKey: public},
+					MinCapabilityVersion:     coordinator.SupportedCapabilityVersion,
+					MaxCapabilityVersion:     tailcfg.CurrentCapabilityVersion,
+				}
+
+				if !rotatedAt.IsZero() {
+					resp.RotatedAt = &rotatedAt
+					if !previous.IsZero() && time.Since(rotatedAt) < KeyRotationWindow {
+						resp.PreviousPublicKey = &previous
+					}
+				}
+
 				if err = json.NewEncoder(w).Encode(resp); err != nil {
 					http.Error(w, "failed to encode response", http.StatusInternalServerError)
 				}
@@ -147,3 +429,15 @@ func KeyHandler(private key.MachinePrivate) http.HandlerFunc {
 		}
 	}
 }
+
+// AdminHandler redirects requests for the /admin endpoint, which clients link to from their ui, to wirefire's admin console
+func AdminHandler(url string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if url == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.Redirect(w, r, url, http.StatusFound)
+	}
+}